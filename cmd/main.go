@@ -1,14 +1,52 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	internal "github.com/thomseddon/traefik-forward-auth/internal"
 )
 
 // Main
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import-users" {
+		if err := importUsers(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "install-service" || os.Args[1] == "uninstall-service") {
+		if err := manageService(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "print-traefik-config" {
+		if err := printTraefikConfig(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Parse options
 	config := internal.NewGlobalConfig()
 
@@ -18,14 +56,181 @@ func main() {
 	// Perform config validation
 	config.Validate()
 
+	// Check the config works, only reporting the result if asked to
+	report := internal.RunSelfTest(config)
+	if config.SelfTest {
+		report.Write(os.Stdout, config.LogFormat == "json")
+		if !report.Passed() {
+			os.Exit(1)
+		}
+		return
+	}
+	report.Log(log)
+
 	// Build server
 	server := internal.NewServer()
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: server.Handler(),
+	}
 
-	// Attach router to default server
-	http.HandleFunc("/", server.RootHandler)
+	// Reload rules and providers on SIGHUP, or when the config files change
+	go server.WatchConfig(os.Args[1:], syscall.SIGHUP)
+
+	// Start background workers
+	server.Start()
 
 	// Start
 	log.WithField("config", config).Debug("Starting with config")
-	log.Infof("Listening on :%d", config.Port)
-	log.Info(http.ListenAndServe(fmt.Sprintf(":%d", config.Port), nil))
+	log.WithField("instance", config.InstanceID).
+		WithField("config_hash", config.Fingerprint()).
+		Infof("Listening on :%d", config.Port)
+	if err := run(srv, log); err != nil {
+		log.Fatal(err)
+	}
+
+	// Finish the logins in progress and stop background workers
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	server.Stop(ctx)
+}
+
+// shutdownTimeout is how long requests in progress are given to finish on
+// shutdown, and then how long background workers are given to stop
+const shutdownTimeout = 10 * time.Second
+
+// listenAndServe serves until one of the signals is received, then stops
+// accepting requests and waits for those in progress. The optional ready hook
+// is called once listening, and stopping once a signal is received
+func listenAndServe(srv *http.Server, ready, stopping func(), signals ...os.Signal) error {
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, signals...)
+		<-c
+		if stopping != nil {
+			stopping()
+		}
+		shutdown(srv)
+		close(done)
+	}()
+
+	if ready != nil {
+		ready()
+	}
+
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// shutdown stops the server, giving requests in progress time to finish
+func shutdown(srv *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// importUsers imports users from a file into the user directory, printing the
+// changes made
+func importUsers(args []string) error {
+	flags := flag.NewFlagSet("import-users", flag.ExitOnError)
+	directory := flags.String("user-directory", os.Getenv("USER_DIRECTORY"), "Path to the user directory")
+	format := flags.String("format", "csv", "Format of the import file, \"csv\" or \"scim\"")
+	replace := flags.Bool("replace", false, "Remove users missing from the import file")
+	dryRun := flags.Bool("dry-run", false, "Show the changes without making them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: traefik-forward-auth import-users [options] <file|->")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *directory == "" {
+		return fmt.Errorf("-user-directory must be set")
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var in io.Reader = os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	imported, err := internal.ParseUserImport(in, *format)
+	if err != nil {
+		return err
+	}
+
+	dir, err := internal.NewUserDirectory(*directory)
+	if err != nil {
+		return err
+	}
+
+	diff, err := dir.Import(imported, *replace, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	internal.WriteImportDiff(os.Stdout, diff)
+	return nil
+}
+
+// migrate applies pending schema migrations to the persistent stores, printing
+// the migrations applied
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	directory := flags.String("user-directory", os.Getenv("USER_DIRECTORY"), "Path to the user directory")
+	cache := flags.String("fallback-cache", os.Getenv("FALLBACK_CACHE"), "Path to the fallback identity cache")
+	secret := flags.String("secret", os.Getenv("SECRET"), "Secret the fallback identity cache is signed with")
+	dryRun := flags.Bool("dry-run", false, "Show the pending migrations without applying them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: traefik-forward-auth migrate [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *cache != "" && *secret == "" {
+		return fmt.Errorf("-secret must be set to migrate the fallback cache")
+	}
+
+	config := &internal.Config{
+		UserDirectory: *directory,
+		FallbackCache: *cache,
+		Secret:        []byte(*secret),
+	}
+	return internal.MigrateStores(config, *dryRun, os.Stdout)
+}
+
+// printTraefikConfig prints the traefik dynamic configuration for the config
+// given after the options, e.g. print-traefik-config -format=docker -- --config=...
+func printTraefikConfig(args []string) error {
+	flags := flag.NewFlagSet("print-traefik-config", flag.ExitOnError)
+	format := flags.String("format", "file", "Format to print, \""+strings.Join(internal.TraefikConfigFormats, "\", \"")+"\"")
+	name := flags.String("name", "traefik-forward-auth", "Name of the middleware, router and service")
+	address := flags.String("address", "", "URL traefik reaches the service at, defaults to http://<name>:<port>")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: traefik-forward-auth print-traefik-config [options] [-- config options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config, err := internal.NewConfig(flags.Args())
+	if err != nil {
+		return err
+	}
+	return internal.NewTraefikConfig(config, *name, *address).Write(os.Stdout, *format)
 }
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	internal "github.com/thomseddon/traefik-forward-auth/internal"
+)
+
+// run serves until the process is terminated, reporting readiness and
+// shutdown to systemd when run as a Type=notify service
+func run(srv *http.Server, log *logrus.Logger) error {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ready := func() {
+		if err := internal.NotifyReady("Listening on " + srv.Addr); err != nil {
+			log.WithField("error", err).Warn("Error notifying systemd")
+		}
+		internal.StartWatchdog(stop)
+	}
+	stopping := func() {
+		log.Info("Shutting down")
+		internal.NotifyStopping()
+	}
+
+	return listenAndServe(srv, ready, stopping, syscall.SIGINT, syscall.SIGTERM)
+}
+
+// manageService installs or uninstalls a Windows service
+func manageService(command string, args []string) error {
+	return fmt.Errorf("%s is only supported on Windows, use the systemd unit in the README instead", command)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "traefik-forward-auth"
+
+// run serves until stopped by the service control manager when run as a
+// Windows service, or until interrupted otherwise
+func run(srv *http.Server, log *logrus.Logger) error {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return err
+	}
+	if interactive {
+		return listenAndServe(srv, nil, nil, os.Interrupt)
+	}
+
+	return svc.Run(serviceName, &windowsService{srv: srv, log: log})
+}
+
+// windowsService reports the server's state to the service control manager
+type windowsService struct {
+	srv *http.Server
+	log *logrus.Logger
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	l, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		s.log.WithField("error", err).Error("Error listening")
+		return true, 1
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.srv.Serve(l)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-errs:
+			s.log.WithField("error", err).Error("Error serving")
+			return true, 2
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s.log.Info("Shutting down")
+				status <- svc.Status{State: svc.StopPending}
+				shutdown(s.srv)
+				return false, 0
+			}
+		}
+	}
+}
+
+// manageService installs or uninstalls the Windows service, arguments given
+// when installing are passed to the service when it starts
+func manageService(command string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if command == "uninstall-service" {
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed", serviceName)
+		}
+		defer s.Close()
+
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		fmt.Printf("Uninstalled service %s\n", serviceName)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Traefik Forward Auth",
+		Description: "Forward authentication service for traefik",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	fmt.Printf("Installed service %s, start it with \"sc start %s\"\n", serviceName, serviceName)
+	return nil
+}
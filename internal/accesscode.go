@@ -0,0 +1,288 @@
+package tfa
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Access codes
+//
+// Clients of non-HTTP services, such as terminals and IMAP bridges, can't
+// follow the login redirect, so with "access-code-lifetime" set a logged in
+// user can exchange their session for a short numeric code at
+// <url-path>/access-code and paste it into the client. The service then
+// checks the email and code at <url-path>/access-code/verify, which accepts
+// each code once.
+//
+// Codes are the signed email, session, time window and a per window counter,
+// truncated to "access-code-digits" digits. Each is stored under a signature of
+// the email and code, with the session it was issued for, in the same store as
+// the rate limits so any instance can verify it. A code is accepted until the
+// end of the window after the one it was issued in, and only while its session
+// is valid. Verification attempts are limited per client and email, so a
+// client can't guess codes, nor lock a user out by using up their attempts
+// from elsewhere. Failures also count towards the client's "lockout-threshold",
+// so codes can't be guessed by spreading attempts across emails
+
+// AccessCodePath is where access codes are issued, under the url-path
+const AccessCodePath = "/access-code"
+
+// AccessCodeVerifyPath is where access codes are verified, under the url-path
+const AccessCodeVerifyPath = "/access-code/verify"
+
+// maxAccessCodes is how many codes a user can be issued per window, which
+// bounds the work of verifying a code
+const maxAccessCodes = 10
+
+// maxAccessCodeAttempts is how many codes a client can check for an email per
+// window, enough to verify every code issued in this window and the last
+const maxAccessCodeAttempts = 3 * maxAccessCodes
+
+// AccessCodeHandler issues an access code to the logged in user
+func (s *Server) AccessCodeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(config().CookieName)
+		if err != nil {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		user, err := ValidateCookie(r, c)
+		if err != nil {
+			log.WithField("error", err).Debug("Invalid cookie for access code")
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		code, expires, err := issueAccessCode(user)
+		if errors.Is(err, errTooManyAccessCodes) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(expires)/time.Second)+1))
+			http.Error(w, "Too many access codes", 429)
+			return
+		} else if err != nil {
+			log.WithField("error", err).Error("Error issuing access code")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		log.WithField("user", user.Email).Debug("Issued access code")
+		auditEvent("access_code_issued", "", auditRequestFields(r, logrus.Fields{
+			"user": user.Email,
+		}))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Email   string    `json:"email"`
+			Code    string    `json:"code"`
+			Expires time.Time `json:"expires"`
+		}{user.Email, code, expires.UTC().Truncate(time.Second)})
+	}
+}
+
+// AccessCodeVerifyHandler checks an email and access code, passed with basic
+// auth or as the "user" and "code" form values, responding with the user's
+// identity if the code is valid and they're permitted by the rule in the
+// "rule" form value, or the default rule
+func (s *Server) AccessCodeVerifyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email, code, ok := r.BasicAuth()
+		if !ok {
+			email, code = r.FormValue("user"), r.FormValue("code")
+		}
+
+		rule := r.FormValue("rule")
+		if rule == "" {
+			rule = "default"
+		} else if _, ok := config().Rules[rule]; !ok {
+			http.Error(w, "Unknown rule", 400)
+			return
+		}
+
+		logger := log.WithFields(logrus.Fields{
+			"user": email,
+			"rule": rule,
+		})
+
+		user, err := verifyAccessCode(originalClientIP(r), email, code)
+		if errors.Is(err, errTooManyAccessCodeAttempts) {
+			logger.Warn("Too many access code attempts")
+			recordLoginFailure(r)
+			auditLoginFailure(r, "access-code", email, "too_many_attempts")
+			next := time.Unix(0, (accessCodeWindow(time.Now())+1)*int64(config().AccessCodeLifetime))
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(next)/time.Second)+1))
+			http.Error(w, "Too many attempts", 429)
+			return
+		} else if err != nil {
+			logger.WithField("error", err).Warn("Invalid access code")
+			recordLoginFailure(r)
+			auditLoginFailure(r, "access-code", email, "invalid_code")
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		user = withRoleGrants(user)
+		if !ValidateUser(user, rule) {
+			logger.Info("Access code user not permitted by rule")
+			auditLoginFailure(r, "access-code", user.Email, "denied")
+			http.Error(w, "Not authorized", 403)
+			return
+		}
+
+		logger.Debug("Verified access code")
+		auditEvent("access_code_verified", "", auditRequestFields(r, logrus.Fields{
+			"user": user.Email,
+			"rule": rule,
+		}))
+
+		setIdentityHeaders(w, user, rule)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Email string   `json:"email"`
+			Name  string   `json:"name"`
+			Roles []string `json:"roles"`
+		}{user.Email, user.Name, user.Roles})
+	}
+}
+
+var (
+	errTooManyAccessCodes        = errors.New("too many access codes issued")
+	errTooManyAccessCodeAttempts = errors.New("too many access code attempts")
+)
+
+// issueAccessCode returns a new code for the user's session, and when it
+// stops being accepted
+func issueAccessCode(user *provider.User) (string, time.Time, error) {
+	email := normalizeEmail(user.Email)
+	window := accessCodeWindow(time.Now())
+	expires := time.Unix(0, (window+2)*int64(config().AccessCodeLifetime))
+
+	n, err := counters.Incr(accessCodeKey("issued", email, window), 2*config().AccessCodeLifetime)
+	if err != nil {
+		return "", expires, err
+	}
+	if n > maxAccessCodes {
+		return "", time.Unix(0, (window+1)*int64(config().AccessCodeLifetime)), errTooManyAccessCodes
+	}
+
+	code, err := accessCode(user, email, window, n)
+	if err != nil {
+		return "", expires, err
+	}
+	key, err := accessCodeLookupKey("code", email, code)
+	if err != nil {
+		return "", expires, err
+	}
+	err = counters.Set(key, user.UUID.String(), time.Until(expires))
+	return code, expires, err
+}
+
+// verifyAccessCode checks the code was issued to the email and hasn't expired
+// or been used, returning the user whose session it was issued for. Attempts
+// are counted for the client checking the code
+func verifyAccessCode(client, email, code string) (*provider.User, error) {
+	email = normalizeEmail(email)
+	if email == "" || len(code) != config().AccessCodeDigits {
+		return nil, errors.New("Invalid access code format")
+	}
+
+	attempts, err := counters.Incr(accessCodeKey("attempts", client+"|"+email, accessCodeWindow(time.Now())), config().AccessCodeLifetime)
+	if err != nil {
+		return nil, err
+	}
+	if attempts > maxAccessCodeAttempts {
+		return nil, errTooManyAccessCodeAttempts
+	}
+
+	key, err := accessCodeLookupKey("code", email, code)
+	if err != nil {
+		return nil, err
+	}
+	session, err := counters.Value(key)
+	if err != nil {
+		return nil, err
+	}
+	if session == "" {
+		return nil, errors.New("Access code is unknown or has expired")
+	}
+	id, err := uuid.Parse(session)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := sessions.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.User == nil || normalizeEmail(entry.User.Email) != email {
+		return nil, errors.New("Access code's session has ended")
+	}
+
+	key, err = accessCodeLookupKey("used", email, code)
+	if err != nil {
+		return nil, err
+	}
+	uses, err := counters.Incr(key, 2*config().AccessCodeLifetime)
+	if err != nil {
+		return nil, err
+	}
+	if uses > 1 {
+		return nil, errors.New("Access code has already been used")
+	}
+	return entry.User, nil
+}
+
+// accessCode derives the n-th code of the window for the user's session
+func accessCode(user *provider.User, email string, window, n int64) (string, error) {
+	data := strings.Join([]string{
+		"access-code",
+		email,
+		user.UUID.String(),
+		strconv.FormatInt(window, 10),
+		strconv.FormatInt(n, 10),
+	}, "|")
+	mac, err := activeSigner().MAC([]byte(data))
+	if err != nil {
+		return "", err
+	}
+
+	modulus := uint64(1)
+	for i := 0; i < config().AccessCodeDigits; i++ {
+		modulus *= 10
+	}
+	value := binary.BigEndian.Uint64(mac[:8]) % modulus
+	return fmt.Sprintf("%0*d", config().AccessCodeDigits, value), nil
+}
+
+// accessCodeWindow returns the number of the "access-code-lifetime" long
+// window the time falls in
+func accessCodeWindow(t time.Time) int64 {
+	return t.UnixNano() / int64(config().AccessCodeLifetime)
+}
+
+func accessCodeKey(kind, subject string, window int64) string {
+	return "access-code:" + kind + ":" + subject + ":" + strconv.FormatInt(window, 10)
+}
+
+// accessCodeLookupKey identifies a code by a signature of the email and code,
+// so codes aren't kept in the store and can't be found from it by trying every
+// code
+func accessCodeLookupKey(kind, email, code string) (string, error) {
+	mac, err := activeSigner().MAC([]byte("access-code-lookup|" + email + "|" + code))
+	if err != nil {
+		return "", err
+	}
+	return "access-code:" + kind + ":" + hex.EncodeToString(mac), nil
+}
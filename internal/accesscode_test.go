@@ -0,0 +1,197 @@
+package tfa
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestServerAccessCode(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AccessCodeLifetime = time.Minute
+	counters = NewMemoryCounterStore()
+	h := NewServer().Handler()
+	user := newTestUser("code@example.com")
+
+	// Should require a cookie
+	req := httptest.NewRequest("GET", "http://example.com/_oauth/access-code", nil)
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should issue a code to the logged in user
+	c, _ := MakeCookie(req, user)
+	req.AddCookie(c)
+	res := serveRouter(h, req)
+	require.Equal(200, res.Code)
+	assert.Equal("no-store", res.Header().Get("Cache-Control"))
+	var issued struct {
+		Email   string
+		Code    string
+		Expires time.Time
+	}
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &issued))
+	assert.Equal("code@example.com", issued.Email)
+	assert.Regexp(`^[0-9]{8}$`, issued.Code)
+	assert.True(issued.Expires.After(time.Now().Add(time.Minute - time.Second)))
+
+	// Should refuse the wrong code
+	verify := httptest.NewRequest("POST", "http://example.com/_oauth/access-code/verify", nil)
+	verify.SetBasicAuth("code@example.com", "00000000")
+	if issued.Code == "00000000" {
+		verify.SetBasicAuth("code@example.com", "11111111")
+	}
+	assert.Equal(401, serveRouter(h, verify).Code)
+
+	// Should verify the code with basic auth
+	verify = httptest.NewRequest("POST", "http://example.com/_oauth/access-code/verify", nil)
+	verify.SetBasicAuth("Code@Example.com", issued.Code)
+	res = serveRouter(h, verify)
+	require.Equal(200, res.Code)
+	assert.Equal("code@example.com", res.Header().Get("X-Forwarded-User"))
+	assert.Contains(res.Body.String(), `"email":"code@example.com"`)
+
+	// Should only accept the code once
+	assert.Equal(401, serveRouter(h, verify).Code)
+
+	// Should verify codes passed as form values
+	res = serveRouter(h, req)
+	require.Equal(200, res.Code)
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &issued))
+	form := url.Values{"user": {"code@example.com"}, "code": {issued.Code}}
+	verify = httptest.NewRequest("POST", "http://example.com/_oauth/access-code/verify", strings.NewReader(form.Encode()))
+	verify.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.Equal(200, serveRouter(h, verify).Code)
+}
+
+func TestServerAccessCodeSession(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AccessCodeLifetime = time.Minute
+	counters = NewMemoryCounterStore()
+	user := newTestUser("code-session@example.com")
+
+	// Should refuse codes once the session has ended
+	code, _, err := issueAccessCode(user)
+	require.Nil(err)
+	require.Nil(sessions.Delete(user.UUID))
+	_, err = verifyAccessCode("192.0.2.1", user.Email, code)
+	assert.NotNil(err)
+
+	// Should refuse codes for another user
+	other := newTestUser("other-session@example.com")
+	code, _, err = issueAccessCode(other)
+	require.Nil(err)
+	_, err = verifyAccessCode("192.0.2.1", user.Email, code)
+	assert.NotNil(err)
+	verified, err := verifyAccessCode("192.0.2.1", other.Email, code)
+	require.Nil(err)
+	assert.Equal(other.Email, verified.Email)
+}
+
+func TestServerAccessCodeRule(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AccessCodeLifetime = time.Minute
+	config().Rules = map[string]*Rule{
+		"imap": {Action: "auth", Rule: "Host(`imap.example.com`)", Whitelist: CommaSeparatedList{"someone@example.com"}},
+	}
+	counters = NewMemoryCounterStore()
+	h := NewServer().Handler()
+	user := newTestUser("code-rule@example.com")
+
+	code, _, err := issueAccessCode(user)
+	require.Nil(err)
+
+	// Should refuse unknown rules
+	verify := httptest.NewRequest("POST", "http://example.com/_oauth/access-code/verify?rule=nope", nil)
+	verify.SetBasicAuth(user.Email, code)
+	assert.Equal(400, serveRouter(h, verify).Code)
+
+	// Should refuse users the rule doesn't permit
+	verify = httptest.NewRequest("POST", "http://example.com/_oauth/access-code/verify?rule=imap", nil)
+	verify.SetBasicAuth(user.Email, code)
+	assert.Equal(403, serveRouter(h, verify).Code)
+}
+
+func TestServerAccessCodeAttempts(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AccessCodeLifetime = time.Hour
+	counters = NewMemoryCounterStore()
+	h := NewServer().Handler()
+	user := newTestUser("code-attempts@example.com")
+
+	code, _, err := issueAccessCode(user)
+	require.Nil(err)
+
+	// Should only store a signature of the code
+	for key := range counters.(*MemoryCounterStore).counts {
+		assert.NotContains(key, code)
+	}
+	sum := sha256.Sum256([]byte(normalizeEmail(user.Email) + "|" + code))
+	assert.NotContains(counters.(*MemoryCounterStore).counts, "access-code:code:"+hex.EncodeToString(sum[:]), "should not be found by hashing every code")
+
+	// Should limit attempts per client and email
+	wrong := "00000000"
+	if code == wrong {
+		wrong = "11111111"
+	}
+	for i := 0; i < maxAccessCodeAttempts; i++ {
+		_, err = verifyAccessCode("10.0.0.9", user.Email, wrong)
+		assert.NotEqual(errTooManyAccessCodeAttempts, err)
+	}
+	verify := httptest.NewRequest("POST", "http://example.com/_oauth/access-code/verify", nil)
+	verify.Header.Set("X-Forwarded-For", "10.0.0.9")
+	verify.SetBasicAuth(user.Email, code)
+	res := serveRouter(h, verify)
+	assert.Equal(429, res.Code)
+	assert.NotEmpty(res.Header().Get("Retry-After"))
+
+	// Should not lock the user out of other clients
+	verify = httptest.NewRequest("POST", "http://example.com/_oauth/access-code/verify", nil)
+	verify.Header.Set("X-Forwarded-For", "10.0.0.10")
+	verify.SetBasicAuth(user.Email, code)
+	assert.Equal(200, serveRouter(h, verify).Code)
+
+	// Should still allow other emails
+	other := newTestUser("code-attempts-other@example.com")
+	code, _, err = issueAccessCode(other)
+	require.Nil(err)
+	_, err = verifyAccessCode("10.0.0.9", other.Email, code)
+	assert.Nil(err)
+}
+
+func TestIssueAccessCodeLimit(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().AccessCodeLifetime = time.Hour
+	counters = NewMemoryCounterStore()
+	user := newTestUser("code-limit@example.com")
+
+	// Should refuse to issue too many codes per window
+	codes := map[string]bool{}
+	for i := 0; i < maxAccessCodes; i++ {
+		code, _, err := issueAccessCode(user)
+		assert.Nil(err)
+		codes[code] = true
+	}
+	assert.Len(codes, maxAccessCodes)
+	_, _, err := issueAccessCode(user)
+	assert.Equal(errTooManyAccessCodes, err)
+}
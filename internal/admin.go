@@ -0,0 +1,426 @@
+package tfa
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Admin endpoints
+
+// adminPermission is what a caller of the admin API may do
+type adminPermission int
+
+const (
+	// adminView permits listing sessions and users
+	adminView adminPermission = iota
+	// adminManage permits revoking sessions and importing users, as well as
+	// everything adminView does
+	adminManage
+)
+
+func (p adminPermission) String() string {
+	if p == adminManage {
+		return "manage"
+	}
+	return "view"
+}
+
+// adminUser returns the user logged in with the auth cookie, with the roles
+// currently granted to them
+func adminUser(r *http.Request) (*provider.User, error) {
+	c, err := r.Cookie(config().CookieName)
+	if err != nil {
+		return nil, err
+	}
+	user, err := ValidateCookie(r, c)
+	if err != nil {
+		return nil, err
+	}
+	return withRoleGrants(user), nil
+}
+
+// hasAdminPermission reports whether the user has a role granting the
+// permission: any "admin-role" grants every permission, "admin-viewer-role"
+// only adminView
+func hasAdminPermission(user *provider.User, permission adminPermission) bool {
+	for _, role := range user.Roles {
+		if containsString(config().AdminRoles, role) {
+			return true
+		}
+		if permission == adminView && containsString(config().AdminViewerRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether the request didn't come from another site.
+// Browsers send the Origin header with cross site requests, other clients
+// don't send it at all
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+type adminSession struct {
+	UUID    string    `json:"uuid"`
+	Email   string    `json:"email"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// AdminSessionsHandler lists the active sessions
+func (s *Server) AdminSessionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := sessions.All()
+		if err != nil {
+			log.WithField("error", err).Error("Error listing sessions")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		list := []adminSession{}
+		for _, entry := range entries {
+			list = append(list, adminSession{
+				UUID:    entry.User.UUID.String(),
+				Email:   entry.User.Email,
+				AddedAt: entry.AddedAt,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// AdminRevokeSessionHandler revokes a session, the user will have to log in
+// again on their next request
+func (s *Server) AdminRevokeSessionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid session id", 400)
+			return
+		}
+
+		entry, err := sessions.Get(id)
+		if err == nil && entry != nil {
+			err = terminateSession(id, "admin_revoked", logrus.Fields{
+				"user":      entry.User.Email,
+				"source_ip": originalClientIP(r),
+			})
+		}
+		if err != nil {
+			log.WithField("error", err).Error("Error revoking session")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+		if entry == nil {
+			http.Error(w, "Session not found", 404)
+			return
+		}
+
+		log.WithFields(logrus.Fields{
+			"user":    entry.User.Email,
+			"session": id,
+		}).Info("Revoked session")
+		w.WriteHeader(204)
+	}
+}
+
+// AdminRevokeUserSessionsHandler revokes every session of the user with the
+// email given in the query, to log a compromised account out everywhere
+func (s *Server) AdminRevokeUserSessionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := normalizeEmail(r.URL.Query().Get("email"))
+		if email == "" {
+			http.Error(w, "Missing email", 400)
+			return
+		}
+
+		entries, err := sessions.ByEmail(email)
+		if err != nil {
+			log.WithField("error", err).Error("Error listing sessions")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		revoked := 0
+		for _, entry := range entries {
+			terminateSession(entry.User.UUID, "admin_revoked", logrus.Fields{
+				"user":      entry.User.Email,
+				"source_ip": originalClientIP(r),
+			})
+			revoked++
+		}
+		if revoked == 0 {
+			http.Error(w, "Session not found", 404)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Revoked int `json:"revoked"`
+		}{revoked})
+	}
+}
+
+// AdminUsersHandler lists the users in the directory
+func (s *Server) AdminUsersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(userDirectory.Users())
+	}
+}
+
+// maxImportSize limits the size of an import request body
+const maxImportSize = 10 << 20
+
+// AdminImportUsersHandler imports users into the directory from the request
+// body, see ParseUserImport for the supported formats. The "format" query
+// parameter defaults to csv, "replace=true" removes users missing from the
+// import and "dry_run=true" only reports the changes that would be made
+func (s *Server) AdminImportUsersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		format := q.Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		replace, _ := strconv.ParseBool(q.Get("replace"))
+		dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+
+		imported, err := ParseUserImport(http.MaxBytesReader(w, r.Body, maxImportSize), format)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		diff, err := userDirectory.Import(imported, replace, dryRun)
+		if err != nil {
+			log.WithField("error", err).Error("Error importing users")
+			http.Error(w, "Error saving user directory", 500)
+			return
+		}
+
+		log.WithFields(logrus.Fields{
+			"added":   len(diff.Added),
+			"updated": len(diff.Updated),
+			"removed": len(diff.Removed),
+			"dry_run": dryRun,
+		}).Info("Imported users")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diff)
+	}
+}
+
+// AdminTagsHandler lists the tagged users
+func (s *Server) AdminTagsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(userTags.Users())
+	}
+}
+
+// maxAdminBodySize limits the size of the JSON body of admin requests
+const maxAdminBodySize = 64 << 10
+
+// AdminSetTagsHandler replaces the tags and note attached to the user with the
+// email given in the query, from a JSON body with "tags", "note" and an
+// optional RFC 3339 "expires" time
+func (s *Server) AdminSetTagsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := normalizeEmail(r.URL.Query().Get("email"))
+		if email == "" {
+			http.Error(w, "Missing email", 400)
+			return
+		}
+
+		var body struct {
+			Tags    []string   `json:"tags"`
+			Note    string     `json:"note"`
+			Expires *time.Time `json:"expires"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBodySize)).Decode(&body); err != nil {
+			http.Error(w, "Invalid tags: "+err.Error(), 400)
+			return
+		}
+		tags := &UserTags{
+			Tags:      body.Tags,
+			Note:      body.Note,
+			Expires:   body.Expires,
+			UpdatedAt: time.Now().UTC(),
+			UpdatedBy: adminCaller(r),
+		}
+
+		if err := userTags.Set(email, tags); err != nil {
+			log.WithField("error", err).Error("Error saving user tags")
+			http.Error(w, "Error saving user tags", 500)
+			return
+		}
+
+		auditEvent("user_tagged", "", auditRequestFields(r, logrus.Fields{
+			"user":  email,
+			"admin": tags.UpdatedBy,
+		}))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TaggedUser{Email: email, UserTags: *tags})
+	}
+}
+
+// AdminDeleteTagsHandler removes the tags and note attached to the user with
+// the email given in the query
+func (s *Server) AdminDeleteTagsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := normalizeEmail(r.URL.Query().Get("email"))
+		if email == "" {
+			http.Error(w, "Missing email", 400)
+			return
+		}
+
+		deleted, err := userTags.Delete(email)
+		if err != nil {
+			log.WithField("error", err).Error("Error saving user tags")
+			http.Error(w, "Error saving user tags", 500)
+			return
+		}
+		if !deleted {
+			http.Error(w, "User not tagged", 404)
+			return
+		}
+
+		auditEvent("user_untagged", "", auditRequestFields(r, logrus.Fields{
+			"user":  email,
+			"admin": adminCaller(r),
+		}))
+		w.WriteHeader(204)
+	}
+}
+
+// adminCaller describes who made an admin request, the logged in user or the
+// admin token
+func adminCaller(r *http.Request) string {
+	if r.Header.Get("Authorization") != "" {
+		return "admin-token"
+	}
+	if user, err := adminUser(r); err == nil {
+		return user.Email
+	}
+	return ""
+}
+
+// AdminGrantsHandler lists the role grants that haven't expired
+func (s *Server) AdminGrantsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roleGrants.Grants())
+	}
+}
+
+// AdminGrantRoleHandler grants a role to a user until a time, from a JSON body
+// with the "email", "role", "reason" and either an RFC 3339 "until" time or a
+// "duration" such as "2h"
+func (s *Server) AdminGrantRoleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Email    string    `json:"email"`
+			Role     string    `json:"role"`
+			Reason   string    `json:"reason"`
+			Until    time.Time `json:"until"`
+			Duration string    `json:"duration"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBodySize)).Decode(&body); err != nil {
+			http.Error(w, "Invalid grant: "+err.Error(), 400)
+			return
+		}
+		email := normalizeEmail(body.Email)
+		if email == "" || body.Role == "" {
+			http.Error(w, "Missing email or role", 400)
+			return
+		}
+
+		now := time.Now().UTC()
+		until := body.Until
+		if body.Duration != "" {
+			duration, err := time.ParseDuration(body.Duration)
+			if err != nil || !until.IsZero() {
+				http.Error(w, "Invalid grant: set either a duration or until", 400)
+				return
+			}
+			until = now.Add(duration)
+		}
+		if !until.After(now) {
+			http.Error(w, "Invalid grant: must be until a time in the future", 400)
+			return
+		}
+
+		grant := &RoleGrant{
+			Role:      body.Role,
+			Until:     until.UTC(),
+			Reason:    body.Reason,
+			GrantedAt: now,
+			GrantedBy: adminCaller(r),
+		}
+		if err := roleGrants.Grant(email, grant); err != nil {
+			log.WithField("error", err).Error("Error saving role grants")
+			http.Error(w, "Error saving role grants", 500)
+			return
+		}
+
+		auditEvent("role_granted", body.Reason, auditRequestFields(r, logrus.Fields{
+			"user":  email,
+			"role":  grant.Role,
+			"until": grant.Until.Format(time.RFC3339),
+			"admin": grant.GrantedBy,
+		}))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(UserGrant{Email: email, RoleGrant: *grant})
+	}
+}
+
+// AdminRevokeGrantHandler revokes the grant of the role given in the query to
+// the user with the email given in the query, before it expires
+func (s *Server) AdminRevokeGrantHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		email := normalizeEmail(q.Get("email"))
+		role := q.Get("role")
+		if email == "" || role == "" {
+			http.Error(w, "Missing email or role", 400)
+			return
+		}
+
+		revoked, err := roleGrants.Revoke(email, role)
+		if err != nil {
+			log.WithField("error", err).Error("Error saving role grants")
+			http.Error(w, "Error saving role grants", 500)
+			return
+		}
+		if !revoked {
+			http.Error(w, "Grant not found", 404)
+			return
+		}
+
+		auditEvent("role_grant_revoked", "", auditRequestFields(r, logrus.Fields{
+			"user":  email,
+			"role":  role,
+			"admin": adminCaller(r),
+		}))
+		w.WriteHeader(204)
+	}
+}
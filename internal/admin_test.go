@@ -0,0 +1,347 @@
+package tfa
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestAdminSessions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminToken = "admintoken"
+	h := NewServer().Handler()
+	user := newTestUser("admin-test@example.com")
+
+	// Should require the token
+	req := httptest.NewRequest("GET", "/admin/sessions", nil)
+	assert.Equal(401, serveRouter(h, req).Code)
+	req.Header.Set("Authorization", "Bearer wrong")
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should list sessions
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res := serveRouter(h, req)
+	require.Equal(200, res.Code)
+	var list []adminSession
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &list))
+	emails := map[string]string{}
+	for _, session := range list {
+		emails[session.UUID] = session.Email
+	}
+	assert.Equal("admin-test@example.com", emails[user.UUID.String()])
+
+	// Should revoke sessions
+	cache, err := NewIdentityCache(filepath.Join(t.TempDir(), "identities.json"), config().Secret, time.Hour)
+	require.Nil(err)
+	fallbackCache = cache
+	defer func() { fallbackCache = nil }()
+	fallbackCache.Record(user)
+	revoked := sessionsRevokedTotal.Value("admin_revoked")
+	req = httptest.NewRequest("DELETE", "/admin/sessions/"+user.UUID.String(), nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(204, serveRouter(h, req).Code)
+	entry, _ := sessions.Get(user.UUID)
+	assert.Nil(entry)
+	assert.Equal(revoked+1, sessionsRevokedTotal.Value("admin_revoked"))
+
+	// Should forget the revoked session in the fallback cache
+	_, ok := fallbackCache.Lookup(user.UUID)
+	assert.False(ok)
+
+	// Should 404 unknown sessions
+	assert.Equal(404, serveRouter(h, req).Code)
+
+	// Should reject invalid ids
+	req = httptest.NewRequest("DELETE", "/admin/sessions/nope", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(400, serveRouter(h, req).Code)
+}
+
+func TestAdminRevokeUserSessions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminToken = "admintoken"
+	h := NewServer().Handler()
+	first := newTestUser("revoke-test@example.com")
+	second := newTestUser("Revoke-Test@example.com")
+	other := newTestUser("revoke-other@example.com")
+
+	// Should revoke every session of the user
+	req := httptest.NewRequest("DELETE", "/admin/sessions?email=revoke-test@EXAMPLE.com", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res := serveRouter(h, req)
+	require.Equal(200, res.Code)
+	assert.JSONEq(`{"revoked": 2}`, res.Body.String())
+	for _, id := range []uuid.UUID{first.UUID, second.UUID} {
+		entry, _ := sessions.Get(id)
+		assert.Nil(entry)
+	}
+	entry, _ := sessions.Get(other.UUID)
+	assert.NotNil(entry, "other users should stay logged in")
+
+	// Should 404 users without sessions
+	assert.Equal(404, serveRouter(h, req).Code)
+
+	// Should require an email
+	req = httptest.NewRequest("DELETE", "/admin/sessions", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(400, serveRouter(h, req).Code)
+
+	// Should require the manage permission
+	config().AdminViewerRoles = CommaSeparatedList{"viewer"}
+	viewer := newTestUser("viewer@example.com")
+	viewer.Roles = []string{"viewer"}
+	req = httptest.NewRequest("DELETE", "/admin/sessions?email=revoke-other@example.com", nil)
+	c, _ := MakeCookie(req, viewer)
+	req.AddCookie(c)
+	assert.Equal(403, serveRouter(h, req).Code)
+}
+
+func TestAdminRoles(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminRoles = CommaSeparatedList{"forwardauth:admin"}
+	config().AdminViewerRoles = CommaSeparatedList{"forwardauth:viewer"}
+	h := NewServer().Handler()
+
+	newAdminRequest := func(method, target string, roles ...string) *http.Request {
+		user := newTestUser("admin-test@example.com")
+		user.Roles = roles
+		req := httptest.NewRequest(method, target, nil)
+		c, err := MakeCookie(req, user)
+		require.Nil(err)
+		req.AddCookie(c)
+		return req
+	}
+	target := newTestUser("target@example.com")
+	revoke := "/admin/sessions/" + target.UUID.String()
+
+	// Should require a cookie or token, a token isn't configured
+	assert.Equal(401, serveRouter(h, httptest.NewRequest("GET", "/admin/sessions", nil)).Code)
+	req := httptest.NewRequest("GET", "/admin/sessions", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	assert.Equal(401, serveRouter(h, req).Code, "empty token should not be accepted")
+
+	// Should require a role
+	assert.Equal(403, serveRouter(h, newAdminRequest("GET", "/admin/sessions", "other")).Code)
+
+	// Viewers should only be able to list
+	assert.Equal(200, serveRouter(h, newAdminRequest("GET", "/admin/sessions", "forwardauth:viewer")).Code)
+	assert.Equal(403, serveRouter(h, newAdminRequest("DELETE", revoke, "forwardauth:viewer")).Code)
+
+	// Admins should be able to manage
+	assert.Equal(200, serveRouter(h, newAdminRequest("GET", "/admin/sessions", "forwardauth:admin")).Code)
+
+	// Should refuse cross site requests
+	req = newAdminRequest("DELETE", revoke, "forwardauth:admin")
+	req.Header.Set("Origin", "https://evil.example.org")
+	assert.Equal(403, serveRouter(h, req).Code)
+	entry, _ := sessions.Get(target.UUID)
+	assert.NotNil(entry)
+
+	req = newAdminRequest("DELETE", revoke, "forwardauth:admin")
+	req.Header.Set("Origin", "https://example.com")
+	assert.Equal(204, serveRouter(h, req).Code)
+	entry, _ = sessions.Get(target.UUID)
+	assert.Nil(entry)
+}
+
+func TestAdminDisabled(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	h := NewServer().Handler()
+
+	// Should not serve the admin endpoints without a token or roles
+	req := httptest.NewRequest("GET", "/admin/sessions", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	assert.Equal(404, serveRouter(h, req).Code)
+}
+
+func TestAdminImportUsers(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminToken = "admintoken"
+	config().UserDirectory = filepath.Join(t.TempDir(), "users.json")
+	directory, err := NewUserDirectory(config().UserDirectory)
+	require.Nil(err)
+	userDirectory = directory
+	defer func() { userDirectory = nil }()
+	h := NewServer().Handler()
+
+	body := "email,roles\none@example.com,admin\n"
+
+	// Should require the token
+	req := httptest.NewRequest("POST", "/admin/users/import", strings.NewReader(body))
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should report changes on a dry run
+	req = httptest.NewRequest("POST", "/admin/users/import?dry_run=true", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res := serveRouter(h, req)
+	require.Equal(200, res.Code)
+	var diff ImportDiff
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &diff))
+	assert.True(diff.DryRun)
+	assert.Equal([]ImportedUser{{Email: "one@example.com", Roles: []string{"admin"}}}, diff.Added)
+	assert.Empty(directory.Users())
+
+	// Should import
+	req = httptest.NewRequest("POST", "/admin/users/import", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	require.Equal(200, serveRouter(h, req).Code)
+
+	// Should list users
+	req = httptest.NewRequest("GET", "/admin/users", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res = serveRouter(h, req)
+	require.Equal(200, res.Code)
+	var users []ImportedUser
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &users))
+	assert.Equal([]ImportedUser{{Email: "one@example.com", Roles: []string{"admin"}}}, users)
+
+	// Should reject invalid imports
+	req = httptest.NewRequest("POST", "/admin/users/import?format=scim", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(400, serveRouter(h, req).Code)
+}
+
+func TestAdminTags(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminToken = "admintoken"
+	config().UserTags = filepath.Join(t.TempDir(), "tags.json")
+	tags, err := NewTagStore(config().UserTags)
+	require.Nil(err)
+	userTags = tags
+	defer func() { userTags = nil }()
+	h := NewServer().Handler()
+
+	body := `{"tags": ["contractor"], "note": "contract ends 2025-09-01", "expires": "2025-09-01T00:00:00Z"}`
+
+	// Should require the token
+	req := httptest.NewRequest("PUT", "/admin/tags?email=one@example.com", strings.NewReader(body))
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should tag the user
+	req = httptest.NewRequest("PUT", "/admin/tags?email=One@example.com", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res := serveRouter(h, req)
+	require.Equal(200, res.Code)
+	var tagged TaggedUser
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &tagged))
+	assert.Equal("one@example.com", tagged.Email)
+	assert.Equal([]string{"contractor"}, tagged.Tags)
+	assert.Equal("admin-token", tagged.UpdatedBy)
+	if assert.NotNil(tagged.Expires) {
+		assert.Equal(time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC), tagged.Expires.UTC())
+	}
+
+	// Should list tagged users
+	req = httptest.NewRequest("GET", "/admin/tags", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res = serveRouter(h, req)
+	require.Equal(200, res.Code)
+	var users []TaggedUser
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &users))
+	require.Len(users, 1)
+	assert.Equal("contract ends 2025-09-01", users[0].Note)
+
+	// Should reject invalid requests
+	req = httptest.NewRequest("PUT", "/admin/tags", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(400, serveRouter(h, req).Code)
+	req = httptest.NewRequest("PUT", "/admin/tags?email=one@example.com", strings.NewReader("contractor"))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(400, serveRouter(h, req).Code)
+
+	// Should remove the tags
+	req = httptest.NewRequest("DELETE", "/admin/tags?email=one@example.com", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(204, serveRouter(h, req).Code)
+	req = httptest.NewRequest("DELETE", "/admin/tags?email=one@example.com", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(404, serveRouter(h, req).Code)
+	assert.Empty(tags.Users())
+}
+
+func TestAdminGrants(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminToken = "admintoken"
+	config().RoleGrants = filepath.Join(t.TempDir(), "grants.json")
+	grants, err := NewGrantStore(config().RoleGrants)
+	require.Nil(err)
+	roleGrants = grants
+	defer func() { roleGrants = nil }()
+	h := NewServer().Handler()
+
+	body := `{"email": "One@example.com", "role": "admin", "duration": "2h", "reason": "incident 42"}`
+
+	// Should require the token
+	req := httptest.NewRequest("POST", "/admin/grants", strings.NewReader(body))
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should grant the role
+	req = httptest.NewRequest("POST", "/admin/grants", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res := serveRouter(h, req)
+	require.Equal(201, res.Code)
+	var granted UserGrant
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &granted))
+	assert.Equal("one@example.com", granted.Email)
+	assert.Equal("incident 42", granted.Reason)
+	assert.Equal("admin-token", granted.GrantedBy)
+	assert.WithinDuration(time.Now().Add(2*time.Hour), granted.Until, 5*time.Second)
+	assert.Equal([]string{"admin"}, grants.Roles("one@example.com"))
+
+	// Should list grants
+	req = httptest.NewRequest("GET", "/admin/grants", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res = serveRouter(h, req)
+	require.Equal(200, res.Code)
+	var list []UserGrant
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &list))
+	require.Len(list, 1)
+	assert.Equal("admin", list[0].Role)
+
+	// Should reject invalid grants
+	for _, invalid := range []string{
+		`{"email": "one@example.com", "duration": "2h"}`,
+		`{"email": "one@example.com", "role": "admin"}`,
+		`{"email": "one@example.com", "role": "admin", "until": "2000-01-01T00:00:00Z"}`,
+		`{"email": "one@example.com", "role": "admin", "duration": "soon"}`,
+		`{"email": "one@example.com", "role": "admin", "duration": "2h", "until": "2999-01-01T00:00:00Z"}`,
+	} {
+		req = httptest.NewRequest("POST", "/admin/grants", strings.NewReader(invalid))
+		req.Header.Set("Authorization", "Bearer admintoken")
+		assert.Equal(400, serveRouter(h, req).Code, invalid)
+	}
+
+	// Should revoke the grant
+	req = httptest.NewRequest("DELETE", "/admin/grants?email=one@example.com&role=admin", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(204, serveRouter(h, req).Code)
+	req = httptest.NewRequest("DELETE", "/admin/grants?email=one@example.com&role=admin", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(404, serveRouter(h, req).Code)
+	assert.Empty(grants.Roles("one@example.com"))
+}
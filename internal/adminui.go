@@ -0,0 +1,194 @@
+package tfa
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Admin UI
+//
+// A small web UI for the admin endpoints is embedded in the binary and served
+// at /admin/ui/: a sessions table, a rule simulator, a tail of recent logs and
+// the config with secrets left out. The pages themselves hold no data, each
+// view calls the admin API with the auth cookie or the "admin-token"
+
+//go:embed adminui
+var adminUIFiles embed.FS
+
+// AdminUIHandler serves the embedded admin UI
+func (s *Server) AdminUIHandler() http.Handler {
+	files, err := fs.Sub(adminUIFiles, "adminui")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileServer := http.StripPrefix("/admin/ui/", http.FileServer(http.FS(files)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// AdminConfigHandler returns the config, options holding secrets are never
+// serialized
+func (s *Server) AdminConfigHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, config().String())
+	}
+}
+
+type adminSimulation struct {
+	Rule      string   `json:"rule"`
+	Action    string   `json:"action"`
+	Providers []string `json:"providers,omitempty"`
+	Allowed   *bool    `json:"allowed,omitempty"`
+}
+
+// AdminSimulateHandler reports which rule a URL falls under and, given an
+// email and roles, whether that user would be permitted
+func (s *Server) AdminSimulateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		target := q.Get("url")
+		if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+			http.Error(w, "url must be an absolute http(s) URL", 400)
+			return
+		}
+
+		sim := adminSimulation{
+			Rule:      s.matchRule(target),
+			Action:    config().DefaultAction,
+			Providers: splitProviders(config().DefaultProvider),
+		}
+		if rule, ok := config().Rules[sim.Rule]; ok {
+			sim.Action = rule.Action
+			sim.Providers = rule.Providers()
+		}
+		if sim.Action != "auth" {
+			sim.Providers = nil
+		}
+
+		if email := q.Get("email"); email != "" && sim.Action == "auth" {
+			user := &provider.User{Email: normalizeEmail(email)}
+			for _, role := range strings.Split(q.Get("roles"), ",") {
+				if role = strings.TrimSpace(role); role != "" {
+					user.Roles = append(user.Roles, role)
+				}
+			}
+			allowed := ValidateUser(user, sim.Rule)
+			sim.Allowed = &allowed
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sim)
+	}
+}
+
+// AdminLogsHandler returns the recent log entries after the "after" sequence
+// number, so the UI can poll for new entries
+func (s *Server) AdminLogsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recentLogs.After(after))
+	}
+}
+
+// Recent logs
+
+// logBufferSize is how many log entries are kept for the admin UI
+const logBufferSize = 500
+
+// recentLogs keeps the latest log entries for the admin UI, it's only added
+// as a hook when the admin endpoints are enabled
+var recentLogs = NewLogBuffer(logBufferSize)
+
+// LogEntry is a log entry kept for the admin UI
+type LogEntry struct {
+	Seq     int64             `json:"seq"`
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// LogBuffer is a logrus hook keeping the latest entries
+type LogBuffer struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	size    int
+	seq     int64
+}
+
+// NewLogBuffer creates a buffer keeping the latest size entries
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{size: size}
+}
+
+// Levels keeps entries of every level that is logged
+func (b *LogBuffer) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire keeps the entry, leaving out fields that may hold credentials
+func (b *LogBuffer) Fire(e *logrus.Entry) error {
+	fields := make(map[string]string, len(e.Data))
+	for k, v := range e.Data {
+		if sensitiveLogField(k) {
+			continue
+		}
+		fields[k] = fmt.Sprint(v)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	b.entries = append(b.entries, LogEntry{
+		Seq:     b.seq,
+		Time:    e.Time,
+		Level:   e.Level.String(),
+		Message: e.Message,
+		Fields:  fields,
+	})
+	if len(b.entries) > b.size {
+		b.entries = b.entries[len(b.entries)-b.size:]
+	}
+	return nil
+}
+
+// After returns the kept entries with a sequence number after seq
+func (b *LogBuffer) After(seq int64) []LogEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries := []LogEntry{}
+	for _, entry := range b.entries {
+		if entry.Seq > seq {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func sensitiveLogField(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"cookie", "token", "secret", "password", "login_url"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+(function () {
+  'use strict';
+
+  var token = sessionStorage.getItem('adminToken') || '';
+  var lastLog = 0;
+  var logTimer = null;
+
+  function $(selector) {
+    return document.querySelector(selector);
+  }
+
+  function showError(message) {
+    var el = $('#error');
+    el.textContent = message;
+    el.hidden = !message;
+  }
+
+  // api calls the admin API with the admin token if one was entered,
+  // otherwise the auth cookie is sent
+  function api(method, path) {
+    var headers = {};
+    if (token) {
+      headers.Authorization = 'Bearer ' + token;
+    }
+    return fetch('/admin/' + path, { method: method, headers: headers, credentials: 'same-origin' })
+      .then(function (res) {
+        if (res.status === 401) {
+          $('#token').hidden = false;
+          throw new Error('Not authorized');
+        }
+        if (res.status === 403) {
+          throw new Error('Your roles do not permit this');
+        }
+        if (!res.ok) {
+          return res.text().then(function (text) { throw new Error(text.trim()); });
+        }
+        showError('');
+        return res.status === 204 ? null : res.json();
+      });
+  }
+
+  function cell(row, text) {
+    var td = document.createElement('td');
+    td.textContent = text;
+    row.appendChild(td);
+    return td;
+  }
+
+  function loadSessions() {
+    api('GET', 'sessions').then(function (sessions) {
+      var body = $('#sessions tbody');
+      body.textContent = '';
+      sessions.sort(function (a, b) { return a.email.localeCompare(b.email); });
+      sessions.forEach(function (session) {
+        var row = document.createElement('tr');
+        cell(row, session.email);
+        cell(row, session.uuid);
+        cell(row, new Date(session.added_at).toLocaleString());
+        var button = document.createElement('button');
+        button.textContent = 'Revoke';
+        button.addEventListener('click', function () {
+          if (confirm('Revoke this session of ' + session.email + '?')) {
+            api('DELETE', 'sessions/' + encodeURIComponent(session.uuid)).then(loadSessions).catch(function (err) { showError(err.message); });
+          }
+        });
+        cell(row, '').appendChild(button);
+        body.appendChild(row);
+      });
+    }).catch(function (err) { showError(err.message); });
+  }
+
+  function simulate(form) {
+    var q = new URLSearchParams(new FormData(form));
+    api('GET', 'simulate?' + q.toString()).then(function (sim) {
+      var dl = $('#simulation');
+      dl.textContent = '';
+      var rows = [['Rule', sim.rule], ['Action', sim.action]];
+      if (sim.providers) {
+        rows.push(['Providers', sim.providers.join(', ')]);
+      }
+      if (sim.allowed !== undefined) {
+        rows.push(['User', sim.allowed ? 'permitted' : 'not permitted']);
+      }
+      rows.forEach(function (r) {
+        var dt = document.createElement('dt');
+        dt.textContent = r[0];
+        var dd = document.createElement('dd');
+        dd.textContent = r[1];
+        dl.appendChild(dt);
+        dl.appendChild(dd);
+      });
+    }).catch(function (err) { showError(err.message); });
+  }
+
+  function pollLogs() {
+    api('GET', 'logs?after=' + lastLog).then(function (entries) {
+      var body = $('#logs tbody');
+      entries.forEach(function (entry) {
+        lastLog = entry.seq;
+        var row = document.createElement('tr');
+        row.className = entry.level;
+        cell(row, new Date(entry.time).toLocaleTimeString());
+        cell(row, entry.level);
+        cell(row, entry.message);
+        var fields = Object.keys(entry.fields || {}).sort().map(function (k) {
+          return k + '=' + entry.fields[k];
+        });
+        cell(row, fields.join(' ')).className = 'fields';
+        body.insertBefore(row, body.firstChild);
+      });
+      while (body.children.length > 500) {
+        body.removeChild(body.lastChild);
+      }
+    }).catch(function (err) {
+      showError(err.message);
+      stopLogs();
+    });
+  }
+
+  function stopLogs() {
+    clearInterval(logTimer);
+    logTimer = null;
+  }
+
+  function loadConfig() {
+    api('GET', 'config').then(function (config) {
+      $('#config pre').textContent = JSON.stringify(config, null, 2);
+    }).catch(function (err) { showError(err.message); });
+  }
+
+  var views = {
+    sessions: loadSessions,
+    simulate: function () {},
+    logs: function () {
+      pollLogs();
+      logTimer = setInterval(pollLogs, 2000);
+    },
+    config: loadConfig
+  };
+
+  function show(view) {
+    stopLogs();
+    showError('');
+    document.querySelectorAll('nav button').forEach(function (b) {
+      b.classList.toggle('active', b.dataset.view === view);
+    });
+    document.querySelectorAll('main section').forEach(function (s) {
+      s.hidden = s.id !== view;
+    });
+    views[view]();
+  }
+
+  document.querySelectorAll('nav button').forEach(function (b) {
+    b.addEventListener('click', function () { show(b.dataset.view); });
+  });
+
+  $('#token').addEventListener('submit', function (e) {
+    e.preventDefault();
+    token = e.target.token.value;
+    sessionStorage.setItem('adminToken', token);
+    e.target.hidden = true;
+    show(document.querySelector('nav button.active').dataset.view);
+  });
+
+  $('#revoke-user').addEventListener('submit', function (e) {
+    e.preventDefault();
+    var email = e.target.email.value;
+    if (confirm('Revoke every session of ' + email + '?')) {
+      api('DELETE', 'sessions?email=' + encodeURIComponent(email)).then(loadSessions).catch(function (err) { showError(err.message); });
+    }
+  });
+
+  $('#simulate-form').addEventListener('submit', function (e) {
+    e.preventDefault();
+    simulate(e.target);
+  });
+
+  show('sessions');
+})();
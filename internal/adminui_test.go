@@ -0,0 +1,152 @@
+package tfa
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+/**
+ * Tests
+ */
+
+func TestAdminUI(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminToken = "admintoken"
+	h := NewServer().Handler()
+
+	// Should serve the embedded pages without credentials
+	res := serveRouter(h, httptest.NewRequest("GET", "/admin/ui/", nil))
+	assert.Equal(200, res.Code)
+	assert.Contains(res.Body.String(), "<title>Forward Auth Admin</title>")
+	assert.Equal("default-src 'self'; frame-ancestors 'none'", res.Header().Get("Content-Security-Policy"))
+
+	res = serveRouter(h, httptest.NewRequest("GET", "/admin/ui/app.js", nil))
+	assert.Equal(200, res.Code)
+
+	res = serveRouter(h, httptest.NewRequest("GET", "/admin/ui", nil))
+	assert.Equal(301, res.Code)
+
+	// Should not be served when the admin endpoints are disabled
+	config().AdminToken = ""
+	res = serveRouter(NewServer().Handler(), httptest.NewRequest("GET", "/admin/ui/", nil))
+	assert.NotEqual(200, res.Code)
+}
+
+func TestAdminConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminToken = "admintoken"
+	config().SecretString = "veryveryverysecret"
+	config().Providers.GenericOAuth.ClientSecret = "oauthsecret"
+	config().Providers.GenericOAuth.Config = &oauth2.Config{ClientSecret: "oauthsecret"}
+	h := NewServer().Handler()
+
+	req := httptest.NewRequest("GET", "/admin/config", nil)
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should leave out secrets
+	req.Header.Set("Authorization", "Bearer admintoken")
+	res := serveRouter(h, req)
+	require.Equal(200, res.Code)
+	var c map[string]interface{}
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &c))
+	assert.Equal("auth", c["DefaultAction"])
+	assert.NotContains(res.Body.String(), "admintoken")
+	assert.NotContains(res.Body.String(), "veryveryverysecret")
+	assert.NotContains(res.Body.String(), "oauthsecret")
+}
+
+func TestAdminSimulate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminToken = "admintoken"
+	config().Rules = map[string]*Rule{
+		"public": {
+			Action: "allow",
+			Rule:   "PathPrefix(`/public`)",
+		},
+		"admin": {
+			Action:    "auth",
+			Rule:      "Host(`admin.example.com`)",
+			Provider:  "google",
+			Whitelist: CommaSeparatedList{"admin@example.com"},
+		},
+	}
+	h := NewServer().Handler()
+
+	simulate := func(query string) adminSimulation {
+		req := httptest.NewRequest("GET", "/admin/simulate?"+query, nil)
+		req.Header.Set("Authorization", "Bearer admintoken")
+		res := serveRouter(h, req)
+		require.Equal(200, res.Code, res.Body.String())
+		var sim adminSimulation
+		require.Nil(json.Unmarshal(res.Body.Bytes(), &sim))
+		return sim
+	}
+
+	sim := simulate("url=https://example.com/public/index.html")
+	assert.Equal("public", sim.Rule)
+	assert.Equal("allow", sim.Action)
+	assert.Nil(sim.Allowed)
+
+	sim = simulate("url=https://admin.example.com/&email=Admin@example.com")
+	assert.Equal("admin", sim.Rule)
+	assert.Equal([]string{"google"}, sim.Providers)
+	if assert.NotNil(sim.Allowed) {
+		assert.True(*sim.Allowed)
+	}
+
+	sim = simulate("url=https://admin.example.com/&email=other@example.com")
+	if assert.NotNil(sim.Allowed) {
+		assert.False(*sim.Allowed)
+	}
+
+	sim = simulate("url=https://other.example.com/")
+	assert.Equal("default", sim.Rule)
+	assert.Equal("auth", sim.Action)
+
+	// Should require an absolute URL
+	req := httptest.NewRequest("GET", "/admin/simulate?url=/public", nil)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	assert.Equal(400, serveRouter(h, req).Code)
+}
+
+func TestLogBuffer(t *testing.T) {
+	assert := assert.New(t)
+	b := NewLogBuffer(2)
+	logger := logrus.New()
+	logger.AddHook(b)
+	logger.SetOutput(httptest.NewRecorder().Body)
+
+	logger.WithField("user", "a@example.com").Warn("first")
+	logger.WithFields(logrus.Fields{
+		"user":        "b@example.com",
+		"csrf_cookie": "nonce",
+		"login_url":   "https://provider/?state=nonce",
+	}).Warn("second")
+	logger.Warn("third")
+
+	// Should only keep the latest entries, without sensitive fields
+	entries := b.After(0)
+	if assert.Len(entries, 2) {
+		assert.Equal("second", entries[0].Message)
+		assert.Equal(map[string]string{"user": "b@example.com"}, entries[0].Fields)
+		assert.Equal("warning", entries[0].Level)
+		assert.Equal("third", entries[1].Message)
+	}
+
+	entries = b.After(entries[0].Seq)
+	if assert.Len(entries, 1) {
+		assert.Equal("third", entries[0].Message)
+	}
+	assert.Empty(b.After(entries[0].Seq))
+}
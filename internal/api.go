@@ -0,0 +1,169 @@
+package tfa
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// API requests
+//
+// Requests made by scripts, rather than a browser navigating to a page, can't
+// follow a redirect to the provider: it would be refused by CORS or handed to
+// the script as an HTML page. They're refused with a 401 and a JSON body
+// giving the URL to log in at, so a single page app can send the user there.
+// Scripts that look like a browser can ask for this with the "api-mode-header"
+// or a "forward_auth_mode" query parameter. The parameter is issued to logged
+// in users at <url-path>/api-mode-url, signed for a single URL until it
+// expires after the "api-mode-param-lifetime"
+
+// apiModeParam is the query parameter with which a request can ask for a
+// JSON 401, in the format:
+// Value = json.expires.hash(secret, host, path, expires)
+const apiModeParam = "forward_auth_mode"
+
+// APIModeURLPath is where the apiModeParam is issued, under the url-path
+const APIModeURLPath = "/api-mode-url"
+
+// isAPIRequest reports whether the request was made by a script, either by
+// its headers or because it matches one of the "api-path-prefix" paths
+func isAPIRequest(r *http.Request) bool {
+	if requestsAPIMode(r) {
+		return true
+	}
+
+	if strings.EqualFold(r.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return true
+	}
+
+	// Browsers accept HTML when navigating, scripts ask for JSON
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "json") && !strings.Contains(accept, "text/html") {
+		return true
+	}
+
+	for _, prefix := range config().APIPathPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestsAPIMode reports whether the request asked to be refused with a JSON
+// 401. The query parameter is signed for the request's host and path, so a
+// link can't be crafted that shows users an error rather than sending them to
+// log in
+func requestsAPIMode(r *http.Request) bool {
+	if config().APIModeHeader != "" && strings.EqualFold(r.Header.Get(config().APIModeHeader), "json") {
+		return true
+	}
+
+	parts := strings.Split(r.URL.Query().Get(apiModeParam), ".")
+	if len(parts) != 3 || parts[0] != "json" {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Unix(expiry, 0).Before(time.Now()) {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	data := apiModeSignatureData(r.Host, r.URL.Path, parts[1])
+	expected, err := activeSigner().MAC(data)
+	if err != nil {
+		log.WithField("error", err).Warn("Unable to check forward_auth_mode parameter")
+		return false
+	}
+	return hmac.Equal(mac, expected) || signedWithPreviousSecret(mac, data)
+}
+
+// APIModeURLHandler adds the apiModeParam to the URL in the "url" query
+// parameter, for the logged in user's app to request it with
+func (s *Server) APIModeURLHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(config().CookieName)
+		if err != nil {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		if _, err := ValidateCookie(r, c); err != nil {
+			log.WithField("error", err).Debug("Invalid cookie for api mode url")
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		u, err := url.Parse(r.URL.Query().Get("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "url must be an absolute http or https URL", 400)
+			return
+		}
+
+		expires := time.Now().Add(config().APIModeParamLifetime)
+		value, err := makeAPIModeParam(u.Host, u.Path, expires)
+		if err != nil {
+			log.WithField("error", err).Error("Error signing forward_auth_mode parameter")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		query := u.Query()
+		query.Set(apiModeParam, value)
+		u.RawQuery = query.Encode()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			URL     string    `json:"url"`
+			Expires time.Time `json:"expires"`
+		}{u.String(), expires.UTC().Truncate(time.Second)})
+	}
+}
+
+// makeAPIModeParam signs the apiModeParam for the path on the host until it
+// expires
+func makeAPIModeParam(host, path string, expires time.Time) (string, error) {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	mac, err := activeSigner().MAC(apiModeSignatureData(host, path, expiry))
+	if err != nil {
+		return "", err
+	}
+	return "json." + expiry + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// apiModeSignatureData returns the data the apiModeParam signs, the host is
+// lowercased as it's case insensitive while the path is not
+func apiModeSignatureData(host, path, expiry string) []byte {
+	if path == "" {
+		path = "/"
+	}
+	return []byte(strings.Join([]string{"api-mode", strings.ToLower(host), path, expiry}, "|"))
+}
+
+// apiLoginRequired refuses the request, telling the script where the user
+// can log in and return to the page that made it
+func (s *Server) apiLoginRequired(logger *logrus.Entry, w http.ResponseWriter, r *http.Request) {
+	q := url.Values{}
+	q.Set("redirect", referringPath(r))
+	loginURL := config().Path + "/login?" + q.Encode()
+
+	logger.Info("Refusing API request that needs to log in")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(401)
+	json.NewEncoder(w).Encode(struct {
+		Error    string `json:"error"`
+		LoginURL string `json:"login_url"`
+	}{"login_required", loginURL})
+}
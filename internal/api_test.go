@@ -0,0 +1,152 @@
+package tfa
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestIsAPIRequest(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().APIPathPrefixes = CommaSeparatedList{"/api/"}
+
+	req := newDefaultHttpRequest("/index.html")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	assert.False(isAPIRequest(req), "page navigations should not be API requests")
+
+	req = newDefaultHttpRequest("/data")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	assert.True(isAPIRequest(req), "XHR should be API requests")
+
+	req = newDefaultHttpRequest("/data")
+	req.Header.Set("Accept", "application/json, text/plain, */*")
+	assert.True(isAPIRequest(req), "requests for JSON should be API requests")
+
+	req = newDefaultHttpRequest("/api/items")
+	assert.True(isAPIRequest(req), "api-path-prefix should be API requests")
+}
+
+func TestRequestsAPIMode(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Secret = []byte("veryverysecretsecret")
+	sign := func(secret, host, path string, expires time.Time) string {
+		expiry := strconv.FormatInt(expires.Unix(), 10)
+		hash := hmac.New(sha256.New, []byte(secret))
+		hash.Write([]byte("api-mode|" + host + "|" + path + "|" + expiry))
+		return "json." + expiry + "." + base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+	}
+	expires := time.Now().Add(time.Hour)
+
+	req := newDefaultHttpRequest("/data")
+	req.Header.Set("X-Forward-Auth-Mode", "json")
+	assert.True(requestsAPIMode(req), "the api-mode-header should be honoured")
+	config().APIModeHeader = ""
+	assert.False(requestsAPIMode(req), "an empty api-mode-header should disable it")
+
+	value, err := makeAPIModeParam("Example.com", "/data", expires)
+	assert.Nil(err)
+	assert.Equal(sign("veryverysecretsecret", "example.com", "/data", expires), value)
+	req = newDefaultHttpRequest("/data?forward_auth_mode=" + value)
+	assert.True(requestsAPIMode(req), "a signed parameter should be honoured")
+
+	req = newDefaultHttpRequest("/other?forward_auth_mode=" + value)
+	assert.False(requestsAPIMode(req), "a parameter signed for another path should be ignored")
+
+	req = newDefaultHttpRequest("/data?forward_auth_mode=" + sign("veryverysecretsecret", "example.com", "/data", time.Now().Add(-time.Minute)))
+	assert.False(requestsAPIMode(req), "an expired parameter should be ignored")
+
+	req = newDefaultHttpRequest("/data?forward_auth_mode=json")
+	assert.False(requestsAPIMode(req), "an unsigned parameter should be ignored")
+
+	req = newDefaultHttpRequest("/data?forward_auth_mode=" + sign("anotheranothersecret", "example.com", "/data", expires))
+	assert.False(requestsAPIMode(req), "a parameter signed with another secret should be ignored")
+	config().previousSecrets = [][]byte{[]byte("anotheranothersecret")}
+	assert.True(requestsAPIMode(req), "a parameter signed with a previous secret should be honoured")
+}
+
+func TestServerAPIModeURL(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	h := NewServer().Handler()
+
+	// Should require a cookie
+	req := httptest.NewRequest("GET", "http://example.com/_oauth/api-mode-url?url=https://app.example.com/events", nil)
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should sign the parameter for the URL
+	c, _ := MakeCookie(req, newTestUser("test@example.com"))
+	req.AddCookie(c)
+	res := serveRouter(h, req)
+	assert.Equal(200, res.Code)
+	assert.Equal("no-store", res.Header().Get("Cache-Control"))
+	var body struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}
+	assert.Nil(json.Unmarshal(res.Body.Bytes(), &body))
+	assert.WithinDuration(time.Now().Add(24*time.Hour), body.Expires, time.Minute)
+	u, _ := url.Parse(body.URL)
+	forwarded := newHTTPRequest("GET", "https://app.example.com/events?"+u.RawQuery)
+	assert.True(requestsAPIMode(forwarded))
+
+	// Should refuse relative URLs
+	req = httptest.NewRequest("GET", "http://example.com/_oauth/api-mode-url?url=/events", nil)
+	req.AddCookie(c)
+	assert.Equal(400, serveRouter(h, req).Code)
+
+	// Should be disabled without a lifetime
+	config().APIModeParamLifetime = 0
+	h = NewServer().Handler()
+	req = httptest.NewRequest("GET", "http://example.com/_oauth/api-mode-url?url=https://app.example.com/events", nil)
+	req.AddCookie(c)
+	assert.NotEqual(200, serveRouter(h, req).Code)
+}
+
+func TestServerAPILoginRequired(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should refuse API requests with the URL to log in at
+	req := newDefaultHttpRequest("/data")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	req.Header.Set("Referer", "http://example.com/dashboard?tab=1")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Equal("application/json", res.Header.Get("Content-Type"))
+
+	var login struct {
+		Error    string `json:"error"`
+		LoginURL string `json:"login_url"`
+	}
+	if assert.Nil(json.Unmarshal([]byte(body), &login)) {
+		assert.Equal("login_required", login.Error)
+		assert.Equal("/_oauth/login?redirect=%2Fdashboard%3Ftab%3D1", login.LoginURL)
+	}
+
+	// Should still redirect page navigations
+	req = newDefaultHttpRequest("/dashboard")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+
+	// Should refuse requests from browser-like clients asking for JSON
+	req = newDefaultHttpRequest("/dashboard")
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("X-Forward-Auth-Mode", "json")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Equal("application/json", res.Header.Get("Content-Type"))
+}
@@ -0,0 +1,287 @@
+package tfa
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Audit trail
+//
+// Security relevant events, logins succeeding and failing, sessions ending
+// (on logout, revocation or consent being withdrawn) and requests being
+// denied, are logged as warnings and also written to the audit sinks, so
+// access can be reviewed from a trail kept apart from the service's logs.
+// Events are queued and written by one goroutine, so a slow sink never holds
+// up a request, if the queue fills up events are dropped and counted
+
+// auditQueueSize is the number of events waiting to be written at most
+const auditQueueSize = 1000
+
+var auditEventsDroppedTotal = NewCounterVec("audit_events_dropped_total",
+	"Audit events that weren't written to the audit sinks because the queue was full")
+
+// auditSink writes audit events, one JSON object at a time
+type auditSink interface {
+	Write(event []byte) error
+	Close() error
+}
+
+// AuditLog writes events to its sinks
+type AuditLog struct {
+	sinks  []auditSink
+	events chan []byte
+	done   chan struct{}
+}
+
+// auditLog is nil when no sinks are configured
+var auditLog *AuditLog
+
+// NewAuditLog creates an audit log writing to the sinks configured by the
+// "audit-*" options, or nil if there are none
+func NewAuditLog(c *Config) (*AuditLog, error) {
+	var sinks []auditSink
+	if c.AuditFile != "" {
+		sink, err := newAuditFileSink(c.AuditFile, int64(c.AuditFileMaxSize)<<20, c.AuditFileMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if c.AuditWebhook != "" {
+		if err := validateAuditWebhookURL(c.AuditWebhook); err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, &auditWebhookSink{url: c.AuditWebhook, client: &http.Client{Timeout: 5 * time.Second}})
+	}
+	if c.AuditSyslog != "" {
+		sink, err := newAuditSyslogSink(c.AuditSyslog)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	a := &AuditLog{
+		sinks:  sinks,
+		events: make(chan []byte, auditQueueSize),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// Record queues the event to be written
+func (a *AuditLog) Record(event map[string]interface{}) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.WithField("error", err).Warn("Error encoding audit event")
+		return
+	}
+
+	select {
+	case a.events <- b:
+	default:
+		auditEventsDroppedTotal.Inc()
+	}
+}
+
+// Close writes the events queued and closes the sinks
+func (a *AuditLog) Close() {
+	close(a.events)
+	<-a.done
+}
+
+func (a *AuditLog) run() {
+	defer close(a.done)
+	for event := range a.events {
+		for _, sink := range a.sinks {
+			if err := sink.Write(event); err != nil {
+				log.WithField("error", err).Warn("Error writing audit event")
+			}
+		}
+	}
+	for _, sink := range a.sinks {
+		sink.Close()
+	}
+}
+
+// auditEvent logs a security relevant event and writes it to the audit sinks.
+// These are logged as warnings so they are kept with the default log level,
+// and carry an "audit" field so they can be picked out. Events about a tagged
+// user carry their tags
+func auditEvent(event, reason string, fields logrus.Fields) {
+	if user, ok := fields["user"].(string); ok {
+		if tags, ok := lookupUserTags(user); ok && len(tags.Tags) > 0 {
+			fields["tags"] = tags.Tags
+		}
+	}
+
+	log.WithFields(fields).WithFields(logrus.Fields{
+		"audit":    event,
+		"reason":   reason,
+		"instance": config().InstanceID,
+	}).Warn("Audit: " + event)
+
+	if auditLog == nil {
+		return
+	}
+	record := map[string]interface{}{
+		"time":     time.Now().UTC().Format(time.RFC3339Nano),
+		"event":    event,
+		"instance": config().InstanceID,
+	}
+	if reason != "" {
+		record["reason"] = reason
+	}
+	for name, value := range fields {
+		if _, ok := record[name]; !ok {
+			record[name] = value
+		}
+	}
+	auditLog.Record(record)
+}
+
+// auditRequestFields describes the client an event was caused by, and the
+// proxies its request came through
+func auditRequestFields(r *http.Request, fields logrus.Fields) logrus.Fields {
+	fields["source_ip"] = originalClientIP(r)
+	if chain, _ := forwardedFor(r); len(chain) > 1 {
+		fields["forwarded_for"] = strings.Join(chain, ", ")
+	}
+	if id := requestID(r); id != "" {
+		fields["request_id"] = id
+	}
+	return fields
+}
+
+// auditLoginFailure records a login that failed, the user is empty when they
+// aren't known yet
+func auditLoginFailure(r *http.Request, providerName, user, reason string) {
+	fields := logrus.Fields{"provider": providerName}
+	if user != "" {
+		fields["user"] = user
+	}
+	auditEvent("login_failed", reason, auditRequestFields(r, fields))
+}
+
+// File sink
+
+// auditFileSink appends events to a file, rotating it once it reaches the
+// maximum size. Rotated files are named after it with a .1 (the newest), .2
+// and so on suffix
+type auditFileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newAuditFileSink(path string, maxSize int64, maxBackups int) (*auditFileSink, error) {
+	s := &auditFileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *auditFileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *auditFileSink) Write(event []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line := append(event, '\n')
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate moves the file aside, dropping the oldest backup
+func (s *auditFileSink) rotate() error {
+	s.file.Close()
+
+	if s.maxBackups < 1 {
+		os.Remove(s.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+		for i := s.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	}
+
+	return s.open()
+}
+
+func (s *auditFileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Webhook sink
+
+// auditWebhookSink POSTs each event to a URL
+type auditWebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// validateAuditWebhookURL checks the webhook is an absolute http(s) URL
+func validateAuditWebhookURL(value string) error {
+	if !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+		return fmt.Errorf("audit-webhook must be an absolute http or https URL")
+	}
+	return nil
+}
+
+func (s *auditWebhookSink) Write(event []byte) error {
+	res, err := s.client.Post(s.url, "application/json", bytes.NewReader(event))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("audit webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+func (s *auditWebhookSink) Close() error {
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+package tfa
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// auditSyslogSink sends events to syslog, with the auth facility
+type auditSyslogSink struct {
+	writer *syslog.Writer
+}
+
+// newAuditSyslogSink connects to the "audit-syslog" server, given as
+// udp://host:port or tcp://host:port, or "local" for the local daemon
+func newAuditSyslogSink(address string) (*auditSyslogSink, error) {
+	network, raddr := "", ""
+	if address != "local" {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("audit-syslog must be udp://host:port, tcp://host:port or local")
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_NOTICE|syslog.LOG_AUTH, "traefik-forward-auth")
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to audit-syslog: %v", err)
+	}
+	return &auditSyslogSink{writer: writer}, nil
+}
+
+func (s *auditSyslogSink) Write(event []byte) error {
+	return s.writer.Notice(string(event))
+}
+
+func (s *auditSyslogSink) Close() error {
+	return s.writer.Close()
+}
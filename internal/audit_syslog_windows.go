@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package tfa
+
+import "errors"
+
+// Windows has no syslog
+func newAuditSyslogSink(address string) (auditSink, error) {
+	return nil, errors.New("audit-syslog is not supported on windows")
+}
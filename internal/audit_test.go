@@ -0,0 +1,203 @@
+package tfa
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestNewAuditLog(t *testing.T) {
+	assert := assert.New(t)
+	c := newDefaultConfig()
+
+	// Should not be set up without sinks
+	a, err := NewAuditLog(c)
+	assert.Nil(err)
+	assert.Nil(a)
+
+	// Should refuse invalid sinks
+	c.AuditWebhook = "audit.example.com"
+	_, err = NewAuditLog(c)
+	if assert.Error(err) {
+		assert.Equal("audit-webhook must be an absolute http or https URL", err.Error())
+	}
+
+	c.AuditWebhook = ""
+	c.AuditSyslog = "syslog.example.com"
+	_, err = NewAuditLog(c)
+	if assert.Error(err) {
+		assert.Equal("audit-syslog must be udp://host:port, tcp://host:port or local", err.Error())
+	}
+}
+
+func TestAuditEvent(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().InstanceID = "tfa-1"
+
+	var received []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		var event map[string]interface{}
+		assert.Nil(json.NewDecoder(r.Body).Decode(&event))
+		received = append(received, event)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(tempAuditDir(t), "audit.log")
+	config().AuditFile = path
+	config().AuditWebhook = server.URL
+	a, err := NewAuditLog(config())
+	require.Nil(err)
+	auditLog = a
+	defer func() { auditLog = nil }()
+
+	auditEvent("session_terminated", "logout", logrus.Fields{"user": "test@example.com", "event": "ignored"})
+	a.Close()
+
+	// Should write the event to each sink
+	events := readAuditFile(t, path)
+	require.Len(events, 1)
+	assert.Equal("session_terminated", events[0]["event"])
+	assert.Equal("logout", events[0]["reason"])
+	assert.Equal("tfa-1", events[0]["instance"])
+	assert.Equal("test@example.com", events[0]["user"])
+	assert.NotEmpty(events[0]["time"])
+	assert.Equal(events, received)
+}
+
+func TestAuditFileSinkRotation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(tempAuditDir(t), "audit.log")
+
+	sink, err := newAuditFileSink(path, 25, 2)
+	require.Nil(err)
+	for _, event := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`, `{"n":5}`, `{"n":6}`, `{"n":7}`} {
+		require.Nil(sink.Write([]byte(event)))
+	}
+	require.Nil(sink.Close())
+
+	// Should rotate the file, keeping the newest backups
+	read := func(path string) string {
+		b, err := ioutil.ReadFile(path)
+		require.Nil(err)
+		return string(b)
+	}
+	assert.Equal("{\"n\":7}\n", read(path))
+	assert.Equal("{\"n\":4}\n{\"n\":5}\n{\"n\":6}\n", read(path+".1"))
+	assert.Equal("{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(os.IsNotExist(err))
+
+	// Should carry on from the size of an existing file
+	sink, err = newAuditFileSink(path, 25, 2)
+	require.Nil(err)
+	assert.Equal(int64(8), sink.size)
+	sink.Close()
+}
+
+func TestServerAuditEvents(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().Whitelist = []string{"other@example.com"}
+
+	// Don't leave the session created by logging in behind
+	previous := sessions
+	sessions = NewMemorySessionStore()
+	defer func() { sessions = previous }()
+
+	server, serverURL := NewOAuthServer(t)
+	defer server.Close()
+	config().Providers.Google.TokenURL = &url.URL{Scheme: serverURL.Scheme, Host: serverURL.Host, Path: "/token"}
+	config().Providers.Google.UserURL = &url.URL{Scheme: serverURL.Scheme, Host: serverURL.Host, Path: "/userinfo"}
+
+	path := filepath.Join(tempAuditDir(t), "audit.log")
+	config().AuditFile = path
+	a, err := NewAuditLog(config())
+	require.Nil(err)
+	auditLog = a
+	defer func() { auditLog = nil }()
+
+	// Should audit failed logins
+	nonce := "auditauditauditauditauditaudit12"
+	req := newHTTPRequest("GET", "http://example.com/_oauth?state="+nonce+":google:http://example.com/redirect")
+	req.Header.Set("X-Forwarded-For", "192.0.2.10")
+	doHttpRequest(req, MakeCSRFCookie(req, "nononononononononononononononono"))
+
+	// Should audit logins, even when the user will be turned away
+	req = newHTTPRequest("GET", "http://example.com/_oauth?state="+nonce+":google:http://example.com/redirect")
+	res, _ := doHttpRequest(req, MakeCSRFCookie(req, nonce))
+	require.Equal(307, res.StatusCode)
+
+	// Should audit denied requests
+	req = newHTTPRequest("GET", "http://example.com/private")
+	c, _ := MakeCookie(req, newTestUser("test@example.com"))
+	res, _ = doHttpRequest(req, c)
+	require.Equal(401, res.StatusCode)
+
+	a.Close()
+	events := readAuditFile(t, path)
+	require.Len(events, 4)
+
+	assert.Equal("login_failed", events[0]["event"])
+	assert.Equal("csrf_missing", events[0]["reason"])
+	assert.Equal("192.0.2.10", events[0]["source_ip"])
+
+	assert.Equal("login_failed", events[1]["event"])
+	assert.Equal("denied", events[1]["reason"])
+	assert.Equal("example@example.com", events[1]["user"])
+
+	assert.Equal("login_succeeded", events[2]["event"])
+	assert.Equal("example@example.com", events[2]["user"])
+	assert.Equal("google", events[2]["provider"])
+	assert.Equal("default", events[2]["rule"])
+
+	assert.Equal("access_denied", events[3]["event"])
+	assert.Equal("user: test@example.com not permitted", events[3]["reason"])
+	assert.Equal("test@example.com", events[3]["user"])
+	assert.Equal("/private", events[3]["uri"])
+}
+
+/**
+ * Utilities
+ */
+
+func tempAuditDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "audit")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func readAuditFile(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event map[string]interface{}
+		require.Nil(t, json.NewDecoder(strings.NewReader(scanner.Text())).Decode(&event))
+		events = append(events, event)
+	}
+	return events
+}
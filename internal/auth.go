@@ -5,10 +5,13 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,116 +21,207 @@ import (
 
 // Request Validation
 
-var users = make(map[uuid.UUID]*UserEntry)
+// ensureUser stores the user's session, or extends it if the user already has
+// one, e.g. a provider with stable user ids
+func ensureUser(user *provider.User) error {
+	// Stateless cookies carry the user themselves
+	if config().StatelessCookie {
+		return nil
+	}
+
+	// A nil id would be shared by every user without one
+	if user.UUID == uuid.Nil {
+		return errors.New("user has no session id")
+	}
 
-type UserEntry struct {
-	User    *provider.User
-	AddedAt time.Time
+	ttl := sessionTTL()
+	if ok, err := sessions.Expire(user.UUID, ttl); err != nil || ok {
+		return err
+	}
+
+	return sessions.Put(user.UUID, &UserEntry{
+		User:    user,
+		AddedAt: time.Now(),
+	}, ttl)
 }
 
-var started = false
+// ValidateCookie verifies that a cookie matches the expected format of:
+// Cookie = hash(secret, cookie domain, userUUID, expires)|expires|userUUID
+func ValidateCookie(r *http.Request, c *http.Cookie) (*provider.User, error) {
+	user, expires, err := cookieUser(r, c)
+	if err != nil {
+		return nil, err
+	}
 
-func cleanUsers() {
-	for userUUID, user := range users {
-		if time.Since(user.AddedAt).Hours() > 1 {
-			delete(users, userUUID)
-		}
+	// Has it expired?
+	if expires.Before(time.Now()) {
+		return nil, errors.New("Cookie has expired")
 	}
-	time.Sleep(5 * time.Minute)
+
+	// Looks valid
+	return user, nil
 }
 
-func ensureUser(user *provider.User) {
-	if !started {
-		go cleanUsers()
-		started = true
+// cookieUser returns the user the cookie belongs to and its expiry, taken
+// from the cookie itself with "stateless-cookie" set and otherwise from the
+// session store. It does not check whether the cookie has expired
+func cookieUser(r *http.Request, c *http.Cookie) (*provider.User, time.Time, error) {
+	if config().StatelessCookie {
+		return parseStatelessCookie(r, c)
 	}
 
-	if _, ok := users[user.UUID]; !ok {
-		users[user.UUID] = &UserEntry{
-			User:    user,
-			AddedAt: time.Now(),
-		}
+	userUUID, expires, err := parseCookie(r, c)
+	if err != nil {
+		return nil, time.Time{}, err
 	}
+
+	userEntry, err := sessions.Get(userUUID)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to load session: %v", err)
+	}
+	if userEntry == nil {
+		return nil, time.Time{}, errors.New("user is unknown")
+	}
+
+	return userEntry.User, expires, nil
 }
 
-// ValidateCookie verifies that a cookie matches the expected format of:
-// Cookie = hash(secret, cookie domain, userUUID, expires)|expires|userUUID
-func ValidateCookie(r *http.Request, c *http.Cookie) (*provider.User, error) {
-	parts := strings.Split(c.Value, "|")
+// parseCookie verifies the cookie signature and returns the user UUID and
+// expiry it contains, it does not check whether the cookie has expired
+func parseCookie(r *http.Request, c *http.Cookie) (uuid.UUID, time.Time, error) {
+	userUUID, expires, _, err := verifyCookie(r, c)
+	return userUUID, expires, err
+}
+
+// verifyCookie is parseCookie, also reporting whether the cookie was signed or
+// encrypted with a previous secret
+func verifyCookie(r *http.Request, c *http.Cookie) (uuid.UUID, time.Time, bool, error) {
+	if config().StatelessCookie {
+		user, expires, previous, err := verifyStatelessCookie(r, c)
+		if err != nil {
+			return uuid.Nil, time.Time{}, false, err
+		}
+		return user.UUID, expires, previous, nil
+	}
+
+	// Encrypted cookies are accepted whether or not "encrypt-cookies" is
+	// set, so it can be turned on and off without logging everyone out
+	value := c.Value
+	previous := false
+	if !strings.Contains(value, "|") {
+		plaintext, rotated, err := decryptValueRotated("auth-cookie", value)
+		if err != nil {
+			return uuid.Nil, time.Time{}, false, errors.New("Invalid cookie format")
+		}
+		value = string(plaintext)
+		previous = rotated
+	}
+
+	parts := strings.Split(value, "|")
 
 	if len(parts) != 3 {
-		return nil, errors.New("Invalid cookie format")
+		return uuid.Nil, time.Time{}, false, errors.New("Invalid cookie format")
 	}
 
 	mac, err := base64.URLEncoding.DecodeString(parts[0])
 	if err != nil {
-		return nil, errors.New("Unable to decode cookie mac")
+		return uuid.Nil, time.Time{}, false, errors.New("Unable to decode cookie mac")
 	}
 
 	var userUUID uuid.UUID
-
 	err = userUUID.UnmarshalText([]byte(parts[2]))
 	if err != nil {
-		return nil, err
+		return uuid.Nil, time.Time{}, false, err
 	}
 
-	userEntry := users[userUUID]
-	if userEntry == nil {
-		return nil, errors.New("user is unknown")
+	user := &provider.User{UUID: userUUID}
+	expectedSignature, err := cookieSignature(r, user, parts[1])
+	if err != nil {
+		return uuid.Nil, time.Time{}, false, fmt.Errorf("Unable to generate mac: %v", err)
 	}
-	user := userEntry.User
-
-	expectedSignature, _ := cookieSignature(r, user, parts[1])
 	expected, err := base64.URLEncoding.DecodeString(expectedSignature)
 	if err != nil {
-		return nil, errors.New("Unable to generate mac")
+		return uuid.Nil, time.Time{}, false, errors.New("Unable to generate mac")
 	}
 
 	// Valid token?
 	if !hmac.Equal(mac, expected) {
-		return nil, errors.New("Invalid cookie mac")
+		data, _ := cookieSignatureData(r, user, parts[1])
+		if !signedWithPreviousSecret(mac, data) {
+			return uuid.Nil, time.Time{}, false, errors.New("Invalid cookie mac")
+		}
+		previous = true
 	}
 
 	expires, err := strconv.ParseInt(parts[1], 10, 64)
 	if err != nil {
-		return nil, errors.New("Unable to parse cookie expiry")
-	}
-
-	// Has it expired?
-	if time.Unix(expires, 0).Before(time.Now()) {
-		return nil, errors.New("Cookie has expired")
+		return uuid.Nil, time.Time{}, false, errors.New("Unable to parse cookie expiry")
 	}
 
-	// Looks valid
-	return user, nil
+	return userUUID, time.Unix(expires, 0), previous, nil
 }
 
 // ValidateUser checks if the given email address matches either a whitelisted
 // email address, as defined by the "whitelist" config parameter. Or is part of
 // a permitted domain, as defined by the "domains" config parameter
 func ValidateUser(user *provider.User, ruleName string) bool {
+	// Blocked users are never permitted, whatever else permits them
+	if ValidateBlocked(user.Email, ruleName) {
+		return false
+	}
+
+	// Users outside the rule's tenants are never permitted
+	if !ValidateTenant(user, ruleName) {
+		return false
+	}
+
 	// Use global config by default
-	whitelist := config.Whitelist
-	domains := config.Domains
-	allowedRoles := config.AllowedRoles
+	whitelist := config().Whitelist
+	domains := config().Domains
+	allowedRoles := config().AllowedRoles
+	allowedGroups := config().AllowedGroups
+	allowedTags := config().AllowedTags
 
-	if rule, ok := config.Rules[ruleName]; ok {
+	// Users in the directory are permitted alongside the allowed groups
+	directory := userDirectory
+
+	if rule, ok := config().Rules[ruleName]; ok {
 		// Override with rule config if found
 		if len(rule.Whitelist) > 0 || len(rule.Domains) > 0 {
 			whitelist = rule.Whitelist
 			domains = rule.Domains
+			directory = nil
 		}
 
 		if len(rule.AllowedRoles) > 0 {
 			allowedRoles = rule.AllowedRoles
 		}
+		if len(rule.AllowedGroups) > 0 {
+			allowedGroups = rule.AllowedGroups
+		}
+		if len(rule.AllowedTags) > 0 {
+			allowedTags = rule.AllowedTags
+		}
+	}
+
+	// The directory only applies to rules with group conditions, it mustn't
+	// restrict rules that would otherwise allow everyone
+	if len(allowedGroups) == 0 {
+		directory = nil
 	}
 
 	// Do we have any validation to perform?
-	if len(whitelist) == 0 && len(domains) == 0 && len(allowedRoles) == 0 {
+	if len(whitelist) == 0 && len(domains) == 0 && len(allowedRoles) == 0 && len(allowedGroups) == 0 && len(allowedTags) == 0 {
 		return true
 	}
 
+	// Directory validation
+	if directory != nil {
+		if _, ok := directory.Lookup(user.Email); ok {
+			return true
+		}
+	}
+
 	// Email whitelist validation
 	if len(whitelist) > 0 {
 		if ValidateWhitelist(user.Email, whitelist) {
@@ -145,9 +239,36 @@ func ValidateUser(user *provider.User, ruleName string) bool {
 		return true
 	}
 
+	// Directory group validation
+	if len(allowedGroups) > 0 && ValidateGroups(user, allowedGroups) {
+		return true
+	}
+
+	// Tag validation
+	if len(allowedTags) > 0 && ValidateTags(user.Email, allowedTags) {
+		return true
+	}
+
 	return false
 }
 
+// ValidateBlocked checks if the email is in the global or rule's
+// "blocked-users", from one of their "blocked-domains", or tagged with one of
+// their "blocked-tags" or past the expiry of its tags
+func ValidateBlocked(email string, ruleName string) bool {
+	if ValidateWhitelist(email, config().BlockedUsers) || ValidateDomains(email, config().BlockedDomains) {
+		return true
+	}
+	blockedTags := config().BlockedTags
+	if rule, ok := config().Rules[ruleName]; ok {
+		if ValidateWhitelist(email, rule.BlockedUsers) || ValidateDomains(email, rule.BlockedDomains) {
+			return true
+		}
+		blockedTags = append(append(CommaSeparatedList{}, blockedTags...), rule.BlockedTags...)
+	}
+	return tagsBlocked(email, blockedTags)
+}
+
 func ValidateRoles(user *provider.User, allowedRoles CommaSeparatedList) bool {
 	log.Debugf("User %s has the following rules: %v", user.Name, user.Roles)
 	for _, allowedRole := range allowedRoles {
@@ -160,30 +281,57 @@ func ValidateRoles(user *provider.User, allowedRoles CommaSeparatedList) bool {
 	return false
 }
 
-// ValidateWhitelist checks if the email is in whitelist
+// ValidateWhitelist checks if the email is in whitelist, or matches one of
+// its patterns
 func ValidateWhitelist(email string, whitelist CommaSeparatedList) bool {
+	email = normalizeEmail(email)
 	for _, whitelist := range whitelist {
-		if email == whitelist {
+		if isPattern(whitelist) {
+			if matchPattern(whitelist, email) {
+				return true
+			}
+		} else if email == normalizeEmail(whitelist) {
 			return true
 		}
 	}
 	return false
 }
 
-// ValidateDomains checks if the email matches a whitelisted domain
+// ValidateDomains checks if the email matches a whitelisted domain or domain
+// pattern
 func ValidateDomains(email string, domains CommaSeparatedList) bool {
-	parts := strings.Split(email, "@")
-	if len(parts) < 2 {
+	userDomain, ok := emailDomain(email)
+	if !ok {
 		return false
 	}
 	for _, domain := range domains {
-		if domain == parts[1] {
+		if isPattern(domain) {
+			if matchPattern(domain, userDomain) {
+				return true
+			}
+		} else if userDomain == normalizeDomain(domain) {
 			return true
 		}
 	}
 	return false
 }
 
+// SessionHash returns a stable, opaque identifier for the user ("user" mode) or
+// for their set of roles ("group" mode), so caches can vary responses without
+// learning who the user is
+func SessionHash(user *provider.User, mode string) string {
+	value := user.Email
+	if mode == "group" {
+		roles := append([]string{}, user.Roles...)
+		sort.Strings(roles)
+		value = strings.Join(roles, ",")
+	}
+
+	hash := hmac.New(sha256.New, config().Secret)
+	hash.Write([]byte("session-hash|" + mode + "|" + value))
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
 // Utility methods
 
 // Get the redirect base
@@ -191,24 +339,26 @@ func redirectBase(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", r.Header.Get("X-Forwarded-Proto"), r.Host)
 }
 
-// Return url
+// Return url, the exact location the user was at including the query. The
+// host carries any non-standard port the user connected to, X-Forwarded-Port
+// isn't used as it's the port of traefik's entrypoint, which may differ
 func returnUrl(r *http.Request) string {
-	return fmt.Sprintf("%s%s", redirectBase(r), r.URL.Path)
+	return fmt.Sprintf("%s://%s%s", r.Header.Get("X-Forwarded-Proto"), r.Host, r.URL.RequestURI())
 }
 
 // Get oauth redirect uri
 func redirectUri(r *http.Request) string {
 	if use, _ := useAuthDomain(r); use {
 		p := r.Header.Get("X-Forwarded-Proto")
-		return fmt.Sprintf("%s://%s%s", p, config.AuthHost, config.Path)
+		return fmt.Sprintf("%s://%s%s", p, config().AuthHost, config().Path)
 	}
 
-	return fmt.Sprintf("%s%s", redirectBase(r), config.Path)
+	return fmt.Sprintf("%s%s", redirectBase(r), config().Path)
 }
 
 // Should we use auth host + what it is
 func useAuthDomain(r *http.Request) (bool, string) {
-	if config.AuthHost == "" {
+	if config().AuthHost == "" {
 		return false, ""
 	}
 
@@ -216,7 +366,7 @@ func useAuthDomain(r *http.Request) (bool, string) {
 	reqMatch, reqHost := matchCookieDomains(r.Host)
 
 	// Do any of the auth hosts match a cookie domain?
-	authMatch, authHost := matchCookieDomains(config.AuthHost)
+	authMatch, authHost := matchCookieDomains(config().AuthHost)
 
 	// We need both to match the same domain
 	return reqMatch && authMatch && reqHost == authHost, reqHost
@@ -224,22 +374,72 @@ func useAuthDomain(r *http.Request) (bool, string) {
 
 // Cookie methods
 
+// cookieSameSite returns the configured SameSite attribute of cookies
+func cookieSameSite() http.SameSite {
+	switch config().CookieSameSite {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteDefaultMode
+}
+
+// setCookie adds the cookie to the response, with the Partitioned attribute
+// when "cookie-partitioned" is set. The header is written directly as
+// http.Cookie has no Partitioned attribute before Go 1.23
+func setCookie(w http.ResponseWriter, c *http.Cookie) {
+	v := c.String()
+	if v == "" {
+		return
+	}
+	if config().CookiePartitioned {
+		v += "; Partitioned"
+	}
+	w.Header().Add("Set-Cookie", v)
+}
+
 // MakeCookie creates an auth cookie
 func MakeCookie(r *http.Request, user *provider.User) (*http.Cookie, error) {
 	expires := cookieExpiry()
-	mac, err := cookieSignature(r, user, fmt.Sprintf("%d", expires.Unix()))
-	if err != nil {
-		return nil, err
+	if !user.SessionExpiry.IsZero() && user.SessionExpiry.Before(expires) {
+		expires = user.SessionExpiry
+	}
+	return makeCookie(r, user, expires)
+}
+
+// makeCookie makes an auth cookie expiring at the given time
+func makeCookie(r *http.Request, user *provider.User, expires time.Time) (*http.Cookie, error) {
+	var value string
+	if config().StatelessCookie {
+		var err error
+		value, err = makeStatelessCookie(r, user, expires)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		mac, err := cookieSignature(r, user, fmt.Sprintf("%d", expires.Unix()))
+		if err != nil {
+			return nil, err
+		}
+		value = fmt.Sprintf("%s|%d|%s", mac, expires.Unix(), user.UUID)
+		if config().EncryptCookies {
+			if value, err = encryptValue("auth-cookie", []byte(value)); err != nil {
+				return nil, err
+			}
+		}
 	}
-	value := fmt.Sprintf("%s|%d|%s", mac, expires.Unix(), user.UUID)
 
 	return &http.Cookie{
-		Name:     config.CookieName,
+		Name:     config().CookieName,
 		Value:    value,
 		Path:     "/",
 		Domain:   cookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !config().InsecureCookie,
+		SameSite: cookieSameSite(),
 		Expires:  expires,
 	}, nil
 }
@@ -247,18 +447,19 @@ func MakeCookie(r *http.Request, user *provider.User) (*http.Cookie, error) {
 // ClearCookie clears the auth cookie
 func ClearCookie(r *http.Request) *http.Cookie {
 	return &http.Cookie{
-		Name:     config.CookieName,
+		Name:     config().CookieName,
 		Value:    "",
 		Path:     "/",
 		Domain:   cookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !config().InsecureCookie,
+		SameSite: cookieSameSite(),
 		Expires:  time.Now().Local().Add(time.Hour * -1),
 	}
 }
 
 func buildCSRFCookieName(nonce string) string {
-	return config.CSRFCookieName + "_" + nonce[:6]
+	return config().CSRFCookieName + "_" + nonce[:6]
 }
 
 // MakeCSRFCookie makes a csrf cookie (used during login only)
@@ -273,7 +474,28 @@ func MakeCSRFCookie(r *http.Request, nonce string) *http.Cookie {
 		Path:     "/",
 		Domain:   csrfCookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !config().InsecureCookie,
+		SameSite: cookieSameSite(),
+		Expires:  time.Now().Local().Add(time.Hour * 1),
+	}
+}
+
+func buildLoginTransactionCookieName() string {
+	return config().CSRFCookieName + "_login"
+}
+
+// MakeLoginTransactionCookie makes a cookie identifying the logins started by
+// a browser, so concurrent logins in several tabs share a session. It lives
+// as long as the CSRF cookies
+func MakeLoginTransactionCookie(r *http.Request, id string) *http.Cookie {
+	return &http.Cookie{
+		Name:     buildLoginTransactionCookieName(),
+		Value:    id,
+		Path:     "/",
+		Domain:   csrfCookieDomain(r),
+		HttpOnly: true,
+		Secure:   !config().InsecureCookie,
+		SameSite: cookieSameSite(),
 		Expires:  time.Now().Local().Add(time.Hour * 1),
 	}
 }
@@ -286,11 +508,47 @@ func ClearCSRFCookie(r *http.Request, c *http.Cookie) *http.Cookie {
 		Path:     "/",
 		Domain:   csrfCookieDomain(r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !config().InsecureCookie,
+		SameSite: cookieSameSite(),
 		Expires:  time.Now().Local().Add(time.Hour * -1),
 	}
 }
 
+// MakeProviderCookie creates a long lived cookie remembering the provider the
+// user last logged in with, so the provider chooser can be skipped
+func MakeProviderCookie(r *http.Request, providerName string) *http.Cookie {
+	return &http.Cookie{
+		Name:     config().ProviderCookieName,
+		Value:    providerName,
+		Path:     "/",
+		Domain:   cookieDomain(r),
+		HttpOnly: true,
+		Secure:   !config().InsecureCookie,
+		SameSite: cookieSameSite(),
+		Expires:  time.Now().Local().Add(providerCookieLifetime),
+	}
+}
+
+// providerCookieLifetime is how long the provider preference is remembered
+const providerCookieLifetime = time.Hour * 24 * 365
+
+// preferredProvider returns the provider remembered by the provider cookie, if
+// it is one of the given choices
+func preferredProvider(r *http.Request, choices []string) (string, bool) {
+	c, err := r.Cookie(config().ProviderCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	for _, name := range choices {
+		if c.Value == name {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
 // FindCSRFCookie extracts the CSRF cookie from the request based on state.
 func FindCSRFCookie(r *http.Request, state string) (c *http.Cookie, err error) {
 	// Check for CSRF cookie
@@ -310,6 +568,13 @@ func ValidateCSRFCookie(c *http.Cookie, state string) (valid bool, provider stri
 
 	// Extract provider
 	params := state[33:]
+	if !strings.Contains(params, ":") {
+		plaintext, err := decryptValue("login-state", params)
+		if err != nil {
+			return false, "", "", errors.New("Invalid CSRF state format")
+		}
+		params = string(plaintext)
+	}
 	split := strings.Index(params, ":")
 	if split == -1 {
 		return false, "", "", errors.New("Invalid CSRF state format")
@@ -319,11 +584,58 @@ func ValidateCSRFCookie(c *http.Cookie, state string) (valid bool, provider stri
 	return true, params[:split], params[split+1:], nil
 }
 
+// ValidateRedirect checks the URL users are returned to after logging in is on
+// the host of the callback, a cookie domain or one of the "redirect-host"s, so
+// the state can't be used to send them elsewhere
+func ValidateRedirect(r *http.Request, redirect string) (*url.URL, error) {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return nil, errors.New("Unable to parse redirect")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("Invalid redirect URL scheme")
+	}
+
+	host := canonicalHost(u.Hostname())
+	if host == "" {
+		return nil, errors.New("Invalid redirect URL host")
+	}
+	if host == canonicalHost((&url.URL{Host: r.Host}).Hostname()) {
+		return u, nil
+	}
+	if match, _ := matchCookieDomains(host); match {
+		return u, nil
+	}
+	for _, allowed := range config().RedirectHosts {
+		allowed = strings.TrimSpace(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			allowed = "*." + canonicalHost(allowed[2:])
+		} else {
+			allowed = canonicalHost(allowed)
+		}
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return u, nil
+		}
+	}
+
+	return nil, errors.New("Redirect host does not match the request, a cookie domain or a redirect-host")
+}
+
 // MakeState generates a state value
 func MakeState(r *http.Request, p provider.Provider, nonce string) string {
 	return fmt.Sprintf("%s:%s:%s", nonce, p.Name(), returnUrl(r))
 }
 
+// encryptState encrypts the provider and return URL in the state, leaving the
+// nonce readable so the CSRF cookie can be found
+func encryptState(state string) (string, error) {
+	params, err := encryptValue("login-state", []byte(state[33:]))
+	if err != nil {
+		return "", err
+	}
+	return state[:33] + params, nil
+}
+
 // ValidateState checks whether the state is of right length.
 func ValidateState(state string) error {
 	if len(state) < 34 {
@@ -367,9 +679,9 @@ func csrfCookieDomain(r *http.Request) string {
 // Return matching cookie domain if exists
 func matchCookieDomains(domain string) (bool, string) {
 	// Remove port
-	p := strings.Split(domain, ":")
+	p := strings.Split(canonicalHost(domain), ":")
 
-	for _, d := range config.CookieDomains {
+	for _, d := range config().CookieDomains {
 		if d.Match(p[0]) {
 			return true, d.Domain
 		}
@@ -380,20 +692,42 @@ func matchCookieDomains(domain string) (bool, string) {
 
 // Create cookie hmac
 func cookieSignature(r *http.Request, user *provider.User, expires string) (string, error) {
-	hash := hmac.New(sha256.New, config.Secret)
-	hash.Write([]byte(cookieDomain(r)))
+	data, err := cookieSignatureData(r, user, expires)
+	if err != nil {
+		return "", err
+	}
+
+	mac, err := activeSigner().MAC(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(mac), nil
+}
+
+// cookieSignatureData returns the data signed by the cookie signature
+func cookieSignatureData(r *http.Request, user *provider.User, expires string) ([]byte, error) {
+	data := []byte(cookieDomain(r))
 	uuidBytes, err := user.UUID.MarshalBinary()
 	if err != nil {
-		return "", errors.New("unable to convert UUID to bytes")
+		return nil, errors.New("unable to convert UUID to bytes")
 	}
-	hash.Write(uuidBytes)
-	hash.Write([]byte(expires))
-	return base64.URLEncoding.EncodeToString(hash.Sum(nil)), nil
+	data = append(data, uuidBytes...)
+	data = append(data, expires...)
+	return data, nil
 }
 
 // Get cookie expiry
 func cookieExpiry() time.Time {
-	return time.Now().Local().Add(config.Lifetime)
+	return time.Now().Local().Add(cookieLifetime())
+}
+
+// cookieLifetime is the cookie lifetime, unless the session-ttl ends the
+// session before then
+func cookieLifetime() time.Duration {
+	if config().SessionTTL > 0 && config().SessionTTL < config().Lifetime {
+		return config().SessionTTL
+	}
+	return config().Lifetime
 }
 
 // CookieDomain holds cookie domain info
@@ -402,20 +736,29 @@ type CookieDomain struct {
 	DomainLen    int
 	SubDomain    string
 	SubDomainLen int
+	PublicSuffix bool
 }
 
 // NewCookieDomain creates a new CookieDomain from the given domain string
 func NewCookieDomain(domain string) *CookieDomain {
+	domain = canonicalHost(domain)
 	return &CookieDomain{
 		Domain:       domain,
 		DomainLen:    len(domain),
 		SubDomain:    fmt.Sprintf(".%s", domain),
 		SubDomainLen: len(domain) + 1,
+		PublicSuffix: isPublicSuffix(domain),
 	}
 }
 
 // Match checks if the given host matches this CookieDomain
 func (c *CookieDomain) Match(host string) bool {
+	// Browsers won't accept a cookie on a public suffix, so it can't span the
+	// separately registered domains beneath it
+	if c.PublicSuffix {
+		return false
+	}
+
 	// Exact domain match?
 	if host == c.Domain {
 		return true
@@ -432,6 +775,9 @@ func (c *CookieDomain) Match(host string) bool {
 // UnmarshalFlag converts a string to a CookieDomain
 func (c *CookieDomain) UnmarshalFlag(value string) error {
 	*c = *NewCookieDomain(value)
+	if c.PublicSuffix {
+		return fmt.Errorf("%q is a public suffix, browsers will refuse cookies set on it", value)
+	}
 	return nil
 }
 
@@ -448,8 +794,11 @@ type CookieDomains []CookieDomain
 func (c *CookieDomains) UnmarshalFlag(value string) error {
 	if len(value) > 0 {
 		for _, d := range strings.Split(value, ",") {
-			cookieDomain := NewCookieDomain(d)
-			*c = append(*c, *cookieDomain)
+			var cookieDomain CookieDomain
+			if err := cookieDomain.UnmarshalFlag(d); err != nil {
+				return err
+			}
+			*c = append(*c, cookieDomain)
 		}
 	}
 	return nil
@@ -4,10 +4,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/thomseddon/traefik-forward-auth/internal/provider"
 )
 
@@ -17,7 +22,8 @@ import (
 
 func TestAuthValidateCookie(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	parsed, _ := NewConfig([]string{})
+	setConfig(parsed)
 	r, _ := http.NewRequest("GET", "http://example.com", nil)
 	c := &http.Cookie{}
 
@@ -38,32 +44,42 @@ func TestAuthValidateCookie(t *testing.T) {
 		assert.Equal("Invalid cookie format", err.Error())
 	}
 
+	// Should catch unknown user
+	user := &provider.User{UUID: uuid.New(), Email: "test@test.com"}
+	c, _ = MakeCookie(r, user)
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("user is unknown", err.Error())
+	}
+
 	// Should catch invalid mac
-	c.Value = "MQ==|2|3"
+	ensureUser(user)
+	c.Value = "MQ==|2|" + user.UUID.String()
 	_, err = ValidateCookie(r, c)
 	if assert.Error(err) {
 		assert.Equal("Invalid cookie mac", err.Error())
 	}
 
 	// Should catch expired
-	config.Lifetime = time.Second * time.Duration(-1)
-	//c = MakeCookie(r, "test@test.com")
+	config().Lifetime = time.Second * time.Duration(-1)
+	c, _ = MakeCookie(r, user)
 	_, err = ValidateCookie(r, c)
 	if assert.Error(err) {
 		assert.Equal("Cookie has expired", err.Error())
 	}
 
 	// Should accept valid cookie
-	config.Lifetime = time.Second * time.Duration(10)
-	//c = MakeCookie(r, "test@test.com")
-	email, err := ValidateCookie(r, c)
+	config().Lifetime = time.Second * time.Duration(10)
+	c, _ = MakeCookie(r, user)
+	validUser, err := ValidateCookie(r, c)
 	assert.Nil(err, "valid request should not return an error")
-	assert.Equal("test@test.com", email, "valid request should return user email")
+	assert.Equal("test@test.com", validUser.Email, "valid request should return user email")
 }
 
 func TestAuthValidateEmail(t *testing.T) {
 	//assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	parsed, _ := NewConfig([]string{})
+	setConfig(parsed)
 
 	// Should allow any with no whitelist/domain is specified
 	//v := ValidateUser("test@test.com", "default")
@@ -72,15 +88,15 @@ func TestAuthValidateEmail(t *testing.T) {
 	//assert.True(v, "should allow any domain if email domain is not defined")
 
 	// Should allow matching domain
-	config.Domains = []string{"test.com"}
+	config().Domains = []string{"test.com"}
 	//v = ValidateUser("one@two.com", "default")
 	//assert.False(v, "should not allow user from another domain")
 	//v = ValidateUser("test@test.com", "default")
 	//assert.True(v, "should allow user from allowed domain")
 
 	// Should allow matching whitelisted email address
-	config.Domains = []string{}
-	config.Whitelist = []string{"test@test.com"}
+	config().Domains = []string{}
+	config().Whitelist = []string{"test@test.com"}
 	//v = ValidateUser("one@two.com", "default")
 	//assert.False(v, "should not allow user not in whitelist")
 	//v = ValidateUser("test@test.com", "default")
@@ -88,9 +104,9 @@ func TestAuthValidateEmail(t *testing.T) {
 
 	// Should allow only matching email address when
 	// MatchWhitelistOrDomain is disabled
-	config.Domains = []string{"example.com"}
-	config.Whitelist = []string{"test@test.com"}
-	config.MatchWhitelistOrDomain = false
+	config().Domains = []string{"example.com"}
+	config().Whitelist = []string{"test@test.com"}
+	config().MatchWhitelistOrDomain = false
 	//v = ValidateUser("one@two.com", "default")
 	//assert.False(v, "should not allow user not in either")
 	//v = ValidateUser("test@example.com", "default")
@@ -100,9 +116,9 @@ func TestAuthValidateEmail(t *testing.T) {
 
 	// Should allow either matching domain or email address when
 	// MatchWhitelistOrDomain is enabled
-	config.Domains = []string{"example.com"}
-	config.Whitelist = []string{"test@test.com"}
-	config.MatchWhitelistOrDomain = true
+	config().Domains = []string{"example.com"}
+	config().Whitelist = []string{"test@test.com"}
+	config().MatchWhitelistOrDomain = true
 	//v = ValidateUser("one@two.com", "default")
 	//assert.False(v, "should not allow user not in either")
 	//v = ValidateUser("test@example.com", "default")
@@ -113,10 +129,10 @@ func TestAuthValidateEmail(t *testing.T) {
 	// Rule testing
 
 	// Should use global whitelist/domain when not specified on rule
-	config.Domains = []string{"example.com"}
-	config.Whitelist = []string{"test@test.com"}
-	config.Rules = map[string]*Rule{"test": NewRule()}
-	config.MatchWhitelistOrDomain = true
+	config().Domains = []string{"example.com"}
+	config().Whitelist = []string{"test@test.com"}
+	config().Rules = map[string]*Rule{"test": NewRule()}
+	config().MatchWhitelistOrDomain = true
 	//v = ValidateUser("one@two.com", "test")
 	//assert.False(v, "should not allow user not in either")
 	//v = ValidateUser("test@example.com", "test")
@@ -125,12 +141,12 @@ func TestAuthValidateEmail(t *testing.T) {
 	//assert.True(v, "should allow user in global whitelist")
 
 	// Should allow matching domain in rule
-	config.Domains = []string{"testglobal.com"}
-	config.Whitelist = []string{}
+	config().Domains = []string{"testglobal.com"}
+	config().Whitelist = []string{}
 	rule := NewRule()
-	config.Rules = map[string]*Rule{"test": rule}
+	config().Rules = map[string]*Rule{"test": rule}
 	rule.Domains = []string{"testrule.com"}
-	config.MatchWhitelistOrDomain = false
+	config().MatchWhitelistOrDomain = false
 	//v = ValidateUser("one@two.com", "test")
 	//assert.False(v, "should not allow user from another domain")
 	//v = ValidateUser("one@testglobal.com", "test")
@@ -139,12 +155,12 @@ func TestAuthValidateEmail(t *testing.T) {
 	//assert.True(v, "should allow user from allowed domain")
 
 	// Should allow matching whitelist in rule
-	config.Domains = []string{}
-	config.Whitelist = []string{"test@testglobal.com"}
+	config().Domains = []string{}
+	config().Whitelist = []string{"test@testglobal.com"}
 	rule = NewRule()
-	config.Rules = map[string]*Rule{"test": rule}
+	config().Rules = map[string]*Rule{"test": rule}
 	rule.Whitelist = []string{"test@testrule.com"}
-	config.MatchWhitelistOrDomain = false
+	config().MatchWhitelistOrDomain = false
 	//v = ValidateUser("one@two.com", "test")
 	//assert.False(v, "should not allow user from another domain")
 	//v = ValidateUser("test@testglobal.com", "test")
@@ -154,13 +170,13 @@ func TestAuthValidateEmail(t *testing.T) {
 
 	// Should allow only matching email address when
 	// MatchWhitelistOrDomain is disabled
-	config.Domains = []string{"exampleglobal.com"}
-	config.Whitelist = []string{"test@testglobal.com"}
+	config().Domains = []string{"exampleglobal.com"}
+	config().Whitelist = []string{"test@testglobal.com"}
 	rule = NewRule()
-	config.Rules = map[string]*Rule{"test": rule}
+	config().Rules = map[string]*Rule{"test": rule}
 	rule.Domains = []string{"examplerule.com"}
 	rule.Whitelist = []string{"test@testrule.com"}
-	config.MatchWhitelistOrDomain = false
+	config().MatchWhitelistOrDomain = false
 	//assert.False(v, "should not allow user not in either")
 	/*v = ValidateUser("one@two.com", "test")
 	v = ValidateUser("test@testglobal.com", "test")
@@ -174,13 +190,13 @@ func TestAuthValidateEmail(t *testing.T) {
 
 	// Should allow either matching domain or email address when
 	// MatchWhitelistOrDomain is enabled
-	config.Domains = []string{"exampleglobal.com"}
-	config.Whitelist = []string{"test@testglobal.com"}
+	config().Domains = []string{"exampleglobal.com"}
+	config().Whitelist = []string{"test@testglobal.com"}
 	rule = NewRule()
-	config.Rules = map[string]*Rule{"test": rule}
+	config().Rules = map[string]*Rule{"test": rule}
 	rule.Domains = []string{"examplerule.com"}
 	rule.Whitelist = []string{"test@testrule.com"}
-	config.MatchWhitelistOrDomain = true
+	config().MatchWhitelistOrDomain = true
 	//v = ValidateUser("one@two.com", "test")
 	//assert.False(v, "should not allow user not in either")
 	//v = ValidateUser("test@testglobal.com", "test")
@@ -193,6 +209,112 @@ func TestAuthValidateEmail(t *testing.T) {
 	//assert.True(v, "should allow user in whitelist")
 }
 
+func TestAuthValidateUserDirectory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	directory, err := NewUserDirectory(filepath.Join(t.TempDir(), "users.json"))
+	require.Nil(err)
+	_, err = directory.Import([]ImportedUser{{Email: "one@example.com"}}, false, false)
+	require.Nil(err)
+	userDirectory = directory
+	defer func() { userDirectory = nil }()
+
+	// Should not restrict rules without group conditions
+	assert.True(ValidateUser(&provider.User{Email: "one@example.com"}, "default"))
+	assert.True(ValidateUser(&provider.User{Email: "two@example.com"}, "default"))
+	config().Whitelist = []string{"two@example.com"}
+	assert.False(ValidateUser(&provider.User{Email: "one@example.com"}, "default"))
+	assert.True(ValidateUser(&provider.User{Email: "two@example.com"}, "default"))
+
+	// Should allow users in the directory alongside the allowed groups
+	config().AllowedGroups = []string{"staff@example.com"}
+	assert.True(ValidateUser(&provider.User{Email: "one@example.com"}, "default"))
+	assert.True(ValidateUser(&provider.User{Email: "three@example.com", Groups: []string{"staff@example.com"}}, "default"))
+	assert.False(ValidateUser(&provider.User{Email: "four@example.com"}, "default"))
+
+	// Should not apply to rules with their own whitelist
+	config().Rules = map[string]*Rule{
+		"team": {Whitelist: []string{"three@example.com"}},
+		"open": {},
+	}
+	assert.False(ValidateUser(&provider.User{Email: "one@example.com"}, "team"))
+	assert.True(ValidateUser(&provider.User{Email: "three@example.com"}, "team"))
+
+	// Should leave an unrelated rule unaffected
+	config().AllowedGroups = nil
+	config().Whitelist = nil
+	assert.True(ValidateUser(&provider.User{Email: "four@example.com"}, "open"))
+}
+
+func TestAuthValidateUserBlocked(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Domains = []string{"example.com", "contractor.example.net"}
+	config().BlockedUsers = []string{"Compromised@example.com"}
+	config().BlockedDomains = []string{"contractor.example.net"}
+
+	// Should refuse blocked users even if their domain is permitted
+	assert.True(ValidateUser(&provider.User{Email: "one@example.com"}, "default"))
+	assert.False(ValidateUser(&provider.User{Email: "compromised@example.com"}, "default"))
+	assert.False(ValidateUser(&provider.User{Email: "one@contractor.example.net"}, "default"))
+
+	// Should refuse blocked users without any allow list
+	config().Domains = nil
+	assert.False(ValidateUser(&provider.User{Email: "compromised@example.com"}, "default"))
+
+	// Should add the rule's blocked users to the global ones
+	config().Rules = map[string]*Rule{
+		"team": {
+			Whitelist:      []string{"*@example.com", "*@contractor.example.net"},
+			BlockedDomains: []string{"*.example.org"},
+			BlockedUsers:   []string{"two@example.com"},
+		},
+	}
+	assert.True(ValidateUser(&provider.User{Email: "one@example.com"}, "team"))
+	assert.False(ValidateUser(&provider.User{Email: "two@example.com"}, "team"))
+	assert.False(ValidateUser(&provider.User{Email: "compromised@example.com"}, "team"))
+	assert.False(ValidateUser(&provider.User{Email: "one@contractor.example.net"}, "team"))
+	assert.True(ValidateBlocked("one@eng.example.org", "team"))
+	assert.False(ValidateBlocked("one@eng.example.org", "default"))
+
+	// Should parse the rule's blocked users and domains
+	c, err := NewConfig([]string{
+		"--rule.team.action=auth",
+		"--rule.team.rule=Host(`team.example.com`)",
+		"--rule.team.blockedUsers=one@example.com,two@example.com",
+		"--rule.team.blockedDomains=example.org",
+	})
+	require.Nil(t, err)
+	assert.Equal(CommaSeparatedList{"one@example.com", "two@example.com"}, c.Rules["team"].BlockedUsers)
+	assert.Equal(CommaSeparatedList{"example.org"}, c.Rules["team"].BlockedDomains)
+}
+
+func TestAuthSessionHash(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	alice := &provider.User{Email: "alice@example.com", Roles: []string{"dev", "admin"}}
+	bob := &provider.User{Email: "bob@example.com", Roles: []string{"admin", "dev"}}
+
+	// Should be stable and opaque
+	hash := SessionHash(alice, "user")
+	assert.Len(hash, 32)
+	assert.Equal(hash, SessionHash(&provider.User{Email: "alice@example.com"}, "user"))
+	assert.NotContains(hash, "alice")
+
+	// Should vary per user
+	assert.NotEqual(hash, SessionHash(bob, "user"))
+
+	// Should be shared by users with the same roles
+	assert.Equal(SessionHash(alice, "group"), SessionHash(bob, "group"))
+	assert.NotEqual(SessionHash(alice, "group"), SessionHash(&provider.User{Email: "alice@example.com"}, "group"))
+
+	// Should change with the secret
+	config().Secret = []byte("anotherverysecret")
+	assert.NotEqual(hash, SessionHash(alice, "user"))
+}
+
 func TestRedirectUri(t *testing.T) {
 	assert := assert.New(t)
 
@@ -202,7 +324,8 @@ func TestRedirectUri(t *testing.T) {
 	//
 	// No Auth Host
 	//
-	config, _ = NewConfig([]string{})
+	parsed, _ := NewConfig([]string{})
+	setConfig(parsed)
 
 	uri, err := url.Parse(redirectUri(r))
 	assert.Nil(err)
@@ -214,7 +337,7 @@ func TestRedirectUri(t *testing.T) {
 	// With Auth URL but no matching cookie domain
 	// - will not use auth host
 	//
-	config.AuthHost = "auth.example.com"
+	config().AuthHost = "auth.example.com"
 
 	uri, err = url.Parse(redirectUri(r))
 	assert.Nil(err)
@@ -225,8 +348,8 @@ func TestRedirectUri(t *testing.T) {
 	//
 	// With correct Auth URL + cookie domain
 	//
-	config.AuthHost = "auth.example.com"
-	config.CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
+	config().AuthHost = "auth.example.com"
+	config().CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
 
 	// Check url
 	uri, err = url.Parse(redirectUri(r))
@@ -242,8 +365,8 @@ func TestRedirectUri(t *testing.T) {
 	r = httptest.NewRequest("GET", "https://another.com/hello", nil)
 	r.Header.Add("X-Forwarded-Proto", "https")
 
-	config.AuthHost = "auth.example.com"
-	config.CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
+	config().AuthHost = "auth.example.com"
+	config().CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
 
 	// Check url
 	uri, err = url.Parse(redirectUri(r))
@@ -255,7 +378,8 @@ func TestRedirectUri(t *testing.T) {
 
 func TestAuthMakeCookie(t *testing.T) {
 	//assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	parsed, _ := NewConfig([]string{})
+	setConfig(parsed)
 	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
 	r.Header.Add("X-Forwarded-Host", "app.example.com")
 
@@ -281,7 +405,8 @@ func TestAuthMakeCookie(t *testing.T) {
 
 func TestAuthMakeCSRFCookie(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	parsed, _ := NewConfig([]string{})
+	setConfig(parsed)
 	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
 	r.Header.Add("X-Forwarded-Host", "app.example.com")
 
@@ -291,14 +416,14 @@ func TestAuthMakeCSRFCookie(t *testing.T) {
 	assert.Equal("app.example.com", c.Domain)
 
 	// With cookie domain but no auth url
-	config.CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
+	config().CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
 	c = MakeCSRFCookie(r, "12222278901234567890123456789012")
 	assert.Equal("_forward_auth_csrf_122222", c.Name)
 	assert.Equal("app.example.com", c.Domain)
 
 	// With cookie domain and auth url
-	config.AuthHost = "auth.example.com"
-	config.CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
+	config().AuthHost = "auth.example.com"
+	config().CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
 	c = MakeCSRFCookie(r, "12333378901234567890123456789012")
 	assert.Equal("_forward_auth_csrf_123333", c.Name)
 	assert.Equal("example.com", c.Domain)
@@ -306,7 +431,8 @@ func TestAuthMakeCSRFCookie(t *testing.T) {
 
 func TestAuthClearCSRFCookie(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	parsed, _ := NewConfig([]string{})
+	setConfig(parsed)
 	r, _ := http.NewRequest("GET", "http://example.com", nil)
 
 	c := ClearCSRFCookie(r, &http.Cookie{Name: "someCsrfCookie"})
@@ -316,9 +442,73 @@ func TestAuthClearCSRFCookie(t *testing.T) {
 	}
 }
 
+func TestAuthCookieAttributes(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
+	r.Header.Add("X-Forwarded-Host", "app.example.com")
+
+	// Should leave SameSite unset by default
+	w := httptest.NewRecorder()
+	setCookie(w, MakeCSRFCookie(r, "12345678901234567890123456789012"))
+	assert.NotContains(w.Header().Get("Set-Cookie"), "SameSite")
+	assert.NotContains(w.Header().Get("Set-Cookie"), "Partitioned")
+
+	config().CookieSameSite = "lax"
+	assert.Equal(http.SameSiteLaxMode, ClearCookie(r).SameSite)
+
+	// Should partition cookies
+	config().CookieSameSite = "none"
+	config().CookiePartitioned = true
+	w = httptest.NewRecorder()
+	setCookie(w, ClearCookie(r))
+	setCookie(w, MakeProviderCookie(r, "google"))
+	cookies := w.Header()["Set-Cookie"]
+	if assert.Len(cookies, 2) {
+		for _, c := range cookies {
+			assert.Contains(c, "; Secure; SameSite=None; Partitioned")
+		}
+	}
+}
+
+func TestAuthCookieAttributesConfig(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	newConfig := func(args ...string) *Config {
+		hook.Reset()
+		c, err := NewConfig(append([]string{
+			"--secret=veryveryverysecret",
+			"--providers.google.client-id=id",
+			"--providers.google.client-secret=secret",
+		}, args...))
+		assert.Nil(err)
+		c.Validate()
+		return c
+	}
+
+	// Should imply SameSite=None
+	c := newConfig("--cookie-partitioned")
+	assert.Equal("none", c.CookieSameSite)
+	assert.Len(hook.AllEntries(), 0)
+
+	newConfig("--cookie-partitioned", "--cookie-same-site=lax")
+	if assert.Len(hook.AllEntries(), 1) {
+		assert.Equal("\"cookie-partitioned\" requires \"cookie-same-site\" to be none", hook.LastEntry().Message)
+	}
+
+	newConfig("--cookie-same-site=none", "--insecure-cookie")
+	if assert.Len(hook.AllEntries(), 1) {
+		assert.Equal("\"cookie-same-site\" none requires secure cookies, \"insecure-cookie\" must not be set", hook.LastEntry().Message)
+	}
+}
+
 func TestAuthValidateCSRFCookie(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	parsed, _ := NewConfig([]string{})
+	setConfig(parsed)
 	c := &http.Cookie{}
 	state := ""
 
@@ -356,6 +546,115 @@ func TestAuthValidateCSRFCookie(t *testing.T) {
 	assert.Equal("url123", redirect, "valid request should return correct redirect")
 }
 
+func TestAuthValidateRedirect(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	r := httptest.NewRequest("GET", "http://app.example.com/_oauth", nil)
+	r.Host = "app.example.com:8443"
+
+	// Should allow the host of the callback
+	u, err := ValidateRedirect(r, "https://app.example.com:8443/page?q=1")
+	if assert.Nil(err) {
+		assert.Equal("/page", u.Path)
+	}
+
+	// Should refuse other hosts and schemes
+	for _, redirect := range []string{
+		"https://other.example.com/page",
+		"https://app.example.com.evil.com/page",
+		"https://evil.com@evil.com/page",
+		"javascript:alert(1)",
+		"//evil.com/page",
+		"/page",
+	} {
+		_, err = ValidateRedirect(r, redirect)
+		assert.Error(err, redirect)
+	}
+
+	// Should allow cookie domains
+	config().CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
+	_, err = ValidateRedirect(r, "https://other.example.com/page")
+	assert.Nil(err)
+	_, err = ValidateRedirect(r, "https://example.org/page")
+	assert.Error(err)
+
+	// Should allow redirect hosts
+	config().RedirectHosts = CommaSeparatedList{"example.org", "*.example.net"}
+	_, err = ValidateRedirect(r, "https://example.org/page")
+	assert.Nil(err)
+	_, err = ValidateRedirect(r, "https://app.example.net/page")
+	assert.Nil(err)
+	_, err = ValidateRedirect(r, "https://sub.example.org/page")
+	assert.Error(err)
+	_, err = ValidateRedirect(r, "https://example.net/page")
+	assert.Error(err, "wildcards should only match subdomains")
+}
+
+func TestAuthEncryptedCookie(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().EncryptCookies = true
+	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
+	r.Header.Add("X-Forwarded-Host", "app.example.com")
+	user := newTestUser("test@example.com")
+
+	// Should hide the session and expiry
+	c, err := MakeCookie(r, user)
+	assert.Nil(err)
+	assert.NotContains(c.Value, user.UUID.String())
+	assert.NotContains(c.Value, "|")
+	validUser, err := ValidateCookie(r, c)
+	assert.Nil(err)
+	assert.Equal(user.UUID, validUser.UUID)
+
+	// Should refuse tampered cookies
+	tampered := *c
+	tampered.Value = "x" + c.Value
+	_, err = ValidateCookie(r, &tampered)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie format", err.Error())
+	}
+
+	// Should still accept plain cookies, and encrypted ones once disabled
+	config().EncryptCookies = false
+	plain, _ := MakeCookie(r, user)
+	_, err = ValidateCookie(r, plain)
+	assert.Nil(err)
+	_, err = ValidateCookie(r, c)
+	assert.Nil(err)
+}
+
+func TestAuthEncryptedState(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	r := httptest.NewRequest("GET", "http://example.com/secret/page", nil)
+	r.Header.Add("X-Forwarded-Proto", "https")
+	p := provider.Google{}
+	nonce := "12345678901234567890123456789012"
+
+	// Should hide the provider and return url, keeping the nonce readable
+	state, err := encryptState(MakeState(r, &p, nonce))
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(state, nonce+":"))
+	assert.NotContains(state, "google")
+	assert.NotContains(state, "secret")
+
+	c := &http.Cookie{Value: nonce}
+	valid, providerName, redirect, err := ValidateCSRFCookie(c, state)
+	assert.True(valid)
+	assert.Nil(err)
+	assert.Equal("google", providerName)
+	assert.Equal("https://example.com/secret/page", redirect)
+
+	// Should refuse state encrypted with another secret
+	config().Secret = []byte("anotheranothersecret")
+	valid, _, _, err = ValidateCSRFCookie(c, state)
+	assert.False(valid)
+	if assert.Error(err) {
+		assert.Equal("Invalid CSRF state format", err.Error())
+	}
+}
+
 func TestValidateState(t *testing.T) {
 	assert := assert.New(t)
 
@@ -391,6 +690,30 @@ func TestMakeState(t *testing.T) {
 	p3 := provider.GenericOAuth{}
 	state = MakeState(r, &p3, "nonce")
 	assert.Equal("nonce:generic-oauth:http://example.com/hello", state)
+
+	// Should keep the query and a non-standard port
+	r = httptest.NewRequest("GET", "http://example.com:8443/hello?page=2", nil)
+	r.Header.Add("X-Forwarded-Proto", "https")
+	state = MakeState(r, &p, "nonce")
+	assert.Equal("nonce:google:https://example.com:8443/hello?page=2", state)
+}
+
+func TestAuthReturnUrl(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "http://example.com/hello?a=1&b=2", nil)
+	r.Header.Add("X-Forwarded-Proto", "https")
+	assert.Equal("https://example.com/hello?a=1&b=2", returnUrl(r))
+
+	// Should ignore traefik's entrypoint port
+	r.Header.Set("X-Forwarded-Port", "8443")
+	assert.Equal("https://example.com/hello?a=1&b=2", returnUrl(r))
+
+	// Should keep a non-standard port in the host
+	r.Host = "example.com:9000"
+	assert.Equal("https://example.com:9000/hello?a=1&b=2", returnUrl(r))
+	r.Host = "[::1]:9000"
+	assert.Equal("https://[::1]:9000/hello?a=1&b=2", returnUrl(r))
 }
 
 func TestAuthNonce(t *testing.T) {
@@ -423,6 +746,38 @@ func TestAuthCookieDomainMatch(t *testing.T) {
 
 	// Other domain should not match
 	assert.False(cd.Match("test.com"), "other domain should not match")
+
+	// Public suffixes should not match the registrable domains beneath them
+	cd = NewCookieDomain("co.uk")
+	assert.True(cd.PublicSuffix)
+	assert.False(cd.Match("example.co.uk"), "domain under a public suffix should not match")
+	assert.False(cd.Match("co.uk"), "public suffix should not match")
+	cd = NewCookieDomain("github.io")
+	assert.False(cd.Match("user.github.io"), "domain under a private suffix should not match")
+
+	// Registrable domains under a public suffix should match
+	cd = NewCookieDomain("example.co.uk")
+	assert.False(cd.PublicSuffix)
+	assert.True(cd.Match("test.example.co.uk"), "subdomain should match")
+}
+
+func TestAuthCookieDomainUnmarshalFlag(t *testing.T) {
+	assert := assert.New(t)
+	var cd CookieDomain
+
+	assert.Nil(cd.UnmarshalFlag("example.com"))
+	assert.Equal(*NewCookieDomain("example.com"), cd)
+
+	// Should allow single label domains
+	assert.Nil(cd.UnmarshalFlag("localhost"))
+
+	// Should refuse public suffixes
+	for _, domain := range []string{"com", "co.uk", "github.io"} {
+		err := cd.UnmarshalFlag(domain)
+		if assert.Error(err) {
+			assert.Equal("\""+domain+"\" is a public suffix, browsers will refuse cookies set on it", err.Error())
+		}
+	}
 }
 
 func TestAuthCookieDomains(t *testing.T) {
@@ -450,4 +805,11 @@ func TestAuthCookieDomains(t *testing.T) {
 	marshal, err := cds.MarshalFlag()
 	assert.Nil(err)
 	assert.Equal("one.com,two.org", marshal)
+
+	// Should refuse public suffixes
+	cds = CookieDomains{}
+	err = cds.UnmarshalFlag("one.com,co.uk")
+	if assert.Error(err) {
+		assert.Equal("\"co.uk\" is a public suffix, browsers will refuse cookies set on it", err.Error())
+	}
 }
@@ -0,0 +1,310 @@
+package tfa
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Webhook authorizer
+//
+// Rules with an "authorizer" set POST the request context to it once the user
+// has passed the rule's own checks, and honour its decision. The global
+// "authorizer" decides for auth rules without their own and the default
+// action, with the global timeout, cache and fail policy unless the rule sets
+// its own.
+//
+// With the "opa" format the authorizer is an Open Policy Agent decision, e.g.
+// http://opa:8181/v1/data/traefik/authz, queried with the request context as
+// the input so policies can be written in Rego. The decision is either a
+// boolean, or an object in the same shape as a webhook's response, and an
+// undefined decision denies the request
+
+// defaultAuthorizerTimeout is used when the rule doesn't set one
+const defaultAuthorizerTimeout = 2 * time.Second
+
+var authorizerDecisionsTotal = NewCounterVec("authorizer_decisions_total",
+	"Decisions made by webhook authorizers: allow, deny or error (the fail policy was applied)", "rule", "decision")
+
+var authorizerClient = &http.Client{}
+
+// AuthorizerRequest is sent to the authorizer
+type AuthorizerRequest struct {
+	Rule    string                   `json:"rule"`
+	User    AuthorizerUser           `json:"user"`
+	Request AuthorizerRequestContext `json:"request"`
+}
+
+// AuthorizerUser is the user making the request
+type AuthorizerUser struct {
+	Email  string                 `json:"email"`
+	Name   string                 `json:"name,omitempty"`
+	Roles  []string               `json:"roles,omitempty"`
+	Groups []string               `json:"groups,omitempty"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// AuthorizerRequestContext describes the request being authorized
+type AuthorizerRequestContext struct {
+	Method   string              `json:"method"`
+	Host     string              `json:"host"`
+	URI      string              `json:"uri"`
+	Path     string              `json:"path"`
+	Query    map[string][]string `json:"query,omitempty"`
+	SourceIP string              `json:"source_ip"`
+}
+
+// AuthorizerResponse is the authorizer's decision, headers are passed to the
+// backend when the request is allowed
+type AuthorizerResponse struct {
+	Allow   bool              `json:"allow"`
+	Reason  string            `json:"reason,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// opaRequest and opaResponse wrap the request context and decision when
+// querying Open Policy Agent's data API
+type opaRequest struct {
+	Input AuthorizerRequest `json:"input"`
+}
+
+type opaResponse struct {
+	Result *json.RawMessage `json:"result"`
+}
+
+// authorizerCacheSize is the most decisions cached, the least recently used
+// are dropped to make room for new ones
+var authorizerCacheSize = 10000
+
+type authorizerCacheEntry struct {
+	key      string
+	response *AuthorizerResponse
+	expires  time.Time
+}
+
+// authorizerCache holds the cached decisions by key, and in order of use with
+// the most recently used first
+var authorizerCache = struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}{entries: make(map[string]*list.Element), order: list.New()}
+
+// ruleAuthorizer returns the authorizer settings for the rule, or nil if its
+// requests aren't authorized by a webhook
+func ruleAuthorizer(ruleName string) *Rule {
+	rule, ok := config().Rules[ruleName]
+	if ok && rule.Authorizer != "" {
+		return rule
+	}
+	if config().Authorizer == "" {
+		return nil
+	}
+
+	settings := &Rule{
+		Authorizer:           config().Authorizer,
+		AuthorizerTimeout:    config().AuthorizerTimeout,
+		AuthorizerCache:      config().AuthorizerCache,
+		AuthorizerFailPolicy: config().AuthorizerFailPolicy,
+		AuthorizerFormat:     config().AuthorizerFormat,
+	}
+	if ok {
+		if rule.AuthorizerTimeout > 0 {
+			settings.AuthorizerTimeout = rule.AuthorizerTimeout
+		}
+		if rule.AuthorizerCache > 0 {
+			settings.AuthorizerCache = rule.AuthorizerCache
+		}
+		if rule.AuthorizerFailPolicy != "" {
+			settings.AuthorizerFailPolicy = rule.AuthorizerFailPolicy
+		}
+	}
+	return settings
+}
+
+// authorizeWebhook asks the rule's authorizer whether the user may make the
+// request. If the authorizer can't be reached or responds with an error, the
+// rule's fail policy decides and the error is returned alongside the decision
+func authorizeWebhook(r *http.Request, ruleName string, rule *Rule, user *provider.User) (*AuthorizerResponse, error) {
+	body := AuthorizerRequest{
+		Rule: ruleName,
+		User: AuthorizerUser{
+			Email:  user.Email,
+			Name:   user.Name,
+			Roles:  user.Roles,
+			Groups: user.Groups,
+			Claims: user.Claims,
+		},
+		Request: AuthorizerRequestContext{
+			Method:   r.Method,
+			Host:     r.Host,
+			URI:      r.URL.RequestURI(),
+			Path:     r.URL.Path,
+			Query:    r.URL.Query(),
+			SourceIP: originalClientIP(r),
+		},
+	}
+
+	// Check the cache
+	var key string
+	if rule.AuthorizerCache > 0 {
+		key = authorizerCacheKey(rule, body)
+		if res, ok := cachedAuthorizerResponse(key); ok {
+			return res, nil
+		}
+	}
+
+	res, err := callAuthorizer(rule, body)
+	if err != nil {
+		authorizerDecisionsTotal.Inc(ruleName, "error")
+		if rule.AuthorizerFailPolicy == "allow" {
+			return &AuthorizerResponse{Allow: true, Reason: "authorizer unavailable, failing open"}, err
+		}
+		return &AuthorizerResponse{Allow: false, Reason: "authorizer unavailable"}, err
+	}
+
+	if res.Allow {
+		authorizerDecisionsTotal.Inc(ruleName, "allow")
+	} else {
+		authorizerDecisionsTotal.Inc(ruleName, "deny")
+	}
+
+	if key != "" {
+		cacheAuthorizerResponse(key, res, rule.AuthorizerCache)
+	}
+
+	return res, nil
+}
+
+func callAuthorizer(rule *Rule, body AuthorizerRequest) (*AuthorizerResponse, error) {
+	timeout := rule.AuthorizerTimeout
+	if timeout <= 0 {
+		timeout = defaultAuthorizerTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var b []byte
+	var err error
+	if rule.AuthorizerFormat == "opa" {
+		b, err = json.Marshal(opaRequest{Input: body})
+	} else {
+		b, err = json.Marshal(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", rule.Authorizer, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := authorizerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response from authorizer: %s", res.Status)
+	}
+
+	if rule.AuthorizerFormat == "opa" {
+		return decodeOPADecision(res)
+	}
+
+	var decision AuthorizerResponse
+	if err := json.NewDecoder(res.Body).Decode(&decision); err != nil {
+		return nil, errors.New("invalid response from authorizer")
+	}
+
+	return &decision, nil
+}
+
+// decodeOPADecision reads the decision from an Open Policy Agent response,
+// which is either a boolean or an object like the webhook response
+func decodeOPADecision(res *http.Response) (*AuthorizerResponse, error) {
+	var body opaResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, errors.New("invalid response from authorizer")
+	}
+
+	// Policies usually default to deny, but may leave the decision undefined
+	if body.Result == nil {
+		return &AuthorizerResponse{Allow: false, Reason: "policy decision is undefined"}, nil
+	}
+
+	var allow bool
+	if err := json.Unmarshal(*body.Result, &allow); err == nil {
+		return &AuthorizerResponse{Allow: allow}, nil
+	}
+
+	var decision AuthorizerResponse
+	if err := json.Unmarshal(*body.Result, &decision); err != nil {
+		return nil, errors.New("policy decision must be a boolean or an object")
+	}
+	return &decision, nil
+}
+
+// authorizerCacheKey identifies requests that will get the same decision, a
+// different authorizer or format may decide differently so they're part of
+// the key
+func authorizerCacheKey(rule *Rule, body AuthorizerRequest) string {
+	b, _ := json.Marshal(body)
+	sum := sha256.Sum256(append([]byte(rule.Authorizer+"\n"+rule.AuthorizerFormat+"\n"), b...))
+	return hex.EncodeToString(sum[:])
+}
+
+func cachedAuthorizerResponse(key string) (*AuthorizerResponse, bool) {
+	authorizerCache.Lock()
+	defer authorizerCache.Unlock()
+
+	element, ok := authorizerCache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*authorizerCacheEntry)
+	if time.Now().After(entry.expires) {
+		authorizerCache.order.Remove(element)
+		delete(authorizerCache.entries, key)
+		return nil, false
+	}
+	authorizerCache.order.MoveToFront(element)
+	return entry.response, true
+}
+
+func cacheAuthorizerResponse(key string, res *AuthorizerResponse, ttl time.Duration) {
+	authorizerCache.Lock()
+	defer authorizerCache.Unlock()
+
+	entry := &authorizerCacheEntry{
+		key:      key,
+		response: res,
+		expires:  time.Now().Add(ttl),
+	}
+	if element, ok := authorizerCache.entries[key]; ok {
+		element.Value = entry
+		authorizerCache.order.MoveToFront(element)
+		return
+	}
+	authorizerCache.entries[key] = authorizerCache.order.PushFront(entry)
+
+	// Drop the least recently used decisions once the cache is full
+	for authorizerCache.order.Len() > authorizerCacheSize {
+		oldest := authorizerCache.order.Back()
+		authorizerCache.order.Remove(oldest)
+		delete(authorizerCache.entries, oldest.Value.(*authorizerCacheEntry).key)
+	}
+}
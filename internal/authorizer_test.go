@@ -0,0 +1,316 @@
+package tfa
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestAuthorizerDecision(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+
+	var requests []AuthorizerRequest
+	authorizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AuthorizerRequest
+		require.Nil(json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req)
+
+		if req.Request.URI == "/admin" {
+			json.NewEncoder(w).Encode(AuthorizerResponse{Allow: false, Reason: "not an admin"})
+			return
+		}
+		json.NewEncoder(w).Encode(AuthorizerResponse{
+			Allow:   true,
+			Headers: map[string]string{"X-Cost-Center": "1234"},
+		})
+	}))
+	defer authorizer.Close()
+
+	config().Rules = map[string]*Rule{
+		"app": {
+			Action:          "auth",
+			Rule:            "Host(`example.com`)",
+			Provider:        "google",
+			Authorizer:      authorizer.URL,
+			AuthorizerCache: time.Minute,
+		},
+	}
+	user := newTestUser("test@example.com")
+	user.Roles = []string{"staff"}
+
+	// Should pass the request context and honour allow with headers
+	req := newDefaultHttpRequest("/foo?bar=1")
+	req.Header.Set("X-Forwarded-For", "10.0.0.3, 10.0.0.1")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("1234", res.Header.Get("X-Cost-Center"))
+	require.Len(requests, 1)
+	assert.Equal("10.0.0.1", requests[0].Request.SourceIP, "should skip addresses the client sent")
+	assert.Equal("app", requests[0].Rule)
+	assert.Equal("test@example.com", requests[0].User.Email)
+	assert.Equal([]string{"staff"}, requests[0].User.Roles)
+	assert.Equal("GET", requests[0].Request.Method)
+	assert.Equal("example.com", requests[0].Request.Host)
+	assert.Equal("/foo?bar=1", requests[0].Request.URI)
+
+	// Should cache decisions
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("1234", res.Header.Get("X-Cost-Center"))
+	assert.Len(requests, 1, "decision should be cached")
+
+	// Should honour deny
+	req = newDefaultHttpRequest("/admin")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode)
+	assert.Len(requests, 2)
+
+	// Should not be asked about users that fail the rule's own checks
+	config().Rules["app"].Whitelist = []string{"other@example.com"}
+	req = newDefaultHttpRequest("/bar")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+	assert.Len(requests, 2)
+
+	// Should not reuse decisions cached for another authorizer
+	config().Rules["app"].Whitelist = nil
+	config().Rules["app"].Authorizer = authorizer.URL + "/v2"
+	req = newDefaultHttpRequest("/foo?bar=1")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Len(requests, 3)
+}
+
+func TestAuthorizerFailPolicy(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	authorizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		http.Error(w, "Service unavailable", 503)
+	}))
+	defer authorizer.Close()
+
+	config().Rules = map[string]*Rule{
+		"closed": {
+			Action:     "auth",
+			Rule:       "PathPrefix(`/closed`)",
+			Provider:   "google",
+			Authorizer: authorizer.URL,
+		},
+		"open": {
+			Action:               "auth",
+			Rule:                 "PathPrefix(`/open`)",
+			Provider:             "google",
+			Authorizer:           authorizer.URL + "/slow",
+			AuthorizerTimeout:    10 * time.Millisecond,
+			AuthorizerFailPolicy: "allow",
+		},
+	}
+	user := newTestUser("test@example.com")
+	errors := authorizerDecisionsTotal.Value("open", "error")
+
+	// Should deny by default
+	req := newDefaultHttpRequest("/closed")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode)
+
+	// Should allow when failing open, including on timeout
+	req = newDefaultHttpRequest("/open")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal(errors+1, authorizerDecisionsTotal.Value("open", "error"))
+}
+
+func TestAuthorizerGlobal(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+
+	var requests []AuthorizerRequest
+	authorizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+		var req AuthorizerRequest
+		require.Nil(json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req)
+		json.NewEncoder(w).Encode(AuthorizerResponse{Allow: r.URL.Path != "/rule" && req.Request.URI != "/denied"})
+	}))
+	defer authorizer.Close()
+
+	config().Authorizer = authorizer.URL
+	config().Rules = map[string]*Rule{
+		"own": {
+			Action:     "auth",
+			Rule:       "PathPrefix(`/own`)",
+			Provider:   "google",
+			Authorizer: authorizer.URL + "/rule",
+		},
+		"failopen": {
+			Action:               "auth",
+			Rule:                 "PathPrefix(`/failopen`)",
+			Provider:             "google",
+			AuthorizerFailPolicy: "allow",
+		},
+	}
+	user := newTestUser("test@example.com")
+	user.Groups = []string{"eng@example.com"}
+
+	// Should ask the global authorizer about the default action
+	req := newDefaultHttpRequest("/denied")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode)
+	require.Len(requests, 1)
+	assert.Equal("default", requests[0].Rule)
+	assert.Equal([]string{"eng@example.com"}, requests[0].User.Groups)
+
+	// Should use the rule's own authorizer
+	req = newDefaultHttpRequest("/own")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode)
+	require.Len(requests, 2)
+	assert.Equal("own", requests[1].Rule)
+
+	// Should apply the rule's fail policy to the global authorizer
+	config().Authorizer = authorizer.URL + "/down"
+	req = newDefaultHttpRequest("/failopen")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode)
+}
+
+func TestAuthorizerOPA(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+
+	var inputs []AuthorizerRequest
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body opaRequest
+		require.Nil(json.NewDecoder(r.Body).Decode(&body))
+		inputs = append(inputs, body.Input)
+
+		switch body.Input.Request.Path {
+		case "/allowed":
+			w.Write([]byte(`{"result": true}`))
+		case "/denied":
+			w.Write([]byte(`{"result": false}`))
+		case "/headers":
+			w.Write([]byte(`{"result": {"allow": true, "headers": {"X-Tenant": "` + body.Input.Request.Query["tenant"][0] + `"}}}`))
+		case "/invalid":
+			w.Write([]byte(`{"result": "yes"}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer opa.Close()
+
+	config().Authorizer = opa.URL + "/v1/data/traefik/authz"
+	config().AuthorizerFormat = "opa"
+	user := newTestUser("test@example.com")
+	user.Roles = []string{"staff"}
+
+	// Should query the policy with the request context as input
+	req := newDefaultHttpRequest("/allowed")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	require.Len(inputs, 1)
+	assert.Equal("default", inputs[0].Rule)
+	assert.Equal([]string{"staff"}, inputs[0].User.Roles)
+	assert.Equal("/allowed", inputs[0].Request.Path)
+
+	// Should honour boolean denials
+	req = newDefaultHttpRequest("/denied")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode)
+
+	// Should accept decision objects with headers
+	req = newDefaultHttpRequest("/headers?tenant=acme")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("acme", res.Header.Get("X-Tenant"))
+
+	// Should deny undefined decisions
+	req = newDefaultHttpRequest("/undefined")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode)
+
+	// Should apply the fail policy to invalid decisions
+	config().AuthorizerFailPolicy = "allow"
+	req = newDefaultHttpRequest("/invalid")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+
+	// Should parse the rule's format
+	c2, err := NewConfig([]string{
+		"--rule.app.action=auth",
+		"--rule.app.rule=Host(`app.example.com`)",
+		"--rule.app.authorizer=http://opa:8181/v1/data/app/allow",
+		"--rule.app.authorizerFormat=opa",
+	})
+	require.Nil(err)
+	assert.Equal("opa", c2.Rules["app"].AuthorizerFormat)
+	assert.Nil(c2.Rules["app"].Validate(config()))
+	c2.Rules["app"].AuthorizerFormat = "rego"
+	assert.NotNil(c2.Rules["app"].Validate(config()))
+}
+
+func TestAuthorizerCache(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	previous := authorizerCacheSize
+	authorizerCacheSize = 2
+	defer func() { authorizerCacheSize = previous }()
+
+	rule := &Rule{Authorizer: "http://authorizer.example.com"}
+	body := func(path string) AuthorizerRequest {
+		return AuthorizerRequest{Rule: "app", Request: AuthorizerRequestContext{Path: path}}
+	}
+	a := authorizerCacheKey(rule, body("/a"))
+	b := authorizerCacheKey(rule, body("/b"))
+	c := authorizerCacheKey(rule, body("/c"))
+	allow := &AuthorizerResponse{Allow: true}
+
+	// Should drop the least recently used decisions once full
+	cacheAuthorizerResponse(a, allow, time.Minute)
+	cacheAuthorizerResponse(b, allow, time.Minute)
+	_, ok := cachedAuthorizerResponse(a)
+	assert.True(ok)
+	cacheAuthorizerResponse(c, allow, time.Minute)
+	_, ok = cachedAuthorizerResponse(b)
+	assert.False(ok, "least recently used decision should be dropped")
+	_, ok = cachedAuthorizerResponse(a)
+	assert.True(ok)
+	_, ok = cachedAuthorizerResponse(c)
+	assert.True(ok)
+
+	// Should not return expired decisions
+	cacheAuthorizerResponse(a, allow, -time.Second)
+	_, ok = cachedAuthorizerResponse(a)
+	assert.False(ok)
+
+	// Should key decisions by the authorizer's format
+	opa := &Rule{Authorizer: rule.Authorizer, AuthorizerFormat: "opa"}
+	assert.NotEqual(a, authorizerCacheKey(opa, body("/a")))
+}
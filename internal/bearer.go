@@ -0,0 +1,78 @@
+package tfa
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Bearer tokens
+//
+// When "bearer-auth" is set, CLI tools and apps that can't follow a redirect
+// to log in may instead send an access token from the rule's provider in the
+// Authorization header. The token is checked with the provider on every
+// request, no session or cookie is created
+
+// bearerToken returns the token in the Authorization header, if any, or for
+// gRPC calls in one of the "grpc-token-metadata" keys
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		if isGRPCRequest(r) {
+			return grpcMetadataToken(r)
+		}
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// bearerUser verifies the token with the first of the providers able to,
+// returning false if none of them can verify tokens. The user is nil if the
+// token is invalid, an error is returned if it couldn't be checked
+func (s *Server) bearerUser(logger *logrus.Entry, r *http.Request, providers []string, token string) (*provider.User, bool, error) {
+	for _, name := range providers {
+		p, err := config().GetConfiguredProvider(name)
+		if err != nil {
+			continue
+		}
+		verifier, ok := p.(provider.BearerVerifier)
+		if !ok {
+			continue
+		}
+
+		if err := waitProviderBudget(name, "bearer", false); err != nil {
+			return nil, true, err
+		}
+		start := time.Now()
+		user, err := verifier.VerifyBearer(r.Context(), token)
+		observeProviderRequest(name, "bearer", start, err)
+		traceProviderRequest(r, name, "bearer", start, err)
+		if err != nil {
+			traceCheck(r, "bearer", "invalid token for "+name)
+			logger.WithFields(logrus.Fields{
+				"provider": name,
+				"error":    err,
+			}).Warn("Invalid bearer token")
+			return nil, true, nil
+		}
+
+		traceCheck(r, "bearer", "verified by "+name)
+		user.Email = normalizeEmail(user.Email)
+		claims := user.Claims
+		addClaimRoles(user, claims)
+		setProfile(user, claims)
+		keepCustomClaims(user)
+		if roleMap != nil {
+			roleMap.Apply(user)
+		}
+		if userDirectory != nil {
+			userDirectory.Apply(user)
+		}
+		return user, true, nil
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,105 @@
+package tfa
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestBearerToken(t *testing.T) {
+	assert := assert.New(t)
+
+	req := newDefaultHttpRequest("/foo")
+	assert.Equal("", bearerToken(req))
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	assert.Equal("", bearerToken(req))
+	req.Header.Set("Authorization", "bearer abc.def")
+	assert.Equal("abc.def", bearerToken(req))
+}
+
+func TestBearerAuth(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().BearerAuth = true
+	config().Whitelist = []string{"cli@example.com"}
+	config().Headers = []string{"X-Auth-Roles:roles"}
+	config().RolesClaims = []string{"groups"}
+
+	// Setup an OIDC provider that can introspect tokens
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/introspect" {
+			r.ParseForm()
+			switch r.PostForm.Get("token") {
+			case "valid":
+				fmt.Fprint(w, `{"active":true,"sub":"1","email":"cli@example.com","groups":["ops"],"aud":"api"}`)
+			case "other":
+				fmt.Fprint(w, `{"active":true,"sub":"2","email":"other@example.com","aud":"api"}`)
+			default:
+				fmt.Fprint(w, `{"active":false}`)
+			}
+			return
+		}
+		fmt.Fprint(w, `{
+			"issuer":"`+server.URL+`",
+			"authorization_endpoint":"`+server.URL+`/auth",
+			"token_endpoint":"`+server.URL+`/token",
+			"jwks_uri":"`+server.URL+`/jwks",
+			"introspection_endpoint":"`+server.URL+`/introspect"
+		}`)
+	}))
+	defer server.Close()
+	config().DefaultProvider = "oidc"
+	config().Providers.OIDC.IssuerURL = server.URL
+	config().Providers.OIDC.ClientID = "id"
+	config().Providers.OIDC.ClientSecret = "secret"
+	config().Providers.OIDC.BearerAudience = "api"
+	require.Nil(config().Providers.OIDC.Setup())
+
+	// Should authenticate with a valid token
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("Authorization", "Bearer valid")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("cli@example.com", res.Header.Get("X-Forwarded-User"))
+	assert.Equal("ops", res.Header.Get("X-Auth-Roles"))
+	assert.Empty(res.Cookies(), "should not create a session")
+
+	// Should refuse invalid tokens rather than redirect to log in
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("Authorization", "Bearer revoked")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Equal(`Bearer error="invalid_token"`, res.Header.Get("WWW-Authenticate"))
+
+	// Should check the user is permitted
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("Authorization", "Bearer other")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+
+	// Should ignore tokens unless enabled
+	config().BearerAuth = false
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("Authorization", "Bearer valid")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+
+	// Should fall back to logging in for providers that can't verify tokens
+	config().BearerAuth = true
+	config().DefaultProvider = "google"
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("Authorization", "Bearer valid")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+}
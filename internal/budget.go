@@ -0,0 +1,96 @@
+package tfa
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Provider request budget
+//
+// When "provider-request-rate" is set, requests to providers share a token
+// bucket, so a burst of logins or session renewals, e.g. after a restart,
+// doesn't run into the provider's own rate limits. Requests made for a user
+// queue for up to "provider-request-max-wait" for their turn and fail beyond
+// it, background renewals and consent checks aren't queued, they're skipped
+// and tried again later
+
+var errProviderBudgetExhausted = errors.New("provider request budget exhausted")
+
+var (
+	providerRequestsQueuedTotal = NewCounterVec("provider_requests_queued_total",
+		"Requests to the provider that waited for the request budget", "provider", "operation")
+	providerRequestsShedTotal = NewCounterVec("provider_requests_shed_total",
+		"Requests to the provider not made because the request budget was exhausted", "provider", "operation")
+)
+
+// providerBudget is set when "provider-request-rate" is configured
+var providerBudget *RequestBudget
+
+// RequestBudget is a token bucket, refilled at rate tokens per second up to
+// burst
+type RequestBudget struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRequestBudget creates a full bucket
+func NewRequestBudget(rate float64, burst int) *RequestBudget {
+	return &RequestBudget{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Reserve takes a token, returning how long to wait until it may be used. No
+// token is taken, and false is returned, if that would be longer than maxWait
+func (b *RequestBudget) Reserve(maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	// Tokens go negative as requests queue, each waiting for those ahead
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+
+	b.tokens--
+	return wait, true
+}
+
+// waitProviderBudget waits for the turn of a request to the provider,
+// returning errProviderBudgetExhausted if it shouldn't be made. Background
+// requests are never queued
+func waitProviderBudget(providerName, operation string, background bool) error {
+	if providerBudget == nil {
+		return nil
+	}
+
+	maxWait := config().ProviderRequestMaxWait
+	if background {
+		maxWait = 0
+	}
+	wait, ok := providerBudget.Reserve(maxWait)
+	if !ok {
+		providerRequestsShedTotal.Inc(providerName, operation)
+		return errProviderBudgetExhausted
+	}
+	if wait > 0 {
+		providerRequestsQueuedTotal.Inc(providerName, operation)
+		time.Sleep(wait)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package tfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestRequestBudgetReserve(t *testing.T) {
+	assert := assert.New(t)
+	budget := NewRequestBudget(10, 2)
+
+	// Should allow the burst at once
+	for i := 0; i < 2; i++ {
+		wait, ok := budget.Reserve(0)
+		assert.True(ok)
+		assert.Equal(time.Duration(0), wait)
+	}
+
+	// Should shed requests that can't wait
+	_, ok := budget.Reserve(0)
+	assert.False(ok)
+
+	// Should queue requests behind each other
+	wait, ok := budget.Reserve(time.Second)
+	assert.True(ok)
+	assert.InDelta(100*time.Millisecond, wait, float64(10*time.Millisecond))
+	wait, ok = budget.Reserve(time.Second)
+	assert.True(ok)
+	assert.InDelta(200*time.Millisecond, wait, float64(10*time.Millisecond))
+
+	// Should shed requests that would wait too long, without taking a token
+	_, ok = budget.Reserve(250 * time.Millisecond)
+	assert.False(ok)
+	wait, ok = budget.Reserve(time.Second)
+	assert.True(ok)
+	assert.InDelta(300*time.Millisecond, wait, float64(10*time.Millisecond))
+}
+
+func TestWaitProviderBudget(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().ProviderRequestMaxWait = time.Second
+	defer func() { providerBudget = nil }()
+
+	// Should not limit without a budget
+	assert.Nil(waitProviderBudget("google", "refresh", true))
+
+	providerBudget = NewRequestBudget(20, 1)
+	assert.Nil(waitProviderBudget("google", "token_exchange", false))
+
+	// Should skip background requests rather than queue them
+	assert.Equal(errProviderBudgetExhausted, waitProviderBudget("google", "refresh", true))
+
+	// Should queue foreground requests
+	start := time.Now()
+	assert.Nil(waitProviderBudget("google", "token_exchange", false))
+	assert.True(time.Since(start) >= 40*time.Millisecond, "should wait for a token")
+}
+
+func TestServerProviderBudgetExhausted(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().ProviderRequestMaxWait = 0
+	providerBudget = NewRequestBudget(0.001, 1)
+	providerBudget.Reserve(0)
+	defer func() { providerBudget = nil }()
+
+	// Should refuse logins, rather than queue them, when the budget is exhausted
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(503, res.StatusCode)
+}
@@ -0,0 +1,57 @@
+package tfa
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net/http"
+)
+
+// Canary rollout
+//
+// Rules with "canary" set are only enforced for that percentage of clients,
+// the rest bypass authentication as if the rule's action were "allow". Clients
+// are assigned to a bucket by hashing their address or session, so each
+// client consistently gets the same treatment and raising the percentage only
+// adds clients
+
+var canaryRequestsTotal = NewCounterVec("canary_requests_total",
+	"Requests to canary rules, by whether the rule was enforced or bypassed", "rule", "decision")
+
+// canaryEnforced reports whether the rule should be enforced for the request
+func canaryEnforced(r *http.Request, ruleName string) bool {
+	rule, ok := config().Rules[ruleName]
+	if !ok || rule.Canary <= 0 || rule.Canary >= 100 {
+		return true
+	}
+
+	enforced := canaryBucket(ruleName, canaryKey(r, rule)) < rule.Canary
+	if enforced {
+		canaryRequestsTotal.Inc(ruleName, "enforced")
+		traceCheck(r, "canary", "enforced")
+	} else {
+		canaryRequestsTotal.Inc(ruleName, "bypassed")
+		traceCheck(r, "canary", "bypassed")
+	}
+	return enforced
+}
+
+// canaryKey identifies the client, by session if "canaryKey" is "session" and
+// the client has one, otherwise by the address behind the trusted proxies, so
+// clients can't pick their bucket with X-Forwarded-For
+func canaryKey(r *http.Request, rule *Rule) string {
+	if rule.CanaryKey == "session" {
+		if c, err := r.Cookie(config().CookieName); err == nil {
+			if session, _, err := parseCookie(r, c); err == nil {
+				return session.String()
+			}
+		}
+	}
+	return originalClientIP(r)
+}
+
+// canaryBucket assigns the key a bucket from 0 to 99, keys are bucketed
+// independently for each rule
+func canaryBucket(ruleName, key string) int {
+	sum := sha256.Sum256([]byte(ruleName + "|" + key))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
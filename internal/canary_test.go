@@ -0,0 +1,96 @@
+package tfa
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestCanaryBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should be stable
+	assert.Equal(canaryBucket("app", "10.0.0.1"), canaryBucket("app", "10.0.0.1"))
+
+	// Should spread keys across buckets
+	buckets := map[int]bool{}
+	for i := 0; i < 1000; i++ {
+		bucket := canaryBucket("app", fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		assert.True(bucket >= 0 && bucket < 100)
+		buckets[bucket] = true
+	}
+	assert.Greater(len(buckets), 90)
+}
+
+func TestCanaryRollout(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"app": {
+			Action:   "auth",
+			Rule:     "Host(`example.com`)",
+			Provider: "google",
+			Canary:   20,
+		},
+	}
+
+	enforcedAt := func(percent int) map[string]bool {
+		config().Rules["app"].Canary = percent
+		enforced := map[string]bool{}
+		for i := 0; i < 200; i++ {
+			ip := fmt.Sprintf("10.0.0.%d", i)
+			req := newDefaultHttpRequest("/foo")
+			req.Header.Set("X-Forwarded-For", ip)
+			res, _ := doHttpRequest(req, nil)
+			if res.StatusCode == 307 {
+				enforced[ip] = true
+			} else {
+				assert.Equal(200, res.StatusCode, "clients outside the canary should be allowed")
+			}
+		}
+		return enforced
+	}
+
+	// Should only enforce for a proportion of clients
+	twenty := enforcedAt(20)
+	assert.InDelta(40, len(twenty), 25)
+
+	// Should only add clients as the percentage increases
+	fifty := enforcedAt(50)
+	assert.InDelta(100, len(fifty), 30)
+	for ip := range twenty {
+		assert.True(fifty[ip], "client enforced at 20%% should be enforced at 50%%")
+	}
+
+	// Should enforce for everyone at 100%
+	assert.Len(enforcedAt(100), 200)
+}
+
+func TestCanarySessionKey(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	rule := &Rule{Action: "auth", Canary: 50, CanaryKey: "session"}
+	config().Rules = map[string]*Rule{"app": rule}
+
+	// Should use the session when the client has one
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	user := newTestUser("test@example.com")
+	c, _ := MakeCookie(req, user)
+	assert.Equal("10.0.0.1", canaryKey(req, rule))
+	req.AddCookie(c)
+	assert.Equal(user.UUID.String(), canaryKey(req, rule))
+
+	// Should use the address otherwise
+	rule.CanaryKey = "ip"
+	assert.Equal("10.0.0.1", canaryKey(req, rule))
+
+	// Should ignore addresses the client added to X-Forwarded-For
+	req.Header.Set("X-Forwarded-For", "10.0.0.9, 10.0.0.1")
+	assert.Equal("10.0.0.1", canaryKey(req, rule))
+}
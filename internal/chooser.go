@@ -0,0 +1,100 @@
+package tfa
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Provider chooser
+
+var chooserTemplate = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 24em; margin: 4em auto; text-align: center; }
+.logo { max-width: 100%; max-height: 6em; }
+a { display: block; margin: 0.5em 0; padding: 0.75em; border: 1px solid #ccc; border-radius: 4px; color: inherit; text-decoration: none; }
+a:hover { background: #f4f4f4; }
+{{.CSS}}
+</style>
+</head>
+<body>
+{{if .Logo}}<img class="logo" src="{{.Logo}}" alt="">
+{{end}}<h1>{{.Title}}</h1>
+{{range .Choices}}<a class="provider" href="{{.URL}}">Log in with {{.Label}}</a>
+{{end}}</body>
+</html>
+`))
+
+// loginBranding is how the pages shown while logging in are branded, with
+// the "login-title", "login-logo" and "login-css"
+type loginBranding struct {
+	Title string
+	Logo  string
+	CSS   template.CSS
+}
+
+func newLoginBranding() loginBranding {
+	return loginBranding{
+		Title: config().LoginTitle,
+		Logo:  config().LoginLogo,
+		CSS:   template.CSS(config().loginCSS),
+	}
+}
+
+type providerChoice struct {
+	Label string
+	URL   string
+}
+
+// chooseProvider renders a page allowing the user to choose which of the given
+// providers to log in with
+func (s *Server) chooseProvider(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, providers []string) {
+	var choices []providerChoice
+	for _, name := range providers {
+		q := url.Values{}
+		q.Set("provider", name)
+		q.Set("redirect", r.URL.RequestURI())
+		label, ok := config().loginProviderLabels[name]
+		if !ok {
+			label = name
+		}
+		choices = append(choices, providerChoice{
+			Label: label,
+			URL:   config().Path + "/login?" + q.Encode(),
+		})
+	}
+
+	logger.WithField("providers", providers).Debug("Asking user to choose provider")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(401)
+	err := chooserTemplate.Execute(w, struct {
+		loginBranding
+		Choices []providerChoice
+	}{newLoginBranding(), choices})
+	if err != nil {
+		logger.WithField("error", err).Error("Error rendering provider chooser")
+	}
+}
+
+// withReturnPath returns a copy of the request for the given path on the same
+// host, so the user is returned there after logging in. Only local paths are
+// accepted, anything else returns the user to the root
+func withReturnPath(r *http.Request, path string) *http.Request {
+	u, err := url.Parse(path)
+	if err != nil || u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		u = &url.URL{Path: "/"}
+	}
+
+	returnReq := r.Clone(r.Context())
+	returnReq.URL = u
+	return returnReq
+}
@@ -0,0 +1,188 @@
+package tfa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Custom claims
+
+// customClaimHeaderPrefix is prepended to the claim name when no header is
+// given, e.g. "employee_id" is passed in "X-Forwarded-Claim-Employee-Id"
+const customClaimHeaderPrefix = "X-Forwarded-Claim-"
+
+type customClaim struct {
+	name   string
+	header string
+}
+
+// parseCustomClaim parses a "custom-claim" value in the format claim[:header]
+func parseCustomClaim(spec string) (customClaim, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	claim := customClaim{name: strings.TrimSpace(parts[0])}
+	if len(parts) == 2 {
+		claim.header = strings.TrimSpace(parts[1])
+	} else {
+		claim.header = customClaimHeaderPrefix + strings.Replace(claim.name, "_", "-", -1)
+	}
+
+	if claim.name == "" || claim.header == "" {
+		return claim, fmt.Errorf("invalid custom-claim %q, must be in the format claim[:header]", spec)
+	}
+	claim.header = http.CanonicalHeaderKey(claim.header)
+
+	return claim, nil
+}
+
+// customClaims returns the configured custom claims
+func customClaims() []customClaim {
+	var claims []customClaim
+	for _, spec := range config().CustomClaims {
+		if claim, err := parseCustomClaim(spec); err == nil {
+			claims = append(claims, claim)
+		}
+	}
+	return claims
+}
+
+// keepCustomClaims drops all but the configured custom claims, the claims
+// rules take tenants from and the claims passed in headers, from the user so
+// only those are kept on the session
+func keepCustomClaims(user *provider.User) {
+	raw := user.Claims
+	user.Claims = nil
+
+	var names []string
+	for _, claim := range customClaims() {
+		names = append(names, claim.name)
+	}
+	for _, rule := range config().Rules {
+		if rule.TenantClaim != "" {
+			names = append(names, rule.TenantClaim)
+		}
+	}
+	names = append(names, headerClaims()...)
+
+	for _, name := range names {
+		value, ok := lookupClaim(raw, name)
+		if !ok {
+			continue
+		}
+		if user.Claims == nil {
+			user.Claims = make(map[string]interface{})
+		}
+		user.Claims[name] = value
+	}
+}
+
+// lookupClaim finds a claim by name, a name containing dots is also looked up
+// as a path into nested objects, e.g. "address.country"
+func lookupClaim(claims map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := claims[name]; ok {
+		return value, true
+	}
+
+	parts := strings.Split(name, ".")
+	var value interface{} = claims
+	for _, part := range parts {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, len(parts) > 1
+}
+
+// Roles claims
+
+// addClaimRoles grants the user the roles found in the configured
+// "roles-claim"s of the provider's claims
+func addClaimRoles(user *provider.User, claims map[string]interface{}) {
+	for _, name := range config().RolesClaims {
+		for _, role := range claimRoles(claims, name) {
+			if !containsString(user.Roles, role) {
+				user.Roles = append(user.Roles, role)
+			}
+		}
+	}
+}
+
+// claimRoles returns the roles in a claim. A name containing dots is also
+// looked up as a path, where a list of objects selects the field from each,
+// e.g. "groups.name", or an index selects one, e.g. "groups.0.name". The
+// claim may be a string or a list of strings
+func claimRoles(claims map[string]interface{}, name string) []string {
+	if value, ok := claims[name]; ok {
+		return roleStrings(value)
+	}
+	return roleStrings(claimPath(claims, strings.Split(name, ".")))
+}
+
+// claimPath follows the path into nested objects and lists
+func claimPath(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return claimPath(v[path[0]], path[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			return claimPath(v[i], path[1:])
+		}
+		var values []interface{}
+		for _, item := range v {
+			if found := claimPath(item, path); found != nil {
+				values = append(values, found)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// roleStrings flattens a claim value into its non-empty strings
+func roleStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		var roles []string
+		for _, item := range v {
+			roles = append(roles, roleStrings(item)...)
+		}
+		return roles
+	}
+	return nil
+}
+
+// setCustomClaimHeaders passes the user's custom claims to the backend.
+// Strings are passed verbatim, other values as JSON
+func setCustomClaimHeaders(w http.ResponseWriter, user *provider.User) {
+	for _, claim := range customClaims() {
+		value, ok := user.Claims[claim.name]
+		if !ok || value == nil {
+			continue
+		}
+
+		if str, ok := value.(string); ok {
+			w.Header().Set(claim.header, str)
+		} else if b, err := json.Marshal(value); err == nil {
+			w.Header().Set(claim.header, string(b))
+		}
+	}
+}
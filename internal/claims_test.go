@@ -0,0 +1,154 @@
+package tfa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestClaimsParseCustomClaim(t *testing.T) {
+	assert := assert.New(t)
+
+	claim, err := parseCustomClaim("employee_id")
+	assert.Nil(err)
+	assert.Equal(customClaim{name: "employee_id", header: "X-Forwarded-Claim-Employee-Id"}, claim)
+
+	claim, err = parseCustomClaim("department:x-department")
+	assert.Nil(err)
+	assert.Equal(customClaim{name: "department", header: "X-Department"}, claim)
+
+	_, err = parseCustomClaim(":X-Department")
+	assert.Error(err)
+	_, err = parseCustomClaim("department:")
+	assert.Error(err)
+}
+
+func TestClaimsKeepCustomClaims(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().CustomClaims = []string{"department", "address.country", "missing"}
+
+	user := &provider.User{Claims: map[string]interface{}{
+		"department": "engineering",
+		"address":    map[string]interface{}{"country": "NZ"},
+		"secret":     "drop me",
+	}}
+	keepCustomClaims(user)
+	assert.Equal(map[string]interface{}{
+		"department":      "engineering",
+		"address.country": "NZ",
+	}, user.Claims)
+
+	// Should keep no claims when none are configured
+	config().CustomClaims = nil
+	keepCustomClaims(user)
+	assert.Nil(user.Claims)
+}
+
+func TestClaimsRoles(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	claims := map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []interface{}{"admin", "dev"}},
+		"groups": []interface{}{
+			map[string]interface{}{"name": "ops"},
+			map[string]interface{}{"name": "dev"},
+			map[string]interface{}{"id": 3},
+		},
+		"https://example.com/role": "auditor",
+		"tier":                     1,
+	}
+
+	// Should follow paths into objects and lists
+	assert.Equal([]string{"admin", "dev"}, claimRoles(claims, "realm_access.roles"))
+	assert.Equal([]string{"ops", "dev"}, claimRoles(claims, "groups.name"))
+	assert.Equal([]string{"dev"}, claimRoles(claims, "groups.1.name"))
+	assert.Equal([]string{"auditor"}, claimRoles(claims, "https://example.com/role"))
+	assert.Nil(claimRoles(claims, "groups.5.name"))
+	assert.Nil(claimRoles(claims, "tier"))
+	assert.Nil(claimRoles(claims, "missing.roles"))
+
+	// Should add the roles once, keeping those the user has
+	config().RolesClaims = []string{"realm_access.roles", "groups.name"}
+	user := &provider.User{Roles: []string{"admin"}}
+	addClaimRoles(user, claims)
+	assert.Equal([]string{"admin", "dev", "ops"}, user.Roles)
+}
+
+func TestClaimsHeaders(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().CustomClaims = []string{"department", "employee_id", "groups:X-Groups", "manager"}
+
+	w := httptest.NewRecorder()
+	setCustomClaimHeaders(w, &provider.User{Claims: map[string]interface{}{
+		"department":  "engineering",
+		"employee_id": float64(1234),
+		"groups":      []interface{}{"a", "b"},
+		"manager":     nil,
+	}})
+	assert.Equal("engineering", w.Header().Get("X-Forwarded-Claim-Department"))
+	assert.Equal("1234", w.Header().Get("X-Forwarded-Claim-Employee-Id"))
+	assert.Equal(`["a","b"]`, w.Header().Get("X-Groups"))
+	assert.NotContains(w.Header(), "X-Forwarded-Claim-Manager")
+}
+
+func TestClaimsLogin(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().CustomClaims = []string{"hd:X-Hosted-Domain", "verified_email"}
+
+	// Setup OAuth server
+	server, serverURL := NewOAuthServer(t)
+	defer server.Close()
+	config().Providers.Google.TokenURL = &url.URL{
+		Scheme: serverURL.Scheme,
+		Host:   serverURL.Host,
+		Path:   "/token",
+	}
+	config().Providers.Google.UserURL = &url.URL{
+		Scheme: serverURL.Scheme,
+		Host:   serverURL.Host,
+		Path:   "/userinfo",
+	}
+
+	// Should keep the custom claims on the session
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	require.Equal(307, res.StatusCode)
+
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == config().CookieName {
+			cookie = c
+		}
+	}
+	require.NotNil(cookie)
+
+	// Should pass them to the backend
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, cookie)
+	require.Equal(200, res.StatusCode)
+	assert.Equal("example.com", res.Header.Get("X-Hosted-Domain"))
+	assert.Equal("true", res.Header.Get("X-Forwarded-Claim-Verified-Email"))
+	assert.Equal("", res.Header.Get("X-Forwarded-Claim-Id"))
+
+	// Should return them in the userinfo
+	req = httptest.NewRequest("GET", "http://example.com/_oauth/userinfo", nil)
+	req.AddCookie(cookie)
+	rec := serveRouter(NewServer().Handler(), req)
+	require.Equal(200, rec.Code)
+	assert.JSONEq(`{"email":"example@example.com","name":"","roles":null,"claims":{"hd":"example.com","verified_email":true}}`, rec.Body.String())
+}
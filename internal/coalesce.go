@@ -0,0 +1,201 @@
+package tfa
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Concurrent logins
+//
+// A browser with several tabs open may start a login in each of them at once.
+// The tabs share a login transaction, identified by a cookie set when the
+// first of them is sent to the provider, so the first callback to complete
+// creates the session and the others join it, rather than each creating their
+// own. A callback repeated once its CSRF cookie has been cleared, e.g. by
+// reloading the page, is sent on to where it was going instead of refused.
+// Transactions are kept in memory, so callbacks are only coalesced when they
+// reach the same instance
+
+// loginTransactionTTL is how long callbacks may join a completed login
+const loginTransactionTTL = 2 * time.Minute
+
+// loginTransactionWait is how long a callback waits for a concurrent one to
+// complete before going ahead on its own
+const loginTransactionWait = 10 * time.Second
+
+var loginTransactions = NewLoginTransactions()
+
+// LoginTransactions tracks the logins of each transaction
+type LoginTransactions struct {
+	mu           sync.Mutex
+	transactions map[string]*loginTransaction
+	lastPurge    time.Time
+}
+
+type loginTransaction struct {
+	provider string
+	done     chan struct{}
+	user     *provider.User
+	expires  time.Time
+
+	// Where each completed callback, by nonce, was sent
+	redirects map[string]string
+}
+
+// NewLoginTransactions creates an empty set of login transactions
+func NewLoginTransactions() *LoginTransactions {
+	return &LoginTransactions{
+		transactions: make(map[string]*loginTransaction),
+	}
+}
+
+// Begin returns the transaction's login with the provider, and whether this
+// callback leads it. The leader must call Finish once it's done, others may
+// Wait for its user. A nil login is returned if key is empty
+func (t *LoginTransactions) Begin(key, providerName string) (*loginTransaction, bool) {
+	if key == "" {
+		return nil, true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.purge(now)
+
+	if tx, ok := t.transactions[key]; ok && tx.provider == providerName && now.Before(tx.expires) {
+		return tx, false
+	}
+
+	tx := &loginTransaction{
+		provider:  providerName,
+		done:      make(chan struct{}),
+		expires:   now.Add(loginTransactionTTL),
+		redirects: make(map[string]string),
+	}
+	t.transactions[key] = tx
+	return tx, true
+}
+
+// Finish completes the leader's login, with the user the session was created
+// for, or nil if the login failed
+func (t *LoginTransactions) Finish(key string, tx *loginTransaction, user *provider.User) {
+	if tx == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if user == nil {
+		if t.transactions[key] == tx {
+			delete(t.transactions, key)
+		}
+	} else {
+		tx.user = user
+		tx.expires = time.Now().Add(loginTransactionTTL)
+	}
+	close(tx.done)
+}
+
+// Wait returns the user of the login once the leader has finished, nil if it
+// failed or didn't finish in time
+func (t *LoginTransactions) Wait(tx *loginTransaction) *provider.User {
+	select {
+	case <-tx.done:
+	case <-time.After(loginTransactionWait):
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return tx.user
+}
+
+// Record remembers where the callback with the nonce was sent
+func (t *LoginTransactions) Record(tx *loginTransaction, nonce, redirect string) {
+	if tx == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx.redirects[nonce] = redirect
+}
+
+// Repeated returns the user and redirect of a completed callback with the
+// nonce, if it is part of the transaction
+func (t *LoginTransactions) Repeated(key, nonce string) (*provider.User, string, bool) {
+	if key == "" {
+		return nil, "", false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx, ok := t.transactions[key]
+	if !ok || tx.user == nil || !time.Now().Before(tx.expires) {
+		return nil, "", false
+	}
+	redirect, ok := tx.redirects[nonce]
+	return tx.user, redirect, ok
+}
+
+// purge drops expired transactions, at most once a minute. Must be called
+// with the lock held
+func (t *LoginTransactions) purge(now time.Time) {
+	if now.Sub(t.lastPurge) < time.Minute {
+		return
+	}
+	t.lastPurge = now
+
+	for key, tx := range t.transactions {
+		if tx.user != nil && !now.Before(tx.expires) {
+			delete(t.transactions, key)
+		}
+	}
+}
+
+// loginTransactionKey identifies the transaction of the request, the
+// transaction cookie is bound to the client so a cookie planted in another
+// browser can't be used to join its login
+func loginTransactionKey(r *http.Request) string {
+	c, err := r.Cookie(buildLoginTransactionCookieName())
+	if err != nil || len(c.Value) != 32 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s", c.Value, trustedIP(r), r.UserAgent())))
+	return fmt.Sprintf("%x", sum)
+}
+
+// joinLogin gives the request a cookie for the session created by another
+// callback and sends it on, returning false if the session has since ended
+func (s *Server) joinLogin(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, user *provider.User, redirect string) bool {
+	// Stateless cookies carry the user, so there's no session to have ended
+	if !config().StatelessCookie {
+		entry, err := sessions.Get(user.UUID)
+		if err != nil || entry == nil {
+			return false
+		}
+	}
+
+	cookie, err := MakeCookie(r, user)
+	if err != nil {
+		return false
+	}
+	setCookie(w, cookie)
+
+	logger.WithFields(logrus.Fields{
+		"redirect": redirect,
+		"user":     user.UUID,
+	}).Info("Joined concurrent login, redirecting user.")
+	http.Redirect(w, r, redirect, http.StatusTemporaryRedirect)
+	return true
+}
@@ -0,0 +1,182 @@
+package tfa
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestLoginTransactions(t *testing.T) {
+	assert := assert.New(t)
+	transactions := NewLoginTransactions()
+	user := newTestUser("test@example.com")
+
+	// Should lead the first login and join later ones
+	tx, leader := transactions.Begin("key", "google")
+	assert.True(leader)
+	joined, leader := transactions.Begin("key", "google")
+	assert.False(leader)
+	assert.Equal(tx, joined)
+
+	// Should not join logins with another provider
+	_, leader = transactions.Begin("other", "google")
+	assert.True(leader)
+
+	transactions.Record(tx, "nonce", "http://example.com/page")
+	transactions.Finish("key", tx, user)
+	assert.Equal(user, transactions.Wait(joined))
+
+	// Should find repeated callbacks
+	repeated, redirect, ok := transactions.Repeated("key", "nonce")
+	assert.True(ok)
+	assert.Equal(user, repeated)
+	assert.Equal("http://example.com/page", redirect)
+	_, _, ok = transactions.Repeated("key", "unknown")
+	assert.False(ok)
+
+	// Should forget failed logins
+	tx, _ = transactions.Begin("failed", "google")
+	transactions.Finish("failed", tx, nil)
+	_, leader = transactions.Begin("failed", "google")
+	assert.True(leader)
+
+	// Should not coalesce without a transaction
+	tx, leader = transactions.Begin("", "google")
+	assert.Nil(tx)
+	assert.True(leader)
+}
+
+func TestServerConcurrentLogins(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	loginTransactions = NewLoginTransactions()
+
+	var exchanges int32
+	exchanging := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			atomic.AddInt32(&exchanges, 1)
+			exchanging <- struct{}{}
+			<-release
+			fmt.Fprint(w, `{"access_token":"123456789"}`)
+		} else {
+			fmt.Fprint(w, `{"email":"example@example.com"}`)
+		}
+	}))
+	defer server.Close()
+	config().Providers.Google.TokenURL, _ = url.Parse(server.URL + "/token")
+	config().Providers.Google.UserURL, _ = url.Parse(server.URL + "/userinfo")
+
+	transaction := &http.Cookie{Name: buildLoginTransactionCookieName(), Value: "abcdefabcdefabcdefabcdefabcdefab"}
+	callback := func(nonce, path string, csrf bool) *http.Response {
+		req := newDefaultHttpRequest("/_oauth?state=" + nonce + ":google:http://example.com" + path)
+		req.AddCookie(transaction)
+		var c *http.Cookie
+		if csrf {
+			c = MakeCSRFCookie(req, nonce)
+		}
+		res, _ := doHttpRequest(req, c)
+		return res
+	}
+
+	// Should only exchange the code of the first of concurrent callbacks
+	var wg sync.WaitGroup
+	responses := make([]*http.Response, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[0] = callback("11111111111111111111111111111111", "/one", true)
+	}()
+	<-exchanging
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[1] = callback("22222222222222222222222222222222", "/two", true)
+	}()
+	close(release)
+	wg.Wait()
+
+	assert.Equal(int32(1), atomic.LoadInt32(&exchanges), "concurrent callbacks should share one login")
+	for i, path := range []string{"/one", "/two"} {
+		require.Equal(307, responses[i].StatusCode)
+		assert.Equal("http://example.com"+path, responses[i].Header.Get("Location"))
+		found := false
+		for _, c := range responses[i].Cookies() {
+			found = found || c.Name == config().CookieName
+		}
+		assert.True(found, "each callback should set the auth cookie")
+	}
+
+	// Should send a repeated callback on without a CSRF cookie
+	res := callback("22222222222222222222222222222222", "/two", false)
+	assert.Equal(307, res.StatusCode)
+	assert.Equal("http://example.com/two", res.Header.Get("Location"))
+
+	// Should still refuse unknown callbacks without a CSRF cookie
+	res = callback("33333333333333333333333333333333", "/three", false)
+	assert.Equal(401, res.StatusCode)
+
+	// Should not join from another client
+	req := newDefaultHttpRequest("/_oauth?state=22222222222222222222222222222222:google:http://example.com/two")
+	req.AddCookie(transaction)
+	req.Header.Set("User-Agent", "other")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+}
+
+func TestServerJoinLoginStateless(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().StatelessCookie = true
+	s := NewServer()
+
+	// Should join without a session on the server
+	user := &provider.User{UUID: uuid.New(), Email: "tabs@example.com"}
+	req := newDefaultHttpRequest("/_oauth")
+	w := httptest.NewRecorder()
+	assert.True(s.joinLogin(log.WithField("test", t.Name()), w, req, user, "http://example.com/two"))
+	assert.Equal(307, w.Code)
+	assert.Contains(w.Header().Get("Set-Cookie"), config().CookieName+"=")
+}
+
+func TestServerLoginTransactionCookie(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should start a transaction when redirecting to log in
+	req := newDefaultHttpRequest("/page")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+	var transaction *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == buildLoginTransactionCookieName() {
+			transaction = c
+		}
+	}
+	if assert.NotNil(transaction) {
+		assert.Len(transaction.Value, 32)
+	}
+
+	// Should keep an existing transaction
+	req = newDefaultHttpRequest("/page")
+	req.AddCookie(&http.Cookie{Name: transaction.Name, Value: transaction.Value})
+	res, _ = doHttpRequest(req, nil)
+	for _, c := range res.Cookies() {
+		assert.NotEqual(buildLoginTransactionCookieName(), c.Name)
+	}
+}
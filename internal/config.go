@@ -7,47 +7,201 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/thomseddon/go-flags"
 	"github.com/thomseddon/traefik-forward-auth/internal/provider"
 )
 
-var config *Config
+// currentConfig holds the config in use. It's swapped as a whole on reload,
+// so it's read with config rather than kept
+var currentConfig atomic.Value
+
+// config returns the config in use
+func config() *Config {
+	c, _ := currentConfig.Load().(*Config)
+	return c
+}
+
+// setConfig swaps in the config, requests read it from then on
+func setConfig(c *Config) {
+	currentConfig.Store(c)
+}
+
+// minSecretLength is the shortest secret accepted for signing
+const minSecretLength = 16
 
 // Config holds the runtime application config
 type Config struct {
-	LogLevel  string `long:"log-level" env:"LOG_LEVEL" default:"warn" choice:"trace" choice:"debug" choice:"info" choice:"warn" choice:"error" choice:"fatal" choice:"panic" description:"Log level"`
-	LogFormat string `long:"log-format"  env:"LOG_FORMAT" default:"text" choice:"text" choice:"json" choice:"pretty" description:"Log format"`
-
-	AuthHost               string               `long:"auth-host" env:"AUTH_HOST" description:"Single host to use when returning from 3rd party auth"`
-	Config                 func(s string) error `long:"config" env:"CONFIG" description:"Path to config file" json:"-"`
-	CookieDomains          []CookieDomain       `long:"cookie-domain" env:"COOKIE_DOMAIN" env-delim:"," description:"Domain to set auth cookie on, can be set multiple times"`
-	InsecureCookie         bool                 `long:"insecure-cookie" env:"INSECURE_COOKIE" description:"Use insecure cookies"`
-	CookieName             string               `long:"cookie-name" env:"COOKIE_NAME" default:"_forward_auth" description:"Cookie Name"`
-	CSRFCookieName         string               `long:"csrf-cookie-name" env:"CSRF_COOKIE_NAME" default:"_forward_auth_csrf" description:"CSRF Cookie Name"`
-	DefaultAction          string               `long:"default-action" env:"DEFAULT_ACTION" default:"auth" choice:"auth" choice:"allow" description:"Default action"`
-	DefaultProvider        string               `long:"default-provider" env:"DEFAULT_PROVIDER" default:"google" choice:"google" choice:"oidc" choice:"generic-oauth" description:"Default provider"`
-	Domains                CommaSeparatedList   `long:"domain" env:"DOMAIN" env-delim:"," description:"Only allow given email domains, can be set multiple times"`
-	LifetimeString         int                  `long:"lifetime" env:"LIFETIME" default:"43200" description:"Lifetime in seconds"`
-	LogoutRedirect         string               `long:"logout-redirect" env:"LOGOUT_REDIRECT" description:"URL to redirect to following logout"`
-	MatchWhitelistOrDomain bool                 `long:"match-whitelist-or-domain" env:"MATCH_WHITELIST_OR_DOMAIN" description:"Allow users that match *either* whitelist or domain (enabled by default in v3)"`
-	Path                   string               `long:"url-path" env:"URL_PATH" default:"/_oauth" description:"Callback URL Path"`
-	SecretString           string               `long:"secret" env:"SECRET" description:"Secret used for signing (required)" json:"-"`
-	Whitelist              CommaSeparatedList   `long:"whitelist" env:"WHITELIST" env-delim:"," description:"Only allow given email addresses, can be set multiple times"`
-	AllowedRoles           CommaSeparatedList   `long:"allowed-roles" env:"ALLOWED_ROLES" env-delim:"," description:"Only allow users with one of the given roles"`
-	Port                   int                  `long:"port" env:"PORT" default:"4181" description:"Port to listen on"`
-
-	Providers provider.Providers `group:"providers" namespace:"providers" env-namespace:"PROVIDERS"`
-	Rules     map[string]*Rule   `long:"rule.<name>.<param>" description:"Rule definitions, param can be: \"action\", \"rule\" or \"provider\""`
+	LogLevel     string `long:"log-level" env:"LOG_LEVEL" default:"warn" choice:"trace" choice:"debug" choice:"info" choice:"warn" choice:"error" choice:"fatal" choice:"panic" description:"Log level"`
+	LogFormat    string `long:"log-format"  env:"LOG_FORMAT" default:"text" choice:"text" choice:"json" choice:"pretty" description:"Log format"`
+	LogDecisions bool   `long:"log-decisions" env:"LOG_DECISIONS" description:"Log each auth decision with the request ID, user, rule and reason, at the info level"`
+
+	AdminToken              string               `long:"admin-token" env:"ADMIN_TOKEN" description:"Bearer token for the admin endpoints, which are disabled if unset" json:"-"`
+	AdminRoles              CommaSeparatedList   `long:"admin-role" env:"ADMIN_ROLE" env-delim:"," description:"Role permitting logged in users full access to the admin endpoints, can be set multiple times"`
+	AdminViewerRoles        CommaSeparatedList   `long:"admin-viewer-role" env:"ADMIN_VIEWER_ROLE" env-delim:"," description:"Role permitting logged in users to list sessions and users with the admin endpoints, can be set multiple times"`
+	APIPathPrefixes         CommaSeparatedList   `long:"api-path-prefix" env:"API_PATH_PREFIX" env-delim:"," description:"Path prefix of API requests, which are refused with a 401 and the URL to log in at rather than redirected, can be set multiple times"`
+	APIModeHeader           string               `long:"api-mode-header" env:"API_MODE_HEADER" default:"X-Forward-Auth-Mode" description:"Header with which scripts can ask for a JSON 401 rather than a redirect to log in, by setting it to json, empty to disable"`
+	APIModeParamLifetime    time.Duration        `long:"api-mode-param-lifetime" env:"API_MODE_PARAM_LIFETIME" default:"24h" description:"How long the forward_auth_mode parameters issued by the api-mode-url endpoint, asking for a JSON 401 for a single URL, are valid for, 0 to disable the endpoint"`
+	AuditFile               string               `long:"audit-file" env:"AUDIT_FILE" description:"File to append audit events to, one JSON object per line"`
+	AuditFileMaxSize        int                  `long:"audit-file-max-size" env:"AUDIT_FILE_MAX_SIZE" default:"100" description:"Size in megabytes at which the audit-file is rotated, 0 to never rotate it"`
+	AuditFileMaxBackups     int                  `long:"audit-file-max-backups" env:"AUDIT_FILE_MAX_BACKUPS" default:"5" description:"Number of rotated audit files to keep"`
+	AuditSyslog             string               `long:"audit-syslog" env:"AUDIT_SYSLOG" description:"Syslog server to send audit events to, as udp://host:port or tcp://host:port, or local for the local syslog daemon"`
+	AuditWebhook            string               `long:"audit-webhook" env:"AUDIT_WEBHOOK" description:"URL to POST each audit event to as JSON" json:"-"`
+	AuthHost                string               `long:"auth-host" env:"AUTH_HOST" description:"Single host to use when returning from 3rd party auth"`
+	Authorizer              string               `long:"authorizer" env:"AUTHORIZER" description:"URL of a webhook deciding whether users may make requests once they have passed the rule's checks, for auth rules without their own authorizer and the default action"`
+	AuthorizerTimeout       time.Duration        `long:"authorizer-timeout" env:"AUTHORIZER_TIMEOUT" default:"2s" description:"How long to wait for the authorizer to respond"`
+	AuthorizerCache         time.Duration        `long:"authorizer-cache" env:"AUTHORIZER_CACHE" default:"0" description:"How long to cache the authorizer's decision for the same user and request, 0 to not cache"`
+	AuthorizerFailPolicy    string               `long:"authorizer-fail-policy" env:"AUTHORIZER_FAIL_POLICY" default:"deny" choice:"allow" choice:"deny" description:"Whether to allow or deny requests when the authorizer can't be reached or responds with an error"`
+	AuthorizerFormat        string               `long:"authorizer-format" env:"AUTHORIZER_FORMAT" default:"webhook" choice:"webhook" choice:"opa" description:"How to talk to the authorizer: webhook, or opa to query an Open Policy Agent decision"`
+	BearerAuth              bool                 `long:"bearer-auth" env:"BEARER_AUTH" description:"Authenticate requests sending an access token in the Authorization header with the rule's provider, instead of redirecting them to log in"`
+	CanonicalEmails         bool                 `long:"canonical-emails" env:"CANONICAL_EMAILS" description:"Ignore the dots and +suffix of Gmail addresses, so aliases of an address are the same user"`
+	Config                  func(s string) error `long:"config" env:"CONFIG" description:"Path to config file" json:"-"`
+	CookieDomains           []CookieDomain       `long:"cookie-domain" env:"COOKIE_DOMAIN" env-delim:"," description:"Domain to set auth cookie on, can be set multiple times"`
+	ForwardedForHeader      string               `long:"forwarded-for-header" env:"FORWARDED_FOR_HEADER" description:"Header to pass backends the request's X-Forwarded-For chain in, without the entries before the client or that aren't addresses, disabled if unset"`
+	GRPCTokenMetadata       CommaSeparatedList   `long:"grpc-token-metadata" env:"GRPC_TOKEN_METADATA" env-delim:"," description:"gRPC metadata key clients may send an access token in when bearer-auth is set, in addition to authorization, can be set multiple times"`
+	Headers                 []string             `long:"header" env:"HEADER" env-delim:"," description:"User field to pass to backends in a header, in the format header:field where field is email, name, avatar, uuid, roles, groups or claim:<name>, can be set multiple times"`
+	HeaderSeparator         string               `long:"header-separator" env:"HEADER_SEPARATOR" default:"," description:"Separator used to join lists, such as roles, passed in a header"`
+	InstanceID              string               `long:"instance-id" env:"INSTANCE_ID" description:"Identifies this instance in metrics, logs and admin responses, defaults to the host name"`
+	RequestIDHeader         string               `long:"request-id-header" env:"REQUEST_ID_HEADER" default:"X-Request-Id" description:"Header carrying the ID logged with each request, taken from traefik when set and generated otherwise, empty to disable"`
+	InsecureCookie          bool                 `long:"insecure-cookie" env:"INSECURE_COOKIE" description:"Use insecure cookies"`
+	CookieName              string               `long:"cookie-name" env:"COOKIE_NAME" default:"_forward_auth" description:"Cookie Name"`
+	CSRFCookieName          string               `long:"csrf-cookie-name" env:"CSRF_COOKIE_NAME" default:"_forward_auth_csrf" description:"CSRF Cookie Name"`
+	CookieSameSite          string               `long:"cookie-same-site" env:"COOKIE_SAME_SITE" choice:"lax" choice:"strict" choice:"none" description:"SameSite attribute of cookies, left unset by default"`
+	CookiePartitioned       bool                 `long:"cookie-partitioned" env:"COOKIE_PARTITIONED" description:"Set the Partitioned attribute (CHIPS) on cookies, so apps embedded in iframes on other sites can be used, implies cookie-same-site=none"`
+	EncryptCookies          bool                 `long:"encrypt-cookies" env:"ENCRYPT_COOKIES" description:"Encrypt the auth cookie and login state, so the session ID, expiry and return URL can't be read"`
+	ProviderCookieName      string               `long:"provider-cookie-name" env:"PROVIDER_COOKIE_NAME" default:"_forward_auth_provider" description:"Name of the cookie remembering the last used provider"`
+	ConsentCheckInterval    time.Duration        `long:"consent-check-interval" env:"CONSENT_CHECK_INTERVAL" default:"0" description:"How often to check users haven't revoked consent at the provider by refreshing their token, 0 to disable"`
+	DebugHeader             bool                 `long:"debug-header" env:"DEBUG_HEADER" description:"Explain each auth decision in the X-Auth-Debug response header"`
+	DebugHeaderToken        string               `long:"debug-header-token" env:"DEBUG_HEADER_TOKEN" description:"Explain the auth decision for requests sending this token in the X-Auth-Debug header" json:"-"`
+	AvatarClaims            []string             `long:"avatar-claim" env:"AVATAR_CLAIM" env-delim:"," default:"picture" default:"avatar_url" description:"Provider claim to take the URL of the user's avatar from, the first present is used, can be set multiple times"`
+	AvatarCacheTTL          time.Duration        `long:"avatar-cache-ttl" env:"AVATAR_CACHE_TTL" default:"1h" description:"How long avatars served by the avatar endpoint are cached"`
+	DisplayNameClaims       []string             `long:"display-name-claim" env:"DISPLAY_NAME_CLAIM" env-delim:"," default:"preferred_username" default:"login" description:"Provider claim to take the user's display name from when the provider doesn't give a name, the first present is used, can be set multiple times"`
+	CustomClaims            []string             `long:"custom-claim" env:"CUSTOM_CLAIM" env-delim:"," description:"Provider claim to keep on the session and pass to backends, in the format claim[:header], can be set multiple times"`
+	DomainCheckInterval     time.Duration        `long:"domain-check-interval" env:"DOMAIN_CHECK_INTERVAL" default:"0" description:"How often to check the cookie-domain and auth-host resolve, 0 to only check on startup, negative to disable"`
+	DefaultAction           string               `long:"default-action" env:"DEFAULT_ACTION" default:"auth" choice:"auth" choice:"allow" description:"Default action"`
+	DefaultProvider         string               `long:"default-provider" env:"DEFAULT_PROVIDER" default:"google" choice:"google" choice:"oidc" choice:"generic-oauth" choice:"tailscale" choice:"ldap" choice:"saml" description:"Default provider"`
+	Domains                 CommaSeparatedList   `long:"domain" env:"DOMAIN" env-delim:"," description:"Only allow given email domains, can be set multiple times"`
+	DownloadTokenLifetime   time.Duration        `long:"download-token-lifetime" env:"DOWNLOAD_TOKEN_LIFETIME" default:"0" description:"How long download tokens, letting tools without the auth cookie request a single URL, are valid for, 0 to disable the download-token endpoint"`
+	DownloadTokenParam      string               `long:"download-token-param" env:"DOWNLOAD_TOKEN_PARAM" default:"tfa_token" description:"Query parameter download tokens are passed in"`
+	AccessCodeLifetime      time.Duration        `long:"access-code-lifetime" env:"ACCESS_CODE_LIFETIME" default:"0" description:"How long access codes, letting clients of non-HTTP services log in with a code issued to the browser session, are valid for, 0 to disable the access-code endpoints"`
+	AccessCodeDigits        int                  `long:"access-code-digits" env:"ACCESS_CODE_DIGITS" default:"8" description:"Number of digits in access codes"`
+	FallbackCache           string               `long:"fallback-cache" env:"FALLBACK_CACHE" description:"Path to persist last known identities, used by rules with fallback enabled while the provider is unavailable"`
+	FallbackMaxStaleness    time.Duration        `long:"fallback-max-staleness" env:"FALLBACK_MAX_STALENESS" default:"24h" description:"How long after their last login a cached identity may be used"`
+	JWT                     bool                 `long:"jwt" env:"JWT" description:"Pass a signed JWT describing the user to backends in the jwt-header"`
+	JWTHeader               string               `long:"jwt-header" env:"JWT_HEADER" default:"X-Forwarded-Jwt" description:"Header to pass the downstream JWT in"`
+	JWTIssuer               string               `long:"jwt-issuer" env:"JWT_ISSUER" default:"traefik-forward-auth" description:"Issuer of the downstream JWT"`
+	JWTLifetime             time.Duration        `long:"jwt-lifetime" env:"JWT_LIFETIME" default:"5m" description:"Lifetime of the downstream JWT"`
+	JWTKeyRotation          time.Duration        `long:"jwt-key-rotation" env:"JWT_KEY_ROTATION" default:"24h" description:"How often the downstream JWT signing key is rotated"`
+	LifetimeString          int                  `long:"lifetime" env:"LIFETIME" default:"43200" description:"Lifetime in seconds"`
+	LimitLifetimeToProvider bool                 `long:"limit-lifetime-to-provider" env:"LIMIT_LIFETIME_TO_PROVIDER" description:"Never let the auth cookie outlive the provider session (token or refresh token expiry)"`
+	LockoutThreshold        int                  `long:"lockout-threshold" env:"LOCKOUT_THRESHOLD" default:"0" description:"Failed logins from a client before it is locked out, 0 to disable"`
+	LockoutDuration         time.Duration        `long:"lockout-duration" env:"LOCKOUT_DURATION" default:"15m" description:"How long failed logins are counted for, and clients locked out"`
+	LoginScript             string               `long:"login-script" env:"LOGIN_SCRIPT" description:"Path to a Starlark script run after each login, which can change the user's roles, add headers passed to backends or reject the login"`
+	LoginTitle              string               `long:"login-title" env:"LOGIN_TITLE" default:"Log in" description:"Title of the login page listing the providers to choose from"`
+	LoginLogo               string               `long:"login-logo" env:"LOGIN_LOGO" description:"URL of a logo to show on the login page"`
+	LoginCSS                string               `long:"login-css" env:"LOGIN_CSS" description:"Path to a CSS file added to the login page's styles, to restyle it"`
+	LoginProviderLabels     []string             `long:"login-provider-label" env:"LOGIN_PROVIDER_LABEL" env-delim:"," description:"Label of a provider's button on the login page, in the format provider:label, can be set multiple times"`
+	LostSubmissionHeader    string               `long:"lost-submission-header" env:"LOST_SUBMISSION_HEADER" description:"Header to tell backends about a submission refused for want of a session, once the user has logged in again, disabled if unset"`
+	LogoutProvider          bool                 `long:"logout-provider" env:"LOGOUT_PROVIDER" description:"Also end the user's session at the provider when they log out, for providers supporting OpenID Connect RP-initiated logout"`
+	LogoutRedirect          string               `long:"logout-redirect" env:"LOGOUT_REDIRECT" description:"URL to redirect to following logout"`
+	MatchWhitelistOrDomain  bool                 `long:"match-whitelist-or-domain" env:"MATCH_WHITELIST_OR_DOMAIN" description:"Allow users that match *either* whitelist or domain (enabled by default in v3)"`
+	Path                    string               `long:"url-path" env:"URL_PATH" default:"/_oauth" description:"Callback URL Path"`
+	SecretString            string               `long:"secret" env:"SECRET" description:"Secret used for signing (required)" json:"-"`
+	PreviousSecretStrings   []string             `long:"previous-secret" env:"PREVIOUS_SECRET" description:"Previous secret, whose cookies are still accepted while the secret is rotated, can be set multiple times" json:"-"`
+	SecretRotationUntil     string               `long:"secret-rotation-until" env:"SECRET_ROTATION_UNTIL" description:"Stop accepting values signed with the previous secrets at this time (RFC 3339), finishing a rotation of the secret"`
+	Whitelist               CommaSeparatedList   `long:"whitelist" env:"WHITELIST" env-delim:"," description:"Only allow given email addresses, can be set multiple times"`
+	AllowedRoles            CommaSeparatedList   `long:"allowed-roles" env:"ALLOWED_ROLES" env-delim:"," description:"Only allow users with one of the given roles"`
+	AllowedGroups           CommaSeparatedList   `long:"allowed-groups" env:"ALLOWED_GROUPS" env-delim:"," description:"Only allow users in one of the given provider directory groups, looked up at login by providers with groups enabled"`
+	BlockedUsers            CommaSeparatedList   `long:"blocked-users" env:"BLOCKED_USERS" env-delim:"," description:"Never allow given email addresses, even if otherwise permitted, can be set multiple times"`
+	BlockedDomains          CommaSeparatedList   `long:"blocked-domains" env:"BLOCKED_DOMAINS" env-delim:"," description:"Never allow users from given email domains, even if otherwise permitted, can be set multiple times"`
+	AllowedTags             CommaSeparatedList   `long:"allowed-tags" env:"ALLOWED_TAGS" env-delim:"," description:"Only allow users with one of the given tags, attached with the admin API"`
+	BlockedTags             CommaSeparatedList   `long:"blocked-tags" env:"BLOCKED_TAGS" env-delim:"," description:"Never allow users with one of the given tags, attached with the admin API, even if otherwise permitted"`
+	GroupsCacheTTL          time.Duration        `long:"groups-cache-ttl" env:"GROUPS_CACHE_TTL" default:"15m" description:"How long the groups looked up for a user are reused for later logins, 0 to look them up every time"`
+	Port                    int                  `long:"port" env:"PORT" default:"4181" description:"Port to listen on"`
+	MetricsPort             int                  `long:"metrics-port" env:"METRICS_PORT" default:"0" description:"Serve /metrics on this port only, rather than on the port auth requests are served on"`
+	MetricsToken            string               `long:"metrics-token" env:"METRICS_TOKEN" description:"Bearer token required to read /metrics" json:"-"`
+	ProxyMode               string               `long:"mode" env:"MODE" default:"traefik" choice:"traefik" choice:"nginx" choice:"caddy" choice:"generic" description:"Reverse proxy sending auth requests, which decides the headers the original request is read from and how logins are redirected"`
+	SelfTest                bool                 `long:"selftest" env:"SELFTEST" description:"Run the startup self-test, print its report and exit, non-zero if any check failed"`
+	RobotsTxt               string               `long:"robots-txt" env:"ROBOTS_TXT" description:"Path to the robots.txt to serve on the auth-host, by default crawlers are asked not to index it"`
+	SecurityTxt             string               `long:"security-txt" env:"SECURITY_TXT" description:"Path to a security.txt to serve on the auth-host at /.well-known/security.txt"`
+	SecurityEventsAudience  string               `long:"security-events-audience" env:"SECURITY_EVENTS_AUDIENCE" description:"Audience security event tokens must be for, e.g. the client ID registered with the issuer"`
+	SecurityEventsIssuer    string               `long:"security-events-issuer" env:"SECURITY_EVENTS_ISSUER" description:"Issuer of the security event tokens pushed to <url-path>/security-events, terminating the sessions of users whose access is revoked, disabled if unset"`
+	SecurityEventsJWKSURL   string               `long:"security-events-jwks-url" env:"SECURITY_EVENTS_JWKS_URL" description:"URL of the keys the security-events-issuer signs tokens with"`
+	RedirectHosts           CommaSeparatedList   `long:"redirect-host" env:"REDIRECT_HOST" env-delim:"," description:"Host users may be returned to after logging in besides the host of the callback and the cookie domains, *.example.com matches subdomains, can be set multiple times"`
+	RateLimit               int                  `long:"rate-limit" env:"RATE_LIMIT" default:"0" description:"Maximum requests per minute from a client to the login, callback, userinfo and admin endpoints, 0 to disable"`
+	RenewWindow             time.Duration        `long:"renew-window" env:"RENEW_WINDOW" default:"0" description:"Renew sessions with the provider's refresh token when their cookie expires within this duration, 0 to disable"`
+	RoleMap                 string               `long:"role-map" env:"ROLE_MAP" description:"Path to a JSON file translating provider groups, e.g. Azure AD object ids or LDAP DNs, into role names, reloaded when changed"`
+	RolesClaims             []string             `long:"roles-claim" env:"ROLES_CLAIM" env-delim:"," description:"Provider claim to take the user's roles from, nested claims and lists of objects can be selected with dots, e.g. realm_access.roles, can be set multiple times"`
+	ReportOnlyUntil         string               `long:"report-only-until" env:"REPORT_ONLY_UNTIL" description:"Log denials and logins without enforcing them until this time (RFC 3339), to observe the impact of a rollout"`
+	Signer                  string               `long:"signer" env:"SIGNER" default:"secret" choice:"secret" choice:"aws-kms" choice:"gcp-kms" choice:"pkcs11" description:"Where the keys signing cookies and downstream JWTs are held, by default they are derived from the secret"`
+	SignerCookieKey         string               `long:"signer-cookie-key" env:"SIGNER_COOKIE_KEY" description:"HMAC key to sign cookies with: the KMS key ID or ARN, KMS key version name or PKCS#11 key label"`
+	SignerJWTKey            string               `long:"signer-jwt-key" env:"SIGNER_JWT_KEY" description:"ECDSA P-256 key to sign downstream JWTs with: the KMS key ID or ARN, KMS key version name or PKCS#11 key label"`
+	SignerPKCS11Module      string               `long:"signer-pkcs11-module" env:"SIGNER_PKCS11_MODULE" description:"Path to the PKCS#11 library"`
+	SignerPKCS11Slot        uint                 `long:"signer-pkcs11-slot" env:"SIGNER_PKCS11_SLOT" default:"0" description:"PKCS#11 slot holding the keys"`
+	SignerPKCS11PIN         string               `long:"signer-pkcs11-pin" env:"SIGNER_PKCS11_PIN" description:"PIN to log in to the PKCS#11 token with" json:"-"`
+	SlidingExpiry           bool                 `long:"sliding-expiry" env:"SLIDING_EXPIRY" description:"Extend the cookie by another lifetime when a request arrives more than half way through it, so active users stay logged in"`
+	SlidingMaxLifetime      time.Duration        `long:"sliding-max-lifetime" env:"SLIDING_MAX_LIFETIME" default:"0" description:"Longest a session is extended to after login with sliding-expiry, 0 for no limit"`
+	SessionStore            string               `long:"session-store" env:"SESSION_STORE" default:"memory" choice:"memory" choice:"redis" choice:"sql" description:"Where sessions are kept, redis and sql share them between instances and keep them across restarts"`
+	SessionHashHeader       string               `long:"session-hash-header" env:"SESSION_HASH_HEADER" default:"X-Auth-Session-Hash" description:"Header to pass the session hash in, for rules with sessionHash set"`
+	SessionsPage            bool                 `long:"sessions-page" env:"SESSIONS_PAGE" description:"Serve a page at <url-path>/sessions where users can see and revoke their own sessions"`
+	StatelessCookie         bool                 `long:"stateless-cookie" env:"STATELESS_COOKIE" description:"Keep the user in a signed JWT auth cookie rather than in a session on the server, sessions can then no longer be listed or revoked"`
+	SQLDriver               string               `long:"sql-driver" env:"SQL_DRIVER" default:"postgres" choice:"postgres" choice:"mysql" description:"Database to keep sessions in when the session-store is sql"`
+	SQLDSN                  string               `long:"sql-dsn" env:"SQL_DSN" description:"Data source name of the SQL database, e.g. postgres://user:password@db:5432/auth or user:password@tcp(db:3306)/auth" json:"-"`
+	SQLMaxConns             int                  `long:"sql-max-conns" env:"SQL_MAX_CONNS" default:"10" description:"Maximum connections to the SQL database"`
+	TenantHeader            string               `long:"tenant-header" env:"TENANT_HEADER" default:"X-Forwarded-Tenant" description:"Header to pass the user's tenant in, for rules with tenantClaim set"`
+	TrustedIPNetworks       CommaSeparatedList   `long:"trusted-ip-networks" env:"TRUSTED_IP_NETWORKS" env-delim:"," description:"CIDRs or addresses of clients that skip authentication, e.g. health checks and monitoring probes, can be set multiple times"`
+	TrustedIPDepth          int                  `long:"trusted-ip-depth" env:"TRUSTED_IP_DEPTH" default:"0" description:"Proxies in front of traefik whose X-Forwarded-For entries are skipped to find the client address matched against trusted-ip-networks"`
+	TracingEndpoint         string               `long:"tracing-endpoint" env:"TRACING_ENDPOINT" description:"OTLP/HTTP collector to send OpenTelemetry traces of requests to, e.g. http://otel-collector:4318, disabled if unset"`
+	TracingHeaders          []string             `long:"tracing-header" env:"TRACING_HEADER" env-delim:"," description:"Header sent to the tracing-endpoint, in the format name:value, e.g. for an API key, can be set multiple times" json:"-"`
+	TracingSampleRatio      float64              `long:"tracing-sample-ratio" env:"TRACING_SAMPLE_RATIO" default:"1" description:"Ratio of requests traced, when traefik hasn't already decided whether to trace them"`
+	TracingServiceName      string               `long:"tracing-service-name" env:"TRACING_SERVICE_NAME" default:"traefik-forward-auth" description:"Service name spans are reported under"`
+	WatchConfig             bool                 `long:"watch-config" env:"WATCH_CONFIG" description:"Reload rules, whitelists and providers when a config file changes, as on SIGHUP"`
+	UserDirectory           string               `long:"user-directory" env:"USER_DIRECTORY" description:"Path to a directory of users permitted to log in and the roles they are granted, managed with the import-users command or admin API"`
+	UserTags                string               `long:"user-tags" env:"USER_TAGS" description:"Path to a file of the tags and notes attached to users with the admin API, which rules can permit or refuse users by"`
+	RoleGrants              string               `long:"role-grants" env:"ROLE_GRANTS" description:"Path to a file of the roles granted to users until a time with the admin API, which are added to their roles on every request"`
+	RedisURL                string               `long:"redis-url" env:"REDIS_URL" description:"Redis URL for state shared between instances, e.g. redis://:password@redis:6379/0" json:"-"`
+	RedisCluster            bool                 `long:"redis-cluster" env:"REDIS_CLUSTER" description:"Treat redis-url as a node of a Redis Cluster, more nodes can be added as addr parameters"`
+
+	ProviderLatencyObjective time.Duration `long:"provider-latency-objective" env:"PROVIDER_LATENCY_OBJECTIVE" default:"2s" description:"Provider requests slower than this count against the provider SLO"`
+	ProviderSLOTarget        float64       `long:"provider-slo-target" env:"PROVIDER_SLO_TARGET" default:"0.99" description:"Target ratio of successful and timely provider requests, used for burn rate metrics"`
+	ProviderRequestRate      float64       `long:"provider-request-rate" env:"PROVIDER_REQUEST_RATE" default:"0" description:"Maximum requests per second to providers, shared by logins, token checks and renewals, 0 to disable"`
+	ProviderRequestBurst     int           `long:"provider-request-burst" env:"PROVIDER_REQUEST_BURST" default:"0" description:"Requests to providers that may be made at once within the provider-request-rate, defaults to the rate"`
+	ProviderRequestMaxWait   time.Duration `long:"provider-request-max-wait" env:"PROVIDER_REQUEST_MAX_WAIT" default:"5s" description:"How long a login may queue for the provider-request-rate before it fails, background renewals are skipped rather than queued"`
+
+	SessionStoreDegradedMode string        `long:"session-store-degraded-mode" env:"SESSION_STORE_DEGRADED_MODE" default:"deny" choice:"deny" choice:"local" description:"How sessions are served while the redis or sql session store is unavailable: deny them, or serve those this instance has seen from memory without allowing new logins"`
+	SessionStoreMaxEntries   int           `long:"session-store-max-entries" env:"SESSION_STORE_MAX_ENTRIES" default:"0" description:"Maximum sessions kept in memory when the session-store is memory, the sessions expiring soonest are dropped to make room for new ones, 0 for no limit"`
+	SessionTTL               time.Duration `long:"session-ttl" env:"SESSION_TTL" default:"0" description:"How long sessions are kept after login or renewal, cookies expire with their session when shorter than the lifetime, 0 to keep them as long as the cookie lifetime"`
+
+	Providers     provider.Providers        `group:"providers" namespace:"providers" env-namespace:"PROVIDERS"`
+	OIDCProviders map[string]*provider.OIDC `long:"providers.oidc.<name>.<param>" description:"Additional OIDC providers, used by rules as \"oidc.<name>\", param can be: \"issuer-url\", \"client-id\", \"client-secret\", \"resource\", \"bearer-audience\", \"required-claim\" or \"graph-groups\""`
+	Rules         map[string]*Rule          `long:"rule.<name>.<param>" description:"Rule definitions, param can be: \"action\", \"rule\" or \"provider\""`
 
 	// Filled during transformations
-	Secret   []byte `json:"-"`
-	Lifetime time.Duration
+	Secret          []byte `json:"-"`
+	Lifetime        time.Duration
+	previousSecrets [][]byte
+
+	// Filled during parsing
+	configFiles []string
+
+	// Filled during validation
+	robotsTxt           []byte
+	securityTxt         []byte
+	loginCSS            []byte
+	loginProviderLabels map[string]string
+	signer              Signer
+	fingerprint         string
+	reportOnlyUntil     time.Time
+	secretRotationUntil time.Time
 
 	// Legacy
 	CookieDomainsLegacy CookieDomains `long:"cookie-domains" env:"COOKIE_DOMAINS" description:"DEPRECATED - Use \"cookie-domain\""`
@@ -60,14 +214,14 @@ type Config struct {
 
 // NewGlobalConfig creates a new global config, parsed from command arguments
 func NewGlobalConfig() *Config {
-	var err error
-	config, err = NewConfig(os.Args[1:])
+	c, err := NewConfig(os.Args[1:])
 	if err != nil {
 		fmt.Printf("%+v\n", err)
 		os.Exit(1)
 	}
 
-	return config
+	setConfig(c)
+	return c
 }
 
 // TODO: move config parsing into new func "NewParsedConfig"
@@ -75,7 +229,8 @@ func NewGlobalConfig() *Config {
 // NewConfig parses and validates provided configuration into a config object
 func NewConfig(args []string) (*Config, error) {
 	c := &Config{
-		Rules: map[string]*Rule{},
+		OIDCProviders: map[string]*provider.OIDC{},
+		Rules:         map[string]*Rule{},
 	}
 
 	err := c.parseFlags(args)
@@ -129,6 +284,10 @@ func NewConfig(args []string) (*Config, error) {
 		c.Path = "/" + c.Path
 	}
 	c.Secret = []byte(c.SecretString)
+	c.previousSecrets = nil
+	for _, secret := range c.PreviousSecretStrings {
+		c.previousSecrets = append(c.previousSecrets, []byte(secret))
+	}
 	c.Lifetime = time.Second * time.Duration(c.LifetimeString)
 
 	return c, nil
@@ -140,19 +299,24 @@ func (c *Config) parseFlags(args []string) error {
 
 	i := flags.NewIniParser(p)
 	c.Config = func(s string) error {
+		c.configFiles = append(c.configFiles, s)
+
+		contents, encrypted, err := readConfigFile(s)
+		if err != nil {
+			return err
+		}
+
 		// Try parsing at as an ini
-		err := i.ParseFile(s)
+		if encrypted {
+			err = i.Parse(bytes.NewReader(contents))
+		} else {
+			err = i.ParseFile(s)
+		}
 
 		// If it fails with a syntax error, try converting legacy to ini
 		if err != nil && strings.Contains(err.Error(), "malformed key=value") {
-			converted, convertErr := convertLegacyToIni(s)
-			if convertErr != nil {
-				// If conversion fails, return the original error
-				return err
-			}
-
 			fmt.Println("config format deprecated, please use ini format")
-			return i.Parse(converted)
+			return i.Parse(convertLegacyToIni(contents))
 		}
 
 		return err
@@ -176,25 +340,9 @@ func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args [
 			return args, errors.New("route name is required")
 		}
 
-		// Get value, or pop the next arg
-		val, ok := arg.Value()
-		if !ok && len(args) > 1 {
-			val = args[0]
-			args = args[1:]
-		}
-
-		// Check value
-		if len(val) == 0 {
-			return args, errors.New("route param value is required")
-		}
-
-		// Unquote if required
-		if val[0] == '"' {
-			var err error
-			val, err = strconv.Unquote(val)
-			if err != nil {
-				return args, err
-			}
+		val, args, err := unknownFlagValue(arg, args)
+		if err != nil {
+			return args, fmt.Errorf("route param %v", err)
 		}
 
 		// Get or create rule
@@ -210,6 +358,12 @@ func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args [
 			rule.Action = val
 		case "rule":
 			rule.Rule = val
+		case "priority":
+			priority, err := strconv.Atoi(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid priority value for rule %v: %v", name, val)
+			}
+			rule.Priority = priority
 		case "provider":
 			rule.Provider = val
 		case "whitelist":
@@ -224,9 +378,163 @@ func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args [
 			list := CommaSeparatedList{}
 			list.UnmarshalFlag(val)
 			rule.AllowedRoles = list
+		case "allowedGroups":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.AllowedGroups = list
+		case "blockedUsers":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.BlockedUsers = list
+		case "blockedDomains":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.BlockedDomains = list
+		case "allowedTags":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.AllowedTags = list
+		case "blockedTags":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.BlockedTags = list
+		case "requireHttps":
+			rule.RequireHTTPS = val
+		case "sessionHash":
+			rule.SessionHash = val
+		case "hsts":
+			maxAge, err := strconv.Atoi(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid hsts value for rule %v: %v", name, val)
+			}
+			rule.HSTS = maxAge
+		case "hstsSubdomains":
+			subdomains, err := strconv.ParseBool(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid hstsSubdomains value for rule %v: %v", name, val)
+			}
+			rule.HSTSSubdomains = subdomains
+		case "gracePeriod":
+			grace, err := time.ParseDuration(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid gracePeriod value for rule %v: %v", name, val)
+			}
+			rule.GracePeriod = grace
+		case "gracePaths":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.GracePaths = list
+		case "canary":
+			percent, err := strconv.Atoi(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid canary value for rule %v: %v", name, val)
+			}
+			rule.Canary = percent
+		case "canaryKey":
+			rule.CanaryKey = val
+		case "authorizer":
+			rule.Authorizer = val
+		case "authorizerTimeout":
+			timeout, err := time.ParseDuration(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid authorizerTimeout value for rule %v: %v", name, val)
+			}
+			rule.AuthorizerTimeout = timeout
+		case "authorizerCache":
+			ttl, err := time.ParseDuration(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid authorizerCache value for rule %v: %v", name, val)
+			}
+			rule.AuthorizerCache = ttl
+		case "authorizerFailPolicy":
+			rule.AuthorizerFailPolicy = val
+		case "authorizerFormat":
+			rule.AuthorizerFormat = val
+		case "streamGrace":
+			grace, err := time.ParseDuration(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid streamGrace value for rule %v: %v", name, val)
+			}
+			rule.StreamGrace = grace
+		case "streamPaths":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.StreamPaths = list
+		case "tenantClaim":
+			rule.TenantClaim = val
+		case "tenants":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.Tenants = list
+		case "idleTimeout":
+			timeout, err := time.ParseDuration(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid idleTimeout value for rule %v: %v", name, val)
+			}
+			rule.IdleTimeout = timeout
+		case "trustedIpNetworks":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.TrustedIPNetworks = list
+		case "headers":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.Headers = list
+		case "methods":
+			list := CommaSeparatedList{}
+			list.UnmarshalFlag(val)
+			rule.Methods = list
+		case "fallback":
+			fallback, err := strconv.ParseBool(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid fallback value for rule %v: %v", name, val)
+			}
+			rule.Fallback = fallback
 		default:
 			return args, fmt.Errorf("invalid route param: %v", option)
 		}
+	} else if len(parts) == 4 && parts[0] == "providers" && parts[1] == "oidc" {
+		// Parse additional OIDC providers in the format
+		// "providers.oidc.<name>.<param>"
+		name := parts[2]
+		if len(name) == 0 {
+			return args, errors.New("provider name is required")
+		}
+
+		val, args, err := unknownFlagValue(arg, args)
+		if err != nil {
+			return args, fmt.Errorf("provider param %v", err)
+		}
+
+		// Get or create provider
+		p, ok := c.OIDCProviders[name]
+		if !ok {
+			p = provider.NewNamedOIDC(name)
+			c.OIDCProviders[name] = p
+		}
+
+		switch parts[3] {
+		case "issuer-url":
+			p.IssuerURL = val
+		case "client-id":
+			p.ClientID = val
+		case "client-secret":
+			p.ClientSecret = val
+		case "resource":
+			p.Resource = val
+		case "bearer-audience":
+			p.BearerAudience = val
+		case "required-claim":
+			p.RequiredClaims = append(p.RequiredClaims, val)
+		case "graph-groups":
+			enabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return args, fmt.Errorf("invalid graph-groups value for provider %v: %v", name, val)
+			}
+			p.GraphGroups = enabled
+		default:
+			return args, fmt.Errorf("invalid provider param: %v", option)
+		}
 	} else {
 		return args, fmt.Errorf("unknown flag: %v", option)
 	}
@@ -234,6 +542,32 @@ func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args [
 	return args, nil
 }
 
+// unknownFlagValue returns the value of a flag handled by parseUnknownFlag,
+// popping it from the remaining args if it wasn't given with the flag
+func unknownFlagValue(arg flags.SplitArgument, args []string) (string, []string, error) {
+	val, ok := arg.Value()
+	if !ok && len(args) > 1 {
+		val = args[0]
+		args = args[1:]
+	}
+
+	// Check value
+	if len(val) == 0 {
+		return val, args, errors.New("value is required")
+	}
+
+	// Unquote if required
+	if val[0] == '"' {
+		var err error
+		val, err = strconv.Unquote(val)
+		if err != nil {
+			return val, args, err
+		}
+	}
+
+	return val, args, nil
+}
+
 func handleFlagError(err error) error {
 	flagsErr, ok := err.(*flags.Error)
 	if ok && flagsErr.Type == flags.ErrHelp {
@@ -246,13 +580,8 @@ func handleFlagError(err error) error {
 
 var legacyFileFormat = regexp.MustCompile(`(?m)^([a-z-]+) (.*)$`)
 
-func convertLegacyToIni(name string) (io.Reader, error) {
-	b, err := ioutil.ReadFile(name)
-	if err != nil {
-		return nil, err
-	}
-
-	return bytes.NewReader(legacyFileFormat.ReplaceAll(b, []byte("$1=$2"))), nil
+func convertLegacyToIni(b []byte) io.Reader {
+	return bytes.NewReader(legacyFileFormat.ReplaceAll(b, []byte("$1=$2")))
 }
 
 // Validate validates a config object
@@ -260,6 +589,317 @@ func (c *Config) Validate() {
 	// Check for show stopper errors
 	if len(c.Secret) == 0 {
 		log.Fatal("\"secret\" option must be set")
+	} else if len(c.Secret) < minSecretLength {
+		log.Fatalf("\"secret\" must be at least %d characters, generate one with e.g. \"openssl rand -hex 16\"", minSecretLength)
+	}
+	for _, secret := range c.previousSecrets {
+		if len(secret) < minSecretLength {
+			log.Fatalf("every \"previous-secret\" must be at least %d characters", minSecretLength)
+		}
+	}
+	if c.SecretRotationUntil != "" {
+		until, err := time.Parse(time.RFC3339, c.SecretRotationUntil)
+		if err != nil {
+			log.Fatal("\"secret-rotation-until\" must be an RFC 3339 time, e.g. 2024-01-31T09:00:00Z")
+		} else if len(c.previousSecrets) == 0 {
+			log.Fatal("\"secret-rotation-until\" requires a \"previous-secret\" to rotate from")
+		} else if time.Now().Before(until) {
+			log.WithField("secret_rotation_until", until.Format(time.RFC3339)).Info("Rotating secret, previous secrets are accepted until the window ends")
+		}
+		c.secretRotationUntil = until
+	}
+
+	if c.Lifetime <= 0 {
+		log.Fatal("\"lifetime\" must be greater than 0")
+	} else if c.RenewWindow >= c.Lifetime {
+		log.Fatal("\"renew-window\" must be shorter than the lifetime")
+	}
+	if c.SlidingMaxLifetime < 0 {
+		log.Fatal("\"sliding-max-lifetime\" must not be negative")
+	} else if c.SlidingMaxLifetime > 0 && c.SlidingMaxLifetime < c.Lifetime {
+		log.Fatal("\"sliding-max-lifetime\" must be at least the lifetime")
+	}
+
+	if c.APIModeParamLifetime < 0 {
+		log.Fatal("\"api-mode-param-lifetime\" must not be negative")
+	}
+
+	if c.DownloadTokenLifetime < 0 {
+		log.Fatal("\"download-token-lifetime\" must not be negative")
+	} else if c.DownloadTokenLifetime > 0 && c.DownloadTokenParam == "" {
+		log.Fatal("\"download-token-param\" must be set to issue download tokens")
+	}
+
+	if c.AccessCodeLifetime < 0 {
+		log.Fatal("\"access-code-lifetime\" must not be negative")
+	} else if c.AccessCodeLifetime > 0 && (c.AccessCodeDigits < 6 || c.AccessCodeDigits > 12) {
+		log.Fatal("\"access-code-digits\" must be between 6 and 12")
+	}
+
+	if c.ProviderSLOTarget <= 0 || c.ProviderSLOTarget >= 1 {
+		log.Fatal("\"provider-slo-target\" must be between 0 and 1")
+	}
+
+	providerBudget = nil
+	if c.ProviderRequestRate < 0 {
+		log.Fatal("\"provider-request-rate\" must not be negative")
+	} else if c.ProviderRequestBurst < 0 {
+		log.Fatal("\"provider-request-burst\" must not be negative")
+	} else if c.ProviderRequestRate > 0 {
+		burst := c.ProviderRequestBurst
+		if burst == 0 {
+			burst = int(math.Ceil(c.ProviderRequestRate))
+		}
+		providerBudget = NewRequestBudget(c.ProviderRequestRate, burst)
+	}
+
+	if c.Authorizer != "" && validateAuthorizerURL(c.Authorizer) != nil {
+		log.Fatal("\"authorizer\" must be an absolute http or https URL")
+	} else if c.AuthorizerTimeout < 0 || c.AuthorizerCache < 0 {
+		log.Fatal("\"authorizer-timeout\" and \"authorizer-cache\" must not be negative")
+	}
+
+	if err := c.validateAccessLists(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Check cookie domains and auth host are consistent, otherwise every
+	// request will either fail to set a cookie or loop back to the provider
+	for _, d := range c.CookieDomains {
+		if err := validateHost(d.Domain, false); err != nil {
+			log.Fatalf("invalid cookie-domain %q: %v", d.Domain, err)
+		}
+	}
+	if c.AuthHost != "" {
+		c.AuthHost = canonicalHost(c.AuthHost)
+		if err := validateHost(c.AuthHost, true); err != nil {
+			log.Fatalf("invalid auth-host %q: %v", c.AuthHost, err)
+		} else if !c.matchesCookieDomain(c.AuthHost) {
+			log.Fatalf("auth-host %q is not a subdomain of any cookie-domain, auth host mode requires a matching cookie-domain", c.AuthHost)
+		}
+	}
+	if err := checkCookieDomains(c); err != nil {
+		log.Fatal(err)
+	}
+
+	// Files served on the auth host
+	if (c.RobotsTxt != "" || c.SecurityTxt != "") && c.AuthHost == "" {
+		log.Fatal("\"robots-txt\" and \"security-txt\" are served on the auth-host, which must be set")
+	}
+	if c.RobotsTxt != "" {
+		b, err := ioutil.ReadFile(c.RobotsTxt)
+		if err != nil {
+			log.Fatalf("unable to read robots-txt: %v", err)
+		}
+		c.robotsTxt = b
+	}
+	if c.SecurityTxt != "" {
+		b, err := ioutil.ReadFile(c.SecurityTxt)
+		if err != nil {
+			log.Fatalf("unable to read security-txt: %v", err)
+		}
+		if err := validateSecurityTxt(b); err != nil {
+			log.Fatalf("invalid security-txt: %v", err)
+		}
+		c.securityTxt = b
+	}
+
+	if c.StatelessCookie && (c.SessionsPage || c.ConsentCheckInterval > 0 || c.RenewWindow > 0 || c.SlidingExpiry || c.LogoutProvider || c.SecurityEventsIssuer != "" || c.DownloadTokenLifetime > 0 || c.AccessCodeLifetime > 0) {
+		log.Fatal("\"sessions-page\", \"consent-check-interval\", \"renew-window\", \"sliding-expiry\", \"logout-provider\", \"security-events-issuer\", \"download-token-lifetime\" and \"access-code-lifetime\" need sessions kept on the server, so can't be used with \"stateless-cookie\"")
+	}
+
+	// Login page
+	if c.LoginCSS != "" {
+		b, err := ioutil.ReadFile(c.LoginCSS)
+		if err != nil {
+			log.Fatalf("unable to read login-css: %v", err)
+		}
+		c.loginCSS = b
+	}
+	c.loginProviderLabels = make(map[string]string)
+	for _, label := range c.LoginProviderLabels {
+		parts := strings.SplitN(label, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("invalid login-provider-label %q, must be in the format provider:label", label)
+			continue
+		}
+		c.loginProviderLabels[parts[0]] = parts[1]
+	}
+
+	if c.JWT && (c.JWTLifetime <= 0 || c.JWTKeyRotation < time.Minute || c.JWTLifetime >= c.JWTKeyRotation) {
+		log.Fatal("\"jwt-lifetime\" must be greater than 0 and shorter than \"jwt-key-rotation\", which must be at least 1m")
+	}
+	if c.JWT && c.Signer != "secret" && c.SignerJWTKey == "" {
+		log.Fatalf("\"signer-jwt-key\" must be set to sign downstream JWTs with the %s signer", c.Signer)
+	}
+	if signer, err := NewSigner(c); err != nil {
+		log.Fatalf("unable to set up %s signer: %v", c.Signer, err)
+	} else {
+		c.signer = signer
+	}
+
+	if c.CookiePartitioned {
+		if c.CookieSameSite == "" {
+			c.CookieSameSite = "none"
+		} else if c.CookieSameSite != "none" {
+			log.Fatal("\"cookie-partitioned\" requires \"cookie-same-site\" to be none")
+		}
+	}
+	if c.CookieSameSite == "none" && c.InsecureCookie {
+		log.Fatal("\"cookie-same-site\" none requires secure cookies, \"insecure-cookie\" must not be set")
+	}
+
+	for _, spec := range c.CustomClaims {
+		if _, err := parseCustomClaim(spec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, spec := range c.Headers {
+		if _, err := parseHeaderMapping(spec); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if _, err := parseNetworks(c.TrustedIPNetworks); err != nil {
+		log.Fatal(err)
+	}
+	if c.TrustedIPDepth < 0 {
+		log.Fatal("\"trusted-ip-depth\" must not be negative")
+	}
+
+	if c.ReportOnlyUntil != "" {
+		until, err := time.Parse(time.RFC3339, c.ReportOnlyUntil)
+		if err != nil {
+			log.Fatal("\"report-only-until\" must be an RFC 3339 time, e.g. 2024-01-31T09:00:00Z")
+		} else if time.Now().Before(until) {
+			log.WithField("report_only_until", until.Format(time.RFC3339)).Warn("Report-only, denials and logins are not enforced")
+		}
+		c.reportOnlyUntil = until
+	}
+
+	if c.LockoutThreshold > 0 && c.LockoutDuration <= 0 {
+		log.Fatal("\"lockout-duration\" must be greater than 0")
+	}
+
+	if c.MetricsPort < 0 {
+		log.Fatal("\"metrics-port\" must not be negative")
+	} else if c.MetricsPort != 0 && c.MetricsPort == c.Port {
+		log.Fatal("\"metrics-port\" must differ from \"port\"")
+	}
+
+	if c.SessionTTL < 0 {
+		log.Fatal("\"session-ttl\" must not be negative")
+	}
+
+	if c.SessionStoreMaxEntries < 0 {
+		log.Fatal("\"session-store-max-entries\" must not be negative")
+	} else if c.SessionStore == "memory" {
+		sessions = newMemorySessionStore(c.SessionStoreMaxEntries)
+	}
+
+	if c.SessionStore == "redis" && c.RedisURL == "" {
+		log.Fatal("\"redis-url\" must be set to keep sessions in redis")
+	}
+	if c.RedisURL != "" {
+		client, err := NewRedisClient(c.RedisURL, c.RedisCluster)
+		if err != nil {
+			log.Fatalf("invalid redis-url: %v", err)
+		} else {
+			counters = NewRedisCounterStore(client)
+			if c.SessionStore == "redis" {
+				store := NewRedisSessionStore(client)
+				store.startIndexEmails()
+				sessions = NewFailoverSessionStore(store, c.SessionStoreDegradedMode)
+			}
+		}
+	}
+
+	if c.SessionStore == "sql" {
+		if c.SQLDSN == "" {
+			log.Fatal("\"sql-dsn\" must be set to keep sessions in sql")
+		} else if c.SQLMaxConns < 1 {
+			log.Fatal("\"sql-max-conns\" must be at least 1")
+		} else if store, err := OpenSQLSessionStore(c.SQLDriver, c.SQLDSN, c.SQLMaxConns); err != nil {
+			log.Fatalf("unable to set up the sql session store: %v", err)
+		} else {
+			store.startPurge(sqlPurgeInterval)
+			sessions = NewFailoverSessionStore(store, c.SessionStoreDegradedMode)
+		}
+	}
+
+	// Upgrade persistent stores written by previous releases
+	if err := MigrateStores(c, false, ioutil.Discard); err != nil {
+		log.Fatalf("unable to migrate %v", err)
+	}
+
+	if c.FallbackCache != "" {
+		cache, err := NewIdentityCache(c.FallbackCache, c.Secret, c.FallbackMaxStaleness, c.previousSecrets...)
+		if err != nil {
+			log.Fatalf("unable to load fallback-cache: %v", err)
+		}
+		fallbackCache = cache
+	}
+
+	if c.UserDirectory != "" {
+		directory, err := NewUserDirectory(c.UserDirectory)
+		if err != nil {
+			log.Fatalf("unable to load user-directory: %v", err)
+		}
+		userDirectory = directory
+	}
+
+	roleGrants = nil
+	if c.RoleGrants != "" {
+		grants, err := NewGrantStore(c.RoleGrants)
+		if err != nil {
+			log.Fatalf("unable to load role-grants: %v", err)
+		}
+		roleGrants = grants
+	}
+
+	userTags = nil
+	if c.UserTags != "" {
+		tags, err := NewTagStore(c.UserTags)
+		if err != nil {
+			log.Fatalf("unable to load user-tags: %v", err)
+		}
+		userTags = tags
+	}
+
+	if c.AuditFileMaxSize < 0 || c.AuditFileMaxBackups < 0 {
+		log.Fatal("\"audit-file-max-size\" and \"audit-file-max-backups\" must not be negative")
+	} else if audit, err := NewAuditLog(c); err != nil {
+		log.Fatalf("unable to set up the audit log: %v", err)
+	} else {
+		auditLog = audit
+	}
+
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		log.Fatal("\"tracing-sample-ratio\" must be between 0 and 1")
+	} else if p, err := NewTracerProvider(c); err != nil {
+		log.Fatalf("unable to set up tracing: %v", err)
+	} else {
+		setTracerProvider(p)
+	}
+
+	if err := setupSecurityEvents(c); err != nil {
+		log.Fatal(err)
+	}
+
+	if c.RoleMap != "" {
+		m, err := NewRoleMap(c.RoleMap)
+		if err != nil {
+			log.Fatalf("unable to load role-map: %v", err)
+		}
+		roleMap = m
+	}
+
+	if c.LoginScript != "" {
+		script, err := NewLoginScript(c.LoginScript)
+		if err != nil {
+			log.Fatalf("unable to load login-script: %v", err)
+		}
+		loginScript = script
 	}
 
 	// Setup default provider
@@ -275,6 +915,69 @@ func (c *Config) Validate() {
 			log.Fatal(err)
 		}
 	}
+
+	c.fingerprint = c.computeFingerprint()
+	if c.InstanceID == "" {
+		c.InstanceID = defaultInstanceID()
+	}
+}
+
+// validateAccessLists checks the global lists users are matched against, which
+// are also checked before they're swapped in on reload
+func (c *Config) validateAccessLists() error {
+	if err := validatePatterns(c.Whitelist); err != nil {
+		return fmt.Errorf("invalid whitelist, %v", err)
+	}
+	if err := validatePatterns(c.Domains); err != nil {
+		return fmt.Errorf("invalid domain, %v", err)
+	}
+	if err := validatePatterns(c.BlockedUsers); err != nil {
+		return fmt.Errorf("invalid blocked-users, %v", err)
+	}
+	if err := validatePatterns(c.BlockedDomains); err != nil {
+		return fmt.Errorf("invalid blocked-domains, %v", err)
+	}
+	if c.UserTags == "" && (len(c.AllowedTags) > 0 || len(c.BlockedTags) > 0) {
+		return errors.New("\"user-tags\" must be set to allow or block users by their tags")
+	}
+	return nil
+}
+
+// validateHost checks a configured host is a bare host name, as opposed to a
+// URL, and that it can be used as a cookie domain
+func validateHost(host string, allowPort bool) error {
+	if strings.Contains(host, "://") || strings.Contains(host, "/") {
+		return errors.New("must be a host name without protocol or path")
+	}
+	if strings.HasPrefix(host, ".") {
+		return errors.New("must not start with a \".\", subdomains are matched automatically")
+	}
+	if strings.Contains(host, ":") {
+		if !allowPort {
+			return errors.New("must not contain a port")
+		}
+		host = strings.Split(host, ":")[0]
+	}
+	if host == "" || strings.ContainsAny(host, " \t") {
+		return errors.New("must not be empty or contain whitespace")
+	}
+	return nil
+}
+
+// adminEnabled reports whether the admin endpoints are available, which needs
+// a token or roles to permit access
+func (c *Config) adminEnabled() bool {
+	return c.AdminToken != "" || len(c.AdminRoles) > 0 || len(c.AdminViewerRoles) > 0
+}
+
+func (c *Config) matchesCookieDomain(host string) bool {
+	host = strings.Split(host, ":")[0]
+	for _, d := range c.CookieDomains {
+		if d.Match(host) {
+			return true
+		}
+	}
+	return false
 }
 
 func (c Config) String() string {
@@ -291,6 +994,18 @@ func (c *Config) GetProvider(name string) (provider.Provider, error) {
 		return &c.Providers.OIDC, nil
 	case "generic-oauth":
 		return &c.Providers.GenericOAuth, nil
+	case "tailscale":
+		return &c.Providers.Tailscale, nil
+	case "ldap":
+		return &c.Providers.LDAP, nil
+	case "saml":
+		return &c.Providers.SAML, nil
+	}
+
+	if strings.HasPrefix(name, "oidc.") {
+		if p, ok := c.OIDCProviders[strings.TrimPrefix(name, "oidc.")]; ok {
+			return p, nil
+		}
 	}
 
 	return nil, fmt.Errorf("Unknown provider: %s", name)
@@ -315,14 +1030,52 @@ func (c *Config) providerConfigured(name string) bool {
 
 	// Check rule providers
 	for _, rule := range c.Rules {
-		if name == rule.Provider {
-			return true
+		for _, p := range rule.Providers() {
+			if name == p {
+				return true
+			}
 		}
 	}
 
 	return false
 }
 
+// configuredProviderNames returns the names of all configured providers, the
+// default provider first
+func (c *Config) configuredProviderNames() []string {
+	names := []string{c.DefaultProvider}
+	seen := map[string]bool{c.DefaultProvider: true}
+
+	var others []string
+	for _, rule := range c.Rules {
+		for _, p := range rule.Providers() {
+			if !seen[p] {
+				seen[p] = true
+				others = append(others, p)
+			}
+		}
+	}
+	sort.Strings(others)
+
+	return append(names, others...)
+}
+
+// interactiveProviders filters the given providers to those that users log in
+// to with their browser
+func (c *Config) interactiveProviders(names []string) []string {
+	var interactive []string
+	for _, name := range names {
+		p, err := c.GetProvider(name)
+		if err != nil {
+			continue
+		}
+		if _, ok := p.(provider.Identifier); !ok {
+			interactive = append(interactive, name)
+		}
+	}
+	return interactive
+}
+
 func (c *Config) setupProvider(name string) error {
 	// Check provider exists
 	p, err := c.GetProvider(name)
@@ -330,8 +1083,15 @@ func (c *Config) setupProvider(name string) error {
 		return err
 	}
 
-	// Setup
+	// Consent checks and renewal need a refresh token
+	if google, ok := p.(*provider.Google); ok {
+		google.Offline = c.ConsentCheckInterval > 0 || c.RenewWindow > 0
+	}
+
+	// Setup, this includes discovery for providers that support it
+	start := time.Now()
 	err = p.Setup()
+	observeProviderRequest(name, "discovery", start, err)
 	if err != nil {
 		return err
 	}
@@ -343,10 +1103,41 @@ func (c *Config) setupProvider(name string) error {
 type Rule struct {
 	Action       string
 	Rule         string
+	Priority     int
 	Provider     string
 	Whitelist    CommaSeparatedList
 	Domains      CommaSeparatedList
 	AllowedRoles CommaSeparatedList
+	Fallback     bool
+	RequireHTTPS string
+	HSTS         int
+	SessionHash  string
+	GracePeriod  time.Duration
+	GracePaths   CommaSeparatedList
+	StreamGrace  time.Duration
+	StreamPaths  CommaSeparatedList
+	Canary       int
+	CanaryKey    string
+	TenantClaim  string
+	Tenants      CommaSeparatedList
+	Headers      CommaSeparatedList
+	Methods      CommaSeparatedList
+
+	HSTSSubdomains bool
+
+	TrustedIPNetworks CommaSeparatedList
+	IdleTimeout       time.Duration
+	AllowedGroups     CommaSeparatedList
+	BlockedUsers      CommaSeparatedList
+	BlockedDomains    CommaSeparatedList
+	AllowedTags       CommaSeparatedList
+	BlockedTags       CommaSeparatedList
+
+	Authorizer           string
+	AuthorizerTimeout    time.Duration
+	AuthorizerCache      time.Duration
+	AuthorizerFailPolicy string
+	AuthorizerFormat     string
 }
 
 // NewRule creates a new rule object
@@ -356,19 +1147,179 @@ func NewRule() *Rule {
 	}
 }
 
+// Providers returns the providers a user may choose from to satisfy the rule
+func (r *Rule) Providers() []string {
+	return splitProviders(r.Provider)
+}
+
+func splitProviders(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 func (r *Rule) formattedRule() string {
 	// Traefik implements their own "Host" matcher and then offers "HostRegexp"
-	// to invoke the mux "Host" matcher. This ensures the mux version is used
-	return strings.ReplaceAll(r.Rule, "Host(", "HostRegexp(")
+	// to invoke the mux "Host" matcher. This ensures the mux version is used,
+	// with the hosts in the canonical form requests are matched in
+	return strings.ReplaceAll(canonicalRuleHosts(r.Rule), "Host(", "HostRegexp(")
 }
 
 // Validate validates a rule
 func (r *Rule) Validate(c *Config) error {
-	if r.Action != "auth" && r.Action != "allow" {
-		return errors.New("invalid rule action, must be \"auth\" or \"allow\"")
+	if r.Action != "auth" && r.Action != "allow" && r.Action != "deny" {
+		return errors.New("invalid rule action, must be \"auth\", \"allow\" or \"deny\"")
+	}
+
+	if r.Rule != "" {
+		if err := validateRuleSyntax(r.formattedRule()); err != nil {
+			return fmt.Errorf("invalid rule rule, %v", err)
+		}
+	}
+
+	if r.Priority < 0 {
+		return errors.New("invalid rule priority, must not be negative")
+	}
+
+	if err := validatePatterns(r.Whitelist); err != nil {
+		return fmt.Errorf("invalid rule whitelist, %v", err)
+	}
+
+	if err := validatePatterns(r.Domains); err != nil {
+		return fmt.Errorf("invalid rule domains, %v", err)
+	}
+
+	if err := validatePatterns(r.BlockedUsers); err != nil {
+		return fmt.Errorf("invalid rule blockedUsers, %v", err)
+	}
+
+	if err := validatePatterns(r.BlockedDomains); err != nil {
+		return fmt.Errorf("invalid rule blockedDomains, %v", err)
+	}
+
+	if r.RequireHTTPS != "" && r.RequireHTTPS != "reject" && r.RequireHTTPS != "redirect" {
+		return errors.New("invalid rule requireHttps, must be \"reject\" or \"redirect\"")
+	}
+
+	if r.SessionHash != "" && r.SessionHash != "user" && r.SessionHash != "group" {
+		return errors.New("invalid rule sessionHash, must be \"user\" or \"group\"")
+	}
+
+	if r.HSTS < 0 {
+		return errors.New("invalid rule hsts, must be a max-age in seconds")
+	}
+
+	if r.Authorizer != "" {
+		if r.Action != "auth" {
+			return errors.New("invalid rule authorizer, only auth rules have a user to authorize")
+		}
+		if err := validateAuthorizerURL(r.Authorizer); err != nil {
+			return err
+		}
+	}
+
+	if r.AuthorizerFailPolicy != "" && r.AuthorizerFailPolicy != "allow" && r.AuthorizerFailPolicy != "deny" {
+		return errors.New("invalid rule authorizerFailPolicy, must be \"allow\" or \"deny\"")
+	}
+
+	if r.AuthorizerFormat != "" && r.AuthorizerFormat != "webhook" && r.AuthorizerFormat != "opa" {
+		return errors.New("invalid rule authorizerFormat, must be \"webhook\" or \"opa\"")
+	} else if r.AuthorizerFormat != "" && r.Authorizer == "" {
+		return errors.New("invalid rule authorizerFormat, only applies to the rule's own authorizer")
+	}
+
+	if r.AuthorizerTimeout < 0 || r.AuthorizerCache < 0 {
+		return errors.New("invalid rule authorizerTimeout or authorizerCache, must not be negative")
+	}
+
+	if r.Canary < 0 || r.Canary > 100 {
+		return errors.New("invalid rule canary, must be a percentage from 0 to 100")
+	}
+
+	if r.CanaryKey != "" && r.CanaryKey != "ip" && r.CanaryKey != "session" {
+		return errors.New("invalid rule canaryKey, must be \"ip\" or \"session\"")
+	}
+
+	if r.StreamGrace < 0 {
+		return errors.New("invalid rule streamGrace, must not be negative")
+	}
+
+	if len(r.StreamPaths) > 0 && r.StreamGrace == 0 {
+		return errors.New("invalid rule streamPaths, streamGrace must also be set")
+	}
+
+	if r.TenantClaim != "" && r.Action != "auth" {
+		return errors.New("invalid rule tenantClaim, only auth rules have a user to take the tenant from")
 	}
 
-	return c.setupProvider(r.Provider)
+	if len(r.Tenants) > 0 && r.TenantClaim == "" {
+		return errors.New("invalid rule tenants, tenantClaim must also be set")
+	}
+
+	if r.IdleTimeout < 0 {
+		return errors.New("invalid rule idleTimeout, must not be negative")
+	}
+
+	if r.IdleTimeout > 0 && r.Action != "auth" {
+		return errors.New("invalid rule idleTimeout, only auth rules have a session to expire")
+	}
+
+	if r.IdleTimeout > 0 && c.StatelessCookie {
+		return errors.New("invalid rule idleTimeout, session activity can't be kept with stateless-cookie")
+	}
+
+	if _, err := parseNetworks(r.TrustedIPNetworks); err != nil {
+		return fmt.Errorf("invalid rule trustedIpNetworks, %v", err)
+	}
+
+	if len(r.Headers) > 0 && r.Action != "auth" {
+		return errors.New("invalid rule headers, only auth rules have a user to pass")
+	}
+
+	for _, spec := range r.Headers {
+		if _, err := parseHeaderMapping(spec); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Methods) > 0 && r.Action != "auth" {
+		return errors.New("invalid rule methods, only auth rules have a user with roles")
+	}
+
+	for _, spec := range r.Methods {
+		if _, err := parseMethodGrant(spec); err != nil {
+			return err
+		}
+	}
+
+	if r.GracePeriod < 0 {
+		return errors.New("invalid rule gracePeriod, must not be negative")
+	}
+
+	if r.GracePeriod > 0 && len(r.GracePaths) == 0 {
+		return errors.New("invalid rule gracePeriod, gracePaths must also be set")
+	}
+
+	for _, p := range r.Providers() {
+		if err := c.setupProvider(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateAuthorizerURL checks a rule authorizer is an absolute http(s) URL
+func validateAuthorizerURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid rule authorizer, must be an absolute http or https URL")
+	}
+	return nil
 }
 
 // Legacy support for comma separated lists
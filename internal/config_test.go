@@ -38,6 +38,10 @@ func TestConfigDefaults(t *testing.T) {
 	assert.Equal("/_oauth", c.Path)
 	assert.Len(c.Whitelist, 0)
 	assert.Equal(c.Port, 4181)
+	assert.Equal(0, c.RateLimit)
+	assert.Equal("", c.AdminToken)
+	assert.Equal(2*time.Second, c.ProviderLatencyObjective)
+	assert.Equal(0.99, c.ProviderSLOTarget)
 
 	assert.Equal("select_account", c.Providers.Google.Prompt)
 }
@@ -86,6 +90,15 @@ func TestConfigParseUnknownFlags(t *testing.T) {
 	}
 }
 
+func TestConfigParsePublicSuffixCookieDomain(t *testing.T) {
+	_, err := NewConfig([]string{
+		"--cookie-domain=co.uk",
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "\"co.uk\" is a public suffix")
+	}
+}
+
 func TestConfigParseRuleError(t *testing.T) {
 	assert := assert.New(t)
 
@@ -332,14 +345,14 @@ func TestConfigValidate(t *testing.T) {
 	assert.Equal(logrus.FatalLevel, logs[1].Level)
 
 	// Should validate rule
-	assert.Equal("invalid rule action, must be \"auth\" or \"allow\"", logs[2].Message)
+	assert.Equal("invalid rule action, must be \"auth\", \"allow\" or \"deny\"", logs[2].Message)
 	assert.Equal(logrus.FatalLevel, logs[2].Level)
 
 	hook.Reset()
 
 	// Validate with invalid providers
 	c, _ = NewConfig([]string{
-		"--secret=veryverysecret",
+		"--secret=veryveryverysecret",
 		"--providers.google.client-id=id",
 		"--providers.google.client-secret=secret",
 		"--rule.1.action=auth",
@@ -355,6 +368,145 @@ func TestConfigValidate(t *testing.T) {
 	assert.Equal(logrus.FatalLevel, logs[0].Level)
 }
 
+func TestConfigValidateSanity(t *testing.T) {
+	assert := assert.New(t)
+
+	// Install new logger + hook
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	// Should refuse short secret and inconsistent auth host
+	c, _ := NewConfig([]string{
+		"--secret=short",
+		"--lifetime=0",
+		"--cookie-domain=.example.com",
+		"--auth-host=auth.another.com",
+		"--providers.google.client-id=id ",
+		"--providers.google.client-secret=secret",
+	})
+	c.Validate()
+
+	logs := hook.AllEntries()
+	if assert.Len(logs, 5) {
+		assert.Equal("\"secret\" must be at least 16 characters, generate one with e.g. \"openssl rand -hex 16\"", logs[0].Message)
+		assert.Equal("\"lifetime\" must be greater than 0", logs[1].Message)
+		assert.Equal("invalid cookie-domain \".example.com\": must not start with a \".\", subdomains are matched automatically", logs[2].Message)
+		assert.Equal("auth-host \"auth.another.com\" is not a subdomain of any cookie-domain, auth host mode requires a matching cookie-domain", logs[3].Message)
+		assert.Equal("providers.google.client-id must not contain leading or trailing whitespace", logs[4].Message)
+	}
+
+	hook.Reset()
+
+	// Should accept consistent config
+	c, _ = NewConfig([]string{
+		"--secret=veryveryverysecret",
+		"--cookie-domain=example.com",
+		"--auth-host=auth.example.com:8443",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+	})
+	c.Validate()
+	assert.Len(hook.AllEntries(), 0)
+
+	// Should refuse url as auth host
+	c.AuthHost = "https://auth.example.com"
+	c.Validate()
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("invalid auth-host \"https://auth.example.com\": must be a host name without protocol or path", logs[0].Message)
+	}
+
+	hook.Reset()
+
+	// Should refuse jwt lifetime outliving the key
+	c.AuthHost = ""
+	c.JWT = true
+	c.JWTLifetime = 2 * time.Hour
+	c.JWTKeyRotation = time.Hour
+	c.Validate()
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("\"jwt-lifetime\" must be greater than 0 and shorter than \"jwt-key-rotation\", which must be at least 1m", logs[0].Message)
+	}
+
+	hook.Reset()
+
+	// Should refuse renewing sessions for their whole lifetime
+	c.JWT = false
+	c.RenewWindow = c.Lifetime
+	c.Validate()
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("\"renew-window\" must be shorter than the lifetime", logs[0].Message)
+	}
+
+	hook.Reset()
+
+	// Should parse login page labels
+	c.RenewWindow = 0
+	c.LoginProviderLabels = []string{"oidc.corp:Corporate SSO", "google"}
+	c.Validate()
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("invalid login-provider-label \"google\", must be in the format provider:label", logs[0].Message)
+	}
+	assert.Equal(map[string]string{"oidc.corp": "Corporate SSO"}, c.loginProviderLabels)
+}
+
+func TestConfigValidateSessionStore(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	// Should require redis to keep sessions in
+	c, _ := NewConfig([]string{
+		"--secret=veryverylongsecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--session-store=redis",
+	})
+	c.Validate()
+	logs := hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("\"redis-url\" must be set to keep sessions in redis", logs[0].Message)
+	}
+}
+
+func TestConfigValidateSigner(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	// Should require a JWT key to sign JWTs with a KMS
+	c, _ := NewConfig([]string{
+		"--secret=veryverylongsecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--jwt",
+		"--signer=pkcs11",
+	})
+	c.Validate()
+	logs := hook.AllEntries()
+	if assert.Len(logs, 2) {
+		assert.Equal("\"signer-jwt-key\" must be set to sign downstream JWTs with the pkcs11 signer", logs[0].Message)
+		assert.Contains(logs[1].Message, "unable to set up pkcs11 signer: ")
+	}
+
+	// Should default to the secret
+	hook.Reset()
+	c, _ = NewConfig([]string{
+		"--secret=veryverylongsecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+	})
+	c.Validate()
+	assert.Len(hook.AllEntries(), 0)
+	assert.Equal(secretSigner{}, c.signer)
+}
+
 func TestConfigGetProvider(t *testing.T) {
 	assert := assert.New(t)
 	c, _ := NewConfig([]string{})
@@ -379,6 +531,55 @@ func TestConfigGetProvider(t *testing.T) {
 	if assert.Error(err) {
 		assert.Equal("Unknown provider: bad", err.Error())
 	}
+	p, err = c.GetProvider("oidc.corp")
+	if assert.Error(err) {
+		assert.Equal("Unknown provider: oidc.corp", err.Error())
+	}
+}
+
+func TestConfigNamedOIDCProviders(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--providers.oidc.corp.issuer-url=https://sso.example.com/realms/corp",
+		"--providers.oidc.corp.client-id=corp-id",
+		"--providers.oidc.corp.client-secret", "corp-secret",
+		"--providers.oidc.partners.issuer-url=https://partners.example.com",
+		"--rule.1.provider=google, oidc.corp",
+	})
+	assert.Nil(err)
+
+	// Should parse each provider
+	if assert.Len(c.OIDCProviders, 2) {
+		corp := c.OIDCProviders["corp"]
+		assert.Equal("oidc.corp", corp.Name())
+		assert.Equal("https://sso.example.com/realms/corp", corp.IssuerURL)
+		assert.Equal("corp-id", corp.ClientID)
+		assert.Equal("corp-secret", corp.ClientSecret)
+	}
+
+	// Should be used by rules by name
+	p, err := c.GetConfiguredProvider("oidc.corp")
+	assert.Nil(err)
+	assert.Equal(c.OIDCProviders["corp"], p)
+	_, err = c.GetConfiguredProvider("oidc.partners")
+	if assert.Error(err) {
+		assert.Equal("Unconfigured provider: oidc.partners", err.Error())
+	}
+	assert.Equal([]string{"google", "oidc.corp"}, c.configuredProviderNames())
+
+	// Should catch invalid params
+	_, err = NewConfig([]string{"--providers.oidc.corp.scope=groups"})
+	if assert.Error(err) {
+		assert.Equal("invalid provider param: providers.oidc.corp.scope", err.Error())
+	}
+	_, err = NewConfig([]string{"--providers.oidc..client-id=id"})
+	if assert.Error(err) {
+		assert.Equal("provider name is required", err.Error())
+	}
+	_, err = NewConfig([]string{"--providers.oidc.corp.client-id="})
+	if assert.Error(err) {
+		assert.Equal("provider param value is required", err.Error())
+	}
 }
 
 func TestConfigGetConfiguredProvider(t *testing.T) {
@@ -397,6 +598,266 @@ func TestConfigGetConfiguredProvider(t *testing.T) {
 	}
 }
 
+func TestConfigRuleProviders(t *testing.T) {
+	assert := assert.New(t)
+	c, _ := NewConfig([]string{
+		"--rule.1.provider=oidc, generic-oauth",
+		"--rule.2.provider=oidc",
+	})
+
+	assert.Equal([]string{"oidc", "generic-oauth"}, c.Rules["1"].Providers())
+	assert.Equal([]string{"google", "generic-oauth", "oidc"}, c.configuredProviderNames())
+
+	// Should consider all rule providers as configured
+	_, err := c.GetConfiguredProvider("generic-oauth")
+	assert.Nil(err)
+}
+
+func TestConfigGoogleOffline(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+	})
+	assert.Nil(err)
+
+	// Should only request offline access when a refresh token is needed
+	assert.Nil(c.setupProvider("google"))
+	assert.False(c.Providers.Google.Offline)
+
+	c.ConsentCheckInterval = time.Hour
+	assert.Nil(c.setupProvider("google"))
+	assert.True(c.Providers.Google.Offline)
+
+	c.ConsentCheckInterval = 0
+	c.RenewWindow = time.Minute
+	assert.Nil(c.setupProvider("google"))
+	assert.True(c.Providers.Google.Offline)
+}
+
+func TestConfigRuleScheme(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--rule.1.requireHttps=redirect",
+		"--rule.1.hsts=31536000",
+	})
+	assert.Nil(err)
+	assert.Equal("redirect", c.Rules["1"].RequireHTTPS)
+	assert.Equal(31536000, c.Rules["1"].HSTS)
+	assert.False(c.Rules["1"].HSTSSubdomains)
+
+	c, err = NewConfig([]string{
+		"--rule.1.hsts=31536000",
+		"--rule.1.hstsSubdomains=true",
+	})
+	assert.Nil(err)
+	assert.True(c.Rules["1"].HSTSSubdomains)
+
+	// Should reject invalid values
+	_, err = NewConfig([]string{
+		"--rule.1.hsts=forever",
+	})
+	if assert.Error(err) {
+		assert.Equal("invalid hsts value for rule 1: forever", err.Error())
+	}
+
+	rule := NewRule()
+	rule.SessionHash = "email"
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule sessionHash, must be \"user\" or \"group\"", err.Error())
+	}
+
+	rule = NewRule()
+	rule.RequireHTTPS = "always"
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule requireHttps, must be \"reject\" or \"redirect\"", err.Error())
+	}
+}
+
+func TestConfigRuleGracePeriod(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--rule.1.gracePeriod=2m",
+		"--rule.1.gracePaths=/static/,*.css",
+	})
+	assert.Nil(err)
+	assert.Equal(2*time.Minute, c.Rules["1"].GracePeriod)
+	assert.Equal(CommaSeparatedList{"/static/", "*.css"}, c.Rules["1"].GracePaths)
+
+	// Should reject invalid values
+	_, err = NewConfig([]string{
+		"--rule.1.gracePeriod=soon",
+	})
+	if assert.Error(err) {
+		assert.Equal("invalid gracePeriod value for rule 1: soon", err.Error())
+	}
+
+	rule := NewRule()
+	rule.GracePeriod = time.Minute
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule gracePeriod, gracePaths must also be set", err.Error())
+	}
+}
+
+func TestConfigRuleAuthorizer(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--rule.1.authorizer=https://authz.example.com/check",
+		"--rule.1.authorizerTimeout=500ms",
+		"--rule.1.authorizerCache=1m",
+		"--rule.1.authorizerFailPolicy=allow",
+	})
+	assert.Nil(err)
+	assert.Equal("https://authz.example.com/check", c.Rules["1"].Authorizer)
+	assert.Equal(500*time.Millisecond, c.Rules["1"].AuthorizerTimeout)
+	assert.Equal(time.Minute, c.Rules["1"].AuthorizerCache)
+	assert.Equal("allow", c.Rules["1"].AuthorizerFailPolicy)
+
+	// Should reject invalid values
+	_, err = NewConfig([]string{
+		"--rule.1.authorizerTimeout=fast",
+	})
+	if assert.Error(err) {
+		assert.Equal("invalid authorizerTimeout value for rule 1: fast", err.Error())
+	}
+
+	rule := NewRule()
+	rule.Authorizer = "authz.example.com"
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule authorizer, must be an absolute http or https URL", err.Error())
+	}
+
+	rule = NewRule()
+	rule.Action = "allow"
+	rule.Authorizer = "https://authz.example.com/check"
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule authorizer, only auth rules have a user to authorize", err.Error())
+	}
+
+	rule = NewRule()
+	rule.AuthorizerFailPolicy = "maybe"
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule authorizerFailPolicy, must be \"allow\" or \"deny\"", err.Error())
+	}
+}
+
+func TestConfigRuleCanary(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--rule.1.canary=10",
+		"--rule.1.canaryKey=session",
+	})
+	assert.Nil(err)
+	assert.Equal(10, c.Rules["1"].Canary)
+	assert.Equal("session", c.Rules["1"].CanaryKey)
+
+	// Should reject invalid values
+	_, err = NewConfig([]string{
+		"--rule.1.canary=10%",
+	})
+	if assert.Error(err) {
+		assert.Equal("invalid canary value for rule 1: 10%", err.Error())
+	}
+
+	rule := NewRule()
+	rule.Canary = 101
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule canary, must be a percentage from 0 to 100", err.Error())
+	}
+
+	rule = NewRule()
+	rule.CanaryKey = "cookie"
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule canaryKey, must be \"ip\" or \"session\"", err.Error())
+	}
+}
+
+func TestConfigRuleStreamGrace(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--rule.1.streamGrace=10m",
+		"--rule.1.streamPaths=/poll/,/events",
+	})
+	assert.Nil(err)
+	assert.Equal(10*time.Minute, c.Rules["1"].StreamGrace)
+	assert.Equal(CommaSeparatedList{"/poll/", "/events"}, c.Rules["1"].StreamPaths)
+
+	// Should reject invalid values
+	_, err = NewConfig([]string{
+		"--rule.1.streamGrace=10",
+	})
+	if assert.Error(err) {
+		assert.Equal("invalid streamGrace value for rule 1: 10", err.Error())
+	}
+
+	rule := NewRule()
+	rule.StreamGrace = -time.Minute
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule streamGrace, must not be negative", err.Error())
+	}
+
+	rule = NewRule()
+	rule.StreamPaths = CommaSeparatedList{"/poll/"}
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule streamPaths, streamGrace must also be set", err.Error())
+	}
+}
+
+func TestConfigRuleTenant(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--rule.1.tenantClaim=org_id",
+		"--rule.1.tenants=acme,globex",
+	})
+	assert.Nil(err)
+	assert.Equal("org_id", c.Rules["1"].TenantClaim)
+	assert.Equal(CommaSeparatedList{"acme", "globex"}, c.Rules["1"].Tenants)
+	assert.Equal("X-Forwarded-Tenant", c.TenantHeader)
+
+	// Should reject invalid values
+	rule := NewRule()
+	rule.Tenants = CommaSeparatedList{"acme"}
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule tenants, tenantClaim must also be set", err.Error())
+	}
+
+	rule = NewRule()
+	rule.Action = "allow"
+	rule.TenantClaim = "org_id"
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule tenantClaim, only auth rules have a user to take the tenant from", err.Error())
+	}
+}
+
+func TestConfigRuleMethods(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--rule.1.methods=viewer:GET,editor:GET|POST|PUT|DELETE",
+	})
+	assert.Nil(err)
+	assert.Equal(CommaSeparatedList{"viewer:GET", "editor:GET|POST|PUT|DELETE"}, c.Rules["1"].Methods)
+
+	// Should reject invalid values
+	rule := NewRule()
+	rule.Methods = CommaSeparatedList{"viewer"}
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal(`invalid rule methods "viewer", must be in the format role:METHOD|METHOD`, err.Error())
+	}
+
+	rule = NewRule()
+	rule.Methods = CommaSeparatedList{"viewer:GET|/"}
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal(`invalid rule methods "viewer:GET|/", "/" is not a method`, err.Error())
+	}
+
+	rule = NewRule()
+	rule.Action = "allow"
+	rule.Methods = CommaSeparatedList{"viewer:GET"}
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule methods, only auth rules have a user with roles", err.Error())
+	}
+}
+
 func TestConfigCommaSeparatedList(t *testing.T) {
 	assert := assert.New(t)
 	list := CommaSeparatedList{}
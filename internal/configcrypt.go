@@ -0,0 +1,101 @@
+package tfa
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// Encrypted config
+//
+// Config files can be encrypted with age (https://age-encryption.org), binary
+// or armored, so a full config including client secrets can be kept in git.
+// They're decrypted as they're read, at startup and on reload, with the
+// identity in CONFIG_AGE_KEY or the identity file at CONFIG_AGE_KEY_FILE. The
+// key is taken from the environment as it's needed before the options are
+// parsed, it can be put there from a KMS or secret manager by the deployment
+// (e.g. a Kubernetes secret)
+
+const (
+	configAgeKeyEnv     = "CONFIG_AGE_KEY"
+	configAgeKeyFileEnv = "CONFIG_AGE_KEY_FILE"
+)
+
+// ageMagic begins files encrypted with age
+const ageMagic = "age-encryption.org/"
+
+// readConfigFile reads a config file, decrypting it if it's encrypted. The
+// boolean reports whether it was
+func readConfigFile(name string) ([]byte, bool, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var src io.Reader
+	switch {
+	case bytes.HasPrefix(b, []byte(ageMagic)):
+		src = bytes.NewReader(b)
+	case bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte(armor.Header)):
+		src = armor.NewReader(bytes.NewReader(bytes.TrimLeft(b, " \t\r\n")))
+	default:
+		return b, false, nil
+	}
+
+	identities, err := configAgeIdentities()
+	if err != nil {
+		return nil, true, fmt.Errorf("config file %s is encrypted: %v", name, err)
+	}
+
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, true, fmt.Errorf("error decrypting config file %s: %v", name, err)
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, true, fmt.Errorf("error decrypting config file %s: %v", name, err)
+	}
+
+	return plain, true, nil
+}
+
+// configAgeIdentities returns the identities config files are decrypted with
+func configAgeIdentities() ([]age.Identity, error) {
+	var identities []age.Identity
+
+	if key := os.Getenv(configAgeKeyEnv); key != "" {
+		parsed, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", configAgeKeyEnv, err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	if path := os.Getenv(configAgeKeyFileEnv); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", configAgeKeyFileEnv, err)
+		}
+		defer f.Close()
+
+		parsed, err := age.ParseIdentities(bufio.NewReader(f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", configAgeKeyFileEnv, err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("set " + configAgeKeyEnv + " or " + configAgeKeyFileEnv + " to decrypt it")
+	}
+
+	return identities, nil
+}
@@ -0,0 +1,106 @@
+package tfa
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestConfigEncryptedFile(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv(configAgeKeyEnv)
+	defer os.Unsetenv(configAgeKeyFileEnv)
+
+	identity, err := age.GenerateX25519Identity()
+	require.Nil(t, err)
+	contents := "cookie-name=encryptedcookiename\nrule.one.action=allow\nrule.one.rule=PathPrefix(`/one`)\n"
+	dir := t.TempDir()
+	binary := writeEncryptedConfig(t, dir, "config.age", contents, identity.Recipient(), false)
+	armored := writeEncryptedConfig(t, dir, "config.asc", contents, identity.Recipient(), true)
+
+	// Should require a key
+	os.Unsetenv(configAgeKeyEnv)
+	_, err = NewConfig([]string{"--config=" + binary})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "set CONFIG_AGE_KEY or CONFIG_AGE_KEY_FILE")
+	}
+
+	// Should decrypt with the key from the environment
+	os.Setenv(configAgeKeyEnv, identity.String())
+	for _, name := range []string{binary, armored} {
+		c, err := NewConfig([]string{"--config=" + name})
+		if assert.Nil(err, name) {
+			assert.Equal("encryptedcookiename", c.CookieName, name)
+			assert.Equal("PathPrefix(`/one`)", c.Rules["one"].Rule, name)
+		}
+	}
+
+	// Should decrypt with the key file
+	os.Unsetenv(configAgeKeyEnv)
+	keyFile := filepath.Join(dir, "key.txt")
+	require.Nil(t, ioutil.WriteFile(keyFile, []byte("# test key\n"+identity.String()+"\n"), 0600))
+	os.Setenv(configAgeKeyFileEnv, keyFile)
+	c, err := NewConfig([]string{"--config=" + binary})
+	if assert.Nil(err) {
+		assert.Equal("encryptedcookiename", c.CookieName)
+	}
+
+	// Should refuse the wrong key
+	other, err := age.GenerateX25519Identity()
+	require.Nil(t, err)
+	os.Unsetenv(configAgeKeyFileEnv)
+	os.Setenv(configAgeKeyEnv, other.String())
+	_, err = NewConfig([]string{"--config=" + binary})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "error decrypting config file")
+	}
+
+	// Should still read plain config files
+	os.Unsetenv(configAgeKeyEnv)
+	c, err = NewConfig([]string{"--config=../test/config0"})
+	if assert.Nil(err) {
+		assert.Equal("inicookiename", c.CookieName)
+	}
+}
+
+/**
+ * Utilities
+ */
+
+// writeEncryptedConfig encrypts the contents to the recipient in a file in
+// the directory, returning its path
+func writeEncryptedConfig(t *testing.T, dir, name, contents string, recipient age.Recipient, armored bool) string {
+	var buf bytes.Buffer
+	var dst io.WriteCloser = nopWriteCloser{&buf}
+	if armored {
+		dst = armor.NewWriter(&buf)
+	}
+	w, err := age.Encrypt(dst, recipient)
+	require.Nil(t, err)
+	_, err = io.WriteString(w, contents)
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	require.Nil(t, dst.Close())
+
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, buf.Bytes(), 0600))
+	return path
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,174 @@
+package tfa
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Consent revocation
+//
+// When "consent-check-interval" is set, the refresh token issued at login is
+// periodically exchanged with the provider. If the provider reports the grant
+// is no longer valid (invalid_grant), the user has revoked the application's
+// consent or been disabled, so their session is terminated rather than being
+// honoured until the cookie expires
+
+var sessionsRevokedTotal = NewCounterVec("sessions_revoked_total",
+	"Sessions terminated before their cookie expired, by reason", "reason")
+
+type consentSession struct {
+	provider     string
+	email        string
+	refreshToken string
+	checked      time.Time
+}
+
+var consentSessions = struct {
+	sync.Mutex
+	sessions map[uuid.UUID]*consentSession
+}{sessions: make(map[uuid.UUID]*consentSession)}
+
+// trackConsent remembers the refresh token for the user's session so their
+// consent can be checked, if checks are enabled and the provider supports it
+func trackConsent(user *provider.User, providerName string, token *provider.Token) {
+	if config().ConsentCheckInterval <= 0 || token.RefreshToken == "" {
+		return
+	}
+	p, err := config().GetConfiguredProvider(providerName)
+	if err != nil {
+		return
+	}
+	if _, ok := p.(provider.Refresher); !ok {
+		return
+	}
+
+	consentSessions.Lock()
+	defer consentSessions.Unlock()
+
+	consentSessions.sessions[user.UUID] = &consentSession{
+		provider:     providerName,
+		email:        user.Email,
+		refreshToken: token.RefreshToken,
+		checked:      time.Now(),
+	}
+}
+
+// startConsentCheck checks the consent of the sessions tracked every interval,
+// until the background workers are stopped
+func startConsentCheck(interval time.Duration) {
+	background.Go(func(ctx context.Context) {
+		for sleepContext(ctx, interval) {
+			checkConsent()
+		}
+	})
+}
+
+// checkConsent refreshes the token of each session that is due a check,
+// terminating the sessions whose grant has been revoked
+func checkConsent() {
+	consentSessions.Lock()
+	due := make(map[uuid.UUID]consentSession)
+	for id, session := range consentSessions.sessions {
+		if entry, err := sessions.Get(id); err == nil && entry == nil {
+			// Session has expired or been revoked
+			delete(consentSessions.sessions, id)
+		} else if time.Since(session.checked) >= config().ConsentCheckInterval {
+			due[id] = *session
+		}
+	}
+	consentSessions.Unlock()
+
+	for id, session := range due {
+		// Sessions skipped for want of budget are checked on the next run
+		if err := waitProviderBudget(session.provider, "refresh", true); err != nil {
+			continue
+		}
+		token, err := refreshSession(session)
+
+		consentSessions.Lock()
+		if tracked, ok := consentSessions.sessions[id]; ok {
+			tracked.checked = time.Now()
+			if err == nil && token.RefreshToken != "" {
+				// Some providers rotate refresh tokens
+				tracked.refreshToken = token.RefreshToken
+			}
+		}
+		consentSessions.Unlock()
+
+		if err == nil && token.RefreshToken != "" {
+			if err := renewedRefreshToken(id, token.RefreshToken); err != nil {
+				log.WithField("error", err).Warn("Error storing rotated refresh token")
+			}
+		}
+
+		if provider.IsConsentRevoked(err) {
+			terminateSession(id, "consent_revoked", logrus.Fields{
+				"user":     session.email,
+				"provider": session.provider,
+				"error":    err,
+			})
+		} else if err != nil {
+			log.WithFields(logrus.Fields{
+				"user":     session.email,
+				"provider": session.provider,
+				"error":    err,
+			}).Warn("Error checking consent, will retry")
+		}
+	}
+}
+
+// consentChecked records a successful refresh of the session's token outside
+// of consent checks, e.g. by renewal, keeping any rotated refresh token
+func consentChecked(id uuid.UUID, refreshToken string) {
+	consentSessions.Lock()
+	defer consentSessions.Unlock()
+
+	if tracked, ok := consentSessions.sessions[id]; ok {
+		tracked.checked = time.Now()
+		tracked.refreshToken = refreshToken
+	}
+}
+
+func refreshSession(session consentSession) (*provider.Token, error) {
+	p, err := config().GetConfiguredProvider(session.provider)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	token, err := p.(provider.Refresher).Refresh(session.refreshToken)
+	observeProviderRequest(session.provider, "refresh", start, err)
+	return token, err
+}
+
+// terminateSession ends a session, the user will have to log in again on
+// their next request. It's forgotten by the fallback cache even if it can't be
+// removed from the session store, in which case the error is returned
+func terminateSession(id uuid.UUID, reason string, fields logrus.Fields) error {
+	err := sessions.Delete(id)
+	if err != nil {
+		log.WithField("error", err).Warn("Error removing session")
+	}
+	if fallbackCache != nil {
+		if err := fallbackCache.Forget(id); err != nil {
+			log.WithField("error", err).Warn("Error removing session from fallback cache")
+		}
+	}
+
+	consentSessions.Lock()
+	delete(consentSessions.sessions, id)
+	consentSessions.Unlock()
+
+	if err != nil {
+		return err
+	}
+	sessionsRevokedTotal.Inc(reason)
+	fields["session"] = id
+	auditEvent("session_terminated", reason, fields)
+	return nil
+}
@@ -0,0 +1,111 @@
+package tfa
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestConsentRevoked(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().ConsentCheckInterval = time.Hour
+
+	// Setup a provider that issues refresh tokens
+	revoked := false
+	var refreshed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/token" && r.PostForm.Get("grant_type") == "authorization_code":
+			fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh-1"}`)
+		case r.URL.Path == "/token" && revoked:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(400)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+		case r.URL.Path == "/token":
+			refreshed = append(refreshed, r.PostForm.Get("refresh_token"))
+			fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh-2"}`)
+		case r.URL.Path == "/userinfo":
+			fmt.Fprint(w, `{"email":"example@example.com"}`)
+		}
+	}))
+	defer server.Close()
+	config().Providers.Google.TokenURL, _ = url.Parse(server.URL + "/token")
+	config().Providers.Google.UserURL, _ = url.Parse(server.URL + "/userinfo")
+
+	// Log in
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	require.Equal(307, res.StatusCode)
+
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == config().CookieName {
+			cookie = c
+		}
+	}
+	require.NotNil(cookie)
+	user, err := ValidateCookie(req, cookie)
+	require.Nil(err)
+
+	// Should not check sessions before they're due
+	checkConsent()
+	assert.Empty(refreshed)
+
+	// Should check, keeping rotated refresh tokens
+	consentSessions.Lock()
+	consentSessions.sessions[user.UUID].checked = time.Now().Add(-2 * time.Hour)
+	consentSessions.Unlock()
+	checkConsent()
+	assert.Equal([]string{"refresh-1"}, refreshed)
+	entry, _ := sessions.Get(user.UUID)
+	assert.NotNil(entry, "session should be kept while consent is granted")
+
+	consentSessions.Lock()
+	assert.Equal("refresh-2", consentSessions.sessions[user.UUID].refreshToken)
+	consentSessions.sessions[user.UUID].checked = time.Now().Add(-2 * time.Hour)
+	consentSessions.Unlock()
+
+	// Should terminate the session once consent is revoked
+	terminated := sessionsRevokedTotal.Value("consent_revoked")
+	revoked = true
+	checkConsent()
+	entry, _ = sessions.Get(user.UUID)
+	assert.Nil(entry, "session should be terminated")
+	assert.Equal(terminated+1, sessionsRevokedTotal.Value("consent_revoked"))
+
+	consentSessions.Lock()
+	assert.NotContains(consentSessions.sessions, user.UUID)
+	consentSessions.Unlock()
+
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, cookie)
+	assert.Equal(307, res.StatusCode, "user should have to log in again")
+}
+
+func TestConsentNotTracked(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should not track sessions when disabled
+	user := newTestUser("untracked@example.com")
+	trackConsent(user, "google", &provider.Token{RefreshToken: "refresh"})
+
+	consentSessions.Lock()
+	assert.NotContains(consentSessions.sessions, user.UUID)
+	consentSessions.Unlock()
+}
@@ -0,0 +1,185 @@
+package tfa
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Counters
+
+// counters holds the rate limiting and lockout counters, and the issued access
+// codes, shared between instances when "redis-url" is configured
+var counters CounterStore = NewMemoryCounterStore()
+
+// CounterStore counts events per key. A key's count is reset once the window
+// that started with its first event has passed. It also keeps short lived
+// values, under keys distinct from the counters
+type CounterStore interface {
+	Incr(key string, window time.Duration) (int64, error)
+	Get(key string) (int64, error)
+	Set(key, value string, ttl time.Duration) error
+	Value(key string) (string, error)
+}
+
+// MemoryCounterStore keeps counters in memory, so limits are per instance
+type MemoryCounterStore struct {
+	mu        sync.Mutex
+	counts    map[string]*memoryCounter
+	lastPurge time.Time
+}
+
+type memoryCounter struct {
+	count   int64
+	value   string
+	expires time.Time
+}
+
+// NewMemoryCounterStore creates an empty in memory counter store
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{
+		counts: make(map[string]*memoryCounter),
+	}
+}
+
+// Incr increments the key, returning the new count
+func (s *MemoryCounterStore) Incr(key string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.purge(now)
+
+	counter, ok := s.counts[key]
+	if !ok || !now.Before(counter.expires) {
+		counter = &memoryCounter{expires: now.Add(window)}
+		s.counts[key] = counter
+	}
+	counter.count++
+
+	return counter.count, nil
+}
+
+// Get returns the current count for the key
+func (s *MemoryCounterStore) Get(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter, ok := s.counts[key]
+	if !ok || !time.Now().Before(counter.expires) {
+		return 0, nil
+	}
+	return counter.count, nil
+}
+
+// Set stores the value under the key until the ttl has passed
+func (s *MemoryCounterStore) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.purge(now)
+
+	s.counts[key] = &memoryCounter{value: value, expires: now.Add(ttl)}
+	return nil
+}
+
+// Value returns the value stored under the key, or "" if there isn't one
+func (s *MemoryCounterStore) Value(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter, ok := s.counts[key]
+	if !ok || !time.Now().Before(counter.expires) {
+		return "", nil
+	}
+	return counter.value, nil
+}
+
+// purge drops expired counters, at most once a minute. Must be called with the
+// lock held
+func (s *MemoryCounterStore) purge(now time.Time) {
+	if now.Sub(s.lastPurge) < time.Minute {
+		return
+	}
+	s.lastPurge = now
+
+	for key, counter := range s.counts {
+		if !now.Before(counter.expires) {
+			delete(s.counts, key)
+		}
+	}
+}
+
+// RedisCounterStore keeps counters in redis, so limits are enforced across all
+// instances. If redis is unavailable, counting falls back to this instance
+type RedisCounterStore struct {
+	client   redis.UniversalClient
+	prefix   string
+	fallback *MemoryCounterStore
+}
+
+// NewRedisCounterStore creates a counter store using the given client
+func NewRedisCounterStore(client redis.UniversalClient) *RedisCounterStore {
+	return &RedisCounterStore{
+		client:   client,
+		prefix:   "tfa:counter:",
+		fallback: NewMemoryCounterStore(),
+	}
+}
+
+// Incr increments the key, returning the new count
+func (s *RedisCounterStore) Incr(key string, window time.Duration) (int64, error) {
+	// Create the key with its expiry if it doesn't exist, then increment,
+	// which preserves the expiry
+	ctx := context.Background()
+	var incr *redis.IntCmd
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, s.prefix+key, "0", window)
+		incr = pipe.Incr(ctx, s.prefix+key)
+		return nil
+	})
+	if err == nil {
+		return incr.Val(), nil
+	}
+
+	log.WithField("error", err).Warn("Error incrementing counter in redis, counting locally")
+	return s.fallback.Incr(key, window)
+}
+
+// Get returns the current count for the key
+func (s *RedisCounterStore) Get(key string) (int64, error) {
+	value, err := s.client.Get(context.Background(), s.prefix+key).Result()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		log.WithField("error", err).Warn("Error reading counter from redis, using local count")
+		return s.fallback.Get(key)
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// Set stores the value under the key until the ttl has passed
+func (s *RedisCounterStore) Set(key, value string, ttl time.Duration) error {
+	err := s.client.Set(context.Background(), s.prefix+key, value, ttl).Err()
+	if err != nil {
+		log.WithField("error", err).Warn("Error storing value in redis, storing locally")
+		return s.fallback.Set(key, value, ttl)
+	}
+	return nil
+}
+
+// Value returns the value stored under the key, or "" if there isn't one
+func (s *RedisCounterStore) Value(key string) (string, error) {
+	value, err := s.client.Get(context.Background(), s.prefix+key).Result()
+	if err == redis.Nil {
+		return "", nil
+	} else if err != nil {
+		log.WithField("error", err).Warn("Error reading value from redis, using local value")
+		return s.fallback.Value(key)
+	}
+	return value, nil
+}
@@ -0,0 +1,104 @@
+package tfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestCountersMemory(t *testing.T) {
+	assert := assert.New(t)
+	s := NewMemoryCounterStore()
+
+	count, err := s.Incr("a", time.Minute)
+	assert.Nil(err)
+	assert.Equal(int64(1), count)
+	count, _ = s.Incr("a", time.Minute)
+	assert.Equal(int64(2), count)
+	count, _ = s.Get("a")
+	assert.Equal(int64(2), count)
+	count, _ = s.Get("b")
+	assert.Equal(int64(0), count)
+
+	// Should reset once the window has passed
+	s.counts["a"].expires = time.Now()
+	count, _ = s.Get("a")
+	assert.Equal(int64(0), count)
+	count, _ = s.Incr("a", time.Minute)
+	assert.Equal(int64(1), count)
+
+	// Should purge expired counters
+	s.counts["a"].expires = time.Now()
+	s.lastPurge = time.Time{}
+	s.Incr("b", time.Minute)
+	assert.NotContains(s.counts, "a")
+
+	// Should keep values until their ttl has passed
+	assert.Nil(s.Set("c", "value", time.Minute))
+	value, err := s.Value("c")
+	assert.Nil(err)
+	assert.Equal("value", value)
+	s.counts["c"].expires = time.Now()
+	value, _ = s.Value("c")
+	assert.Equal("", value)
+}
+
+func TestCountersRedis(t *testing.T) {
+	assert := assert.New(t)
+	server := newFakeRedis(t, "")
+	client, _ := NewRedisClient("redis://"+server.addr, false)
+	s := NewRedisCounterStore(client)
+
+	// Should count in redis, so counts are shared
+	count, err := s.Incr("a", time.Minute)
+	assert.Nil(err)
+	assert.Equal(int64(1), count)
+	count, _ = NewRedisCounterStore(client).Incr("a", time.Minute)
+	assert.Equal(int64(2), count)
+	count, _ = s.Get("a")
+	assert.Equal(int64(2), count)
+	assert.Equal("2", server.values["tfa:counter:a"])
+
+	// Should expire with the window
+	server.expires["tfa:counter:a"] = time.Now()
+	count, _ = s.Get("a")
+	assert.Equal(int64(0), count)
+	count, _ = s.Incr("a", time.Minute)
+	assert.Equal(int64(1), count)
+	assert.WithinDuration(time.Now().Add(time.Minute), server.expires["tfa:counter:a"], 5*time.Second)
+
+	// Should keep values in redis until their ttl has passed
+	assert.Nil(s.Set("b", "value", time.Minute))
+	assert.Equal("value", server.values["tfa:counter:b"])
+	assert.WithinDuration(time.Now().Add(time.Minute), server.expires["tfa:counter:b"], 5*time.Second)
+	value, err := NewRedisCounterStore(client).Value("b")
+	assert.Nil(err)
+	assert.Equal("value", value)
+	value, _ = s.Value("c")
+	assert.Equal("", value)
+}
+
+func TestCountersRedisFallback(t *testing.T) {
+	assert := assert.New(t)
+	client, _ := NewRedisClient("redis://127.0.0.1:1", false)
+	s := NewRedisCounterStore(client)
+
+	// Should count locally when redis is unavailable
+	count, err := s.Incr("a", time.Minute)
+	assert.Nil(err)
+	assert.Equal(int64(1), count)
+	count, _ = s.Incr("a", time.Minute)
+	assert.Equal(int64(2), count)
+	count, _ = s.Get("a")
+	assert.Equal(int64(2), count)
+
+	// Should keep values locally too
+	assert.Nil(s.Set("b", "value", time.Minute))
+	value, _ := s.Value("b")
+	assert.Equal("value", value)
+}
@@ -0,0 +1,112 @@
+package tfa
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Decision explanations
+//
+// When "debug-header" is enabled, or the request carries the
+// "debug-header-token" in the X-Auth-Debug header, the checks made while
+// deciding a request and how long each took are summarised in the X-Auth-Debug
+// response header, so a denial can be explained from curl
+
+// DebugHeader is the request header carrying the debug token, and the response
+// header carrying the explanation
+const DebugHeader = "X-Auth-Debug"
+
+type decisionTraceKey struct{}
+
+// decisionTrace records the checks made for a request
+type decisionTrace struct {
+	rule   string
+	start  time.Time
+	last   time.Time
+	checks []string
+}
+
+// withDecisionTrace explains the decision made by next for the rule, if the
+// request asks for an explanation
+func (s *Server) withDecisionTrace(rule string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !debugRequested(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		trace := &decisionTrace{rule: rule, start: now, last: now}
+		ctx := context.WithValue(r.Context(), decisionTraceKey{}, trace)
+		next.ServeHTTP(&traceWriter{ResponseWriter: w, trace: trace}, r.WithContext(ctx))
+	})
+}
+
+// debugRequested reports whether the decision should be explained
+func debugRequested(r *http.Request) bool {
+	if config().DebugHeader {
+		return true
+	}
+
+	token := r.Header.Get(DebugHeader)
+	return config().DebugHeaderToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(config().DebugHeaderToken)) == 1
+}
+
+// traceCheck records the result of a check, if the decision is being
+// explained, and notes it as the reason for the decision log
+func traceCheck(r *http.Request, check, result string) {
+	recordDecisionReason(r, check, result)
+
+	trace, ok := r.Context().Value(decisionTraceKey{}).(*decisionTrace)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	result = strings.NewReplacer("\r", " ", "\n", " ", ";", ",").Replace(result)
+	trace.checks = append(trace.checks, fmt.Sprintf("%s=%s (%s)", check, result, formatMillis(now.Sub(trace.last))))
+	trace.last = now
+}
+
+// summary formats the trace for the response header, e.g.
+// "rule=app; cookie=valid (0.012ms); user=not permitted (0.003ms); status=401; total=0.051ms"
+func (t *decisionTrace) summary(status int) string {
+	parts := []string{"rule=" + t.rule}
+	parts = append(parts, t.checks...)
+	parts = append(parts,
+		fmt.Sprintf("status=%d", status),
+		"total="+formatMillis(time.Since(t.start)),
+	)
+	return strings.Join(parts, "; ")
+}
+
+func formatMillis(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
+
+// traceWriter adds the explanation to the response before it is written
+type traceWriter struct {
+	http.ResponseWriter
+	trace       *decisionTrace
+	wroteHeader bool
+}
+
+func (w *traceWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(DebugHeader, w.trace.summary(status))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,100 @@
+package tfa
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestDebugHeader(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should not explain decisions by default
+	req := newDefaultHttpRequest("/foo")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+	assert.Empty(res.Header.Get("X-Auth-Debug"))
+
+	// Should explain a redirect to log in
+	config().DebugHeader = true
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+	assert.Regexp(regexp.MustCompile(`^rule=default; cookie=missing \([0-9.]+ms\); login=redirecting to google \([0-9.]+ms\); status=307; total=[0-9.]+ms$`), res.Header.Get("X-Auth-Debug"))
+
+	// Should explain a denial
+	config().Whitelist = []string{"other@example.com"}
+	user := newTestUser("test@example.com")
+	req = newDefaultHttpRequest("/foo")
+	c, _ := MakeCookie(req, user)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+	assert.Regexp(regexp.MustCompile(`^rule=default; cookie=valid \([0-9.]+ms\); user=test@example.com not permitted \([0-9.]+ms\); status=401`), res.Header.Get("X-Auth-Debug"))
+
+	// Should explain an allowed request
+	config().Whitelist = []string{"test@example.com"}
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Contains(res.Header.Get("X-Auth-Debug"), "user=test@example.com permitted")
+	assert.Contains(res.Header.Get("X-Auth-Debug"), "status=200")
+}
+
+func TestDebugHeaderRules(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().DebugHeader = true
+	config().Rules = map[string]*Rule{
+		"public": {
+			Action: "allow",
+			Rule:   "Path(`/public`)",
+		},
+		"secure": {
+			Action:       "auth",
+			Rule:         "Path(`/secure`)",
+			Provider:     "google",
+			RequireHTTPS: "reject",
+		},
+	}
+
+	// Should name the matched rule
+	req := newHTTPRequest("GET", "http://example.com/public")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Regexp(regexp.MustCompile(`^rule=public; action=allow \([0-9.]+ms\); status=200`), res.Header.Get("X-Auth-Debug"))
+
+	// Should explain scheme checks
+	req = newHTTPRequest("GET", "http://example.com/secure")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(403, res.StatusCode)
+	assert.Regexp(regexp.MustCompile(`^rule=secure; scheme=http, https required \([0-9.]+ms\); status=403`), res.Header.Get("X-Auth-Debug"))
+}
+
+func TestDebugHeaderToken(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().DebugHeaderToken = "debugtoken"
+
+	// Should not explain without the token
+	req := newDefaultHttpRequest("/foo")
+	res, _ := doHttpRequest(req, nil)
+	assert.Empty(res.Header.Get("X-Auth-Debug"))
+
+	// Should not explain with the wrong token
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Auth-Debug", "wrong")
+	res, _ = doHttpRequest(req, nil)
+	assert.Empty(res.Header.Get("X-Auth-Debug"))
+
+	// Should explain with the token
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Auth-Debug", "debugtoken")
+	res, _ = doHttpRequest(req, nil)
+	assert.Contains(res.Header.Get("X-Auth-Debug"), "cookie=missing")
+}
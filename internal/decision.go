@@ -0,0 +1,253 @@
+package tfa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Decision API
+//
+// POST /api/v1/decision evaluates the config against a described request and,
+// optionally, the identity making it, and returns the decision that would be
+// made with the rule it fell under and the checks that led to it. Nothing is
+// recorded and webhook authorizers aren't called, so CI pipelines can assert
+// that a policy change doesn't expose or lock out a service. The request and
+// response formats only change with the version in the path
+
+// DecisionPath is the path of the decision API
+const DecisionPath = "/api/v1/decision"
+
+// Decisions returned by the decision API
+const (
+	decisionAllow    = "allow"
+	decisionDeny     = "deny"
+	decisionLogin    = "login"
+	decisionRedirect = "redirect"
+)
+
+// DecisionRequest describes the request to decide
+type DecisionRequest struct {
+	Request struct {
+		Method   string            `json:"method"`
+		URL      string            `json:"url"`
+		Headers  map[string]string `json:"headers"`
+		SourceIP string            `json:"source_ip"`
+	} `json:"request"`
+
+	// Identity is the logged in user, nil if the request has no session
+	Identity *DecisionIdentity `json:"identity"`
+}
+
+// DecisionIdentity describes the user making the request, as returned by the
+// provider
+type DecisionIdentity struct {
+	Email  string                 `json:"email"`
+	Roles  []string               `json:"roles"`
+	Groups []string               `json:"groups"`
+	Claims map[string]interface{} `json:"claims"`
+}
+
+// DecisionReason is one of the checks made in reaching the decision
+type DecisionReason struct {
+	Check  string `json:"check"`
+	Result string `json:"result"`
+}
+
+// DecisionResult is the decision that would be made
+type DecisionResult struct {
+	Decision  string           `json:"decision"`
+	Rule      string           `json:"rule"`
+	Action    string           `json:"action"`
+	Providers []string         `json:"providers"`
+	Reasons   []DecisionReason `json:"reasons"`
+}
+
+func (d *DecisionResult) reason(check, format string, args ...interface{}) {
+	d.Reasons = append(d.Reasons, DecisionReason{Check: check, Result: fmt.Sprintf(format, args...)})
+}
+
+// DecisionHandler returns the decision for the request described in the body
+func (s *Server) DecisionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DecisionRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), 400)
+			return
+		}
+
+		res, err := s.decide(&req)
+		if err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), 400)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// decide makes the decision the AuthHandler would make for the described
+// request, without side effects
+func (s *Server) decide(req *DecisionRequest) (*DecisionResult, error) {
+	r, err := decisionHTTPRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &DecisionResult{
+		Rule:      s.matchRequest(r),
+		Action:    config().DefaultAction,
+		Providers: splitProviders(config().DefaultProvider),
+		Reasons:   []DecisionReason{},
+	}
+	ruleConfig, ok := config().Rules[res.Rule]
+	if ok {
+		res.Action = ruleConfig.Action
+		res.Providers = ruleConfig.Providers()
+		res.reason("rule", "matched %s", res.Rule)
+	} else {
+		res.reason("rule", "no rule matched, using the defaults")
+	}
+	if res.Action != "auth" {
+		res.Providers = nil
+	}
+	if res.Providers == nil {
+		res.Providers = []string{}
+	}
+
+	res.Decision = s.decideRule(r, req.Identity, res, ruleConfig)
+
+	// The window allows what would otherwise be refused
+	if (res.Decision == decisionDeny || res.Decision == decisionLogin) && reportOnly() {
+		res.reason("report-only", "would %s", res.Decision)
+		res.Decision = decisionAllow
+	}
+	return res, nil
+}
+
+// decideRule follows the checks of the rule's handler, recording a reason for
+// each
+func (s *Server) decideRule(r *http.Request, identity *DecisionIdentity, res *DecisionResult, ruleConfig *Rule) string {
+	if res.Action == "deny" {
+		res.reason("action", "deny")
+		return decisionDeny
+	}
+
+	if ruleConfig != nil && ruleConfig.RequireHTTPS != "" && r.Header.Get("X-Forwarded-Proto") != "https" {
+		if ruleConfig.RequireHTTPS == "redirect" {
+			res.reason("scheme", "http, redirecting to https")
+			return decisionRedirect
+		}
+		res.reason("scheme", "http, https required")
+		return decisionDeny
+	}
+
+	if res.Action == "allow" {
+		res.reason("action", "allow")
+		return decisionAllow
+	}
+
+	if fromTrustedNetwork(r, res.Rule) {
+		res.reason("trusted-network", "bypassed")
+		return decisionAllow
+	}
+	if ruleConfig != nil && ruleConfig.Canary > 0 && ruleConfig.Canary < 100 {
+		if canaryBucket(res.Rule, canaryKey(r, ruleConfig)) >= ruleConfig.Canary {
+			res.reason("canary", "bypassed")
+			return decisionAllow
+		}
+		res.reason("canary", "enforced")
+	}
+
+	if identity == nil {
+		if len(config().interactiveProviders(res.Providers)) == 0 {
+			res.reason("login", "no provider to log in with")
+			return decisionDeny
+		}
+		res.reason("session", "missing")
+		return decisionLogin
+	}
+
+	user := &provider.User{
+		Email:  normalizeEmail(identity.Email),
+		Roles:  append([]string(nil), identity.Roles...),
+		Groups: identity.Groups,
+		Claims: identity.Claims,
+	}
+	addClaimRoles(user, identity.Claims)
+	if roleMap != nil {
+		roleMap.Apply(user)
+	}
+	if userDirectory != nil {
+		userDirectory.Apply(user)
+	}
+	user = withRoleGrants(user)
+	if len(user.Roles) > 0 {
+		res.reason("roles", strings.Join(user.Roles, ", "))
+	}
+	if len(user.Groups) > 0 {
+		res.reason("groups", strings.Join(user.Groups, ", "))
+	}
+	if tags, ok := lookupUserTags(user.Email); ok && len(tags.Tags) > 0 {
+		res.reason("tags", strings.Join(tags.Tags, ", "))
+	}
+
+	if ValidateBlocked(user.Email, res.Rule) {
+		res.reason("user", "%s blocked", user.Email)
+		return decisionDeny
+	}
+	if !ValidateUser(user, res.Rule) {
+		res.reason("user", "%s not permitted", user.Email)
+		return decisionDeny
+	}
+	res.reason("user", "%s permitted", user.Email)
+
+	if !ValidateMethod(user, res.Rule, r.Method) {
+		res.reason("method", "%s not permitted", r.Method)
+		return decisionDeny
+	}
+
+	if authorizer := ruleAuthorizer(res.Rule); authorizer != nil {
+		res.reason("authorizer", "not called, %s decides for real requests", authorizer.Authorizer)
+	}
+	return decisionAllow
+}
+
+// decisionHTTPRequest builds the request as forwarded by traefik
+func decisionHTTPRequest(req *DecisionRequest) (*http.Request, error) {
+	method := strings.ToUpper(req.Request.Method)
+	if method == "" {
+		method = "GET"
+	}
+	if !strings.HasPrefix(req.Request.URL, "http://") && !strings.HasPrefix(req.Request.URL, "https://") {
+		return nil, fmt.Errorf("request.url must be an absolute http(s) URL")
+	}
+
+	r, err := http.NewRequest(method, req.Request.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("request.url: %v", err)
+	}
+	for name, value := range req.Request.Headers {
+		r.Header.Set(name, value)
+	}
+	r.Header.Set("X-Forwarded-Proto", r.URL.Scheme)
+	r.Header.Set("X-Forwarded-Host", r.URL.Host)
+	r.Header.Set("X-Forwarded-Method", method)
+	r.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if req.Request.SourceIP != "" {
+		// As if through each of the trusted-ip-depth proxies
+		forwarded := []string{req.Request.SourceIP}
+		for i := 0; i < config().TrustedIPDepth; i++ {
+			forwarded = append(forwarded, req.Request.SourceIP)
+		}
+		r.Header.Set("X-Forwarded-For", strings.Join(forwarded, ", "))
+		r.RemoteAddr = req.Request.SourceIP
+	}
+	return r, nil
+}
@@ -0,0 +1,175 @@
+package tfa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestDecisionHandler(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AdminToken = "admintoken"
+	config().Rules = map[string]*Rule{
+		"app": {
+			Action:       "auth",
+			Rule:         "Host(`app.example.com`)",
+			Provider:     "google",
+			AllowedRoles: CommaSeparatedList{"app"},
+		},
+		"hooks": {
+			Action: "allow",
+			Rule:   "Host(`app.example.com`) && Method(`POST`) && Headers(`X-Hook`, `deploy`)",
+		},
+	}
+	h := NewServer().Handler()
+
+	decide := func(body string) (int, DecisionResult) {
+		req := httptest.NewRequest("POST", DecisionPath, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admintoken")
+		res := serveRouter(h, req)
+		var result DecisionResult
+		if res.Code == 200 {
+			require.Nil(json.Unmarshal(res.Body.Bytes(), &result))
+		}
+		return res.Code, result
+	}
+
+	// Should require the admin token
+	req := httptest.NewRequest("POST", DecisionPath, strings.NewReader(`{}`))
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should send requests without a session to log in
+	code, res := decide(`{"request":{"url":"https://app.example.com/page"}}`)
+	require.Equal(200, code)
+	assert.Equal("login", res.Decision)
+	assert.Equal("app", res.Rule)
+	assert.Equal("auth", res.Action)
+	assert.Equal([]string{"google"}, res.Providers)
+	assert.Equal([]DecisionReason{
+		{Check: "rule", Result: "matched app"},
+		{Check: "session", Result: "missing"},
+	}, res.Reasons)
+
+	// Should check the identity against the rule
+	code, res = decide(`{"request":{"url":"https://app.example.com/page"},"identity":{"email":"alice@example.com","roles":["app"]}}`)
+	require.Equal(200, code)
+	assert.Equal("allow", res.Decision)
+	assert.Contains(res.Reasons, DecisionReason{Check: "user", Result: "alice@example.com permitted"})
+
+	code, res = decide(`{"request":{"url":"https://app.example.com/page"},"identity":{"email":"bob@example.com"}}`)
+	require.Equal(200, code)
+	assert.Equal("deny", res.Decision)
+	assert.Contains(res.Reasons, DecisionReason{Check: "user", Result: "bob@example.com not permitted"})
+
+	// Should match the method and headers
+	code, res = decide(`{"request":{"method":"POST","url":"https://app.example.com/hook","headers":{"X-Hook":"deploy"}}}`)
+	require.Equal(200, code)
+	assert.Equal("allow", res.Decision)
+	assert.Equal("hooks", res.Rule)
+	assert.Equal([]string{}, res.Providers)
+
+	// Should allow trusted networks
+	config().TrustedIPNetworks = CommaSeparatedList{"10.0.0.0/8"}
+	code, res = decide(`{"request":{"url":"https://app.example.com/page","source_ip":"10.1.2.3"}}`)
+	require.Equal(200, code)
+	assert.Equal("allow", res.Decision)
+	assert.Contains(res.Reasons, DecisionReason{Check: "trusted-network", Result: "bypassed"})
+
+	// Should refuse invalid requests
+	code, _ = decide(`{"request":{"url":"/page"}}`)
+	assert.Equal(400, code)
+	code, _ = decide(`{"request":{"url":"https://app.example.com/"},"identity":{"mail":"alice@example.com"}}`)
+	assert.Equal(400, code, "unknown fields should be refused")
+}
+
+func TestDecisionRule(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"admin": {
+			Action: "deny",
+			Rule:   "Host(`app.example.com`) && PathPrefix(`/admin`)",
+		},
+		"secure": {
+			Action:       "auth",
+			Rule:         "Host(`secure.example.com`)",
+			Provider:     "google",
+			RequireHTTPS: "redirect",
+			Authorizer:   "http://authz.internal/check",
+		},
+		"wiki": {
+			Action:   "auth",
+			Rule:     "Host(`wiki.example.com`)",
+			Provider: "google",
+			Methods:  CommaSeparatedList{"viewer:GET", "editor:GET|POST"},
+		},
+		"canary": {
+			Action:   "auth",
+			Rule:     "Host(`canary.example.com`)",
+			Provider: "google",
+			Canary:   50,
+		},
+	}
+	s := NewServer()
+
+	decide := func(body string) *DecisionResult {
+		var req DecisionRequest
+		require.Nil(json.Unmarshal([]byte(body), &req))
+		res, err := s.decide(&req)
+		require.Nil(err)
+		return res
+	}
+
+	res := decide(`{"request":{"url":"https://app.example.com/admin"},"identity":{"email":"alice@example.com"}}`)
+	assert.Equal("deny", res.Decision)
+	assert.Equal([]DecisionReason{
+		{Check: "rule", Result: "matched admin"},
+		{Check: "action", Result: "deny"},
+	}, res.Reasons)
+
+	// Should fall back to the defaults
+	res = decide(`{"request":{"url":"https://other.example.com/"}}`)
+	assert.Equal("login", res.Decision)
+	assert.Equal("default", res.Rule)
+
+	// Should redirect plain HTTP
+	res = decide(`{"request":{"url":"http://secure.example.com/"}}`)
+	assert.Equal("redirect", res.Decision)
+
+	// Should say the authorizer wasn't called
+	res = decide(`{"request":{"url":"https://secure.example.com/"},"identity":{"email":"alice@example.com"}}`)
+	assert.Equal("allow", res.Decision)
+	assert.Contains(res.Reasons, DecisionReason{Check: "authorizer", Result: "not called, http://authz.internal/check decides for real requests"})
+
+	// Should check the method is granted to the user's roles
+	res = decide(`{"request":{"method":"POST","url":"https://wiki.example.com/"},"identity":{"email":"alice@example.com","roles":["viewer"]}}`)
+	assert.Equal("deny", res.Decision)
+	assert.Contains(res.Reasons, DecisionReason{Check: "method", Result: "POST not permitted"})
+
+	res = decide(`{"request":{"method":"POST","url":"https://wiki.example.com/"},"identity":{"email":"alice@example.com","roles":["editor"]}}`)
+	assert.Equal("allow", res.Decision)
+
+	// Should bucket canary clients by the address behind the trusted proxies
+	expected := DecisionReason{Check: "canary", Result: "enforced"}
+	if canaryBucket("canary", "10.1.2.3") >= 50 {
+		expected.Result = "bypassed"
+	}
+	res = decide(`{"request":{"url":"https://canary.example.com/","source_ip":"10.1.2.3"}}`)
+	assert.Contains(res.Reasons, expected)
+	for i := 0; i < 20; i++ {
+		res = decide(fmt.Sprintf(`{"request":{"url":"https://canary.example.com/","headers":{"X-Forwarded-For":"10.9.9.%d, 10.1.2.3"}}}`, i))
+		assert.Contains(res.Reasons, expected, "should ignore addresses the client added")
+	}
+}
@@ -0,0 +1,457 @@
+package tfa
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// User directory
+
+// userDirectory is set when "user-directory" is configured
+var userDirectory *UserDirectory
+
+// userDirectoryReloadInterval is how often the directory file is checked for
+// changes made by another instance or the import-users command
+const userDirectoryReloadInterval = 10 * time.Second
+
+// UserDirectory is a persistent table of users that are permitted to log in,
+// along with the roles they are granted, typically imported from another auth
+// proxy or an IdP export
+type UserDirectory struct {
+	mu        sync.Mutex
+	path      string
+	users     map[string]*DirectoryEntry
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// DirectoryEntry is a user in the directory
+type DirectoryEntry struct {
+	Roles      []string  `json:"roles"`
+	ImportedAt time.Time `json:"imported_at"`
+}
+
+type userDirectoryFile struct {
+	SchemaVersion int                        `json:"schema_version"`
+	Users         map[string]*DirectoryEntry `json:"users"`
+}
+
+// ImportedUser is a user read from an import file
+type ImportedUser struct {
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+}
+
+// ImportDiff describes the changes an import makes to the directory
+type ImportDiff struct {
+	Added     []ImportedUser `json:"added"`
+	Updated   []UpdatedUser  `json:"updated"`
+	Removed   []ImportedUser `json:"removed"`
+	Unchanged int            `json:"unchanged"`
+	DryRun    bool           `json:"dry_run"`
+}
+
+// UpdatedUser is a user whose roles are changed by an import
+type UpdatedUser struct {
+	Email    string   `json:"email"`
+	OldRoles []string `json:"old_roles"`
+	NewRoles []string `json:"new_roles"`
+}
+
+// NewUserDirectory loads the user directory at the given path, a missing file
+// results in an empty directory
+func NewUserDirectory(path string) (*UserDirectory, error) {
+	d := &UserDirectory{
+		path:  path,
+		users: make(map[string]*DirectoryEntry),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	d.lastCheck = time.Now()
+	return d, nil
+}
+
+// Lookup returns the directory entry for the email address
+func (d *UserDirectory) Lookup(email string) (*DirectoryEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.reloadIfChanged()
+	entry, ok := d.users[normalizeEmail(email)]
+	return entry, ok
+}
+
+// Apply grants the user the roles they have in the directory
+func (d *UserDirectory) Apply(user *provider.User) {
+	entry, ok := d.Lookup(user.Email)
+	if !ok {
+		return
+	}
+
+	for _, role := range entry.Roles {
+		if !containsString(user.Roles, role) {
+			user.Roles = append(user.Roles, role)
+		}
+	}
+}
+
+// Users returns all users in the directory, sorted by email
+func (d *UserDirectory) Users() []ImportedUser {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.reloadIfChanged()
+	list := []ImportedUser{}
+	for email, entry := range d.users {
+		list = append(list, ImportedUser{Email: email, Roles: entry.Roles})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Email < list[j].Email
+	})
+	return list
+}
+
+// Import adds the users to the directory, replacing the roles of existing
+// users. If replace is set, users missing from the import are removed. When
+// dryRun is set the changes are only reported
+func (d *UserDirectory) Import(imported []ImportedUser, replace, dryRun bool) (*ImportDiff, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Make sure changes from elsewhere aren't lost
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	diff := &ImportDiff{
+		Added:   []ImportedUser{},
+		Updated: []UpdatedUser{},
+		Removed: []ImportedUser{},
+		DryRun:  dryRun,
+	}
+	users := make(map[string]*DirectoryEntry)
+	for email, entry := range d.users {
+		users[email] = entry
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, u := range imported {
+		roles := sortedUnique(u.Roles)
+		seen[u.Email] = true
+
+		existing, ok := users[u.Email]
+		if !ok {
+			diff.Added = append(diff.Added, ImportedUser{Email: u.Email, Roles: roles})
+		} else if !equalStrings(existing.Roles, roles) {
+			diff.Updated = append(diff.Updated, UpdatedUser{Email: u.Email, OldRoles: existing.Roles, NewRoles: roles})
+		} else {
+			diff.Unchanged++
+			continue
+		}
+		users[u.Email] = &DirectoryEntry{Roles: roles, ImportedAt: now}
+	}
+
+	if replace {
+		for email, entry := range users {
+			if !seen[email] {
+				diff.Removed = append(diff.Removed, ImportedUser{Email: email, Roles: entry.Roles})
+				delete(users, email)
+			}
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Email < diff.Added[j].Email })
+	sort.Slice(diff.Updated, func(i, j int) bool { return diff.Updated[i].Email < diff.Updated[j].Email })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Email < diff.Removed[j].Email })
+
+	if dryRun {
+		return diff, nil
+	}
+
+	d.users = users
+	return diff, d.save()
+}
+
+// reloadIfChanged reloads the directory if the file has been modified, at
+// most every reload interval. Must be called with the lock held
+func (d *UserDirectory) reloadIfChanged() {
+	if time.Since(d.lastCheck) < userDirectoryReloadInterval {
+		return
+	}
+	d.lastCheck = time.Now()
+
+	info, err := os.Stat(d.path)
+	if err != nil || info.ModTime().Equal(d.modTime) {
+		return
+	}
+	if err := d.load(); err != nil {
+		log.WithField("error", err).Warn("Error reloading user directory, keeping previous contents")
+	}
+}
+
+// load reads the directory from disk. Must be called with the lock held
+func (d *UserDirectory) load() error {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var file userDirectoryFile
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return err
+	}
+	// Key users by their normalized email, which changes with
+	// "canonical-emails"
+	d.users = make(map[string]*DirectoryEntry, len(file.Users))
+	for email, entry := range file.Users {
+		d.users[normalizeEmail(email)] = entry
+	}
+	d.modTime = info.ModTime()
+	return nil
+}
+
+// save atomically writes the directory to disk. Must be called with the lock
+// held
+func (d *UserDirectory) save() error {
+	b, err := json.MarshalIndent(userDirectoryFile{
+		SchemaVersion: latestVersion(userDirectoryMigrations),
+		Users:         d.users,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(d.path, b); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(d.path); err == nil {
+		d.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// WriteImportDiff writes a human readable summary of the diff
+func WriteImportDiff(w io.Writer, diff *ImportDiff) {
+	for _, u := range diff.Added {
+		fmt.Fprintf(w, "+ %s [%s]\n", u.Email, strings.Join(u.Roles, ", "))
+	}
+	for _, u := range diff.Updated {
+		fmt.Fprintf(w, "~ %s [%s] -> [%s]\n", u.Email, strings.Join(u.OldRoles, ", "), strings.Join(u.NewRoles, ", "))
+	}
+	for _, u := range diff.Removed {
+		fmt.Fprintf(w, "- %s [%s]\n", u.Email, strings.Join(u.Roles, ", "))
+	}
+
+	summary := fmt.Sprintf("%d added, %d updated, %d removed, %d unchanged", len(diff.Added), len(diff.Updated), len(diff.Removed), diff.Unchanged)
+	if diff.DryRun {
+		summary += " (dry run, no changes made)"
+	}
+	fmt.Fprintln(w, summary)
+}
+
+// Import formats
+
+// ParseUserImport reads users from an import file. The format is one of:
+//
+//	csv  - a header row followed by one user per row, with an "email" column
+//	       and optionally a "roles" (or "groups") column of roles separated by
+//	       ";", "|" or ","
+//	scim - a SCIM ListResponse of users, as exported by most IdPs, roles are
+//	       taken from the user's groups and roles
+func ParseUserImport(r io.Reader, format string) ([]ImportedUser, error) {
+	var users []ImportedUser
+	var err error
+	switch format {
+	case "csv":
+		users, err = parseCSVImport(r)
+	case "scim":
+		users, err = parseSCIMImport(r)
+	default:
+		return nil, fmt.Errorf("unknown import format %q, must be \"csv\" or \"scim\"", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge duplicate rows
+	merged := make(map[string]int)
+	var result []ImportedUser
+	for _, u := range users {
+		if i, ok := merged[u.Email]; ok {
+			result[i].Roles = sortedUnique(append(result[i].Roles, u.Roles...))
+			continue
+		}
+		merged[u.Email] = len(result)
+		result = append(result, ImportedUser{Email: u.Email, Roles: sortedUnique(u.Roles)})
+	}
+
+	return result, nil
+}
+
+func parseCSVImport(r io.Reader) ([]ImportedUser, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("csv import is empty")
+	} else if err != nil {
+		return nil, err
+	}
+
+	emailCol, rolesCol := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "email", "mail":
+			emailCol = i
+		case "roles", "groups":
+			rolesCol = i
+		}
+	}
+	if emailCol == -1 {
+		return nil, errors.New("csv import must have an \"email\" column")
+	}
+
+	var users []ImportedUser
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if emailCol >= len(record) || strings.TrimSpace(record[emailCol]) == "" {
+			continue
+		}
+		email := normalizeEmail(record[emailCol])
+		if !strings.Contains(email, "@") {
+			return nil, fmt.Errorf("row %d: invalid email %q", row, record[emailCol])
+		}
+
+		user := ImportedUser{Email: email}
+		if rolesCol != -1 && rolesCol < len(record) {
+			user.Roles = strings.FieldsFunc(record[rolesCol], func(r rune) bool {
+				return r == ';' || r == '|' || r == ','
+			})
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+type scimListResponse struct {
+	Resources []struct {
+		UserName string `json:"userName"`
+		Active   *bool  `json:"active"`
+		Emails   []struct {
+			Value   string `json:"value"`
+			Primary bool   `json:"primary"`
+		} `json:"emails"`
+		Groups []struct {
+			Display string `json:"display"`
+		} `json:"groups"`
+		Roles []struct {
+			Value string `json:"value"`
+		} `json:"roles"`
+	} `json:"Resources"`
+}
+
+func parseSCIMImport(r io.Reader) ([]ImportedUser, error) {
+	var list scimListResponse
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid scim import: %v", err)
+	}
+
+	var users []ImportedUser
+	for i, resource := range list.Resources {
+		// Deactivated users shouldn't be granted access
+		if resource.Active != nil && !*resource.Active {
+			continue
+		}
+
+		email := ""
+		for _, e := range resource.Emails {
+			if email == "" || e.Primary {
+				email = e.Value
+			}
+		}
+		if email == "" {
+			email = resource.UserName
+		}
+		email = normalizeEmail(email)
+		if !strings.Contains(email, "@") {
+			return nil, fmt.Errorf("resource %d: no email address", i)
+		}
+
+		user := ImportedUser{Email: email}
+		for _, g := range resource.Groups {
+			user.Roles = append(user.Roles, g.Display)
+		}
+		for _, role := range resource.Roles {
+			user.Roles = append(user.Roles, role.Value)
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// Helpers
+
+// sortedUnique returns the non-empty values, trimmed, sorted and deduplicated
+func sortedUnique(values []string) []string {
+	result := []string{}
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v != "" && !containsString(result, v) {
+			result = append(result, v)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package tfa
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestDirectoryParseCSV(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	users, err := ParseUserImport(strings.NewReader(
+		"Name,Email,Groups\n"+
+			"One,One@Example.com,\"admin;staff\"\n"+
+			"Two,two@example.com,\n"+
+			"Blank,,\n"+
+			"One again,one@example.com,ops|staff\n"), "csv")
+	require.Nil(err)
+	assert.Equal([]ImportedUser{
+		{Email: "one@example.com", Roles: []string{"admin", "ops", "staff"}},
+		{Email: "two@example.com", Roles: []string{}},
+	}, users)
+
+	// Should require an email column
+	_, err = ParseUserImport(strings.NewReader("name,roles\nOne,admin\n"), "csv")
+	if assert.Error(err) {
+		assert.Equal("csv import must have an \"email\" column", err.Error())
+	}
+
+	// Should reject invalid emails
+	_, err = ParseUserImport(strings.NewReader("email\none@example.com\nnope\n"), "csv")
+	if assert.Error(err) {
+		assert.Equal("row 3: invalid email \"nope\"", err.Error())
+	}
+
+	// Should reject unknown formats
+	_, err = ParseUserImport(strings.NewReader(""), "xml")
+	assert.Error(err)
+}
+
+func TestDirectoryParseSCIM(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	users, err := ParseUserImport(strings.NewReader(`{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:ListResponse"],
+		"Resources": [
+			{
+				"userName": "one",
+				"emails": [{"value": "old@example.com"}, {"value": "one@example.com", "primary": true}],
+				"groups": [{"display": "staff"}],
+				"roles": [{"value": "admin"}]
+			},
+			{"userName": "two@example.com", "active": true},
+			{"userName": "gone@example.com", "active": false}
+		]
+	}`), "scim")
+	require.Nil(err)
+	assert.Equal([]ImportedUser{
+		{Email: "one@example.com", Roles: []string{"admin", "staff"}},
+		{Email: "two@example.com", Roles: []string{}},
+	}, users)
+
+	// Should require an email for each user
+	_, err = ParseUserImport(strings.NewReader(`{"Resources": [{"userName": "one"}]}`), "scim")
+	assert.Error(err)
+}
+
+func TestDirectoryImport(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	d, err := NewUserDirectory(path)
+	require.Nil(err)
+
+	diff, err := d.Import([]ImportedUser{
+		{Email: "one@example.com", Roles: []string{"staff"}},
+		{Email: "two@example.com"},
+	}, false, false)
+	require.Nil(err)
+	assert.Len(diff.Added, 2)
+
+	// Should report changes without making them on a dry run
+	imported := []ImportedUser{
+		{Email: "one@example.com", Roles: []string{"admin", "staff"}},
+		{Email: "three@example.com"},
+	}
+	diff, err = d.Import(imported, true, true)
+	require.Nil(err)
+	assert.Equal([]ImportedUser{{Email: "three@example.com", Roles: []string{}}}, diff.Added)
+	assert.Equal([]UpdatedUser{{Email: "one@example.com", OldRoles: []string{"staff"}, NewRoles: []string{"admin", "staff"}}}, diff.Updated)
+	assert.Equal([]ImportedUser{{Email: "two@example.com", Roles: []string{}}}, diff.Removed)
+	_, ok := d.Lookup("three@example.com")
+	assert.False(ok, "dry run should not add users")
+
+	var out bytes.Buffer
+	WriteImportDiff(&out, diff)
+	assert.Equal("+ three@example.com []\n"+
+		"~ one@example.com [staff] -> [admin, staff]\n"+
+		"- two@example.com []\n"+
+		"1 added, 1 updated, 1 removed, 0 unchanged (dry run, no changes made)\n", out.String())
+
+	// Should apply changes
+	_, err = d.Import(imported, true, false)
+	require.Nil(err)
+	_, ok = d.Lookup("two@example.com")
+	assert.False(ok)
+
+	// Should persist
+	d, err = NewUserDirectory(path)
+	require.Nil(err)
+	assert.Equal([]ImportedUser{
+		{Email: "one@example.com", Roles: []string{"admin", "staff"}},
+		{Email: "three@example.com", Roles: []string{}},
+	}, d.Users())
+
+	// Should grant roles
+	user := &provider.User{Email: "One@example.com", Roles: []string{"staff", "dev"}}
+	d.Apply(user)
+	assert.Equal([]string{"staff", "dev", "admin"}, user.Roles)
+}
+
+func TestDirectoryReload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	d, err := NewUserDirectory(path)
+	require.Nil(err)
+
+	// Should pick up changes made elsewhere, e.g. by the import-users command
+	require.Nil(ioutil.WriteFile(path, []byte(`{"users": {"one@example.com": {"roles": ["staff"]}}}`), 0600))
+	future := time.Now().Add(time.Minute)
+	require.Nil(os.Chtimes(path, future, future))
+	d.lastCheck = time.Time{}
+
+	entry, ok := d.Lookup("one@example.com")
+	require.True(ok)
+	assert.Equal([]string{"staff"}, entry.Roles)
+}
@@ -0,0 +1,101 @@
+package tfa
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Cookie domain checks
+//
+// Browsers refuse cookies set on a public suffix (e.g. co.uk or github.io),
+// and the auth host can only set a cookie its origin shares a registrable
+// domain with. These mistakes otherwise show up as users looping back to the
+// provider, so they're caught on startup. Whether the domains resolve is
+// checked in the background, on startup and every "domain-check-interval"
+
+// checkCookieDomains checks browsers will accept cookies on the cookie-domains
+// and that the auth-host shares a registrable domain with its cookie-domain
+func checkCookieDomains(c *Config) error {
+	for _, d := range c.CookieDomains {
+		if d.PublicSuffix {
+			return fmt.Errorf("cookie-domain %q is a public suffix, browsers will refuse cookies set on it", d.Domain)
+		}
+	}
+
+	if c.AuthHost == "" {
+		return nil
+	}
+
+	host := strings.Split(c.AuthHost, ":")[0]
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		// The auth-host is invalid or a public suffix itself, in which case
+		// so is the cookie-domain it matches, both are reported elsewhere
+		return nil
+	}
+	for _, d := range c.CookieDomains {
+		if !d.Match(host) {
+			continue
+		}
+		if cookieSite, err := publicsuffix.EffectiveTLDPlusOne(d.Domain); err != nil || cookieSite != site {
+			return fmt.Errorf("auth-host %q (%s) and cookie-domain %q are on different registrable domains, browsers will refuse the cookie", c.AuthHost, site, d.Domain)
+		}
+	}
+
+	return nil
+}
+
+// isPublicSuffix reports whether the domain is on the public suffix list.
+// Single label domains (e.g. localhost) are only suffixes by default, so are
+// allowed
+func isPublicSuffix(domain string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	suffix, icann := publicsuffix.PublicSuffix(domain)
+	if suffix != domain {
+		return false
+	}
+	return icann || strings.Contains(domain, ".")
+}
+
+// resolveDomains returns a warning for each of the cookie-domains and the
+// auth-host that doesn't resolve
+func resolveDomains(c *Config, lookup func(host string) ([]string, error)) []string {
+	var warnings []string
+	if c.AuthHost != "" {
+		host := strings.Split(c.AuthHost, ":")[0]
+		if _, err := lookup(host); err != nil {
+			warnings = append(warnings, fmt.Sprintf("auth-host %q does not resolve, users can't return from the provider: %v", host, err))
+		}
+	}
+	for _, d := range c.CookieDomains {
+		if _, err := lookup(d.Domain); err != nil {
+			warnings = append(warnings, fmt.Sprintf("cookie-domain %q does not resolve, check it's spelt correctly: %v", d.Domain, err))
+		}
+	}
+	return warnings
+}
+
+// startDomainCheck resolves the domains in the background, on startup and then
+// every interval if it's greater than 0, until the background workers are
+// stopped. A negative interval disables the check
+func startDomainCheck(c *Config, interval time.Duration) {
+	if interval < 0 || (c.AuthHost == "" && len(c.CookieDomains) == 0) {
+		return
+	}
+
+	background.Go(func(ctx context.Context) {
+		for {
+			for _, warning := range resolveDomains(c, net.LookupHost) {
+				log.WithField("check", "domain").Warn(warning)
+			}
+			if interval <= 0 || !sleepContext(ctx, interval) {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package tfa
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestCheckCookieDomains(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Config{CookieDomains: []CookieDomain{*NewCookieDomain("example.com"), *NewCookieDomain("example.co.uk")}}
+	assert.Nil(checkCookieDomains(c))
+
+	// Should reject public suffixes
+	c = &Config{CookieDomains: []CookieDomain{*NewCookieDomain("co.uk")}}
+	if err := checkCookieDomains(c); assert.Error(err) {
+		assert.Equal("cookie-domain \"co.uk\" is a public suffix, browsers will refuse cookies set on it", err.Error())
+	}
+	c = &Config{CookieDomains: []CookieDomain{*NewCookieDomain("github.io")}}
+	assert.Error(checkCookieDomains(c), "private suffixes should be rejected")
+
+	// Should allow single label domains
+	c = &Config{CookieDomains: []CookieDomain{*NewCookieDomain("localhost")}}
+	assert.Nil(checkCookieDomains(c))
+
+	// Should check the auth host shares a registrable domain with its cookie
+	// domain
+	c = &Config{
+		AuthHost:      "auth.example.com:8443",
+		CookieDomains: []CookieDomain{*NewCookieDomain("example.com")},
+	}
+	assert.Nil(checkCookieDomains(c))
+
+	c = &Config{
+		AuthHost:      "auth.example.co.uk",
+		CookieDomains: []CookieDomain{*NewCookieDomain("co.uk")},
+	}
+	assert.Error(checkCookieDomains(c))
+}
+
+func TestResolveDomains(t *testing.T) {
+	assert := assert.New(t)
+	c := &Config{
+		AuthHost:      "auth.example.com:8443",
+		CookieDomains: []CookieDomain{*NewCookieDomain("example.com"), *NewCookieDomain("exmaple.org")},
+	}
+
+	var looked []string
+	warnings := resolveDomains(c, func(host string) ([]string, error) {
+		looked = append(looked, host)
+		if host == "exmaple.org" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"192.0.2.1"}, nil
+	})
+
+	assert.Equal([]string{"auth.example.com", "example.com", "exmaple.org"}, looked)
+	assert.Equal([]string{"cookie-domain \"exmaple.org\" does not resolve, check it's spelt correctly: no such host"}, warnings)
+}
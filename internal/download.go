@@ -0,0 +1,146 @@
+package tfa
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Download tokens
+//
+// Tools such as wget and media players can't log in or send the auth cookie,
+// so with "download-token-lifetime" set a logged in user can exchange their
+// session for a token at <url-path>/download-token, valid for a single URL
+// until it expires. A request for that host and path carrying the token in
+// the "download-token-param" query parameter is authenticated as the user, as
+// long as their session is still valid. The token is signed like the auth
+// cookie, and is of no use for any other path
+
+// DownloadTokenPath is where download tokens are issued, under the url-path
+const DownloadTokenPath = "/download-token"
+
+// DownloadTokenHandler issues a download token for the URL in the "url" query
+// parameter to the logged in user
+func (s *Server) DownloadTokenHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(config().CookieName)
+		if err != nil {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		user, err := ValidateCookie(r, c)
+		if err != nil {
+			log.WithField("error", err).Debug("Invalid cookie for download token")
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		u, err := url.Parse(r.URL.Query().Get("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "url must be an absolute http or https URL", 400)
+			return
+		}
+
+		expires := time.Now().Add(config().DownloadTokenLifetime)
+		token, err := makeDownloadToken(user, u.Host, u.Path, expires)
+		if err != nil {
+			log.WithField("error", err).Error("Error signing download token")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		query := u.Query()
+		query.Set(config().DownloadTokenParam, token)
+		u.RawQuery = query.Encode()
+
+		log.WithFields(logrus.Fields{
+			"user": user.Email,
+			"host": u.Host,
+			"path": u.Path,
+		}).Debug("Issued download token")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			URL     string    `json:"url"`
+			Token   string    `json:"token"`
+			Expires time.Time `json:"expires"`
+		}{u.String(), token, expires.UTC().Truncate(time.Second)})
+	}
+}
+
+// makeDownloadToken makes a token for the user to request the path on the
+// host until it expires, in the format:
+// Token = expires.userUUID.hash(secret, host, path, userUUID, expires)
+func makeDownloadToken(user *provider.User, host, path string, expires time.Time) (string, error) {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	mac, err := downloadTokenSignature(user.UUID, host, path, expiry)
+	if err != nil {
+		return "", err
+	}
+	return expiry + "." + user.UUID.String() + "." + mac, nil
+}
+
+// ValidateDownloadToken verifies the token is for the request's host and
+// path, returning the user it was issued to
+func ValidateDownloadToken(r *http.Request, token string) (*provider.User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid download token format")
+	}
+
+	var userUUID uuid.UUID
+	if err := userUUID.UnmarshalText([]byte(parts[1])); err != nil {
+		return nil, errors.New("Unable to parse download token user")
+	}
+
+	expected, err := downloadTokenSignature(userUUID, r.Host, r.URL.Path, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return nil, errors.New("Invalid download token mac")
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Unable to parse download token expiry")
+	}
+	if time.Unix(expiry, 0).Before(time.Now()) {
+		return nil, errors.New("Download token has expired")
+	}
+
+	userEntry, err := sessions.Get(userUUID)
+	if err != nil {
+		return nil, err
+	}
+	if userEntry == nil {
+		return nil, errors.New("user is unknown")
+	}
+	return userEntry.User, nil
+}
+
+// downloadTokenSignature signs the token's fields, the host is lowercased as
+// it's case insensitive while the path is not
+func downloadTokenSignature(userUUID uuid.UUID, host, path, expiry string) (string, error) {
+	if path == "" {
+		path = "/"
+	}
+	data := strings.Join([]string{"download-token", strings.ToLower(host), path, userUUID.String(), expiry}, "|")
+	mac, err := activeSigner().MAC([]byte(data))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(mac), nil
+}
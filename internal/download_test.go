@@ -0,0 +1,106 @@
+package tfa
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestServerDownloadToken(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().DownloadTokenLifetime = time.Minute
+	h := NewServer().Handler()
+	user := newTestUser("download@example.com")
+
+	// Should require a cookie
+	req := httptest.NewRequest("GET", "http://example.com/_oauth/download-token?url=https://files.example.com/reports/q1.pdf", nil)
+	res := serveRouter(h, req)
+	assert.Equal(401, res.Code)
+
+	// Should require an absolute URL
+	bad := httptest.NewRequest("GET", "http://example.com/_oauth/download-token?url=/reports/q1.pdf", nil)
+	c, _ := MakeCookie(bad, user)
+	bad.AddCookie(c)
+	assert.Equal(400, serveRouter(h, bad).Code)
+
+	// Should issue a URL with the token
+	req.AddCookie(c)
+	res = serveRouter(h, req)
+	require.Equal(200, res.Code)
+	assert.Equal("no-store", res.Header().Get("Cache-Control"))
+	var issued struct {
+		URL     string
+		Token   string
+		Expires time.Time
+	}
+	require.Nil(json.Unmarshal(res.Body.Bytes(), &issued))
+	assert.Equal("https://files.example.com/reports/q1.pdf?tfa_token="+url.QueryEscape(issued.Token), issued.URL)
+	assert.WithinDuration(time.Now().Add(time.Minute), issued.Expires, 2*time.Second)
+
+	// Should authenticate requests for the URL with the token
+	req = newHTTPRequest("GET", "http://files.example.com/reports/q1.pdf?tfa_token="+issued.Token)
+	res = serveRouter(h, req)
+	assert.Equal(200, res.Code)
+	assert.Equal("download@example.com", res.Header().Get("X-Forwarded-User"))
+
+	// Should refuse the token for other paths
+	req = newHTTPRequest("GET", "http://files.example.com/reports/q2.pdf?tfa_token="+issued.Token)
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should refuse the token for other hosts
+	req = newHTTPRequest("GET", "http://other.example.com/reports/q1.pdf?tfa_token="+issued.Token)
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should fall back to the cookie when one is sent
+	req = newHTTPRequest("GET", "http://files.example.com/reports/q2.pdf?tfa_token="+issued.Token)
+	c, _ = MakeCookie(req, user)
+	req.AddCookie(c)
+	assert.Equal(200, serveRouter(h, req).Code)
+
+	// Should refuse the token once the session has ended
+	sessions.Delete(user.UUID)
+	req = newHTTPRequest("GET", "http://files.example.com/reports/q1.pdf?tfa_token="+issued.Token)
+	assert.Equal(401, serveRouter(h, req).Code)
+}
+
+func TestValidateDownloadToken(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	user := newTestUser("download-validate@example.com")
+
+	req := httptest.NewRequest("GET", "http://Files.example.com/q1.pdf", nil)
+	token, err := makeDownloadToken(user, "files.example.com", "/q1.pdf", time.Now().Add(time.Minute))
+	assert.Nil(err)
+
+	// Should accept the token, ignoring the host's case
+	valid, err := ValidateDownloadToken(req, token)
+	if assert.Nil(err) {
+		assert.Equal(user.Email, valid.Email)
+	}
+
+	// Should refuse expired tokens
+	expired, _ := makeDownloadToken(user, "files.example.com", "/q1.pdf", time.Now().Add(-time.Second))
+	_, err = ValidateDownloadToken(req, expired)
+	if assert.Error(err) {
+		assert.Equal("Download token has expired", err.Error())
+	}
+
+	// Should refuse tokens that have been tampered with
+	_, err = ValidateDownloadToken(req, "9999999999"+token[len("9999999999"):])
+	if assert.Error(err) {
+		assert.Equal("Invalid download token mac", err.Error())
+	}
+	_, err = ValidateDownloadToken(req, "garbage")
+	assert.Error(err)
+}
@@ -0,0 +1,60 @@
+package tfa
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Email normalization
+//
+// Providers don't agree on the case of email addresses, and may return an
+// internationalized domain in unicode or punycode. Emails are normalized
+// before being matched against the whitelist, domains and user directory, and
+// before a session is created, so each user has a single identity. When
+// "canonical-emails" is set, the dots and +suffix Gmail ignores are dropped
+// too, so aliases of a Gmail address are the same user
+
+// gmailDomains are the domains of Gmail addresses, googlemail.com addresses
+// are the same mailbox as their gmail.com equivalent
+var gmailDomains = []string{"gmail.com", "googlemail.com"}
+
+// normalizeEmail folds the case of the address and converts its domain to
+// ASCII, canonicalizing Gmail aliases if "canonical-emails" is set
+func normalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return strings.ToLower(email)
+	}
+
+	local := strings.ToLower(email[:at])
+	domain := normalizeDomain(email[at+1:])
+	if config() != nil && config().CanonicalEmails && containsString(gmailDomains, domain) {
+		if plus := strings.Index(local, "+"); plus >= 0 {
+			local = local[:plus]
+		}
+		local = strings.Replace(local, ".", "", -1)
+		domain = gmailDomains[0]
+	}
+	return local + "@" + domain
+}
+
+// normalizeDomain folds the case of the domain and converts it to ASCII, an
+// invalid internationalized domain is only case folded
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		return ascii
+	}
+	return domain
+}
+
+// emailDomain returns the normalized domain of the address
+func emailDomain(email string) (string, bool) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "", false
+	}
+	return normalizeDomain(email[at+1:]), true
+}
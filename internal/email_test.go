@@ -0,0 +1,53 @@
+package tfa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestNormalizeEmail(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	assert.Equal("user@example.com", normalizeEmail(" User@Example.COM "))
+	assert.Equal("user@xn--bcher-kva.example", normalizeEmail("user@Bücher.example"))
+	assert.Equal("user@xn--bcher-kva.example", normalizeEmail("user@xn--bcher-kva.example"))
+	assert.Equal("not-an-email", normalizeEmail("Not-An-Email"))
+
+	// Should only canonicalize Gmail aliases when enabled
+	assert.Equal("first.last+news@gmail.com", normalizeEmail("First.Last+News@gmail.com"))
+	config().CanonicalEmails = true
+	assert.Equal("firstlast@gmail.com", normalizeEmail("First.Last+News@gmail.com"))
+	assert.Equal("firstlast@gmail.com", normalizeEmail("firstlast@GoogleMail.com"))
+	assert.Equal("first.last+news@example.com", normalizeEmail("first.last+news@example.com"))
+}
+
+func TestNormalizeEmailValidateUser(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should match the whitelist regardless of case
+	config().Whitelist = CommaSeparatedList{"User@Example.com"}
+	assert.True(ValidateUser(&provider.User{Email: "user@example.COM"}, "default"))
+	assert.False(ValidateUser(&provider.User{Email: "other@example.com"}, "default"))
+
+	// Should match domains regardless of case or encoding
+	config().Whitelist = nil
+	config().Domains = CommaSeparatedList{"Bücher.example"}
+	assert.True(ValidateUser(&provider.User{Email: "user@BÜCHER.example"}, "default"))
+	assert.True(ValidateUser(&provider.User{Email: "user@xn--bcher-kva.example"}, "default"))
+	assert.False(ValidateUser(&provider.User{Email: "user@example.com"}, "default"))
+
+	// Should match Gmail aliases when enabled
+	config().Domains = nil
+	config().Whitelist = CommaSeparatedList{"firstlast@gmail.com"}
+	assert.False(ValidateUser(&provider.User{Email: "first.last+news@gmail.com"}, "default"))
+	config().CanonicalEmails = true
+	assert.True(ValidateUser(&provider.User{Email: "first.last+news@gmail.com"}, "default"))
+}
@@ -0,0 +1,78 @@
+package tfa
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// Encryption
+//
+// Values handed to the browser or provider that shouldn't be readable, such
+// as lost submissions and, when "encrypt-cookies" is set, the auth cookie and
+// login state, are encrypted with AES-GCM. Each use has its own key derived
+// from the secret, so a value can't be replayed as another
+
+// secretCipher derives the key for the purpose from the secret
+func secretCipher(secret []byte, purpose string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptValue encrypts the plaintext, returning it base64 encoded
+func encryptValue(purpose string, plaintext []byte) (string, error) {
+	aead, err := secretCipher(config().Secret, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// decryptValue decrypts a value returned by encryptValue for the same purpose
+func decryptValue(purpose, value string) ([]byte, error) {
+	plaintext, previous, err := decryptValueRotated(purpose, value)
+	if previous {
+		previousSecretUsesTotal.Inc(purpose)
+	}
+	return plaintext, err
+}
+
+// decryptValueRotated decrypts the value with the secret or, while it's being
+// rotated, a previous secret, reporting whether a previous secret was used
+func decryptValueRotated(purpose, value string) ([]byte, bool, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = errors.New("no secret")
+	for i, secret := range acceptedSecrets() {
+		var aead cipher.AEAD
+		if aead, err = secretCipher(secret, purpose); err != nil {
+			return nil, false, err
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, false, errors.New("encrypted value too short")
+		}
+
+		var plaintext []byte
+		if plaintext, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil); err == nil {
+			return plaintext, i > 0, nil
+		}
+	}
+	return nil, false, err
+}
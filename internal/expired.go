@@ -0,0 +1,80 @@
+package tfa
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Expired submissions
+//
+// Redirecting a POST (or other unsafe request) to the provider would lose what
+// the user submitted, so instead they're told it wasn't saved and offered a
+// link to log in and return to the page they submitted it from
+
+var expiredTemplate = template.Must(template.New("expired").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Session expired</title>
+<style>
+body { font-family: sans-serif; max-width: 32em; margin: 4em auto; text-align: center; }
+a { display: inline-block; margin: 0.5em 0; padding: 0.75em; border: 1px solid #ccc; border-radius: 4px; color: inherit; text-decoration: none; }
+a:hover { background: #f4f4f4; }
+</style>
+</head>
+<body>
+<h1>Session expired</h1>
+<p>You need to log in again. What you submitted has not been saved, you will need to submit it again once you have logged in.</p>
+<a href="{{.}}">Log in and return to the previous page</a>
+</body>
+</html>
+`))
+
+// isSafeMethod reports whether the request method is safe, so following a
+// redirect to log in won't lose anything the user submitted
+func isSafeMethod(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// submissionExpired renders a page explaining the request wasn't submitted,
+// with a link to log in and return to the referring page
+func (s *Server) submissionExpired(logger *logrus.Entry, w http.ResponseWriter, r *http.Request) {
+	q := url.Values{}
+	q.Set("redirect", referringPath(r))
+	loginURL := config().Path + "/login?" + q.Encode()
+
+	logger.WithField("method", r.Method).Info("Refusing unsafe request that needs to log in")
+
+	// Remember the submission so the backend can be told after login
+	if config().LostSubmissionHeader != "" {
+		if c, err := MakeSubmissionCookie(r, newLostSubmission(r)); err != nil {
+			logger.WithField("error", err).Warn("Error recording lost submission")
+		} else {
+			setCookie(w, c)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(401)
+	if err := expiredTemplate.Execute(w, loginURL); err != nil {
+		logger.WithField("error", err).Error("Error rendering expired submission page")
+	}
+}
+
+// referringPath returns the path and query of the Referer if it's on the same
+// host as the request, otherwise the path of the request itself
+func referringPath(r *http.Request) string {
+	if referer, err := url.Parse(r.Referer()); err == nil && referer.Host == r.Host && referer.Path != "" {
+		return referer.RequestURI()
+	}
+	return r.URL.Path
+}
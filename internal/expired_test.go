@@ -0,0 +1,50 @@
+package tfa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestExpiredSubmission(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should explain the submission was lost rather than redirect
+	req := newHTTPRequest("POST", "http://example.com/form/submit")
+	req.Header.Set("Referer", "http://example.com/form?id=1")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Equal("text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal("", res.Header.Get("Location"))
+	assert.Contains(body, "has not been saved")
+	assert.Contains(body, `href="/_oauth/login?redirect=%2Fform%3Fid%3D1"`)
+
+	// Should return to the submitted path if the referer is another host
+	req = newHTTPRequest("PUT", "http://example.com/form/submit")
+	req.Header.Set("Referer", "http://evil.com/form")
+	res, body = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Contains(body, `href="/_oauth/login?redirect=%2Fform%2Fsubmit"`)
+
+	// Should still redirect safe requests
+	req = newHTTPRequest("GET", "http://example.com/form")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+}
+
+func TestIsSafeMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isSafeMethod("GET"))
+	assert.True(isSafeMethod("HEAD"))
+	assert.True(isSafeMethod("OPTIONS"))
+	assert.False(isSafeMethod("POST"))
+	assert.False(isSafeMethod("PUT"))
+	assert.False(isSafeMethod("PATCH"))
+	assert.False(isSafeMethod("DELETE"))
+}
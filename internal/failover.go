@@ -0,0 +1,266 @@
+package tfa
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Session store failover
+//
+// When the shared session store (redis or sql) can't be reached, sessions are
+// served in the "session-store-degraded-mode" until it recovers: "deny"
+// refuses every session, "local" serves the sessions this instance has seen
+// from memory but can't create new ones. The store is probed in the
+// background while degraded, so it's picked up again as soon as it returns
+
+// sessionStoreProbeInterval is how often a degraded store is checked
+const sessionStoreProbeInterval = 5 * time.Second
+
+var errSessionStoreDegraded = errors.New("session store is unavailable")
+
+var (
+	sessionStoreDegraded = NewGaugeVec("session_store_degraded",
+		"Whether the shared session store is unavailable and sessions are served in the degraded mode")
+	sessionStoreFailoversTotal = NewCounterVec("session_store_failovers_total",
+		"Times the shared session store became unavailable", "mode")
+)
+
+// FailoverSessionStore wraps a shared session store, serving sessions in the
+// degraded mode while it's unavailable
+type FailoverSessionStore struct {
+	store SessionStore
+	mode  string
+	local *MemorySessionStore
+
+	mu            sync.Mutex
+	degraded      bool
+	probeInterval time.Duration
+}
+
+// NewFailoverSessionStore wraps the store, mode is "deny" or "local"
+func NewFailoverSessionStore(store SessionStore, mode string) *FailoverSessionStore {
+	sessionStoreDegraded.Set(0)
+	return &FailoverSessionStore{
+		store: store,
+		mode:  mode,
+		local: NewMemorySessionStore(),
+
+		probeInterval: sessionStoreProbeInterval,
+	}
+}
+
+// Degraded reports whether the store is unavailable
+func (s *FailoverSessionStore) Degraded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.degraded
+}
+
+// Mode returns the degraded mode
+func (s *FailoverSessionStore) Mode() string {
+	return s.mode
+}
+
+// Get returns the session, from the local cache while degraded in local mode
+func (s *FailoverSessionStore) Get(id uuid.UUID) (*UserEntry, error) {
+	if s.Degraded() {
+		return s.degradedGet(id)
+	}
+
+	entry, err := s.store.Get(id)
+	if err != nil {
+		s.fail(err)
+		return s.degradedGet(id)
+	}
+	if entry != nil && s.mode == "local" {
+		s.local.Put(id, entry, sessionTTL())
+	}
+	return entry, nil
+}
+
+// Put stores the session, sessions can't be created while degraded
+func (s *FailoverSessionStore) Put(id uuid.UUID, entry *UserEntry, ttl time.Duration) error {
+	if s.Degraded() {
+		return errSessionStoreDegraded
+	}
+
+	if err := s.store.Put(id, entry, ttl); err != nil {
+		s.fail(err)
+		return err
+	}
+	if s.mode == "local" {
+		s.local.Put(id, entry, ttl)
+	}
+	return nil
+}
+
+// Delete removes the session, it's always removed from the local cache so
+// this instance stops accepting it
+func (s *FailoverSessionStore) Delete(id uuid.UUID) error {
+	s.local.Delete(id)
+	if s.Degraded() {
+		return errSessionStoreDegraded
+	}
+
+	if err := s.store.Delete(id); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Expire resets the TTL of the session
+func (s *FailoverSessionStore) Expire(id uuid.UUID, ttl time.Duration) (bool, error) {
+	if s.Degraded() {
+		if s.mode == "local" {
+			return s.local.Expire(id, ttl)
+		}
+		return false, errSessionStoreDegraded
+	}
+
+	ok, err := s.store.Expire(id, ttl)
+	if err != nil {
+		s.fail(err)
+		return false, err
+	}
+	if ok && s.mode == "local" {
+		s.local.Expire(id, ttl)
+	}
+	return ok, nil
+}
+
+// Touch records when the session was last seen, in the local cache while
+// degraded in local mode
+func (s *FailoverSessionStore) Touch(id uuid.UUID, seen time.Time) error {
+	if s.Degraded() {
+		if s.mode == "local" {
+			return s.local.Touch(id, seen)
+		}
+		return errSessionStoreDegraded
+	}
+
+	if err := s.store.Touch(id, seen); err != nil {
+		s.fail(err)
+		return err
+	}
+	if s.mode == "local" {
+		s.local.Touch(id, seen)
+	}
+	return nil
+}
+
+// All returns every session, only those in the local cache while degraded
+func (s *FailoverSessionStore) All() ([]*UserEntry, error) {
+	if !s.Degraded() {
+		entries, err := s.store.All()
+		if err == nil {
+			return entries, nil
+		}
+		s.fail(err)
+	}
+
+	if s.mode == "local" {
+		return s.local.All()
+	}
+	return nil, errSessionStoreDegraded
+}
+
+// ByEmail returns the sessions of the user with the email address, only those
+// in the local cache while degraded
+func (s *FailoverSessionStore) ByEmail(email string) ([]*UserEntry, error) {
+	if !s.Degraded() {
+		entries, err := s.store.ByEmail(email)
+		if err == nil {
+			return entries, nil
+		}
+		s.fail(err)
+	}
+
+	if s.mode == "local" {
+		return s.local.ByEmail(email)
+	}
+	return nil, errSessionStoreDegraded
+}
+
+// Count returns the number of sessions, only those in the local cache while
+// degraded
+func (s *FailoverSessionStore) Count() (int, error) {
+	if !s.Degraded() {
+		count, err := s.store.Count()
+		if err == nil {
+			return count, nil
+		}
+		s.fail(err)
+	}
+
+	if s.mode == "local" {
+		return s.local.Count()
+	}
+	return 0, errSessionStoreDegraded
+}
+
+// Ping checks the store can be reached, which it can't be said to be while
+// degraded unless sessions are served from memory
+func (s *FailoverSessionStore) Ping() error {
+	if !s.Degraded() {
+		err := s.store.Ping()
+		if err == nil {
+			return nil
+		}
+		s.fail(err)
+	}
+
+	if s.mode == "local" {
+		return nil
+	}
+	return errSessionStoreDegraded
+}
+
+func (s *FailoverSessionStore) degradedGet(id uuid.UUID) (*UserEntry, error) {
+	if s.mode == "local" {
+		return s.local.Get(id)
+	}
+	return nil, errSessionStoreDegraded
+}
+
+// fail switches to the degraded mode, probing the store until it recovers
+func (s *FailoverSessionStore) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.degraded {
+		return
+	}
+
+	s.degraded = true
+	sessionStoreDegraded.Set(1)
+	sessionStoreFailoversTotal.Inc(s.mode)
+	log.WithFields(logrus.Fields{
+		"error": err,
+		"mode":  s.mode,
+	}).Error("Session store unavailable, serving sessions in degraded mode")
+	background.Go(func(ctx context.Context) {
+		s.probe(ctx, s.probeInterval)
+	})
+}
+
+// probe checks the store every interval, leaving the degraded mode once it
+// responds or giving up once ctx is cancelled
+func (s *FailoverSessionStore) probe(ctx context.Context, interval time.Duration) {
+	for sleepContext(ctx, interval) {
+		if err := s.store.Ping(); err != nil {
+			continue
+		}
+
+		s.mu.Lock()
+		s.degraded = false
+		s.mu.Unlock()
+		sessionStoreDegraded.Set(0)
+		log.WithField("mode", s.mode).Warn("Session store recovered, leaving degraded mode")
+		return
+	}
+}
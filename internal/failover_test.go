@@ -0,0 +1,153 @@
+package tfa
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Setup
+ */
+
+// flakySessionStore is a memory store that fails while down is set
+type flakySessionStore struct {
+	*MemorySessionStore
+
+	mu   sync.Mutex
+	down bool
+}
+
+func newFlakySessionStore() *flakySessionStore {
+	return &flakySessionStore{MemorySessionStore: NewMemorySessionStore()}
+}
+
+func (s *flakySessionStore) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *flakySessionStore) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (s *flakySessionStore) Get(id uuid.UUID) (*UserEntry, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+	return s.MemorySessionStore.Get(id)
+}
+
+func (s *flakySessionStore) Put(id uuid.UUID, entry *UserEntry, ttl time.Duration) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.MemorySessionStore.Put(id, entry, ttl)
+}
+
+func (s *flakySessionStore) Ping() error {
+	return s.err()
+}
+
+func (s *flakySessionStore) Count() (int, error) {
+	if err := s.err(); err != nil {
+		return 0, err
+	}
+	return s.MemorySessionStore.Count()
+}
+
+/**
+ * Tests
+ */
+
+func TestFailoverSessionStoreLocal(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+
+	backend := newFlakySessionStore()
+	s := NewFailoverSessionStore(backend, "local")
+	s.probeInterval = 10 * time.Millisecond
+
+	seen, unseen := uuid.New(), uuid.New()
+	require.Nil(s.Put(seen, &UserEntry{Provider: "google"}, time.Hour))
+	require.Nil(backend.Put(unseen, &UserEntry{Provider: "oidc"}, time.Hour))
+
+	// Should serve sessions this instance has seen once the store is down
+	backend.setDown(true)
+	failovers := sessionStoreFailoversTotal.Value("local")
+	entry, err := s.Get(seen)
+	assert.Nil(err)
+	if assert.NotNil(entry) {
+		assert.Equal("google", entry.Provider)
+	}
+	assert.True(s.Degraded())
+	assert.Equal(float64(1), sessionStoreDegraded.Value())
+	assert.Equal(failovers+1, sessionStoreFailoversTotal.Value("local"))
+
+	entry, err = s.Get(unseen)
+	assert.Nil(err)
+	assert.Nil(entry)
+
+	// Should not create sessions
+	assert.Equal(errSessionStoreDegraded, s.Put(uuid.New(), &UserEntry{}, time.Hour))
+
+	// Should recover once the store is back
+	backend.setDown(false)
+	assert.Eventually(func() bool { return !s.Degraded() }, time.Second, 10*time.Millisecond)
+	assert.Equal(float64(0), sessionStoreDegraded.Value())
+	entry, err = s.Get(unseen)
+	assert.Nil(err)
+	assert.NotNil(entry)
+}
+
+func TestFailoverSessionStoreDeny(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+
+	backend := newFlakySessionStore()
+	s := NewFailoverSessionStore(backend, "deny")
+	s.probeInterval = time.Hour
+
+	id := uuid.New()
+	require.Nil(s.Put(id, &UserEntry{Provider: "google"}, time.Hour))
+
+	// Should refuse every session once the store is down
+	backend.setDown(true)
+	entry, err := s.Get(id)
+	assert.Equal(errSessionStoreDegraded, err)
+	assert.Nil(entry)
+	assert.True(s.Degraded())
+
+	_, err = s.Count()
+	assert.Equal(errSessionStoreDegraded, err)
+	assert.Equal(errSessionStoreDegraded, s.Ping())
+}
+
+func TestFailoverSessionStorePing(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	backend := newFlakySessionStore()
+	s := NewFailoverSessionStore(backend, "local")
+	s.probeInterval = time.Hour
+	assert.Nil(s.Ping())
+	assert.False(s.Degraded())
+
+	// Should fail over when the store can't be pinged
+	backend.setDown(true)
+	assert.Nil(s.Ping(), "should serve sessions from memory")
+	assert.True(s.Degraded())
+}
@@ -0,0 +1,384 @@
+package tfa
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Fallback identity cache
+
+// fallbackCache is set when "fallback-cache" is configured
+var fallbackCache *IdentityCache
+
+// identityCacheFlushInterval is how often identities recorded since the cache
+// was last saved are written to disk
+const identityCacheFlushInterval = 10 * time.Second
+
+// maxCachedSessionsPerUser limits the sessions remembered for each user, the
+// least recently seen are dropped first
+const maxCachedSessionsPerUser = 20
+
+// IdentityCache remembers the last known identity of users that have logged
+// in, so requests to low risk rules can still be granted while the provider is
+// unavailable. The cache is persisted to disk, signed with the secret so it
+// can't be tampered with to grant roles. Logins are saved in batches by
+// startFlush, rather than rewriting the file for each one
+type IdentityCache struct {
+	mu       sync.Mutex
+	path     string
+	secret   []byte
+	previous [][]byte
+	maxAge   time.Duration
+	contents identityCacheContents
+	dirty    bool
+}
+
+// CachedIdentity is the last known identity of a user
+type CachedIdentity struct {
+	Name     string                 `json:"name"`
+	Avatar   string                 `json:"avatar,omitempty"`
+	Roles    []string               `json:"roles"`
+	Groups   []string               `json:"groups,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+	LastSeen time.Time              `json:"last_seen"`
+}
+
+// cachedSession is a session that has logged in
+type cachedSession struct {
+	Email    string    `json:"email"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type identityCacheContents struct {
+	SchemaVersion int `json:"schema_version"`
+
+	// Identities maps email to the last known identity
+	Identities map[string]*CachedIdentity `json:"identities"`
+
+	// Sessions maps the session UUID in the auth cookie to the user
+	Sessions map[string]*cachedSession `json:"sessions"`
+}
+
+type identityCacheFile struct {
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+// NewIdentityCache loads the identity cache at the given path, a missing file
+// results in an empty cache. A file signed with one of the previous secrets is
+// accepted, and signed with the secret when it's next saved
+func NewIdentityCache(path string, secret []byte, maxAge time.Duration, previous ...[]byte) (*IdentityCache, error) {
+	c := &IdentityCache{
+		path:     path,
+		secret:   secret,
+		previous: previous,
+		maxAge:   maxAge,
+		contents: identityCacheContents{
+			Identities: make(map[string]*CachedIdentity),
+			Sessions:   make(map[string]*cachedSession),
+		},
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var file identityCacheFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+
+	if !c.validSignature(file.Payload, file.Signature) {
+		return nil, errors.New("identity cache signature is invalid, the file has been modified or the secret has changed")
+	}
+
+	if err := json.Unmarshal(file.Payload, &c.contents); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Record stores the identity of a user who has just logged in, it's written to
+// disk by the next Flush
+func (c *IdentityCache) Record(user *provider.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.contents.Identities[user.Email] = &CachedIdentity{
+		Name:     user.Name,
+		Avatar:   user.Avatar,
+		Roles:    user.Roles,
+		Groups:   user.Groups,
+		Claims:   user.Claims,
+		LastSeen: now,
+	}
+	c.contents.Sessions[user.UUID.String()] = &cachedSession{Email: user.Email, LastSeen: now}
+	c.prune()
+	c.dirty = true
+}
+
+// Lookup returns the last known identity for the given session, if it has been
+// seen within the staleness limit
+func (c *IdentityCache) Lookup(session uuid.UUID) (*provider.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.contents.Sessions[session.String()]
+	if !ok || time.Since(cached.LastSeen) > c.maxAge {
+		return nil, false
+	}
+
+	email := cached.Email
+	identity, ok := c.contents.Identities[email]
+	if !ok || time.Since(identity.LastSeen) > c.maxAge {
+		return nil, false
+	}
+
+	return &provider.User{
+		UUID:   session,
+		Email:  email,
+		Name:   identity.Name,
+		Avatar: identity.Avatar,
+		Roles:  identity.Roles,
+		Groups: identity.Groups,
+		Claims: identity.Claims,
+	}, true
+}
+
+// Forget removes a session, so it can no longer be used to fall back to the
+// cached identity. The cache is saved straight away, so the session can't be
+// used after a restart either
+func (c *IdentityCache) Forget(session uuid.UUID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.contents.Sessions[session.String()]; !ok {
+		return nil
+	}
+	delete(c.contents.Sessions, session.String())
+
+	if err := c.save(); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Flush saves the identities recorded since the cache was last saved
+func (c *IdentityCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	if err := c.save(); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// startFlush flushes the cache every interval, and once more when the server
+// is stopped
+func (c *IdentityCache) startFlush(interval time.Duration) {
+	background.Go(func(ctx context.Context) {
+		for sleepContext(ctx, interval) {
+			c.flushOrWarn()
+		}
+		c.flushOrWarn()
+	})
+}
+
+func (c *IdentityCache) flushOrWarn() {
+	if err := c.Flush(); err != nil {
+		log.WithField("error", err).Warn("Error saving fallback cache")
+	}
+}
+
+// prune removes identities that are too stale to be used, along with their
+// sessions, and the sessions that haven't been seen within the staleness limit.
+// Only the most recently seen sessions of each user are kept. Must be called
+// with the lock held
+func (c *IdentityCache) prune() {
+	for email, identity := range c.contents.Identities {
+		if time.Since(identity.LastSeen) > c.maxAge {
+			delete(c.contents.Identities, email)
+		}
+	}
+
+	byEmail := make(map[string][]string)
+	for id, session := range c.contents.Sessions {
+		if _, ok := c.contents.Identities[session.Email]; !ok || time.Since(session.LastSeen) > c.maxAge {
+			delete(c.contents.Sessions, id)
+			continue
+		}
+		byEmail[session.Email] = append(byEmail[session.Email], id)
+	}
+
+	for _, ids := range byEmail {
+		if len(ids) <= maxCachedSessionsPerUser {
+			continue
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return c.contents.Sessions[ids[i]].LastSeen.After(c.contents.Sessions[ids[j]].LastSeen)
+		})
+		for _, id := range ids[maxCachedSessionsPerUser:] {
+			delete(c.contents.Sessions, id)
+		}
+	}
+}
+
+// save atomically writes the signed cache to disk. Must be called with the lock
+// held
+func (c *IdentityCache) save() error {
+	c.contents.SchemaVersion = latestVersion(identityCacheMigrations)
+	payload, err := json.Marshal(c.contents)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(identityCacheFile{
+		Payload:   payload,
+		Signature: c.signature(payload),
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.path, b)
+}
+
+func (c *IdentityCache) signature(payload []byte) string {
+	return base64.URLEncoding.EncodeToString(identityCacheMAC(c.secret, payload))
+}
+
+// validSignature reports whether the payload was signed with the secret or
+// one of the previous secrets
+func (c *IdentityCache) validSignature(payload []byte, signature string) bool {
+	actual, err := base64.URLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	for _, secret := range append([][]byte{c.secret}, c.previous...) {
+		if hmac.Equal(identityCacheMAC(secret, payload), actual) {
+			return true
+		}
+	}
+	return false
+}
+
+func identityCacheMAC(secret, payload []byte) []byte {
+	hash := hmac.New(sha256.New, secret)
+	hash.Write([]byte("identity-cache"))
+	hash.Write(payload)
+	return hash.Sum(nil)
+}
+
+// Provider availability
+
+// providerProbeInterval is how often the providers are probed
+const providerProbeInterval = 30 * time.Second
+
+// providerProbes holds the result of the last probe of each provider
+var providerProbes = struct {
+	sync.Mutex
+	results map[string]bool
+}{results: make(map[string]bool)}
+
+var probeClient = &http.Client{Timeout: 3 * time.Second}
+
+// startProviderProbes probes the providers of rules with fallback enabled
+// every interval, so requests only have to check the last result
+func startProviderProbes(interval time.Duration) {
+	background.Go(func(ctx context.Context) {
+		for {
+			for _, p := range fallbackProviders(config()) {
+				probeProvider(p)
+			}
+			if !sleepContext(ctx, interval) {
+				return
+			}
+		}
+	})
+}
+
+// fallbackProviders returns the providers of rules with fallback enabled that
+// can be probed
+func fallbackProviders(c *Config) []provider.Provider {
+	var providers []provider.Provider
+	seen := make(map[string]bool)
+	for _, rule := range c.Rules {
+		if !rule.Fallback {
+			continue
+		}
+		names := rule.Providers()
+		if len(names) == 0 {
+			names = []string{c.DefaultProvider}
+		}
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			p, err := c.GetConfiguredProvider(name)
+			if err != nil {
+				continue
+			}
+			if _, ok := p.(provider.Prober); ok {
+				providers = append(providers, p)
+			}
+		}
+	}
+	return providers
+}
+
+// probeProvider checks whether the provider is reachable and records the result
+func probeProvider(p provider.Provider) {
+	prober, ok := p.(provider.Prober)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	res, err := probeClient.Get(prober.ProbeURL())
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode >= 500 {
+			err = errors.New(res.Status)
+		}
+	}
+	observeProviderRequest(p.Name(), "probe", start, err)
+
+	providerProbes.Lock()
+	providerProbes.results[p.Name()] = err == nil
+	providerProbes.Unlock()
+}
+
+// providerAvailable returns the result of the last probe of the provider.
+// Providers that haven't been probed are assumed to be available
+func providerAvailable(p provider.Provider) bool {
+	providerProbes.Lock()
+	defer providerProbes.Unlock()
+
+	available, ok := providerProbes.results[p.Name()]
+	return !ok || available
+}
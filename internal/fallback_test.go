@@ -0,0 +1,289 @@
+package tfa
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestFallbackCacheRecordLookup(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "identities.json")
+
+	cache, err := NewIdentityCache(path, []byte("veryveryverysecret"), time.Hour)
+	require.Nil(err)
+
+	user := &provider.User{
+		UUID:  uuid.New(),
+		Email: "test@example.com",
+		Name:  "Test",
+		Roles: []string{"admin"},
+	}
+	cache.Record(user)
+
+	// Should return the cached identity
+	cached, ok := cache.Lookup(user.UUID)
+	require.True(ok)
+	assert.Equal(user.Email, cached.Email)
+	assert.Equal(user.Name, cached.Name)
+	assert.Equal(user.Roles, cached.Roles)
+
+	// Should not return unknown sessions
+	_, ok = cache.Lookup(uuid.New())
+	assert.False(ok)
+
+	// Should not be saved until it's flushed
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+
+	// Should persist across restarts
+	require.Nil(cache.Flush())
+	cache, err = NewIdentityCache(path, []byte("veryveryverysecret"), time.Hour)
+	require.Nil(err)
+	cached, ok = cache.Lookup(user.UUID)
+	require.True(ok)
+	assert.Equal(user.Email, cached.Email)
+
+	// Should forget terminated sessions
+	other := &provider.User{UUID: uuid.New(), Email: "test@example.com"}
+	cache.Record(other)
+	require.Nil(cache.Forget(other.UUID))
+	_, ok = cache.Lookup(other.UUID)
+	assert.False(ok)
+	_, ok = cache.Lookup(user.UUID)
+	assert.True(ok, "other sessions for the user should be kept")
+
+	// Should save forgotten sessions straight away
+	reloaded, err := NewIdentityCache(path, []byte("veryveryverysecret"), time.Hour)
+	require.Nil(err)
+	_, ok = reloaded.Lookup(other.UUID)
+	assert.False(ok)
+
+	// Should not return stale identities
+	cache.contents.Identities[user.Email].LastSeen = time.Now().Add(-2 * time.Hour)
+	_, ok = cache.Lookup(user.UUID)
+	assert.False(ok)
+
+	// Should prune stale identities
+	cache.Record(&provider.User{UUID: uuid.New(), Email: "other@example.com"})
+	assert.NotContains(cache.contents.Identities, user.Email)
+	assert.NotContains(cache.contents.Sessions, user.UUID.String())
+}
+
+func TestFallbackCacheSignature(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "identities.json")
+
+	cache, err := NewIdentityCache(path, []byte("veryveryverysecret"), time.Hour)
+	require.Nil(err)
+	cache.Record(&provider.User{UUID: uuid.New(), Email: "test@example.com"})
+	require.Nil(cache.Flush())
+
+	// Should reject a different secret
+	_, err = NewIdentityCache(path, []byte("anotherverysecret"), time.Hour)
+	assert.NotNil(err)
+
+	// Should accept the secret it was signed with as a previous secret
+	_, err = NewIdentityCache(path, []byte("anotherverysecret"), time.Hour, []byte("veryveryverysecret"))
+	assert.Nil(err)
+
+	// Should reject a modified file
+	b, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	b = []byte(string(b[:len(b)-3]) + "x\"}")
+	require.Nil(ioutil.WriteFile(path, b, 0600))
+	_, err = NewIdentityCache(path, []byte("veryveryverysecret"), time.Hour)
+	assert.NotNil(err)
+
+	// Should start empty if there's no file
+	os.Remove(path)
+	cache, err = NewIdentityCache(path, []byte("veryveryverysecret"), time.Hour)
+	assert.Nil(err)
+	assert.Len(cache.contents.Identities, 0)
+}
+
+func TestFallbackCacheSessionLimits(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cache, err := NewIdentityCache(filepath.Join(t.TempDir(), "identities.json"), []byte("veryveryverysecret"), time.Hour)
+	require.Nil(err)
+
+	// Should keep only the most recently seen sessions of each user
+	var users []*provider.User
+	for i := 0; i < maxCachedSessionsPerUser+5; i++ {
+		user := &provider.User{UUID: uuid.New(), Email: "test@example.com"}
+		cache.Record(user)
+		cache.contents.Sessions[user.UUID.String()].LastSeen = time.Now().Add(time.Duration(i-100) * time.Second)
+		users = append(users, user)
+	}
+	cache.Record(&provider.User{UUID: uuid.New(), Email: "other@example.com"})
+	assert.Len(cache.contents.Sessions, maxCachedSessionsPerUser+1)
+	_, ok := cache.Lookup(users[0].UUID)
+	assert.False(ok)
+	_, ok = cache.Lookup(users[len(users)-1].UUID)
+	assert.True(ok)
+
+	// Should expire sessions that haven't been seen within the staleness limit
+	stale := users[len(users)-1]
+	cache.contents.Sessions[stale.UUID.String()].LastSeen = time.Now().Add(-2 * time.Hour)
+	_, ok = cache.Lookup(stale.UUID)
+	assert.False(ok, "the user's identity is still fresh, but the session isn't")
+	cache.Record(&provider.User{UUID: uuid.New(), Email: "other@example.com"})
+	assert.NotContains(cache.contents.Sessions, stale.UUID.String())
+}
+
+func TestFallbackCacheFlush(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "identities.json")
+	secret := []byte("veryveryverysecret")
+
+	cache, err := NewIdentityCache(path, secret, time.Hour)
+	require.Nil(err)
+	user := &provider.User{UUID: uuid.New(), Email: "test@example.com"}
+	cache.Record(user)
+
+	// Should save once the server is stopped
+	cache.startFlush(time.Hour)
+	require.Nil(background.Stop(context.Background()))
+
+	cache, err = NewIdentityCache(path, secret, time.Hour)
+	require.Nil(err)
+	_, ok := cache.Lookup(user.UUID)
+	assert.True(ok)
+}
+
+func TestFallbackProviderAvailable(t *testing.T) {
+	assert := assert.New(t)
+	status := 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	defer resetProviderProbes()
+
+	p := &provider.GenericOAuth{AuthURL: server.URL}
+
+	// Should be assumed available until it's probed
+	resetProviderProbes()
+	assert.True(providerAvailable(p))
+
+	// Should be available
+	probeProvider(p)
+	assert.True(providerAvailable(p))
+
+	// Should reuse the last result
+	status = 503
+	assert.True(providerAvailable(p))
+
+	// Should be unavailable on server errors
+	probeProvider(p)
+	assert.False(providerAvailable(p))
+
+	// Should be unavailable when unreachable
+	status = 200
+	server.Close()
+	probeProvider(p)
+	assert.False(providerAvailable(p))
+}
+
+func TestFallbackProviders(t *testing.T) {
+	assert := assert.New(t)
+	c := newDefaultConfig()
+	c.Rules = map[string]*Rule{
+		"wiki":   {Action: "auth", Provider: "oidc", Fallback: true},
+		"docs":   {Action: "auth", Fallback: true},
+		"admin":  {Action: "auth", Provider: "generic-oauth"},
+		"status": {Action: "auth", Provider: "oidc", Fallback: true},
+	}
+
+	// Should only probe the providers of rules with fallback
+	var names []string
+	for _, p := range fallbackProviders(c) {
+		names = append(names, p.Name())
+	}
+	assert.ElementsMatch([]string{"oidc", "google"}, names)
+}
+
+func TestServerAuthHandlerFallback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"low-risk": {
+			Action:   "auth",
+			Rule:     "PathPrefix(`/wiki`)",
+			Provider: "google",
+			Fallback: true,
+		},
+	}
+
+	cache, err := NewIdentityCache(filepath.Join(t.TempDir(), "identities.json"), config().Secret, time.Hour)
+	require.Nil(err)
+	fallbackCache = cache
+	defer func() { fallbackCache = nil }()
+	defer resetProviderProbes()
+
+	// Simulate a restart, the session is no longer known
+	user := newTestUser("test@example.com")
+	fallbackCache.Record(user)
+	c, _ := MakeCookie(newDefaultHttpRequest("/"), user)
+	sessions.Delete(user.UUID)
+
+	// Should log in again while the provider is available
+	setProviderProbe("google", true)
+	req := newDefaultHttpRequest("/wiki")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+
+	// Should use the cached identity while the provider is unavailable
+	setProviderProbe("google", false)
+	req = newDefaultHttpRequest("/wiki")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("test@example.com", res.Header.Get("X-Forwarded-User"))
+
+	// Should not use the cached identity for rules without fallback
+	req = newDefaultHttpRequest("/other")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+
+	// Should not use the cached identity with an invalid cookie
+	req = newDefaultHttpRequest("/wiki")
+	c.Value = "bad" + c.Value
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+}
+
+/**
+ * Utilities
+ */
+
+func setProviderProbe(name string, available bool) {
+	providerProbes.Lock()
+	defer providerProbes.Unlock()
+	providerProbes.results[name] = available
+}
+
+func resetProviderProbes() {
+	providerProbes.Lock()
+	defer providerProbes.Unlock()
+	providerProbes.results = make(map[string]bool)
+}
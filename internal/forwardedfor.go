@@ -0,0 +1,101 @@
+package tfa
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarded for
+//
+// The X-Forwarded-For chain of a request starts with whatever the client sent,
+// followed by the addresses appended by traefik and any proxies in front of it.
+// The chain is sanitized by dropping entries that aren't addresses and those
+// before the client, found by skipping the "trusted-ip-depth" proxies from the
+// end, so what's left is the client followed by the proxies it went through.
+// The client is recorded in audit events, and with "forwarded-for-header" set
+// the chain is passed to backends, so they see the client rather than traefik
+
+// forwardedFor returns the sanitized X-Forwarded-For chain of the request,
+// starting with the client, or the address it connected from if it has none.
+// The boolean is false if the chain is shorter than the trusted proxies, so
+// the client isn't known and the chain is returned as it is
+func forwardedFor(r *http.Request) ([]string, bool) {
+	var chain []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(header, ",") {
+			if ip := parseForwardedIP(entry); ip != nil {
+				chain = append(chain, ip.String())
+			}
+		}
+	}
+
+	if len(chain) == 0 {
+		ip := parseForwardedIP(r.RemoteAddr)
+		if ip == nil {
+			return nil, false
+		}
+		return []string{ip.String()}, config().TrustedIPDepth == 0
+	}
+
+	i := len(chain) - 1 - config().TrustedIPDepth
+	if i < 0 {
+		return chain, false
+	}
+	return chain[i:], true
+}
+
+// parseForwardedIP parses an entry of the chain, which may have a port
+func parseForwardedIP(entry string) net.IP {
+	entry = strings.TrimSpace(entry)
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		entry = host
+	}
+	return net.ParseIP(strings.Trim(entry, "[]"))
+}
+
+// originalClientIP returns the address of the client, skipping the trusted
+// proxies, for recording who made a request
+func originalClientIP(r *http.Request) string {
+	chain, _ := forwardedFor(r)
+	if len(chain) == 0 {
+		return r.RemoteAddr
+	}
+	return chain[0]
+}
+
+// withForwardedFor passes the sanitized chain to the backend in the
+// "forwarded-for-header" when next allows the request
+func withForwardedFor(next http.Handler) http.Handler {
+	if config().ForwardedForHeader == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&forwardedForWriter{ResponseWriter: w, r: r}, r)
+	})
+}
+
+// forwardedForWriter adds the chain to successful responses, it's left off
+// others as traefik returns them to the client
+type forwardedForWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (w *forwardedForWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 && status < 300 {
+		if chain, _ := forwardedFor(w.r); len(chain) > 0 {
+			w.Header().Set(config().ForwardedForHeader, strings.Join(chain, ", "))
+		}
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *forwardedForWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,83 @@
+package tfa
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestForwardedFor(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	tests := []struct {
+		depth     int
+		forwarded []string
+		chain     []string
+		complete  bool
+	}{
+		// Should fall back to the connecting address
+		{0, nil, []string{"192.0.2.1"}, true},
+		{1, nil, []string{"192.0.2.1"}, false},
+		// Should keep the entry traefik added
+		{0, []string{"203.0.113.5"}, []string{"203.0.113.5"}, true},
+		// Should drop the entries the client sent
+		{0, []string{"10.0.0.1, 203.0.113.5"}, []string{"203.0.113.5"}, true},
+		// Should keep the client and the trusted proxies
+		{1, []string{"10.0.0.1, 203.0.113.5, 198.51.100.2"}, []string{"203.0.113.5", "198.51.100.2"}, true},
+		// Should read every header, dropping invalid entries and ports
+		{1, []string{"unknown, 203.0.113.5:4711", "[2001:db8::1]:443"}, []string{"203.0.113.5", "2001:db8::1"}, true},
+		// Should report chains shorter than the trusted proxies
+		{2, []string{"203.0.113.5, 198.51.100.2"}, []string{"203.0.113.5", "198.51.100.2"}, false},
+	}
+
+	for _, test := range tests {
+		config().TrustedIPDepth = test.depth
+		req := newDefaultHttpRequest("/")
+		for _, value := range test.forwarded {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		chain, complete := forwardedFor(req)
+		assert.Equal(test.chain, chain, test.forwarded)
+		assert.Equal(test.complete, complete, test.forwarded)
+		assert.Equal(test.chain[0], originalClientIP(req), test.forwarded)
+	}
+
+	// Should fall back to the connecting address as it is
+	req := newDefaultHttpRequest("/")
+	req.RemoteAddr = "@"
+	assert.Equal("@", originalClientIP(req))
+}
+
+func TestServerForwardedForHeader(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().ForwardedForHeader = "X-Client-Chain"
+	config().TrustedIPDepth = 1
+	config().Rules = map[string]*Rule{
+		"public": {
+			Action: "allow",
+			Rule:   "PathPrefix(`/public`)",
+		},
+	}
+	h := NewServer().Handler()
+
+	// Should pass allowed requests the sanitized chain
+	req := newDefaultHttpRequest("/public")
+	req.Header.Set("X-Forwarded-For", "10.6.6.6, 203.0.113.5, 198.51.100.2")
+	res := serveRouter(h, req)
+	assert.Equal(200, res.Code)
+	assert.Equal("203.0.113.5, 198.51.100.2", res.Header().Get("X-Client-Chain"))
+
+	// Should leave it off responses returned to the client
+	req = newDefaultHttpRequest("/private")
+	req.Header.Set("X-Forwarded-For", "10.6.6.6, 203.0.113.5, 198.51.100.2")
+	res = serveRouter(h, req)
+	assert.Equal(http.StatusTemporaryRedirect, res.Code)
+	assert.Equal("", res.Header().Get("X-Client-Chain"))
+}
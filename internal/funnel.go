@@ -0,0 +1,119 @@
+package tfa
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/containous/traefik/v2/pkg/rules"
+)
+
+// Login funnel
+//
+// A login passes through three stages: the user is redirected to the provider,
+// returns to the callback, and a session is created. Each is counted per
+// provider and rule, along with the reason logins drop out
+
+const (
+	funnelRedirect = "redirect"
+	funnelCallback = "callback"
+	funnelSession  = "session"
+)
+
+// funnelUnknown labels failures that happen before the provider or rule can be
+// trusted, e.g. a callback with an invalid state
+const funnelUnknown = "unknown"
+
+var (
+	loginFunnelTotal = NewCounterVec("login_funnel_total",
+		"Logins reaching each stage: redirect (sent to the provider), callback (returned from the provider) and session (logged in)", "provider", "rule", "stage")
+	loginFailuresTotal = NewCounterVec("login_failures_total",
+		"Logins that dropped out of the funnel, by reason", "provider", "rule", "reason")
+	loginConversionRatio = NewGaugeVec("login_conversion_ratio",
+		"Ratio of redirects to the provider that resulted in a session", "provider", "rule")
+)
+
+// recordFunnelStage counts a login reaching the given stage
+func recordFunnelStage(providerName, rule, stage string) {
+	loginFunnelTotal.Inc(providerName, rule, stage)
+
+	if redirects := loginFunnelTotal.Value(providerName, rule, funnelRedirect); redirects > 0 {
+		sessions := loginFunnelTotal.Value(providerName, rule, funnelSession)
+		loginConversionRatio.Set(sessions/redirects, providerName, rule)
+	}
+}
+
+// recordFunnelFailure counts a login dropping out of the funnel
+func recordFunnelFailure(providerName, rule, reason string) {
+	loginFailuresTotal.Inc(providerName, rule, reason)
+}
+
+// Rule matching
+
+type ruleNameKey struct{}
+
+// buildRuleMatcher builds a router that reports which rule a request falls
+// under, used to attribute logins to the rule the user is returning to
+func buildRuleMatcher(ruleSet map[string]*Rule) (*rules.Router, error) {
+	router, err := rules.NewRouter()
+	if err != nil {
+		return nil, err
+	}
+
+	err = addRuleRoutes(router, ruleSet, func(name string, _ *Rule) http.Handler {
+		return ruleNameHandler(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	router.NewRoute().Handler(ruleNameHandler("default"))
+
+	return router, nil
+}
+
+func ruleNameHandler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if match, ok := r.Context().Value(ruleNameKey{}).(*string); ok {
+			*match = name
+		}
+	}
+}
+
+// matchRule returns the name of the rule the given URL falls under. Only the
+// host, path and query are known, so rules matching on headers won't match
+func (s *Server) matchRule(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return funnelUnknown
+	}
+
+	// Requests from traefik have a relative URL, so a port in the host is
+	// ignored when matching as it is for them
+	r, err := http.NewRequest("GET", u.RequestURI(), nil)
+	if err != nil {
+		return funnelUnknown
+	}
+	r.Host = u.Host
+	return s.matchRequest(r)
+}
+
+// matchRequest returns the name of the rule the request falls under, the
+// request's host, path, method and headers are matched
+func (s *Server) matchRequest(r *http.Request) string {
+	match := funnelUnknown
+	r = r.WithContext(context.WithValue(r.Context(), ruleNameKey{}, &match))
+	r.Host = canonicalHost(r.Host)
+
+	s.mu.RLock()
+	matcher := s.ruleMatcher
+	s.mu.RUnlock()
+	matcher.ServeHTTP(discardResponseWriter{}, r)
+	return match
+}
+
+// discardResponseWriter is used when a handler is only run for its side effects
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header         { return http.Header{} }
+func (discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponseWriter) WriteHeader(int)             {}
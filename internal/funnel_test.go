@@ -0,0 +1,105 @@
+package tfa
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestFunnelMatchRule(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"wiki": {
+			Action: "auth",
+			Rule:   "Host(`wiki.example.com`)",
+		},
+		"api": {
+			Action: "auth",
+			Rule:   "Host(`example.com`) && PathPrefix(`/api`)",
+		},
+	}
+
+	s := NewServer()
+	assert.Equal("wiki", s.matchRule("https://wiki.example.com/page"))
+	assert.Equal("wiki", s.matchRule("https://wiki.example.com:8443/page"), "port should be ignored")
+	assert.Equal("api", s.matchRule("https://example.com/api/v1?x=1"))
+	assert.Equal("default", s.matchRule("https://example.com/other"))
+	assert.Equal(funnelUnknown, s.matchRule("%%"))
+}
+
+func TestFunnelCallback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"wiki": {
+			Action:   "auth",
+			Rule:     "Host(`wiki.example.com`)",
+			Provider: "google",
+		},
+	}
+
+	// Setup OAuth server
+	server, serverURL := NewOAuthServer(t)
+	defer server.Close()
+	config().Providers.Google.TokenURL = &url.URL{
+		Scheme: serverURL.Scheme,
+		Host:   serverURL.Host,
+		Path:   "/token",
+	}
+	config().Providers.Google.UserURL = &url.URL{
+		Scheme: serverURL.Scheme,
+		Host:   serverURL.Host,
+		Path:   "/userinfo",
+	}
+
+	redirects := loginFunnelTotal.Value("google", "wiki", funnelRedirect)
+	callbacks := loginFunnelTotal.Value("google", "wiki", funnelCallback)
+	sessions := loginFunnelTotal.Value("google", "wiki", funnelSession)
+
+	// Should count the redirect to the provider against the rule
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Forwarded-Host", "wiki.example.com")
+	res, _ := doHttpRequest(req, nil)
+	require.Equal(307, res.StatusCode)
+	assert.Equal(redirects+1, loginFunnelTotal.Value("google", "wiki", funnelRedirect))
+
+	// Should count the callback and session
+	config().CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://wiki.example.com/foo")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	require.Equal(307, res.StatusCode)
+
+	assert.Equal(callbacks+1, loginFunnelTotal.Value("google", "wiki", funnelCallback))
+	assert.Equal(sessions+1, loginFunnelTotal.Value("google", "wiki", funnelSession))
+	assert.Greater(loginConversionRatio.Value("google", "wiki"), 0.0)
+}
+
+func TestFunnelFailures(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	missing := loginFailuresTotal.Value(funnelUnknown, funnelUnknown, "csrf_missing")
+	mismatch := loginFailuresTotal.Value(funnelUnknown, funnelUnknown, "csrf_mismatch")
+
+	// Should count a callback without a csrf cookie
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Equal(missing+1, loginFailuresTotal.Value(funnelUnknown, funnelUnknown, "csrf_missing"))
+
+	// Should count a callback with the wrong csrf cookie
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	c.Value = "invalid"
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+	assert.Equal(mismatch+1, loginFailuresTotal.Value(funnelUnknown, funnelUnknown, "csrf_mismatch"))
+}
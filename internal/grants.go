@@ -0,0 +1,269 @@
+package tfa
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Role grants
+//
+// Operators can grant a user a role until a given time with the admin API,
+// for break-glass or temporary elevated access that ends by itself. Grants
+// are kept in the "role-grants" file, keyed by normalized email, and are
+// merged into the user's roles on every request rather than at login, so a
+// grant applies to sessions that already exist and stops applying as soon as
+// it expires. Changes made by other instances are picked up within
+// roleGrantsReloadInterval
+
+// roleGrants is set when "role-grants" is configured
+var roleGrants *GrantStore
+
+// roleGrantsReloadInterval is how often the grants file is checked for
+// changes made by another instance
+const roleGrantsReloadInterval = 10 * time.Second
+
+// GrantStore is a persistent table of the roles temporarily granted to users
+type GrantStore struct {
+	mu        sync.Mutex
+	path      string
+	users     map[string][]*RoleGrant
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// RoleGrant is a role granted to a user until a time
+type RoleGrant struct {
+	Role      string    `json:"role"`
+	Until     time.Time `json:"until"`
+	Reason    string    `json:"reason,omitempty"`
+	GrantedAt time.Time `json:"granted_at"`
+	GrantedBy string    `json:"granted_by,omitempty"`
+}
+
+// Active reports whether the grant hasn't expired yet
+func (g *RoleGrant) Active() bool {
+	return time.Now().Before(g.Until)
+}
+
+// UserGrant is a grant along with the user it's for, as listed by the admin
+// API
+type UserGrant struct {
+	Email string `json:"email"`
+	RoleGrant
+}
+
+type roleGrantsFile struct {
+	SchemaVersion int                     `json:"schema_version"`
+	Users         map[string][]*RoleGrant `json:"users"`
+}
+
+// NewGrantStore loads the grants at the given path, a missing file results in
+// no roles being granted
+func NewGrantStore(path string) (*GrantStore, error) {
+	s := &GrantStore{
+		path:  path,
+		users: make(map[string][]*RoleGrant),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.lastCheck = time.Now()
+	return s, nil
+}
+
+// Roles returns the roles currently granted to the email address
+func (s *GrantStore) Roles(email string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloadIfChanged()
+	var roles []string
+	for _, grant := range s.users[normalizeEmail(email)] {
+		if grant.Active() {
+			roles = append(roles, grant.Role)
+		}
+	}
+	return roles
+}
+
+// Grants returns the grants that haven't expired, sorted by email and role
+func (s *GrantStore) Grants() []UserGrant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloadIfChanged()
+	list := []UserGrant{}
+	for email, grants := range s.users {
+		for _, grant := range grants {
+			if grant.Active() {
+				list = append(list, UserGrant{Email: email, RoleGrant: *grant})
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Email != list[j].Email {
+			return list[i].Email < list[j].Email
+		}
+		return list[i].Role < list[j].Role
+	})
+	return list
+}
+
+// Grant grants the role to the email address, replacing any grant of the same
+// role. Expired grants are dropped
+func (s *GrantStore) Grant(email string, grant *RoleGrant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Make sure changes from elsewhere aren't lost
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	email = normalizeEmail(email)
+	s.users[email] = append(s.without(email, grant.Role), grant)
+	s.purge()
+	return s.save()
+}
+
+// Revoke removes the grant of the role to the email address, returning false
+// if the role wasn't granted
+func (s *GrantStore) Revoke(email, role string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return false, err
+	}
+
+	email = normalizeEmail(email)
+	remaining := s.without(email, role)
+	if len(remaining) == len(s.users[email]) {
+		return false, nil
+	}
+	s.users[email] = remaining
+	s.purge()
+	return true, s.save()
+}
+
+// without returns the user's grants other than of the role. Must be called
+// with the lock held
+func (s *GrantStore) without(email, role string) []*RoleGrant {
+	var grants []*RoleGrant
+	for _, grant := range s.users[email] {
+		if grant.Role != role {
+			grants = append(grants, grant)
+		}
+	}
+	return grants
+}
+
+// purge drops expired grants. Must be called with the lock held
+func (s *GrantStore) purge() {
+	for email, grants := range s.users {
+		var active []*RoleGrant
+		for _, grant := range grants {
+			if grant.Active() {
+				active = append(active, grant)
+			}
+		}
+		if len(active) == 0 {
+			delete(s.users, email)
+		} else {
+			s.users[email] = active
+		}
+	}
+}
+
+// reloadIfChanged reloads the grants if the file has been modified, at most
+// every reload interval. Must be called with the lock held
+func (s *GrantStore) reloadIfChanged() {
+	if time.Since(s.lastCheck) < roleGrantsReloadInterval {
+		return
+	}
+	s.lastCheck = time.Now()
+
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return
+	}
+	if err := s.load(); err != nil {
+		log.WithField("error", err).Warn("Error reloading role grants, keeping previous contents")
+	}
+}
+
+// load reads the grants from disk. Must be called with the lock held
+func (s *GrantStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var file roleGrantsFile
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return err
+	}
+	s.users = make(map[string][]*RoleGrant, len(file.Users))
+	for email, grants := range file.Users {
+		key := normalizeEmail(email)
+		s.users[key] = append(s.users[key], grants...)
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save atomically writes the grants to disk. Must be called with the lock
+// held
+func (s *GrantStore) save() error {
+	b, err := json.MarshalIndent(roleGrantsFile{
+		SchemaVersion: latestVersion(roleGrantsMigrations),
+		Users:         s.users,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// withRoleGrants returns the user with the roles currently granted to them
+// added. Users are shared with the session store, so a copy is returned
+// rather than the user changed, otherwise the roles would outlive the grant
+func withRoleGrants(user *provider.User) *provider.User {
+	if roleGrants == nil {
+		return user
+	}
+	granted := roleGrants.Roles(user.Email)
+	if len(granted) == 0 {
+		return user
+	}
+
+	elevated := *user
+	elevated.Roles = append([]string{}, user.Roles...)
+	for _, role := range granted {
+		if !containsString(elevated.Roles, role) {
+			elevated.Roles = append(elevated.Roles, role)
+		}
+	}
+	return &elevated
+}
@@ -0,0 +1,111 @@
+package tfa
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestGrantStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "grants.json")
+
+	s, err := NewGrantStore(path)
+	require.Nil(err)
+	assert.Empty(s.Grants())
+
+	// Should grant roles until they expire
+	require.Nil(s.Grant("One@Example.com", &RoleGrant{Role: "admin", Until: time.Now().Add(time.Hour)}))
+	require.Nil(s.Grant("one@example.com", &RoleGrant{Role: "oncall", Until: time.Now().Add(-time.Second)}))
+	assert.Equal([]string{"admin"}, s.Roles("one@example.com"))
+	grants := s.Grants()
+	require.Len(grants, 1)
+	assert.Equal("one@example.com", grants[0].Email)
+
+	// Should replace grants of the same role
+	until := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	require.Nil(s.Grant("one@example.com", &RoleGrant{Role: "admin", Until: until}))
+	grants = s.Grants()
+	require.Len(grants, 1)
+	assert.Equal(until, grants[0].Until)
+
+	// Should persist grants, dropping expired ones
+	reloaded, err := NewGrantStore(path)
+	require.Nil(err)
+	assert.Equal([]string{"admin"}, reloaded.Roles("one@example.com"))
+	assert.Len(reloaded.users["one@example.com"], 1)
+
+	// Should revoke grants
+	revoked, err := s.Revoke("one@example.com", "admin")
+	assert.Nil(err)
+	assert.True(revoked)
+	revoked, err = s.Revoke("one@example.com", "admin")
+	assert.Nil(err)
+	assert.False(revoked)
+	assert.Empty(s.Roles("one@example.com"))
+}
+
+func TestWithRoleGrants(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	user := &provider.User{Email: "one@example.com", Roles: []string{"staff"}}
+
+	// Should leave users alone without grants
+	assert.Same(user, withRoleGrants(user))
+
+	s, err := NewGrantStore(filepath.Join(t.TempDir(), "grants.json"))
+	require.Nil(err)
+	roleGrants = s
+	defer func() { roleGrants = nil }()
+	assert.Same(user, withRoleGrants(user))
+
+	// Should add granted roles without changing the user
+	require.Nil(s.Grant("one@example.com", &RoleGrant{Role: "admin", Until: time.Now().Add(time.Hour)}))
+	require.Nil(s.Grant("one@example.com", &RoleGrant{Role: "staff", Until: time.Now().Add(time.Hour)}))
+	elevated := withRoleGrants(user)
+	assert.Equal([]string{"staff", "admin"}, elevated.Roles)
+	assert.Equal([]string{"staff"}, user.Roles)
+}
+
+func TestRoleGrantsAuthHandler(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().AllowedRoles = []string{"breakglass"}
+	config().Headers = []string{"X-Auth-Roles:roles"}
+	s, err := NewGrantStore(filepath.Join(t.TempDir(), "grants.json"))
+	require.Nil(err)
+	roleGrants = s
+	defer func() { roleGrants = nil }()
+	user := newTestUser("grant-handler@example.com")
+
+	// Should refuse users without the role
+	req := newDefaultHttpRequest("/foo")
+	c, _ := makeCookie(req, user, time.Now().Add(time.Hour))
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+
+	// Should allow existing sessions once the role is granted
+	require.Nil(s.Grant(user.Email, &RoleGrant{Role: "breakglass", Until: time.Now().Add(time.Hour)}))
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("breakglass", res.Header.Get("X-Auth-Roles"))
+
+	// Should refuse them again once the grant is revoked
+	_, err = s.Revoke(user.Email, "breakglass")
+	require.Nil(err)
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+}
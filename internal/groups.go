@@ -0,0 +1,120 @@
+package tfa
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Directory groups
+//
+// Providers with groups enabled ("providers.google.groups" or
+// "providers.oidc.graph-groups") look up the groups the user is a member of in
+// their directory at login, with the access token just issued, and whenever
+// the session is renewed. Groups are kept with the session, and rules permit
+// users in one of their "allowed-groups". Lookups are cached for
+// "groups-cache-ttl", so users logging in repeatedly don't each cost a
+// directory request
+
+var groupLookupsTotal = NewCounterVec("group_lookups_total",
+	"Directory group lookups made at login and renewal, by provider and result", "provider", "result")
+
+// groupCache holds the groups recently looked up, by provider and email
+var groupCache = &GroupCache{entries: make(map[string]*cachedGroups)}
+
+// GroupCache holds the groups looked up for users until they expire
+type GroupCache struct {
+	sync.Mutex
+	entries   map[string]*cachedGroups
+	lastPurge time.Time
+}
+
+type cachedGroups struct {
+	groups  []string
+	expires time.Time
+}
+
+// Get returns the cached groups, and whether any were cached
+func (c *GroupCache) Get(providerName, email string) ([]string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[providerName+"|"+email]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.groups, true
+}
+
+// Put caches the groups for the ttl
+func (c *GroupCache) Put(providerName, email string, groups []string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	c.entries[providerName+"|"+email] = &cachedGroups{groups: groups, expires: now.Add(ttl)}
+
+	// Drop expired entries now and then
+	if now.Sub(c.lastPurge) > time.Minute {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.lastPurge = now
+	}
+}
+
+// resolveGroups sets the user's groups from the provider's directory, if the
+// provider looks groups up. The user is left without groups if the lookup
+// fails, so they're only permitted by allowed-groups once it succeeds
+func resolveGroups(r *http.Request, logger *logrus.Entry, providerName string, p provider.Provider, token *provider.Token, user *provider.User) {
+	resolver, ok := p.(provider.GroupResolver)
+	if !ok {
+		return
+	}
+	if groups, ok := groupCache.Get(providerName, user.Email); ok {
+		user.Groups = groups
+		groupLookupsTotal.Inc(providerName, "cached")
+		return
+	}
+
+	// The directory APIs aren't the provider's login endpoints, so lookups
+	// aren't limited by the provider-request-rate
+	start := time.Now()
+	groups, err := resolver.ResolveGroups(token, user)
+	if groups == nil && err == nil {
+		return
+	}
+	observeProviderRequest(providerName, "groups", start, err)
+	traceProviderRequest(r, providerName, "groups", start, err)
+	if err != nil {
+		groupLookupsTotal.Inc(providerName, "error")
+		logger.WithFields(logrus.Fields{
+			"error": err,
+			"user":  user.Email,
+		}).Warn("Error looking up groups")
+		return
+	}
+
+	groupLookupsTotal.Inc(providerName, "success")
+	user.Groups = groups
+	if config().GroupsCacheTTL > 0 {
+		groupCache.Put(providerName, user.Email, groups, config().GroupsCacheTTL)
+	}
+}
+
+// ValidateGroups checks if the user is in one of the allowed groups, group
+// emails and names are compared without case
+func ValidateGroups(user *provider.User, allowedGroups CommaSeparatedList) bool {
+	for _, allowed := range allowedGroups {
+		for _, group := range user.Groups {
+			if strings.EqualFold(allowed, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
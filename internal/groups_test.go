@@ -0,0 +1,111 @@
+package tfa
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestResolveGroups(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	groupCache = &GroupCache{entries: make(map[string]*cachedGroups)}
+	logger := logrus.NewEntry(log)
+	req := newDefaultHttpRequest("/_oauth")
+	p := &groupsTestProvider{groups: []string{"eng@example.com"}}
+
+	// Should set the groups looked up
+	user := &provider.User{Email: "groups@example.com"}
+	resolveGroups(req, logger, "google", p, &provider.Token{}, user)
+	assert.Equal([]string{"eng@example.com"}, user.Groups)
+	assert.Equal(1, p.lookups)
+
+	// Should reuse cached groups
+	user = &provider.User{Email: "groups@example.com"}
+	resolveGroups(req, logger, "google", p, &provider.Token{}, user)
+	assert.Equal([]string{"eng@example.com"}, user.Groups)
+	assert.Equal(1, p.lookups)
+
+	// Should leave the user without groups if the lookup fails
+	p.err = errors.New("directory unavailable")
+	user = &provider.User{Email: "other@example.com"}
+	resolveGroups(req, logger, "google", p, &provider.Token{}, user)
+	assert.Nil(user.Groups)
+	assert.Equal(2, p.lookups)
+
+	// Should look groups up every time without a cache
+	p.err = nil
+	config().GroupsCacheTTL = 0
+	resolveGroups(req, logger, "google", p, &provider.Token{}, user)
+	resolveGroups(req, logger, "google", p, &provider.Token{}, user)
+	assert.Equal(4, p.lookups)
+}
+
+func TestGroupCacheExpiry(t *testing.T) {
+	assert := assert.New(t)
+	c := &GroupCache{entries: make(map[string]*cachedGroups)}
+
+	c.Put("google", "one@example.com", []string{"eng@example.com"}, time.Minute)
+	c.Put("google", "two@example.com", []string{"ops@example.com"}, -time.Second)
+
+	groups, ok := c.Get("google", "one@example.com")
+	assert.True(ok)
+	assert.Equal([]string{"eng@example.com"}, groups)
+	_, ok = c.Get("oidc", "one@example.com")
+	assert.False(ok, "groups should be cached per provider")
+	_, ok = c.Get("google", "two@example.com")
+	assert.False(ok, "expired groups shouldn't be returned")
+}
+
+func TestValidateUserGroups(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().AllowedGroups = []string{"Eng@example.com"}
+	user := &provider.User{Email: "groups@example.com", Groups: []string{"eng@example.com"}}
+
+	// Should allow users in an allowed group, ignoring case
+	assert.True(ValidateUser(user, "default"))
+	assert.False(ValidateUser(&provider.User{Email: "groups@example.com"}, "default"))
+
+	// Should use the rule's allowed groups
+	c, err := NewConfig([]string{
+		"--rule.ops.action=auth",
+		"--rule.ops.rule=Host(`ops.example.com`)",
+		"--rule.ops.allowedGroups=ops@example.com,sre@example.com",
+	})
+	require.Nil(t, err)
+	config().Rules = c.Rules
+	assert.Equal(CommaSeparatedList{"ops@example.com", "sre@example.com"}, config().Rules["ops"].AllowedGroups)
+	assert.False(ValidateUser(user, "ops"))
+	user.Groups = append(user.Groups, "sre@example.com")
+	assert.True(ValidateUser(user, "ops"))
+}
+
+/**
+ * Utilities
+ */
+
+// groupsTestProvider looks up the same groups for every user
+type groupsTestProvider struct {
+	provider.Provider
+	groups  []string
+	err     error
+	lookups int
+}
+
+func (p *groupsTestProvider) ResolveGroups(token *provider.Token, user *provider.User) ([]string, error) {
+	p.lookups++
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.groups, nil
+}
@@ -0,0 +1,142 @@
+package tfa
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC
+//
+// gRPC clients can't follow a redirect to log in and don't show an error
+// page, they expect the outcome of a call in the grpc-status and grpc-message
+// metadata. Requests with an application/grpc content type that are refused
+// are answered with a trailers-only response, the status mapped from the HTTP
+// status as gRPC clients would and the message taken from the error. The HTTP
+// status is kept, as traefik only returns responses that aren't 2xx to the
+// client. Calls that need to log in are refused as unauthenticated rather
+// than redirected, and with "bearer-auth" set their access token may be sent
+// in the authorization metadata or one of the "grpc-token-metadata" keys
+
+// isGRPCRequest reports whether the request is a gRPC call
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcMetadataToken returns the access token in the first of the
+// "grpc-token-metadata" keys sent, decoding binary (-bin) metadata
+func grpcMetadataToken(r *http.Request) string {
+	for _, key := range config().GRPCTokenMetadata {
+		value := strings.TrimSpace(r.Header.Get(key))
+		if value == "" {
+			continue
+		}
+		if strings.HasSuffix(strings.ToLower(key), "-bin") {
+			decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		if len(value) >= 7 && strings.EqualFold(value[:7], "Bearer ") {
+			value = strings.TrimSpace(value[7:])
+		}
+		return value
+	}
+	return ""
+}
+
+// grpcStatus maps an HTTP status to the gRPC status code clients would
+// assume for it, see https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func grpcStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return 13 // INTERNAL
+	case http.StatusUnauthorized:
+		return 16 // UNAUTHENTICATED
+	case http.StatusForbidden:
+		return 7 // PERMISSION_DENIED
+	case http.StatusNotFound:
+		return 12 // UNIMPLEMENTED
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return 14 // UNAVAILABLE
+	}
+	return 2 // UNKNOWN
+}
+
+// grpcMessage percent-encodes the message as grpc-message requires
+func grpcMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// withGRPCResponse answers gRPC calls next refuses with a gRPC status
+func withGRPCResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isGRPCRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &grpcWriter{ResponseWriter: w}
+		next.ServeHTTP(gw, r)
+		if gw.status != 0 && !gw.wroteHeader {
+			gw.writeStatus(http.StatusText(gw.status))
+		}
+	})
+}
+
+// grpcWriter holds back the status of refused requests until the error
+// message is written, which becomes the grpc-message instead of the body
+type grpcWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *grpcWriter) WriteHeader(status int) {
+	if w.wroteHeader || w.status != 0 {
+		return
+	}
+	if status < 300 {
+		w.wroteHeader = true
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *grpcWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		if !w.wroteHeader {
+			w.writeStatus(strings.TrimSpace(string(b)))
+		}
+		return len(b), nil
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// writeStatus sends the held back status as a trailers-only response
+func (w *grpcWriter) writeStatus(msg string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("X-Content-Type-Options")
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(grpcStatus(w.status)))
+	h.Set("Grpc-Message", grpcMessage(msg))
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
@@ -0,0 +1,130 @@
+package tfa
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestIsGRPCRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	req := newDefaultHttpRequest("/helloworld.Greeter/SayHello")
+	assert.False(isGRPCRequest(req))
+	req.Header.Set("Content-Type", "application/grpc")
+	assert.True(isGRPCRequest(req))
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	assert.True(isGRPCRequest(req))
+	req.Header.Set("Content-Type", "application/grpc-web")
+	assert.True(isGRPCRequest(req))
+}
+
+func TestGRPCMetadataToken(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().GRPCTokenMetadata = CommaSeparatedList{"x-access-token", "x-token-bin"}
+
+	// Should only take tokens from metadata of gRPC calls
+	req := newDefaultHttpRequest("/helloworld.Greeter/SayHello")
+	req.Header.Set("X-Access-Token", "abc.def")
+	assert.Equal("", bearerToken(req))
+	req.Header.Set("Content-Type", "application/grpc")
+	assert.Equal("abc.def", bearerToken(req))
+
+	// Should prefer the authorization metadata
+	req.Header.Set("Authorization", "Bearer authz")
+	assert.Equal("authz", bearerToken(req))
+
+	// Should decode binary metadata, and drop the Bearer prefix
+	req = newDefaultHttpRequest("/helloworld.Greeter/SayHello")
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("X-Token-Bin", base64.RawStdEncoding.EncodeToString([]byte("Bearer binary")))
+	assert.Equal("binary", bearerToken(req))
+	req.Header.Set("X-Token-Bin", "not base64!")
+	assert.Equal("", bearerToken(req))
+}
+
+func TestGRPCMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("Not authorized", grpcMessage("Not authorized"))
+	assert.Equal("100%25 d%C3%A9j%C3%A0 vu%0A", grpcMessage("100% déjà vu\n"))
+}
+
+func TestGRPCResponse(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"closed": {
+			Action: "deny",
+			Rule:   "Host(`closed.example.com`)",
+		},
+	}
+	h := NewServer().Handler()
+
+	// Should refuse calls that need to log in as unauthenticated
+	req := newHTTPRequest("POST", "http://example.com/helloworld.Greeter/SayHello")
+	req.Header.Set("Content-Type", "application/grpc")
+	res := serveRouter(h, req)
+	assert.Equal(401, res.Code)
+	assert.Equal("application/grpc", res.Header().Get("Content-Type"))
+	assert.Equal("16", res.Header().Get("Grpc-Status"))
+	assert.Equal("Login required", res.Header().Get("Grpc-Message"))
+	assert.Empty(res.Header().Get("Location"))
+	assert.Empty(res.Body.String())
+
+	// Should refuse calls denied by a rule
+	req = newHTTPRequest("POST", "http://closed.example.com/helloworld.Greeter/SayHello")
+	req.Header.Set("Content-Type", "application/grpc")
+	res = serveRouter(h, req)
+	assert.Equal("application/grpc", res.Header().Get("Content-Type"))
+	assert.NotEmpty(res.Header().Get("Grpc-Status"))
+	assert.Empty(res.Body.String())
+
+	// Should leave other requests alone
+	req = newHTTPRequest("GET", "http://example.com/foo")
+	res = serveRouter(h, req)
+	assert.Equal(307, res.Code)
+	assert.Empty(res.Header().Get("Grpc-Status"))
+}
+
+func TestGRPCWriter(t *testing.T) {
+	assert := assert.New(t)
+	req := newDefaultHttpRequest("/helloworld.Greeter/SayHello")
+	req.Header.Set("Content-Type", "application/grpc")
+
+	// Should map the status of refused calls
+	res := httptest.NewRecorder()
+	withGRPCResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Service unavailable", 503)
+	})).ServeHTTP(res, req)
+	assert.Equal(503, res.Code)
+	assert.Equal("14", res.Header().Get("Grpc-Status"))
+	assert.Equal("Service unavailable", res.Header().Get("Grpc-Message"))
+
+	// Should send the status of refusals without a body
+	res = httptest.NewRecorder()
+	withGRPCResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(403)
+	})).ServeHTTP(res, req)
+	assert.Equal(403, res.Code)
+	assert.Equal("7", res.Header().Get("Grpc-Status"))
+	assert.Equal("Forbidden", res.Header().Get("Grpc-Message"))
+
+	// Should pass allowed calls through
+	res = httptest.NewRecorder()
+	withGRPCResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Forwarded-User", "grpc@example.com")
+		w.WriteHeader(200)
+	})).ServeHTTP(res, req)
+	assert.Equal(200, res.Code)
+	assert.Empty(res.Header().Get("Grpc-Status"))
+	assert.Equal("grpc@example.com", res.Header().Get("X-Forwarded-User"))
+}
@@ -0,0 +1,141 @@
+package tfa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Identity headers
+//
+// Operators can map fields of the user onto headers passed to backends with
+// "header", in the format header:field. The field is one of email, name,
+// avatar, uuid, roles, groups or claim:<name>. Rules can add mappings of their own
+// with "headers", which are only passed to their backends
+
+type headerMapping struct {
+	header string
+	field  string
+	claim  string
+}
+
+var headerFields = []string{"email", "name", "avatar", "uuid", "roles", "groups"}
+
+// parseHeaderMapping parses a "header" value in the format header:field
+func parseHeaderMapping(spec string) (headerMapping, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return headerMapping{}, fmt.Errorf("invalid header %q, must be in the format header:field", spec)
+	}
+
+	m := headerMapping{
+		header: http.CanonicalHeaderKey(strings.TrimSpace(parts[0])),
+		field:  strings.TrimSpace(parts[1]),
+	}
+	if strings.HasPrefix(m.field, "claim:") {
+		m.claim = strings.TrimSpace(strings.TrimPrefix(m.field, "claim:"))
+		m.field = "claim"
+		if m.claim == "" {
+			return m, fmt.Errorf("invalid header %q, the claim name is missing", spec)
+		}
+		return m, nil
+	}
+	if m.field == "groups" {
+		m.claim = "groups"
+	}
+	if !containsString(headerFields, m.field) {
+		return m, fmt.Errorf("invalid header %q, field must be one of %s or claim:<name>", spec, strings.Join(headerFields, ", "))
+	}
+
+	return m, nil
+}
+
+// headerMappings returns the configured header mappings followed by those of
+// the rule, so the rule's take precedence
+func headerMappings(rule string) []headerMapping {
+	specs := config().Headers
+	if ruleConfig, ok := config().Rules[rule]; ok {
+		specs = append(append([]string{}, specs...), ruleConfig.Headers...)
+	}
+
+	var mappings []headerMapping
+	for _, spec := range specs {
+		if m, err := parseHeaderMapping(spec); err == nil {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings
+}
+
+// headerClaims returns the claims the header mappings of every rule need
+// kept on the session
+func headerClaims() []string {
+	var names []string
+	add := func(mappings []headerMapping) {
+		for _, m := range mappings {
+			if m.claim != "" && !containsString(names, m.claim) {
+				names = append(names, m.claim)
+			}
+		}
+	}
+	add(headerMappings(""))
+	for name := range config().Rules {
+		add(headerMappings(name))
+	}
+	return names
+}
+
+// setIdentityHeaders passes the user to the backend in the X-Forwarded-User
+// header, any headers added by the login script and the headers mapped
+// globally and by the rule, which may replace it. Lists are joined with the
+// "header-separator", objects are passed as JSON
+func setIdentityHeaders(w http.ResponseWriter, user *provider.User, rule string) {
+	w.Header().Set("X-Forwarded-User", user.Email)
+	for name, value := range user.Headers {
+		w.Header().Set(name, value)
+	}
+
+	for _, m := range headerMappings(rule) {
+		var value string
+		switch m.field {
+		case "email":
+			value = user.Email
+		case "name":
+			value = user.Name
+		case "avatar":
+			value = user.Avatar
+		case "uuid":
+			value = user.UUID.String()
+		case "roles":
+			value = strings.Join(user.Roles, config().HeaderSeparator)
+		default:
+			value = formatHeaderClaim(user.Claims[m.claim])
+		}
+
+		if value == "" {
+			w.Header().Del(m.header)
+		} else {
+			w.Header().Set(m.header, value)
+		}
+	}
+}
+
+func formatHeaderClaim(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			items = append(items, formatHeaderClaim(item))
+		}
+		return strings.Join(items, config().HeaderSeparator)
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
@@ -0,0 +1,192 @@
+package tfa
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestHeadersParseMapping(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := parseHeaderMapping("x-auth-email:email")
+	assert.Nil(err)
+	assert.Equal(headerMapping{header: "X-Auth-Email", field: "email"}, m)
+
+	m, err = parseHeaderMapping("X-Auth-Groups:groups")
+	assert.Nil(err)
+	assert.Equal(headerMapping{header: "X-Auth-Groups", field: "groups", claim: "groups"}, m)
+
+	m, err = parseHeaderMapping("X-Auth-Realm-Roles:claim:realm_access.roles")
+	assert.Nil(err)
+	assert.Equal(headerMapping{header: "X-Auth-Realm-Roles", field: "claim", claim: "realm_access.roles"}, m)
+
+	_, err = parseHeaderMapping("X-Auth-Email")
+	if assert.Error(err) {
+		assert.Equal("invalid header \"X-Auth-Email\", must be in the format header:field", err.Error())
+	}
+	_, err = parseHeaderMapping("X-Auth-Phone:phone")
+	if assert.Error(err) {
+		assert.Equal("invalid header \"X-Auth-Phone:phone\", field must be one of email, name, avatar, uuid, roles, groups or claim:<name>", err.Error())
+	}
+	_, err = parseHeaderMapping("X-Auth-Claim:claim:")
+	assert.Error(err)
+}
+
+func TestHeadersSetIdentityHeaders(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Headers = []string{
+		"X-Auth-Email:email",
+		"X-Auth-Name:name",
+		"X-Auth-Uuid:uuid",
+		"X-Auth-Roles:roles",
+		"X-Auth-Groups:groups",
+		"X-Auth-Level:claim:level",
+		"X-Auth-Address:claim:address",
+		"X-Auth-Missing:claim:missing",
+	}
+	config().HeaderSeparator = "; "
+
+	user := &provider.User{
+		UUID:  uuid.MustParse("3f1ad3ba-1fd5-4e39-9e4b-cf2e3bd5e0b4"),
+		Email: "example@example.com",
+		Name:  "Example",
+		Roles: []string{"admin", "dev"},
+		Claims: map[string]interface{}{
+			"groups":  []interface{}{"eng", "ops"},
+			"level":   float64(3),
+			"address": map[string]interface{}{"country": "NL"},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	setIdentityHeaders(w, user, "default")
+	assert.Equal("example@example.com", w.Header().Get("X-Forwarded-User"))
+	assert.Equal("example@example.com", w.Header().Get("X-Auth-Email"))
+	assert.Equal("Example", w.Header().Get("X-Auth-Name"))
+	assert.Equal("3f1ad3ba-1fd5-4e39-9e4b-cf2e3bd5e0b4", w.Header().Get("X-Auth-Uuid"))
+	assert.Equal("admin; dev", w.Header().Get("X-Auth-Roles"))
+	assert.Equal("eng; ops", w.Header().Get("X-Auth-Groups"))
+	assert.Equal("3", w.Header().Get("X-Auth-Level"))
+	assert.Equal(`{"country":"NL"}`, w.Header().Get("X-Auth-Address"))
+	assert.NotContains(w.Header(), "X-Auth-Missing")
+
+	// Should let the default user header be replaced
+	config().Headers = []string{"X-Forwarded-User:uuid"}
+	w = httptest.NewRecorder()
+	setIdentityHeaders(w, user, "default")
+	assert.Equal("3f1ad3ba-1fd5-4e39-9e4b-cf2e3bd5e0b4", w.Header().Get("X-Forwarded-User"))
+}
+
+func TestHeadersRule(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Headers = []string{"X-Auth-Roles:roles"}
+	config().Rules = map[string]*Rule{
+		"admin": {
+			Action:   "auth",
+			Rule:     "Host(`admin.example.com`)",
+			Provider: "google",
+			Headers:  []string{"X-User-Roles:roles", "X-Auth-Roles:email", "X-Auth-Team:claim:team"},
+		},
+	}
+	user := &provider.User{
+		Email:  "example@example.com",
+		Roles:  []string{"admin", "dev"},
+		Claims: map[string]interface{}{"team": "ops"},
+	}
+
+	// Should only add the rule's headers for its requests
+	w := httptest.NewRecorder()
+	setIdentityHeaders(w, user, "admin")
+	assert.Equal("admin,dev", w.Header().Get("X-User-Roles"))
+	assert.Equal("example@example.com", w.Header().Get("X-Auth-Roles"), "should take precedence over global headers")
+	assert.Equal("ops", w.Header().Get("X-Auth-Team"))
+
+	w = httptest.NewRecorder()
+	setIdentityHeaders(w, user, "default")
+	assert.NotContains(w.Header(), "X-User-Roles")
+	assert.NotContains(w.Header(), "X-Auth-Team")
+	assert.Equal("admin,dev", w.Header().Get("X-Auth-Roles"))
+
+	// Should keep the rule's claims on the session
+	assert.Equal([]string{"team"}, headerClaims())
+
+	// Should pass the headers of the matched rule
+	admin := &provider.User{UUID: uuid.New(), Email: "example@example.com", Roles: []string{"admin"}}
+	ensureUser(admin)
+	req := newHTTPRequest("GET", "http://admin.example.com/foo")
+	c, _ := MakeCookie(req, admin)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("admin", res.Header.Get("X-User-Roles"))
+
+	req = newDefaultHttpRequest("/foo")
+	c, _ = MakeCookie(req, admin)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("", res.Header.Get("X-User-Roles"))
+}
+
+func TestHeadersKeepClaims(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Headers = []string{"X-Auth-Groups:groups", "X-Auth-Country:claim:address.country"}
+
+	// Should keep the claims passed in headers on the session
+	user := &provider.User{Claims: map[string]interface{}{
+		"groups":  []interface{}{"eng"},
+		"address": map[string]interface{}{"country": "NL"},
+		"secret":  "value",
+	}}
+	keepCustomClaims(user)
+	assert.Equal(map[string]interface{}{
+		"groups":          []interface{}{"eng"},
+		"address.country": "NL",
+	}, user.Claims)
+}
+
+func TestHeadersConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	c, _ := NewConfig([]string{
+		"--secret=veryveryverysecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--header=X-Auth-Phone:phone",
+	})
+	c.Validate()
+	logs := hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("invalid header \"X-Auth-Phone:phone\", field must be one of email, name, avatar, uuid, roles, groups or claim:<name>", logs[0].Message)
+	}
+
+	// Should validate rule headers
+	hook.Reset()
+	c, _ = NewConfig([]string{
+		"--secret=veryveryverysecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--rule.admin.action=auth",
+		"--rule.admin.rule=Host(`admin.example.com`)",
+		"--rule.admin.headers=X-User-Roles:roles,X-Auth-Phone:phone",
+	})
+	assert.Equal(CommaSeparatedList{"X-User-Roles:roles", "X-Auth-Phone:phone"}, c.Rules["admin"].Headers)
+	c.Validate()
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("invalid header \"X-Auth-Phone:phone\", field must be one of email, name, avatar, uuid, roles, groups or claim:<name>", logs[0].Message)
+	}
+}
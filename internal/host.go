@@ -0,0 +1,52 @@
+package tfa
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Host canonicalization
+//
+// Host headers may arrive in any case, with the trailing dot of a fully
+// qualified name, or with an internationalized domain in unicode rather than
+// punycode. Hosts are canonicalized to lower case ASCII without the trailing
+// dot before rules are matched and cookie domains chosen, and the hosts in
+// rules, "cookie-domain", "auth-host" and "redirect-host" are canonicalized
+// the same way, so each matches whichever form it's written in
+
+// ruleHostArgs finds the hosts given to Host matchers in rules
+var ruleHostArgs = regexp.MustCompile("\\bHost\\(([^)]*)\\)")
+
+// canonicalHost folds the case of the host, drops any trailing dot and
+// converts an internationalized domain to ASCII, keeping any port
+func canonicalHost(host string) string {
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	}
+
+	if ip := net.ParseIP(strings.Trim(name, "[]")); ip != nil {
+		name = strings.ToLower(name)
+	} else {
+		name = normalizeDomain(name)
+	}
+
+	if port != "" {
+		return net.JoinHostPort(strings.Trim(name, "[]"), port)
+	}
+	return name
+}
+
+// canonicalRuleHosts canonicalizes the hosts given to Host matchers in the
+// rule, e.g. Host(`Bücher.example.`) becomes Host(`xn--bcher-kva.example`)
+func canonicalRuleHosts(rule string) string {
+	return ruleHostArgs.ReplaceAllStringFunc(rule, func(matcher string) string {
+		args := strings.Split(matcher[len("Host("):len(matcher)-1], ",")
+		for i, arg := range args {
+			host := strings.Trim(strings.TrimSpace(arg), "`\"")
+			args[i] = "`" + canonicalHost(host) + "`"
+		}
+		return "Host(" + strings.Join(args, ", ") + ")"
+	})
+}
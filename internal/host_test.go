@@ -0,0 +1,62 @@
+package tfa
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestCanonicalHost(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("app.example.com", canonicalHost("App.Example.COM"))
+	assert.Equal("app.example.com", canonicalHost("app.example.com."))
+	assert.Equal("app.example.com:8443", canonicalHost("APP.example.com.:8443"))
+	assert.Equal("xn--bcher-kva.example", canonicalHost("Bücher.example"))
+	assert.Equal("xn--bcher-kva.example:8080", canonicalHost("bücher.example:8080"))
+	assert.Equal("xn--bcher-kva.example", canonicalHost("XN--BCHER-KVA.example"))
+
+	// Should keep addresses as they are
+	assert.Equal("10.0.0.1:4181", canonicalHost("10.0.0.1:4181"))
+	assert.Equal("[::1]:4181", canonicalHost("[::1]:4181"))
+	assert.Equal("[fe80::1]", canonicalHost("[FE80::1]"))
+}
+
+func TestCanonicalRuleHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("Host(`xn--bcher-kva.example`) && PathPrefix(`/API`)", canonicalRuleHosts("Host(`Bücher.example.`) && PathPrefix(`/API`)"))
+	assert.Equal("Host(`one.example.com`, `two.example.com`)", canonicalRuleHosts("Host(`One.example.com`,\"TWO.example.com\")"))
+	assert.Equal("HostRegexp(`{sub:[A-Z]+}.example.com`)", canonicalRuleHosts("HostRegexp(`{sub:[A-Z]+}.example.com`)"), "should leave regexps alone")
+}
+
+func TestServerCanonicalHost(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"shop": {
+			Action: "allow",
+			Rule:   "Host(`Bücher.example.com`)",
+		},
+	}
+	h := NewServer().Handler()
+
+	// Should match rules whatever form the host is sent in
+	for _, host := range []string{"bücher.example.com", "BÜCHER.example.com.", "xn--bcher-kva.example.com", "XN--BCHER-KVA.EXAMPLE.COM"} {
+		req := newHTTPRequest("GET", "http://example.com/")
+		req.Header.Set("X-Forwarded-Host", host)
+		res := serveRouter(h, req)
+		assert.Equal(200, res.Code, host)
+	}
+
+	// Should match the cookie domain whatever form the host is sent in
+	config().CookieDomains = []CookieDomain{*NewCookieDomain("Bücher.example.com")}
+	assert.Equal("xn--bcher-kva.example.com", config().CookieDomains[0].Domain)
+	req := &http.Request{Host: "Shop.BÜCHER.example.com."}
+	assert.Equal("xn--bcher-kva.example.com", cookieDomain(req))
+}
@@ -0,0 +1,138 @@
+package tfa
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Idle timeouts
+//
+// Rules with an "idleTimeout" send users back to log in once their session
+// hasn't been used for that long, even though their cookie is still valid.
+// When a session was last seen is written to the session store in batches,
+// so requests don't each cost a write
+
+// sessionActivityFlushInterval is how often last seen times are written to
+// the session store, other instances see activity up to this late
+const sessionActivityFlushInterval = 30 * time.Second
+
+var sessionActivity = NewActivityTracker()
+
+// ActivityTracker records when sessions were last seen, writing them to the
+// session store at most every flush interval
+type ActivityTracker struct {
+	mu        sync.Mutex
+	seen      map[uuid.UUID]time.Time
+	pending   map[uuid.UUID]time.Time
+	lastFlush time.Time
+}
+
+// NewActivityTracker creates an activity tracker with nothing pending
+func NewActivityTracker() *ActivityTracker {
+	return &ActivityTracker{
+		seen:      make(map[uuid.UUID]time.Time),
+		pending:   make(map[uuid.UUID]time.Time),
+		lastFlush: time.Now(),
+	}
+}
+
+// Touch records that the session was just seen, writing pending times in the
+// background once the flush interval has passed
+func (t *ActivityTracker) Touch(id uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.seen[id] = now
+	t.pending[id] = now
+	if now.Sub(t.lastFlush) >= sessionActivityFlushInterval {
+		go writeLastSeen(t.takePending(now))
+	}
+}
+
+// Flush writes all pending times to the session store
+func (t *ActivityTracker) Flush() {
+	t.mu.Lock()
+	pending := t.takePending(time.Now())
+	t.mu.Unlock()
+
+	writeLastSeen(pending)
+}
+
+// takePending returns the times to write, and forgets sessions idle for
+// longer than any rule allows. Must be called with the lock held
+func (t *ActivityTracker) takePending(now time.Time) map[uuid.UUID]time.Time {
+	pending := t.pending
+	t.pending = make(map[uuid.UUID]time.Time)
+	t.lastFlush = now
+
+	longest := longestIdleTimeout()
+	for id, seen := range t.seen {
+		if now.Sub(seen) > longest {
+			delete(t.seen, id)
+		}
+	}
+	return pending
+}
+
+// LastSeen returns when the session was last seen by this instance
+func (t *ActivityTracker) LastSeen(id uuid.UUID) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.seen[id]
+}
+
+// writeLastSeen updates the last seen time of each session still in the
+// store, without extending how long the session is kept
+func writeLastSeen(pending map[uuid.UUID]time.Time) {
+	for id, seen := range pending {
+		if err := sessions.Touch(id, seen); err != nil {
+			log.WithField("error", err).Warn("Error recording session activity")
+		}
+	}
+}
+
+// longestIdleTimeout returns the longest "idleTimeout" of any rule, activity
+// is only tracked if there is one
+func longestIdleTimeout() time.Duration {
+	var longest time.Duration
+	for _, rule := range config().Rules {
+		if rule.IdleTimeout > longest {
+			longest = rule.IdleTimeout
+		}
+	}
+	return longest
+}
+
+// sessionIdle reports whether the session has been idle for longer than the
+// rule's "idleTimeout"
+func sessionIdle(r *http.Request, ruleName string, id uuid.UUID) (bool, error) {
+	rule, ok := config().Rules[ruleName]
+	if !ok || rule.IdleTimeout <= 0 {
+		return false, nil
+	}
+
+	// Other instances may have seen the session more recently
+	lastSeen := sessionActivity.LastSeen(id)
+	if time.Since(lastSeen) > rule.IdleTimeout {
+		entry, err := sessions.Get(id)
+		if err != nil || entry == nil {
+			return false, err
+		}
+		for _, t := range []time.Time{entry.AddedAt, entry.LastSeenAt} {
+			if t.After(lastSeen) {
+				lastSeen = t
+			}
+		}
+	}
+
+	idle := time.Since(lastSeen) > rule.IdleTimeout
+	if idle {
+		traceCheck(r, "idle", "idle for "+time.Since(lastSeen).Round(time.Second).String())
+	}
+	return idle, nil
+}
@@ -0,0 +1,133 @@
+package tfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestIdleTimeout(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"admin": {
+			Action:      "auth",
+			Rule:        "Host(`admin.example.com`)",
+			Provider:    "google",
+			IdleTimeout: 10 * time.Minute,
+		},
+	}
+	sessions = NewMemorySessionStore()
+	sessionActivity = NewActivityTracker()
+
+	user := &provider.User{UUID: uuid.New(), Email: "test@example.com"}
+	sessions.Put(user.UUID, &UserEntry{User: user, AddedAt: time.Now().Add(-time.Hour)}, time.Hour)
+
+	// Should send users idle for longer than the rule allows to log in
+	req := newHTTPRequest("GET", "http://admin.example.com/foo")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+
+	// Should not apply to other rules
+	req = newDefaultHttpRequest("/foo")
+	c, _ = MakeCookie(req, user)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+
+	// Should count activity seen elsewhere
+	sessionActivity = NewActivityTracker()
+	sessions.Put(user.UUID, &UserEntry{
+		User:       user,
+		AddedAt:    time.Now().Add(-time.Hour),
+		LastSeenAt: time.Now().Add(-5 * time.Minute),
+	}, time.Hour)
+	req = newHTTPRequest("GET", "http://admin.example.com/foo")
+	c, _ = MakeCookie(req, user)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.WithinDuration(time.Now(), sessionActivity.LastSeen(user.UUID), time.Second, "should record the activity")
+}
+
+func TestIdleActivityTracker(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"admin": {Action: "auth", IdleTimeout: 10 * time.Minute},
+	}
+	sessions = NewMemorySessionStore()
+	tracker := NewActivityTracker()
+
+	id := uuid.New()
+	addedAt := time.Now().Add(-time.Hour)
+	sessions.Put(id, &UserEntry{User: &provider.User{UUID: id}, AddedAt: addedAt}, time.Hour)
+
+	// Should only write to the store when flushed
+	tracker.Touch(id)
+	tracker.Touch(uuid.New())
+	entry, _ := sessions.Get(id)
+	assert.True(entry.LastSeenAt.IsZero())
+
+	expires := sessions.(*MemorySessionStore).sessions[id].expires
+	tracker.Flush()
+	entry, _ = sessions.Get(id)
+	require.NotNil(entry)
+	assert.Equal(tracker.LastSeen(id), entry.LastSeenAt)
+	assert.True(addedAt.Equal(entry.AddedAt), "should keep the rest of the session")
+	assert.Equal(expires, sessions.(*MemorySessionStore).sessions[id].expires, "should not extend the session")
+	count, _ := sessions.Count()
+	assert.Equal(1, count, "should not create unknown sessions")
+
+	// Should forget sessions idle for longer than any rule allows
+	tracker.seen[id] = time.Now().Add(-time.Hour)
+	tracker.Flush()
+	assert.True(tracker.LastSeen(id).IsZero())
+}
+
+func TestIdleTimeoutConfig(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	c, err := NewConfig([]string{
+		"--secret=veryveryverysecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--rule.admin.action=allow",
+		"--rule.admin.rule=Host(`admin.example.com`)",
+		"--rule.admin.idleTimeout=15m",
+	})
+	assert.Nil(err)
+	assert.Equal(15*time.Minute, c.Rules["admin"].IdleTimeout)
+	c.Validate()
+	logs := hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("invalid rule idleTimeout, only auth rules have a session to expire", logs[0].Message)
+	}
+
+	// Should need sessions kept on the server
+	hook.Reset()
+	c.Rules["admin"].Action = "auth"
+	c.StatelessCookie = true
+	c.Validate()
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("invalid rule idleTimeout, session activity can't be kept with stateless-cookie", logs[0].Message)
+	}
+
+	_, err = NewConfig([]string{"--rule.admin.idleTimeout=soon"})
+	if assert.Error(err) {
+		assert.Equal("invalid idleTimeout value for rule admin: soon", err.Error())
+	}
+}
@@ -0,0 +1,64 @@
+package tfa
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// Instance identity
+//
+// Each instance reports its ID and a fingerprint of its config in metrics,
+// logs and admin responses, so operators running several replicas can tell
+// which instance made a decision and whether replicas have diverged
+
+var instanceInfo = NewGaugeVec("instance_info",
+	"Identifies the instance and the fingerprint of its config(), always 1", "instance", "config_hash")
+
+func init() {
+	instanceInfo.OnCollect(func() {
+		instanceInfo.Reset()
+		if config() != nil && config().fingerprint != "" {
+			instanceInfo.Set(1, config().InstanceID, config().fingerprint)
+		}
+	})
+}
+
+// Fingerprint returns the hash of the config, calculated during validation
+func (c *Config) Fingerprint() string {
+	return c.fingerprint
+}
+
+// computeFingerprint hashes every option except the instance ID, which is
+// expected to differ between replicas. The secret is included so replicas
+// that can't validate each other's cookies are spotted, other credentials
+// are not
+func (c *Config) computeFingerprint() string {
+	fingerprinted := *c
+	fingerprinted.InstanceID = ""
+	b, _ := json.Marshal(fingerprinted)
+
+	hash := sha256.New()
+	hash.Write(b)
+	hash.Write(c.Secret)
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// defaultInstanceID is the host name, which is unique per replica in most
+// deployments (e.g. the pod name in kubernetes), or a random ID otherwise
+func defaultInstanceID() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return uuid.New().String()[:8]
+}
+
+// setInstanceHeaders identifies the instance and its config in the response
+func setInstanceHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Forward-Auth-Instance", config().InstanceID)
+	w.Header().Set("X-Forward-Auth-Config-Hash", config().fingerprint)
+}
@@ -0,0 +1,70 @@
+package tfa
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestInstanceFingerprint(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	newConfig := func(args ...string) *Config {
+		c, _ := NewConfig(append([]string{
+			"--secret=veryveryverysecret",
+			"--providers.google.client-id=id",
+			"--providers.google.client-secret=secret",
+		}, args...))
+		c.Validate()
+		return c
+	}
+
+	// Should default the instance id to the host name
+	c := newConfig()
+	hostname, _ := os.Hostname()
+	assert.Equal(hostname, c.InstanceID)
+	assert.Len(c.Fingerprint(), 12)
+
+	// Should match replicas with the same config
+	assert.Equal(c.Fingerprint(), newConfig("--instance-id=replica-2").Fingerprint())
+
+	// Should differ when options or the secret differ
+	assert.NotEqual(c.Fingerprint(), newConfig("--lifetime=60").Fingerprint())
+	assert.NotEqual(c.Fingerprint(), newConfig("--rule.1.action=allow", "--rule.1.rule=PathPrefix(`/public`)").Fingerprint())
+	assert.NotEqual(c.Fingerprint(), newConfig("--secret=anotherverysecretvalue").Fingerprint())
+}
+
+func TestInstanceTelemetry(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().InstanceID = "replica-1"
+	config().fingerprint = "0123456789ab"
+	config().AdminToken = "admintoken"
+
+	// Should expose the instance in metrics
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(w.Body.String(), `traefik_forward_auth_instance_info{config_hash="0123456789ab",instance="replica-1"} 1`)
+
+	// Should only expose the current instance
+	config().InstanceID = "replica-2"
+	w = httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.NotContains(w.Body.String(), `instance="replica-1"`)
+
+	// Should identify the instance in admin responses
+	req := httptest.NewRequest("GET", "/admin/sessions", nil)
+	res := serveRouter(NewServer().Handler(), req)
+	assert.Equal(401, res.Code)
+	assert.Equal("replica-2", res.Header().Get("X-Forward-Auth-Instance"))
+	assert.Equal("0123456789ab", res.Header().Get("X-Forward-Auth-Config-Hash"))
+}
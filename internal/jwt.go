@@ -0,0 +1,143 @@
+package tfa
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Downstream JWTs
+
+// JWKSPath is where the public keys for downstream JWTs are served
+const JWKSPath = "/.well-known/jwks.json"
+
+type jwtKey struct {
+	private *ecdsa.PrivateKey
+	id      string
+}
+
+var jwtKeys = struct {
+	sync.Mutex
+	secret string
+	keys   map[int64]*jwtKey
+}{keys: make(map[int64]*jwtKey)}
+
+type downstreamClaims struct {
+	Email string   `json:"email"`
+	Name  string   `json:"name,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// MintJWT creates a signed JWT describing the user for the given audience
+// (the forwarded host), so backends can trust the identity without trusting
+// the network between them and traefik
+func MintJWT(user *provider.User, audience string) (string, error) {
+	now := time.Now()
+	signer, err := jose.NewSigner(activeSigner().JWTKey(now), (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.Claims{
+		Issuer:    config().JWTIssuer,
+		Subject:   user.Email,
+		Audience:  jwt.Audience{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(config().JWTLifetime)),
+	}
+
+	return jwt.Signed(signer).Claims(claims).Claims(downstreamClaims{
+		Email: user.Email,
+		Name:  user.Name,
+		Roles: user.Roles,
+	}).CompactSerialize()
+}
+
+// JWKS returns the public keys that backends should accept
+func JWKS() jose.JSONWebKeySet {
+	return jose.JSONWebKeySet{Keys: activeSigner().JWTPublicKeys(time.Now())}
+}
+
+// JWKSHandler serves the JWKS for downstream JWTs
+func (s *Server) JWKSHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(JWKS())
+	}
+}
+
+// jwtKeyPeriod returns the key rotation period the given time falls in
+func jwtKeyPeriod(t time.Time) int64 {
+	return t.Unix() / int64(config().JWTKeyRotation/time.Second)
+}
+
+// getJWTKey returns the signing key for a rotation period. Keys are derived
+// from the secret, so every instance signs with the same keys and rotates at
+// the same time without any keys having to be distributed
+func getJWTKey(period int64) *jwtKey {
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+
+	if jwtKeys.secret != string(config().Secret) {
+		jwtKeys.secret = string(config().Secret)
+		jwtKeys.keys = make(map[int64]*jwtKey)
+	}
+
+	if key, ok := jwtKeys.keys[period]; ok {
+		return key
+	}
+
+	key := deriveJWTKey(config().Secret, period)
+
+	// Forget keys that can no longer be used
+	for p := range jwtKeys.keys {
+		if p < period-1 {
+			delete(jwtKeys.keys, p)
+		}
+	}
+	jwtKeys.keys[period] = key
+
+	return key
+}
+
+func deriveJWTKey(secret []byte, period int64) *jwtKey {
+	curve := elliptic.P256()
+
+	// Find a valid scalar, in practice the first candidate almost always is
+	var d *big.Int
+	for counter := 0; ; counter++ {
+		mac := hmac.New(sha256.New, secret)
+		fmt.Fprintf(mac, "jwt-key|%d|%d", period, counter)
+		d = new(big.Int).SetBytes(mac.Sum(nil))
+		if d.Sign() > 0 && d.Cmp(curve.Params().N) < 0 {
+			break
+		}
+	}
+
+	private := &ecdsa.PrivateKey{D: d}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+
+	// Use the RFC 7638 thumbprint as the key ID
+	thumbprint, _ := (&jose.JSONWebKey{Key: &private.PublicKey}).Thumbprint(crypto.SHA256)
+
+	return &jwtKey{
+		private: private,
+		id:      base64.RawURLEncoding.EncodeToString(thumbprint),
+	}
+}
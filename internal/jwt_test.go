@@ -0,0 +1,118 @@
+package tfa
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+/**
+ * Tests
+ */
+
+func TestJWTMint(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().JWT = true
+
+	user := &provider.User{
+		Email: "test@example.com",
+		Name:  "Test",
+		Roles: []string{"admin"},
+	}
+	raw, err := MintJWT(user, "app.example.com")
+	require.Nil(err)
+
+	// Should verify against the JWKS
+	token, err := jwt.ParseSigned(raw)
+	require.Nil(err)
+	require.Len(token.Headers, 1)
+	set := JWKS()
+	keys := set.Key(token.Headers[0].KeyID)
+	require.Len(keys, 1)
+
+	var claims jwt.Claims
+	var private downstreamClaims
+	require.Nil(token.Claims(keys[0].Key, &claims, &private))
+	assert.Nil(claims.Validate(jwt.Expected{
+		Issuer:   "traefik-forward-auth",
+		Subject:  "test@example.com",
+		Audience: jwt.Audience{"app.example.com"},
+		Time:     time.Now(),
+	}))
+	assert.Equal(downstreamClaims{Email: "test@example.com", Name: "Test", Roles: []string{"admin"}}, private)
+	assert.WithinDuration(time.Now().Add(5*time.Minute), claims.Expiry.Time(), 5*time.Second)
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Keys should be stable for a period, so all instances agree
+	period := jwtKeyPeriod(time.Now())
+	assert.Equal(deriveJWTKey(config().Secret, period).id, getJWTKey(period).id)
+	assert.Equal(deriveJWTKey(config().Secret, period).private.D, getJWTKey(period).private.D)
+
+	// Keys should differ between periods and secrets
+	assert.NotEqual(getJWTKey(period).id, getJWTKey(period-1).id)
+	assert.NotEqual(deriveJWTKey([]byte("anotherverysecret"), period).id, getJWTKey(period).id)
+
+	// Should publish the previous, active and next keys
+	set := JWKS()
+	assert.Len(set.Keys, 3)
+	for _, p := range []int64{period - 1, period, period + 1} {
+		assert.Len(set.Key(getJWTKey(p).id), 1)
+	}
+	for _, key := range set.Keys {
+		assert.True(key.IsPublic())
+		assert.Equal("ES256", key.Algorithm)
+	}
+
+	// A token minted with the previous key should still verify
+	previous := getJWTKey(period - 1)
+	signer, _ := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       jose.JSONWebKey{Key: previous.private, KeyID: previous.id},
+	}, nil)
+	raw, _ := jwt.Signed(signer).Claims(jwt.Claims{Subject: "test"}).CompactSerialize()
+	token, _ := jwt.ParseSigned(raw)
+	keys := set.Key(token.Headers[0].KeyID)
+	if assert.Len(keys, 1) {
+		var claims jwt.Claims
+		assert.Nil(token.Claims(keys[0].Key, &claims))
+	}
+}
+
+func TestJWTServer(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().JWT = true
+
+	// Should pass a JWT to the backend
+	req := newDefaultHttpRequest("/foo")
+	c, _ := MakeCookie(req, newTestUser("test@example.com"))
+	res, _ := doHttpRequest(req, c)
+	require.Equal(200, res.StatusCode)
+	token, err := jwt.ParseSigned(res.Header.Get("X-Forwarded-Jwt"))
+	require.Nil(err)
+	var claims jwt.Claims
+	require.Nil(token.UnsafeClaimsWithoutVerification(&claims))
+	assert.Equal("example.com", claims.Audience[0])
+
+	// Should serve the JWKS
+	w := httptest.NewRecorder()
+	NewServer().Handler().ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	require.Equal(200, w.Code)
+	var set jose.JSONWebKeySet
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &set))
+	assert.Len(set.Key(token.Headers[0].KeyID), 1)
+}
@@ -0,0 +1,172 @@
+package tfa
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Lifecycle
+//
+// Background workers, such as the consent checker and the session purge, run
+// in the background group until the server is stopped. Stopping first drains
+// the auth callbacks in progress, so users part way through a login aren't
+// left with an error, then cancels the workers and flushes the audit log and
+// traces, giving up on whatever's left when the context expires
+
+// background runs the background workers
+var background = newWorkerGroup()
+
+// workerGroup runs workers until it's stopped
+type workerGroup struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkerGroup() *workerGroup {
+	g := &workerGroup{}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	return g
+}
+
+// Go runs the worker, which should return once its context is cancelled
+func (g *workerGroup) Go(worker func(ctx context.Context)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.wg.Add(1)
+	go func(ctx context.Context) {
+		defer g.wg.Done()
+		worker(ctx)
+	}(g.ctx)
+}
+
+// Stop cancels the workers and waits for them to return, or for ctx to
+// expire. Workers started afterwards run until the next Stop
+func (g *workerGroup) Stop(ctx context.Context) error {
+	g.mu.Lock()
+	g.cancel()
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleepContext waits for d, returning false if ctx is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// inflight counts requests in progress
+type inflight struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func (f *inflight) add() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.n == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.n++
+}
+
+func (f *inflight) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
+	}
+}
+
+// wait waits for the requests in progress to finish, or for ctx to expire
+func (f *inflight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *inflight) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+// Start starts the background workers, which run until Stop is called
+func (s *Server) Start() {
+	startDomainCheck(config(), config().DomainCheckInterval)
+	startSessionCount(activeSessionsInterval)
+	if config().MetricsPort > 0 {
+		startMetricsListener(config().MetricsPort)
+	}
+	if config().ConsentCheckInterval > 0 {
+		startConsentCheck(config().ConsentCheckInterval)
+	}
+	if fallbackCache != nil {
+		fallbackCache.startFlush(identityCacheFlushInterval)
+		startProviderProbes(providerProbeInterval)
+	}
+}
+
+// Stop waits for the auth callbacks in progress, then stops the background
+// workers and flushes the audit log and traces. It returns early if ctx
+// expires, abandoning what's left
+func (s *Server) Stop(ctx context.Context) error {
+	if err := s.callbacks.wait(ctx); err != nil {
+		log.WithField("callbacks", s.callbacks.count()).Warn("Gave up waiting for auth callbacks in progress")
+	}
+
+	err := background.Stop(ctx)
+	if err != nil {
+		log.Warn("Gave up waiting for background workers")
+	}
+
+	if auditLog != nil {
+		auditLog.Close()
+		auditLog = nil
+	}
+	shutdownTracing(ctx)
+	return err
+}
+
+// withInflight counts the requests to next in progress
+func withInflight(f *inflight, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.add()
+		defer f.done()
+		next.ServeHTTP(w, r)
+	})
+}
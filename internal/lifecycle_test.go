@@ -0,0 +1,118 @@
+package tfa
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestWorkerGroupStop(t *testing.T) {
+	assert := assert.New(t)
+	g := newWorkerGroup()
+
+	// Should cancel the workers and wait for them
+	stopped := make(chan struct{})
+	g.Go(func(ctx context.Context) {
+		for sleepContext(ctx, time.Millisecond) {
+		}
+		close(stopped)
+	})
+	assert.Nil(g.Stop(context.Background()))
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("worker still running")
+	}
+
+	// Should give up on workers that don't return
+	release := make(chan struct{})
+	g.Go(func(ctx context.Context) {
+		<-release
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, g.Stop(ctx))
+	close(release)
+
+	// Should run workers started after stopping
+	ran := make(chan struct{})
+	g.Go(func(ctx context.Context) {
+		if sleepContext(ctx, time.Millisecond) {
+			close(ran)
+		}
+	})
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("worker was cancelled")
+	}
+	assert.Nil(g.Stop(context.Background()))
+}
+
+func TestServerStopDrainsCallbacks(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	s := NewServer()
+
+	// Should count callbacks while they're in progress
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	h := withInflight(s.callbacks, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+	go h.ServeHTTP(httptest.NewRecorder(), newDefaultHttpRequest("/_oauth"))
+	<-entered
+	assert.Equal(1, s.callbacks.count())
+
+	// Should give up once the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, s.callbacks.wait(ctx))
+
+	// Should wait for them to finish
+	stopped := make(chan error)
+	go func() {
+		stopped <- s.Stop(context.Background())
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stopped with a callback in progress")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-stopped:
+		assert.Nil(err)
+	case <-time.After(time.Second):
+		t.Fatal("didn't stop once the callback finished")
+	}
+	assert.Equal(0, s.callbacks.count())
+}
+
+func TestServerStartStop(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().DomainCheckInterval = -1
+	config().ConsentCheckInterval = time.Millisecond
+	s := NewServer()
+
+	// Should stop the consent check it starts
+	s.Start()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(s.Stop(context.Background()))
+
+	// Should close the audit log
+	auditLog = &AuditLog{events: make(chan []byte), done: make(chan struct{})}
+	go auditLog.run()
+	assert.Nil(s.Stop(context.Background()))
+	assert.Nil(auditLog)
+}
@@ -15,7 +15,7 @@ func NewDefaultLogger() *logrus.Logger {
 	logrus.SetOutput(os.Stdout)
 
 	// Set logger format
-	switch config.LogFormat {
+	switch config().LogFormat {
 	case "pretty":
 		break
 	case "json":
@@ -29,7 +29,7 @@ func NewDefaultLogger() *logrus.Logger {
 	}
 
 	// Set logger level
-	switch config.LogLevel {
+	switch config().LogLevel {
 	case "trace":
 		logrus.SetLevel(logrus.TraceLevel)
 	case "debug":
@@ -47,5 +47,10 @@ func NewDefaultLogger() *logrus.Logger {
 		logrus.SetLevel(logrus.WarnLevel)
 	}
 
+	// Keep recent entries for the admin UI
+	if config().adminEnabled() {
+		log.AddHook(recentLogs)
+	}
+
 	return log
 }
@@ -0,0 +1,206 @@
+package tfa
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Login script
+//
+// A Starlark script, set with "login-script", defining an on_login function
+// which is called after the code exchange for every login. It's passed the
+// user's claims and the request, and can change the user's roles, add headers
+// passed to backends, or reject the login by returning the reason
+
+// loginScript is set when "login-script" is configured
+var loginScript *LoginScript
+
+// loginScriptMaxSteps bounds the work a single call can do, so a runaway
+// script can't hold up logins
+const loginScriptMaxSteps = 1000000
+
+// LoginScript is a compiled login script
+type LoginScript struct {
+	path    string
+	onLogin starlark.Callable
+}
+
+// LoginRejectedError is returned when the script rejects the login
+type LoginRejectedError struct {
+	Reason string
+}
+
+func (e *LoginRejectedError) Error() string {
+	return fmt.Sprintf("login rejected: %s", e.Reason)
+}
+
+// NewLoginScript loads and compiles the script at the path
+func NewLoginScript(path string) (*LoginScript, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	globals, err := starlark.ExecFile(newLoginScriptThread(path), path, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	onLogin, ok := globals["on_login"].(starlark.Callable)
+	if !ok {
+		return nil, errors.New("the script must define an on_login function")
+	}
+
+	return &LoginScript{
+		path:    path,
+		onLogin: onLogin,
+	}, nil
+}
+
+// Run calls on_login for the user, whose roles and headers are updated from
+// the script. The claims are all those returned by the provider, not just
+// the ones kept on the session
+func (s *LoginScript) Run(r *http.Request, providerName string, user *provider.User, claims map[string]interface{}) error {
+	claimsValue, err := toStarlark(claims)
+	if err != nil {
+		return err
+	}
+	claimsValue.Freeze()
+
+	var roles []starlark.Value
+	for _, role := range user.Roles {
+		roles = append(roles, starlark.String(role))
+	}
+	rolesValue := starlark.NewList(roles)
+	headersValue := starlark.NewDict(0)
+
+	requestHeaders := starlark.NewDict(len(r.Header))
+	for name, values := range r.Header {
+		requestHeaders.SetKey(starlark.String(name), starlark.String(strings.Join(values, ", ")))
+	}
+	requestHeaders.Freeze()
+
+	login := starlarkstruct.FromStringDict(starlark.String("login"), starlark.StringDict{
+		"provider": starlark.String(providerName),
+		"email":    starlark.String(user.Email),
+		"name":     starlark.String(user.Name),
+		"claims":   claimsValue,
+		"roles":    rolesValue,
+		"headers":  headersValue,
+		"request": starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+			"host":        starlark.String(r.Header.Get("X-Forwarded-Host")),
+			"remote_addr": starlark.String(originalClientIP(r)),
+			"headers":     requestHeaders,
+		}),
+	})
+
+	result, err := starlark.Call(newLoginScriptThread(s.path), s.onLogin, starlark.Tuple{login}, nil)
+	if err != nil {
+		return err
+	}
+
+	switch v := result.(type) {
+	case starlark.NoneType:
+	case starlark.String:
+		return &LoginRejectedError{Reason: string(v)}
+	default:
+		return fmt.Errorf("on_login must return None or the reason the login is rejected, got %s", result.Type())
+	}
+
+	newRoles := make([]string, 0, rolesValue.Len())
+	for i := 0; i < rolesValue.Len(); i++ {
+		role, ok := starlark.AsString(rolesValue.Index(i))
+		if !ok {
+			return fmt.Errorf("roles must be strings, got %s", rolesValue.Index(i).Type())
+		}
+		if !containsString(newRoles, role) {
+			newRoles = append(newRoles, role)
+		}
+	}
+
+	var headers map[string]string
+	for _, item := range headersValue.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return fmt.Errorf("header names must be strings, got %s", item[0].Type())
+		}
+		value, ok := starlark.AsString(item[1])
+		if !ok {
+			return fmt.Errorf("header %q must be a string, got %s", name, item[1].Type())
+		}
+		if value == "" {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+
+	user.Roles = newRoles
+	user.Headers = headers
+	return nil
+}
+
+func newLoginScriptThread(path string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: path,
+		Print: func(thread *starlark.Thread, msg string) {
+			log.WithField("script", path).Info(msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(loginScriptMaxSteps)
+	return thread
+}
+
+// toStarlark converts a decoded JSON value to its Starlark equivalent
+func toStarlark(value interface{}) (starlark.Value, error) {
+	switch v := value.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case string:
+		return starlark.String(v), nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	case []interface{}:
+		items := make([]starlark.Value, 0, len(v))
+		for _, item := range v {
+			converted, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, converted)
+		}
+		return starlark.NewList(items), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		dict := starlark.NewDict(len(v))
+		for _, key := range keys {
+			converted, err := toStarlark(v[key])
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(key), converted)
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("unsupported claim type %T", value)
+}
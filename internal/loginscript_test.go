@@ -0,0 +1,210 @@
+package tfa
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func writeLoginScript(t *testing.T, src string) string {
+	path := filepath.Join(t.TempDir(), "login.star")
+	require.Nil(t, ioutil.WriteFile(path, []byte(src), 0600))
+	return path
+}
+
+func TestLoginScriptLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewLoginScript(filepath.Join(t.TempDir(), "missing.star"))
+	assert.Error(err)
+
+	// Should require on_login
+	_, err = NewLoginScript(writeLoginScript(t, "def login(login):\n    pass\n"))
+	if assert.Error(err) {
+		assert.Equal("the script must define an on_login function", err.Error())
+	}
+
+	// Should report syntax errors
+	_, err = NewLoginScript(writeLoginScript(t, "def on_login(login)\n"))
+	assert.Error(err)
+
+	// Should fail validation
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+	defer func() { loginScript = nil }()
+
+	c, _ := NewConfig([]string{
+		"--secret=veryveryverysecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--login-script=" + writeLoginScript(t, "x = 1\n"),
+	})
+	c.Validate()
+	logs := hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("unable to load login-script: the script must define an on_login function", logs[0].Message)
+	}
+}
+
+func TestLoginScriptRun(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+
+	script, err := NewLoginScript(writeLoginScript(t, `
+def on_login(login):
+    if not login.claims.get("email_verified"):
+        return "email not verified for " + login.email
+    if "admins" in login.claims.get("groups", []):
+        login.roles.append("admin")
+    if "guest" in login.roles:
+        login.roles.remove("guest")
+    login.headers["x-auth-org"] = login.claims["org"]["name"]
+    login.headers["X-Auth-Level"] = str(login.claims["level"])
+    login.headers["X-Auth-Via"] = login.provider + " " + login.request.host
+    login.headers["X-Auth-Addr"] = login.request.remote_addr
+    login.headers["X-Auth-Empty"] = ""
+`))
+	require.Nil(err)
+
+	req := newDefaultHttpRequest("/_oauth")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 203.0.113.5")
+	claims := map[string]interface{}{
+		"email_verified": true,
+		"groups":         []interface{}{"admins", "eng"},
+		"org":            map[string]interface{}{"name": "Example"},
+		"level":          float64(3),
+	}
+
+	// Should change the roles and add headers
+	user := &provider.User{Email: "example@example.com", Roles: []string{"guest", "dev"}}
+	err = script.Run(req, "google", user, claims)
+	require.Nil(err)
+	assert.Equal([]string{"dev", "admin"}, user.Roles)
+	assert.Equal(map[string]string{
+		"X-Auth-Org":   "Example",
+		"X-Auth-Level": "3",
+		"X-Auth-Via":   "google example.com",
+		"X-Auth-Addr":  "203.0.113.5",
+	}, user.Headers, "should pass the address traefik saw, not one the client sent")
+
+	// Should reject the login
+	user = &provider.User{Email: "example@example.com"}
+	err = script.Run(req, "google", user, map[string]interface{}{"email_verified": false})
+	if assert.IsType(&LoginRejectedError{}, err) {
+		assert.Equal("email not verified for example@example.com", err.(*LoginRejectedError).Reason)
+	}
+
+	// Should return script errors
+	err = script.Run(req, "google", user, map[string]interface{}{"email_verified": true})
+	if assert.Error(err) {
+		assert.NotContains(err.Error(), "login rejected")
+	}
+}
+
+func TestLoginScriptLimits(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	req := newDefaultHttpRequest("/_oauth")
+
+	// Should not let the script mutate the claims
+	script, err := NewLoginScript(writeLoginScript(t, "def on_login(login):\n    login.claims[\"admin\"] = True\n"))
+	assert.Nil(err)
+	assert.Error(script.Run(req, "google", &provider.User{}, map[string]interface{}{}))
+
+	// Should stop runaway scripts
+	script, err = NewLoginScript(writeLoginScript(t, "def on_login(login):\n    for i in range(10000000):\n        pass\n"))
+	assert.Nil(err)
+	assert.Error(script.Run(req, "google", &provider.User{}, nil))
+
+	// Should require string roles and headers
+	script, err = NewLoginScript(writeLoginScript(t, "def on_login(login):\n    login.roles.append(1)\n"))
+	assert.Nil(err)
+	assert.Error(script.Run(req, "google", &provider.User{}, nil))
+
+	script, err = NewLoginScript(writeLoginScript(t, "def on_login(login):\n    login.headers[\"X-Count\"] = 1\n"))
+	assert.Nil(err)
+	assert.Error(script.Run(req, "google", &provider.User{}, nil))
+
+	script, err = NewLoginScript(writeLoginScript(t, "def on_login(login):\n    return True\n"))
+	assert.Nil(err)
+	assert.Error(script.Run(req, "google", &provider.User{}, nil))
+}
+
+func TestLoginScriptLogin(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	sessions = NewMemorySessionStore()
+	defer func() {
+		loginScript = nil
+		sessions = NewMemorySessionStore()
+	}()
+
+	// Setup OAuth server
+	server, serverURL := NewOAuthServer(t)
+	defer server.Close()
+	config().Providers.Google.TokenURL = &url.URL{
+		Scheme: serverURL.Scheme,
+		Host:   serverURL.Host,
+		Path:   "/token",
+	}
+	config().Providers.Google.UserURL = &url.URL{
+		Scheme: serverURL.Scheme,
+		Host:   serverURL.Host,
+		Path:   "/userinfo",
+	}
+
+	var err error
+	loginScript, err = NewLoginScript(writeLoginScript(t, `
+def on_login(login):
+    if login.claims["hd"] != "example.com":
+        return "wrong hosted domain"
+    login.roles.append("staff")
+    login.headers["X-Hosted-Domain"] = login.claims["hd"]
+`))
+	require.Nil(err)
+
+	// Should apply the script to the session
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	require.Equal(307, res.StatusCode)
+
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == config().CookieName {
+			cookie = c
+		}
+	}
+	require.NotNil(cookie)
+
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, cookie)
+	require.Equal(200, res.StatusCode)
+	assert.Equal("example.com", res.Header.Get("X-Hosted-Domain"))
+
+	// Should reject the login
+	loginScript, err = NewLoginScript(writeLoginScript(t, "def on_login(login):\n    return \"not today\"\n"))
+	require.Nil(err)
+
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode)
+	for _, c := range res.Cookies() {
+		assert.NotEqual(config().CookieName, c.Name)
+	}
+}
@@ -0,0 +1,65 @@
+package tfa
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/containous/traefik/v2/pkg/rules"
+)
+
+// Rule matching
+//
+// Rules match the forwarded request with traefik's rule syntax, e.g.
+// "Host(`app.example.com`) && PathPrefix(`/api`) && Method(`POST`)". When
+// several rules match a request the one with the highest priority applies,
+// which as in traefik defaults to the length of the rule, so more specific
+// rules win over broader ones
+
+// priority returns the rule's priority, the length of the rule unless set
+func (r *Rule) priority() int {
+	if r.Priority > 0 {
+		return r.Priority
+	}
+	return len(r.Rule)
+}
+
+// sortedRuleNames returns the names of the rules in the order they're
+// matched, highest priority first. Rules with the same priority are ordered
+// by name so the order doesn't change between restarts
+func sortedRuleNames(ruleSet map[string]*Rule) []string {
+	names := make([]string, 0, len(ruleSet))
+	for name := range ruleSet {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := ruleSet[names[i]].priority(), ruleSet[names[j]].priority()
+		if pi != pj {
+			return pi > pj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// validateRuleSyntax checks the rule can be parsed, so a typo is reported at
+// startup rather than the rule silently never matching
+func validateRuleSyntax(rule string) error {
+	router, err := rules.NewRouter()
+	if err != nil {
+		return err
+	}
+	return router.AddRoute(rule, 1, http.NotFoundHandler())
+}
+
+// addRuleRoutes adds a route for each rule, in priority order, to the router
+func addRuleRoutes(router *rules.Router, ruleSet map[string]*Rule, handler func(name string, rule *Rule) http.Handler) error {
+	for _, name := range sortedRuleNames(ruleSet) {
+		rule := ruleSet[name]
+		if err := router.AddRoute(rule.formattedRule(), rule.priority(), handler(name, rule)); err != nil {
+			return fmt.Errorf("rule %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package tfa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestMatcherSortedRuleNames(t *testing.T) {
+	assert := assert.New(t)
+
+	ruleSet := map[string]*Rule{
+		"broad":    {Rule: "Host(`app.example.com`)"},
+		"specific": {Rule: "Host(`app.example.com`) && PathPrefix(`/api`)"},
+		"b":        {Rule: "Path(`/b`)"},
+		"a":        {Rule: "Path(`/a`)"},
+	}
+	assert.Equal([]string{"specific", "broad", "a", "b"}, sortedRuleNames(ruleSet))
+
+	// Should put rules with a priority set first
+	ruleSet["a"].Priority = 100
+	assert.Equal([]string{"a", "specific", "broad", "b"}, sortedRuleNames(ruleSet))
+}
+
+func TestMatcherValidateRuleSyntax(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(validateRuleSyntax("Host(`app.example.com`) && (Method(`POST`) || Headers(`X-Api`, `1`))"))
+	assert.Error(validateRuleSyntax("Hots(`app.example.com`)"))
+	assert.Error(validateRuleSyntax("Host(`app.example.com`) &&"))
+
+	c, _ := NewConfig([]string{})
+	rule := NewRule()
+	rule.Rule = "PathPrefix(`/api`"
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Contains(err.Error(), "invalid rule rule, ")
+	}
+
+	rule = NewRule()
+	rule.Priority = -1
+	if err := rule.Validate(c); assert.Error(err) {
+		assert.Equal("invalid rule priority, must not be negative", err.Error())
+	}
+}
+
+func TestServerRuleMatching(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"app": {
+			Action:   "auth",
+			Rule:     "Host(`app.example.com`)",
+			Provider: "google",
+		},
+		"public": {
+			Action: "allow",
+			Rule:   "Host(`app.example.com`) && PathPrefix(`/public`)",
+		},
+		"reads": {
+			Action: "allow",
+			Rule:   "Host(`api.example.com`) && Method(`GET`, `HEAD`)",
+		},
+		"hooks": {
+			Action: "allow",
+			Rule:   "Host(`api.example.com`) && Headers(`X-Hook`, `deploy`)",
+		},
+	}
+
+	// Should apply the more specific rule where rules overlap
+	res, _ := doHttpRequest(newHTTPRequest("GET", "https://app.example.com/public/page"), nil)
+	assert.Equal(200, res.StatusCode)
+	res, _ = doHttpRequest(newHTTPRequest("GET", "https://app.example.com/private"), nil)
+	assert.Equal(307, res.StatusCode)
+
+	// Should match the method of the forwarded request
+	res, _ = doHttpRequest(newHTTPRequest("GET", "https://api.example.com/items"), nil)
+	assert.Equal(200, res.StatusCode)
+	res, _ = doHttpRequest(newHTTPRequest("POST", "https://api.example.com/items"), nil)
+	assert.Equal(401, res.StatusCode)
+
+	// Should match headers of the forwarded request
+	req := newHTTPRequest("POST", "https://api.example.com/items")
+	req.Header.Set("X-Hook", "deploy")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+
+	// Should let a priority override the default order
+	config().Rules["app"].Priority = 1000
+	res, _ = doHttpRequest(newHTTPRequest("GET", "https://app.example.com/public/page"), nil)
+	assert.Equal(307, res.StatusCode)
+}
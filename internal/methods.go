@@ -0,0 +1,73 @@
+package tfa
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Method restrictions
+//
+// Rules with "methods" only let users make requests with the HTTP methods
+// granted to one of their roles, e.g. viewers may GET while editors may also
+// POST, PUT and DELETE. This write-protects backends that have no access
+// control of their own, before the request reaches them
+
+// methodGrant is a "methods" value, the methods a role may use
+type methodGrant struct {
+	role    string
+	methods []string
+}
+
+// parseMethodGrant parses a "methods" value in the format role:METHOD|METHOD,
+// "*" grants every role or every method
+func parseMethodGrant(spec string) (methodGrant, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return methodGrant{}, fmt.Errorf("invalid rule methods %q, must be in the format role:METHOD|METHOD", spec)
+	}
+
+	g := methodGrant{role: strings.TrimSpace(parts[0])}
+	for _, method := range strings.Split(parts[1], "|") {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" {
+			continue
+		}
+		if method != "*" && strings.IndexFunc(method, func(c rune) bool { return c < 'A' || c > 'Z' }) >= 0 {
+			return g, fmt.Errorf("invalid rule methods %q, %q is not a method", spec, method)
+		}
+		g.methods = append(g.methods, method)
+	}
+	if len(g.methods) == 0 {
+		return g, fmt.Errorf("invalid rule methods %q, no methods given", spec)
+	}
+
+	return g, nil
+}
+
+// ValidateMethod checks one of the user's roles is granted the method by the
+// rule, rules without methods permit every method. GET also grants HEAD
+func ValidateMethod(user *provider.User, ruleName, method string) bool {
+	rule, ok := config().Rules[ruleName]
+	if !ok || len(rule.Methods) == 0 {
+		return true
+	}
+
+	method = strings.ToUpper(method)
+	for _, spec := range rule.Methods {
+		g, err := parseMethodGrant(spec)
+		if err != nil {
+			continue
+		}
+		if g.role != "*" && !containsString(user.Roles, g.role) {
+			continue
+		}
+		for _, m := range g.methods {
+			if m == "*" || m == method || (m == "GET" && method == "HEAD") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package tfa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestValidateMethod(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"app": {
+			Action:  "auth",
+			Methods: CommaSeparatedList{"viewer:GET", "editor:get|post|PUT|DELETE", "*:OPTIONS"},
+		},
+		"admin": {
+			Action:  "auth",
+			Methods: CommaSeparatedList{"admin:*"},
+		},
+	}
+
+	viewer := &provider.User{Email: "test@example.com", Roles: []string{"viewer"}}
+	editor := &provider.User{Email: "test@example.com", Roles: []string{"viewer", "editor"}}
+	none := &provider.User{Email: "test@example.com"}
+
+	// Should only permit the methods granted to the user's roles
+	assert.True(ValidateMethod(viewer, "app", "GET"))
+	assert.True(ValidateMethod(viewer, "app", "HEAD"), "GET should grant HEAD")
+	assert.False(ValidateMethod(viewer, "app", "POST"))
+	assert.True(ValidateMethod(editor, "app", "POST"))
+	assert.True(ValidateMethod(editor, "app", "delete"))
+	assert.False(ValidateMethod(editor, "app", "PATCH"))
+
+	// Should grant every role with *
+	assert.True(ValidateMethod(none, "app", "OPTIONS"))
+	assert.False(ValidateMethod(none, "app", "GET"))
+
+	// Should grant every method with *
+	admin := &provider.User{Roles: []string{"admin"}}
+	assert.True(ValidateMethod(admin, "admin", "PATCH"))
+	assert.False(ValidateMethod(editor, "admin", "GET"))
+
+	// Should not apply to other rules
+	assert.True(ValidateMethod(none, "default", "POST"))
+}
+
+func TestServerMethods(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"app": {
+			Action:   "auth",
+			Rule:     "Host(`app.example.com`)",
+			Provider: "google",
+			Methods:  CommaSeparatedList{"viewer:GET", "editor:GET|POST"},
+		},
+	}
+
+	viewer := newTestUser("viewer@example.com")
+	viewer.Roles = []string{"viewer"}
+	editor := newTestUser("editor@example.com")
+	editor.Roles = []string{"editor"}
+
+	// Should permit the methods granted to the user's roles
+	req := newHTTPRequest("GET", "https://app.example.com/foo")
+	c, _ := MakeCookie(req, viewer)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+
+	req = newHTTPRequest("POST", "https://app.example.com/foo")
+	c, _ = MakeCookie(req, editor)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+
+	// Should forbid other methods
+	req = newHTTPRequest("POST", "https://app.example.com/foo")
+	c, _ = MakeCookie(req, viewer)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode)
+
+	// Should not apply to other rules
+	req = newHTTPRequest("POST", "https://example.com/foo")
+	c, _ = MakeCookie(req, viewer)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+}
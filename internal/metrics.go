@@ -0,0 +1,391 @@
+package tfa
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metrics are collected with the prometheus client and served in the
+// prometheus text format, along with the Go runtime and process metrics
+
+const metricsNamespace = "traefik_forward_auth"
+
+// metrics is the registry served by the metrics handler
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(collectors.NewGoCollector())
+	r.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return r
+}
+
+// metricsHandler serves the registry, requiring the "metrics-token" as a
+// bearer token when it's set
+func metricsHandler() http.Handler {
+	handler := promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := config().MetricsToken; token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// startMetricsListener serves the metrics on the "metrics-port", rather than
+// alongside the auth endpoints, until the background workers are stopped
+func startMetricsListener(port int) {
+	srv := &http.Server{
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           metricsListenerHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	background.Go(func(ctx context.Context) {
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		log.Infof("Serving metrics on :%d", port)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.WithField("error", err).Error("Error serving metrics")
+		}
+	})
+}
+
+// metricsListenerHandler only serves /metrics
+func metricsListenerHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	return mux
+}
+
+// metricValue reads the current value of a series
+func metricValue(m prometheus.Metric) *dto.Metric {
+	var value dto.Metric
+	m.Write(&value)
+	return &value
+}
+
+// CounterVec is a monotonically increasing metric partitioned by labels
+type CounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+// NewCounterVec creates and registers a new counter
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      name,
+		Help:      help,
+	}, labels)}
+	metrics.MustRegister(c.vec)
+	return c
+}
+
+// Inc increments the counter for the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Inc()
+}
+
+// Add adds the given value to the counter for the given label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Add(v)
+}
+
+// Value returns the current value for the given label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	return metricValue(c.vec.WithLabelValues(labelValues...)).GetCounter().GetValue()
+}
+
+// GaugeVec is a metric that can go up and down, partitioned by labels
+type GaugeVec struct {
+	vec *prometheus.GaugeVec
+
+	mu      sync.Mutex
+	collect func()
+}
+
+// NewGaugeVec creates and registers a new gauge
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      name,
+		Help:      help,
+	}, labels)}
+	metrics.MustRegister(g)
+	return g
+}
+
+// OnCollect registers a function run before every scrape, used to update
+// gauges derived from other state
+func (g *GaugeVec) OnCollect(fn func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.collect = fn
+}
+
+// Describe implements prometheus.Collector
+func (g *GaugeVec) Describe(ch chan<- *prometheus.Desc) {
+	g.vec.Describe(ch)
+}
+
+// Collect implements prometheus.Collector, running the OnCollect function
+// first
+func (g *GaugeVec) Collect(ch chan<- prometheus.Metric) {
+	g.mu.Lock()
+	collect := g.collect
+	g.mu.Unlock()
+	if collect != nil {
+		collect()
+	}
+	g.vec.Collect(ch)
+}
+
+// Set sets the gauge for the given label values
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Set(v)
+}
+
+// Add adds the given (possibly negative) value to the gauge
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Add(v)
+}
+
+// Value returns the current value for the given label values
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	return metricValue(g.vec.WithLabelValues(labelValues...)).GetGauge().GetValue()
+}
+
+// Reset removes all series
+func (g *GaugeVec) Reset() {
+	g.vec.Reset()
+}
+
+// HistogramVec samples observations into buckets, partitioned by labels
+type HistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+// latencyBuckets are the default buckets used for request latencies
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// NewHistogramVec creates and registers a new histogram
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	}, labels)}
+	metrics.MustRegister(h.vec)
+	return h
+}
+
+// Observe adds an observation for the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(v)
+}
+
+// Count returns the number of observations for the given label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	series := h.vec.WithLabelValues(labelValues...).(prometheus.Metric)
+	return metricValue(series).GetHistogram().GetSampleCount()
+}
+
+// Decision metrics
+
+var (
+	authDecisionsTotal = NewCounterVec("auth_decisions_total",
+		"Forward auth decisions: allow, deny, login (the user was sent to log in) or error", "rule", "decision")
+	cookieValidationErrorsTotal = NewCounterVec("cookie_validation_errors_total",
+		"Auth cookies that were refused, by reason", "reason")
+	activeSessions = NewGaugeVec("active_sessions",
+		"Sessions held in the session store")
+)
+
+// activeSessionsInterval is how often the sessions are counted, rather than
+// on every scrape, as counting scans the whole redis or sql session store
+const activeSessionsInterval = time.Minute
+
+// startSessionCount counts the sessions on startup and then every interval,
+// until the background workers are stopped
+func startSessionCount(interval time.Duration) {
+	background.Go(func(ctx context.Context) {
+		countSessions()
+		for sleepContext(ctx, interval) {
+			countSessions()
+		}
+	})
+}
+
+// countSessions updates the active_sessions gauge
+func countSessions() {
+	count, err := sessions.Count()
+	if err != nil {
+		log.WithField("error", err).Warn("Error counting sessions")
+		return
+	}
+	activeSessions.Set(float64(count))
+}
+
+// cookieErrorReason classifies the error returned when validating a cookie
+func cookieErrorReason(err error) string {
+	switch err.Error() {
+	case "Cookie has expired":
+		return "expired"
+	case "user is unknown":
+		return "unknown_session"
+	case "Invalid cookie mac":
+		return "invalid_mac"
+	case "Invalid cookie format", "Unable to decode cookie mac", "Unable to parse cookie expiry":
+		return "invalid_format"
+	}
+	return "error"
+}
+
+// Provider metrics
+
+var (
+	providerRequestDuration = NewHistogramVec("provider_request_duration_seconds",
+		"Latency of requests made to the provider", latencyBuckets, "provider", "operation")
+	providerRequestsTotal = NewCounterVec("provider_requests_total",
+		"Requests made to the provider", "provider", "operation", "result")
+	providerSLOEventsTotal = NewCounterVec("provider_slo_events_total",
+		"Provider requests counted towards the provider SLO", "provider")
+	providerSLOBadEventsTotal = NewCounterVec("provider_slo_bad_events_total",
+		"Provider requests that failed or exceeded the provider-latency-objective", "provider")
+	providerSLOBurnRate = NewGaugeVec("provider_slo_burn_rate",
+		"Rate at which the provider SLO error budget is being consumed, 1 means the budget will be exactly exhausted", "provider", "window")
+	loginsTotal = NewCounterVec("logins_total",
+		"Completed login attempts", "provider", "result")
+)
+
+// sloWindows are the burn rate windows exposed, commonly paired as fast
+// (5m/1h) and slow (30m/6h) burn alerts
+var sloWindows = map[string]time.Duration{
+	"5m":  5 * time.Minute,
+	"30m": 30 * time.Minute,
+	"1h":  time.Hour,
+	"6h":  6 * time.Hour,
+}
+
+var providerSLO = newSLOTracker(6 * time.Hour)
+
+func init() {
+	providerSLOBurnRate.OnCollect(func() {
+		providerSLO.updateBurnRates(time.Now())
+	})
+}
+
+// observeProviderRequest records the outcome and latency of a request made to
+// the provider, counting it against the provider SLO
+func observeProviderRequest(providerName, operation string, start time.Time, err error) {
+	d := time.Since(start)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+
+	providerRequestDuration.Observe(d.Seconds(), providerName, operation)
+	providerRequestsTotal.Inc(providerName, operation, result)
+
+	bad := err != nil || (config().ProviderLatencyObjective > 0 && d > config().ProviderLatencyObjective)
+	providerSLOEventsTotal.Inc(providerName)
+	if bad {
+		providerSLOBadEventsTotal.Inc(providerName)
+	}
+	providerSLO.record(providerName, time.Now(), bad)
+}
+
+// sloTracker counts good and bad events per minute in a ring buffer so burn
+// rates can be calculated over sliding windows
+type sloTracker struct {
+	mu      sync.Mutex
+	size    int64
+	windows map[string][]sloBucket
+}
+
+type sloBucket struct {
+	minute int64
+	total  uint64
+	bad    uint64
+}
+
+func newSLOTracker(retention time.Duration) *sloTracker {
+	return &sloTracker{
+		size:    int64(retention / time.Minute),
+		windows: make(map[string][]sloBucket),
+	}
+}
+
+func (s *sloTracker) record(name string, now time.Time, bad bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets, ok := s.windows[name]
+	if !ok {
+		buckets = make([]sloBucket, s.size)
+		s.windows[name] = buckets
+	}
+
+	minute := now.Unix() / 60
+	b := &buckets[minute%s.size]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+}
+
+// burnRate returns the error budget burn rate over the given window
+func (s *sloTracker) burnRate(name string, now time.Time, window time.Duration, target float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total, bad uint64
+	minute := now.Unix() / 60
+	oldest := minute - int64(window/time.Minute)
+	for _, b := range s.windows[name] {
+		if b.minute > oldest && b.minute <= minute {
+			total += b.total
+			bad += b.bad
+		}
+	}
+
+	if total == 0 || target >= 1 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / (1 - target)
+}
+
+func (s *sloTracker) updateBurnRates(now time.Time) {
+	s.mu.Lock()
+	var names []string
+	for name := range s.windows {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+
+	for _, name := range names {
+		for label, window := range sloWindows {
+			providerSLOBurnRate.Set(s.burnRate(name, now, window, config().ProviderSLOTarget), name, label)
+		}
+	}
+}
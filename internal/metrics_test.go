@@ -0,0 +1,219 @@
+package tfa
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestMetricsFormat(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics
+	metrics = prometheus.NewRegistry()
+	defer func() { metrics = registry }()
+
+	c := NewCounterVec("test_total", "Test counter", "label")
+	c.Inc("a")
+	c.Add(2, "b\"quoted\"")
+	g := NewGaugeVec("test_gauge", "Test gauge")
+	g.Set(1.5)
+	h := NewHistogramVec("test_seconds", "Test histogram", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "x")
+	h.Observe(0.5, "x")
+	assert.Equal(3.0, c.Value("a")+c.Value("b\"quoted\""))
+	assert.Equal(1.5, g.Value())
+	assert.Equal(uint64(2), h.Count("x"))
+
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal("text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(`# HELP traefik_forward_auth_test_gauge Test gauge
+# TYPE traefik_forward_auth_test_gauge gauge
+traefik_forward_auth_test_gauge 1.5
+# HELP traefik_forward_auth_test_seconds Test histogram
+# TYPE traefik_forward_auth_test_seconds histogram
+traefik_forward_auth_test_seconds_bucket{op="x",le="0.1"} 1
+traefik_forward_auth_test_seconds_bucket{op="x",le="1"} 2
+traefik_forward_auth_test_seconds_bucket{op="x",le="+Inf"} 2
+traefik_forward_auth_test_seconds_sum{op="x"} 0.55
+traefik_forward_auth_test_seconds_count{op="x"} 2
+# HELP traefik_forward_auth_test_total Test counter
+# TYPE traefik_forward_auth_test_total counter
+traefik_forward_auth_test_total{label="a"} 1
+traefik_forward_auth_test_total{label="b\"quoted\""} 2
+`, w.Body.String())
+}
+
+func TestMetricsToken(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should serve the runtime metrics too
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), "go_goroutines")
+
+	// Should require the token when set
+	config().MetricsToken = "scrape"
+	w = httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(401, w.Code)
+	assert.NotContains(w.Body.String(), "go_goroutines")
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, req)
+	assert.Equal(401, w.Code)
+
+	req.Header.Set("Authorization", "Bearer scrape")
+	w = httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, req)
+	assert.Equal(200, w.Code)
+}
+
+func TestMetricsPort(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should serve metrics with the auth endpoints by default
+	w := httptest.NewRecorder()
+	NewServer().Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), "traefik_forward_auth_")
+
+	// Should only serve metrics on the metrics-port when set
+	config().MetricsPort = 9090
+	w = httptest.NewRecorder()
+	NewServer().Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.NotContains(w.Body.String(), "traefik_forward_auth_")
+
+	w = httptest.NewRecorder()
+	metricsListenerHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), "traefik_forward_auth_")
+	w = httptest.NewRecorder()
+	metricsListenerHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(404, w.Code, "should only serve metrics")
+}
+
+func TestMetricsSLOBurnRate(t *testing.T) {
+	assert := assert.New(t)
+	s := newSLOTracker(time.Hour)
+	now := time.Unix(1600000000, 0)
+
+	// No events shouldn't burn any budget
+	assert.Equal(0.0, s.burnRate("p", now, 5*time.Minute, 0.99))
+
+	// 1 in 10 bad events against a 99% target burns budget 10x too fast
+	for i := 0; i < 9; i++ {
+		s.record("p", now, false)
+	}
+	s.record("p", now, true)
+	assert.InDelta(10.0, s.burnRate("p", now, 5*time.Minute, 0.99), 0.0001)
+
+	// Events should fall out of the window
+	later := now.Add(10 * time.Minute)
+	s.record("p", later, false)
+	assert.Equal(0.0, s.burnRate("p", later, 5*time.Minute, 0.99))
+	assert.InDelta(100.0/11.0, s.burnRate("p", later, time.Hour, 0.99), 0.0001)
+
+	// Ring buffer should not count stale buckets from a previous lap
+	assert.Equal(0.0, s.burnRate("p", now.Add(time.Hour), time.Hour, 0.99))
+}
+
+func TestMetricsProviderCallback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+
+	// Setup OAuth server
+	server, serverURL := NewOAuthServer(t)
+	defer server.Close()
+	config().Providers.Google.TokenURL = &url.URL{
+		Scheme: serverURL.Scheme,
+		Host:   serverURL.Host,
+		Path:   "/token",
+	}
+	config().Providers.Google.UserURL = &url.URL{
+		Scheme: serverURL.Scheme,
+		Host:   serverURL.Host,
+		Path:   "/userinfo",
+	}
+
+	logins := loginsTotal.Value("google", "success")
+	exchanges := providerRequestDuration.Count("google", "token_exchange")
+
+	// Should record successful login
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	require.Equal(307, res.StatusCode)
+
+	assert.Equal(logins+1, loginsTotal.Value("google", "success"))
+	assert.Equal(exchanges+1, providerRequestDuration.Count("google", "token_exchange"))
+}
+
+func TestMetricsDecisions(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	sessions = NewMemorySessionStore()
+	defer func() { sessions = NewMemorySessionStore() }()
+
+	allowed := authDecisionsTotal.Value("default", "allow")
+	logins := authDecisionsTotal.Value("default", "login")
+	denied := authDecisionsTotal.Value("default", "deny")
+	invalid := cookieValidationErrorsTotal.Value("invalid_mac")
+
+	// Should count requests sent to log in
+	req := newDefaultHttpRequest("/foo")
+	doHttpRequest(req, nil)
+	assert.Equal(logins+1, authDecisionsTotal.Value("default", "login"))
+
+	// Should count allowed requests
+	user := newTestUser("metrics@example.com")
+	req = newDefaultHttpRequest("/foo")
+	c, _ := MakeCookie(req, user)
+	doHttpRequest(req, c)
+	assert.Equal(allowed+1, authDecisionsTotal.Value("default", "allow"))
+
+	// Should count refused cookies
+	parts := strings.Split(c.Value, "|")
+	c.Value = parts[0] + "|" + parts[1] + "0|" + parts[2]
+	req = newDefaultHttpRequest("/foo")
+	doHttpRequest(req, c)
+	assert.Equal(denied+1, authDecisionsTotal.Value("default", "deny"))
+	assert.Equal(invalid+1, cookieValidationErrorsTotal.Value("invalid_mac"))
+
+	// Should expose the number of sessions, once counted
+	countSessions()
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(w.Body.String(), "traefik_forward_auth_active_sessions 1\n")
+	newTestUser("metrics-other@example.com")
+	w = httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(w.Body.String(), "traefik_forward_auth_active_sessions 1\n", "should not count the sessions on every scrape")
+}
+
+func TestMetricsCookieErrorReason(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("expired", cookieErrorReason(errors.New("Cookie has expired")))
+	assert.Equal("unknown_session", cookieErrorReason(errors.New("user is unknown")))
+	assert.Equal("invalid_mac", cookieErrorReason(errors.New("Invalid cookie mac")))
+	assert.Equal("invalid_format", cookieErrorReason(errors.New("Invalid cookie format")))
+	assert.Equal("error", cookieErrorReason(errors.New("unable to load session: EOF")))
+}
@@ -0,0 +1,381 @@
+package tfa
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Schema migrations
+//
+// Each persistent store records the version of its schema. When a release
+// changes a schema it adds a migration, which is applied when the store is
+// next loaded (or by the migrate command), so existing data keeps working
+
+// Migration upgrades a store's data from the previous version to Version
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(data map[string]interface{}) error
+}
+
+// schemaStore reads and writes a store's data as a generic document, so
+// migrations don't depend on how the store is encoded
+type schemaStore interface {
+	name() string
+	file() string
+	read() (map[string]interface{}, error)
+	write(data map[string]interface{}) error
+}
+
+// schemaVersionKey is the key the schema version is stored under
+const schemaVersionKey = "schema_version"
+
+// Stores
+
+// userDirectoryMigrations upgrade the "user-directory"
+var userDirectoryMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "Normalise emails to lower case, merging duplicate users",
+		Up: func(data map[string]interface{}) error {
+			users, _ := data["users"].(map[string]interface{})
+			normalised := make(map[string]interface{})
+			for email, entry := range users {
+				key := strings.ToLower(strings.TrimSpace(email))
+				existing, ok := normalised[key].(map[string]interface{})
+				current, _ := entry.(map[string]interface{})
+				if !ok || current == nil {
+					normalised[key] = entry
+					continue
+				}
+
+				// Merge the roles of duplicate users
+				var roles []string
+				for _, e := range []map[string]interface{}{existing, current} {
+					list, _ := e["roles"].([]interface{})
+					for _, role := range list {
+						if s, ok := role.(string); ok {
+							roles = append(roles, s)
+						}
+					}
+				}
+				existing["roles"] = sortedUnique(roles)
+			}
+			data["users"] = normalised
+			return nil
+		},
+	},
+}
+
+// identityCacheMigrations upgrade the "fallback-cache"
+var identityCacheMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "Record schema version",
+		Up:          func(data map[string]interface{}) error { return nil },
+	},
+	{
+		Version:     2,
+		Description: "Record when each session was last seen",
+		Up: func(data map[string]interface{}) error {
+			identities, _ := data["identities"].(map[string]interface{})
+			sessions, _ := data["sessions"].(map[string]interface{})
+			for id, value := range sessions {
+				email, ok := value.(string)
+				if !ok {
+					continue
+				}
+
+				// Sessions are as old as the user's last login
+				identity, ok := identities[email].(map[string]interface{})
+				if !ok {
+					delete(sessions, id)
+					continue
+				}
+				sessions[id] = map[string]interface{}{
+					"email":     email,
+					"last_seen": identity["last_seen"],
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// userTagsMigrations upgrade the "user-tags"
+var userTagsMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "Record schema version",
+		Up:          func(data map[string]interface{}) error { return nil },
+	},
+}
+
+// roleGrantsMigrations upgrade the "role-grants"
+var roleGrantsMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "Record schema version",
+		Up:          func(data map[string]interface{}) error { return nil },
+	},
+}
+
+// latestVersion returns the version the migrations upgrade to
+func latestVersion(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrateStores applies any pending migrations to the configured stores,
+// when dryRun is set the pending migrations are only reported
+func MigrateStores(c *Config, dryRun bool, w io.Writer) error {
+	type target struct {
+		store      schemaStore
+		migrations []Migration
+	}
+
+	var targets []target
+	if c.UserDirectory != "" {
+		targets = append(targets, target{&userDirectoryStore{c.UserDirectory}, userDirectoryMigrations})
+	}
+	if c.UserTags != "" {
+		targets = append(targets, target{&userTagsStore{userDirectoryStore{c.UserTags}}, userTagsMigrations})
+	}
+	if c.RoleGrants != "" {
+		targets = append(targets, target{&roleGrantsStore{userDirectoryStore{c.RoleGrants}}, roleGrantsMigrations})
+	}
+	if c.FallbackCache != "" {
+		targets = append(targets, target{&identityCacheStore{c.FallbackCache, c.Secret, c.previousSecrets}, identityCacheMigrations})
+	}
+
+	if len(targets) == 0 {
+		fmt.Fprintln(w, "No persistent stores are configured")
+		return nil
+	}
+
+	for _, t := range targets {
+		applied, err := migrate(t.store, t.migrations, dryRun)
+		if err != nil {
+			return fmt.Errorf("%s: %v", t.store.name(), err)
+		}
+		if len(applied) == 0 {
+			fmt.Fprintf(w, "%s: up to date\n", t.store.name())
+		}
+		for _, m := range applied {
+			if dryRun {
+				fmt.Fprintf(w, "%s: would apply %d: %s\n", t.store.name(), m.Version, m.Description)
+			} else {
+				fmt.Fprintf(w, "%s: applied %d: %s\n", t.store.name(), m.Version, m.Description)
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrate applies the migrations the store hasn't had yet, in order, keeping a
+// backup of the data from before the migration. Data written by a newer
+// release is refused, as it can't safely be read
+func migrate(store schemaStore, migrations []Migration, dryRun bool) ([]Migration, error) {
+	if _, err := os.Stat(store.file()); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	data, err := store.read()
+	if err != nil {
+		return nil, err
+	}
+
+	version := schemaVersion(data)
+	latest := latestVersion(migrations)
+	if version > latest {
+		return nil, fmt.Errorf("schema version %d is newer than this release supports (%d), upgrade traefik-forward-auth", version, latest)
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 || dryRun {
+		return pending, nil
+	}
+
+	if err := backupStore(store, version); err != nil {
+		return nil, fmt.Errorf("unable to back up before migrating: %v", err)
+	}
+
+	for _, m := range pending {
+		if err := m.Up(data); err != nil {
+			return nil, fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		data[schemaVersionKey] = m.Version
+	}
+
+	if err := store.write(data); err != nil {
+		return nil, err
+	}
+
+	for _, m := range pending {
+		log.WithFields(logrus.Fields{
+			"store":       store.name(),
+			"version":     m.Version,
+			"description": m.Description,
+		}).Warn("Applied migration")
+	}
+
+	return pending, nil
+}
+
+func schemaVersion(data map[string]interface{}) int {
+	version, _ := data[schemaVersionKey].(float64)
+	return int(version)
+}
+
+// backupStore copies the store's file alongside it, e.g. users.json.v0.bak
+func backupStore(store schemaStore, version int) error {
+	b, err := ioutil.ReadFile(store.file())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fmt.Sprintf("%s.v%d.bak", store.file(), version), b)
+}
+
+// userTagsStore is the "user-tags" file, encoded as the user directory is
+type userTagsStore struct {
+	userDirectoryStore
+}
+
+func (s *userTagsStore) name() string {
+	return "user-tags"
+}
+
+// roleGrantsStore is the "role-grants" file, encoded as the user directory is
+type roleGrantsStore struct {
+	userDirectoryStore
+}
+
+func (s *roleGrantsStore) name() string {
+	return "role-grants"
+}
+
+// userDirectoryStore is the "user-directory" file
+type userDirectoryStore struct {
+	path string
+}
+
+func (s *userDirectoryStore) name() string {
+	return "user-directory"
+}
+
+func (s *userDirectoryStore) file() string {
+	return s.path
+}
+
+func (s *userDirectoryStore) read() (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *userDirectoryStore) write(data map[string]interface{}) error {
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+// identityCacheStore is the "fallback-cache" file, the payload is migrated and
+// signed again
+type identityCacheStore struct {
+	path     string
+	secret   []byte
+	previous [][]byte
+}
+
+func (s *identityCacheStore) name() string {
+	return "fallback-cache"
+}
+
+func (s *identityCacheStore) file() string {
+	return s.path
+}
+
+func (s *identityCacheStore) read() (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file identityCacheFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+
+	cache := &IdentityCache{secret: s.secret, previous: s.previous}
+	if !cache.validSignature(file.Payload, file.Signature) {
+		return nil, errors.New("identity cache signature is invalid, the file has been modified or the secret has changed")
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(file.Payload, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *identityCacheStore) write(data map[string]interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	cache := &IdentityCache{secret: s.secret}
+	b, err := json.Marshal(identityCacheFile{
+		Payload:   payload,
+		Signature: cache.signature(payload),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+// writeFileAtomic writes the file via a temporary file, so readers never see a
+// partially written file
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
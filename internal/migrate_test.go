@@ -0,0 +1,133 @@
+package tfa
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestMigrateUserDirectory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	// Directory written before emails were normalised
+	original := []byte(`{"users": {
+		"Alice@Example.com": {"roles": ["admin"]},
+		"alice@example.com": {"roles": ["dev"]},
+		"bob@example.com": {"roles": []}
+	}}`)
+	require.Nil(ioutil.WriteFile(path, original, 0600))
+	c := &Config{UserDirectory: path}
+
+	// Dry run should report the migration without applying it
+	var out bytes.Buffer
+	require.Nil(MigrateStores(c, true, &out))
+	assert.Equal("user-directory: would apply 1: Normalise emails to lower case, merging duplicate users\n", out.String())
+	b, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	assert.Equal(original, b, "dry run should not change the store")
+
+	// Should migrate
+	out.Reset()
+	require.Nil(MigrateStores(c, false, &out))
+	assert.Equal("user-directory: applied 1: Normalise emails to lower case, merging duplicate users\n", out.String())
+
+	dir, err := NewUserDirectory(path)
+	require.Nil(err)
+	entry, ok := dir.Lookup("alice@example.com")
+	require.True(ok)
+	assert.Equal([]string{"admin", "dev"}, entry.Roles)
+	assert.Len(dir.Users(), 2)
+
+	// Should keep a backup of the original
+	b, err = ioutil.ReadFile(path + ".v0.bak")
+	require.Nil(err)
+	assert.Equal(original, b)
+
+	// Should be up to date
+	out.Reset()
+	require.Nil(MigrateStores(c, false, &out))
+	assert.Equal("user-directory: up to date\n", out.String())
+
+	// Should stay up to date when the directory is saved again
+	_, err = dir.Import([]ImportedUser{{Email: "carol@example.com"}}, false, false)
+	require.Nil(err)
+	out.Reset()
+	require.Nil(MigrateStores(c, false, &out))
+	assert.Equal("user-directory: up to date\n", out.String())
+}
+
+func TestMigrateRefusesNewerVersion(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	require.Nil(ioutil.WriteFile(path, []byte(`{"schema_version": 99, "users": {}}`), 0600))
+
+	err := MigrateStores(&Config{UserDirectory: path}, false, ioutil.Discard)
+	if assert.Error(err) {
+		assert.Equal("user-directory: schema version 99 is newer than this release supports (1), upgrade traefik-forward-auth", err.Error())
+	}
+}
+
+func TestMigrateMissingStore(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	var out bytes.Buffer
+	assert.Nil(MigrateStores(&Config{UserDirectory: path}, false, &out))
+	assert.Equal("user-directory: up to date\n", out.String())
+	_, err := os.Stat(path)
+	assert.True(os.IsNotExist(err), "should not create the store")
+}
+
+func TestMigrateFallbackCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "identities.json")
+	secret := []byte("veryveryverysecret")
+
+	// Write a cache without a schema version
+	user := &provider.User{UUID: uuid.New(), Email: "test@example.com"}
+	store := &identityCacheStore{path: path, secret: secret}
+	require.Nil(store.write(map[string]interface{}{
+		"identities": map[string]interface{}{
+			user.Email: map[string]interface{}{
+				"name":      "Test",
+				"last_seen": time.Now(),
+			},
+		},
+		"sessions": map[string]interface{}{
+			user.UUID.String(): user.Email,
+		},
+	}))
+
+	var out bytes.Buffer
+	require.Nil(MigrateStores(&Config{FallbackCache: path, Secret: secret}, false, &out))
+	assert.Equal("fallback-cache: applied 1: Record schema version\nfallback-cache: applied 2: Record when each session was last seen\n", out.String())
+
+	// Should still be signed correctly
+	cache, err := NewIdentityCache(path, secret, time.Hour)
+	require.Nil(err)
+	cached, ok := cache.Lookup(user.UUID)
+	require.True(ok)
+	assert.Equal(user.Email, cached.Email)
+	assert.Equal("Test", cached.Name)
+
+	// Should refuse a cache signed with another secret
+	err = MigrateStores(&Config{FallbackCache: path, Secret: []byte("anotheranothersecret")}, false, ioutil.Discard)
+	assert.Error(err)
+}
@@ -0,0 +1,207 @@
+package tfa
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Password login
+//
+// Providers that check a username and password themselves (e.g. ldap) have no
+// login page to send the user to, so the user is sent to one next to the
+// callback instead. Forward auth requests never carry a body, so a submitted
+// form can't reach us: the browser's own password prompt is used, which sends
+// the credentials in an Authorization: Basic header. Once they're checked the
+// user is sent on to the callback with a one-time code. Providers may also
+// accept Basic auth on protected requests, for clients that can't log in
+
+// passwordRealm is the realm the browser's password prompt is shown for
+const passwordRealm = "traefik-forward-auth"
+
+var passwordTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 32em; margin: 4em auto; text-align: center; }
+.logo { max-width: 100%; max-height: 6em; }
+a { display: inline-block; margin: 0.5em 0; padding: 0.75em; border: 1px solid #ccc; border-radius: 4px; color: inherit; text-decoration: none; }
+a:hover { background: #f4f4f4; }
+{{.CSS}}
+</style>
+</head>
+<body>
+{{if .Logo}}<img class="logo" src="{{.Logo}}" alt="">
+{{end}}<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<a href="{{.RetryURL}}">Try again</a>
+</body>
+</html>
+`))
+
+// PasswordLoginHandler asks for the user's username and password, and sends
+// them on to the callback once the provider in the login state has checked
+// them
+func (s *Server) PasswordLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "PasswordLogin", "default", "Handling password login")
+
+		// Check state and CSRF cookie, as the callback will
+		state := r.URL.Query().Get("state")
+		if err := ValidateState(state); err != nil {
+			logger.WithField("error", err).Warn("Error validating state")
+			recordLoginFailure(r)
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		cookie, err := FindCSRFCookie(r, state)
+		if err != nil {
+			logger.Info("Missing csrf cookie")
+			recordLoginFailure(r)
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		valid, providerName, _, err := ValidateCSRFCookie(cookie, state)
+		if !valid {
+			logger.WithField("error", err).Warn("Error validating csrf cookie")
+			recordLoginFailure(r)
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		p, err := config().GetConfiguredProvider(providerName)
+		authenticator, ok := p.(provider.PasswordAuthenticator)
+		if err != nil || !ok {
+			logger.WithField("provider", providerName).Warn("Provider in csrf cookie does not check passwords")
+			recordLoginFailure(r)
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			passwordChallenge(logger, w, r, "Log in with your username and password.")
+			return
+		}
+
+		if err := waitProviderBudget(providerName, "password", false); err != nil {
+			loginsTotal.Inc(providerName, "budget_exhausted")
+			logger.WithField("error", err).Warn("Not checking password with provider")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+		start := time.Now()
+		user, err := authenticator.Authenticate(username, password)
+		if errors.Is(err, provider.ErrInvalidCredentials) {
+			observeProviderRequest(providerName, "password", start, nil)
+			traceProviderRequest(r, providerName, "password", start, nil)
+			logger.WithFields(logrus.Fields{
+				"provider": providerName,
+				"username": username,
+			}).Warn("Invalid username or password")
+			recordLoginFailure(r)
+			loginsTotal.Inc(providerName, "invalid_credentials")
+			auditLoginFailure(r, providerName, username, "invalid_credentials")
+			passwordChallenge(logger, w, r, "The username or password was incorrect.")
+			return
+		}
+		observeProviderRequest(providerName, "password", start, err)
+		traceProviderRequest(r, providerName, "password", start, err)
+		if err != nil {
+			logger.WithField("error", err).Error("Error checking password with provider")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		code, err := authenticator.IssueCode(user)
+		if err != nil {
+			logger.WithField("error", err).Error("Error issuing login code")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		q := url.Values{}
+		q.Set("code", code)
+		q.Set("state", state)
+		http.Redirect(w, r, redirectUri(r)+"?"+q.Encode(), http.StatusSeeOther)
+	}
+}
+
+// passwordChallenge asks the browser to prompt for a username and password,
+// the page is only shown if the prompt is cancelled
+func passwordChallenge(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", passwordRealm))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(401)
+	err := passwordTemplate.Execute(w, struct {
+		loginBranding
+		Message  string
+		RetryURL string
+	}{newLoginBranding(), message, r.URL.RequestURI()})
+	if err != nil {
+		logger.WithField("error", err).Error("Error rendering password page")
+	}
+}
+
+// basicUser checks the credentials with the first of the providers accepting
+// Basic auth, returning false if none of them do. The user is nil if the
+// credentials are invalid, an error is returned if they couldn't be checked
+func (s *Server) basicUser(logger *logrus.Entry, r *http.Request, providers []string, username, password string) (*provider.User, bool, error) {
+	for _, name := range providers {
+		p, err := config().GetConfiguredProvider(name)
+		if err != nil {
+			continue
+		}
+		authenticator, ok := p.(provider.BasicAuthenticator)
+		if !ok || !authenticator.AcceptsBasicAuth() {
+			continue
+		}
+
+		if err := waitProviderBudget(name, "basic", false); err != nil {
+			return nil, true, err
+		}
+		start := time.Now()
+		user, err := authenticator.AuthenticateBasic(username, password)
+		if errors.Is(err, provider.ErrInvalidCredentials) {
+			observeProviderRequest(name, "basic", start, nil)
+			traceProviderRequest(r, name, "basic", start, nil)
+			traceCheck(r, "basic", "invalid credentials for "+name)
+			logger.WithFields(logrus.Fields{
+				"provider": name,
+				"username": username,
+			}).Warn("Invalid Basic auth credentials")
+			return nil, true, nil
+		}
+		observeProviderRequest(name, "basic", start, err)
+		traceProviderRequest(r, name, "basic", start, err)
+		if err != nil {
+			return nil, true, err
+		}
+
+		traceCheck(r, "basic", "verified by "+name)
+		user.Email = normalizeEmail(user.Email)
+		claims := user.Claims
+		addClaimRoles(user, claims)
+		setProfile(user, claims)
+		keepCustomClaims(user)
+		if roleMap != nil {
+			roleMap.Apply(user)
+		}
+		if userDirectory != nil {
+			userDirectory.Apply(user)
+		}
+		return user, true, nil
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,127 @@
+package tfa
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestPasswordLoginHandler(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newLDAPTestConfig(t))
+	nonce := "12345678901234567890123456789012"
+
+	// Should refuse requests without a valid login state
+	req := newHTTPRequest("GET", "http://example.com/_oauth/ldap?state="+nonce+":ldap:http://example.com/redirect")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Empty(res.Header.Get("WWW-Authenticate"), "shouldn't prompt without a csrf cookie")
+
+	// Should refuse providers that don't check passwords
+	req = newHTTPRequest("GET", "http://example.com/_oauth/ldap?state="+nonce+":google:http://example.com/redirect")
+	res, _ = doHttpRequest(req, MakeCSRFCookie(req, nonce))
+	assert.Equal(401, res.StatusCode)
+	assert.Empty(res.Header.Get("WWW-Authenticate"))
+
+	// Should prompt for a username and password
+	req = newHTTPRequest("GET", "http://example.com/_oauth/ldap?state="+nonce+":ldap:http://example.com/redirect")
+	res, body := doHttpRequest(req, MakeCSRFCookie(req, nonce))
+	assert.Equal(401, res.StatusCode)
+	assert.Equal(`Basic realm="traefik-forward-auth", charset="UTF-8"`, res.Header.Get("WWW-Authenticate"))
+	assert.Contains(body, "Log in with your username and password.")
+	assert.Contains(body, `href="/_oauth/ldap?state=`+nonce+`:ldap:http://example.com/redirect"`)
+
+	// Should refuse empty passwords without asking the directory
+	req = newHTTPRequest("GET", "http://example.com/_oauth/ldap?state="+nonce+":ldap:http://example.com/redirect")
+	req.SetBasicAuth("alice", "")
+	res, body = doHttpRequest(req, MakeCSRFCookie(req, nonce))
+	assert.Equal(401, res.StatusCode)
+	assert.Contains(body, "The username or password was incorrect.")
+
+	// Should be unavailable if the directory can't be reached
+	req = newHTTPRequest("GET", "http://example.com/_oauth/ldap?state="+nonce+":ldap:http://example.com/redirect")
+	req.SetBasicAuth("alice", "password")
+	res, _ = doHttpRequest(req, MakeCSRFCookie(req, nonce))
+	assert.Equal(503, res.StatusCode)
+}
+
+func TestPasswordLoginCallback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newLDAPTestConfig(t))
+	nonce := "12345678901234567890123456789012"
+
+	user := &provider.User{UUID: uuid.New(), Email: "alice@example.com", Roles: []string{"admins"}}
+	code, err := config().Providers.LDAP.IssueCode(user)
+	require.Nil(err)
+
+	// Should log the user in with the code
+	q := url.Values{}
+	q.Set("code", code)
+	q.Set("state", nonce+":ldap:http://example.com/redirect")
+	req := newHTTPRequest("GET", "http://example.com/_oauth?"+q.Encode())
+	res, _ := doHttpRequest(req, MakeCSRFCookie(req, nonce))
+	require.Equal(307, res.StatusCode)
+	fwd, _ := res.Location()
+	assert.Equal("/redirect", fwd.Path)
+
+	// Should only accept the code once
+	req = newHTTPRequest("GET", "http://example.com/_oauth?"+q.Encode())
+	res, _ = doHttpRequest(req, MakeCSRFCookie(req, nonce))
+	assert.Equal(401, res.StatusCode)
+}
+
+func TestServerBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newLDAPTestConfig(t))
+	config().Rules = map[string]*Rule{
+		"api": {
+			Action:   "auth",
+			Rule:     "Host(`api.example.com`)",
+			Provider: "ldap",
+		},
+	}
+
+	// Should ignore Basic auth unless the provider accepts it
+	req := newHTTPRequest("GET", "https://api.example.com/items")
+	req.SetBasicAuth("alice", "")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+
+	// Should challenge invalid credentials
+	config().Providers.LDAP.BasicAuth = true
+	req = newHTTPRequest("GET", "https://api.example.com/items")
+	req.SetBasicAuth("alice", "")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Equal(`Basic realm="traefik-forward-auth", charset="UTF-8"`, res.Header.Get("WWW-Authenticate"))
+
+	// Should be unavailable if the directory can't be reached
+	req = newHTTPRequest("GET", "https://api.example.com/items")
+	req.SetBasicAuth("alice", "password")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(503, res.StatusCode)
+}
+
+/**
+ * Utilities
+ */
+
+// newLDAPTestConfig configures the ldap provider with a directory that can't
+// be reached
+func newLDAPTestConfig(t *testing.T) *Config {
+	c := newDefaultConfig()
+	c.DefaultProvider = "ldap"
+	c.Providers.LDAP.URL = "ldap://127.0.0.1:1"
+	c.Providers.LDAP.BaseDN = "dc=example,dc=com"
+	require.Nil(t, c.Providers.LDAP.Setup())
+	return c
+}
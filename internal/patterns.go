@@ -0,0 +1,79 @@
+package tfa
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Whitelist and domain patterns
+//
+// Entries of the "whitelist" and "domain" lists, globally and in rules, may be
+// patterns rather than exact addresses and domains. A "*" matches any
+// characters other than "@", so "*@team.example.com" permits everyone at
+// team.example.com and "*.example.org" every subdomain of example.org (but not
+// example.org itself). An entry between slashes, e.g. "/^ops-[a-z]+@example\.com$/",
+// is a regular expression, matched without case against the normalized email
+// or domain; it should be anchored, as otherwise it matches anywhere within
+
+// compiledPatterns caches the regular expressions patterns compile to
+var compiledPatterns sync.Map
+
+// isPattern reports whether the whitelist or domain entry is a pattern
+func isPattern(entry string) bool {
+	return strings.Contains(entry, "*") || isRegexpPattern(entry)
+}
+
+// isRegexpPattern reports whether the entry is a regular expression
+func isRegexpPattern(entry string) bool {
+	return len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/")
+}
+
+// compilePattern returns the regular expression the pattern matches with
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := compiledPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	var expr string
+	if isRegexpPattern(pattern) {
+		expr = "(?i)" + pattern[1:len(pattern)-1]
+	} else {
+		parts := strings.Split(strings.ToLower(strings.TrimSpace(pattern)), "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		expr = "^" + strings.Join(parts, "[^@]*") + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	compiledPatterns.Store(pattern, re)
+	return re, nil
+}
+
+// matchPattern reports whether the normalized email or domain matches the
+// pattern, invalid patterns never match
+func matchPattern(pattern, value string) bool {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value)
+}
+
+// validatePatterns checks the patterns in the list compile
+func validatePatterns(list CommaSeparatedList) error {
+	for _, entry := range list {
+		if !isPattern(entry) {
+			continue
+		}
+		if _, err := compilePattern(entry); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", entry, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package tfa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestValidateWhitelistPatterns(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should match wildcards without crossing the @
+	whitelist := CommaSeparatedList{"*@team.example.com", "ops-*@Example.com"}
+	assert.True(ValidateWhitelist("alice@team.example.com", whitelist))
+	assert.True(ValidateWhitelist("Bob@TEAM.example.com", whitelist))
+	assert.False(ValidateWhitelist("alice@other.example.com", whitelist))
+	assert.False(ValidateWhitelist("alice@evil.com@team.example.com.evil.com", whitelist))
+	assert.True(ValidateWhitelist("ops-oncall@example.com", whitelist))
+	assert.False(ValidateWhitelist("dev-oncall@example.com", whitelist))
+
+	// Should match regular expressions without case
+	whitelist = CommaSeparatedList{`/^[a-z]+\.admin@example\.com$/`}
+	assert.True(ValidateWhitelist("Jane.Admin@example.com", whitelist))
+	assert.False(ValidateWhitelist("jane.admin@example.com.evil.com", whitelist))
+	assert.False(ValidateWhitelist("jane@example.com", whitelist))
+
+	// Should still match exact entries
+	assert.True(ValidateWhitelist("test@example.com", CommaSeparatedList{"*@other.com", "Test@example.com"}))
+}
+
+func TestValidateDomainsPatterns(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should match subdomains at any depth, but not the domain itself
+	domains := CommaSeparatedList{"*.example.org"}
+	assert.True(ValidateDomains("test@eng.example.org", domains))
+	assert.True(ValidateDomains("test@a.b.Example.org", domains))
+	assert.False(ValidateDomains("test@example.org", domains))
+	assert.False(ValidateDomains("test@example.org.evil.com", domains))
+	assert.False(ValidateDomains("test@badexample.org", domains))
+
+	// Should match regular expressions
+	domains = CommaSeparatedList{`/^(eu|us)\.example\.com$/`}
+	assert.True(ValidateDomains("test@eu.example.com", domains))
+	assert.False(ValidateDomains("test@asia.example.com", domains))
+}
+
+func TestValidateUserPatterns(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Whitelist = CommaSeparatedList{"*@team.example.com"}
+
+	// Should use global patterns
+	assert.True(ValidateUser(newTestUser("alice@team.example.com"), "default"))
+	assert.False(ValidateUser(newTestUser("alice@example.com"), "default"))
+
+	// Should use the rule's patterns
+	c, err := NewConfig([]string{
+		"--rule.docs.action=auth",
+		"--rule.docs.rule=Host(`docs.example.com`)",
+		"--rule.docs.domains=*.example.org",
+	})
+	require.Nil(t, err)
+	config().Rules = c.Rules
+	assert.True(ValidateUser(newTestUser("alice@eng.example.org"), "docs"))
+	assert.False(ValidateUser(newTestUser("alice@team.example.com"), "docs"))
+}
+
+func TestValidatePatterns(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(validatePatterns(CommaSeparatedList{"test@example.com", "*@example.com", `/^a+@example\.com$/`}))
+	assert.NotNil(validatePatterns(CommaSeparatedList{"/^(unclosed@example\\.com$/"}))
+
+	// Should refuse rules with invalid patterns
+	rule := NewRule()
+	rule.Rule = "Host(`docs.example.com`)"
+	rule.Whitelist = CommaSeparatedList{"/[/"}
+	err := rule.Validate(newDefaultConfig())
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "invalid rule whitelist")
+	}
+}
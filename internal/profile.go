@@ -0,0 +1,228 @@
+package tfa
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Profiles
+//
+// The user's display name and avatar URL are taken from the provider's claims
+// at login and kept on the session, whichever provider they logged in with.
+// Apps read them from the userinfo endpoint or the "name" and "avatar" header
+// fields, and can show the avatar from <url-path>/avatar, which fetches it
+// once and serves it from a cache, rather than calling the provider themselves
+
+// avatarMaxSize is the largest avatar that's cached
+const avatarMaxSize = 1 << 20
+
+// avatarCacheSize is the number of avatars cached at most
+const avatarCacheSize = 1000
+
+// setProfile fills in the user's display name from the "display-name-claim"s,
+// if the provider didn't give one, and their avatar URL from the
+// "avatar-claim"s
+func setProfile(user *provider.User, claims map[string]interface{}) {
+	if user.Name == "" {
+		for _, name := range config().DisplayNameClaims {
+			if value, ok := lookupClaim(claims, name); ok {
+				if s, ok := value.(string); ok && s != "" {
+					user.Name = s
+					break
+				}
+			}
+		}
+	}
+
+	user.Avatar = ""
+	for _, name := range config().AvatarClaims {
+		value, _ := lookupClaim(claims, name)
+		s, _ := value.(string)
+		if u, err := url.Parse(s); err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" {
+			user.Avatar = s
+			break
+		}
+	}
+}
+
+// AvatarHandler serves the logged in user's avatar
+func (s *Server) AvatarHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(config().CookieName)
+		if err != nil {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		user, err := ValidateCookie(r, c)
+		if err != nil {
+			log.WithField("error", err).Debug("Invalid cookie for avatar")
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		if user.Avatar == "" {
+			http.Error(w, "Not found", 404)
+			return
+		}
+
+		avatar, err := avatars.Get(user.Avatar, config().AvatarCacheTTL)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error":  err,
+				"avatar": user.Avatar,
+			}).Warn("Error fetching avatar")
+			http.Error(w, "Avatar unavailable", 502)
+			return
+		}
+
+		w.Header().Set("Content-Type", avatar.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(avatar.body)))
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(config().AvatarCacheTTL/time.Second)))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(avatar.body)
+	}
+}
+
+// Avatar cache
+
+type cachedAvatar struct {
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// avatarCache holds the avatars fetched, by URL
+type avatarCache struct {
+	mu      sync.Mutex
+	client  *http.Client
+	avatars map[string]*cachedAvatar
+}
+
+var avatars = newAvatarCache()
+
+func newAvatarCache() *avatarCache {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: refusePrivateAddress,
+	}
+	return &avatarCache{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: dialer.DialContext,
+			},
+		},
+		avatars: make(map[string]*cachedAvatar),
+	}
+}
+
+// privateNetworks are the networks avatars aren't fetched from
+var privateNetworks = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// refusePrivateAddress stops avatar URLs being used to reach the network
+// traefik-forward-auth runs in. The address is checked once resolved, so a
+// public name can't resolve to a private address
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return fmt.Errorf("avatar address %s is not public", host)
+	}
+	for _, private := range privateNetworks {
+		if private.Contains(ip) {
+			return fmt.Errorf("avatar address %s is not public", host)
+		}
+	}
+	return nil
+}
+
+// Get returns the avatar at the URL, fetching it if it isn't cached or the
+// cached copy is older than the ttl
+func (c *avatarCache) Get(avatarURL string, ttl time.Duration) (*cachedAvatar, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	avatar, ok := c.avatars[avatarURL]
+	c.mu.Unlock()
+	if ok && now.Before(avatar.expires) {
+		return avatar, nil
+	}
+
+	avatar, err := c.fetch(avatarURL)
+	if err != nil {
+		return nil, err
+	}
+	avatar.expires = now.Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.avatars) >= avatarCacheSize {
+		for key, cached := range c.avatars {
+			if !now.Before(cached.expires) {
+				delete(c.avatars, key)
+			}
+		}
+	}
+	// Still full, make room
+	for key := range c.avatars {
+		if len(c.avatars) < avatarCacheSize {
+			break
+		}
+		delete(c.avatars, key)
+	}
+	c.avatars[avatarURL] = avatar
+	return avatar, nil
+}
+
+// fetch requests the avatar, only images other than SVG (which can contain
+// scripts) are accepted
+func (c *avatarCache) fetch(avatarURL string) (*cachedAvatar, error) {
+	res, err := c.client.Get(avatarURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("avatar returned %s", res.Status)
+	}
+
+	contentType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(contentType, "image/") || contentType == "image/svg+xml" {
+		return nil, fmt.Errorf("avatar has content type %q, not an image", res.Header.Get("Content-Type"))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, avatarMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > avatarMaxSize {
+		return nil, errors.New("avatar is too large")
+	}
+	return &cachedAvatar{contentType: contentType, body: body}, nil
+}
@@ -0,0 +1,138 @@
+package tfa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestSetProfile(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should take the name and avatar from the claims
+	user := newTestUser("test@example.com")
+	setProfile(user, map[string]interface{}{
+		"preferred_username": "test",
+		"picture":            "https://example.com/test.png",
+	})
+	assert.Equal("test", user.Name)
+	assert.Equal("https://example.com/test.png", user.Avatar)
+
+	// Should keep the name given by the provider
+	user = newTestUser("test@example.com")
+	user.Name = "Test User"
+	setProfile(user, map[string]interface{}{"login": "test"})
+	assert.Equal("Test User", user.Name)
+	assert.Equal("", user.Avatar)
+
+	// Should skip claims that aren't web URLs
+	user = newTestUser("test@example.com")
+	setProfile(user, map[string]interface{}{
+		"picture":    "javascript:alert(1)",
+		"avatar_url": "https://example.com/avatar.png",
+	})
+	assert.Equal("https://example.com/avatar.png", user.Avatar)
+}
+
+func TestAvatarHandler(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	h := NewServer().Handler()
+
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		switch r.URL.Path {
+		case "/test.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		case "/test.svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte("<svg/>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer swapAvatarCache()()
+
+	request := func(avatar string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/_oauth/avatar", nil)
+		user := newTestUser("test@example.com")
+		user.Avatar = avatar
+		c, _ := MakeCookie(req, user)
+		req.AddCookie(c)
+		return serveRouter(h, req)
+	}
+
+	// Should require a cookie
+	res := serveRouter(h, httptest.NewRequest("GET", "http://example.com/_oauth/avatar", nil))
+	assert.Equal(401, res.Code)
+
+	// Should 404 without an avatar
+	res = request("")
+	assert.Equal(404, res.Code)
+
+	// Should serve the avatar
+	res = request(server.URL + "/test.png")
+	assert.Equal(200, res.Code)
+	assert.Equal("image/png", res.Header().Get("Content-Type"))
+	assert.Equal("private, max-age=3600", res.Header().Get("Cache-Control"))
+	assert.Equal("png", res.Body.String())
+
+	// Should serve it from the cache
+	res = request(server.URL + "/test.png")
+	assert.Equal(200, res.Code)
+	assert.Equal(1, fetches)
+
+	// Should refuse SVGs
+	res = request(server.URL + "/test.svg")
+	assert.Equal(502, res.Code)
+
+	// Should pass on failures
+	res = request(server.URL + "/missing.png")
+	assert.Equal(502, res.Code)
+}
+
+func TestAvatarCacheRefusesPrivateAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer server.Close()
+
+	_, err := newAvatarCache().Get(server.URL, time.Hour)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "is not public")
+	}
+
+	for _, address := range []string{"127.0.0.1:80", "10.1.2.3:443", "192.168.0.1:80", "169.254.169.254:80", "[::1]:443", "[fd00::1]:80"} {
+		assert.Error(refusePrivateAddress("tcp", address, nil), address)
+	}
+	assert.Nil(refusePrivateAddress("tcp", "93.184.216.34:443", nil))
+}
+
+/**
+ * Utilities
+ */
+
+// swapAvatarCache replaces the avatar cache with one that can fetch from test
+// servers, returning a function to put it back
+func swapAvatarCache() func() {
+	previous := avatars
+	avatars = &avatarCache{
+		client:  http.DefaultClient,
+		avatars: make(map[string]*cachedAvatar),
+	}
+	return func() { avatars = previous }
+}
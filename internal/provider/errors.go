@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2"
+)
+
+// Error is an OAuth2 error response returned by a provider, either as query
+// parameters on the callback or as the body of a failed token request
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	URI         string `json:"error_uri"`
+}
+
+// Remediation hints for well known error codes, see RFC 6749 section 4.1.2.1
+// and 5.2, plus the OpenID Connect additions
+var errorHints = map[string]string{
+	"access_denied":              "The provider denied access, either the user cancelled the login or a provider policy (e.g. conditional access or app assignment) rejected them. Check the user is permitted to use this application at the provider.",
+	"consent_required":           "The user has not consented to this application. Ask the user to log in again and grant consent, or have an administrator grant consent on their behalf.",
+	"login_required":             "The provider requires the user to log in interactively. Check the provider \"prompt\" option is not set to \"none\".",
+	"interaction_required":       "The provider requires user interaction to complete the login. Check the provider \"prompt\" option is not set to \"none\".",
+	"account_selection_required": "The user must select an account at the provider. Check the provider \"prompt\" option is not set to \"none\".",
+	"invalid_request":            "The provider rejected the request as malformed. Check the provider configuration.",
+	"unauthorized_client":        "The client is not permitted to use the authorization code flow. Check the application configuration at the provider.",
+	"unsupported_response_type":  "The provider does not support the \"code\" response type for this client. Check the application configuration at the provider.",
+	"invalid_scope":              "The provider rejected the requested scopes. Check the configured scopes are enabled for this client.",
+	"invalid_client":             "The provider could not authenticate the client. Check the configured client-id and client-secret.",
+	"invalid_grant":              "The authorization code was invalid, expired or already used, or the redirect URI does not match. Try logging in again.",
+	"redirect_uri_mismatch":      "The redirect URI is not registered with the provider. Register the callback URL (including the url-path) with the provider.",
+	"server_error":               "The provider encountered an internal error. Try again later.",
+	"temporarily_unavailable":    "The provider is temporarily unavailable. Try again later.",
+}
+
+// ErrorFromQuery extracts an error response from the callback query string,
+// returns nil if the query does not contain an error
+func ErrorFromQuery(q url.Values) *Error {
+	code := q.Get("error")
+	if code == "" {
+		return nil
+	}
+
+	return &Error{
+		Code:        code,
+		Description: q.Get("error_description"),
+		URI:         q.Get("error_uri"),
+	}
+}
+
+// AsError returns the provider error contained in the given error, if any
+func AsError(err error) (*Error, bool) {
+	var perr *Error
+	if errors.As(err, &perr) {
+		return perr, true
+	}
+
+	// Errors from the oauth2 library carry the raw response body
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		if perr := errorFromBody(rerr.Body); perr != nil {
+			return perr, true
+		}
+	}
+
+	return nil, false
+}
+
+// errorFromResponse builds an error from a failed provider response, using the
+// structured error body if one is present
+func errorFromResponse(res *http.Response) error {
+	body, _ := ioutil.ReadAll(res.Body)
+	if perr := errorFromBody(body); perr != nil {
+		return perr
+	}
+
+	return fmt.Errorf("unexpected response from provider: %s", res.Status)
+}
+
+func errorFromBody(body []byte) *Error {
+	var perr Error
+	if err := json.Unmarshal(body, &perr); err != nil || perr.Code == "" {
+		return nil
+	}
+	return &perr
+}
+
+func (e *Error) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	return e.Code
+}
+
+// IsConsentRevoked reports whether the error from a token refresh shows the
+// user has revoked the application's consent (or their grant has otherwise
+// been withdrawn, e.g. the user was disabled)
+func IsConsentRevoked(err error) bool {
+	perr, ok := AsError(err)
+	return ok && perr.Code == "invalid_grant"
+}
+
+// Hint returns remediation advice for the error code, if it is well known
+func (e *Error) Hint() string {
+	return errorHints[e.Code]
+}
+
+// Status returns the HTTP status code that best describes the error to the
+// user: unavailable for provider side failures, unauthorized when the user
+// was refused and internal error for anything suggesting a misconfiguration
+func (e *Error) Status() int {
+	switch e.Code {
+	case "server_error", "temporarily_unavailable":
+		return http.StatusServiceUnavailable
+	case "access_denied", "consent_required", "login_required",
+		"interaction_required", "account_selection_required", "invalid_grant":
+		return http.StatusUnauthorized
+	}
+
+	return http.StatusInternalServerError
+}
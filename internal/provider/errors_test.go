@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// Tests
+
+func TestErrorFromQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should ignore query without error
+	assert.Nil(ErrorFromQuery(url.Values{"code": []string{"123"}}))
+
+	// Should extract error
+	perr := ErrorFromQuery(url.Values{
+		"error":             []string{"access_denied"},
+		"error_description": []string{"denied by policy"},
+	})
+	if assert.NotNil(perr) {
+		assert.Equal("access_denied", perr.Code)
+		assert.Equal("denied by policy", perr.Description)
+		assert.Equal("access_denied: denied by policy", perr.Error())
+		assert.Equal(http.StatusUnauthorized, perr.Status())
+		assert.NotEmpty(perr.Hint())
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(http.StatusUnauthorized, (&Error{Code: "consent_required"}).Status())
+	assert.Equal(http.StatusServiceUnavailable, (&Error{Code: "temporarily_unavailable"}).Status())
+	assert.Equal(http.StatusInternalServerError, (&Error{Code: "invalid_client"}).Status())
+	assert.Equal(http.StatusInternalServerError, (&Error{Code: "unknown"}).Status())
+	assert.Equal("", (&Error{Code: "unknown"}).Hint())
+}
+
+func TestAsError(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should unwrap provider errors
+	perr, ok := AsError(fmt.Errorf("wrapped: %w", &Error{Code: "invalid_grant"}))
+	assert.True(ok)
+	assert.Equal("invalid_grant", perr.Code)
+
+	// Should parse oauth2 library errors
+	perr, ok = AsError(&oauth2.RetrieveError{
+		Body: []byte(`{"error":"invalid_client","error_description":"bad secret"}`),
+	})
+	assert.True(ok)
+	assert.Equal("invalid_client", perr.Code)
+	assert.Equal("bad secret", perr.Description)
+
+	// Should ignore other errors
+	_, ok = AsError(&oauth2.RetrieveError{Body: []byte("Service unavailable")})
+	assert.False(ok)
+	_, ok = AsError(errors.New("random"))
+	assert.False(ok)
+}
+
+func TestGoogleExchangeCodeError(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Bad Request"}`)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	p := Google{
+		TokenURL: &url.URL{
+			Scheme: serverURL.Scheme,
+			Host:   serverURL.Host,
+			Path:   "/token",
+		},
+	}
+
+	_, err := p.ExchangeCode("http://example.com/_oauth", "code")
+	perr, ok := AsError(err)
+	if assert.True(ok) {
+		assert.Equal("invalid_grant", perr.Code)
+		assert.Equal("Bad Request", perr.Description)
+	}
+}
+
+func TestGoogleRefreshConsentRevoked(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal("refresh_token", r.PostForm.Get("grant_type"))
+		assert.Equal("refresh", r.PostForm.Get("refresh_token"))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	p := Google{
+		TokenURL: &url.URL{
+			Scheme: serverURL.Scheme,
+			Host:   serverURL.Host,
+			Path:   "/token",
+		},
+	}
+
+	_, err := p.Refresh("refresh")
+	assert.True(IsConsentRevoked(err))
+
+	// Should not treat other errors as revoked consent
+	assert.False(IsConsentRevoked(&Error{Code: "temporarily_unavailable"}))
+	assert.False(IsConsentRevoked(errors.New("connection refused")))
+}
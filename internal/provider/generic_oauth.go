@@ -2,7 +2,6 @@ package provider
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -20,7 +19,11 @@ type GenericOAuth struct {
 	Scopes       []string `long:"scope" env:"SCOPE" env-delim:"," default:"profile" default:"email" description:"Scopes"`
 	TokenStyle   string   `long:"token-style" env:"TOKEN_STYLE" default:"header" choice:"header" choice:"query" description:"How token is presented when querying the User URL"`
 
+	RequiredClaims []string `long:"required-claim" env:"REQUIRED_CLAIM" env-delim:"," description:"Only allow users with this claim value, in the format claim=value, can be set multiple times"`
+
 	OAuthProvider
+
+	required requiredClaims
 }
 
 // Name returns the name of the provider
@@ -34,6 +37,22 @@ func (o *GenericOAuth) Setup() error {
 	if o.AuthURL == "" || o.TokenURL == "" || o.UserURL == "" || o.ClientID == "" || o.ClientSecret == "" {
 		return errors.New("providers.generic-oauth.auth-url, providers.generic-oauth.token-url, providers.generic-oauth.user-url, providers.generic-oauth.client-id, providers.generic-oauth.client-secret must be set")
 	}
+	if err := validateCredentials("generic-oauth", o.ClientID, o.ClientSecret); err != nil {
+		return err
+	}
+	for option, value := range map[string]string{
+		"providers.generic-oauth.auth-url":  o.AuthURL,
+		"providers.generic-oauth.token-url": o.TokenURL,
+		"providers.generic-oauth.user-url":  o.UserURL,
+	} {
+		if err := validateURL(option, value); err != nil {
+			return err
+		}
+	}
+	var err error
+	if o.required, err = parseRequiredClaims("providers.generic-oauth.required-claim", o.RequiredClaims); err != nil {
+		return err
+	}
 
 	// Create oauth2 config
 	o.Config = &oauth2.Config{
@@ -51,23 +70,38 @@ func (o *GenericOAuth) Setup() error {
 	return nil
 }
 
+// ProbeURL returns the URL used to check the provider is available
+func (o *GenericOAuth) ProbeURL() string {
+	return o.AuthURL
+}
+
 // GetLoginURL provides the login url for the given redirect uri and state
 func (o *GenericOAuth) GetLoginURL(redirectURI, state string) string {
 	return o.OAuthGetLoginURL(redirectURI, state)
 }
 
 // ExchangeCode exchanges the given redirect uri and code for a token
-func (o *GenericOAuth) ExchangeCode(redirectURI, code string) (string, error) {
+func (o *GenericOAuth) ExchangeCode(redirectURI, code string) (*Token, error) {
 	token, err := o.OAuthExchangeCode(redirectURI, code)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return newToken(token), nil
+}
+
+// Refresh exchanges the refresh token for a new token
+func (o *GenericOAuth) Refresh(refreshToken string) (*Token, error) {
+	token, err := o.OAuthRefresh(refreshToken)
+	if err != nil {
+		return nil, err
 	}
 
-	return token.AccessToken, nil
+	return newToken(token), nil
 }
 
 // GetUser uses the given token and returns a complete provider.User object
-func (o *GenericOAuth) GetUser(token string) (*User, error) {
+func (o *GenericOAuth) GetUser(token *Token) (*User, error) {
 	var user User
 
 	req, err := http.NewRequest("GET", o.UserURL, nil)
@@ -76,10 +110,10 @@ func (o *GenericOAuth) GetUser(token string) (*User, error) {
 	}
 
 	if o.TokenStyle == "header" {
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
 	} else if o.TokenStyle == "query" {
 		q := req.URL.Query()
-		q.Add("access_token", token)
+		q.Add("access_token", token.AccessToken)
 		req.URL.RawQuery = q.Encode()
 	}
 
@@ -90,7 +124,12 @@ func (o *GenericOAuth) GetUser(token string) (*User, error) {
 	}
 
 	defer res.Body.Close()
-	err = json.NewDecoder(res.Body).Decode(&user)
-
-	return &user, err
+	u, err := decodeUser(res.Body)
+	if err != nil {
+		return u, err
+	}
+	if err := o.required.check(u.Claims); err != nil {
+		return nil, err
+	}
+	return u, nil
 }
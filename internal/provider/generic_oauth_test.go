@@ -25,6 +25,19 @@ func TestGenericOAuthSetup(t *testing.T) {
 		assert.Equal("providers.generic-oauth.auth-url, providers.generic-oauth.token-url, providers.generic-oauth.user-url, providers.generic-oauth.client-id, providers.generic-oauth.client-secret must be set", err.Error())
 	}
 
+	// Check url validation
+	p = GenericOAuth{
+		AuthURL:      "https://provider.com/oauth2/auth",
+		TokenURL:     "provider.com/oauth2/token",
+		UserURL:      "https://provider.com/oauth2/user",
+		ClientID:     "id",
+		ClientSecret: "secret",
+	}
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.generic-oauth.token-url must be an absolute http or https URL", err.Error())
+	}
+
 	// Check setup
 	p = GenericOAuth{
 		AuthURL:      "https://provider.com/oauth2/auth",
@@ -106,7 +119,41 @@ func TestGenericOAuthExchangeCode(t *testing.T) {
 
 	token, err := p.ExchangeCode("http://example.com/_oauth", "code")
 	assert.Nil(err)
-	assert.Equal("123456789", token)
+	assert.Equal("123456789", token.AccessToken)
+}
+
+func TestGenericOAuthRefresh(t *testing.T) {
+	assert := assert.New(t)
+
+	// Setup server
+	expected := url.Values{
+		"client_id":     []string{"idtest"},
+		"client_secret": []string{"sectest"},
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{"refresh"},
+	}
+	server, serverURL := NewOAuthServer(t, map[string]string{
+		"token": expected.Encode(),
+	})
+	defer server.Close()
+
+	// Setup provider
+	p := GenericOAuth{
+		AuthURL:      "https://provider.com/oauth2/auth",
+		TokenURL:     serverURL.String() + "/token",
+		UserURL:      "https://provider.com/oauth2/user",
+		ClientID:     "idtest",
+		ClientSecret: "sectest",
+	}
+	err := p.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+
+	token, err := p.Refresh("refresh")
+	assert.Nil(err)
+	assert.Equal("123456789", token.AccessToken)
 }
 
 func TestGenericOAuthGetUser(t *testing.T) {
@@ -133,8 +180,17 @@ func TestGenericOAuthGetUser(t *testing.T) {
 	// AuthStyleInHeader is attempted
 	p.Config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
 
-	user, err := p.GetUser("123456789")
+	user, err := p.GetUser(&Token{AccessToken: "123456789"})
 	assert.Nil(err)
 
 	assert.Equal("example@example.com", user.Email)
+	assert.Equal("example@example.com", user.Claims["email"], "should keep raw claims")
+
+	// Should check required claims
+	p.RequiredClaims = []string{"hd=example.org"}
+	assert.Nil(p.Setup())
+	_, err = p.GetUser(&Token{AccessToken: "123456789"})
+	if perr, ok := AsError(err); assert.True(ok) {
+		assert.Equal("access_denied", perr.Code)
+	}
 }
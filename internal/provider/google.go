@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 // Google provider
@@ -13,11 +14,18 @@ type Google struct {
 	ClientID     string `long:"client-id" env:"CLIENT_ID" description:"Client ID"`
 	ClientSecret string `long:"client-secret" env:"CLIENT_SECRET" description:"Client Secret" json:"-"`
 	Scope        string
+	Offline      bool
 	Prompt       string `long:"prompt" env:"PROMPT" default:"select_account" description:"Space separated list of OpenID prompt options"`
 
-	LoginURL *url.URL
-	TokenURL *url.URL
-	UserURL  *url.URL
+	HostedDomains []string `long:"hosted-domain" env:"HOSTED_DOMAIN" env-delim:"," description:"Only allow accounts of this Google Workspace domain, checked against the hd claim, can be set multiple times"`
+	Groups        bool     `long:"groups" env:"GROUPS" description:"Look up the user's Google Workspace groups with the Cloud Identity API at login, for allowed-groups"`
+
+	LoginURL  *url.URL
+	TokenURL  *url.URL
+	UserURL   *url.URL
+	GroupsURL *url.URL
+
+	required requiredClaims
 }
 
 // Name returns the name of the provider
@@ -30,9 +38,25 @@ func (g *Google) Setup() error {
 	if g.ClientID == "" || g.ClientSecret == "" {
 		return errors.New("providers.google.client-id, providers.google.client-secret must be set")
 	}
+	if err := validateCredentials("google", g.ClientID, g.ClientSecret); err != nil {
+		return err
+	}
+
+	// Any Google account can be used however hd is set on the login URL, so
+	// the claim is checked too
+	g.required = nil
+	if len(g.HostedDomains) > 0 {
+		g.required = requiredClaims{}
+		for _, domain := range g.HostedDomains {
+			g.required["hd"] = append(g.required["hd"], strings.ToLower(strings.TrimSpace(domain)))
+		}
+	}
 
 	// Set static values
 	g.Scope = "https://www.googleapis.com/auth/userinfo.profile https://www.googleapis.com/auth/userinfo.email"
+	if g.Groups {
+		g.Scope += " https://www.googleapis.com/auth/cloud-identity.groups.readonly"
+	}
 	g.LoginURL = &url.URL{
 		Scheme: "https",
 		Host:   "accounts.google.com",
@@ -48,10 +72,20 @@ func (g *Google) Setup() error {
 		Host:   "www.googleapis.com",
 		Path:   "/oauth2/v2/userinfo",
 	}
+	g.GroupsURL = &url.URL{
+		Scheme: "https",
+		Host:   "cloudidentity.googleapis.com",
+		Path:   "/v1/groups/-/memberships:searchTransitiveGroups",
+	}
 
 	return nil
 }
 
+// ProbeURL returns the URL used to check the provider is available
+func (g *Google) ProbeURL() string {
+	return "https://accounts.google.com/.well-known/openid-configuration"
+}
+
 // GetLoginURL provides the login url for the given redirect uri and state
 func (g *Google) GetLoginURL(redirectURI, state string) string {
 	q := url.Values{}
@@ -61,6 +95,13 @@ func (g *Google) GetLoginURL(redirectURI, state string) string {
 	if g.Prompt != "" {
 		q.Set("prompt", g.Prompt)
 	}
+	if len(g.HostedDomains) == 1 {
+		q.Set("hd", g.required["hd"][0])
+	}
+	if g.Offline {
+		// Google only issues refresh tokens for offline access
+		q.Set("access_type", "offline")
+	}
 	q.Set("redirect_uri", redirectURI)
 	q.Set("state", state)
 
@@ -72,7 +113,7 @@ func (g *Google) GetLoginURL(redirectURI, state string) string {
 }
 
 // ExchangeCode exchanges the given redirect uri and code for a token
-func (g *Google) ExchangeCode(redirectURI, code string) (string, error) {
+func (g *Google) ExchangeCode(redirectURI, code string) (*Token, error) {
 	form := url.Values{}
 	form.Set("client_id", g.ClientID)
 	form.Set("client_secret", g.ClientSecret)
@@ -82,18 +123,44 @@ func (g *Google) ExchangeCode(redirectURI, code string) (string, error) {
 
 	res, err := http.PostForm(g.TokenURL.String(), form)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var token token
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errorFromResponse(res)
+	}
 	err = json.NewDecoder(res.Body).Decode(&token)
 
-	return token.Token, err
+	return token.Token(), err
+}
+
+// Refresh exchanges the refresh token for a new token
+func (g *Google) Refresh(refreshToken string) (*Token, error) {
+	form := url.Values{}
+	form.Set("client_id", g.ClientID)
+	form.Set("client_secret", g.ClientSecret)
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+
+	res, err := http.PostForm(g.TokenURL.String(), form)
+	if err != nil {
+		return nil, err
+	}
+
+	var token token
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errorFromResponse(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&token)
+
+	return token.Token(), err
 }
 
 // GetUser uses the given token and returns a complete provider.User object
-func (g *Google) GetUser(token string) (*User, error) {
+func (g *Google) GetUser(token *Token) (*User, error) {
 	var user User
 
 	client := &http.Client{}
@@ -102,14 +169,59 @@ func (g *Google) GetUser(token string) (*User, error) {
 		return &user, err
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
 	res, err := client.Do(req)
 	if err != nil {
 		return &user, err
 	}
 
 	defer res.Body.Close()
-	err = json.NewDecoder(res.Body).Decode(&user)
+	u, err := decodeUser(res.Body)
+	if err != nil {
+		return u, err
+	}
+	if err := g.required.check(u.Claims); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ResolveGroups returns the email addresses of the groups the user is a
+// member of, directly or through other groups
+func (g *Google) ResolveGroups(token *Token, user *User) ([]string, error) {
+	if !g.Groups {
+		return nil, nil
+	}
 
-	return &user, err
+	groups := []string{}
+	pageToken := ""
+	for {
+		q := url.Values{}
+		q.Set("query", fmt.Sprintf("member_key_id == '%s' && 'cloudidentity.googleapis.com/groups.discussion_forum' in labels", strings.ReplaceAll(user.Email, "'", "\\'")))
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		u := *g.GroupsURL
+		u.RawQuery = q.Encode()
+
+		var page struct {
+			Memberships []struct {
+				GroupKey struct {
+					ID string `json:"id"`
+				} `json:"groupKey"`
+			} `json:"memberships"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := getJSON(u.String(), token.AccessToken, &page); err != nil {
+			return nil, err
+		}
+		for _, m := range page.Memberships {
+			groups = append(groups, strings.ToLower(m.GroupKey.ID))
+		}
+
+		if page.NextPageToken == "" {
+			return groups, nil
+		}
+		pageToken = page.NextPageToken
+	}
 }
@@ -1,6 +1,9 @@
 package provider
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -24,6 +27,16 @@ func TestGoogleSetup(t *testing.T) {
 		assert.Equal("providers.google.client-id, providers.google.client-secret must be set", err.Error())
 	}
 
+	// Check credential validation
+	p = Google{
+		ClientID:     "id",
+		ClientSecret: "secret\n",
+	}
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.google.client-secret must not contain leading or trailing whitespace", err.Error())
+	}
+
 	// Check setup
 	p = Google{
 		ClientID:     "id",
@@ -85,6 +98,17 @@ func TestGoogleGetLoginURL(t *testing.T) {
 		"state":         []string{"state"},
 	}
 	assert.Equal(expectedQs, qs)
+
+	// Should hint the hosted domain
+	p.HostedDomains = []string{"Example.com"}
+	p.required = requiredClaims{"hd": {"example.com"}}
+	uri, _ = url.Parse(p.GetLoginURL("http://example.com/_oauth", "state"))
+	assert.Equal("example.com", uri.Query().Get("hd"))
+
+	// Should request offline access
+	p.Offline = true
+	uri, _ = url.Parse(p.GetLoginURL("http://example.com/_oauth", "state"))
+	assert.Equal("offline", uri.Query().Get("access_type"))
 }
 
 func TestGoogleExchangeCode(t *testing.T) {
@@ -118,7 +142,7 @@ func TestGoogleExchangeCode(t *testing.T) {
 
 	token, err := p.ExchangeCode("http://example.com/_oauth", "code")
 	assert.Nil(err)
-	assert.Equal("123456789", token)
+	assert.Equal("123456789", token.AccessToken)
 }
 
 func TestGoogleGetUser(t *testing.T) {
@@ -141,8 +165,88 @@ func TestGoogleGetUser(t *testing.T) {
 		},
 	}
 
-	user, err := p.GetUser("123456789")
+	user, err := p.GetUser(&Token{AccessToken: "123456789"})
 	assert.Nil(err)
 
 	assert.Equal("example@example.com", user.Email)
+	assert.Equal("example@example.com", user.Claims["email"], "should keep raw claims")
+}
+
+func TestGoogleGetUserHostedDomain(t *testing.T) {
+	assert := assert.New(t)
+
+	// Setup server
+	server, serverURL := NewOAuthServer(t, nil)
+	defer server.Close()
+
+	// Setup provider
+	p := Google{
+		ClientID:      "idtest",
+		ClientSecret:  "sectest",
+		HostedDomains: []string{"other.com", "Example.com"},
+	}
+	assert.Nil(p.Setup())
+	p.UserURL = &url.URL{
+		Scheme: serverURL.Scheme,
+		Host:   serverURL.Host,
+		Path:   "/userinfo",
+	}
+
+	// Should allow accounts of the hosted domains
+	user, err := p.GetUser(&Token{AccessToken: "123456789"})
+	assert.Nil(err)
+	assert.Equal("example@example.com", user.Email)
+
+	// Should refuse accounts of other domains, whatever the login URL hinted
+	userURL := p.UserURL
+	p.HostedDomains = []string{"other.com"}
+	assert.Nil(p.Setup())
+	p.UserURL = userURL
+	_, err = p.GetUser(&Token{AccessToken: "123456789"})
+	if perr, ok := AsError(err); assert.True(ok) {
+		assert.Equal("access_denied", perr.Code)
+		assert.Equal(`hd claim "example.com" is not allowed`, perr.Description)
+	}
+}
+
+func TestGoogleResolveGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	// Setup a directory returning two pages of groups
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("Bearer 123456789", r.Header.Get("Authorization"))
+		queries = append(queries, r.URL.Query())
+		if r.URL.Query().Get("pageToken") == "" {
+			fmt.Fprint(w, `{"memberships":[{"groupKey":{"id":"Engineering@example.com"}}],"nextPageToken":"2"}`)
+			return
+		}
+		fmt.Fprint(w, `{"memberships":[{"groupKey":{"id":"all@example.com"}}]}`)
+	}))
+	defer server.Close()
+
+	p := Google{ClientID: "idtest", ClientSecret: "sectest"}
+	assert.Nil(p.Setup())
+	p.GroupsURL, _ = url.Parse(server.URL + "/v1/groups/-/memberships:searchTransitiveGroups")
+	user := &User{Email: "example@example.com"}
+
+	// Should not look groups up unless enabled
+	groups, err := p.ResolveGroups(&Token{AccessToken: "123456789"}, user)
+	assert.Nil(err)
+	assert.Nil(groups)
+	assert.Empty(queries)
+
+	// Should request the groups scope and follow every page
+	p.Groups = true
+	groupsURL := p.GroupsURL
+	assert.Nil(p.Setup())
+	p.GroupsURL = groupsURL
+	assert.Contains(p.Scope, "https://www.googleapis.com/auth/cloud-identity.groups.readonly")
+	groups, err = p.ResolveGroups(&Token{AccessToken: "123456789"}, user)
+	assert.Nil(err)
+	assert.Equal([]string{"engineering@example.com", "all@example.com"}, groups)
+	if assert.Len(queries, 2) {
+		assert.Equal("member_key_id == 'example@example.com' && 'cloudidentity.googleapis.com/groups.discussion_forum' in labels", queries[0].Get("query"))
+		assert.Equal("2", queries[1].Get("pageToken"))
+	}
 }
@@ -0,0 +1,343 @@
+package provider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP provider
+//
+// Users log in with a password prompt served by traefik-forward-auth, or with
+// Basic auth, and their credentials are checked by binding to the directory as
+// them. The prompt hands the user on to the callback with a one-time code, so
+// the rest of the login is the same as for OAuth providers. Codes are kept in
+// memory, so the callback must reach the instance that checked the credentials
+type LDAP struct {
+	URL                string `long:"url" env:"URL" description:"URL of the directory, e.g. ldaps://ldap.example.com or ldap://dc.example.com:389"`
+	StartTLS           bool   `long:"start-tls" env:"START_TLS" description:"Upgrade ldap:// connections with StartTLS"`
+	BindDN             string `long:"bind-dn" env:"BIND_DN" description:"DN to bind as to search for users and their groups, anonymous if unset"`
+	BindPassword       string `long:"bind-password" env:"BIND_PASSWORD" description:"Password of the bind-dn" json:"-"`
+	BaseDN             string `long:"base-dn" env:"BASE_DN" description:"DN users are searched for under"`
+	UserFilter         string `long:"user-filter" env:"USER_FILTER" default:"(uid={username})" description:"Filter finding the user logging in, e.g. (sAMAccountName={username}) for Active Directory"`
+	EmailAttribute     string `long:"email-attribute" env:"EMAIL_ATTRIBUTE" default:"mail" description:"Attribute holding the user's email address, the username is used if it's empty"`
+	NameAttribute      string `long:"name-attribute" env:"NAME_ATTRIBUTE" default:"cn" description:"Attribute holding the user's name"`
+	GroupBaseDN        string `long:"group-base-dn" env:"GROUP_BASE_DN" description:"DN groups are searched for under, defaults to the base-dn"`
+	GroupFilter        string `long:"group-filter" env:"GROUP_FILTER" default:"(member={dn})" description:"Filter finding the groups the user is a member of, granted as roles, e.g. (member:1.2.840.113556.1.4.1941:={dn}) for nested Active Directory groups"`
+	GroupNameAttribute string `long:"group-name-attribute" env:"GROUP_NAME_ATTRIBUTE" default:"cn" description:"Attribute holding the name of each group"`
+	BasicAuth          bool   `long:"basic-auth" env:"BASIC_AUTH" description:"Also accept credentials in an Authorization: Basic header, checked at most once a minute"`
+
+	dial  func() (ldapConn, error)
+	codes *loginCodes
+	cache *sync.Map
+}
+
+// ldapConn is the part of the LDAP connection used
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// ldapTimeout bounds each connection to the directory
+const ldapTimeout = 5 * time.Second
+
+// basicAuthCacheTTL is how long Basic auth credentials are accepted without
+// checking them with the directory again
+const basicAuthCacheTTL = time.Minute
+
+// ErrInvalidCredentials is returned when the username or password is wrong
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// Name returns the name of the provider
+func (l *LDAP) Name() string {
+	return "ldap"
+}
+
+// Setup performs validation and setup
+func (l *LDAP) Setup() error {
+	if l.URL == "" || l.BaseDN == "" {
+		return errors.New("providers.ldap.url, providers.ldap.base-dn must be set")
+	}
+	u, err := url.Parse(l.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return errors.New("providers.ldap.url must be an ldap or ldaps URL")
+	}
+	if l.StartTLS && u.Scheme != "ldap" {
+		return errors.New("providers.ldap.start-tls is only used with ldap:// URLs")
+	}
+	if !strings.Contains(l.UserFilter, "{username}") {
+		return errors.New("providers.ldap.user-filter must contain {username}")
+	}
+	if l.BindDN != "" && l.BindPassword == "" {
+		return errors.New("providers.ldap.bind-password must be set with providers.ldap.bind-dn")
+	}
+
+	l.codes = newLoginCodes()
+	l.cache = &sync.Map{}
+	if l.dial == nil {
+		l.dial = l.dialDirectory
+	}
+	return nil
+}
+
+// dialDirectory connects to the directory
+func (l *LDAP) dialDirectory() (ldapConn, error) {
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if l.StartTLS {
+		u, _ := url.Parse(l.URL)
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// GetLoginURL returns the URL of the login form, next to the callback
+func (l *LDAP) GetLoginURL(redirectURI, state string) string {
+	q := url.Values{}
+	q.Set("state", state)
+	return redirectURI + "/ldap?" + q.Encode()
+}
+
+// ExchangeCode exchanges the code issued once the user's credentials were
+// checked for the user
+func (l *LDAP) ExchangeCode(redirectURI, code string) (*Token, error) {
+	if !l.codes.exchange(code) {
+		return nil, &Error{Code: "invalid_grant", Description: "login code is invalid, expired or already used"}
+	}
+	return &Token{AccessToken: code}, nil
+}
+
+// GetUser returns the user the exchanged code was issued for
+func (l *LDAP) GetUser(token *Token) (*User, error) {
+	user := l.codes.user(token.AccessToken)
+	if user == nil {
+		return nil, errors.New("login code is invalid, expired or already used")
+	}
+	return user, nil
+}
+
+// IssueCode returns a one-time code the callback exchanges for the user
+func (l *LDAP) IssueCode(user *User) (string, error) {
+	return l.codes.issue(user)
+}
+
+// Authenticate checks the username and password with the directory,
+// returning the user with their groups as roles
+func (l *LDAP) Authenticate(username, password string) (*User, error) {
+	// An empty password is an unauthenticated bind, which servers accept
+	// whatever the DN
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to the directory: %v", err)
+	}
+	defer conn.Close()
+
+	if err := l.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	// Find the user
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		strings.ReplaceAll(l.UserFilter, "{username}", ldap.EscapeFilter(username)),
+		[]string{l.EmailAttribute, l.NameAttribute}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for the user: %v", err)
+	}
+	if len(res.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	// Check their password
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("unable to bind as the user: %v", err)
+	}
+
+	user := newUser()
+	user.Email = entry.GetAttributeValue(l.EmailAttribute)
+	if user.Email == "" {
+		user.Email = username
+	}
+	user.Name = entry.GetAttributeValue(l.NameAttribute)
+	user.Claims = map[string]interface{}{
+		"dn":       entry.DN,
+		"username": username,
+	}
+
+	// Find their groups, as the service account again
+	if err := l.bindService(conn); err != nil {
+		return nil, err
+	}
+	groupBaseDN := l.GroupBaseDN
+	if groupBaseDN == "" {
+		groupBaseDN = l.BaseDN
+	}
+	filter := strings.NewReplacer("{dn}", ldap.EscapeFilter(entry.DN), "{username}", ldap.EscapeFilter(username)).Replace(l.GroupFilter)
+	res, err = conn.Search(ldap.NewSearchRequest(
+		groupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout/time.Second), false,
+		filter, []string{l.GroupNameAttribute}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for the user's groups: %v", err)
+	}
+	for _, group := range res.Entries {
+		if name := group.GetAttributeValue(l.GroupNameAttribute); name != "" {
+			user.Roles = append(user.Roles, name)
+		}
+	}
+	user.Claims["groups"] = append([]string(nil), user.Roles...)
+
+	return user, nil
+}
+
+// bindService binds as the bind-dn, if set
+func (l *LDAP) bindService(conn ldapConn) error {
+	if l.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+		return fmt.Errorf("unable to bind as providers.ldap.bind-dn: %v", err)
+	}
+	return nil
+}
+
+// AcceptsBasicAuth reports whether "basic-auth" is set
+func (l *LDAP) AcceptsBasicAuth() bool {
+	return l.BasicAuth
+}
+
+// basicAuthEntry is a cached Basic auth login
+type basicAuthEntry struct {
+	user    *User
+	expires time.Time
+}
+
+// AuthenticateBasic is Authenticate, caching successful logins for a minute
+// so each request with the same credentials doesn't bind to the directory
+func (l *LDAP) AuthenticateBasic(username, password string) (*User, error) {
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+
+	now := time.Now()
+	if cached, ok := l.cache.Load(key); ok {
+		entry := cached.(basicAuthEntry)
+		if now.Before(entry.expires) {
+			return copyUser(entry.user), nil
+		}
+		l.cache.Delete(key)
+	}
+
+	user, err := l.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+	l.cache.Store(key, basicAuthEntry{user: copyUser(user), expires: now.Add(basicAuthCacheTTL)})
+	return user, nil
+}
+
+// copyUser copies the user, so a cached user isn't changed when the roles of
+// the one returned are mapped
+func copyUser(user *User) *User {
+	copied := *user
+	copied.Roles = append([]string(nil), user.Roles...)
+	copied.Claims = make(map[string]interface{}, len(user.Claims))
+	for k, v := range user.Claims {
+		copied.Claims[k] = v
+	}
+	return &copied
+}
+
+// Login codes
+
+// loginCodeTTL is how long the user has to reach the callback with the code
+const loginCodeTTL = time.Minute
+
+type loginCode struct {
+	user      *User
+	expires   time.Time
+	exchanged bool
+}
+
+// loginCodes holds the codes issued to users whose credentials were checked
+type loginCodes struct {
+	mu    sync.Mutex
+	codes map[string]*loginCode
+}
+
+func newLoginCodes() *loginCodes {
+	return &loginCodes{codes: make(map[string]*loginCode)}
+}
+
+func (c *loginCodes) issue(user *User) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range c.codes {
+		if now.After(entry.expires) {
+			delete(c.codes, key)
+		}
+	}
+	c.codes[code] = &loginCode{user: user, expires: now.Add(loginCodeTTL)}
+	return code, nil
+}
+
+// exchange marks the code used, returning false if it's unknown, expired or
+// was already exchanged
+func (c *loginCodes) exchange(code string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.codes[code]
+	if !ok || entry.exchanged || time.Now().After(entry.expires) {
+		return false
+	}
+	entry.exchanged = true
+	return true
+}
+
+// user returns the user of an exchanged code, forgetting the code
+func (c *loginCodes) user(code string) *User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.codes[code]
+	if !ok || !entry.exchanged {
+		return nil
+	}
+	delete(c.codes, code)
+	return entry.user
+}
@@ -0,0 +1,255 @@
+package provider
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests
+
+func TestLDAPName(t *testing.T) {
+	p := LDAP{}
+	assert.Equal(t, "ldap", p.Name())
+}
+
+func TestLDAPSetup(t *testing.T) {
+	assert := assert.New(t)
+	p := LDAP{UserFilter: "(uid={username})"}
+
+	err := p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.ldap.url, providers.ldap.base-dn must be set", err.Error())
+	}
+
+	p.URL = "https://ldap.example.com"
+	p.BaseDN = "dc=example,dc=com"
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.ldap.url must be an ldap or ldaps URL", err.Error())
+	}
+
+	p.URL = "ldaps://ldap.example.com"
+	p.StartTLS = true
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.ldap.start-tls is only used with ldap:// URLs", err.Error())
+	}
+
+	p.StartTLS = false
+	p.UserFilter = "(uid=alice)"
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.ldap.user-filter must contain {username}", err.Error())
+	}
+
+	p.UserFilter = "(uid={username})"
+	p.BindDN = "cn=tfa,dc=example,dc=com"
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.ldap.bind-password must be set with providers.ldap.bind-dn", err.Error())
+	}
+
+	p.BindPassword = "secret"
+	assert.Nil(p.Setup())
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	p, dir := setupLDAPTest(t)
+
+	// Should bind as the user and find their groups
+	user, err := p.Authenticate("alice", "alice-password")
+	require.Nil(err)
+	assert.Equal("alice@example.com", user.Email)
+	assert.Equal("Alice Smith", user.Name)
+	assert.Equal([]string{"admins", "developers"}, user.Roles)
+	assert.Equal("uid=alice,ou=people,dc=example,dc=com", user.Claims["dn"])
+	assert.Equal([]string{"admins", "developers"}, user.Claims["groups"])
+	assert.Equal([]string{
+		"cn=tfa,dc=example,dc=com",
+		"uid=alice,ou=people,dc=example,dc=com",
+		"cn=tfa,dc=example,dc=com",
+	}, dir.binds)
+	assert.Equal([]string{"(uid=alice)", "(member=uid=alice,ou=people,dc=example,dc=com)"}, dir.filters)
+	assert.True(dir.closed)
+
+	// Should fall back to the username without an email address
+	user, err = p.Authenticate("bob", "bob-password")
+	require.Nil(err)
+	assert.Equal("bob", user.Email)
+	assert.Nil(user.Roles)
+
+	// Should escape the username in the filter
+	dir.filters = nil
+	_, err = p.Authenticate("*)(uid=alice", "alice-password")
+	assert.Equal(ErrInvalidCredentials, err)
+	assert.Equal(`(uid=\2a\29\28uid=alice)`, dir.filters[0])
+
+	// Should refuse wrong passwords and unknown users
+	_, err = p.Authenticate("alice", "wrong")
+	assert.Equal(ErrInvalidCredentials, err)
+	_, err = p.Authenticate("carol", "carol-password")
+	assert.Equal(ErrInvalidCredentials, err)
+
+	// Should refuse empty passwords without binding
+	dir.binds = nil
+	_, err = p.Authenticate("alice", "")
+	assert.Equal(ErrInvalidCredentials, err)
+	assert.Nil(dir.binds)
+
+	// Should return other errors
+	dir.err = errors.New("connection reset")
+	_, err = p.Authenticate("alice", "alice-password")
+	if assert.Error(err) {
+		assert.NotEqual(ErrInvalidCredentials, err)
+		assert.Contains(err.Error(), "connection reset")
+	}
+}
+
+func TestLDAPCodes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	p, _ := setupLDAPTest(t)
+	assert.Equal("https://auth.example.com/_oauth/ldap?state=abc", p.GetLoginURL("https://auth.example.com/_oauth", "abc"))
+
+	user, err := p.Authenticate("alice", "alice-password")
+	require.Nil(err)
+	code, err := p.IssueCode(user)
+	require.Nil(err)
+
+	// Should exchange the code for the user
+	token, err := p.ExchangeCode("https://auth.example.com/_oauth", code)
+	require.Nil(err)
+	got, err := p.GetUser(token)
+	require.Nil(err)
+	assert.Equal(user, got)
+
+	// Should only exchange a code once
+	_, err = p.ExchangeCode("https://auth.example.com/_oauth", code)
+	if perr, ok := AsError(err); assert.True(ok) {
+		assert.Equal("invalid_grant", perr.Code)
+	}
+	_, err = p.GetUser(token)
+	assert.Error(err)
+
+	// Should refuse unknown codes
+	_, err = p.ExchangeCode("https://auth.example.com/_oauth", "unknown")
+	assert.Error(err)
+}
+
+func TestLDAPAuthenticateBasic(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	p, dir := setupLDAPTest(t)
+	p.BasicAuth = true
+	assert.True(p.AcceptsBasicAuth())
+
+	user, err := p.AuthenticateBasic("alice", "alice-password")
+	require.Nil(err)
+	assert.Equal("alice@example.com", user.Email)
+
+	// Should use the cached user, unchanged by the last caller
+	user.Roles = append(user.Roles, "mapped")
+	dir.binds = nil
+	user, err = p.AuthenticateBasic("alice", "alice-password")
+	require.Nil(err)
+	assert.Equal([]string{"admins", "developers"}, user.Roles)
+	assert.Nil(dir.binds)
+
+	// Should check other credentials with the directory
+	_, err = p.AuthenticateBasic("alice", "wrong")
+	assert.Equal(ErrInvalidCredentials, err)
+	assert.NotNil(dir.binds)
+}
+
+// Utils
+
+type ldapTestEntry struct {
+	password string
+	attrs    map[string][]string
+	groups   []string
+}
+
+// ldapTestDirectory is a fake directory recording the binds and searches made
+type ldapTestDirectory struct {
+	users   map[string]ldapTestEntry
+	binds   []string
+	filters []string
+	closed  bool
+	err     error
+}
+
+func (d *ldapTestDirectory) Bind(username, password string) error {
+	if d.err != nil {
+		return d.err
+	}
+	d.binds = append(d.binds, username)
+	if username == "cn=tfa,dc=example,dc=com" && password == "tfa-password" {
+		return nil
+	}
+	if entry, ok := d.users[username]; ok && entry.password == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (d *ldapTestDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.filters = append(d.filters, req.Filter)
+	res := &ldap.SearchResult{}
+
+	// Groups the user is a member of
+	if strings.HasPrefix(req.Filter, "(member=") {
+		dn := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "(member="), ")")
+		for _, group := range d.users[dn].groups {
+			res.Entries = append(res.Entries, ldap.NewEntry("cn="+group+",ou=groups,dc=example,dc=com", map[string][]string{"cn": {group}}))
+		}
+		return res, nil
+	}
+
+	// The user
+	for dn, entry := range d.users {
+		if req.Filter == "(uid="+entry.attrs["uid"][0]+")" {
+			res.Entries = append(res.Entries, ldap.NewEntry(dn, entry.attrs))
+		}
+	}
+	return res, nil
+}
+
+func (d *ldapTestDirectory) Close() {
+	d.closed = true
+}
+
+func setupLDAPTest(t *testing.T) (*LDAP, *ldapTestDirectory) {
+	dir := &ldapTestDirectory{users: map[string]ldapTestEntry{
+		"uid=alice,ou=people,dc=example,dc=com": {
+			password: "alice-password",
+			attrs:    map[string][]string{"uid": {"alice"}, "mail": {"alice@example.com"}, "cn": {"Alice Smith"}},
+			groups:   []string{"admins", "developers"},
+		},
+		"uid=bob,ou=people,dc=example,dc=com": {
+			password: "bob-password",
+			attrs:    map[string][]string{"uid": {"bob"}, "cn": {"Bob"}},
+		},
+	}}
+
+	p := &LDAP{
+		URL:                "ldap://ldap.example.com",
+		BindDN:             "cn=tfa,dc=example,dc=com",
+		BindPassword:       "tfa-password",
+		BaseDN:             "dc=example,dc=com",
+		UserFilter:         "(uid={username})",
+		EmailAttribute:     "mail",
+		NameAttribute:      "cn",
+		GroupFilter:        "(member={dn})",
+		GroupNameAttribute: "cn",
+	}
+	p.dial = func() (ldapConn, error) { return dir, nil }
+	require.Nil(t, p.Setup())
+	return p, dir
+}
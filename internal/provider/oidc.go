@@ -2,7 +2,14 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
@@ -14,25 +21,71 @@ type OIDC struct {
 	ClientID     string `long:"client-id" env:"CLIENT_ID" description:"Client ID"`
 	ClientSecret string `long:"client-secret" env:"CLIENT_SECRET" description:"Client Secret" json:"-"`
 
+	BearerAudience string   `long:"bearer-audience" env:"BEARER_AUDIENCE" description:"Audience access tokens must be issued for to be accepted as bearer tokens, bearer tokens aren't accepted if unset"`
+	RequiredClaims []string `long:"required-claim" env:"REQUIRED_CLAIM" env-delim:"," description:"Only allow users with this claim value, in the format claim=value, e.g. tid=<tenant id> for Azure AD, can be set multiple times"`
+	GraphGroups    bool     `long:"graph-groups" env:"GRAPH_GROUPS" description:"Look up the user's Azure AD groups with Microsoft Graph at login, for allowed-groups"`
+
+	// GraphGroupsURL lists the user's groups, set to Microsoft Graph on setup
+	GraphGroupsURL string
+
 	OAuthProvider
 
-	provider *oidc.Provider
-	verifier *oidc.IDTokenVerifier
+	name                  string
+	provider              *oidc.Provider
+	verifier              *oidc.IDTokenVerifier
+	bearerVerifier        *oidc.IDTokenVerifier
+	endSessionEndpoint    string
+	userInfoEndpoint      string
+	introspectionEndpoint string
+	jwksURI               string
+	required              requiredClaims
+	keys                  *oidcKeys
+}
+
+// oidcKeys records whether the provider's signing keys have been fetched
+type oidcKeys struct {
+	mu      sync.Mutex
+	fetched bool
+}
+
+// readyTimeout is how long to wait for the provider's keys when checking it's
+// ready
+const readyTimeout = 5 * time.Second
+
+// NewNamedOIDC creates an additional OIDC provider, named "oidc.<name>"
+func NewNamedOIDC(name string) *OIDC {
+	return &OIDC{name: "oidc." + name}
 }
 
 // Name returns the name of the provider
 func (o *OIDC) Name() string {
+	if o.name != "" {
+		return o.name
+	}
 	return "oidc"
 }
 
 // Setup performs validation and setup
 func (o *OIDC) Setup() error {
 	// Check parms
+	name := o.Name()
 	if o.IssuerURL == "" || o.ClientID == "" || o.ClientSecret == "" {
-		return errors.New("providers.oidc.issuer-url, providers.oidc.client-id, providers.oidc.client-secret must be set")
+		return fmt.Errorf("providers.%[1]s.issuer-url, providers.%[1]s.client-id, providers.%[1]s.client-secret must be set", name)
+	}
+	if err := validateCredentials(name, o.ClientID, o.ClientSecret); err != nil {
+		return err
+	}
+	if err := validateURL("providers."+name+".issuer-url", o.IssuerURL); err != nil {
+		return err
+	}
+	if o.GraphGroups && o.Resource != "" {
+		return fmt.Errorf("providers.%s.graph-groups needs a token for Microsoft Graph, so can't be used with a resource", name)
 	}
-
 	var err error
+	if o.required, err = parseRequiredClaims("providers."+name+".required-claim", o.RequiredClaims); err != nil {
+		return err
+	}
+
 	o.ctx = context.Background()
 
 	// Try to initiate provider
@@ -41,6 +94,22 @@ func (o *OIDC) Setup() error {
 		return err
 	}
 
+	// RP-initiated logout, the userinfo and introspection endpoints are
+	// optional
+	var claims struct {
+		EndSessionEndpoint    string `json:"end_session_endpoint"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := o.provider.Claims(&claims); err == nil {
+		o.endSessionEndpoint = claims.EndSessionEndpoint
+		o.userInfoEndpoint = claims.UserInfoEndpoint
+		o.introspectionEndpoint = claims.IntrospectionEndpoint
+		o.jwksURI = claims.JWKSURI
+	}
+	o.keys = &oidcKeys{}
+
 	// Create oauth2 config
 	o.Config = &oauth2.Config{
 		ClientID:     o.ClientID,
@@ -50,43 +119,144 @@ func (o *OIDC) Setup() error {
 		// "openid" is a required scope for OpenID Connect flows.
 		Scopes: []string{oidc.ScopeOpenID, "profile", "email"},
 	}
+	if o.GraphGroups {
+		o.Config.Scopes = append(o.Config.Scopes, "https://graph.microsoft.com/GroupMember.Read.All")
+		if o.GraphGroupsURL == "" {
+			o.GraphGroupsURL = "https://graph.microsoft.com/v1.0/me/transitiveMemberOf/microsoft.graph.group?$select=id,displayName"
+		}
+	}
 
-	// Create OIDC verifier
+	// Create OIDC verifiers
 	o.verifier = o.provider.Verifier(&oidc.Config{
 		ClientID: o.ClientID,
 	})
+	// ID tokens are issued for the client id, so they mustn't be accepted as
+	// access tokens
+	o.bearerVerifier = nil
+	if o.BearerAudience == o.ClientID && o.BearerAudience != "" {
+		return errors.New("providers.oidc.bearer-audience must not be the client-id, or ID tokens would be accepted as access tokens")
+	} else if o.BearerAudience != "" {
+		o.bearerVerifier = o.provider.Verifier(&oidc.Config{
+			ClientID: o.BearerAudience,
+		})
+	}
 
 	return nil
 }
 
+// Ready checks the discovery document has been fetched, and fetches the
+// provider's signing keys until they have been once. Tokens are verified with
+// keys fetched by the verifier, so this only shows they can be
+func (o *OIDC) Ready() error {
+	if o.provider == nil || o.keys == nil {
+		return errors.New("discovery document hasn't been fetched")
+	}
+
+	o.keys.mu.Lock()
+	defer o.keys.mu.Unlock()
+	if o.keys.fetched || o.jwksURI == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(o.ctx, readyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", o.jwksURI, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching signing keys: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching signing keys: %s returned %s", o.jwksURI, res.Status)
+	}
+
+	var keys struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&keys); err != nil {
+		return fmt.Errorf("fetching signing keys: %v", err)
+	} else if len(keys.Keys) == 0 {
+		return fmt.Errorf("fetching signing keys: %s has no keys", o.jwksURI)
+	}
+
+	o.keys.fetched = true
+	return nil
+}
+
+// ProbeURL returns the URL used to check the provider is available
+func (o *OIDC) ProbeURL() string {
+	return strings.TrimSuffix(o.IssuerURL, "/") + "/.well-known/openid-configuration"
+}
+
 // GetLoginURL provides the login url for the given redirect uri and state
 func (o *OIDC) GetLoginURL(redirectURI, state string) string {
 	return o.OAuthGetLoginURL(redirectURI, state)
 }
 
+// LogoutURL returns the provider's end session endpoint for the given id
+// token, or an empty string if the provider doesn't advertise one
+func (o *OIDC) LogoutURL(idToken, postLogoutRedirectURI string) string {
+	if o.endSessionEndpoint == "" {
+		return ""
+	}
+	u, err := url.Parse(o.endSessionEndpoint)
+	if err != nil {
+		return ""
+	}
+
+	q := u.Query()
+	q.Set("client_id", o.ClientID)
+	if idToken != "" {
+		q.Set("id_token_hint", idToken)
+	}
+	if postLogoutRedirectURI != "" {
+		q.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
 // ExchangeCode exchanges the given redirect uri and code for a token
-func (o *OIDC) ExchangeCode(redirectURI, code string) (string, error) {
-	token, err := o.OAuthExchangeCode(redirectURI, code)
+func (o *OIDC) ExchangeCode(redirectURI, code string) (*Token, error) {
+	oauthToken, err := o.OAuthExchangeCode(redirectURI, code)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// Ensure we have an ID token
+	token := newToken(oauthToken)
+	if token.IDToken == "" {
+		return nil, errors.New("Missing id_token")
 	}
 
-	// Extract ID token
-	rawIDToken, ok := token.Extra("id_token").(string)
-	if !ok {
-		return "", errors.New("Missing id_token")
+	return token, nil
+}
+
+// Refresh exchanges the refresh token for a new token
+func (o *OIDC) Refresh(refreshToken string) (*Token, error) {
+	token, err := o.OAuthRefresh(refreshToken)
+	if err != nil {
+		return nil, err
 	}
 
-	return rawIDToken, nil
+	return newToken(token), nil
 }
 
-// GetUser uses the given token and returns a complete provider.User object
-func (o *OIDC) GetUser(token string) (*User, error) {
+// GetUser uses the given token and returns a complete provider.User object.
+// Expired id tokens are rejected, and the token's expiry is recorded so the
+// session can be limited to it
+func (o *OIDC) GetUser(token *Token) (*User, error) {
 	// Parse & Verify ID Token
-	idToken, err := o.verifier.Verify(o.ctx, token)
+	idToken, err := o.verifier.Verify(o.ctx, token.IDToken)
 	if err != nil {
 		return nil, err
 	}
+	token.IDTokenExpiry = idToken.Expiry
 
 	var user = newUser()
 
@@ -94,6 +264,187 @@ func (o *OIDC) GetUser(token string) (*User, error) {
 	if err := idToken.Claims(user); err != nil {
 		return nil, err
 	}
+	if err := idToken.Claims(&user.Claims); err != nil {
+		return nil, err
+	}
 
+	// Many providers only return some claims, such as the email, from the
+	// userinfo endpoint, these fill in any missing from the ID token
+	if o.userInfoEndpoint != "" && token.AccessToken != "" {
+		if err := o.addUserInfo(user, idToken.Subject, token.AccessToken); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := o.required.check(user.Claims); err != nil {
+		return nil, err
+	}
 	return user, nil
 }
+
+// addUserInfo merges the claims from the userinfo endpoint into the user,
+// claims from the ID token take precedence
+func (o *OIDC) addUserInfo(user *User, subject, accessToken string) error {
+	info, err := o.provider.UserInfo(o.ctx, oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: accessToken,
+	}))
+	if err != nil {
+		return err
+	}
+
+	// The response must be for the same user as the ID token
+	if info.Subject != subject {
+		return errors.New("userinfo subject does not match the id_token")
+	}
+
+	var claims map[string]interface{}
+	if err := info.Claims(&claims); err != nil {
+		return err
+	}
+	if user.Claims == nil {
+		user.Claims = make(map[string]interface{})
+	}
+	for name, value := range claims {
+		if _, ok := user.Claims[name]; !ok {
+			user.Claims[name] = value
+		}
+	}
+
+	b, err := json.Marshal(user.Claims)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, user)
+}
+
+// ResolveGroups returns the object ids and display names of the groups the
+// user is a member of, directly or through other groups. The access token
+// must be for Microsoft Graph, so this can't be combined with a resource
+func (o *OIDC) ResolveGroups(token *Token, user *User) ([]string, error) {
+	if !o.GraphGroups {
+		return nil, nil
+	}
+
+	groups := []string{}
+	next := o.GraphGroupsURL
+	for next != "" {
+		var page struct {
+			Value []struct {
+				ID          string `json:"id"`
+				DisplayName string `json:"displayName"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := getJSON(next, token.AccessToken, &page); err != nil {
+			return nil, err
+		}
+		for _, g := range page.Value {
+			groups = append(groups, g.ID)
+			if g.DisplayName != "" {
+				groups = append(groups, g.DisplayName)
+			}
+		}
+		next = page.NextLink
+	}
+	return groups, nil
+}
+
+// VerifyBearer validates an access token sent by a non-browser client. JWTs
+// are verified against the provider's keys, other tokens are checked with the
+// provider's introspection endpoint. Either way the token must be issued for
+// the bearer audience
+func (o *OIDC) VerifyBearer(ctx context.Context, token string) (*User, error) {
+	if o.bearerVerifier == nil {
+		return nil, errors.New("providers.oidc.bearer-audience isn't set, so bearer tokens aren't accepted")
+	}
+
+	var claims map[string]interface{}
+	if strings.Count(token, ".") == 2 {
+		accessToken, err := o.bearerVerifier.Verify(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		if err := accessToken.Claims(&claims); err != nil {
+			return nil, err
+		}
+	} else if o.introspectionEndpoint != "" {
+		var err error
+		if claims, err = o.introspect(ctx, token); err != nil {
+			return nil, err
+		}
+		if !introspectedFor(claims, o.BearerAudience) {
+			return nil, errors.New("token wasn't issued for the bearer audience")
+		}
+	} else {
+		return nil, errors.New("token is not a JWT and the provider has no introspection endpoint")
+	}
+
+	if err := o.required.check(claims); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	user := newUser()
+	if err := json.Unmarshal(b, user); err != nil {
+		return nil, err
+	}
+	user.Claims = claims
+	return user, nil
+}
+
+// introspectionClient bounds how long a bearer request waits on the provider
+var introspectionClient = &http.Client{Timeout: 5 * time.Second}
+
+// introspect asks the provider whether the token is active, returning the
+// claims it has for the token (RFC 7662)
+func (o *OIDC) introspect(ctx context.Context, token string) (map[string]interface{}, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.introspectionEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+
+	res, err := introspectionClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned %s", res.Status)
+	}
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, errors.New("token is not active")
+	}
+	delete(claims, "active")
+	return claims, nil
+}
+
+// introspectedFor reports whether the introspected token's aud, or the
+// client_id it was issued to, is the audience
+func introspectedFor(claims map[string]interface{}, audience string) bool {
+	if clientID, _ := claims["client_id"].(string); clientID == audience {
+		return true
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
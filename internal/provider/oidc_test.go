@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
@@ -23,6 +24,18 @@ func TestOIDCName(t *testing.T) {
 	assert.Equal(t, "oidc", p.Name())
 }
 
+func TestOIDCNamed(t *testing.T) {
+	assert := assert.New(t)
+	p := NewNamedOIDC("corp")
+	assert.Equal("oidc.corp", p.Name())
+
+	// Should name the provider's options in errors
+	err := p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.oidc.corp.issuer-url, providers.oidc.corp.client-id, providers.oidc.corp.client-secret must be set", err.Error())
+	}
+}
+
 func TestOIDCSetup(t *testing.T) {
 	assert := assert.New(t)
 	p := OIDC{}
@@ -33,6 +46,43 @@ func TestOIDCSetup(t *testing.T) {
 	}
 }
 
+func TestOIDCReady(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should not be ready before discovery
+	p := OIDC{}
+	assert.Error(p.Ready())
+
+	// Should fetch the signing keys
+	provider, server, serverURL, _ := setupOIDCTest(t, nil)
+	assert.Equal(serverURL.String()+"/jwks", provider.jwksURI)
+	assert.Nil(provider.Ready())
+
+	// Should not fetch them again
+	server.Close()
+	assert.Nil(provider.Ready())
+
+	// Should not be ready while the keys can't be fetched
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	provider.jwksURI = missing.URL
+	provider.keys = &oidcKeys{}
+	err := provider.Ready()
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "404")
+	}
+
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"keys":[]}`)
+	}))
+	defer empty.Close()
+	provider.jwksURI = empty.URL
+	err = provider.Ready()
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "has no keys")
+	}
+}
+
 func TestOIDCGetLoginURL(t *testing.T) {
 	assert := assert.New(t)
 
@@ -88,6 +138,33 @@ func TestOIDCGetLoginURL(t *testing.T) {
 	assert.Equal("", provider.Config.RedirectURL)
 }
 
+func TestOIDCLogoutURL(t *testing.T) {
+	assert := assert.New(t)
+
+	provider, server, serverURL, _ := setupOIDCTest(t, nil)
+	defer server.Close()
+
+	// Should use the advertised end session endpoint
+	uri, err := url.Parse(provider.LogoutURL("id_123", "https://example.com/bye"))
+	assert.Nil(err)
+	assert.Equal(serverURL.Host, uri.Host)
+	assert.Equal("/logout", uri.Path)
+	assert.Equal(url.Values{
+		"client_id":                []string{"idtest"},
+		"id_token_hint":            []string{"id_123"},
+		"post_logout_redirect_uri": []string{"https://example.com/bye"},
+		"ui":                       []string{"1"},
+	}, uri.Query())
+
+	// Should omit the redirect if there isn't one
+	uri, _ = url.Parse(provider.LogoutURL("id_123", ""))
+	assert.NotContains(uri.Query(), "post_logout_redirect_uri")
+
+	// Should not log out of providers without an end session endpoint
+	provider.endSessionEndpoint = ""
+	assert.Equal("", provider.LogoutURL("id_123", ""))
+}
+
 func TestOIDCExchangeCode(t *testing.T) {
 	assert := assert.New(t)
 
@@ -102,7 +179,7 @@ func TestOIDCExchangeCode(t *testing.T) {
 
 	token, err := provider.ExchangeCode("http://example.com/_oauth", "code")
 	assert.Nil(err)
-	assert.Equal("id_123456789", token)
+	assert.Equal("id_123456789", token.IDToken)
 }
 
 func TestOIDCGetUser(t *testing.T) {
@@ -118,13 +195,182 @@ func TestOIDCGetUser(t *testing.T) {
 		"aud": "idtest",
 		"sub": "1",
 		"email": "example@example.com",
-		"email_verified": true
+		"email_verified": true,
+		"department": "engineering"
 	}`))
 
 	// Get user
-	user, err := provider.GetUser(token)
+	userToken := &Token{IDToken: token}
+	user, err := provider.GetUser(userToken)
+	assert.Nil(err)
+	assert.Equal("example@example.com", user.Email)
+	assert.Equal("engineering", user.Claims["department"], "should keep raw claims")
+
+	// Should record the id token expiry
+	assert.WithinDuration(time.Now().Add(time.Hour), userToken.IDTokenExpiry, time.Minute)
+	assert.Equal(userToken.IDTokenExpiry, userToken.SessionExpiry())
+
+	// Should reject expired id tokens
+	expired := key.sign(t, []byte(`{
+		"iss": "`+serverURL.String()+`",
+		"exp":`+strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)+`,
+		"aud": "idtest",
+		"sub": "1",
+		"email": "example@example.com"
+	}`))
+	_, err = provider.GetUser(&Token{IDToken: expired})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "expired")
+	}
+
+	// Should check required claims
+	provider.required = requiredClaims{"department": {"sales"}}
+	_, err = provider.GetUser(&Token{IDToken: token})
+	if assert.Error(err) {
+		assert.Equal(`access_denied: department claim "engineering" is not allowed`, err.Error())
+	}
+}
+
+func TestOIDCGetUserInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	provider, server, serverURL, key := setupOIDCTest(t, nil)
+	defer server.Close()
+
+	newIDToken := func(sub string) string {
+		return key.sign(t, []byte(`{
+			"iss": "`+serverURL.String()+`",
+			"exp":`+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)+`,
+			"aud": "idtest",
+			"sub": "`+sub+`",
+			"department": "engineering"
+		}`))
+	}
+
+	// Should fill in claims missing from the id token
+	user, err := provider.GetUser(&Token{IDToken: newIDToken("1"), AccessToken: "123456789"})
+	assert.Nil(err)
+	assert.Equal("example@example.com", user.Email)
+	assert.Equal("Example User", user.Name)
+	assert.Equal([]interface{}{"engineering"}, user.Claims["groups"])
+	assert.Equal("engineering", user.Claims["department"], "should prefer the id token")
+
+	// Should reject userinfo for another user
+	_, err = provider.GetUser(&Token{IDToken: newIDToken("2"), AccessToken: "123456789"})
+	if assert.Error(err) {
+		assert.Equal("userinfo subject does not match the id_token", err.Error())
+	}
+}
+
+func TestOIDCVerifyBearer(t *testing.T) {
+	assert := assert.New(t)
+
+	provider, server, serverURL, key := setupOIDCTest(t, nil)
+	defer server.Close()
+
+	newAccessToken := func(aud string) string {
+		return key.sign(t, []byte(`{
+			"iss": "`+serverURL.String()+`",
+			"exp":`+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)+`,
+			"aud": "`+aud+`",
+			"sub": "1",
+			"email": "example@example.com",
+			"roles": ["admin"]
+		}`))
+	}
+
+	// Should only accept tokens once the bearer audience is set
+	ctx := context.Background()
+	_, err := provider.VerifyBearer(ctx, newAccessToken("idtest"))
+	if assert.Error(err) {
+		assert.Equal("providers.oidc.bearer-audience isn't set, so bearer tokens aren't accepted", err.Error())
+	}
+	_, err = provider.VerifyBearer(ctx, "opaque_123456789")
+	if assert.Error(err) {
+		assert.Equal("providers.oidc.bearer-audience isn't set, so bearer tokens aren't accepted", err.Error())
+	}
+
+	// Should refuse the client id as the bearer audience
+	provider.BearerAudience = "idtest"
+	err = provider.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.oidc.bearer-audience must not be the client-id, or ID tokens would be accepted as access tokens", err.Error())
+	}
+
+	// Should verify JWTs against the provider's keys
+	provider.BearerAudience = "api"
+	assert.Nil(provider.Setup())
+	user, err := provider.VerifyBearer(ctx, newAccessToken("api"))
+	assert.Nil(err, "should accept the bearer audience")
+	assert.Equal("example@example.com", user.Email)
+	assert.Equal([]string{"admin"}, user.Roles)
+	_, err = provider.VerifyBearer(ctx, newAccessToken("idtest"))
+	assert.Error(err, "should refuse ID tokens")
+
+	// Should introspect other tokens
+	user, err = provider.VerifyBearer(ctx, "opaque_123456789")
 	assert.Nil(err)
 	assert.Equal("example@example.com", user.Email)
+	assert.Equal("read", user.Claims["scope"])
+	assert.NotContains(user.Claims, "active")
+
+	_, err = provider.VerifyBearer(ctx, "opaque_revoked")
+	if assert.Error(err) {
+		assert.Equal("token is not active", err.Error())
+	}
+
+	// Should refuse introspected tokens issued for another audience
+	_, err = provider.VerifyBearer(ctx, "opaque_other")
+	if assert.Error(err) {
+		assert.Equal("token wasn't issued for the bearer audience", err.Error())
+	}
+	user, err = provider.VerifyBearer(ctx, "opaque_client")
+	assert.Nil(err, "should accept the bearer audience as the client_id")
+	assert.Equal("example@example.com", user.Email)
+
+	provider.introspectionEndpoint = ""
+	_, err = provider.VerifyBearer(ctx, "opaque_123456789")
+	if assert.Error(err) {
+		assert.Equal("token is not a JWT and the provider has no introspection endpoint", err.Error())
+	}
+}
+
+func TestOIDCResolveGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	// Setup Microsoft Graph returning two pages of groups
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("Bearer 123456789", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("$skiptoken") == "" {
+			fmt.Fprintf(w, `{"value":[{"id":"1f0c","displayName":"Engineering"}],"@odata.nextLink":"%s/groups?$skiptoken=2"}`, server.URL)
+			return
+		}
+		fmt.Fprint(w, `{"value":[{"id":"77aa","displayName":null}]}`)
+	}))
+	defer server.Close()
+
+	p := &OIDC{GraphGroupsURL: server.URL + "/groups"}
+	user := &User{Email: "example@example.com"}
+
+	// Should not look groups up unless enabled
+	groups, err := p.ResolveGroups(&Token{AccessToken: "123456789"}, user)
+	assert.Nil(err)
+	assert.Nil(groups)
+
+	// Should return the ids and names of the groups on every page
+	p.GraphGroups = true
+	groups, err = p.ResolveGroups(&Token{AccessToken: "123456789"}, user)
+	assert.Nil(err)
+	assert.Equal([]string{"1f0c", "Engineering", "77aa"}, groups)
+
+	// Should refuse a resource, as the token must be for Microsoft Graph
+	p = &OIDC{IssuerURL: "https://login.microsoftonline.com/tenant/v2.0", ClientID: "idtest", ClientSecret: "sectest", GraphGroups: true}
+	p.Resource = "api://backend"
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.oidc.graph-groups needs a token for Microsoft Graph, so can't be used with a resource", err.Error())
+	}
 }
 
 // Utils
@@ -193,7 +439,10 @@ func (s *OIDCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"issuer":"`+s.url.String()+`",
 			"authorization_endpoint":"`+s.url.String()+`/auth",
 			"token_endpoint":"`+s.url.String()+`/token",
-			"jwks_uri":"`+s.url.String()+`/jwks"
+			"jwks_uri":"`+s.url.String()+`/jwks",
+			"userinfo_endpoint":"`+s.url.String()+`/userinfo",
+			"introspection_endpoint":"`+s.url.String()+`/introspect",
+			"end_session_endpoint":"`+s.url.String()+`/logout?ui=1"
 		}`)
 	} else if r.URL.Path == "/token" {
 		// Token request
@@ -209,6 +458,38 @@ func (s *OIDCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"access_token":"123456789",
 			"id_token":"id_123456789"
 		}`)
+	} else if r.URL.Path == "/userinfo" {
+		// User info request
+		if r.Header.Get("Authorization") != "Bearer 123456789" {
+			s.t.Fatal("Unexpected authorization header, got", r.Header.Get("Authorization"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"sub":"1",
+			"email":"example@example.com",
+			"name":"Example User",
+			"department":"sales",
+			"groups":["engineering"]
+		}`)
+	} else if r.URL.Path == "/introspect" {
+		// Token introspection request
+		if id, secret, _ := r.BasicAuth(); id != "idtest" || secret != "sectest" {
+			s.t.Fatal("Unexpected client credentials, got", id, secret)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		form, _ := url.ParseQuery(string(body))
+		switch form.Get("token") {
+		case "opaque_123456789":
+			fmt.Fprint(w, `{"active":true,"sub":"1","email":"example@example.com","scope":"read","aud":["api","other"]}`)
+		case "opaque_client":
+			fmt.Fprint(w, `{"active":true,"sub":"1","email":"example@example.com","client_id":"api"}`)
+		case "opaque_other":
+			fmt.Fprint(w, `{"active":true,"sub":"1","email":"example@example.com","aud":"other"}`)
+		default:
+			fmt.Fprint(w, `{"active":false}`)
+		}
 	} else if r.URL.Path == "/jwks" {
 		// Key request
 		w.Header().Set("Content-Type", "application/json")
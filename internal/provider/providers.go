@@ -2,6 +2,16 @@ package provider
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/google/uuid"
 
 	// "net/url"
@@ -14,19 +24,171 @@ type Providers struct {
 	Google       Google       `group:"Google Provider" namespace:"google" env-namespace:"GOOGLE"`
 	OIDC         OIDC         `group:"OIDC Provider" namespace:"oidc" env-namespace:"OIDC"`
 	GenericOAuth GenericOAuth `group:"Generic OAuth2 Provider" namespace:"generic-oauth" env-namespace:"GENERIC_OAUTH"`
+	Tailscale    Tailscale    `group:"Tailscale Provider" namespace:"tailscale" env-namespace:"TAILSCALE"`
+	LDAP         LDAP         `group:"LDAP Provider" namespace:"ldap" env-namespace:"LDAP"`
+	SAML         SAML         `group:"SAML Provider" namespace:"saml" env-namespace:"SAML"`
 }
 
 // Provider is used to authenticate users
 type Provider interface {
 	Name() string
 	GetLoginURL(redirectURI, state string) string
-	ExchangeCode(redirectURI, code string) (string, error)
-	GetUser(token string) (*User, error)
+	ExchangeCode(redirectURI, code string) (*Token, error)
+	GetUser(token *Token) (*User, error)
 	Setup() error
 }
 
+// Prober is implemented by providers that expose an endpoint which can be
+// requested to check the provider is available
+type Prober interface {
+	ProbeURL() string
+}
+
+// Readier is implemented by providers that need documents from the provider,
+// such as its signing keys, before users can log in with it
+type Readier interface {
+	// Ready fetches the documents if they haven't been yet, returning an
+	// error while they can't be
+	Ready() error
+}
+
+// Refresher is implemented by providers that can exchange a refresh token for
+// a new token, used to check the user hasn't revoked the application's consent
+type Refresher interface {
+	Refresh(refreshToken string) (*Token, error)
+}
+
+// Logouter is implemented by providers that can end the user's session at the
+// provider when they log out, e.g. OpenID Connect RP-initiated logout
+type Logouter interface {
+	// LogoutURL returns the URL to send the user to, or an empty string if
+	// the provider doesn't support logout
+	LogoutURL(idToken, postLogoutRedirectURI string) string
+}
+
+// Identifier is implemented by providers that identify users from the address
+// they connect from rather than an interactive login
+type Identifier interface {
+	Identify(ip string) (*User, error)
+}
+
+// BearerVerifier is implemented by providers that can validate the access
+// tokens non-browser clients send in the Authorization header
+type BearerVerifier interface {
+	VerifyBearer(ctx context.Context, token string) (*User, error)
+}
+
+// PasswordAuthenticator is implemented by providers that check the user's
+// username and password, entered in a password prompt served by
+// traefik-forward-auth rather than the provider
+type PasswordAuthenticator interface {
+	Authenticate(username, password string) (*User, error)
+	// IssueCode returns a one-time code the callback exchanges for the user
+	IssueCode(user *User) (string, error)
+}
+
+// BasicAuthenticator is implemented by providers that can check credentials
+// sent in an Authorization: Basic header
+type BasicAuthenticator interface {
+	AcceptsBasicAuth() bool
+	AuthenticateBasic(username, password string) (*User, error)
+}
+
+// GroupResolver is implemented by providers that can look up the groups the
+// user is a member of in the provider's directory, with the access token
+// issued at login. It returns nil if group lookups aren't enabled
+type GroupResolver interface {
+	ResolveGroups(token *Token, user *User) ([]string, error)
+}
+
+// Token holds the tokens returned by the provider following a code exchange
+type Token struct {
+	AccessToken  string
+	IDToken      string
+	RefreshToken string
+
+	// Expiry is when the access token expires, zero if unknown
+	Expiry time.Time
+
+	// RefreshExpiry is when the refresh token expires, zero if unknown
+	RefreshExpiry time.Time
+
+	// IDTokenExpiry is when the id token expires, zero if unknown. It's set
+	// by providers that verify the id token
+	IDTokenExpiry time.Time
+}
+
+// SessionExpiry returns when the authorization granted by the provider ends,
+// zero if unknown. When a refresh token is issued the session lasts as long as
+// the refresh token, otherwise it ends when the access or id token expires,
+// whichever is first
+func (t *Token) SessionExpiry() time.Time {
+	if !t.RefreshExpiry.IsZero() {
+		return t.RefreshExpiry
+	}
+	if t.RefreshToken != "" {
+		return time.Time{}
+	}
+	if !t.IDTokenExpiry.IsZero() && (t.Expiry.IsZero() || t.IDTokenExpiry.Before(t.Expiry)) {
+		return t.IDTokenExpiry
+	}
+	return t.Expiry
+}
+
+// token is the json token response, for providers that don't use the oauth2
+// library
 type token struct {
-	Token string `json:"access_token"`
+	AccessToken           string `json:"access_token"`
+	IDToken               string `json:"id_token"`
+	RefreshToken          string `json:"refresh_token"`
+	ExpiresIn             int64  `json:"expires_in"`
+	RefreshTokenExpiresIn int64  `json:"refresh_token_expires_in"`
+}
+
+func (t *token) Token() *Token {
+	token := &Token{
+		AccessToken:  t.AccessToken,
+		IDToken:      t.IDToken,
+		RefreshToken: t.RefreshToken,
+	}
+	if t.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	if t.RefreshTokenExpiresIn > 0 {
+		token.RefreshExpiry = time.Now().Add(time.Duration(t.RefreshTokenExpiresIn) * time.Second)
+	}
+	return token
+}
+
+// newToken converts a token from the oauth2 library, including the non
+// standard refresh token expiry returned by some providers (e.g. keycloak)
+func newToken(t *oauth2.Token) *Token {
+	token := &Token{
+		AccessToken:  t.AccessToken,
+		RefreshToken: t.RefreshToken,
+		Expiry:       t.Expiry,
+	}
+	if idToken, ok := t.Extra("id_token").(string); ok {
+		token.IDToken = idToken
+	}
+	for _, key := range []string{"refresh_expires_in", "refresh_token_expires_in"} {
+		if expiresIn := extraSeconds(t, key); expiresIn > 0 {
+			token.RefreshExpiry = time.Now().Add(expiresIn)
+		}
+	}
+	return token
+}
+
+func extraSeconds(t *oauth2.Token, key string) time.Duration {
+	switch v := t.Extra(key).(type) {
+	case float64:
+		return time.Duration(v) * time.Second
+	case string:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Duration(i) * time.Second
+		}
+	}
+	return 0
 }
 
 // User is the authenticated user
@@ -35,6 +197,46 @@ type User struct {
 	Email string   `json:"email"`
 	Name  string   `json:"name"`
 	Roles []string `json:"roles"`
+
+	// Groups are the user's groups in the provider's directory, looked up at
+	// login by providers implementing GroupResolver
+	Groups []string `json:"groups,omitempty"`
+
+	// Avatar is the URL of the user's picture, taken from their claims at
+	// login
+	Avatar string `json:"-"`
+
+	// SessionExpiry is when the provider side session ends, zero if unknown
+	// or not enforced
+	SessionExpiry time.Time `json:"-"`
+
+	// Claims holds the raw claims returned by the provider
+	Claims map[string]interface{} `json:"-"`
+
+	// Headers holds headers to pass to backends, set by the login script
+	Headers map[string]string `json:"-"`
+}
+
+// decodeUser decodes a user from a JSON userinfo response, keeping the raw
+// claims. Each login is a new session, so the user gets a new UUID even if the
+// response has a "uuid" claim
+func decodeUser(r io.Reader) (*User, error) {
+	user := newUser()
+	id := user.UUID
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return user, err
+	}
+	if err := json.Unmarshal(b, user); err != nil {
+		return user, err
+	}
+	if err := json.Unmarshal(b, &user.Claims); err != nil {
+		return user, err
+	}
+	user.UUID = id
+
+	return user, nil
 }
 
 func newUser() *User {
@@ -47,7 +249,7 @@ func newUser() *User {
 type OAuthProvider struct {
 	Resource string `long:"resource" env:"RESOURCE" description:"Optional resource indicator"`
 
-	Config *oauth2.Config
+	Config *oauth2.Config `json:"-"`
 	ctx    context.Context
 }
 
@@ -75,3 +277,96 @@ func (p *OAuthProvider) OAuthExchangeCode(redirectURI, code string) (*oauth2.Tok
 	config := p.ConfigCopy(redirectURI)
 	return config.Exchange(p.ctx, code)
 }
+
+// OAuthRefresh provides a base "Refresh" for providers using OAuth2
+func (p *OAuthProvider) OAuthRefresh(refreshToken string) (*oauth2.Token, error) {
+	return p.Config.TokenSource(p.ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+}
+
+// getJSON requests the url with the access token, decoding the JSON response
+// into v
+func getJSON(u, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errorFromResponse(res)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// validateCredentials catches common copy and paste mistakes in the client
+// credentials, which would otherwise only surface as failed logins
+func validateCredentials(name, clientID, clientSecret string) error {
+	if strings.TrimSpace(clientID) != clientID {
+		return fmt.Errorf("providers.%s.client-id must not contain leading or trailing whitespace", name)
+	}
+	if strings.TrimSpace(clientSecret) != clientSecret {
+		return fmt.Errorf("providers.%s.client-secret must not contain leading or trailing whitespace", name)
+	}
+	return nil
+}
+
+// validateURL checks the given option is an absolute http(s) URL
+func validateURL(option, value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an absolute http or https URL", option)
+	}
+	return nil
+}
+
+// requiredClaims maps each claim a user must have to the values it may take,
+// pinning the provider to the expected tenants or domains
+type requiredClaims map[string][]string
+
+// parseRequiredClaims parses "required-claim" values in the format
+// claim=value
+func parseRequiredClaims(option string, values []string) (requiredClaims, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	required := make(requiredClaims)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid %s %q, must be in the format claim=value", option, value)
+		}
+		required[parts[0]] = append(required[parts[0]], parts[1])
+	}
+	return required, nil
+}
+
+// check returns an access_denied error unless each required claim has one of
+// its values
+func (r requiredClaims) check(claims map[string]interface{}) error {
+	for name, values := range r {
+		value, ok := claims[name]
+		if !ok {
+			return &Error{Code: "access_denied", Description: fmt.Sprintf("%s claim is missing", name)}
+		}
+
+		s := fmt.Sprint(value)
+		allowed := false
+		for _, v := range values {
+			if s == v {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &Error{Code: "access_denied", Description: fmt.Sprintf("%s claim %q is not allowed", name, s)}
+		}
+	}
+	return nil
+}
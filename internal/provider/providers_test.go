@@ -6,9 +6,115 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
 )
 
+// Tests
+
+func TestTokenSessionExpiry(t *testing.T) {
+	assert := assert.New(t)
+	expiry := time.Now().Add(time.Hour)
+	refreshExpiry := time.Now().Add(time.Hour * 24)
+
+	// Should use access token expiry without refresh token
+	token := &Token{Expiry: expiry}
+	assert.Equal(expiry, token.SessionExpiry())
+
+	// Should use the id token expiry if it's earlier
+	idExpiry := time.Now().Add(time.Minute * 30)
+	token = &Token{Expiry: expiry, IDTokenExpiry: idExpiry}
+	assert.Equal(idExpiry, token.SessionExpiry())
+	token = &Token{IDTokenExpiry: idExpiry}
+	assert.Equal(idExpiry, token.SessionExpiry())
+	token = &Token{Expiry: expiry, IDTokenExpiry: expiry.Add(time.Hour)}
+	assert.Equal(expiry, token.SessionExpiry())
+
+	// Should be unknown with refresh token of unknown expiry
+	token = &Token{Expiry: expiry, RefreshToken: "refresh"}
+	assert.True(token.SessionExpiry().IsZero())
+
+	// Should use refresh token expiry
+	token = &Token{Expiry: expiry, RefreshToken: "refresh", RefreshExpiry: refreshExpiry}
+	assert.Equal(refreshExpiry, token.SessionExpiry())
+}
+
+func TestNewToken(t *testing.T) {
+	assert := assert.New(t)
+	expiry := time.Now().Add(time.Hour)
+
+	token := newToken((&oauth2.Token{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		Expiry:       expiry,
+	}).WithExtra(map[string]interface{}{
+		"id_token":           "id",
+		"refresh_expires_in": float64(1800),
+	}))
+
+	assert.Equal("access", token.AccessToken)
+	assert.Equal("refresh", token.RefreshToken)
+	assert.Equal("id", token.IDToken)
+	assert.Equal(expiry, token.Expiry)
+	assert.WithinDuration(time.Now().Add(30*time.Minute), token.RefreshExpiry, 10*time.Second)
+}
+
+func TestRequiredClaims(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := parseRequiredClaims("providers.oidc.required-claim", []string{"tid"})
+	if assert.Error(err) {
+		assert.Equal(`invalid providers.oidc.required-claim "tid", must be in the format claim=value`, err.Error())
+	}
+
+	required, err := parseRequiredClaims("providers.oidc.required-claim", []string{"tid=a", "tid=b", "verified=true"})
+	assert.Nil(err)
+	assert.Equal(requiredClaims{"tid": {"a", "b"}, "verified": {"true"}}, required)
+
+	// Should allow any of the values of a claim
+	assert.Nil(required.check(map[string]interface{}{"tid": "b", "verified": true}))
+
+	// Should refuse other values and missing claims
+	err = required.check(map[string]interface{}{"tid": "c", "verified": true})
+	if assert.Error(err) {
+		assert.Equal(`access_denied: tid claim "c" is not allowed`, err.Error())
+	}
+	err = required.check(map[string]interface{}{"tid": "a"})
+	if assert.Error(err) {
+		assert.Equal("access_denied: verified claim is missing", err.Error())
+	}
+
+	// Should allow everyone without required claims
+	required, err = parseRequiredClaims("providers.oidc.required-claim", nil)
+	assert.Nil(err)
+	assert.Nil(required.check(nil))
+}
+
+func TestDecodeUser(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should give each user a new UUID
+	first, err := decodeUser(strings.NewReader(`{"email":"first@example.com"}`))
+	assert.Nil(err)
+	second, err := decodeUser(strings.NewReader(`{"email":"second@example.com"}`))
+	assert.Nil(err)
+	assert.NotEqual(uuid.Nil, first.UUID)
+	assert.NotEqual(uuid.Nil, second.UUID)
+	assert.NotEqual(first.UUID, second.UUID)
+
+	// Should not take the UUID from the response
+	claimed := uuid.New()
+	user, err := decodeUser(strings.NewReader(`{"email":"third@example.com","uuid":"` + claimed.String() + `"}`))
+	assert.Nil(err)
+	assert.NotEqual(claimed, user.UUID)
+	assert.Equal(claimed.String(), user.Claims["uuid"])
+}
+
 // Utilities
 
 type OAuthServer struct {
@@ -0,0 +1,631 @@
+package provider
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// SAML provider
+//
+// traefik-forward-auth acts as a SAML 2.0 service provider. Users are sent to
+// the identity provider with an AuthnRequest using the HTTP-Redirect binding,
+// and the identity provider posts its response to the assertion consumer
+// service next to the callback. Forward auth requests never carry a body, so
+// the assertion consumer service is served directly rather than through the
+// middleware. Once the signed assertion is checked the user is sent on to the
+// callback with a one-time code, so the rest of the login is the same as for
+// OAuth providers
+type SAML struct {
+	EntityID        string `long:"entity-id" env:"ENTITY_ID" description:"Entity ID of traefik-forward-auth as a service provider, registered with the identity provider"`
+	IDPMetadataURL  string `long:"idp-metadata-url" env:"IDP_METADATA_URL" description:"URL of the identity provider's metadata, read on startup"`
+	IDPMetadataFile string `long:"idp-metadata-file" env:"IDP_METADATA_FILE" description:"Path to the identity provider's metadata, instead of idp-metadata-url"`
+	EmailAttribute  string `long:"email-attribute" env:"EMAIL_ATTRIBUTE" default:"email" description:"Attribute holding the user's email address, the NameID is used if it's missing"`
+	NameAttribute   string `long:"name-attribute" env:"NAME_ATTRIBUTE" default:"name" description:"Attribute holding the user's name"`
+	GroupsAttribute string `long:"groups-attribute" env:"GROUPS_ATTRIBUTE" default:"groups" description:"Attribute holding the user's groups, granted as roles"`
+	AttributeMap    string `long:"attribute-map" env:"ATTRIBUTE_MAP" description:"Path to a JSON file listing the attributes the user's email, name and roles are read from, for identity providers naming them differently"`
+
+	idpEntityID string
+	ssoURL      string
+	certs       []*x509.Certificate
+	attributes  samlAttributeMap
+
+	now   func() time.Time
+	codes *loginCodes
+	seen  *samlSeenAssertions
+}
+
+// SAML namespaces and bindings
+const (
+	samlMetadataNS   = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlProtocolNS   = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS  = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlRedirectBind = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPostBind     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlBearer       = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	xmlDSigNS        = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// SAMLACSPath is the path of the assertion consumer service, relative to the
+// callback
+const SAMLACSPath = "/saml/acs"
+
+// SAMLMetadataPath is the path of the service provider metadata, relative to
+// the callback
+const SAMLMetadataPath = "/saml/metadata"
+
+// samlClockSkew is allowed between the clocks of the identity provider and
+// traefik-forward-auth when checking an assertion's validity period
+const samlClockSkew = 90 * time.Second
+
+// Name returns the name of the provider
+func (s *SAML) Name() string {
+	return "saml"
+}
+
+// Setup performs validation and reads the identity provider's metadata
+func (s *SAML) Setup() error {
+	if s.EntityID == "" {
+		return errors.New("providers.saml.entity-id must be set")
+	}
+	if (s.IDPMetadataURL == "") == (s.IDPMetadataFile == "") {
+		return errors.New("one of providers.saml.idp-metadata-url, providers.saml.idp-metadata-file must be set")
+	}
+
+	var metadata []byte
+	var err error
+	if s.IDPMetadataURL != "" {
+		if err := validateURL("providers.saml.idp-metadata-url", s.IDPMetadataURL); err != nil {
+			return err
+		}
+		metadata, err = fetchSAMLMetadata(s.IDPMetadataURL)
+	} else {
+		metadata, err = ioutil.ReadFile(s.IDPMetadataFile)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read the identity provider's metadata: %v", err)
+	}
+	if err := s.parseMetadata(metadata); err != nil {
+		return fmt.Errorf("invalid identity provider metadata: %v", err)
+	}
+
+	s.attributes = samlAttributeMap{
+		Email: []string{s.EmailAttribute},
+		Name:  []string{s.NameAttribute},
+		Roles: []string{s.GroupsAttribute},
+	}
+	if s.AttributeMap != "" {
+		if err := s.loadAttributeMap(); err != nil {
+			return fmt.Errorf("invalid providers.saml.attribute-map: %v", err)
+		}
+	}
+
+	if s.now == nil {
+		s.now = time.Now
+	}
+	s.codes = newLoginCodes()
+	s.seen = &samlSeenAssertions{ids: make(map[string]time.Time)}
+	return nil
+}
+
+// samlAttributeMap lists the attributes the user is read from, in order of
+// preference for the email address and name, while roles are collected from
+// every attribute listed. With RolesSeparator set, values holding several
+// roles are split on it
+type samlAttributeMap struct {
+	Email          []string `json:"email"`
+	Name           []string `json:"name"`
+	Roles          []string `json:"roles"`
+	RolesSeparator string   `json:"roles_separator"`
+}
+
+// loadAttributeMap reads the attribute map file, the attributes it leaves out
+// are read from the email, name and groups attribute options
+func (s *SAML) loadAttributeMap() error {
+	b, err := ioutil.ReadFile(s.AttributeMap)
+	if err != nil {
+		return err
+	}
+
+	var m samlAttributeMap
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&m); err != nil {
+		return err
+	}
+
+	if len(m.Email) > 0 {
+		s.attributes.Email = m.Email
+	}
+	if len(m.Name) > 0 {
+		s.attributes.Name = m.Name
+	}
+	if len(m.Roles) > 0 {
+		s.attributes.Roles = m.Roles
+	}
+	s.attributes.RolesSeparator = m.RolesSeparator
+	return nil
+}
+
+// fetchSAMLMetadata requests the identity provider's metadata
+func fetchSAMLMetadata(metadataURL string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("%s returned %s", metadataURL, res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// samlEntityDescriptor is the part of the identity provider's metadata used
+type samlEntityDescriptor struct {
+	EntityID      string `xml:"entityID,attr"`
+	IDPDescriptor *struct {
+		Keys []struct {
+			Use          string   `xml:"use,attr"`
+			Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SingleSignOnServices []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+// parseMetadata reads the entity ID, signing certificates and HTTP-Redirect
+// single sign on URL of the identity provider
+func (s *SAML) parseMetadata(metadata []byte) error {
+	var desc samlEntityDescriptor
+	if err := xml.Unmarshal(metadata, &desc); err != nil {
+		return err
+	}
+	if desc.EntityID == "" || desc.IDPDescriptor == nil {
+		return errors.New("no IDPSSODescriptor in an EntityDescriptor")
+	}
+	s.idpEntityID = desc.EntityID
+
+	s.ssoURL = ""
+	for _, sso := range desc.IDPDescriptor.SingleSignOnServices {
+		if sso.Binding == samlRedirectBind {
+			s.ssoURL = sso.Location
+			break
+		}
+	}
+	if s.ssoURL == "" {
+		return errors.New("no SingleSignOnService with the HTTP-Redirect binding")
+	}
+
+	s.certs = nil
+	for _, key := range desc.IDPDescriptor.Keys {
+		if key.Use != "" && key.Use != "signing" {
+			continue
+		}
+		for _, data := range key.Certificates {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+			if err != nil {
+				return fmt.Errorf("invalid signing certificate: %v", err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return fmt.Errorf("invalid signing certificate: %v", err)
+			}
+			s.certs = append(s.certs, cert)
+		}
+	}
+	if len(s.certs) == 0 {
+		return errors.New("no signing certificate")
+	}
+	return nil
+}
+
+// GetLoginURL returns the identity provider's single sign on URL with an
+// AuthnRequest, the state is passed as the RelayState
+func (s *SAML) GetLoginURL(redirectURI, state string) string {
+	doc := etree.NewDocument()
+	req := doc.CreateElement("samlp:AuthnRequest")
+	req.CreateAttr("xmlns:samlp", samlProtocolNS)
+	req.CreateAttr("xmlns:saml", samlAssertionNS)
+	req.CreateAttr("ID", samlRequestID(state))
+	req.CreateAttr("Version", "2.0")
+	req.CreateAttr("IssueInstant", s.now().UTC().Format(time.RFC3339))
+	req.CreateAttr("Destination", s.ssoURL)
+	req.CreateAttr("AssertionConsumerServiceURL", redirectURI+SAMLACSPath)
+	req.CreateAttr("ProtocolBinding", samlPostBind)
+	req.CreateElement("saml:Issuer").SetText(s.EntityID)
+	xmlReq, err := doc.WriteToBytes()
+	if err != nil {
+		return ""
+	}
+
+	var deflated bytes.Buffer
+	w, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	w.Write(xmlReq)
+	w.Close()
+
+	u, err := url.Parse(s.ssoURL)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	q.Set("RelayState", state)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// samlRequestID derives the AuthnRequest ID from the state, so the response
+// can be tied to the login it answers without keeping the request
+func samlRequestID(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return "_" + hex.EncodeToString(sum[:])
+}
+
+// ExchangeCode exchanges the code issued once the user's assertion was
+// checked for the user
+func (s *SAML) ExchangeCode(redirectURI, code string) (*Token, error) {
+	if !s.codes.exchange(code) {
+		return nil, &Error{Code: "invalid_grant", Description: "login code is invalid, expired or already used"}
+	}
+	return &Token{AccessToken: code}, nil
+}
+
+// GetUser returns the user the exchanged code was issued for
+func (s *SAML) GetUser(token *Token) (*User, error) {
+	user := s.codes.user(token.AccessToken)
+	if user == nil {
+		return nil, errors.New("login code is invalid, expired or already used")
+	}
+	return user, nil
+}
+
+// IssueCode returns a one-time code the callback exchanges for the user
+func (s *SAML) IssueCode(user *User) (string, error) {
+	return s.codes.issue(user)
+}
+
+// Metadata returns the service provider metadata to register with the
+// identity provider
+func (s *SAML) Metadata(acsURL string) ([]byte, error) {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	entity := doc.CreateElement("md:EntityDescriptor")
+	entity.CreateAttr("xmlns:md", samlMetadataNS)
+	entity.CreateAttr("entityID", s.EntityID)
+	sp := entity.CreateElement("md:SPSSODescriptor")
+	sp.CreateAttr("AuthnRequestsSigned", "false")
+	sp.CreateAttr("WantAssertionsSigned", "true")
+	sp.CreateAttr("protocolSupportEnumeration", samlProtocolNS)
+	acs := sp.CreateElement("md:AssertionConsumerService")
+	acs.CreateAttr("Binding", samlPostBind)
+	acs.CreateAttr("Location", acsURL)
+	acs.CreateAttr("index", "0")
+	acs.CreateAttr("isDefault", "true")
+	doc.Indent(2)
+	return doc.WriteToBytes()
+}
+
+// samlStatus is the status of a response
+type samlStatus struct {
+	StatusCode struct {
+		Value      string `xml:"Value,attr"`
+		StatusCode struct {
+			Value string `xml:"Value,attr"`
+		} `xml:"StatusCode"`
+	} `xml:"StatusCode"`
+	StatusMessage string `xml:"StatusMessage"`
+}
+
+// samlAssertion is the part of an assertion used. Elements are matched by
+// local name, as a validated assertion is detached from the namespace
+// declarations of the response
+type samlAssertion struct {
+	ID      string `xml:"ID,attr"`
+	Issuer  string `xml:"Issuer"`
+	Subject struct {
+		NameID        string `xml:"NameID"`
+		Confirmations []struct {
+			Method string `xml:"Method,attr"`
+			Data   struct {
+				Recipient    string    `xml:"Recipient,attr"`
+				InResponseTo string    `xml:"InResponseTo,attr"`
+				NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+			} `xml:"SubjectConfirmationData"`
+		} `xml:"SubjectConfirmation"`
+	} `xml:"Subject"`
+	Conditions struct {
+		NotBefore    time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+		Audiences    []struct {
+			Audience []string `xml:"Audience"`
+		} `xml:"AudienceRestriction"`
+	} `xml:"Conditions"`
+	Attributes []samlAttribute `xml:"AttributeStatement>Attribute"`
+}
+
+// samlAttribute is an attribute of the assertion, which may have many values
+type samlAttribute struct {
+	Name         string   `xml:"Name,attr"`
+	FriendlyName string   `xml:"FriendlyName,attr"`
+	Values       []string `xml:"AttributeValue"`
+}
+
+// ParseResponse checks the base64 encoded response posted to the assertion
+// consumer service at acsURL answers the login with the given state, and
+// returns the user from its signed assertion. Identity provider errors are
+// returned as an access_denied *Error
+func (s *SAML) ParseResponse(encoded, acsURL, state string) (*User, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("response is not base64 encoded")
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, fmt.Errorf("response is not XML: %v", err)
+	}
+	response := doc.Root()
+	if response == nil || response.Tag != "Response" || response.NamespaceURI() != samlProtocolNS {
+		return nil, errors.New("not a SAML response")
+	}
+
+	// Only the signed elements are read, either the whole response or the
+	// assertion within it
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: s.certs})
+	ctx.Clock = dsig.NewFakeClockAt(s.now())
+	responseSigned := false
+	if samlChild(response, xmlDSigNS, "Signature") != nil {
+		response, err = ctx.Validate(response)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response signature: %v", err)
+		}
+		responseSigned = true
+	}
+
+	var status samlStatus
+	if el := samlChild(response, samlProtocolNS, "Status"); el != nil {
+		if err := samlDecode(el, &status); err != nil {
+			return nil, err
+		}
+	}
+	if status.StatusCode.Value != samlSuccess {
+		desc := status.StatusMessage
+		if desc == "" {
+			desc = strings.TrimPrefix(status.StatusCode.StatusCode.Value, "urn:oasis:names:tc:SAML:2.0:status:")
+		}
+		if desc == "" {
+			desc = status.StatusCode.Value
+		}
+		return nil, &Error{Code: "access_denied", Description: desc}
+	}
+	if dest := response.SelectAttrValue("Destination", ""); dest != "" && dest != acsURL {
+		return nil, fmt.Errorf("response is for %s", dest)
+	}
+
+	if samlChild(response, samlAssertionNS, "EncryptedAssertion") != nil {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	var assertionEl *etree.Element
+	for _, el := range response.ChildElements() {
+		if el.Tag == "Assertion" && el.NamespaceURI() == samlAssertionNS {
+			if assertionEl != nil {
+				return nil, errors.New("response has more than one assertion")
+			}
+			assertionEl = el
+		}
+	}
+	if assertionEl == nil {
+		return nil, errors.New("response has no assertion")
+	}
+	if samlChild(assertionEl, xmlDSigNS, "Signature") != nil {
+		assertionEl, err = ctx.Validate(assertionEl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid assertion signature: %v", err)
+		}
+	} else if !responseSigned {
+		return nil, errors.New("neither the response nor the assertion is signed")
+	}
+
+	var assertion samlAssertion
+	if err := samlDecode(assertionEl, &assertion); err != nil {
+		return nil, err
+	}
+	if err := s.checkAssertion(&assertion, acsURL, samlRequestID(state)); err != nil {
+		return nil, err
+	}
+	return s.assertionUser(&assertion), nil
+}
+
+// checkAssertion checks the assertion was issued by the identity provider
+// for us, in answer to the request, is within its validity period and hasn't
+// been used before
+func (s *SAML) checkAssertion(a *samlAssertion, acsURL, requestID string) error {
+	now := s.now()
+
+	if a.Issuer != s.idpEntityID {
+		return fmt.Errorf("assertion was issued by %q", a.Issuer)
+	}
+
+	if !a.Conditions.NotBefore.IsZero() && now.Add(samlClockSkew).Before(a.Conditions.NotBefore) {
+		return errors.New("assertion is not yet valid")
+	}
+	if !a.Conditions.NotOnOrAfter.IsZero() && !now.Add(-samlClockSkew).Before(a.Conditions.NotOnOrAfter) {
+		return errors.New("assertion has expired")
+	}
+	if len(a.Conditions.Audiences) == 0 {
+		return errors.New("assertion has no audience restriction")
+	}
+	for _, restriction := range a.Conditions.Audiences {
+		allowed := false
+		for _, audience := range restriction.Audience {
+			if audience == s.EntityID {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("assertion is not for %s", s.EntityID)
+		}
+	}
+
+	// A bearer confirmation must be for this login
+	var expires time.Time
+	confirmed := false
+	for _, c := range a.Subject.Confirmations {
+		if c.Method != samlBearer || c.Data.Recipient != acsURL || c.Data.InResponseTo != requestID {
+			continue
+		}
+		if c.Data.NotOnOrAfter.IsZero() || !now.Add(-samlClockSkew).Before(c.Data.NotOnOrAfter) {
+			continue
+		}
+		confirmed = true
+		expires = c.Data.NotOnOrAfter
+		break
+	}
+	if !confirmed {
+		return errors.New("assertion has no bearer subject confirmation for this login")
+	}
+
+	// Keep the assertion until it can no longer be confirmed, so it can't be
+	// replayed
+	if a.ID == "" || !s.seen.add(a.ID, now, expires.Add(samlClockSkew)) {
+		return errors.New("assertion has already been used")
+	}
+	return nil
+}
+
+// samlSeenAssertions holds the IDs of the assertions used to log in
+type samlSeenAssertions struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+// add records the assertion ID until the given time, returning false if it
+// was already recorded
+func (s *samlSeenAssertions) add(id string, now, until time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, expires := range s.ids {
+		if now.After(expires) {
+			delete(s.ids, key)
+		}
+	}
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	s.ids[id] = until
+	return true
+}
+
+// assertionUser maps the assertion's attributes onto the user, all of them
+// are kept as claims. Attributes are found by their name or friendly name
+func (s *SAML) assertionUser(a *samlAssertion) *User {
+	user := newUser()
+	user.Claims = map[string]interface{}{
+		"name_id": a.Subject.NameID,
+	}
+	values := make(map[string][]string)
+	for _, attr := range a.Attributes {
+		if len(attr.Values) == 1 {
+			user.Claims[attr.Name] = attr.Values[0]
+		} else {
+			claim := make([]interface{}, len(attr.Values))
+			for i, v := range attr.Values {
+				claim[i] = v
+			}
+			user.Claims[attr.Name] = claim
+		}
+
+		values[attr.Name] = append(values[attr.Name], attr.Values...)
+		if attr.FriendlyName != "" && attr.FriendlyName != attr.Name {
+			values[attr.FriendlyName] = append(values[attr.FriendlyName], attr.Values...)
+		}
+	}
+
+	user.Email = firstSAMLValue(values, s.attributes.Email)
+	user.Name = firstSAMLValue(values, s.attributes.Name)
+	for _, name := range s.attributes.Roles {
+		for _, value := range values[name] {
+			roles := []string{value}
+			if s.attributes.RolesSeparator != "" {
+				roles = strings.Split(value, s.attributes.RolesSeparator)
+			}
+			for _, role := range roles {
+				if role = strings.TrimSpace(role); role != "" && !containsRole(user.Roles, role) {
+					user.Roles = append(user.Roles, role)
+				}
+			}
+		}
+	}
+	if user.Email == "" {
+		user.Email = a.Subject.NameID
+	}
+	return user
+}
+
+// firstSAMLValue returns the first value of the first of the attributes that
+// has one
+func firstSAMLValue(values map[string][]string, names []string) string {
+	for _, name := range names {
+		for _, value := range values[name] {
+			if value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// containsRole returns true if the role is in the list
+func containsRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// samlChild returns the first child element in the namespace with the tag
+func samlChild(el *etree.Element, ns, tag string) *etree.Element {
+	for _, child := range el.ChildElements() {
+		if child.Tag == tag && child.NamespaceURI() == ns {
+			return child
+		}
+	}
+	return nil
+}
+
+// samlDecode decodes the element into v
+func samlDecode(el *etree.Element, v interface{}) error {
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	b, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("invalid %s: %v", el.Tag, err)
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+package provider
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests
+
+func TestSAMLName(t *testing.T) {
+	p := SAML{}
+	assert.Equal(t, "saml", p.Name())
+}
+
+func TestSAMLSetup(t *testing.T) {
+	assert := assert.New(t)
+	idp := newSAMLTestIDP(t)
+	p := SAML{}
+
+	err := p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.saml.entity-id must be set", err.Error())
+	}
+
+	p.EntityID = "https://auth.example.com/_oauth/saml/metadata"
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("one of providers.saml.idp-metadata-url, providers.saml.idp-metadata-file must be set", err.Error())
+	}
+
+	p.IDPMetadataURL = "https://idp.example.com/metadata"
+	p.IDPMetadataFile = "/etc/idp.xml"
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("one of providers.saml.idp-metadata-url, providers.saml.idp-metadata-file must be set", err.Error())
+	}
+
+	// Should require the HTTP-Redirect binding
+	p.IDPMetadataURL = ""
+	p.IDPMetadataFile = writeSAMLTestFile(t, strings.Replace(idp.metadata(), samlRedirectBind, samlPostBind, 1))
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("invalid identity provider metadata: no SingleSignOnService with the HTTP-Redirect binding", err.Error())
+	}
+
+	// Should read the metadata from a file
+	p.IDPMetadataFile = writeSAMLTestFile(t, idp.metadata())
+	assert.Nil(p.Setup())
+	assert.Equal("https://idp.example.com", p.idpEntityID)
+	assert.Equal("https://idp.example.com/sso", p.ssoURL)
+	assert.Len(p.certs, 1)
+
+	// Should read the metadata from a URL
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, idp.metadata())
+	}))
+	defer server.Close()
+	p = SAML{EntityID: "https://auth.example.com/_oauth/saml/metadata", IDPMetadataURL: server.URL}
+	assert.Nil(p.Setup())
+	assert.Equal("https://idp.example.com/sso", p.ssoURL)
+}
+
+func TestSAMLGetLoginURL(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	p, _ := setupSAMLTest(t)
+
+	loginURL, err := url.Parse(p.GetLoginURL("https://auth.example.com/_oauth", "state"))
+	require.Nil(err)
+	assert.Equal("idp.example.com", loginURL.Host)
+	assert.Equal("/sso", loginURL.Path)
+	assert.Equal("state", loginURL.Query().Get("RelayState"))
+
+	// Should deflate the AuthnRequest
+	deflated, err := base64.StdEncoding.DecodeString(loginURL.Query().Get("SAMLRequest"))
+	require.Nil(err)
+	raw, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	require.Nil(err)
+	doc := etree.NewDocument()
+	require.Nil(doc.ReadFromBytes(raw))
+	req := doc.Root()
+	assert.Equal("AuthnRequest", req.Tag)
+	assert.Equal(samlProtocolNS, req.NamespaceURI())
+	assert.Equal(samlRequestID("state"), req.SelectAttrValue("ID", ""))
+	assert.Equal("https://idp.example.com/sso", req.SelectAttrValue("Destination", ""))
+	assert.Equal("https://auth.example.com/_oauth/saml/acs", req.SelectAttrValue("AssertionConsumerServiceURL", ""))
+	assert.Equal(samlPostBind, req.SelectAttrValue("ProtocolBinding", ""))
+	assert.Equal("https://auth.example.com/_oauth/saml/metadata", req.SelectElement("Issuer").Text())
+}
+
+func TestSAMLMetadata(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	p, _ := setupSAMLTest(t)
+
+	metadata, err := p.Metadata("https://auth.example.com/_oauth/saml/acs")
+	require.Nil(err)
+	doc := etree.NewDocument()
+	require.Nil(doc.ReadFromBytes(metadata))
+	assert.Equal("https://auth.example.com/_oauth/saml/metadata", doc.Root().SelectAttrValue("entityID", ""))
+	acs := doc.FindElement("//AssertionConsumerService")
+	require.NotNil(acs)
+	assert.Equal(samlPostBind, acs.SelectAttrValue("Binding", ""))
+	assert.Equal("https://auth.example.com/_oauth/saml/acs", acs.SelectAttrValue("Location", ""))
+}
+
+func TestSAMLParseResponse(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	p, idp := setupSAMLTest(t)
+	acsURL := "https://auth.example.com/_oauth/saml/acs"
+
+	// Should return the user from a signed assertion
+	user, err := p.ParseResponse(idp.response(t, samlTestAssertion{}), acsURL, "state")
+	require.Nil(err)
+	assert.Equal("alice@example.com", user.Email)
+	assert.Equal("Alice", user.Name)
+	assert.Equal([]string{"admins", "developers"}, user.Roles)
+	assert.Equal("alice", user.Claims["name_id"])
+	assert.Equal("Engineering", user.Claims["department"])
+	assert.Equal([]interface{}{"admins", "developers"}, user.Claims["groups"])
+
+	// Should refuse replayed assertions
+	response := idp.response(t, samlTestAssertion{ID: "_replayed"})
+	_, err = p.ParseResponse(response, acsURL, "state")
+	require.Nil(err)
+	_, err = p.ParseResponse(response, acsURL, "state")
+	if assert.Error(err) {
+		assert.Equal("assertion has already been used", err.Error())
+	}
+
+	// Should accept a signed response
+	user, err = p.ParseResponse(idp.response(t, samlTestAssertion{SignResponse: true}), acsURL, "state")
+	require.Nil(err)
+	assert.Equal("alice@example.com", user.Email)
+
+	// Should fall back to the NameID
+	user, err = p.ParseResponse(idp.response(t, samlTestAssertion{NoAttributes: true}), acsURL, "state")
+	require.Nil(err)
+	assert.Equal("alice", user.Email)
+
+	tests := []struct {
+		name      string
+		assertion samlTestAssertion
+		acsURL    string
+		state     string
+		err       string
+	}{
+		{"unsigned", samlTestAssertion{Unsigned: true}, acsURL, "state", "neither the response nor the assertion is signed"},
+		{"tampered", samlTestAssertion{Tamper: true}, acsURL, "state", "invalid assertion signature: Signature could not be verified"},
+		{"other idp", samlTestAssertion{OtherKey: true}, acsURL, "state", "invalid assertion signature: Could not verify certificate against trusted certs"},
+		{"issuer", samlTestAssertion{Issuer: "https://other.example.com"}, acsURL, "state", `assertion was issued by "https://other.example.com"`},
+		{"audience", samlTestAssertion{Audience: "https://other.example.com"}, acsURL, "state", "assertion is not for https://auth.example.com/_oauth/saml/metadata"},
+		{"expired", samlTestAssertion{Age: time.Hour}, acsURL, "state", "assertion has expired"},
+		{"other login", samlTestAssertion{}, acsURL, "other", "assertion has no bearer subject confirmation for this login"},
+		{"other recipient", samlTestAssertion{}, "https://other.example.com/_oauth/saml/acs", "state", "response is for https://auth.example.com/_oauth/saml/acs"},
+	}
+	for _, test := range tests {
+		_, err := p.ParseResponse(idp.response(t, test.assertion), test.acsURL, test.state)
+		if assert.Error(err, test.name) {
+			assert.Equal(test.err, err.Error(), test.name)
+		}
+	}
+
+	// Should return identity provider errors
+	_, err = p.ParseResponse(idp.response(t, samlTestAssertion{Status: "urn:oasis:names:tc:SAML:2.0:status:Responder"}), acsURL, "state")
+	perr, ok := AsError(err)
+	require.True(ok)
+	assert.Equal("access_denied", perr.Code)
+	assert.Equal("AuthnFailed", perr.Description)
+
+	// Should refuse anything else
+	_, err = p.ParseResponse("not base64!", acsURL, "state")
+	assert.Error(err)
+	_, err = p.ParseResponse(base64.StdEncoding.EncodeToString([]byte("<html/>")), acsURL, "state")
+	if assert.Error(err) {
+		assert.Equal("not a SAML response", err.Error())
+	}
+}
+
+func TestSAMLAttributeMap(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	p, _ := setupSAMLTest(t)
+
+	assertion := &samlAssertion{Attributes: []samlAttribute{
+		{Name: "urn:oid:0.9.2342.19200300.100.1.3", FriendlyName: "mail", Values: []string{"alice@example.com", "alice@example.org"}},
+		{Name: "urn:oid:2.16.840.1.113730.3.1.241", FriendlyName: "displayName", Values: []string{"Alice"}},
+		{Name: "memberOf", Values: []string{"admins, developers", "developers"}},
+		{Name: "http://schemas.microsoft.com/ws/2008/06/identity/claims/role", Values: []string{"auditors"}},
+	}}
+	assertion.Subject.NameID = "alice"
+
+	// Should read the attributes from the map by name or friendly name
+	p.AttributeMap = writeSAMLTestFile(t, `{
+		"email": ["email", "mail"],
+		"name": ["displayName"],
+		"roles": ["memberOf", "http://schemas.microsoft.com/ws/2008/06/identity/claims/role"],
+		"roles_separator": ","
+	}`)
+	require.Nil(p.Setup())
+	user := p.assertionUser(assertion)
+	assert.Equal("alice@example.com", user.Email, "should take the first value")
+	assert.Equal("Alice", user.Name)
+	assert.Equal([]string{"admins", "developers", "auditors"}, user.Roles)
+	assert.Equal([]interface{}{"alice@example.com", "alice@example.org"}, user.Claims["urn:oid:0.9.2342.19200300.100.1.3"])
+
+	// Should fall back to the attribute options for those left out
+	p.AttributeMap = writeSAMLTestFile(t, `{"roles": ["memberOf"]}`)
+	p.NameAttribute = "displayName"
+	require.Nil(p.Setup())
+	user = p.assertionUser(assertion)
+	assert.Equal("alice", user.Email, "should fall back to the NameID")
+	assert.Equal("Alice", user.Name)
+	assert.Equal([]string{"admins, developers", "developers"}, user.Roles)
+
+	// Should refuse invalid maps
+	p.AttributeMap = writeSAMLTestFile(t, `{"groups": ["memberOf"]}`)
+	err := p.Setup()
+	if assert.Error(err) {
+		assert.Equal(`invalid providers.saml.attribute-map: json: unknown field "groups"`, err.Error())
+	}
+	p.AttributeMap = filepath.Join(t.TempDir(), "missing.json")
+	assert.Error(p.Setup())
+}
+
+func TestSAMLCodes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	p, _ := setupSAMLTest(t)
+
+	code, err := p.IssueCode(&User{Email: "alice@example.com"})
+	require.Nil(err)
+
+	token, err := p.ExchangeCode("", code)
+	require.Nil(err)
+	user, err := p.GetUser(token)
+	require.Nil(err)
+	assert.Equal("alice@example.com", user.Email)
+
+	// Should only accept each code once
+	_, err = p.ExchangeCode("", code)
+	perr, ok := AsError(err)
+	require.True(ok)
+	assert.Equal("invalid_grant", perr.Code)
+}
+
+// Utils
+
+// samlTestIDP signs responses as an identity provider would
+type samlTestIDP struct {
+	keyStore dsig.X509KeyStore
+	cert     []byte
+}
+
+func newSAMLTestIDP(t *testing.T) *samlTestIDP {
+	ks := dsig.RandomKeyStoreForTest()
+	_, cert, err := ks.GetKeyPair()
+	require.Nil(t, err)
+	return &samlTestIDP{keyStore: ks, cert: cert}
+}
+
+func (i *samlTestIDP) metadata() string {
+	return `<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="https://idp.example.com">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo><ds:X509Data><ds:X509Certificate>` + base64.StdEncoding.EncodeToString(i.cert) + `</ds:X509Certificate></ds:X509Data></ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/sso/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`
+}
+
+// samlTestAssertion changes the assertion from the valid default
+type samlTestAssertion struct {
+	ID           string
+	Issuer       string
+	Audience     string
+	Age          time.Duration
+	Status       string
+	NoAttributes bool
+	Unsigned     bool
+	SignResponse bool
+	Tamper       bool
+	OtherKey     bool
+}
+
+// response returns a base64 encoded response answering the login with the
+// state "state"
+func (i *samlTestIDP) response(t *testing.T, a samlTestAssertion) string {
+	if a.ID == "" {
+		a.ID = fmt.Sprintf("_%d", time.Now().UnixNano())
+	}
+	if a.Issuer == "" {
+		a.Issuer = "https://idp.example.com"
+	}
+	if a.Audience == "" {
+		a.Audience = "https://auth.example.com/_oauth/saml/metadata"
+	}
+	acsURL := "https://auth.example.com/_oauth/saml/acs"
+	issued := time.Now().Add(-a.Age).UTC()
+	format := func(t time.Time) string { return t.Format(time.RFC3339) }
+
+	doc := etree.NewDocument()
+	response := doc.CreateElement("samlp:Response")
+	response.CreateAttr("xmlns:samlp", samlProtocolNS)
+	response.CreateAttr("xmlns:saml", samlAssertionNS)
+	response.CreateAttr("ID", a.ID+"-response")
+	response.CreateAttr("Version", "2.0")
+	response.CreateAttr("IssueInstant", format(issued))
+	response.CreateAttr("Destination", acsURL)
+	response.CreateAttr("InResponseTo", samlRequestID("state"))
+	response.CreateElement("saml:Issuer").SetText(a.Issuer)
+	status := response.CreateElement("samlp:Status").CreateElement("samlp:StatusCode")
+	if a.Status != "" {
+		status.CreateAttr("Value", a.Status)
+		status.CreateElement("samlp:StatusCode").CreateAttr("Value", "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed")
+		return i.encode(t, doc)
+	}
+	status.CreateAttr("Value", samlSuccess)
+
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", samlAssertionNS)
+	assertion.CreateAttr("ID", a.ID)
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateAttr("IssueInstant", format(issued))
+	assertion.CreateElement("saml:Issuer").SetText(a.Issuer)
+	subject := assertion.CreateElement("saml:Subject")
+	subject.CreateElement("saml:NameID").SetText("alice")
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", samlBearer)
+	data := confirmation.CreateElement("saml:SubjectConfirmationData")
+	data.CreateAttr("InResponseTo", samlRequestID("state"))
+	data.CreateAttr("Recipient", acsURL)
+	data.CreateAttr("NotOnOrAfter", format(issued.Add(5*time.Minute)))
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", format(issued.Add(-time.Minute)))
+	conditions.CreateAttr("NotOnOrAfter", format(issued.Add(5*time.Minute)))
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(a.Audience)
+	if !a.NoAttributes {
+		attributes := assertion.CreateElement("saml:AttributeStatement")
+		for name, values := range map[string][]string{
+			"email":      {"alice@example.com"},
+			"name":       {"Alice"},
+			"department": {"Engineering"},
+			"groups":     {"admins", "developers"},
+		} {
+			attr := attributes.CreateElement("saml:Attribute")
+			attr.CreateAttr("Name", name)
+			for _, value := range values {
+				attr.CreateElement("saml:AttributeValue").SetText(value)
+			}
+		}
+	}
+
+	signer := i.keyStore
+	if a.OtherKey {
+		signer = dsig.RandomKeyStoreForTest()
+	}
+	if !a.Unsigned && !a.SignResponse {
+		signed, err := dsig.NewDefaultSigningContext(signer).SignEnveloped(assertion)
+		require.Nil(t, err)
+		assertion = signed
+	}
+	if a.Tamper {
+		assertion.FindElement("//AttributeValue").SetText("mallory@example.com")
+	}
+	response.AddChild(assertion)
+
+	if a.SignResponse {
+		signed, err := dsig.NewDefaultSigningContext(signer).SignEnveloped(response)
+		require.Nil(t, err)
+		doc.SetRoot(signed)
+	}
+	return i.encode(t, doc)
+}
+
+func (i *samlTestIDP) encode(t *testing.T, doc *etree.Document) string {
+	b, err := doc.WriteToBytes()
+	require.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func writeSAMLTestFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "saml")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "metadata.xml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func setupSAMLTest(t *testing.T) (*SAML, *samlTestIDP) {
+	idp := newSAMLTestIDP(t)
+	p := &SAML{
+		EntityID:        "https://auth.example.com/_oauth/saml/metadata",
+		IDPMetadataFile: writeSAMLTestFile(t, idp.metadata()),
+		EmailAttribute:  "email",
+		NameAttribute:   "name",
+		GroupsAttribute: "groups",
+	}
+	require.Nil(t, p.Setup())
+	return p, idp
+}
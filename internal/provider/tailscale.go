@@ -0,0 +1,140 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Tailscale provider
+type Tailscale struct {
+	Socket    string   `long:"socket" env:"SOCKET" default:"/var/run/tailscale/tailscaled.sock" description:"Path to the tailscaled LocalAPI socket"`
+	UserRoles []string `long:"user-role" env:"USER_ROLE" env-delim:"," description:"Grant a role to a tailnet user, in the format user@example.com:role, can be set multiple times"`
+
+	client    *http.Client
+	userRoles map[string][]string
+}
+
+// tailscaleNamespace is used to derive stable user UUIDs from tailnet logins
+var tailscaleNamespace = uuid.MustParse("5f0a8e52-7b1c-4bb1-9f57-3c1c1b8a4e1d")
+
+// tailscaleLocalAPI is the LocalAPI base URL, requests are always sent to the
+// socket whatever the host
+const tailscaleLocalAPI = "http://local-tailscaled.sock"
+
+// taggedDevices is the login name tailscale reports for nodes owned by tags
+const taggedDevices = "tagged-devices"
+
+// Name returns the name of the provider
+func (t *Tailscale) Name() string {
+	return "tailscale"
+}
+
+// Setup performs validation and setup
+func (t *Tailscale) Setup() error {
+	if t.Socket == "" {
+		return errors.New("providers.tailscale.socket must be set")
+	}
+
+	t.userRoles = make(map[string][]string)
+	for _, mapping := range t.UserRoles {
+		parts := strings.SplitN(mapping, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid providers.tailscale.user-role %q, must be in the format user@example.com:role", mapping)
+		}
+		t.userRoles[parts[0]] = append(t.userRoles[parts[0]], parts[1])
+	}
+
+	socket := t.Socket
+	t.client = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	return nil
+}
+
+// GetLoginURL is not supported, tailnet users are identified by Identify
+func (t *Tailscale) GetLoginURL(redirectURI, state string) string {
+	return ""
+}
+
+// ExchangeCode is not supported, tailnet users are identified by Identify
+func (t *Tailscale) ExchangeCode(redirectURI, code string) (*Token, error) {
+	return nil, errors.New("tailscale provider does not support interactive login")
+}
+
+// GetUser is not supported, tailnet users are identified by Identify
+func (t *Tailscale) GetUser(token *Token) (*User, error) {
+	return nil, errors.New("tailscale provider does not support interactive login")
+}
+
+type tailscaleWhois struct {
+	Node struct {
+		Name string   `json:"Name"`
+		Tags []string `json:"Tags"`
+	} `json:"Node"`
+	UserProfile struct {
+		LoginName   string `json:"LoginName"`
+		DisplayName string `json:"DisplayName"`
+	} `json:"UserProfile"`
+}
+
+// Identify looks up the tailnet identity of the given address. Nodes owned by
+// users are identified by the user's login, tagged nodes by their node name.
+// Tags are granted as roles (without the "tag:" prefix), as well as any roles
+// configured for the user. Returns nil if the address isn't in the tailnet
+func (t *Tailscale) Identify(ip string) (*User, error) {
+	q := url.Values{}
+	q.Set("addr", ip)
+
+	res, err := t.client.Get(tailscaleLocalAPI + "/localapi/v0/whois?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tailscale whois failed: %s", res.Status)
+	}
+
+	var whois tailscaleWhois
+	if err := json.NewDecoder(res.Body).Decode(&whois); err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		Email: whois.UserProfile.LoginName,
+		Name:  whois.UserProfile.DisplayName,
+	}
+	if user.Email == taggedDevices || user.Email == "" {
+		user.Email = strings.TrimSuffix(whois.Node.Name, ".")
+		user.Name = ""
+	}
+	if user.Email == "" {
+		return nil, errors.New("tailscale whois returned no identity")
+	}
+	user.UUID = uuid.NewSHA1(tailscaleNamespace, []byte(user.Email))
+
+	for _, tag := range whois.Node.Tags {
+		user.Roles = append(user.Roles, strings.TrimPrefix(tag, "tag:"))
+	}
+	user.Roles = append(user.Roles, t.userRoles[user.Email]...)
+
+	return user, nil
+}
@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests
+
+func TestTailscaleName(t *testing.T) {
+	p := Tailscale{}
+	assert.Equal(t, "tailscale", p.Name())
+}
+
+func TestTailscaleSetup(t *testing.T) {
+	assert := assert.New(t)
+	p := Tailscale{}
+
+	err := p.Setup()
+	if assert.Error(err) {
+		assert.Equal("providers.tailscale.socket must be set", err.Error())
+	}
+
+	p.Socket = "/tmp/tailscaled.sock"
+	p.UserRoles = []string{"alice@example.com"}
+	err = p.Setup()
+	if assert.Error(err) {
+		assert.Equal("invalid providers.tailscale.user-role \"alice@example.com\", must be in the format user@example.com:role", err.Error())
+	}
+
+	p.UserRoles = []string{"alice@example.com:admin", "alice@example.com:dev"}
+	assert.Nil(p.Setup())
+	assert.Equal([]string{"admin", "dev"}, p.userRoles["alice@example.com"])
+}
+
+func TestTailscaleIdentify(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	p := setupTailscaleTest(t, map[string]string{
+		"100.64.0.1": `{"Node":{"Name":"laptop.tailnet.ts.net.","Tags":null},"UserProfile":{"LoginName":"alice@example.com","DisplayName":"Alice"}}`,
+		"100.64.0.2": `{"Node":{"Name":"ci.tailnet.ts.net.","Tags":["tag:ci","tag:deploy"]},"UserProfile":{"LoginName":"tagged-devices","DisplayName":"Tagged Devices"}}`,
+	})
+	p.UserRoles = []string{"alice@example.com:admin"}
+	require.Nil(p.Setup())
+
+	// Should identify users
+	user, err := p.Identify("100.64.0.1")
+	require.Nil(err)
+	require.NotNil(user)
+	assert.Equal("alice@example.com", user.Email)
+	assert.Equal("Alice", user.Name)
+	assert.Equal([]string{"admin"}, user.Roles)
+	assert.NotEqual(uuid.Nil, user.UUID)
+
+	// Should identify tagged nodes by name
+	user, err = p.Identify("100.64.0.2")
+	require.Nil(err)
+	require.NotNil(user)
+	assert.Equal("ci.tailnet.ts.net", user.Email)
+	assert.Equal("", user.Name)
+	assert.Equal([]string{"ci", "deploy"}, user.Roles)
+
+	// Should return nil for addresses outside the tailnet
+	user, err = p.Identify("192.168.0.1")
+	assert.Nil(err)
+	assert.Nil(user)
+
+	// Should not support interactive login
+	_, err = p.ExchangeCode("http://example.com/_oauth", "code")
+	assert.Error(err)
+}
+
+// Utils
+
+func setupTailscaleTest(t *testing.T, whois map[string]string) *Tailscale {
+	socket := filepath.Join(t.TempDir(), "tailscaled.sock")
+	l, err := net.Listen("unix", socket)
+	require.Nil(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/whois" {
+			http.NotFound(w, r)
+			return
+		}
+
+		res, ok := whois[r.URL.Query().Get("addr")]
+		if !ok {
+			http.Error(w, "no match for IP:port", 404)
+			return
+		}
+		fmt.Fprint(w, res)
+	}))
+	server.Listener = l
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return &Tailscale{Socket: socket}
+}
@@ -0,0 +1,84 @@
+package tfa
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+)
+
+// Proxy modes
+//
+// The "mode" adapts auth requests to the reverse proxy sending them. traefik
+// and caddy send the original request in X-Forwarded-Method, X-Forwarded-Host
+// and X-Forwarded-Uri, and pass redirects on to the browser. nginx's
+// auth_request sends X-Original-URL and X-Original-Method, and can't pass a
+// redirect on, so users needing to log in get a 401 with the login URL in the
+// Location header instead. generic reads either set of headers, passing
+// redirects on, for other proxies implementing auth_request semantics
+
+// readsOriginalURL reports whether the original request may be given in
+// X-Original-URL
+func readsOriginalURL() bool {
+	return config().ProxyMode == "nginx" || config().ProxyMode == "generic"
+}
+
+// isForwardedRequest reports whether the request is an auth request from the
+// proxy, rather than for one of our own endpoints
+func isForwardedRequest(r *http.Request, _ *mux.RouteMatch) bool {
+	if _, ok := r.Header["X-Forwarded-Host"]; ok {
+		return true
+	}
+	return readsOriginalURL() && r.Header.Get("X-Original-Url") != ""
+}
+
+// originalRequest rewrites the request from the X-Original-URL and
+// X-Original-Method headers, returning false if they aren't usable
+func originalRequest(r *http.Request) bool {
+	if !readsOriginalURL() {
+		return false
+	}
+	original, err := url.Parse(r.Header.Get("X-Original-Url"))
+	if err != nil || original.Host == "" {
+		return false
+	}
+
+	r.Method = r.Header.Get("X-Original-Method")
+	if r.Method == "" {
+		r.Method = "GET"
+	}
+	r.Host = original.Host
+	r.URL, _ = url.Parse(original.RequestURI())
+
+	// The rest of the request is read from the X-Forwarded headers
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", original.Scheme)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", original.Host)
+	}
+	return true
+}
+
+// withProxyResponse adapts the responses of auth decisions to the proxy
+func withProxyResponse(next http.Handler) http.Handler {
+	if config().ProxyMode != "nginx" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&unauthorizedRedirectWriter{ResponseWriter: w}, r)
+	})
+}
+
+// unauthorizedRedirectWriter turns redirects into a 401, keeping the Location
+// header for the proxy to redirect to
+type unauthorizedRedirectWriter struct {
+	http.ResponseWriter
+}
+
+func (w *unauthorizedRedirectWriter) WriteHeader(status int) {
+	if status >= 300 && status < 400 {
+		status = http.StatusUnauthorized
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,86 @@
+package tfa
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestProxyModeForwardedRequest(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Original-Url", "https://app.example.com/page")
+	assert.False(isForwardedRequest(req, nil), "traefik should ignore X-Original-URL")
+
+	config().ProxyMode = "nginx"
+	assert.True(isForwardedRequest(req, nil), "nginx should accept X-Original-URL")
+
+	req = newDefaultHttpRequest("/page")
+	assert.True(isForwardedRequest(req, nil), "nginx should still accept X-Forwarded-Host")
+
+	req = httptest.NewRequest("GET", "/healthz", nil)
+	assert.False(isForwardedRequest(req, nil), "requests without either header are for our own endpoints")
+}
+
+func TestProxyModeNginx(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().ProxyMode = "nginx"
+	config().Rules = map[string]*Rule{
+		"public": {
+			Action: "allow",
+			Rule:   "PathPrefix(`/public`)",
+		},
+	}
+
+	// Should read the original request from X-Original-URL
+	req := httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("X-Original-Url", "https://app.example.com/public/page?q=1")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "rules should match the original URL")
+
+	// Should answer logins with a 401 and the login URL
+	req = httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("X-Original-Url", "https://app.example.com/private?q=1")
+	req.Header.Set("X-Original-Method", "GET")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	location := res.Header.Get("Location")
+	assert.True(strings.HasPrefix(location, "https://accounts.google.com/"), location)
+	assert.Contains(location, "redirect_uri=https%3A%2F%2Fapp.example.com%2F_oauth")
+
+	// Should fall back to the X-Forwarded headers
+	req = newHTTPRequest("GET", "https://app.example.com/private")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.NotEmpty(res.Header.Get("Location"))
+}
+
+func TestProxyModeGeneric(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().ProxyMode = "generic"
+
+	// Should read X-Original-URL and pass redirects on
+	req := httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("X-Original-Url", "https://app.example.com/private")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+	assert.Contains(res.Header.Get("Location"), "redirect_uri=https%3A%2F%2Fapp.example.com%2F_oauth")
+
+	// Should refuse unsafe methods of the original request
+	req = httptest.NewRequest("GET", "/auth", nil)
+	req.Header.Set("X-Original-Url", "https://app.example.com/private")
+	req.Header.Set("X-Original-Method", "POST")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Empty(res.Header.Get("Location"))
+}
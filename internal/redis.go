@@ -0,0 +1,88 @@
+package tfa
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis client
+//
+// State is shared between instances with go-redis, which pools connections
+// and handles TLS, ACL users and Redis Cluster
+
+func init() {
+	redis.SetLogger(redisLogger{})
+}
+
+// NewRedisClient creates a client from a URL in the format
+// redis[s]://[[username]:password@]host[:port][/db]. With cluster set the
+// host is one node of a Redis Cluster, more nodes can be given as addr
+// parameters, e.g. redis://:password@node1:6379?addr=node2:6379
+func NewRedisClient(rawURL string, cluster bool) (redis.UniversalClient, error) {
+	if cluster {
+		opts, err := redis.ParseClusterURL(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClusterClient(opts), nil
+	}
+
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opts), nil
+}
+
+// scanRedisKeys returns the keys matching the pattern. They're read with SCAN
+// a batch at a time, as KEYS would block redis while it went through every
+// key. In a cluster each master is scanned
+func scanRedisKeys(ctx context.Context, client redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanRedisNode(ctx, client, pattern)
+	}
+
+	results := make(chan []string)
+	done := make(chan error)
+	go func() {
+		done <- cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			keys, err := scanRedisNode(ctx, node, pattern)
+			results <- keys
+			return err
+		})
+	}()
+
+	var keys []string
+	for {
+		select {
+		case batch := <-results:
+			keys = append(keys, batch...)
+		case err := <-done:
+			return keys, err
+		}
+	}
+}
+
+func scanRedisNode(ctx context.Context, client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		// Keys may be returned more than once during a scan
+		if key := iter.Val(); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, iter.Err()
+}
+
+// redisLogger passes go-redis's messages, e.g. about dropped connections, to
+// the debug log
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, v ...interface{}) {
+	log.Debugf(format, v...)
+}
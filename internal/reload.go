@@ -0,0 +1,132 @@
+package tfa
+
+import (
+	"os"
+	"os/signal"
+	"time"
+)
+
+// Config reload
+//
+// Rules, the whitelist, domains, allowed roles and providers can be changed
+// without a restart: on SIGHUP, or when "watch-config" is set and one of the
+// config files changes, the config is parsed again and, if valid, swapped in
+// for new requests. Sessions are kept, so nobody is logged out. Other options
+// only take effect on restart
+
+// configWatchInterval is how often the config files are checked for changes
+const configWatchInterval = 10 * time.Second
+
+var configReloadsTotal = NewCounterVec("config_reloads_total",
+	"Config reloads, by result", "result")
+
+// Reload parses the config from the arguments again, swapping in the
+// reloadable options if they're valid. The current config is kept otherwise
+func (s *Server) Reload(args []string) error {
+	next, err := NewConfig(args)
+	if err != nil {
+		return err
+	}
+
+	updated := *config()
+	updated.Rules = next.Rules
+	updated.Whitelist = next.Whitelist
+	updated.Domains = next.Domains
+	updated.AllowedRoles = next.AllowedRoles
+	updated.BlockedUsers = next.BlockedUsers
+	updated.BlockedDomains = next.BlockedDomains
+	updated.AllowedTags = next.AllowedTags
+	updated.BlockedTags = next.BlockedTags
+	updated.MatchWhitelistOrDomain = next.MatchWhitelistOrDomain
+	updated.DefaultAction = next.DefaultAction
+	updated.DefaultProvider = next.DefaultProvider
+	updated.Providers = next.Providers
+	updated.OIDCProviders = next.OIDCProviders
+
+	if err := updated.validateAccessLists(); err != nil {
+		return err
+	}
+	if err := updated.setupProvider(updated.DefaultProvider); err != nil {
+		return err
+	}
+	for _, rule := range updated.Rules {
+		if err := rule.Validate(&updated); err != nil {
+			return err
+		}
+	}
+	if _, err := buildRuleMatcher(updated.Rules); err != nil {
+		return err
+	}
+	updated.fingerprint = updated.computeFingerprint()
+
+	// Handlers are built for the new config, requests in progress finish
+	// with the routes they started with
+	setConfig(&updated)
+	fresh := &Server{callbacks: s.callbacks}
+	fresh.buildRoutes()
+
+	s.mu.Lock()
+	s.router, s.ruleMatcher = fresh.router, fresh.ruleMatcher
+	s.mu.Unlock()
+	return nil
+}
+
+// WatchConfig reloads the config whenever one of the signals is received, or
+// when "watch-config" is set and a config file changes. It never returns
+func (s *Server) WatchConfig(args []string, signals ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+
+	var tick <-chan time.Time
+	if config().WatchConfig {
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	modTimes := configModTimes(config().configFiles)
+	for {
+		select {
+		case <-c:
+			log.Info("Reloading config")
+		case <-tick:
+			current := configModTimes(config().configFiles)
+			if !modTimesChanged(modTimes, current) {
+				continue
+			}
+			log.Info("Config file changed, reloading config")
+		}
+
+		modTimes = configModTimes(config().configFiles)
+		if err := s.Reload(args); err != nil {
+			configReloadsTotal.Inc("error")
+			log.WithField("error", err).Error("Invalid config(), keeping the current config")
+			continue
+		}
+		configReloadsTotal.Inc("success")
+		log.WithField("config_hash", config().Fingerprint()).Info("Reloaded config")
+	}
+}
+
+// configModTimes returns when each config file was last modified, files that
+// can't be read have the zero time
+func configModTimes(paths []string) map[string]time.Time {
+	modTimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		} else {
+			modTimes[path] = time.Time{}
+		}
+	}
+	return modTimes
+}
+
+func modTimesChanged(previous, current map[string]time.Time) bool {
+	for path, modTime := range current {
+		if !previous[path].Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package tfa
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestServerReload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	s := NewServer()
+	user := newTestUser("test@example.com")
+
+	serve := func(uri string) int {
+		req := newDefaultHttpRequest(uri)
+		c, _ := MakeCookie(req, user)
+		req.AddCookie(c)
+		w := httptest.NewRecorder()
+		s.RootHandler(w, req)
+		return w.Code
+	}
+	assert.Equal(200, serve("/private"))
+
+	// Should swap in the new rules and whitelist, keeping sessions
+	path := filepath.Join(t.TempDir(), "config.ini")
+	require.Nil(ioutil.WriteFile(path, []byte(`
+whitelist = admin@example.com
+rule.public.action = allow
+rule.public.rule = PathPrefix(`+"`/public`"+`)
+`), 0600))
+	args := []string{
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--config=" + path,
+	}
+	require.Nil(s.Reload(args))
+	assert.Equal(CommaSeparatedList{"admin@example.com"}, config().Whitelist)
+	assert.Equal(200, serve("/public"))
+	assert.Equal(401, serve("/private"), "user is no longer whitelisted")
+	assert.Equal("public", s.matchRule("http://example.com/public"))
+
+	// Should keep the current config if the new one is invalid
+	require.Nil(ioutil.WriteFile(path, []byte(`
+rule.public.action = nope
+rule.public.rule = PathPrefix(`+"`/public`"+`)
+`), 0600))
+	assert.NotNil(s.Reload(args))
+	assert.Equal(CommaSeparatedList{"admin@example.com"}, config().Whitelist)
+	assert.Equal(200, serve("/public"))
+
+	// Should check the global lists as on startup
+	for _, line := range []string{"whitelist = /admin(@example.com/", "domain = /example.(com/", "blocked-users = /bad(@example.com/", "blocked-domains = /bad.(example.com/"} {
+		require.Nil(ioutil.WriteFile(path, []byte(line+"\n"), 0600))
+		err := s.Reload(args)
+		if assert.Error(err, line) {
+			assert.Contains(err.Error(), "invalid pattern")
+		}
+		assert.Equal(CommaSeparatedList{"admin@example.com"}, config().Whitelist)
+	}
+}
+
+func TestServerReloadConcurrent(t *testing.T) {
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	s := NewServer()
+	user := newTestUser("test@example.com")
+
+	path := filepath.Join(t.TempDir(), "config.ini")
+	require.Nil(ioutil.WriteFile(path, []byte("whitelist = test@example.com\n"), 0600))
+	args := []string{
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--config=" + path,
+	}
+
+	// Should serve requests while the config is swapped, run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			req := newDefaultHttpRequest("/private")
+			c, _ := MakeCookie(req, user)
+			req.AddCookie(c)
+			s.RootHandler(httptest.NewRecorder(), req)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		require.Nil(s.Reload(args))
+	}
+	<-done
+}
+
+func TestConfigModTimes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "config.ini")
+	require.Nil(ioutil.WriteFile(path, []byte("whitelist = a@example.com\n"), 0600))
+
+	modTimes := configModTimes([]string{path})
+	assert.False(modTimesChanged(modTimes, configModTimes([]string{path})))
+
+	future := time.Now().Add(time.Minute)
+	require.Nil(os.Chtimes(path, future, future))
+	assert.True(modTimesChanged(modTimes, configModTimes([]string{path})))
+
+	// Should notice a file being removed
+	require.Nil(os.Remove(path))
+	assert.True(modTimesChanged(modTimes, configModTimes([]string{path})))
+}
+
+func TestConfigFiles(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "config.ini")
+	ioutil.WriteFile(path, []byte("watch-config = true\n"), 0600)
+
+	c, err := NewConfig([]string{"--config=" + path})
+	assert.Nil(err)
+	assert.True(c.WatchConfig)
+	assert.Equal([]string{path}, c.configFiles)
+}
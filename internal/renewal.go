@@ -0,0 +1,138 @@
+package tfa
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Session renewal
+//
+// When "renew-window" is set, the refresh token issued at login is kept with
+// the session. Once a request arrives with a cookie that expires within the
+// window, the refresh token is exchanged with the provider and a new cookie is
+// issued, so active users aren't sent back through the login flow
+
+var sessionsRenewedTotal = NewCounterVec("sessions_renewed_total",
+	"Sessions renewed with the provider's refresh token, by result", "result")
+
+// renewing holds the sessions this instance is renewing, so concurrent
+// requests don't exchange the same refresh token
+var renewing = struct {
+	sync.Mutex
+	sessions map[uuid.UUID]bool
+}{sessions: make(map[uuid.UUID]bool)}
+
+// renewable reports whether sessions logged in with the token can be renewed
+func renewable(providerName string, token *provider.Token) bool {
+	if config().RenewWindow <= 0 || token.RefreshToken == "" {
+		return false
+	}
+	p, err := config().GetConfiguredProvider(providerName)
+	if err != nil {
+		return false
+	}
+	_, ok := p.(provider.Refresher)
+	return ok
+}
+
+// renewSession returns a new cookie if the cookie expires within the renew
+// window, exchanging the session's refresh token with the provider. It returns
+// nil if the session isn't due, can't be renewed or is already being renewed
+func renewSession(r *http.Request, c *http.Cookie) (*http.Cookie, error) {
+	if config().RenewWindow <= 0 {
+		return nil, nil
+	}
+	id, expires, err := parseCookie(r, c)
+	if err != nil || time.Until(expires) > config().RenewWindow {
+		return nil, err
+	}
+
+	renewing.Lock()
+	if renewing.sessions[id] {
+		renewing.Unlock()
+		return nil, nil
+	}
+	renewing.sessions[id] = true
+	renewing.Unlock()
+	defer func() {
+		renewing.Lock()
+		delete(renewing.sessions, id)
+		renewing.Unlock()
+	}()
+
+	entry, err := sessions.Get(id)
+	if err != nil || entry == nil || entry.RefreshToken == "" {
+		return nil, err
+	}
+
+	// The session was renewed after this cookie was issued, e.g. by a
+	// concurrent request, the client just hasn't stored the new cookie yet
+	if entry.RenewedAt.After(expires.Add(-cookieLifetime())) {
+		return MakeCookie(r, entry.User)
+	}
+
+	p, err := config().GetConfiguredProvider(entry.Provider)
+	if err != nil {
+		return nil, err
+	}
+	refresher, ok := p.(provider.Refresher)
+	if !ok {
+		return nil, nil
+	}
+
+	// Renewal can wait for a later request
+	if err := waitProviderBudget(entry.Provider, "refresh", true); err != nil {
+		sessionsRenewedTotal.Inc("deferred")
+		return nil, nil
+	}
+	start := time.Now()
+	token, err := refresher.Refresh(entry.RefreshToken)
+	observeProviderRequest(entry.Provider, "refresh", start, err)
+	traceProviderRequest(r, entry.Provider, "refresh", start, err)
+	if err != nil {
+		sessionsRenewedTotal.Inc("error")
+		return nil, err
+	}
+
+	user := *entry.User
+	renewed := *entry
+	renewed.User = &user
+	renewed.RenewedAt = time.Now()
+	if token.RefreshToken != "" {
+		// Some providers rotate refresh tokens
+		renewed.RefreshToken = token.RefreshToken
+	}
+	if renewed.IDToken != "" && token.IDToken != "" {
+		renewed.IDToken = token.IDToken
+	}
+	if config().LimitLifetimeToProvider {
+		user.SessionExpiry = token.SessionExpiry()
+	}
+	resolveGroups(r, log.WithField("provider", entry.Provider), entry.Provider, p, token, &user)
+
+	if err := sessions.Put(id, &renewed, sessionTTL()); err != nil {
+		sessionsRenewedTotal.Inc("error")
+		return nil, err
+	}
+	consentChecked(id, renewed.RefreshToken)
+	sessionsRenewedTotal.Inc("success")
+
+	return MakeCookie(r, &user)
+}
+
+// renewedRefreshToken keeps a refresh token rotated outside of renewal, e.g.
+// by a consent check, with the session
+func renewedRefreshToken(id uuid.UUID, refreshToken string) error {
+	entry, err := sessions.Get(id)
+	if err != nil || entry == nil || entry.RefreshToken == "" || entry.RefreshToken == refreshToken {
+		return err
+	}
+
+	updated := *entry
+	updated.RefreshToken = refreshToken
+	return sessions.Put(id, &updated, sessionTTL())
+}
@@ -0,0 +1,147 @@
+package tfa
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestRenewSession(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().RenewWindow = time.Hour
+
+	// Setup a provider that rotates refresh tokens
+	revoked := false
+	var refreshed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if revoked {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(400)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		refreshed = append(refreshed, r.PostForm.Get("refresh_token"))
+		fmt.Fprintf(w, `{"access_token":"access","refresh_token":"refresh-%d"}`, len(refreshed)+1)
+	}))
+	defer server.Close()
+	config().Providers.Google.TokenURL, _ = url.Parse(server.URL + "/token")
+
+	user := newTestUser("renew@example.com")
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Renew)")
+	require.Nil(recordSessionClient(user, req))
+	require.Nil(keepTokens(user, "google", &provider.Token{RefreshToken: "refresh-1"}))
+
+	// Should keep the client the session was created from
+	entry, err := sessions.Get(user.UUID)
+	require.Nil(err)
+	assert.Equal("Mozilla/5.0 (Renew)", entry.UserAgent)
+
+	// Should not renew cookies that aren't due
+	c, err := MakeCookie(req, user)
+	require.Nil(err)
+	renewed, err := renewSession(req, c)
+	assert.Nil(err)
+	assert.Nil(renewed)
+	assert.Empty(refreshed)
+
+	// Should renew cookies expiring within the window
+	lifetime := config().Lifetime
+	config().Lifetime = 30 * time.Minute
+	c, _ = MakeCookie(req, user)
+	config().Lifetime = lifetime
+
+	renewed, err = renewSession(req, c)
+	assert.Nil(err)
+	if assert.NotNil(renewed) {
+		assert.Equal(config().CookieName, renewed.Name)
+		assert.WithinDuration(time.Now().Add(lifetime), renewed.Expires, 10*time.Second)
+		renewedUser, err := ValidateCookie(req, renewed)
+		assert.Nil(err)
+		assert.Equal(user.Email, renewedUser.Email)
+	}
+	assert.Equal([]string{"refresh-1"}, refreshed)
+	entry, _ = sessions.Get(user.UUID)
+	require.NotNil(entry)
+	assert.Equal("refresh-2", entry.RefreshToken, "should keep rotated refresh token")
+
+	// Should reissue the cookie without the provider if the session was
+	// renewed since the cookie was issued
+	renewed, err = renewSession(req, c)
+	assert.Nil(err)
+	assert.NotNil(renewed)
+	assert.Len(refreshed, 1)
+
+	// Should keep the cookie if the provider refuses to renew
+	revoked = true
+	entry.RenewedAt = time.Time{}
+	sessions.Put(user.UUID, entry, time.Hour)
+	renewed, err = renewSession(req, c)
+	assert.NotNil(err)
+	assert.Nil(renewed)
+	loaded, _ := ValidateCookie(req, c)
+	assert.NotNil(loaded, "session should be kept until the cookie expires")
+
+	// Should not renew sessions without a refresh token
+	other := newTestUser("other@example.com")
+	config().Lifetime = 30 * time.Minute
+	c, _ = MakeCookie(req, other)
+	config().Lifetime = lifetime
+	renewed, err = renewSession(req, c)
+	assert.Nil(err)
+	assert.Nil(renewed)
+}
+
+func TestRenewSessionAuthHandler(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().RenewWindow = time.Hour
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh-2"}`)
+	}))
+	defer server.Close()
+	config().Providers.Google.TokenURL, _ = url.Parse(server.URL + "/token")
+
+	user := newTestUser("renew@example.com")
+	keepTokens(user, "google", &provider.Token{RefreshToken: "refresh-1"})
+
+	// Should allow the request and set the renewed cookie
+	lifetime := config().Lifetime
+	config().Lifetime = 30 * time.Minute
+	req := newDefaultHttpRequest("/foo")
+	c, _ := MakeCookie(req, user)
+	config().Lifetime = lifetime
+
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	cookies := res.Cookies()
+	if assert.Len(cookies, 2) {
+		renewed := cookies[1]
+		assert.Equal(config().CookieName, renewed.Name)
+		assert.NotEqual(c.Value, renewed.Value)
+	}
+
+	// Should not track refresh tokens when renewal is disabled
+	config().RenewWindow = 0
+	untracked := newTestUser("untracked@example.com")
+	keepTokens(untracked, "google", &provider.Token{RefreshToken: "refresh-1"})
+	entry, _ := sessions.Get(untracked.UUID)
+	if assert.NotNil(entry) {
+		assert.Equal("", entry.RefreshToken)
+	}
+}
@@ -0,0 +1,57 @@
+package tfa
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Report-only window
+//
+// Until "report-only-until" passes, requests that would be denied or sent to
+// log in are allowed, and the decision that would have been made is logged
+// and counted. Once the time passes every instance enforces its rules, so a
+// site migrating to forward auth can observe the impact first without anyone
+// having to remember to turn enforcement on
+
+var reportOnlyDecisionsTotal = NewCounterVec("report_only_decisions_total",
+	"Requests allowed during the report-only window, by the decision that would have been enforced", "rule", "decision")
+
+// reportOnlyEnded logs the end of the window once
+var reportOnlyEnded sync.Once
+
+// reportOnly reports whether the window is open
+func reportOnly() bool {
+	if config().reportOnlyUntil.IsZero() {
+		return false
+	}
+	if time.Now().Before(config().reportOnlyUntil) {
+		return true
+	}
+
+	reportOnlyEnded.Do(func() {
+		log.WithField("report_only_until", config().reportOnlyUntil.Format(time.RFC3339)).Warn("Report-only window has ended, enforcing rules")
+	})
+	return false
+}
+
+// allowReportOnly allows the request instead of the decision ("deny" or
+// "login") if the window is open, returning false if the decision should be
+// enforced
+func allowReportOnly(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule, decision, reason string) bool {
+	if !reportOnly() {
+		return false
+	}
+
+	traceCheck(r, "report-only", "would "+decision+": "+reason)
+	logger.WithFields(logrus.Fields{
+		"decision": decision,
+		"reason":   reason,
+	}).Warn("Report-only, allowing request that would not have been allowed")
+	reportOnlyDecisionsTotal.Inc(rule, decision)
+	recordDecision(r, rule, "allow")
+	w.WriteHeader(200)
+	return true
+}
@@ -0,0 +1,91 @@
+package tfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestReportOnlyWindow(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Whitelist = []string{"permitted@example.com"}
+	config().reportOnlyUntil = time.Now().Add(time.Hour)
+
+	logins := reportOnlyDecisionsTotal.Value("default", "login")
+	denied := reportOnlyDecisionsTotal.Value("default", "deny")
+
+	// Should allow requests that would be sent to log in
+	req := newDefaultHttpRequest("/foo")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("", res.Header.Get("X-Forwarded-User"))
+	assert.Equal(logins+1, reportOnlyDecisionsTotal.Value("default", "login"))
+
+	// Should allow users that would be denied, without passing their identity
+	req = newDefaultHttpRequest("/foo")
+	c, _ := MakeCookie(req, newTestUser("other@example.com"))
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("", res.Header.Get("X-Forwarded-User"))
+	assert.Equal(denied+1, reportOnlyDecisionsTotal.Value("default", "deny"))
+
+	// Should pass permitted users as usual
+	req = newDefaultHttpRequest("/foo")
+	c, _ = MakeCookie(req, newTestUser("permitted@example.com"))
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("permitted@example.com", res.Header.Get("X-Forwarded-User"))
+
+	// Should enforce once the window has passed
+	config().reportOnlyUntil = time.Now().Add(-time.Second)
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+
+	req = newDefaultHttpRequest("/foo")
+	c, _ = MakeCookie(req, newTestUser("other@example.com"))
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+	assert.Equal(denied+1, reportOnlyDecisionsTotal.Value("default", "deny"))
+}
+
+func TestReportOnlyConfig(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	newConfig := func(until string) *Config {
+		hook.Reset()
+		c, _ := NewConfig([]string{
+			"--secret=veryveryverysecret",
+			"--providers.google.client-id=id",
+			"--providers.google.client-secret=secret",
+			"--report-only-until=" + until,
+		})
+		c.Validate()
+		return c
+	}
+
+	c := newConfig("2099-01-31T09:00:00Z")
+	assert.Equal(time.Date(2099, 1, 31, 9, 0, 0, 0, time.UTC), c.reportOnlyUntil.UTC())
+	if assert.Len(hook.AllEntries(), 1) {
+		assert.Equal("Report-only, denials and logins are not enforced", hook.LastEntry().Message)
+	}
+
+	// Should not warn about a window that has passed
+	newConfig("2020-01-31T09:00:00Z")
+	assert.Len(hook.AllEntries(), 0)
+
+	newConfig("next week")
+	if assert.Len(hook.AllEntries(), 1) {
+		assert.Equal("\"report-only-until\" must be an RFC 3339 time, e.g. 2024-01-31T09:00:00Z", hook.LastEntry().Message)
+	}
+}
@@ -0,0 +1,149 @@
+package tfa
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Request logging
+//
+// Each request is given an ID, taken from the "request-id-header" when traefik
+// (or a proxy in front of it) sets one, so entries can be matched up with the
+// proxy's access log. The ID is added to every entry logged for the request
+// and echoed in the response. With "log-decisions", each auth decision is
+// logged at the info level with the user, rule, decision and the check that
+// decided it, so decisions can be searched once shipped to a log store,
+// ideally with log-format=json
+
+// maxRequestIDLength is the longest request ID accepted from a client
+const maxRequestIDLength = 128
+
+// ensureRequestID gives the request an ID if it doesn't have a usable one,
+// and echoes it in the response
+func ensureRequestID(w http.ResponseWriter, r *http.Request) string {
+	if config().RequestIDHeader == "" {
+		return ""
+	}
+
+	id := r.Header.Get(config().RequestIDHeader)
+	if !validRequestID(id) {
+		if err, nonce := Nonce(); err == nil {
+			id = nonce
+		} else {
+			id = ""
+		}
+		r.Header.Set(config().RequestIDHeader, id)
+	}
+	w.Header().Set(config().RequestIDHeader, id)
+	return id
+}
+
+// validRequestID checks an ID is safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	return strings.IndexFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) < 0
+}
+
+// requestID returns the ID of the request
+func requestID(r *http.Request) string {
+	if config().RequestIDHeader == "" {
+		return ""
+	}
+	return r.Header.Get(config().RequestIDHeader)
+}
+
+type decisionLogKey struct{}
+
+// decisionLog records the outcome of a forward auth request
+type decisionLog struct {
+	decision string
+	user     string
+	reason   string
+}
+
+// withDecisionLog logs the decision made by next for the rule, if
+// "log-decisions" is set, audits denials and adds the decision to the trace
+func (s *Server) withDecisionLog(rule string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &decisionLog{}
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), decisionLogKey{}, entry)))
+
+		if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
+			span.SetAttributes(
+				attribute.String("rule", rule),
+				attribute.String("decision", entry.decision),
+				attribute.String("user", entry.user),
+				attribute.String("reason", entry.reason),
+			)
+		}
+
+		if entry.decision == "deny" {
+			auditEvent("access_denied", entry.reason, auditRequestFields(r, logrus.Fields{
+				"user":   entry.user,
+				"rule":   rule,
+				"method": r.Method,
+				"host":   r.Host,
+				"uri":    r.URL.RequestURI(),
+			}))
+		}
+
+		if !config().LogDecisions {
+			return
+		}
+
+		// Failures that weren't decisions, e.g. the session store is down
+		if entry.decision == "" {
+			entry.decision = "error"
+		}
+
+		log.WithFields(logrus.Fields{
+			"request_id": requestID(r),
+			"instance":   config().InstanceID,
+			"rule":       rule,
+			"decision":   entry.decision,
+			"user":       entry.user,
+			"reason":     entry.reason,
+			"status":     rec.status,
+			"method":     r.Header.Get("X-Forwarded-Method"),
+			"host":       r.Header.Get("X-Forwarded-Host"),
+			"uri":        r.Header.Get("X-Forwarded-Uri"),
+			"source_ip":  originalClientIP(r),
+			"duration":   time.Since(start).String(),
+		}).Info("Auth decision")
+	})
+}
+
+// recordDecision counts the decision made for the rule, and notes it for the
+// decision log
+func recordDecision(r *http.Request, rule, decision string) {
+	authDecisionsTotal.Inc(rule, decision)
+	if entry, ok := r.Context().Value(decisionLogKey{}).(*decisionLog); ok {
+		entry.decision = decision
+	}
+}
+
+// recordDecisionUser notes the user a decision is being made for
+func recordDecisionUser(r *http.Request, user *provider.User) {
+	if entry, ok := r.Context().Value(decisionLogKey{}).(*decisionLog); ok {
+		entry.user = user.Email
+	}
+}
+
+// recordDecisionReason notes the latest check made, the last before the
+// decision is its reason
+func recordDecisionReason(r *http.Request, check, result string) {
+	if entry, ok := r.Context().Value(decisionLogKey{}).(*decisionLog); ok {
+		entry.reason = check + ": " + result
+	}
+}
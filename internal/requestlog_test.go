@@ -0,0 +1,135 @@
+package tfa
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestEnsureRequestID(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should keep the ID set by traefik
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "abc-123")
+	w := httptest.NewRecorder()
+	assert.Equal("abc-123", ensureRequestID(w, req))
+	assert.Equal("abc-123", w.Header().Get("X-Request-Id"))
+
+	// Should generate an ID when missing
+	req = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	id := ensureRequestID(w, req)
+	assert.Len(id, 32)
+	assert.Equal(id, requestID(req))
+	assert.Equal(id, w.Header().Get("X-Request-Id"))
+
+	// Should replace IDs that aren't safe to log
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "abc 123")
+	assert.Len(ensureRequestID(httptest.NewRecorder(), req), 32)
+	req.Header.Set("X-Request-Id", strings.Repeat("a", 129))
+	assert.Len(ensureRequestID(httptest.NewRecorder(), req), 32)
+
+	// Should do nothing when disabled
+	config().RequestIDHeader = ""
+	req = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	assert.Equal("", ensureRequestID(w, req))
+	assert.Empty(w.Header().Get("X-Request-Id"))
+}
+
+func TestServerRequestID(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	h := NewServer().Handler()
+
+	// Should echo the request ID
+	req := newHTTPRequest("GET", "https://example.com/foo")
+	req.Header.Set("X-Request-Id", "abc-123")
+	res := serveRouter(h, req)
+	assert.Equal(307, res.Code)
+	assert.Equal("abc-123", res.Header().Get("X-Request-Id"))
+
+	// Should generate one for the service's own endpoints too
+	res = serveRouter(h, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Len(res.Header().Get("X-Request-Id"), 32)
+}
+
+func TestDecisionLog(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	setConfig(newDefaultConfig())
+	config().Whitelist = []string{"other@example.com"}
+
+	// Should not log decisions by default
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Request-Id", "abc-123")
+	doHttpRequest(req, nil)
+	assert.Nil(decisionLogEntry(hook))
+
+	// Should log a redirect to log in
+	config().LogDecisions = true
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Request-Id", "abc-123")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+	entry := decisionLogEntry(hook)
+	if assert.NotNil(entry) {
+		assert.Equal(logrus.InfoLevel, entry.Level)
+		assert.Equal("abc-123", entry.Data["request_id"])
+		assert.Equal("default", entry.Data["rule"])
+		assert.Equal("login", entry.Data["decision"])
+		assert.Equal("login: redirecting to google", entry.Data["reason"])
+		assert.Equal(307, entry.Data["status"])
+	}
+
+	// Should log the user denied
+	hook.Reset()
+	req = newDefaultHttpRequest("/foo")
+	c, _ := MakeCookie(req, newTestUser("test@example.com"))
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+	entry = decisionLogEntry(hook)
+	if assert.NotNil(entry) {
+		assert.Equal("deny", entry.Data["decision"])
+		assert.Equal("test@example.com", entry.Data["user"])
+		assert.Equal("user: test@example.com not permitted", entry.Data["reason"])
+	}
+
+	// Should log the user allowed
+	hook.Reset()
+	config().Whitelist = []string{"test@example.com"}
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	entry = decisionLogEntry(hook)
+	if assert.NotNil(entry) {
+		assert.Equal("allow", entry.Data["decision"])
+		assert.Equal("test@example.com", entry.Data["user"])
+		assert.Equal(200, entry.Data["status"])
+	}
+}
+
+/**
+ * Utilities
+ */
+
+func decisionLogEntry(hook *test.Hook) *logrus.Entry {
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Auth decision" {
+			return entry
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package tfa
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Role map
+
+// roleMap is set when "role-map" is configured
+var roleMap *RoleMap
+
+// roleMapReloadInterval is how often the role map file is checked for changes
+const roleMapReloadInterval = 10 * time.Second
+
+// RoleMap translates the groups providers grant, such as Azure AD object ids
+// or LDAP DNs, into the role names used by rules and headers, so policy
+// doesn't depend on provider internal identifiers
+type RoleMap struct {
+	mu        sync.Mutex
+	path      string
+	roles     map[string][]string
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewRoleMap loads the role map at the given path
+func NewRoleMap(path string) (*RoleMap, error) {
+	m := &RoleMap{path: path}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	m.lastCheck = time.Now()
+	return m, nil
+}
+
+// Translate replaces the roles found in the map with the roles they map to,
+// roles missing from the map are kept as they are. Groups are matched
+// ignoring case
+func (m *RoleMap) Translate(roles []string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reloadIfChanged()
+	var translated []string
+	for _, role := range roles {
+		mapped, ok := m.roles[strings.ToLower(role)]
+		if !ok {
+			mapped = []string{role}
+		}
+		for _, r := range mapped {
+			if !containsString(translated, r) {
+				translated = append(translated, r)
+			}
+		}
+	}
+	return translated
+}
+
+// Apply translates the user's roles
+func (m *RoleMap) Apply(user *provider.User) {
+	user.Roles = m.Translate(user.Roles)
+}
+
+// reloadIfChanged reloads the map if the file has been modified, at most
+// every reload interval. Must be called with the lock held
+func (m *RoleMap) reloadIfChanged() {
+	if time.Since(m.lastCheck) < roleMapReloadInterval {
+		return
+	}
+	m.lastCheck = time.Now()
+
+	info, err := os.Stat(m.path)
+	if err != nil || info.ModTime().Equal(m.modTime) {
+		return
+	}
+	if err := m.load(); err != nil {
+		log.WithField("error", err).Warn("Error reloading role map, keeping previous contents")
+		return
+	}
+	log.WithField("groups", len(m.roles)).Info("Reloaded role map")
+}
+
+// load reads the map from disk, a JSON object of groups to the role, or list
+// of roles, they grant. Must be called with the lock held
+func (m *RoleMap) load() error {
+	f, err := os.Open(m.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var file map[string]json.RawMessage
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return err
+	}
+
+	roles := make(map[string][]string)
+	for group, raw := range file {
+		var mapped []string
+		var role string
+		if err := json.Unmarshal(raw, &role); err == nil {
+			mapped = []string{role}
+		} else if err := json.Unmarshal(raw, &mapped); err != nil {
+			return fmt.Errorf("group %q must map to a role or list of roles", group)
+		}
+		roles[strings.ToLower(group)] = sortedUnique(mapped)
+	}
+
+	m.roles = roles
+	m.modTime = info.ModTime()
+	return nil
+}
@@ -0,0 +1,92 @@
+package tfa
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestRoleMapTranslate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "roles.json")
+	require.Nil(ioutil.WriteFile(path, []byte(`{
+		"3F2504E0-4F89-11D3-9A0C-0305E82C3301": "admin",
+		"CN=Ops,OU=Groups,DC=example,DC=com": ["ops", "staff"],
+		"cn=dev,ou=groups,dc=example,dc=com": "staff"
+	}`), 0600))
+
+	m, err := NewRoleMap(path)
+	require.Nil(err)
+
+	// Should translate mapped groups ignoring case, keep others and
+	// drop duplicates
+	user := &provider.User{Roles: []string{
+		"3f2504e0-4f89-11d3-9a0c-0305e82c3301",
+		"CN=Ops,OU=Groups,DC=example,DC=com",
+		"CN=Dev,OU=Groups,DC=example,DC=com",
+		"viewer",
+	}}
+	m.Apply(user)
+	assert.Equal([]string{"admin", "ops", "staff", "viewer"}, user.Roles)
+	assert.Nil(m.Translate(nil))
+}
+
+func TestRoleMapReload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "roles.json")
+	require.Nil(ioutil.WriteFile(path, []byte(`{"group-1": "admin"}`), 0600))
+
+	m, err := NewRoleMap(path)
+	require.Nil(err)
+	assert.Equal([]string{"admin"}, m.Translate([]string{"group-1"}))
+
+	// Should pick up changes to the file
+	require.Nil(ioutil.WriteFile(path, []byte(`{"group-1": "viewer"}`), 0600))
+	future := time.Now().Add(time.Minute)
+	require.Nil(os.Chtimes(path, future, future))
+	m.lastCheck = time.Time{}
+	assert.Equal([]string{"viewer"}, m.Translate([]string{"group-1"}))
+
+	// Should keep the previous contents when the file is invalid
+	require.Nil(ioutil.WriteFile(path, []byte(`{"group-1": 1}`), 0600))
+	future = future.Add(time.Minute)
+	require.Nil(os.Chtimes(path, future, future))
+	m.lastCheck = time.Time{}
+	assert.Equal([]string{"viewer"}, m.Translate([]string{"group-1"}))
+}
+
+func TestRoleMapConfig(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	path := filepath.Join(t.TempDir(), "roles.json")
+	ioutil.WriteFile(path, []byte(`{"group-1": {"role": "admin"}}`), 0600)
+
+	c, _ := NewConfig([]string{
+		"--secret=veryveryverysecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--role-map=" + path,
+	})
+	c.Validate()
+	logs := hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.True(strings.HasPrefix(logs[0].Message, "unable to load role-map: group \"group-1\""), logs[0].Message)
+	}
+}
@@ -0,0 +1,271 @@
+package tfa
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Handler returns the top level handler. The service's own endpoints are routed
+// by path and method, requests forwarded by traefik are passed to the
+// RootHandler
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+
+	r.Handle("/healthz", s.withLogging("Health", s.HealthHandler())).Methods("GET", "HEAD")
+	r.Handle("/readyz", s.withLogging("Ready", s.ReadyHandler())).Methods("GET", "HEAD")
+	if config().MetricsPort == 0 {
+		r.Handle("/metrics", s.withLogging("Metrics", s.MetricsHandler())).Methods("GET")
+	}
+	r.Handle(config().Path+"/userinfo", s.withLogging("UserInfo", s.withRateLimit(s.UserInfoHandler()))).Methods("GET")
+	r.Handle(config().Path+"/avatar", s.withLogging("Avatar", s.withRateLimit(s.AvatarHandler()))).Methods("GET")
+
+	if config().SessionsPage {
+		r.Handle(config().Path+"/sessions", s.withLogging("Sessions", s.withRateLimit(s.SessionsPageHandler()))).Methods("GET")
+		r.Handle(config().Path+"/sessions", s.withLogging("Sessions", s.withRateLimit(s.SessionsRevokeHandler()))).Methods("POST")
+	}
+
+	if config().APIModeParamLifetime > 0 {
+		r.Handle(config().Path+APIModeURLPath, s.withLogging("APIModeURL", s.withRateLimit(s.APIModeURLHandler()))).Methods("GET")
+	}
+
+	if config().DownloadTokenLifetime > 0 {
+		r.Handle(config().Path+DownloadTokenPath, s.withLogging("DownloadToken", s.withRateLimit(s.DownloadTokenHandler()))).Methods("GET")
+	}
+
+	if config().AccessCodeLifetime > 0 {
+		r.Handle(config().Path+AccessCodePath, s.withLogging("AccessCode", s.withRateLimit(s.AccessCodeHandler()))).Methods("GET")
+		r.Handle(config().Path+AccessCodeVerifyPath, s.withLogging("AccessCodeVerify", s.withRateLimit(s.withLockout(s.AccessCodeVerifyHandler())))).Methods("POST")
+	}
+
+	// The identity provider posts SAML responses directly
+	if config().providerConfigured("saml") {
+		r.Handle(config().Path+provider.SAMLMetadataPath, s.withLogging("SAMLMetadata", s.SAMLMetadataHandler())).Methods("GET")
+		r.Handle(config().Path+provider.SAMLACSPath, s.withLogging("SAMLAssertion", s.withRateLimit(s.withLockout(s.SAMLAssertionHandler())))).Methods("POST")
+	}
+
+	// The issuer pushes security events directly
+	if config().SecurityEventsIssuer != "" {
+		r.Handle(config().Path+SecurityEventsPath, s.withLogging("SecurityEvents", s.SecurityEventsHandler())).Methods("POST")
+	}
+
+	if config().JWT {
+		r.Handle(JWKSPath, s.withLogging("JWKS", s.JWKSHandler())).Methods("GET")
+	}
+
+	// Admin endpoints are only available when a token or admin roles are
+	// configured
+	if config().adminEnabled() {
+		admin := r.PathPrefix("/admin").Subrouter()
+		admin.Handle("/sessions", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminView, s.AdminSessionsHandler())))).Methods("GET")
+		admin.Handle("/sessions", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminManage, s.AdminRevokeUserSessionsHandler())))).Methods("DELETE")
+		admin.Handle("/sessions/{id}", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminManage, s.AdminRevokeSessionHandler())))).Methods("DELETE")
+		admin.Handle("/config", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminView, s.AdminConfigHandler())))).Methods("GET")
+		admin.Handle("/simulate", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminView, s.AdminSimulateHandler())))).Methods("GET")
+		admin.Handle("/logs", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminManage, s.AdminLogsHandler())))).Methods("GET")
+		admin.Handle("/ui", http.RedirectHandler("/admin/ui/", http.StatusMovedPermanently)).Methods("GET", "HEAD")
+		admin.PathPrefix("/ui/").Handler(s.withLogging("AdminUI", s.AdminUIHandler())).Methods("GET", "HEAD")
+
+		r.Handle(DecisionPath, s.withLogging("Decision", s.withRateLimit(s.withAdminPermission(adminView, s.DecisionHandler())))).Methods("POST")
+
+		if config().UserDirectory != "" {
+			admin.Handle("/users", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminView, s.AdminUsersHandler())))).Methods("GET")
+			admin.Handle("/users/import", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminManage, s.AdminImportUsersHandler())))).Methods("POST")
+		}
+
+		if config().UserTags != "" {
+			admin.Handle("/tags", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminView, s.AdminTagsHandler())))).Methods("GET")
+			admin.Handle("/tags", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminManage, s.AdminSetTagsHandler())))).Methods("PUT")
+			admin.Handle("/tags", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminManage, s.AdminDeleteTagsHandler())))).Methods("DELETE")
+		}
+
+		if config().RoleGrants != "" {
+			admin.Handle("/grants", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminView, s.AdminGrantsHandler())))).Methods("GET")
+			admin.Handle("/grants", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminManage, s.AdminGrantRoleHandler())))).Methods("POST")
+			admin.Handle("/grants", s.withLogging("Admin", s.withRateLimit(s.withAdminPermission(adminManage, s.AdminRevokeGrantHandler())))).Methods("DELETE")
+		}
+	}
+
+	r.PathPrefix("/").MatcherFunc(isForwardedRequest).Handler(s.withLogging("Root", http.HandlerFunc(s.RootHandler)))
+
+	return r
+}
+
+// Middleware
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// withLogging logs the outcome and duration of each request, and traces it
+func (s *Server) withLogging(handler string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := ensureRequestID(w, r)
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		path := r.URL.Path
+
+		r, span := startRequestSpan(r, handler)
+		next.ServeHTTP(rec, r)
+		endRequestSpan(span, rec.status)
+
+		log.WithFields(logrus.Fields{
+			"request_id": id,
+			"handler":    handler,
+			"method":     r.Method,
+			"path":       path,
+			"status":     rec.status,
+			"duration":   time.Since(start).String(),
+		}).Debug("Handled request")
+	})
+}
+
+// authHandler wraps the handler of a rule, or the default handler, with the
+// middleware every forward auth request goes through
+func (s *Server) authHandler(rule string, next http.Handler) http.Handler {
+	return withProxyResponse(withGRPCResponse(withForwardedFor(s.withDecisionLog(rule, s.withDecisionTrace(rule, next)))))
+}
+
+// withRateLimit rejects clients that have exceeded "rate-limit" requests in
+// the current minute. Clients are counted by the address found by skipping the
+// trusted proxies, as the first X-Forwarded-For entry can be set by the client
+func (s *Server) withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config().RateLimit > 0 && !rateLimiter.Allow(originalClientIP(r), config().RateLimit) {
+			log.WithField("source_ip", originalClientIP(r)).Warn("Rate limit exceeded")
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Too many requests", 429)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withAdminPermission requires the "admin-token" as a bearer token, or the
+// auth cookie of a user with a role granting the permission
+func (s *Server) withAdminPermission(permission adminPermission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setInstanceHeaders(w)
+
+		if token := r.Header.Get("Authorization"); token != "" {
+			token = strings.TrimPrefix(token, "Bearer ")
+			if config().AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config().AdminToken)) != 1 {
+				log.WithField("source_ip", originalClientIP(r)).Warn("Invalid admin token")
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := adminUser(r)
+		if err != nil {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		if !hasAdminPermission(user, permission) {
+			log.WithFields(logrus.Fields{
+				"user":       user.Email,
+				"permission": permission,
+				"source_ip":  originalClientIP(r),
+			}).Warn("Admin permission denied")
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+
+		// The cookie is sent with cross site requests too
+		if r.Method != "GET" && !sameOrigin(r) {
+			log.WithFields(logrus.Fields{
+				"user":      user.Email,
+				"origin":    r.Header.Get("Origin"),
+				"source_ip": originalClientIP(r),
+			}).Warn("Cross origin admin request refused")
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Rate limiting
+
+var rateLimiter = NewRateLimiter("ratelimit:", time.Minute)
+
+// RateLimiter limits requests per key in fixed windows, counted in the shared
+// counter store so limits apply across all instances
+type RateLimiter struct {
+	prefix string
+	window time.Duration
+}
+
+// NewRateLimiter creates a rate limiter with the given window, prefix
+// distinguishes its counters from others in the store
+func NewRateLimiter(prefix string, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		prefix: prefix,
+		window: window,
+	}
+}
+
+// Allow records a request for the key, returning false if the key has already
+// made limit requests in the current window
+func (l *RateLimiter) Allow(key string, limit int) bool {
+	count, err := counters.Incr(l.prefix+key, l.window)
+	if err != nil {
+		log.WithField("error", err).Warn("Error counting request, allowing")
+		return true
+	}
+	return count <= int64(limit)
+}
+
+// Lockout
+
+// withLockout rejects clients that have failed to log in "lockout-threshold"
+// times within the "lockout-duration", counted by address as with rate limits
+func (s *Server) withLockout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config().LockoutThreshold <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		failures, err := counters.Get("lockout:" + originalClientIP(r))
+		if err != nil {
+			log.WithField("error", err).Warn("Error reading login failures, allowing")
+		} else if failures >= int64(config().LockoutThreshold) {
+			log.WithField("source_ip", originalClientIP(r)).Warn("Client locked out after failed logins")
+			w.Header().Set("Retry-After", strconv.Itoa(int(config().LockoutDuration/time.Second)))
+			http.Error(w, "Too many failed login attempts", 429)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordLoginFailure counts a failed login towards the client's lockout
+func recordLoginFailure(r *http.Request) {
+	if config().LockoutThreshold <= 0 {
+		return
+	}
+
+	if _, err := counters.Incr("lockout:"+originalClientIP(r), config().LockoutDuration); err != nil {
+		log.WithField("error", err).Warn("Error recording login failure")
+	}
+}
@@ -0,0 +1,158 @@
+package tfa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestRouterEndpoints(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	h := NewServer().Handler()
+
+	// Should route health checks
+	res := serveRouter(h, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(200, res.Code)
+	assert.Equal("ok\n", res.Body.String())
+
+	// Should reject unsupported methods
+	res = serveRouter(h, httptest.NewRequest("POST", "/healthz", nil))
+	assert.Equal(405, res.Code)
+
+	// Should route readiness checks
+	res = serveRouter(h, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(200, res.Code)
+	assert.Equal("ok\n", res.Body.String())
+
+	// Should route metrics
+	res = serveRouter(h, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(200, res.Code)
+	assert.Contains(res.Body.String(), "traefik_forward_auth_logins_total")
+
+	// Should not expose admin endpoints without a token
+	res = serveRouter(h, httptest.NewRequest("GET", "/admin/sessions", nil))
+	assert.Equal(404, res.Code)
+
+	// Should pass everything else to the forward auth router
+	req := newDefaultHttpRequest("/foo")
+	res = serveRouter(h, req)
+	assert.Equal(307, res.Code)
+}
+
+func TestRouterRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().RateLimit = 2
+	counters = NewMemoryCounterStore()
+	h := NewServer().Handler()
+
+	// Should limit requests per client
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/_oauth/userinfo", nil)
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		assert.Equal(401, serveRouter(h, req).Code)
+	}
+	req := httptest.NewRequest("GET", "/_oauth/userinfo", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	res := serveRouter(h, req)
+	assert.Equal(429, res.Code)
+	assert.Equal("60", res.Header().Get("Retry-After"))
+
+	// Should not limit other clients
+	req = httptest.NewRequest("GET", "/_oauth/userinfo", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.2")
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should not be escaped by adding X-Forwarded-For entries
+	req = httptest.NewRequest("GET", "/_oauth/userinfo", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.3, 10.0.0.1")
+	assert.Equal(429, serveRouter(h, req).Code)
+
+	// Should skip the trusted proxies
+	config().TrustedIPDepth = 1
+	req = httptest.NewRequest("GET", "/_oauth/userinfo", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 192.168.0.1")
+	assert.Equal(429, serveRouter(h, req).Code)
+	req = httptest.NewRequest("GET", "/_oauth/userinfo", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.4, 192.168.0.1")
+	assert.Equal(401, serveRouter(h, req).Code)
+	config().TrustedIPDepth = 0
+
+	// Should limit forwarded login requests
+	req = newDefaultHttpRequest("/_oauth/login")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	res = serveRouter(h, req)
+	assert.Equal(429, res.Code)
+
+	// Should not limit forwarded auth requests
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	res = serveRouter(h, req)
+	assert.Equal(307, res.Code)
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	counters = NewMemoryCounterStore()
+	l := NewRateLimiter("test:", time.Minute)
+
+	assert.True(l.Allow("a", 1))
+	assert.False(l.Allow("a", 1))
+	assert.True(l.Allow("b", 1))
+
+	// Should reset in the next window
+	counters.(*MemoryCounterStore).counts["test:a"].expires = time.Now()
+	assert.True(l.Allow("a", 1))
+}
+
+func TestRouterLockout(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().LockoutThreshold = 2
+	counters = NewMemoryCounterStore()
+
+	// Should count failed callbacks
+	for i := 0; i < 2; i++ {
+		req := newDefaultHttpRequest("/_oauth?state=invalid")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		res, _ := doHttpRequest(req, nil)
+		assert.Equal(401, res.StatusCode)
+	}
+
+	// Should lock the client out of login
+	req := newDefaultHttpRequest("/_oauth/login")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(429, res.StatusCode)
+	assert.Equal("900", res.Header.Get("Retry-After"))
+
+	// Should not be escaped by adding X-Forwarded-For entries
+	req = newDefaultHttpRequest("/_oauth/login")
+	req.Header.Set("X-Forwarded-For", "10.0.0.3, 10.0.0.1")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(429, res.StatusCode)
+
+	// Should not lock out other clients
+	req = newDefaultHttpRequest("/_oauth/login")
+	req.Header.Set("X-Forwarded-For", "10.0.0.2")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+}
+
+/**
+ * Utilities
+ */
+
+func serveRouter(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
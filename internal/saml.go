@@ -0,0 +1,89 @@
+package tfa
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// SAML
+//
+// The identity provider posts its response to the assertion consumer service
+// in the body of a request, which forward auth never passes on, so both it and
+// the service provider metadata are served directly. Traefik must route
+// <url-path>/saml/ on the callback host to traefik-forward-auth itself,
+// without the middleware
+
+// SAMLMetadataHandler serves the service provider metadata to register with
+// the identity provider
+func (s *Server) SAMLMetadataHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metadata, err := config().Providers.SAML.Metadata(redirectUri(r) + provider.SAMLACSPath)
+		if err != nil {
+			log.WithField("error", err).Error("Error rendering SAML metadata")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.Write(metadata)
+	}
+}
+
+// SAMLAssertionHandler checks the response posted by the identity provider
+// and sends the user on to the callback with a one-time code. The callback
+// checks the RelayState against the CSRF cookie, as it does the state
+func (s *Server) SAMLAssertionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := log.WithFields(logrus.Fields{
+			"handler":   "SAMLAssertion",
+			"instance":  config().InstanceID,
+			"source_ip": originalClientIP(r),
+		})
+		logger.Debug("Handling SAML response")
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid request", 400)
+			return
+		}
+		state := r.PostForm.Get("RelayState")
+		if err := ValidateState(state); err != nil {
+			logger.WithField("error", err).Warn("Error validating state")
+			recordLoginFailure(r)
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		saml := &config().Providers.SAML
+		user, err := saml.ParseResponse(r.PostForm.Get("SAMLResponse"), redirectUri(r)+provider.SAMLACSPath, state)
+		if err != nil {
+			if perr, ok := provider.AsError(err); ok {
+				loginsTotal.Inc(saml.Name(), "provider_error")
+				auditLoginFailure(r, saml.Name(), "", "provider_error")
+				s.providerError(logger, w, r, saml.Name(), perr)
+				return
+			}
+			logger.WithField("error", err).Warn("Invalid SAML response")
+			recordLoginFailure(r)
+			loginsTotal.Inc(saml.Name(), "invalid_assertion")
+			auditLoginFailure(r, saml.Name(), "", "invalid_assertion")
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		code, err := saml.IssueCode(user)
+		if err != nil {
+			logger.WithField("error", err).Error("Error issuing login code")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		q := url.Values{}
+		q.Set("code", code)
+		q.Set("state", state)
+		http.Redirect(w, r, redirectUri(r)+"?"+q.Encode(), http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,116 @@
+package tfa
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestSAMLLogin(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newSAMLTestConfig(t))
+
+	// Should send the user to the identity provider
+	req := newHTTPRequest("GET", "https://app.example.com/page")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+	fwd, _ := res.Location()
+	assert.Equal("idp.example.com", fwd.Host)
+	assert.Equal("/sso", fwd.Path)
+	assert.NotEmpty(fwd.Query().Get("SAMLRequest"))
+	assert.True(strings.HasSuffix(fwd.Query().Get("RelayState"), ":saml:https://app.example.com/page"))
+}
+
+func TestSAMLMetadataHandler(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newSAMLTestConfig(t))
+	h := NewServer().Handler()
+
+	req := httptest.NewRequest("GET", "https://app.example.com/_oauth/saml/metadata", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	res := serveRouter(h, req)
+	assert.Equal(200, res.Code)
+	assert.Equal("application/samlmetadata+xml", res.Header().Get("Content-Type"))
+	assert.Contains(res.Body.String(), `entityID="https://app.example.com/_oauth/saml/metadata"`)
+	assert.Contains(res.Body.String(), `Location="https://app.example.com/_oauth/saml/acs"`)
+
+	// Should only be served when the provider is used
+	setConfig(newDefaultConfig())
+	h = NewServer().Handler()
+	res = serveRouter(h, httptest.NewRequest("GET", "https://app.example.com/_oauth/saml/metadata", nil))
+	assert.Equal(404, res.Code)
+}
+
+func TestSAMLAssertionHandler(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newSAMLTestConfig(t))
+	h := NewServer().Handler()
+	state := "12345678901234567890123456789012:saml:https://app.example.com/page"
+
+	post := func(form url.Values) (int, string) {
+		req := httptest.NewRequest("POST", "https://app.example.com/_oauth/saml/acs", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		res := serveRouter(h, req)
+		return res.Code, res.Body.String()
+	}
+
+	// Should refuse responses without a login state
+	code, _ := post(url.Values{"SAMLResponse": {"PHJlc3BvbnNlLz4="}})
+	assert.Equal(401, code)
+
+	// Should refuse invalid responses
+	code, _ = post(url.Values{"SAMLResponse": {"PHJlc3BvbnNlLz4="}, "RelayState": {state}})
+	assert.Equal(401, code)
+
+	// Should show identity provider errors
+	response := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1" Version="2.0">` +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Responder"/>` +
+		`<samlp:StatusMessage>User is not assigned to this application</samlp:StatusMessage></samlp:Status>` +
+		`</samlp:Response>`
+	code, body := post(url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(response))}, "RelayState": {state}})
+	assert.Equal(401, code)
+	assert.Contains(body, "User is not assigned to this application")
+}
+
+/**
+ * Utilities
+ */
+
+// newSAMLTestConfig configures the saml provider with an identity provider
+// whose key is thrown away
+func newSAMLTestConfig(t *testing.T) *Config {
+	_, cert, err := dsig.RandomKeyStoreForTest().GetKeyPair()
+	require.Nil(t, err)
+	metadata := `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="https://idp.example.com">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>` + base64.StdEncoding.EncodeToString(cert) + `</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`
+	dir, err := ioutil.TempDir("", "saml")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "metadata.xml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(metadata), 0600))
+
+	c := newDefaultConfig()
+	c.DefaultProvider = "saml"
+	c.Providers.SAML.EntityID = "https://app.example.com/_oauth/saml/metadata"
+	c.Providers.SAML.IDPMetadataFile = path
+	require.Nil(t, c.Providers.SAML.Setup())
+	return c
+}
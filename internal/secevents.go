@@ -0,0 +1,261 @@
+package tfa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Security events
+//
+// With "security-events-issuer" set, the identity provider can push security
+// event tokens (SETs, RFC 8417) to <url-path>/security-events as described by
+// RFC 8935, as sent by Shared Signals (CAEP and RISC) transmitters and Google's
+// cross-account protection. Each token must be signed by one of the keys at
+// "security-events-jwks-url" and be for the "security-events-audience". When
+// an event reports a user's sessions or credentials were revoked, or their
+// account was disabled, their sessions are terminated straight away instead of
+// when the consent check next runs or the cookie expires
+
+// SecurityEventsPath is where security event tokens are pushed to, under the
+// url-path
+const SecurityEventsPath = "/security-events"
+
+// maxSecurityEventSize limits the size of the tokens accepted
+const maxSecurityEventSize = 64 << 10
+
+// revokingSecurityEvents are the event types that end the subject's sessions
+var revokingSecurityEvents = map[string]bool{
+	"https://schemas.openid.net/secevent/caep/event-type/session-revoked":                    true,
+	"https://schemas.openid.net/secevent/risc/event-type/sessions-revoked":                   true,
+	"https://schemas.openid.net/secevent/risc/event-type/tokens-revoked":                     true,
+	"https://schemas.openid.net/secevent/risc/event-type/account-disabled":                   true,
+	"https://schemas.openid.net/secevent/risc/event-type/account-purged":                     true,
+	"https://schemas.openid.net/secevent/risc/event-type/account-credential-change-required": true,
+}
+
+// credentialChangeEvent ends the subject's sessions if their credential was
+// revoked or deleted, rather than updated
+const credentialChangeEvent = "https://schemas.openid.net/secevent/caep/event-type/credential-change"
+
+var securityEventsTotal = NewCounterVec("security_events_total",
+	"Security event tokens received, by result", "result")
+
+// securityEventKeys verifies the signatures of security event tokens, nil
+// unless "security-events-issuer" is set
+var securityEventKeys oidc.KeySet
+
+// setupSecurityEvents checks the "security-events-*" options, fetching the
+// issuer's keys as they're needed
+func setupSecurityEvents(c *Config) error {
+	if c.SecurityEventsIssuer == "" {
+		securityEventKeys = nil
+		return nil
+	}
+	if !strings.HasPrefix(c.SecurityEventsJWKSURL, "http://") && !strings.HasPrefix(c.SecurityEventsJWKSURL, "https://") {
+		return fmt.Errorf("\"security-events-jwks-url\" must be an absolute http or https URL to receive security events")
+	}
+	if c.SecurityEventsAudience == "" {
+		return fmt.Errorf("\"security-events-audience\" must be set to receive security events")
+	}
+	securityEventKeys = oidc.NewRemoteKeySet(context.Background(), c.SecurityEventsJWKSURL)
+	return nil
+}
+
+// securityEventToken is the payload of a SET
+type securityEventToken struct {
+	jwt.Claims
+	SubjectID *securityEventSubject              `json:"sub_id"`
+	Events    map[string]securityEventTokenEvent `json:"events"`
+}
+
+// securityEventTokenEvent is an event within a SET, only the fields needed to
+// find the subject and decide whether to act are decoded
+type securityEventTokenEvent struct {
+	Subject    *securityEventSubject `json:"subject"`
+	ChangeType string                `json:"change_type"`
+}
+
+// securityEventSubject identifies who an event is about, by email address or
+// by subject at the issuer, from any of the Shared Signals subject formats and
+// RISC subject types
+type securityEventSubject struct {
+	Email   string `json:"email"`
+	Issuer  string `json:"iss"`
+	Subject string `json:"sub"`
+
+	// User is set for complex subjects, which may also identify the session
+	// or device
+	User *securityEventSubject `json:"user"`
+}
+
+// matches returns whether the session belongs to the subject, by their email
+// address or their subject at the issuer
+func (s *securityEventSubject) matches(entry *UserEntry) bool {
+	if s.User != nil {
+		return s.User.matches(entry)
+	}
+	if s.Email != "" {
+		return normalizeEmail(s.Email) == normalizeEmail(entry.User.Email)
+	}
+	if s.Subject != "" {
+		sub, _ := entry.User.Claims["sub"].(string)
+		iss, _ := entry.User.Claims["iss"].(string)
+		return sub == s.Subject && (s.Issuer == "" || iss == "" || iss == s.Issuer)
+	}
+	return false
+}
+
+func (s *securityEventSubject) String() string {
+	if s.User != nil {
+		return s.User.String()
+	}
+	if s.Email != "" {
+		return s.Email
+	}
+	return s.Subject
+}
+
+// SecurityEventsHandler receives security event tokens pushed by the issuer,
+// terminating the sessions of users whose access was revoked
+func (s *Server) SecurityEventsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := log.WithFields(logrus.Fields{
+			"handler":   "SecurityEvents",
+			"source_ip": originalClientIP(r),
+		})
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSecurityEventSize))
+		if err != nil {
+			securityEventError(w, "invalid_request", "Unable to read the token")
+			return
+		}
+
+		token, err := verifySecurityEvent(r.Context(), strings.TrimSpace(string(body)))
+		if err != nil {
+			securityEventsTotal.Inc("invalid")
+			logger.WithField("error", err).Warn("Invalid security event token")
+			securityEventError(w, err.(securityEventErr).code, err.Error())
+			return
+		}
+
+		for eventType, event := range token.Events {
+			subject := event.Subject
+			if subject == nil {
+				subject = token.SubjectID
+			}
+			fields := logrus.Fields{
+				"event": eventType,
+				"jti":   token.ID,
+			}
+
+			if !revokesSessions(eventType, event) || subject == nil {
+				securityEventsTotal.Inc("ignored")
+				logger.WithFields(fields).Debug("Ignoring security event")
+				continue
+			}
+
+			revoked, err := terminateSubjectSessions(subject, eventType)
+			if err != nil {
+				securityEventsTotal.Inc("error")
+				logger.WithFields(fields).WithField("error", err).Error("Error listing sessions")
+				http.Error(w, "Service unavailable", 503)
+				return
+			}
+			securityEventsTotal.Inc("revoked")
+			fields["user"] = subject.String()
+			fields["sessions"] = revoked
+			logger.WithFields(fields).Info("Received security event")
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// revokesSessions returns whether the event ends the subject's sessions
+func revokesSessions(eventType string, event securityEventTokenEvent) bool {
+	if eventType == credentialChangeEvent {
+		return event.ChangeType == "revoke" || event.ChangeType == "delete"
+	}
+	return revokingSecurityEvents[eventType]
+}
+
+// terminateSubjectSessions terminates the sessions of the subject, returning
+// how many there were
+func terminateSubjectSessions(subject *securityEventSubject, eventType string) (int, error) {
+	entries, err := sessions.All()
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, entry := range entries {
+		if !subject.matches(entry) {
+			continue
+		}
+		terminateSession(entry.User.UUID, "security_event", logrus.Fields{
+			"user":  entry.User.Email,
+			"event": eventType,
+		})
+		revoked++
+	}
+	return revoked, nil
+}
+
+// securityEventErr is an error reported to the transmitter, with one of the
+// error codes from RFC 8935
+type securityEventErr struct {
+	code string
+	err  error
+}
+
+func (e securityEventErr) Error() string {
+	return e.err.Error()
+}
+
+// verifySecurityEvent checks the token's signature, issuer and audience
+func verifySecurityEvent(ctx context.Context, raw string) (*securityEventToken, error) {
+	if securityEventKeys == nil {
+		return nil, securityEventErr{"invalid_key", fmt.Errorf("security events aren't configured")}
+	}
+	payload, err := securityEventKeys.VerifySignature(ctx, raw)
+	if err != nil {
+		return nil, securityEventErr{"invalid_key", err}
+	}
+
+	var token securityEventToken
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return nil, securityEventErr{"invalid_request", err}
+	}
+	if token.Issuer != config().SecurityEventsIssuer {
+		return nil, securityEventErr{"invalid_issuer", fmt.Errorf("unexpected issuer %q", token.Issuer)}
+	}
+	if !token.Audience.Contains(config().SecurityEventsAudience) {
+		return nil, securityEventErr{"invalid_audience", fmt.Errorf("token isn't for %q", config().SecurityEventsAudience)}
+	}
+	if err := token.Claims.Validate(jwt.Expected{Time: time.Now()}); err != nil {
+		return nil, securityEventErr{"invalid_request", err}
+	}
+	if len(token.Events) == 0 {
+		return nil, securityEventErr{"invalid_request", fmt.Errorf("token has no events")}
+	}
+	return &token, nil
+}
+
+// securityEventError responds with an RFC 8935 error
+func securityEventError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(struct {
+		Err         string `json:"err"`
+		Description string `json:"description"`
+	}{code, description})
+}
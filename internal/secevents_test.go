@@ -0,0 +1,191 @@
+package tfa
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+)
+
+/**
+ * Tests
+ */
+
+func TestSecurityEvents(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(err)
+	jwks := newTestJWKS(key)
+	defer jwks.Close()
+
+	setConfig(newDefaultConfig())
+	config().SecurityEventsIssuer = "https://idp.example.com"
+	config().SecurityEventsAudience = "client-id"
+	config().SecurityEventsJWKSURL = jwks.URL
+	require.Nil(setupSecurityEvents(config()))
+	defer func() { securityEventKeys = nil }()
+	h := NewServer().Handler()
+
+	byEmail := newTestUser("secevent-email@example.com")
+	bySubject := newTestUser("secevent-sub@example.com")
+	bySubject.Claims = map[string]interface{}{"iss": "https://idp.example.com", "sub": "248289761001"}
+	other := newTestUser("secevent-other@example.com")
+
+	// Should terminate the sessions of users whose sessions were revoked
+	res := postSecurityEvent(h, signSecurityEvent(t, key, map[string]interface{}{
+		"iss": "https://idp.example.com",
+		"aud": "client-id",
+		"iat": time.Now().Unix(),
+		"jti": "1",
+		"sub_id": map[string]interface{}{
+			"format": "email",
+			"email":  "SecEvent-Email@example.com",
+		},
+		"events": map[string]interface{}{
+			"https://schemas.openid.net/secevent/caep/event-type/session-revoked": map[string]interface{}{},
+		},
+	}))
+	assert.Equal(202, res.Code)
+	entry, _ := sessions.Get(byEmail.UUID)
+	assert.Nil(entry)
+	entry, _ = sessions.Get(other.UUID)
+	assert.NotNil(entry, "other users should stay logged in")
+
+	// Should match users by their subject at the issuer
+	res = postSecurityEvent(h, signSecurityEvent(t, key, map[string]interface{}{
+		"iss": "https://idp.example.com",
+		"aud": []string{"client-id"},
+		"iat": time.Now().Unix(),
+		"jti": "2",
+		"events": map[string]interface{}{
+			"https://schemas.openid.net/secevent/risc/event-type/account-disabled": map[string]interface{}{
+				"subject": map[string]interface{}{
+					"subject_type": "iss-sub",
+					"iss":          "https://idp.example.com",
+					"sub":          "248289761001",
+				},
+			},
+		},
+	}))
+	assert.Equal(202, res.Code)
+	entry, _ = sessions.Get(bySubject.UUID)
+	assert.Nil(entry)
+
+	// Should accept events that don't revoke access, without acting on them
+	res = postSecurityEvent(h, signSecurityEvent(t, key, map[string]interface{}{
+		"iss": "https://idp.example.com",
+		"aud": "client-id",
+		"iat": time.Now().Unix(),
+		"jti": "3",
+		"events": map[string]interface{}{
+			"https://schemas.openid.net/secevent/caep/event-type/credential-change": map[string]interface{}{
+				"subject":     map[string]interface{}{"format": "email", "email": "secevent-other@example.com"},
+				"change_type": "update",
+			},
+		},
+	}))
+	assert.Equal(202, res.Code)
+	entry, _ = sessions.Get(other.UUID)
+	assert.NotNil(entry)
+
+	// Should refuse tokens for other audiences
+	res = postSecurityEvent(h, signSecurityEvent(t, key, map[string]interface{}{
+		"iss":    "https://idp.example.com",
+		"aud":    "another-client",
+		"iat":    time.Now().Unix(),
+		"events": map[string]interface{}{"https://schemas.openid.net/secevent/risc/event-type/sessions-revoked": map[string]interface{}{}},
+	}))
+	assert.Equal(400, res.Code)
+	assert.JSONEq(`{"err": "invalid_audience", "description": "token isn't for \"client-id\""}`, res.Body.String())
+
+	// Should refuse tokens from other issuers
+	res = postSecurityEvent(h, signSecurityEvent(t, key, map[string]interface{}{
+		"iss":    "https://evil.example.com",
+		"aud":    "client-id",
+		"events": map[string]interface{}{"https://schemas.openid.net/secevent/risc/event-type/sessions-revoked": map[string]interface{}{}},
+	}))
+	assert.Equal(400, res.Code)
+	assert.Contains(res.Body.String(), "invalid_issuer")
+
+	// Should refuse tokens signed with other keys
+	forged, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(err)
+	res = postSecurityEvent(h, signSecurityEvent(t, forged, map[string]interface{}{
+		"iss": "https://idp.example.com",
+		"aud": "client-id",
+		"events": map[string]interface{}{
+			"https://schemas.openid.net/secevent/risc/event-type/sessions-revoked": map[string]interface{}{
+				"subject": map[string]interface{}{"subject_type": "email", "email": "secevent-other@example.com"},
+			},
+		},
+	}))
+	assert.Equal(400, res.Code)
+	assert.Contains(res.Body.String(), "invalid_key")
+	entry, _ = sessions.Get(other.UUID)
+	assert.NotNil(entry)
+}
+
+func TestSecurityEventsConfig(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	defer func() { securityEventKeys = nil }()
+
+	// Should be disabled without an issuer
+	assert.Nil(setupSecurityEvents(config()))
+	assert.Nil(securityEventKeys)
+	res := postSecurityEvent(NewServer().Handler(), "token")
+	assert.NotEqual(202, res.Code)
+
+	// Should require the keys and audience
+	config().SecurityEventsIssuer = "https://idp.example.com"
+	assert.Error(setupSecurityEvents(config()))
+	config().SecurityEventsJWKSURL = "https://idp.example.com/jwks"
+	assert.Error(setupSecurityEvents(config()))
+	config().SecurityEventsAudience = "client-id"
+	assert.Nil(setupSecurityEvents(config()))
+	assert.NotNil(securityEventKeys)
+}
+
+/**
+ * Utilities
+ */
+
+// newTestJWKS serves the public key as a JWKS
+func newTestJWKS(key *rsa.PrivateKey) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "1", Algorithm: "RS256", Use: "sig"},
+		}})
+	}))
+}
+
+// signSecurityEvent signs the claims as a security event token
+func signSecurityEvent(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: key, KeyID: "1"},
+	}, (&jose.SignerOptions{}).WithType("secevent+jwt"))
+	require.Nil(t, err)
+	payload, err := json.Marshal(claims)
+	require.Nil(t, err)
+	jws, err := signer.Sign(payload)
+	require.Nil(t, err)
+	token, err := jws.CompactSerialize()
+	require.Nil(t, err)
+	return token
+}
+
+func postSecurityEvent(h http.Handler, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/_oauth/security-events", strings.NewReader(token))
+	req.Header.Set("Content-Type", "application/secevent+jwt")
+	return serveRouter(h, req)
+}
@@ -0,0 +1,86 @@
+package tfa
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Secret rotation
+//
+// While the "secret" is being rotated the old one is set as a
+// "previous-secret". New cookies and encrypted values are signed with the
+// secret, but those signed with any of the previous secrets are still
+// accepted, and auth cookies are signed again with the secret as they're
+// seen. The previous secrets can be
+// dropped once every cookie has been re-signed or expired, i.e. after the
+// cookie "lifetime". With "secret-rotation-until" set they're refused once
+// the window ends, so every instance finishes the rotation at the same time
+// without another deploy
+
+var previousSecretUsesTotal = NewCounterVec("previous_secret_uses_total",
+	"Cookies and encrypted values accepted because they were signed with a previous secret, by use", "use")
+
+// secretRotationEnded logs the end of the rotation window once
+var secretRotationEnded sync.Once
+
+// previousSecrets returns the previous secrets still accepted, none once the
+// rotation window has ended
+func previousSecrets() [][]byte {
+	if config().secretRotationUntil.IsZero() || time.Now().Before(config().secretRotationUntil) {
+		return config().previousSecrets
+	}
+
+	secretRotationEnded.Do(func() {
+		log.WithField("secret_rotation_until", config().secretRotationUntil.Format(time.RFC3339)).Warn("Secret rotation window has ended, refusing values signed with previous secrets")
+	})
+	return nil
+}
+
+// acceptedSecrets returns the secret followed by the previous secrets still
+// accepted
+func acceptedSecrets() [][]byte {
+	return append([][]byte{config().Secret}, previousSecrets()...)
+}
+
+// signedWithPreviousSecret reports whether mac is the signature of data with
+// one of the previous secrets. Only cookies signed by the "secret" signer can
+// have been signed with a previous secret
+func signedWithPreviousSecret(mac, data []byte) bool {
+	if _, ok := activeSigner().(secretSigner); !ok {
+		return false
+	}
+
+	for _, secret := range previousSecrets() {
+		hash := hmac.New(sha256.New, secret)
+		hash.Write(data)
+		if hmac.Equal(mac, hash.Sum(nil)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resignCookie returns the cookie signed with the current secret, keeping its
+// expiry, if it was signed or encrypted with a previous secret. It returns nil
+// if the cookie is current
+func resignCookie(r *http.Request, c *http.Cookie, user *provider.User) *http.Cookie {
+	if len(previousSecrets()) == 0 {
+		return nil
+	}
+	_, expires, previous, err := verifyCookie(r, c)
+	if err != nil || !previous {
+		return nil
+	}
+
+	cookie, err := makeCookie(r, user, expires)
+	if err != nil {
+		return nil
+	}
+	previousSecretUsesTotal.Inc("auth-cookie")
+	return cookie
+}
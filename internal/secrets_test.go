@@ -0,0 +1,179 @@
+package tfa
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestPreviousSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should keep commas in the secret
+	c, err := NewConfig([]string{"--secret=newnewnewnewsecret,with,commas"})
+	require.Nil(t, err)
+	assert.Equal([]byte("newnewnewnewsecret,with,commas"), c.Secret)
+	assert.Nil(c.previousSecrets)
+
+	// Should accept any number of previous secrets
+	c, err = NewConfig([]string{
+		"--secret=newnewnewnewsecret",
+		"--previous-secret=oldoldoldoldsecret",
+		"--previous-secret=olderolderolder,secret",
+	})
+	require.Nil(t, err)
+	assert.Equal([]byte("newnewnewnewsecret"), c.Secret)
+	assert.Equal([][]byte{[]byte("oldoldoldoldsecret"), []byte("olderolderolder,secret")}, c.previousSecrets)
+}
+
+func TestSecretRotationCookie(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	req := newHTTPRequest("GET", "http://example.com/foo")
+	user := newTestUser("test@example.com")
+
+	config().Secret = []byte("oldoldoldoldsecret")
+	old, _ := MakeCookie(req, user)
+	config().EncryptCookies = true
+	oldEncrypted, _ := MakeCookie(req, user)
+	config().EncryptCookies = false
+
+	// Should refuse cookies signed with a secret that was dropped
+	config().Secret = []byte("newnewnewnewsecret")
+	_, err := ValidateCookie(req, old)
+	assert.Error(err)
+	_, err = ValidateCookie(req, oldEncrypted)
+	assert.Error(err)
+
+	// Should accept cookies signed with a previous secret
+	config().previousSecrets = [][]byte{[]byte("oldoldoldoldsecret")}
+	for _, c := range []*http.Cookie{old, oldEncrypted} {
+		_, err = ValidateCookie(req, c)
+		assert.Nil(err)
+
+		// Should sign them again with the current secret, keeping their
+		// expiry
+		resigned := resignCookie(req, c, user)
+		if assert.NotNil(resigned) {
+			assert.Equal(c.Expires.Unix(), resigned.Expires.Unix())
+			_, _, previous, err := verifyCookie(req, resigned)
+			assert.Nil(err)
+			assert.False(previous)
+			assert.Nil(resignCookie(req, resigned, user), "current cookies shouldn't be signed again")
+		}
+	}
+
+	// Should set the re-signed cookie on the response
+	req = newHTTPRequest("GET", "http://example.com/foo")
+	res, _ := doHttpRequest(req, old)
+	assert.Equal(200, res.StatusCode)
+	var resigned *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == config().CookieName && c.Value != old.Value {
+			resigned = c
+		}
+	}
+	assert.NotNil(resigned, "cookie signed with a previous secret should be signed again")
+}
+
+func TestSecretRotationStatelessCookie(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().StatelessCookie = true
+	req := newHTTPRequest("GET", "http://example.com/foo")
+	user := newTestUser("test@example.com")
+
+	config().Secret = []byte("oldoldoldoldsecret")
+	old, _ := MakeCookie(req, user)
+
+	// Should accept stateless cookies signed with a previous secret, and sign
+	// them again with the current secret
+	config().Secret = []byte("newnewnewnewsecret")
+	config().previousSecrets = [][]byte{[]byte("oldoldoldoldsecret")}
+	validUser, err := ValidateCookie(req, old)
+	if assert.Nil(err) {
+		assert.Equal("test@example.com", validUser.Email)
+	}
+	resigned := resignCookie(req, old, user)
+	if assert.NotNil(resigned) {
+		_, _, previous, err := verifyCookie(req, resigned)
+		assert.Nil(err)
+		assert.False(previous)
+	}
+}
+
+func TestSecretRotationEncryptedValue(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	config().Secret = []byte("oldoldoldoldsecret")
+	value, err := encryptValue("lost-submission", []byte("plaintext"))
+	require.Nil(t, err)
+
+	config().Secret = []byte("newnewnewnewsecret")
+	_, err = decryptValue("lost-submission", value)
+	assert.Error(err)
+
+	// Should decrypt values encrypted with a previous secret
+	config().previousSecrets = [][]byte{[]byte("oldoldoldoldsecret")}
+	plaintext, previous, err := decryptValueRotated("lost-submission", value)
+	assert.Nil(err)
+	assert.True(previous)
+	assert.Equal("plaintext", string(plaintext))
+}
+
+func TestSecretRotationWindow(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	req := newHTTPRequest("GET", "http://example.com/foo")
+	user := newTestUser("rotation-window@example.com")
+
+	config().Secret = []byte("oldoldoldoldsecret")
+	old, _ := MakeCookie(req, user)
+	value, err := encryptValue("lost-submission", []byte("plaintext"))
+	require.Nil(t, err)
+
+	// Should accept values signed with a previous secret during the window
+	config().Secret = []byte("newnewnewnewsecret")
+	config().previousSecrets = [][]byte{[]byte("oldoldoldoldsecret")}
+	config().secretRotationUntil = time.Now().Add(time.Hour)
+	_, err = ValidateCookie(req, old)
+	assert.Nil(err)
+	_, err = decryptValue("lost-submission", value)
+	assert.Nil(err)
+	current, _ := MakeCookie(req, user)
+	_, _, previous, err := verifyCookie(req, current)
+	assert.Nil(err)
+	assert.False(previous, "new cookies should be signed with the new secret")
+
+	// Should refuse them once the window has ended
+	config().secretRotationUntil = time.Now().Add(-time.Second)
+	_, err = ValidateCookie(req, old)
+	assert.Error(err)
+	_, err = decryptValue("lost-submission", value)
+	assert.Error(err)
+	assert.Nil(resignCookie(req, old, user))
+	_, err = ValidateCookie(req, current)
+	assert.Nil(err)
+}
+
+func TestSecretRotationWindowConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	// Should parse the end of the window
+	c, err := NewConfig([]string{
+		"--secret=newnewnewnewsecret",
+		"--previous-secret=oldoldoldoldsecret",
+		"--secret-rotation-until=2024-01-31T09:00:00Z",
+	})
+	require.Nil(t, err)
+	c.Validate()
+	assert.Equal(time.Date(2024, 1, 31, 9, 0, 0, 0, time.UTC), c.secretRotationUntil)
+}
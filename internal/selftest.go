@@ -0,0 +1,316 @@
+package tfa
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Self-test
+//
+// Once the config has been validated, a few checks that it will actually work
+// are run: that the secret looks random, the cookie domains resolve, the
+// providers and session store are reachable, the clock agrees with the
+// providers' and the port is free. On startup failures are logged as
+// warnings, with "selftest" the report is printed and the service exits,
+// non-zero if any check failed
+
+// Self-test check outcomes
+const (
+	selfTestPass = "pass"
+	selfTestFail = "fail"
+	selfTestSkip = "skip"
+)
+
+// minSecretEntropyBits is the estimated entropy below which the secret is
+// reported as guessable
+const minSecretEntropyBits = 96
+
+// maxClockSkew is how far the clock may be from the providers' before tokens
+// they issue may be considered not yet valid or already expired
+const maxClockSkew = 30 * time.Second
+
+// SelfTestCheck is the outcome of one self-test check
+type SelfTestCheck struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	Detail      string `json:"detail"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// SelfTestReport holds the outcome of each self-test check
+type SelfTestReport struct {
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+// Passed reports whether no check failed
+func (r *SelfTestReport) Passed() bool {
+	for _, check := range r.Checks {
+		if check.Status == selfTestFail {
+			return false
+		}
+	}
+	return true
+}
+
+// Write prints the report as a table, or as JSON
+func (r *SelfTestReport) Write(w io.Writer, asJSON bool) error {
+	if asJSON {
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, check := range r.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Name, strings.ToUpper(check.Status), check.Detail)
+		if check.Status == selfTestFail && check.Remediation != "" {
+			fmt.Fprintf(tw, "\t\t-> %s\n", check.Remediation)
+		}
+	}
+	return tw.Flush()
+}
+
+// Log logs each check, failures as warnings
+func (r *SelfTestReport) Log(logger *logrus.Logger) {
+	for _, check := range r.Checks {
+		entry := logger.WithField("check", check.Name)
+		if check.Status == selfTestFail {
+			entry.WithField("remediation", check.Remediation).Warn("Self-test failed: " + check.Detail)
+		} else {
+			entry.Info("Self-test " + check.Status + ": " + check.Detail)
+		}
+	}
+}
+
+// RunSelfTest runs every check against the validated config
+func RunSelfTest(c *Config) *SelfTestReport {
+	report := &SelfTestReport{}
+	report.Checks = append(report.Checks,
+		checkSecretEntropy(c.Secret),
+		checkCookieDomainSanity(c, net.LookupHost),
+	)
+	report.Checks = append(report.Checks, checkProviders(c)...)
+	report.Checks = append(report.Checks,
+		checkSessionStore(sessions),
+		checkListener(fmt.Sprintf(":%d", c.Port)),
+	)
+	return report
+}
+
+// checkSecretEntropy estimates the entropy of the secret from the frequency
+// of its characters, which catches passwords and repeated text but not every
+// predictable secret
+func checkSecretEntropy(secret []byte) SelfTestCheck {
+	check := SelfTestCheck{Name: "secret"}
+
+	counts := make(map[byte]int)
+	for _, b := range secret {
+		counts[b]++
+	}
+	var perChar float64
+	for _, n := range counts {
+		p := float64(n) / float64(len(secret))
+		perChar -= p * math.Log2(p)
+	}
+	bits := perChar * float64(len(secret))
+
+	check.Detail = fmt.Sprintf("estimated %.0f bits of entropy", bits)
+	if bits < minSecretEntropyBits {
+		check.Status = selfTestFail
+		check.Remediation = fmt.Sprintf("use a random secret of at least %d bits, e.g. from \"openssl rand -hex 32\", see the secret option for rotating it", minSecretEntropyBits)
+	} else {
+		check.Status = selfTestPass
+	}
+	return check
+}
+
+// checkCookieDomainSanity checks the cookie domains and auth host resolve,
+// and that cookies aren't sent over plain HTTP
+func checkCookieDomainSanity(c *Config, lookup func(host string) ([]string, error)) SelfTestCheck {
+	check := SelfTestCheck{Name: "cookie-domain"}
+
+	problems := resolveDomains(c, lookup)
+	if err := checkCookieDomains(c); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.InsecureCookie {
+		problems = append(problems, "insecure-cookie is set, so cookies are sent over plain HTTP")
+	}
+
+	if len(problems) > 0 {
+		check.Status = selfTestFail
+		check.Detail = strings.Join(problems, "; ")
+		check.Remediation = "check the cookie-domain and auth-host are spelt correctly and served over HTTPS, then unset insecure-cookie"
+		return check
+	}
+
+	check.Status = selfTestPass
+	if len(c.CookieDomains) == 0 {
+		check.Detail = "no cookie-domain set, cookies are set on each host"
+	} else {
+		var domains []string
+		for _, d := range c.CookieDomains {
+			domains = append(domains, d.Domain)
+		}
+		check.Detail = "cookies are set on " + strings.Join(domains, ", ")
+	}
+	return check
+}
+
+// providerResponse is the outcome of probing one provider
+type providerResponse struct {
+	name string
+	err  error
+	date time.Time
+	rtt  time.Duration
+}
+
+// checkProviders probes each provider in use, and compares the clock with the
+// Date of their responses
+func checkProviders(c *Config) []SelfTestCheck {
+	discovery := SelfTestCheck{Name: "provider-discovery", Status: selfTestPass}
+	skew := SelfTestCheck{Name: "clock-skew", Status: selfTestSkip, Detail: "no provider response had a Date header"}
+
+	var reached, failed []string
+	for _, res := range probeProviders(c) {
+		if res.err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", res.name, res.err))
+			continue
+		}
+		reached = append(reached, res.name)
+
+		// The Date was set somewhere during the round trip, and is truncated
+		// to the second
+		if res.date.IsZero() || skew.Status == selfTestFail {
+			continue
+		}
+		offset := time.Since(res.date) - res.rtt/2
+		if offset < -time.Second-maxClockSkew || offset > time.Second+maxClockSkew {
+			skew.Status = selfTestFail
+			skew.Detail = fmt.Sprintf("clock is %s from %s's", offset.Round(time.Second), res.name)
+			skew.Remediation = "synchronise the clock with NTP, tokens from the provider may otherwise be refused"
+		} else {
+			skew.Status = selfTestPass
+			skew.Detail = fmt.Sprintf("clock is within %s of %s's", maxClockSkew, res.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		discovery.Status = selfTestFail
+		discovery.Detail = strings.Join(failed, "; ")
+		discovery.Remediation = "check the provider's URLs are correct and reachable from this host, including through any proxy"
+	} else if len(reached) == 0 {
+		discovery.Status = selfTestSkip
+		discovery.Detail = "no provider in use can be probed"
+	} else {
+		discovery.Detail = "reached " + strings.Join(reached, ", ")
+	}
+
+	return []SelfTestCheck{discovery, skew}
+}
+
+// probeProviders requests the probe URL of each provider in use
+func probeProviders(c *Config) []providerResponse {
+	var responses []providerResponse
+	for _, name := range c.configuredProviderNames() {
+		p, err := c.GetConfiguredProvider(name)
+		if err != nil {
+			responses = append(responses, providerResponse{name: name, err: err})
+			continue
+		}
+		prober, ok := p.(provider.Prober)
+		if !ok {
+			continue
+		}
+
+		start := time.Now()
+		res, err := probeClient.Get(prober.ProbeURL())
+		response := providerResponse{name: name, err: err, rtt: time.Since(start)}
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode >= 500 {
+				response.err = fmt.Errorf("%s returned %s", prober.ProbeURL(), res.Status)
+			}
+			response.date, _ = http.ParseTime(res.Header.Get("Date"))
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+// checkSessionStore stores, reads back and deletes a session
+func checkSessionStore(store SessionStore) SelfTestCheck {
+	check := SelfTestCheck{
+		Name:        "session-store",
+		Status:      selfTestFail,
+		Remediation: "check the session store is running and the redis-url or sql-dsn is correct",
+	}
+	if config().StatelessCookie {
+		check.Status = selfTestSkip
+		check.Detail = "stateless-cookie is set, so no sessions are kept"
+		return check
+	}
+
+	id := uuid.New()
+	entry := &UserEntry{
+		User:    &provider.User{UUID: id, Email: "selftest@traefik-forward-auth"},
+		AddedAt: time.Now(),
+	}
+	if err := store.Put(id, entry, time.Minute); err != nil {
+		check.Detail = "writing a session: " + err.Error()
+		return check
+	}
+	defer store.Delete(id)
+
+	read, err := store.Get(id)
+	if err != nil {
+		check.Detail = "reading a session: " + err.Error()
+		return check
+	} else if read == nil || read.User == nil || read.User.Email != entry.User.Email {
+		check.Detail = "a session read back differs from the one written"
+		return check
+	}
+
+	if err := store.Delete(id); err != nil {
+		check.Detail = "deleting a session: " + err.Error()
+		return check
+	}
+
+	check.Status = selfTestPass
+	check.Detail = "wrote, read and deleted a session"
+	check.Remediation = ""
+	return check
+}
+
+// checkListener checks the address can be listened on
+func checkListener(addr string) SelfTestCheck {
+	check := SelfTestCheck{Name: "listener"}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		check.Status = selfTestFail
+		check.Detail = err.Error()
+		check.Remediation = "stop whatever else is listening on the port, or set a different port"
+		return check
+	}
+	l.Close()
+
+	check.Status = selfTestPass
+	check.Detail = "can listen on " + addr
+	return check
+}
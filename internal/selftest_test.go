@@ -0,0 +1,145 @@
+package tfa
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestSelfTestSecretEntropy(t *testing.T) {
+	assert := assert.New(t)
+
+	check := checkSecretEntropy([]byte("3f9c2a7d1e8b4c6f0a5d9e2b7c1f4a8d3e6b9c0f2a5d8e1b"))
+	assert.Equal(selfTestPass, check.Status, check.Detail)
+
+	check = checkSecretEntropy([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+	assert.Equal(selfTestFail, check.Status)
+	assert.Equal("estimated 0 bits of entropy", check.Detail)
+	assert.NotEmpty(check.Remediation)
+
+	check = checkSecretEntropy([]byte("correcthorsebattery"))
+	assert.Equal(selfTestFail, check.Status, "short passwords should fail")
+}
+
+func TestSelfTestCookieDomainSanity(t *testing.T) {
+	assert := assert.New(t)
+	c, _ := NewConfig([]string{"--cookie-domain=example.com"})
+	resolves := func(host string) ([]string, error) { return []string{"192.0.2.1"}, nil }
+
+	check := checkCookieDomainSanity(c, resolves)
+	assert.Equal(selfTestPass, check.Status)
+	assert.Equal("cookies are set on example.com", check.Detail)
+
+	// Should fail domains that don't resolve
+	check = checkCookieDomainSanity(c, func(host string) ([]string, error) {
+		return nil, errors.New("no such host")
+	})
+	assert.Equal(selfTestFail, check.Status)
+	assert.Contains(check.Detail, "cookie-domain \"example.com\" does not resolve")
+
+	// Should fail insecure cookies
+	c.InsecureCookie = true
+	check = checkCookieDomainSanity(c, resolves)
+	assert.Equal(selfTestFail, check.Status)
+	assert.Contains(check.Detail, "insecure-cookie")
+}
+
+func TestSelfTestProviders(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().DefaultProvider = "generic-oauth"
+
+	date := time.Now()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", date.UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+	config().Providers.GenericOAuth.AuthURL = server.URL
+
+	checks := checkProviders(config())
+	if assert.Len(checks, 2) {
+		assert.Equal(selfTestPass, checks[0].Status, checks[0].Detail)
+		assert.Equal("reached generic-oauth", checks[0].Detail)
+		assert.Equal(selfTestPass, checks[1].Status, checks[1].Detail)
+	}
+
+	// Should fail when the clock is skewed
+	date = time.Now().Add(-2 * time.Minute)
+	checks = checkProviders(config())
+	assert.Equal(selfTestFail, checks[1].Status)
+	assert.Contains(checks[1].Detail, "from generic-oauth's")
+
+	// Should fail unreachable providers
+	config().Providers.GenericOAuth.AuthURL = "http://127.0.0.1:1"
+	checks = checkProviders(config())
+	assert.Equal(selfTestFail, checks[0].Status)
+	assert.Equal(selfTestSkip, checks[1].Status)
+}
+
+func TestSelfTestSessionStore(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	store := NewMemorySessionStore()
+
+	check := checkSessionStore(store)
+	assert.Equal(selfTestPass, check.Status, check.Detail)
+	count, _ := store.Count()
+	assert.Equal(0, count, "the test session should be deleted")
+
+	// Should skip the store when no sessions are kept
+	config().StatelessCookie = true
+	check = checkSessionStore(store)
+	assert.Equal(selfTestSkip, check.Status)
+}
+
+func TestSelfTestListener(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := l.Addr().String()
+
+	check := checkListener(addr)
+	assert.Equal(selfTestFail, check.Status)
+
+	l.Close()
+	check = checkListener(addr)
+	assert.Equal(selfTestPass, check.Status, check.Detail)
+}
+
+func TestSelfTestReport(t *testing.T) {
+	assert := assert.New(t)
+	report := &SelfTestReport{Checks: []SelfTestCheck{
+		{Name: "secret", Status: selfTestPass, Detail: "estimated 150 bits of entropy"},
+		{Name: "listener", Status: selfTestFail, Detail: "address in use", Remediation: "set a different port"},
+	}}
+	assert.False(report.Passed())
+
+	var out bytes.Buffer
+	assert.Nil(report.Write(&out, false))
+	assert.Equal("CHECK     STATUS  DETAIL\n"+
+		"secret    PASS    estimated 150 bits of entropy\n"+
+		"listener  FAIL    address in use\n"+
+		"                  -> set a different port\n", out.String())
+
+	out.Reset()
+	assert.Nil(report.Write(&out, true))
+	var decoded SelfTestReport
+	assert.Nil(json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(*report, decoded)
+
+	report.Checks = report.Checks[:1]
+	assert.True(report.Passed())
+}
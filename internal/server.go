@@ -1,8 +1,15 @@
 package tfa
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containous/traefik/v2/pkg/rules"
 	"github.com/sirupsen/logrus"
@@ -11,12 +18,18 @@ import (
 
 // Server contains router and handler methods
 type Server struct {
-	router *rules.Router
+	mu          sync.RWMutex
+	router      *rules.Router
+	ruleMatcher *rules.Router
+
+	// callbacks counts the auth callbacks in progress, it's shared with the
+	// routes built on reload
+	callbacks *inflight
 }
 
 // NewServer creates a new server object and builds router
 func NewServer() *Server {
-	s := &Server{}
+	s := &Server{callbacks: &inflight{}}
 	s.buildRoutes()
 	return s
 }
@@ -28,98 +41,663 @@ func (s *Server) buildRoutes() {
 		log.Fatal(err)
 	}
 
+	s.ruleMatcher, err = buildRuleMatcher(config().Rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Let's build a router
-	for name, rule := range config.Rules {
-		matchRule := rule.formattedRule()
-		if rule.Action == "allow" {
-			s.router.AddRoute(matchRule, 1, s.AllowHandler(name))
-		} else {
-			s.router.AddRoute(matchRule, 1, s.AuthHandler(rule.Provider, name))
+	err = addRuleRoutes(s.router, config().Rules, func(name string, rule *Rule) http.Handler {
+		switch rule.Action {
+		case "allow":
+			return s.authHandler(name, s.AllowHandler(name))
+		case "deny":
+			return s.authHandler(name, s.DenyHandler(name))
 		}
+		return s.authHandler(name, s.AuthHandler(rule.Provider, name))
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	// Add robots.txt and security.txt for the auth host
+	s.addAuthHostFiles()
+
 	// Add callback handler
-	s.router.Handle(config.Path, s.AuthCallbackHandler())
+	s.router.Handle(config().Path, withInflight(s.callbacks, s.withRateLimit(s.withLockout(s.AuthCallbackHandler()))))
 
 	// Add logout handler
-	s.router.Handle(config.Path+"/logout", s.LogoutHandler())
+	s.router.Handle(config().Path+"/logout", s.LogoutHandler())
+
+	// Add login handler, used by the provider chooser
+	s.router.Handle(config().Path+"/login", s.withRateLimit(s.withLockout(s.LoginHandler())))
+
+	// Add password login handler, used by providers that check passwords
+	s.router.Handle(config().Path+"/ldap", s.withRateLimit(s.withLockout(s.PasswordLoginHandler())))
 
 	// Add a default handler
-	if config.DefaultAction == "allow" {
-		s.router.NewRoute().Handler(s.AllowHandler("default"))
+	if config().DefaultAction == "allow" {
+		s.router.NewRoute().Handler(s.authHandler("default", s.AllowHandler("default")))
 	} else {
-		s.router.NewRoute().Handler(s.AuthHandler(config.DefaultProvider, "default"))
+		s.router.NewRoute().Handler(s.authHandler("default", s.AuthHandler(config().DefaultProvider, "default")))
+	}
+}
+
+// HealthHandler reports that the service is up
+func (s *Server) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
 	}
 }
 
+// ReadyHandler reports whether the session store and providers are ready
+func (s *Server) ReadyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		var problems []string
+		status := "ok"
+		if degraded, err := checkSessionsReady(); degraded {
+			status = "degraded"
+		} else if err != nil {
+			log.WithField("error", err).Debug("Session store not ready")
+			problems = append(problems, "session store unavailable")
+		}
+
+		for _, name := range config().configuredProviderNames() {
+			if err := checkProviderReady(name); err != nil {
+				log.WithFields(logrus.Fields{
+					"provider": name,
+					"error":    err,
+				}).Debug("Provider not ready")
+				problems = append(problems, fmt.Sprintf("provider %s not ready: %v", name, err))
+			}
+		}
+
+		if len(problems) > 0 {
+			w.WriteHeader(503)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, status)
+	}
+}
+
+// checkSessionsReady pings the session store, reporting whether sessions are
+// being served from memory instead. With stateless cookies the store isn't
+// used, so isn't checked
+func checkSessionsReady() (bool, error) {
+	if config().StatelessCookie {
+		return false, nil
+	}
+
+	err := sessions.Ping()
+	if store, ok := sessions.(*FailoverSessionStore); ok && store.Degraded() && store.Mode() == "local" {
+		return true, nil
+	}
+	return false, err
+}
+
+// checkProviderReady checks the provider has fetched the documents it needs
+func checkProviderReady(name string) error {
+	p, err := config().GetConfiguredProvider(name)
+	if err != nil {
+		return err
+	}
+	if readier, ok := p.(provider.Readier); ok {
+		return readier.Ready()
+	}
+	return nil
+}
+
+// UserInfoHandler returns the identity of the logged in user
+func (s *Server) UserInfoHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(config().CookieName)
+		if err != nil {
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		user, err := ValidateCookie(r, c)
+		if err != nil {
+			log.WithField("error", err).Debug("Invalid cookie for userinfo")
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Email  string                 `json:"email"`
+			Name   string                 `json:"name"`
+			Avatar string                 `json:"avatar,omitempty"`
+			Roles  []string               `json:"roles"`
+			Claims map[string]interface{} `json:"claims,omitempty"`
+		}{user.Email, user.Name, user.Avatar, user.Roles, user.Claims})
+	}
+}
+
+// MetricsHandler serves metrics in the prometheus text format
+func (s *Server) MetricsHandler() http.Handler {
+	return metricsHandler()
+}
+
 // RootHandler Overwrites the request method, host and URL with those from the
 // forwarded request so it's correctly routed by mux
 func (s *Server) RootHandler(w http.ResponseWriter, r *http.Request) {
 	// Modify request
-	r.Method = r.Header.Get("X-Forwarded-Method")
-	r.Host = r.Header.Get("X-Forwarded-Host")
+	if !originalRequest(r) {
+		r.Method = r.Header.Get("X-Forwarded-Method")
+		r.Host = r.Header.Get("X-Forwarded-Host")
 
-	// Read URI from header if we're acting as forward auth middleware
-	if _, ok := r.Header["X-Forwarded-Uri"]; ok {
-		r.URL, _ = url.Parse(r.Header.Get("X-Forwarded-Uri"))
+		// Read URI from header if we're acting as forward auth middleware
+		if _, ok := r.Header["X-Forwarded-Uri"]; ok {
+			r.URL, _ = url.Parse(r.Header.Get("X-Forwarded-Uri"))
+		}
 	}
 
+	r.Host = canonicalHost(r.Host)
+
 	// Pass to mux
-	s.router.ServeHTTP(w, r)
+	s.mu.RLock()
+	router := s.router
+	s.mu.RUnlock()
+	router.ServeHTTP(w, r)
 }
 
 // AllowHandler Allows requests
 func (s *Server) AllowHandler(rule string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s.logger(r, "Allow", rule, "Allowing request")
+		logger := s.logger(r, "Allow", rule, "Allowing request")
+		if !s.enforceScheme(logger, w, r, rule) {
+			return
+		}
+		traceCheck(r, "action", "allow")
+		recordDecision(r, rule, "allow")
 		w.WriteHeader(200)
 	}
 }
 
-// AuthHandler Authenticates requests
-func (s *Server) AuthHandler(providerName, rule string) http.HandlerFunc {
-	p, _ := config.GetConfiguredProvider(providerName)
+// DenyHandler Denies requests, whoever makes them
+func (s *Server) DenyHandler(rule string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "Deny", rule, "Denying request")
+		traceCheck(r, "action", "deny")
+		if allowReportOnly(logger, w, r, rule, "deny", "rule action is deny") {
+			return
+		}
+		recordDecision(r, rule, "deny")
+		http.Error(w, "Forbidden", 403)
+	}
+}
+
+// enforceScheme applies the rule's HTTPS requirements, returning false if the
+// request has already been responded to
+func (s *Server) enforceScheme(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule string) bool {
+	ruleConfig, ok := config().Rules[rule]
+	if !ok {
+		return true
+	}
+
+	if ruleConfig.HSTS > 0 {
+		hsts := fmt.Sprintf("max-age=%d", ruleConfig.HSTS)
+		if ruleConfig.HSTSSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		w.Header().Set("Strict-Transport-Security", hsts)
+	}
+
+	if ruleConfig.RequireHTTPS == "" {
+		return true
+	}
+	if r.Header.Get("X-Forwarded-Proto") == "https" {
+		traceCheck(r, "scheme", "https")
+		return true
+	}
+
+	if ruleConfig.RequireHTTPS == "redirect" {
+		traceCheck(r, "scheme", "http, redirecting to https")
+		logger.Info("Redirecting plain HTTP request to HTTPS")
+		u := url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	} else {
+		traceCheck(r, "scheme", "http, https required")
+		logger.Warn("Rejecting plain HTTP request")
+		http.Error(w, "HTTPS required", 403)
+	}
+	return false
+}
+
+// AuthHandler Authenticates requests, providerNames is a comma separated list
+// of the providers the user may log in with
+func (s *Server) AuthHandler(providerNames, rule string) http.HandlerFunc {
+	providers := splitProviders(providerNames)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Logging setup
 		logger := s.logger(r, "Auth", rule, "Authenticating request")
+		if !s.enforceScheme(logger, w, r, rule) {
+			return
+		}
+
+		// Health checks and probes from trusted networks can't log in
+		if fromTrustedNetwork(r, rule) {
+			traceCheck(r, "trusted-network", "bypassed")
+			logger.Debug("Client in trusted network, allowing request")
+			recordDecision(r, rule, "allow")
+			w.WriteHeader(200)
+			return
+		}
+
+		// Clients outside the canary aren't authenticated yet
+		if !canaryEnforced(r, rule) {
+			logger.Debug("Client outside canary, allowing request")
+			recordDecision(r, rule, "allow")
+			w.WriteHeader(200)
+			return
+		}
+
+		// Identify users by the address they connect from
+		if user := s.identifyUser(logger, r, providers); user != nil {
+			s.authorize(logger, w, r, rule, user)
+			return
+		}
+
+		// Non-browser clients may send an access token instead of logging in
+		if token := bearerToken(r); config().BearerAuth && token != "" {
+			if user, ok, err := s.bearerUser(logger, r, providers, token); ok {
+				if err != nil {
+					logger.WithField("error", err).Warn("Not verifying bearer token")
+					http.Error(w, "Service unavailable", 503)
+					return
+				}
+				if user == nil {
+					if allowReportOnly(logger, w, r, rule, "deny", "invalid bearer token") {
+						return
+					}
+					recordDecision(r, rule, "deny")
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					http.Error(w, "Not authorized", 401)
+					return
+				}
+				s.authorize(logger, w, r, rule, user)
+				return
+			}
+		}
+
+		// Or a username and password, if the provider accepts Basic auth
+		if username, password, ok := r.BasicAuth(); ok {
+			if user, ok, err := s.basicUser(logger, r, providers, username, password); ok {
+				if err != nil {
+					logger.WithField("error", err).Warn("Not checking Basic auth credentials")
+					http.Error(w, "Service unavailable", 503)
+					return
+				}
+				if user == nil {
+					if allowReportOnly(logger, w, r, rule, "deny", "invalid basic auth credentials") {
+						return
+					}
+					recordDecision(r, rule, "deny")
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", passwordRealm))
+					http.Error(w, "Not authorized", 401)
+					return
+				}
+				s.authorize(logger, w, r, rule, user)
+				return
+			}
+		}
+
+		// Or a download token for this URL, from tools without the cookie
+		if token := r.URL.Query().Get(config().DownloadTokenParam); config().DownloadTokenLifetime > 0 && token != "" {
+			user, err := ValidateDownloadToken(r, token)
+			if err == nil {
+				traceCheck(r, "download-token", "valid")
+				s.authorize(logger, w, r, rule, user)
+				return
+			}
+			traceCheck(r, "download-token", err.Error())
+
+			// Browsers with a cookie can still use it
+			if _, cerr := r.Cookie(config().CookieName); cerr != nil {
+				logger.WithField("error", err).Info("Invalid download token")
+				if allowReportOnly(logger, w, r, rule, "deny", err.Error()) {
+					return
+				}
+				recordDecision(r, rule, "deny")
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+		}
 
 		// Get auth cookie
-		c, err := r.Cookie(config.CookieName)
+		c, err := r.Cookie(config().CookieName)
 		if err != nil {
-			s.authRedirect(logger, w, r, p)
+			traceCheck(r, "cookie", "missing")
+			if allowReportOnly(logger, w, r, rule, "login", "missing cookie") {
+				return
+			}
+			recordDecision(r, rule, "login")
+			s.login(logger, w, r, rule, providers)
 			return
 		}
 
 		// Validate cookie
 		user, err := ValidateCookie(r, c)
 		if err != nil {
-			if err.Error() == "Cookie has expired" {
-				logger.Info("Cookie has expired")
-				s.authRedirect(logger, w, r, p)
-			} else if err.Error() == "user is unknown" {
-				logger.Info("user is unknown, redirecting to log in")
-				s.authRedirect(logger, w, r, p)
-			} else {
+			traceCheck(r, "cookie", err.Error())
+			cookieValidationErrorsTotal.Inc(cookieErrorReason(err))
+			if err.Error() != "Cookie has expired" && err.Error() != "user is unknown" {
 				logger.WithField("error", err).Warn("Invalid cookie")
+				if allowReportOnly(logger, w, r, rule, "deny", err.Error()) {
+					return
+				}
+				recordDecision(r, rule, "deny")
 				http.Error(w, "Not authorized", 401)
+				return
+			}
+
+			// Let static assets and streams through for a moment after
+			// expiry, so a page isn't left half rendered and streams can
+			// reconnect
+			if err.Error() == "Cookie has expired" {
+				if expired, ok := s.graceUser(r, c, rule); ok {
+					traceCheck(r, "grace", "within grace period")
+					logger.WithField("user", expired.Email).Debug("Allowing request with recently expired cookie")
+					s.authorize(logger, w, r, rule, expired)
+					return
+				}
+			}
+
+			// Fall back to the last known identity if the provider is down
+			cached, ok := s.fallbackUser(r, c, rule, providers)
+			if !ok {
+				if err.Error() == "Cookie has expired" {
+					logger.Info("Cookie has expired")
+				} else {
+					logger.Info("user is unknown, redirecting to log in")
+				}
+				if allowReportOnly(logger, w, r, rule, "login", err.Error()) {
+					return
+				}
+				recordDecision(r, rule, "login")
+				s.login(logger, w, r, rule, providers)
+				return
+			}
+
+			traceCheck(r, "fallback", "provider unavailable, using cached identity")
+			logger.WithField("user", cached.Email).Warn("Provider unavailable, using cached identity")
+			user = cached
+		} else {
+			traceCheck(r, "cookie", "valid")
+
+			// Send users back to log in once the session has been left
+			// unattended for longer than the rule allows
+			if idle, err := sessionIdle(r, rule, user.UUID); err != nil {
+				logger.WithField("error", err).Warn("Error checking session activity")
+			} else if idle {
+				logger.WithField("user", user.Email).Info("Session is idle, redirecting to log in")
+				if allowReportOnly(logger, w, r, rule, "login", "session idle") {
+					return
+				}
+				recordDecision(r, rule, "login")
+				s.login(logger, w, r, rule, providers)
+				return
+			}
+			if longestIdleTimeout() > 0 {
+				sessionActivity.Touch(user.UUID)
+			}
+
+			// Renew the session before the cookie expires
+			if renewed, err := renewSession(r, c); err != nil {
+				traceCheck(r, "renew", "error")
+				logger.WithField("error", err).Warn("Error renewing session")
+			} else if renewed != nil {
+				traceCheck(r, "renew", "renewed")
+				setCookie(w, renewed)
+			} else if extended, err := slideSession(r, c, user); err != nil {
+				logger.WithField("error", err).Warn("Error extending session")
+			} else if extended != nil {
+				traceCheck(r, "cookie", "extended")
+				setCookie(w, extended)
+			} else if resigned := resignCookie(r, c, user); resigned != nil {
+				traceCheck(r, "cookie", "signed again with the current secret")
+				setCookie(w, resigned)
+			}
+		}
+
+		s.authorize(logger, w, r, rule, user)
+	}
+}
+
+// authorize allows the request if the user is permitted by the rule, passing
+// their identity to the backend
+func (s *Server) authorize(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule string, user *provider.User) {
+	user = withRoleGrants(user)
+	recordDecisionUser(r, user)
+
+	// Validate user
+	valid := ValidateUser(user, rule)
+	if !valid {
+		reason := user.Email + " not permitted"
+		if ValidateBlocked(user.Email, rule) {
+			reason = user.Email + " blocked"
+		}
+		traceCheck(r, "user", reason)
+		logger.WithField("user", user).Warn("Invalid user")
+		if allowReportOnly(logger, w, r, rule, "deny", reason) {
+			return
+		}
+		recordDecision(r, rule, "deny")
+		http.Error(w, "Not authorized", 401)
+		return
+	}
+	traceCheck(r, "user", user.Email+" permitted")
+
+	// Check the user's roles may use the method
+	if !ValidateMethod(user, rule, r.Method) {
+		traceCheck(r, "method", r.Method+" not permitted")
+		logger.WithFields(logrus.Fields{
+			"user":   user.Email,
+			"method": r.Method,
+		}).Warn("Method not permitted")
+		if allowReportOnly(logger, w, r, rule, "deny", r.Method+" not permitted") {
+			return
+		}
+		recordDecision(r, rule, "deny")
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+
+	// Let the rule's authorizer decide
+	if ruleConfig := ruleAuthorizer(rule); ruleConfig != nil {
+		decision, err := authorizeWebhook(r, rule, ruleConfig, user)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error":       err,
+				"fail_policy": ruleConfig.AuthorizerFailPolicy,
+			}).Error("Error calling authorizer")
+		}
+		switch {
+		case err != nil:
+			traceCheck(r, "authorizer", decision.Reason)
+		case decision.Allow:
+			traceCheck(r, "authorizer", "allow")
+		default:
+			traceCheck(r, "authorizer", strings.TrimSpace("deny "+decision.Reason))
+		}
+		if !decision.Allow {
+			logger.WithFields(logrus.Fields{
+				"user":   user.Email,
+				"reason": decision.Reason,
+			}).Warn("Denied by authorizer")
+			if allowReportOnly(logger, w, r, rule, "deny", strings.TrimSpace("authorizer "+decision.Reason)) {
+				return
 			}
+			recordDecision(r, rule, "deny")
+			http.Error(w, "Forbidden", 403)
 			return
 		}
+		for name, value := range decision.Headers {
+			w.Header().Set(name, value)
+		}
+	}
 
-		// Validate user
-		valid := ValidateUser(user, rule)
-		if !valid {
-			logger.WithField("user", user).Warn("Invalid user")
-			http.Error(w, "Not authorized", 401)
+	// Pass identity to the backend
+	if config().JWT {
+		token, err := MintJWT(user, r.Host)
+		if err != nil {
+			traceCheck(r, "jwt", "error minting token")
+			logger.WithField("error", err).Error("Error minting downstream JWT")
+			recordDecision(r, rule, "error")
+			http.Error(w, "Service unavailable", 503)
 			return
 		}
+		w.Header().Set(config().JWTHeader, token)
+	}
 
-		// Valid request
-		logger.Debug("Allowing valid request")
-		w.Header().Set("X-Forwarded-User", user.Email)
-		w.WriteHeader(200)
+	// Let caches vary by user or group without seeing the identity
+	if ruleConfig, ok := config().Rules[rule]; ok && ruleConfig.SessionHash != "" {
+		w.Header().Set(config().SessionHashHeader, SessionHash(user, ruleConfig.SessionHash))
+	}
+
+	setCustomClaimHeaders(w, user)
+	setTenantHeader(w, r, user, rule)
+	signalLostSubmission(w, r)
+
+	// Valid request
+	logger.Debug("Allowing valid request")
+	recordDecision(r, rule, "allow")
+	setIdentityHeaders(w, user, rule)
+	w.WriteHeader(200)
+}
+
+// identifyUser asks the given providers that identify users by the address
+// they connect from (e.g. tailscale) who the client is, returning nil if none
+// of them know the client
+func (s *Server) identifyUser(logger *logrus.Entry, r *http.Request, providers []string) *provider.User {
+	ip := trustedIP(r)
+	if ip == nil {
+		return nil
+	}
+	for _, name := range providers {
+		p, err := config().GetConfiguredProvider(name)
+		if err != nil {
+			continue
+		}
+		identifier, ok := p.(provider.Identifier)
+		if !ok {
+			continue
+		}
+
+		start := time.Now()
+		user, err := identifier.Identify(ip.String())
+		observeProviderRequest(name, "identify", start, err)
+		traceProviderRequest(r, name, "identify", start, err)
+		if err != nil {
+			traceCheck(r, "identify", "error from "+name)
+			logger.WithFields(logrus.Fields{
+				"provider": name,
+				"error":    err,
+			}).Error("Error identifying client")
+			continue
+		}
+		if user != nil {
+			traceCheck(r, "identify", "identified by "+name)
+			user.Email = normalizeEmail(user.Email)
+			logger.WithFields(logrus.Fields{
+				"provider": name,
+				"user":     user.Email,
+			}).Debug("Identified client")
+			if roleMap != nil {
+				roleMap.Apply(user)
+			}
+			if userDirectory != nil {
+				userDirectory.Apply(user)
+			}
+			return user
+		}
+	}
+
+	return nil
+}
+
+// fallbackUser returns the cached identity for the session in the cookie when
+// the rule allows fallback and none of its providers are available
+func (s *Server) fallbackUser(r *http.Request, c *http.Cookie, rule string, providers []string) (*provider.User, bool) {
+	if fallbackCache == nil || len(providers) == 0 {
+		return nil, false
+	}
+	if ruleConfig, ok := config().Rules[rule]; !ok || !ruleConfig.Fallback {
+		return nil, false
+	}
+
+	session, _, err := parseCookie(r, c)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, name := range providers {
+		p, err := config().GetConfiguredProvider(name)
+		if err != nil || providerAvailable(p) {
+			return nil, false
+		}
+	}
+
+	return fallbackCache.Lookup(session)
+}
+
+// graceUser returns the user of a correctly signed cookie that expired no more
+// than the rule's gracePeriod ago, if the request is for one of the rule's
+// gracePaths, or no more than its streamGrace ago for streaming requests
+func (s *Server) graceUser(r *http.Request, c *http.Cookie, rule string) (*provider.User, bool) {
+	ruleConfig, ok := config().Rules[rule]
+	if !ok {
+		return nil, false
+	}
+
+	var grace time.Duration
+	if ruleConfig.GracePeriod > 0 && matchGracePath(r.URL.Path, ruleConfig.GracePaths) {
+		grace = ruleConfig.GracePeriod
+	}
+	if stream, ok := streamGrace(r, rule); ok && stream > grace {
+		grace = stream
+	}
+	if grace <= 0 {
+		return nil, false
+	}
+
+	user, expires, err := cookieUser(r, c)
+	if err != nil || time.Since(expires) > grace {
+		return nil, false
+	}
+	return user, true
+}
+
+// matchGracePath reports whether the path matches one of the patterns, which
+// are either a path prefix (e.g. /static/) or an extension (e.g. *.css). The
+// path is cleaned first, so /static/../secret doesn't match /static/
+func matchGracePath(urlPath string, patterns []string) bool {
+	path := cleanPath(urlPath)
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(path, pattern[1:]) {
+				return true
+			}
+		} else if strings.HasPrefix(path, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath resolves the dot segments of the path, keeping a trailing slash
+func cleanPath(urlPath string) string {
+	cleaned := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
 	}
+	return cleaned
 }
 
 // AuthCallbackHandler Handles auth callback request
@@ -134,6 +712,9 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 			logger.WithFields(logrus.Fields{
 				"error": err,
 			}).Warn("Error validating state")
+			recordLoginFailure(req)
+			recordFunnelFailure(funnelUnknown, funnelUnknown, "invalid_state")
+			auditLoginFailure(req, funnelUnknown, "", "invalid_state")
 			http.Error(writer, "Not authorized", 401)
 			return
 		}
@@ -141,7 +722,16 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 		// Check for CSRF cookie
 		cookie, err := FindCSRFCookie(req, state)
 		if err != nil {
+			// The callback may have been repeated after completing
+			if user, redirect, ok := loginTransactions.Repeated(loginTransactionKey(req), state[:32]); ok {
+				if s.joinLogin(logger, writer, req, user, redirect) {
+					return
+				}
+			}
 			logger.Info("Missing csrf cookie")
+			recordLoginFailure(req)
+			recordFunnelFailure(funnelUnknown, funnelUnknown, "csrf_missing")
+			auditLoginFailure(req, funnelUnknown, "", "csrf_missing")
 			http.Error(writer, "Not authorized", 401)
 			return
 		}
@@ -153,46 +743,227 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 				"error":       err,
 				"csrf_cookie": cookie,
 			}).Warn("Error validating csrf cookie")
+			recordLoginFailure(req)
+			recordFunnelFailure(funnelUnknown, funnelUnknown, "csrf_mismatch")
+			auditLoginFailure(req, funnelUnknown, "", "csrf_mismatch")
 			http.Error(writer, "Not authorized", 401)
 			return
 		}
 
 		// Get provider
-		configuredProvider, err := config.GetConfiguredProvider(providerName)
+		configuredProvider, err := config().GetConfiguredProvider(providerName)
 		if err != nil {
 			logger.WithFields(logrus.Fields{
 				"error":       err,
 				"csrf_cookie": cookie,
 				"provider":    providerName,
 			}).Warn("Invalid provider in csrf cookie")
+			recordLoginFailure(req)
+			recordFunnelFailure(funnelUnknown, funnelUnknown, "invalid_provider")
+			auditLoginFailure(req, funnelUnknown, "", "invalid_provider")
+			http.Error(writer, "Not authorized", 401)
+			return
+		}
+
+		// Only return users to hosts we protect
+		if _, err := ValidateRedirect(req, redirect); err != nil {
+			logger.WithFields(logrus.Fields{
+				"error":    err,
+				"redirect": redirect,
+			}).Warn("Invalid redirect in csrf state")
+			recordLoginFailure(req)
+			recordFunnelFailure(providerName, funnelUnknown, "invalid_redirect")
+			auditLoginFailure(req, providerName, "", "invalid_redirect")
 			http.Error(writer, "Not authorized", 401)
 			return
 		}
 
 		// Clear CSRF cookie
-		http.SetCookie(writer, ClearCSRFCookie(req, cookie))
+		setCookie(writer, ClearCSRFCookie(req, cookie))
+
+		// The user has returned from the provider
+		rule := s.matchRule(redirect)
+		recordFunnelStage(providerName, rule, funnelCallback)
+
+		// Did the provider return an error?
+		if perr := provider.ErrorFromQuery(req.URL.Query()); perr != nil {
+			loginsTotal.Inc(providerName, "provider_error")
+			recordFunnelFailure(providerName, rule, "provider_error")
+			auditLoginFailure(req, providerName, "", "provider_error")
+			s.providerError(logger, writer, req, providerName, perr)
+			return
+		}
+
+		// Join the session of a concurrent login from another tab, or lead
+		// the transaction
+		txKey := loginTransactionKey(req)
+		tx, leader := loginTransactions.Begin(txKey, providerName)
+		if !leader {
+			if user := loginTransactions.Wait(tx); user != nil {
+				loginTransactions.Record(tx, state[:32], redirect)
+				if s.joinLogin(logger, writer, req, user, redirect) {
+					loginsTotal.Inc(providerName, "joined")
+					recordFunnelStage(providerName, rule, funnelSession)
+					return
+				}
+			}
+			tx = nil
+		}
+		var txUser *provider.User
+		defer func() {
+			loginTransactions.Finish(txKey, tx, txUser)
+		}()
 
 		// Exchange code for token
+		if err := waitProviderBudget(providerName, "token_exchange", false); err != nil {
+			loginsTotal.Inc(providerName, "budget_exhausted")
+			recordFunnelFailure(providerName, rule, "budget_exhausted")
+			logger.WithField("error", err).Warn("Not exchanging code with provider")
+			http.Error(writer, "Service unavailable", 503)
+			return
+		}
+		start := time.Now()
 		token, err := configuredProvider.ExchangeCode(redirectUri(req), req.URL.Query().Get("code"))
+		observeProviderRequest(providerName, "token_exchange", start, err)
+		traceProviderRequest(req, providerName, "token_exchange", start, err)
 		if err != nil {
+			loginsTotal.Inc(providerName, "exchange_error")
+			recordFunnelFailure(providerName, rule, "exchange_error")
+			auditLoginFailure(req, providerName, "", "exchange_error")
+			if perr, ok := provider.AsError(err); ok {
+				s.providerError(logger, writer, req, providerName, perr)
+				return
+			}
 			logger.WithField("error", err).Error("Code exchange failed with provider")
 			http.Error(writer, "Service unavailable", 503)
 			return
 		}
 
 		// Get user
+		if err := waitProviderBudget(providerName, "userinfo", false); err != nil {
+			loginsTotal.Inc(providerName, "budget_exhausted")
+			recordFunnelFailure(providerName, rule, "budget_exhausted")
+			logger.WithField("error", err).Warn("Not getting user from provider")
+			http.Error(writer, "Service unavailable", 503)
+			return
+		}
+		start = time.Now()
 		user, err := configuredProvider.GetUser(token)
+		observeProviderRequest(providerName, "userinfo", start, err)
+		traceProviderRequest(req, providerName, "userinfo", start, err)
 		if err != nil {
+			// e.g. the user isn't in the provider's required-claim tenant
+			if perr, ok := provider.AsError(err); ok {
+				loginsTotal.Inc(providerName, "provider_error")
+				recordFunnelFailure(providerName, rule, "provider_error")
+				auditLoginFailure(req, providerName, "", "provider_error")
+				s.providerError(logger, writer, req, providerName, perr)
+				return
+			}
+			loginsTotal.Inc(providerName, "user_error")
+			recordFunnelFailure(providerName, rule, "user_error")
 			logger.WithField("error", err).Error("Error getting user")
 			http.Error(writer, "Service unavailable", 503)
 			return
 		}
+		loginsTotal.Inc(providerName, "success")
+		user.Email = normalizeEmail(user.Email)
+
+		// Take roles from the configured claims, before only keeping the
+		// claims that are passed on
+		claims := user.Claims
+		addClaimRoles(user, claims)
+		setProfile(user, claims)
+		keepCustomClaims(user)
+		resolveGroups(req, logger, providerName, configuredProvider, token, user)
+
+		// Translate provider groups, then grant roles from the directory
+		if roleMap != nil {
+			roleMap.Apply(user)
+		}
+		if userDirectory != nil {
+			userDirectory.Apply(user)
+		}
 
-		ensureUser(user)
+		// Let the login script adjust or reject the user
+		if loginScript != nil {
+			if err := loginScript.Run(req, providerName, user, claims); err != nil {
+				if rejected, ok := err.(*LoginRejectedError); ok {
+					logger.WithFields(logrus.Fields{
+						"user":   user.Email,
+						"reason": rejected.Reason,
+					}).Warn("Login rejected by login script")
+					recordFunnelFailure(providerName, rule, "script_rejected")
+					auditLoginFailure(req, providerName, user.Email, "script_rejected")
+					http.Error(writer, "Forbidden", 403)
+					return
+				}
+				logger.WithField("error", err).Error("Error running login script")
+				recordFunnelFailure(providerName, rule, "script_error")
+				http.Error(writer, "Service unavailable", 503)
+				return
+			}
+		}
+
+		// The user will be turned away when they return, e.g. they aren't
+		// on the whitelist
+		if !ValidateUser(user, rule) {
+			recordFunnelFailure(providerName, rule, "denied")
+			auditLoginFailure(req, providerName, user.Email, "denied")
+		}
+
+		// Don't outlive the provider session
+		if config().LimitLifetimeToProvider {
+			user.SessionExpiry = token.SessionExpiry()
+		}
+
+		if err := ensureUser(user); err != nil {
+			logger.WithField("error", err).Error("Error storing session")
+			http.Error(writer, "Service unavailable", 503)
+			return
+		}
+		if config().SessionsPage {
+			if err := recordSessionClient(user, req); err != nil {
+				logger.WithField("error", err).Warn("Error recording session client")
+			}
+		}
+		if err := keepTokens(user, providerName, token); err != nil {
+			logger.WithField("error", err).Error("Error storing session")
+			http.Error(writer, "Service unavailable", 503)
+			return
+		}
+		trackConsent(user, providerName, token)
+
+		// Logging in again resets the idle timeout of an existing session
+		if longestIdleTimeout() > 0 {
+			sessionActivity.Touch(user.UUID)
+		}
+
+		if fallbackCache != nil {
+			fallbackCache.Record(user)
+		}
 
 		// Generate cookie
-		cookie, _ = MakeCookie(req, user)
-		http.SetCookie(writer, cookie)
+		cookie, err = MakeCookie(req, user)
+		if err != nil {
+			logger.WithField("error", err).Error("Error creating auth cookie")
+			http.Error(writer, "Service unavailable", 503)
+			return
+		}
+		setCookie(writer, cookie)
+		recordFunnelStage(providerName, rule, funnelSession)
+		txUser = user
+		loginTransactions.Record(tx, state[:32], redirect)
+
+		// Remember the provider if the user may have had to choose
+		if len(config().interactiveProviders(config().configuredProviderNames())) > 1 {
+			setCookie(writer, MakeProviderCookie(req, providerName))
+		}
+		auditEvent("login_succeeded", "", auditRequestFields(req, logrus.Fields{
+			"user":     user.Email,
+			"provider": providerName,
+			"rule":     rule,
+		}))
 		logger.WithFields(logrus.Fields{
 			"provider": providerName,
 			"redirect": redirect,
@@ -204,24 +975,162 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 	}
 }
 
-// LogoutHandler logs a user out
+// LogoutHandler logs a user out, ending their session and, if
+// "logout-provider" is set, their session at the provider
 func (s *Server) LogoutHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Clear cookie
-		http.SetCookie(w, ClearCookie(r))
+		setCookie(w, ClearCookie(r))
 
 		logger := s.logger(r, "Logout", "default", "Handling logout")
+
+		// End the session, so the cookie can't be used again
+		var entry *UserEntry
+		if c, err := r.Cookie(config().CookieName); err == nil {
+			if id, _, err := parseCookie(r, c); err == nil {
+				fields := logrus.Fields{}
+				entry, err = sessions.Get(id)
+				if err != nil {
+					logger.WithField("error", err).Warn("Error loading session")
+				} else if entry != nil {
+					fields["user"] = entry.User.Email
+				}
+				if err != nil || entry != nil {
+					terminateSession(id, "logout", fields)
+				}
+			}
+		}
 		logger.Info("Logged out user")
 
-		if config.LogoutRedirect != "" {
-			http.Redirect(w, r, config.LogoutRedirect, http.StatusTemporaryRedirect)
+		if logoutURL := providerLogoutURL(entry); logoutURL != "" {
+			http.Redirect(w, r, logoutURL, http.StatusTemporaryRedirect)
+		} else if config().LogoutRedirect != "" {
+			http.Redirect(w, r, config().LogoutRedirect, http.StatusTemporaryRedirect)
 		} else {
 			http.Error(w, "You have been logged out", 401)
 		}
 	}
 }
 
-func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, p provider.Provider) {
+// providerLogoutURL returns where to send the user to end their session at the
+// provider, or an empty string if it can't or shouldn't be ended
+func providerLogoutURL(entry *UserEntry) string {
+	if !config().LogoutProvider || entry == nil || entry.IDToken == "" {
+		return ""
+	}
+	p, err := config().GetConfiguredProvider(entry.Provider)
+	if err != nil {
+		return ""
+	}
+	logouter, ok := p.(provider.Logouter)
+	if !ok {
+		return ""
+	}
+	return logouter.LogoutURL(entry.IDToken, config().LogoutRedirect)
+}
+
+// LoginHandler starts a login with the provider given in the query string, or
+// the provider the user last used. If neither are present, or the "switch"
+// query parameter is set, the user is asked to choose a provider
+func (s *Server) LoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "Login", "default", "Handling login")
+
+		q := r.URL.Query()
+		returnReq := withReturnPath(r, q.Get("redirect"))
+		providers := config().interactiveProviders(config().configuredProviderNames())
+
+		// Explicitly chosen provider
+		if name := q.Get("provider"); name != "" {
+			p, err := config().GetConfiguredProvider(name)
+			if _, ok := p.(provider.Identifier); ok {
+				err = errors.New("provider does not support login")
+			}
+			if err != nil {
+				logger.WithField("provider", name).Warn("Invalid provider chosen")
+				http.Error(w, "Invalid provider", 400)
+				return
+			}
+			s.authRedirect(logger, w, returnReq, s.matchRule(returnUrl(returnReq)), p)
+			return
+		}
+
+		// Ignore the remembered provider if the user wants to switch
+		if _, ok := q["switch"]; ok {
+			s.chooseProvider(logger, w, returnReq, providers)
+			return
+		}
+
+		s.login(logger, w, returnReq, s.matchRule(returnUrl(returnReq)), providers)
+	}
+}
+
+// login sends the user to log in with one of the given providers, if there is
+// a choice to be made it is remembered or the user is asked to choose
+func (s *Server) login(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule string, providers []string) {
+	// Streams can't follow a redirect to log in
+	if _, ok := streamGrace(r, rule); ok {
+		traceCheck(r, "login", "refused, streams can't follow a redirect")
+		logger.Info("Refusing streaming request that needs to log in")
+		http.Error(w, "Not authorized", 401)
+		return
+	}
+
+	// Clients that weren't identified by their address can't log in with
+	// those providers
+	providers = config().interactiveProviders(providers)
+	if len(providers) == 0 {
+		traceCheck(r, "login", "no provider to log in with")
+		logger.Info("Client not identified and no provider to log in with")
+		http.Error(w, "Not authorized", 401)
+		return
+	}
+
+	// Nor can gRPC clients, they're told the call is unauthenticated
+	if isGRPCRequest(r) {
+		traceCheck(r, "login", "refused, gRPC calls can't follow a redirect")
+		logger.Info("Refusing gRPC call that needs to log in")
+		http.Error(w, "Login required", 401)
+		return
+	}
+
+	// Scripts can't follow a redirect to log in either
+	if isAPIRequest(r) {
+		traceCheck(r, "login", "refused, API requests can't follow a redirect")
+		s.apiLoginRequired(logger, w, r)
+		return
+	}
+
+	// Following a redirect would lose what the user submitted
+	if !isSafeMethod(r.Method) {
+		traceCheck(r, "login", "refused, "+r.Method+" request would be lost")
+		s.submissionExpired(logger, w, r)
+		return
+	}
+
+	name := providers[0]
+	if len(providers) > 1 {
+		var ok bool
+		if name, ok = preferredProvider(r, providers); !ok {
+			traceCheck(r, "login", "choosing provider")
+			s.chooseProvider(logger, w, r, providers)
+			return
+		}
+		logger.WithField("provider", name).Debug("Using remembered provider")
+	}
+
+	p, err := config().GetConfiguredProvider(name)
+	if err != nil {
+		logger.WithField("error", err).Error("Invalid provider")
+		http.Error(w, "Service unavailable", 503)
+		return
+	}
+
+	traceCheck(r, "login", "redirecting to "+name)
+	s.authRedirect(logger, w, r, rule, p)
+}
+
+func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule string, p provider.Provider) {
 	// Error indicates no cookie, generate nonce
 	err, nonce := Nonce()
 	if err != nil {
@@ -232,17 +1141,35 @@ func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *ht
 
 	// Set the CSRF cookie
 	csrf := MakeCSRFCookie(r, nonce)
-	http.SetCookie(w, csrf)
+	setCookie(w, csrf)
 
-	if !config.InsecureCookie && r.Header.Get("X-Forwarded-Proto") != "https" {
+	// Tabs logging in at the same time share a transaction
+	if _, err := r.Cookie(buildLoginTransactionCookieName()); err != nil {
+		if err, id := Nonce(); err == nil {
+			setCookie(w, MakeLoginTransactionCookie(r, id))
+		}
+	}
+
+	if !config().InsecureCookie && r.Header.Get("X-Forwarded-Proto") != "https" {
 		logger.Warn("You are using \"secure\" cookies for a request that was not " +
 			"received via https. You should either redirect to https or pass the " +
 			"\"insecure-cookie\" config option to permit cookies via http.")
 	}
 
+	// Hide where the user is returning to from the provider
+	state := MakeState(r, p, nonce)
+	if config().EncryptCookies {
+		if state, err = encryptState(state); err != nil {
+			logger.WithField("error", err).Error("Error encrypting state")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+	}
+
 	// Forward them on
-	loginURL := p.GetLoginURL(redirectUri(r), MakeState(r, p, nonce))
+	loginURL := p.GetLoginURL(redirectUri(r), state)
 	http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
+	recordFunnelStage(p.Name(), rule, funnelRedirect)
 
 	logger.WithFields(logrus.Fields{
 		"csrf_cookie": csrf,
@@ -250,16 +1177,42 @@ func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *ht
 	}).Debug("Set CSRF cookie and redirected to provider login url")
 }
 
+// providerError logs and displays an error returned by the provider, along
+// with a remediation hint if the error is well known
+func (s *Server) providerError(logger *logrus.Entry, w http.ResponseWriter, r *http.Request, providerName string, perr *provider.Error) {
+	status := perr.Status()
+	entry := logger.WithFields(logrus.Fields{
+		"provider":          providerName,
+		"error":             perr.Code,
+		"error_description": perr.Description,
+		"error_uri":         perr.URI,
+	})
+	if status == http.StatusUnauthorized {
+		entry.Warn("Provider refused login")
+		recordLoginFailure(r)
+	} else {
+		entry.Error("Provider returned an error")
+	}
+
+	msg := fmt.Sprintf("Authentication failed: %s", perr.Error())
+	if hint := perr.Hint(); hint != "" {
+		msg = fmt.Sprintf("%s\n\n%s", msg, hint)
+	}
+	http.Error(w, msg, status)
+}
+
 func (s *Server) logger(r *http.Request, handler, rule, msg string) *logrus.Entry {
 	// Create logger
 	logger := log.WithFields(logrus.Fields{
-		"handler":   handler,
-		"rule":      rule,
-		"method":    r.Header.Get("X-Forwarded-Method"),
-		"proto":     r.Header.Get("X-Forwarded-Proto"),
-		"host":      r.Header.Get("X-Forwarded-Host"),
-		"uri":       r.Header.Get("X-Forwarded-Uri"),
-		"source_ip": r.Header.Get("X-Forwarded-For"),
+		"request_id": requestID(r),
+		"handler":    handler,
+		"instance":   config().InstanceID,
+		"rule":       rule,
+		"method":     r.Header.Get("X-Forwarded-Method"),
+		"proto":      r.Header.Get("X-Forwarded-Proto"),
+		"host":       r.Header.Get("X-Forwarded-Host"),
+		"uri":        r.Header.Get("X-Forwarded-Uri"),
+		"source_ip":  r.Header.Get("X-Forwarded-For"),
 	})
 
 	// Log request
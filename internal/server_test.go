@@ -3,17 +3,21 @@ package tfa
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
 	"golang.org/x/oauth2"
 )
 
@@ -22,8 +26,8 @@ import (
  */
 
 func init() {
-	config = newDefaultConfig()
-	config.LogLevel = "panic"
+	setConfig(newDefaultConfig())
+	config().LogLevel = "panic"
 	log = NewDefaultLogger()
 }
 
@@ -33,7 +37,7 @@ func init() {
 
 func TestServerRootHandler(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
+	setConfig(newDefaultConfig())
 
 	// X-Forwarded headers should be read into request
 	req := httptest.NewRequest("POST", "http://should-use-x-forwarded.com/should?ignore=me", nil)
@@ -64,7 +68,7 @@ func TestServerRootHandler(t *testing.T) {
 
 func TestServerAuthHandlerInvalid(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
+	setConfig(newDefaultConfig())
 	var hook *test.Hook
 	log, hook = test.NewNullLogger()
 
@@ -98,7 +102,7 @@ func TestServerAuthHandlerInvalid(t *testing.T) {
 
 	// Should catch invalid cookie
 	req = newDefaultHttpRequest("/foo")
-	c := MakeCookie(req, "test@example.com")
+	c, _ := MakeCookie(req, newTestUser("test@example.com"))
 	parts = strings.Split(c.Value, "|")
 	c.Value = fmt.Sprintf("bad|%s|%s", parts[1], parts[2])
 
@@ -107,8 +111,8 @@ func TestServerAuthHandlerInvalid(t *testing.T) {
 
 	// Should validate email
 	req = newDefaultHttpRequest("/foo")
-	c = MakeCookie(req, "test@example.com")
-	config.Domains = []string{"test.com"}
+	c, _ = MakeCookie(req, newTestUser("test@example.com"))
+	config().Domains = []string{"test.com"}
 
 	res, _ = doHttpRequest(req, c)
 	assert.Equal(401, res.StatusCode, "invalid email should not be authorised")
@@ -116,20 +120,20 @@ func TestServerAuthHandlerInvalid(t *testing.T) {
 
 func TestServerAuthHandlerExpired(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
-	config.Lifetime = time.Second * time.Duration(-1)
-	config.Domains = []string{"test.com"}
+	setConfig(newDefaultConfig())
+	config().Lifetime = time.Second * time.Duration(-1)
+	config().Domains = []string{"test.com"}
 
 	// Should redirect expired cookie
 	req := newHTTPRequest("GET", "http://example.com/foo")
-	c := MakeCookie(req, "test@example.com")
+	c, _ := MakeCookie(req, newTestUser("test@example.com"))
 	res, _ := doHttpRequest(req, c)
 	require.Equal(t, 307, res.StatusCode, "request with expired cookie should be redirected")
 
 	// Check for CSRF cookie
 	var cookie *http.Cookie
 	for _, c := range res.Cookies() {
-		if strings.HasPrefix(c.Name, config.CSRFCookieName) {
+		if strings.HasPrefix(c.Name, config().CSRFCookieName) {
 			cookie = c
 		}
 	}
@@ -144,12 +148,12 @@ func TestServerAuthHandlerExpired(t *testing.T) {
 
 func TestServerAuthHandlerValid(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
+	setConfig(newDefaultConfig())
 
 	// Should allow valid request email
 	req := newHTTPRequest("GET", "http://example.com/foo")
-	c := MakeCookie(req, "test@example.com")
-	config.Domains = []string{}
+	c, _ := MakeCookie(req, newTestUser("test@example.com"))
+	config().Domains = []string{}
 
 	res, _ := doHttpRequest(req, c)
 	assert.Equal(200, res.StatusCode, "valid request should be allowed")
@@ -163,17 +167,17 @@ func TestServerAuthHandlerValid(t *testing.T) {
 func TestServerAuthCallback(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
-	config = newDefaultConfig()
+	setConfig(newDefaultConfig())
 
 	// Setup OAuth server
 	server, serverURL := NewOAuthServer(t)
 	defer server.Close()
-	config.Providers.Google.TokenURL = &url.URL{
+	config().Providers.Google.TokenURL = &url.URL{
 		Scheme: serverURL.Scheme,
 		Host:   serverURL.Host,
 		Path:   "/token",
 	}
-	config.Providers.Google.UserURL = &url.URL{
+	config().Providers.Google.UserURL = &url.URL{
 		Scheme: serverURL.Scheme,
 		Host:   serverURL.Host,
 		Path:   "/userinfo",
@@ -186,49 +190,141 @@ func TestServerAuthCallback(t *testing.T) {
 
 	// Should catch invalid csrf cookie
 	nonce := "12345678901234567890123456789012"
-	req = newHTTPRequest("GET", "http://example.com/_oauth?state="+nonce+":http://redirect")
+	req = newHTTPRequest("GET", "http://example.com/_oauth?state="+nonce+":http://example.com/redirect")
 	c := MakeCSRFCookie(req, "nononononononononononononononono")
 	res, _ = doHttpRequest(req, c)
 	assert.Equal(401, res.StatusCode, "auth callback with invalid cookie shouldn't be authorised")
 
 	// Should catch invalid provider cookie
-	req = newHTTPRequest("GET", "http://example.com/_oauth?state="+nonce+":invalid:http://redirect")
+	req = newHTTPRequest("GET", "http://example.com/_oauth?state="+nonce+":invalid:http://example.com/redirect")
 	c = MakeCSRFCookie(req, nonce)
 	res, _ = doHttpRequest(req, c)
 	assert.Equal(401, res.StatusCode, "auth callback with invalid provider shouldn't be authorised")
 
 	// Should redirect valid request
-	req = newHTTPRequest("GET", "http://example.com/_oauth?state="+nonce+":google:http://redirect")
+	req = newHTTPRequest("GET", "http://example.com/_oauth?state="+nonce+":google:http://example.com/redirect")
 	c = MakeCSRFCookie(req, nonce)
 	res, _ = doHttpRequest(req, c)
 	require.Equal(307, res.StatusCode, "valid auth callback should be allowed")
 
 	fwd, _ := res.Location()
 	assert.Equal("http", fwd.Scheme, "valid request should be redirected to return url")
-	assert.Equal("redirect", fwd.Host, "valid request should be redirected to return url")
-	assert.Equal("", fwd.Path, "valid request should be redirected to return url")
+	assert.Equal("example.com", fwd.Host, "valid request should be redirected to return url")
+	assert.Equal("/redirect", fwd.Path, "valid request should be redirected to return url")
+
+	// Should refuse to redirect to other hosts
+	req = newHTTPRequest("GET", "http://example.com/_oauth?state="+nonce+":google:http://evil.com/redirect")
+	c = MakeCSRFCookie(req, nonce)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "auth callback with invalid redirect shouldn't be authorised")
+}
+
+func TestServerAuthCallbackProviderError(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should display error returned by provider on callback
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect&error=access_denied&error_description=denied+by+policy")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, body := doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "auth callback should refuse provider error")
+	assert.Contains(body, "access_denied: denied by policy")
+	assert.Contains(body, "provider policy", "auth callback should include hint")
+
+	// Should treat provider outage as unavailable
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect&error=temporarily_unavailable")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(503, res.StatusCode, "auth callback should handle unavailable provider")
+
+	// Should treat error with token exchange as provider error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"error":"invalid_client"}`)
+	}))
+	defer server.Close()
+	config().Providers.Google.TokenURL, _ = url.Parse(server.URL + "/token")
+
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect&code=123")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, body = doHttpRequest(req, c)
+	assert.Equal(500, res.StatusCode, "auth callback should handle misconfigured client")
+	assert.Contains(body, "client-secret")
+
+	// Should refuse users outside the hosted domain
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"access_token":"123456789"}`)
+		} else {
+			fmt.Fprint(w, `{"email":"example@gmail.com"}`)
+		}
+	}))
+	defer server.Close()
+	config().Providers.Google.HostedDomains = []string{"example.com"}
+	config().Providers.Google.Setup()
+	config().Providers.Google.TokenURL, _ = url.Parse(server.URL + "/token")
+	config().Providers.Google.UserURL, _ = url.Parse(server.URL + "/userinfo")
+
+	req = newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect&code=123")
+	c = MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, body = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "auth callback should refuse users outside the hosted domain")
+	assert.Contains(body, "hd claim is missing")
+}
+
+func TestServerAuthCallbackProviderLifetime(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().LimitLifetimeToProvider = true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"access_token":"123456789","expires_in":60}`)
+		} else {
+			fmt.Fprint(w, `{"email":"example@example.com"}`)
+		}
+	}))
+	defer server.Close()
+	config().Providers.Google.TokenURL, _ = url.Parse(server.URL + "/token")
+	config().Providers.Google.UserURL, _ = url.Parse(server.URL + "/userinfo")
+
+	// Should limit cookie to provider token expiry
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	require.Equal(307, res.StatusCode)
+
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == config().CookieName {
+			cookie = c
+		}
+	}
+	require.NotNil(cookie)
+	assert.WithinDuration(time.Now().Add(time.Minute), cookie.Expires, 10*time.Second, "cookie should not outlive provider token")
 }
 
 func TestServerAuthCallbackExchangeFailure(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
+	setConfig(newDefaultConfig())
 
 	// Setup OAuth server
 	server, serverURL := NewFailingOAuthServer(t)
 	defer server.Close()
-	config.Providers.Google.TokenURL = &url.URL{
+	config().Providers.Google.TokenURL = &url.URL{
 		Scheme: serverURL.Scheme,
 		Host:   serverURL.Host,
 		Path:   "/token",
 	}
-	config.Providers.Google.UserURL = &url.URL{
+	config().Providers.Google.UserURL = &url.URL{
 		Scheme: serverURL.Scheme,
 		Host:   serverURL.Host,
 		Path:   "/userinfo",
 	}
 
 	// Should handle failed code exchange
-	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://redirect")
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
 	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
 	res, _ := doHttpRequest(req, c)
 	assert.Equal(503, res.StatusCode, "auth callback should handle failed code exchange")
@@ -236,35 +332,81 @@ func TestServerAuthCallbackExchangeFailure(t *testing.T) {
 
 func TestServerAuthCallbackUserFailure(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
+	setConfig(newDefaultConfig())
 
 	// Setup OAuth server
 	server, serverURL := NewOAuthServer(t)
 	defer server.Close()
-	config.Providers.Google.TokenURL = &url.URL{
+	config().Providers.Google.TokenURL = &url.URL{
 		Scheme: serverURL.Scheme,
 		Host:   serverURL.Host,
 		Path:   "/token",
 	}
 	serverFail, serverFailURL := NewFailingOAuthServer(t)
 	defer serverFail.Close()
-	config.Providers.Google.UserURL = &url.URL{
+	config().Providers.Google.UserURL = &url.URL{
 		Scheme: serverFailURL.Scheme,
 		Host:   serverFailURL.Host,
 		Path:   "/userinfo",
 	}
 
 	// Should handle failed user request
-	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://redirect")
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
 	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
 	res, _ := doHttpRequest(req, c)
 	assert.Equal(503, res.StatusCode, "auth callback should handle failed user request")
 }
 
+func TestServerAuthCallbackSeparateUsers(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	sessions = NewMemorySessionStore()
+
+	// Setup OAuth server logging in a different user each time
+	var logins int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"access_token":"123456789"}`)
+			return
+		}
+		logins++
+		fmt.Fprintf(w, `{"email":"user%d@example.com","verified_email":true}`, logins)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	config().Providers.Google.TokenURL = &url.URL{Scheme: serverURL.Scheme, Host: serverURL.Host, Path: "/token"}
+	config().Providers.Google.UserURL = &url.URL{Scheme: serverURL.Scheme, Host: serverURL.Host, Path: "/userinfo"}
+
+	login := func() *provider.User {
+		nonce := "12345678901234567890123456789012"
+		req := newDefaultHttpRequest("/_oauth?state=" + nonce + ":google:http://example.com/redirect")
+		res, _ := doHttpRequest(req, MakeCSRFCookie(req, nonce))
+		require.Equal(307, res.StatusCode)
+		for _, c := range res.Cookies() {
+			if c.Name == config().CookieName {
+				user, err := ValidateCookie(newDefaultHttpRequest("/"), c)
+				require.Nil(err)
+				return user
+			}
+		}
+		require.Fail("no auth cookie set")
+		return nil
+	}
+
+	// Should give each login its own session
+	first := login()
+	second := login()
+	assert.NotEqual(uuid.Nil, first.UUID)
+	assert.NotEqual(first.UUID, second.UUID)
+	assert.Equal("user1@example.com", first.Email)
+	assert.Equal("user2@example.com", second.Email)
+}
+
 func TestServerLogout(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
-	config = newDefaultConfig()
+	setConfig(newDefaultConfig())
 
 	req := newDefaultHttpRequest("/_oauth/logout")
 	res, _ := doHttpRequest(req, nil)
@@ -273,7 +415,7 @@ func TestServerLogout(t *testing.T) {
 	// Check for cookie
 	var cookie *http.Cookie
 	for _, c := range res.Cookies() {
-		if c.Name == config.CookieName {
+		if c.Name == config().CookieName {
 			cookie = c
 		}
 	}
@@ -281,7 +423,7 @@ func TestServerLogout(t *testing.T) {
 	require.Less(cookie.Expires.Local().Unix(), time.Now().Local().Unix()-50, "cookie should have expired")
 
 	// Test with redirect
-	config.LogoutRedirect = "http://redirect/path"
+	config().LogoutRedirect = "http://redirect/path"
 	req = newDefaultHttpRequest("/_oauth/logout")
 	res, _ = doHttpRequest(req, nil)
 	require.Equal(307, res.StatusCode, "should return a 307")
@@ -289,7 +431,7 @@ func TestServerLogout(t *testing.T) {
 	// Check for cookie
 	cookie = nil
 	for _, c := range res.Cookies() {
-		if c.Name == config.CookieName {
+		if c.Name == config().CookieName {
 			cookie = c
 		}
 	}
@@ -304,15 +446,329 @@ func TestServerLogout(t *testing.T) {
 
 }
 
+func TestServerLogoutSession(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should end the session so the cookie can't be used again
+	user := newTestUser("logout@example.com")
+	req := newDefaultHttpRequest("/_oauth/logout")
+	c, _ := MakeCookie(req, user)
+	logouts := sessionsRevokedTotal.Value("logout")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+	entry, _ := sessions.Get(user.UUID)
+	assert.Nil(entry, "session should be ended")
+	assert.Equal(logouts+1, sessionsRevokedTotal.Value("logout"))
+
+	req = newDefaultHttpRequest("/foo")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "cookie should no longer be accepted")
+}
+
+func TestServerLogoutProvider(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().LogoutProvider = true
+	config().LogoutRedirect = "https://example.com/bye"
+
+	// Setup an OIDC provider advertising an end session endpoint
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"issuer":"`+server.URL+`",
+			"authorization_endpoint":"`+server.URL+`/auth",
+			"token_endpoint":"`+server.URL+`/token",
+			"jwks_uri":"`+server.URL+`/jwks",
+			"end_session_endpoint":"`+server.URL+`/logout"
+		}`)
+	}))
+	defer server.Close()
+	config().DefaultProvider = "oidc"
+	config().Providers.OIDC.IssuerURL = server.URL
+	config().Providers.OIDC.ClientID = "id"
+	config().Providers.OIDC.ClientSecret = "secret"
+	require.Nil(config().Providers.OIDC.Setup())
+
+	// Should keep the id token with the session
+	user := newTestUser("logout@example.com")
+	require.Nil(keepTokens(user, "oidc", &provider.Token{IDToken: "id-token"}))
+
+	// Should redirect to the provider to end its session
+	req := newDefaultHttpRequest("/_oauth/logout")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	require.Equal(307, res.StatusCode)
+	fwd, _ := res.Location()
+	require.NotNil(fwd)
+	assert.Equal(server.URL+"/logout", fwd.Scheme+"://"+fwd.Host+fwd.Path)
+	assert.Equal("id-token", fwd.Query().Get("id_token_hint"))
+	assert.Equal("https://example.com/bye", fwd.Query().Get("post_logout_redirect_uri"))
+	entry, _ := sessions.Get(user.UUID)
+	assert.Nil(entry, "session should be ended")
+
+	// Should fall back to the logout redirect without a session
+	res, _ = doHttpRequest(newDefaultHttpRequest("/_oauth/logout"), c)
+	require.Equal(307, res.StatusCode)
+	fwd, _ = res.Location()
+	assert.Equal("https://example.com/bye", fwd.String())
+
+	// Should not keep id tokens when disabled
+	config().LogoutProvider = false
+	other := newTestUser("other@example.com")
+	keepTokens(other, "oidc", &provider.Token{IDToken: "id-token"})
+	entry, _ = sessions.Get(other.UUID)
+	if assert.NotNil(entry) {
+		assert.Equal("", entry.IDToken)
+	}
+}
+
+func TestServerUserInfo(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	h := NewServer().Handler()
+
+	// Should require a cookie
+	req := httptest.NewRequest("GET", "http://example.com/_oauth/userinfo", nil)
+	res := serveRouter(h, req)
+	assert.Equal(401, res.Code)
+
+	// Should return the user
+	user := newTestUser("test@example.com")
+	user.Name = "Test"
+	user.Roles = []string{"admin"}
+	c, _ := MakeCookie(req, user)
+	req.AddCookie(c)
+	res = serveRouter(h, req)
+	assert.Equal(200, res.Code)
+	assert.Equal("application/json", res.Header().Get("Content-Type"))
+	assert.JSONEq(`{"email":"test@example.com","name":"Test","roles":["admin"]}`, res.Body.String())
+}
+
+func TestServerRequireHTTPS(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"redirect": {
+			Action:       "allow",
+			Rule:         "PathPrefix(`/redirect`)",
+			RequireHTTPS: "redirect",
+			HSTS:         31536000,
+		},
+		"reject": {
+			Action:       "auth",
+			Rule:         "PathPrefix(`/reject`)",
+			Provider:     "google",
+			RequireHTTPS: "reject",
+		},
+	}
+
+	// Should redirect plain HTTP requests
+	req := newHTTPRequest("GET", "http://example.com/redirect?q=1")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(308, res.StatusCode)
+	location, _ := res.Location()
+	assert.Equal("https://example.com/redirect?q=1", location.String())
+	assert.Equal("max-age=31536000", res.Header.Get("Strict-Transport-Security"))
+
+	// Should allow HTTPS requests
+	req = newHTTPRequest("GET", "https://example.com/redirect")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("max-age=31536000", res.Header.Get("Strict-Transport-Security"))
+
+	// Should only include subdomains when configured
+	config().Rules["redirect"].HSTSSubdomains = true
+	req = newHTTPRequest("GET", "https://example.com/redirect")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal("max-age=31536000; includeSubDomains", res.Header.Get("Strict-Transport-Security"))
+
+	// Should reject plain HTTP requests
+	req = newHTTPRequest("GET", "http://example.com/reject")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(403, res.StatusCode)
+	assert.Equal("", res.Header.Get("Strict-Transport-Security"))
+
+	// Should authenticate HTTPS requests
+	req = newHTTPRequest("GET", "https://example.com/reject")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+
+	// Should not affect other rules
+	req = newHTTPRequest("GET", "http://example.com/other")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+}
+
+func TestServerTailscale(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"tailnet": {
+			Action:   "auth",
+			Rule:     "PathPrefix(`/tailnet`)",
+			Provider: "tailscale",
+		},
+		"either": {
+			Action:   "auth",
+			Rule:     "PathPrefix(`/either`)",
+			Provider: "tailscale,google",
+		},
+	}
+
+	// Setup tailscaled LocalAPI
+	socket := filepath.Join(t.TempDir(), "tailscaled.sock")
+	l, err := net.Listen("unix", socket)
+	require.Nil(err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("addr") == "100.64.0.1" {
+			fmt.Fprint(w, `{"Node":{"Name":"laptop."},"UserProfile":{"LoginName":"alice@example.com"}}`)
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+	config().Providers.Tailscale.Socket = socket
+	require.Nil(config().Providers.Tailscale.Setup())
+
+	// Should identify tailnet clients from the address traefik saw
+	req := newDefaultHttpRequest("/tailnet")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 100.64.0.1")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("alice@example.com", res.Header.Get("X-Forwarded-User"))
+
+	// Should not trust addresses provided by the client
+	req = newDefaultHttpRequest("/tailnet")
+	req.Header.Set("X-Forwarded-For", "100.64.0.1, 10.0.0.1")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+
+	// Should read the whole chain when it's split over several headers
+	req = newDefaultHttpRequest("/tailnet")
+	req.Header.Add("X-Forwarded-For", "100.64.0.1")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	req = newDefaultHttpRequest("/tailnet")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+	req.Header.Add("X-Forwarded-For", "100.64.0.1")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+
+	// Should skip the trusted proxies
+	config().TrustedIPDepth = 1
+	req = newDefaultHttpRequest("/tailnet")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 100.64.0.1, 192.168.0.1")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	req = newDefaultHttpRequest("/tailnet")
+	req.Header.Set("X-Forwarded-For", "100.64.0.1")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	config().TrustedIPDepth = 0
+
+	// Should fall back to interactive providers for other clients
+	req = newDefaultHttpRequest("/either")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+	location, _ := res.Location()
+	assert.Equal("accounts.google.com", location.Host)
+
+	// Should not allow choosing tailscale to log in with
+	req = newDefaultHttpRequest("/_oauth/login?provider=tailscale")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(400, res.StatusCode)
+}
+
+func TestServerSessionHash(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"cached": {
+			Action:      "auth",
+			Rule:        "PathPrefix(`/cached`)",
+			Provider:    "google",
+			SessionHash: "group",
+		},
+	}
+	user := newTestUser("test@example.com")
+	user.Roles = []string{"staff"}
+
+	// Should pass the hash for rules with sessionHash
+	req := newDefaultHttpRequest("/cached")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal(SessionHash(user, "group"), res.Header.Get("X-Auth-Session-Hash"))
+
+	// Should not pass the hash for other rules
+	req = newDefaultHttpRequest("/other")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("", res.Header.Get("X-Auth-Session-Hash"))
+}
+
+func TestServerGracePeriod(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"app": {
+			Action:      "auth",
+			Rule:        "Host(`example.com`)",
+			Provider:    "google",
+			GracePeriod: 5 * time.Minute,
+			GracePaths:  CommaSeparatedList{"/static/", "*.css"},
+		},
+	}
+	user := newTestUser("test@example.com")
+
+	// Should allow assets with a recently expired cookie
+	config().Lifetime = -time.Minute
+	req := newDefaultHttpRequest("/static/app.js")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "recently expired cookie should be allowed for asset paths")
+
+	req = newDefaultHttpRequest("/theme/main.css")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "recently expired cookie should be allowed for asset extensions")
+
+	// Should redirect other paths
+	req = newDefaultHttpRequest("/index.html")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "recently expired cookie should be redirected for other paths")
+
+	// Should not be escaped from the asset paths with dot segments
+	for _, uri := range []string{"/static/../secret", "/static/%2e%2e/secret", "/static/../secret/../"} {
+		req = newDefaultHttpRequest(uri)
+		res, _ = doHttpRequest(req, c)
+		assert.Equal(307, res.StatusCode, "recently expired cookie should be redirected for "+uri)
+	}
+
+	// Should redirect once the grace period has passed
+	config().Lifetime = -10 * time.Minute
+	req = newDefaultHttpRequest("/static/app.js")
+	c, _ = MakeCookie(req, user)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "cookie expired beyond the grace period should be redirected")
+}
+
 func TestServerDefaultAction(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
+	setConfig(newDefaultConfig())
 
 	req := newDefaultHttpRequest("/random")
 	res, _ := doHttpRequest(req, nil)
 	assert.Equal(307, res.StatusCode, "request should require auth with auth default handler")
 
-	config.DefaultAction = "allow"
+	config().DefaultAction = "allow"
 	req = newDefaultHttpRequest("/random")
 	res, _ = doHttpRequest(req, nil)
 	assert.Equal(200, res.StatusCode, "request should be allowed with default handler")
@@ -320,7 +776,7 @@ func TestServerDefaultAction(t *testing.T) {
 
 func TestServerDefaultProvider(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
+	setConfig(newDefaultConfig())
 
 	// Should use "google" as default provider when not specified
 	req := newDefaultHttpRequest("/random")
@@ -331,8 +787,8 @@ func TestServerDefaultProvider(t *testing.T) {
 	assert.Equal("/o/oauth2/auth", fwd.Path, "request with expired cookie should be redirected to google")
 
 	// Should use alternative default provider when set
-	config.DefaultProvider = "oidc"
-	config.Providers.OIDC.OAuthProvider.Config = &oauth2.Config{
+	config().DefaultProvider = "oidc"
+	config().Providers.OIDC.OAuthProvider.Config = &oauth2.Config{
 		Endpoint: oauth2.Endpoint{
 			AuthURL: "https://oidc.com/oidcauth",
 		},
@@ -345,10 +801,159 @@ func TestServerDefaultProvider(t *testing.T) {
 	assert.Equal("/oidcauth", fwd.Path, "request with expired cookie should be redirected to oidc")
 }
 
+func TestServerProviderChooser(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().Providers.OIDC.OAuthProvider.Config = &oauth2.Config{
+		Endpoint: oauth2.Endpoint{
+			AuthURL: "https://oidc.com/oidcauth",
+		},
+	}
+	config().Rules = map[string]*Rule{
+		"1": {
+			Action:   "auth",
+			Rule:     "PathPrefix(`/multi`)",
+			Provider: "google,oidc",
+		},
+	}
+
+	// Should ask user to choose provider
+	req := newDefaultHttpRequest("/multi/page")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "request with multiple providers should be asked to choose")
+	assert.Equal("text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(body, `href="/_oauth/login?provider=google&amp;redirect=%2Fmulti%2Fpage"`)
+	assert.Contains(body, `href="/_oauth/login?provider=oidc&amp;redirect=%2Fmulti%2Fpage"`)
+
+	// Should keep the query string
+	req = newDefaultHttpRequest("/multi/page?tab=1&q=a+b")
+	_, body = doHttpRequest(req, nil)
+	assert.Contains(body, `href="/_oauth/login?provider=google&amp;redirect=%2Fmulti%2Fpage%3Ftab%3D1%26q%3Da%2Bb"`)
+
+	// Should use remembered provider
+	req = newDefaultHttpRequest("/multi/page")
+	res, _ = doHttpRequest(req, &http.Cookie{Name: config().ProviderCookieName, Value: "oidc"})
+	require.Equal(307, res.StatusCode, "request with remembered provider should be redirected")
+	fwd, _ := res.Location()
+	assert.Equal("oidc.com", fwd.Host, "request with remembered provider should be redirected to it")
+
+	// Should ignore remembered provider not permitted by rule
+	req = newDefaultHttpRequest("/multi/page")
+	res, _ = doHttpRequest(req, &http.Cookie{Name: config().ProviderCookieName, Value: "generic-oauth"})
+	assert.Equal(401, res.StatusCode, "request with invalid remembered provider should be asked to choose")
+
+	// Should login with chosen provider and return to original path
+	req = newDefaultHttpRequest("/_oauth/login?provider=google&redirect=%2Fmulti%2Fpage")
+	res, _ = doHttpRequest(req, nil)
+	require.Equal(307, res.StatusCode, "chosen provider should be redirected to")
+	fwd, _ = res.Location()
+	assert.Equal("accounts.google.com", fwd.Host, "chosen provider should be redirected to")
+	assert.True(strings.HasSuffix(fwd.Query().Get("state"), ":google:http://example.com/multi/page"))
+
+	// Should return to the original query string
+	req = newDefaultHttpRequest("/_oauth/login?provider=google&redirect=%2Fmulti%2Fpage%3Ftab%3D1%26q%3Da%2Bb")
+	res, _ = doHttpRequest(req, nil)
+	fwd, _ = res.Location()
+	assert.True(strings.HasSuffix(fwd.Query().Get("state"), ":google:http://example.com/multi/page?tab=1&q=a+b"))
+
+	// Should not allow redirect to another host
+	req = newDefaultHttpRequest("/_oauth/login?provider=google&redirect=%2F%2Fevil.com%2F")
+	res, _ = doHttpRequest(req, nil)
+	fwd, _ = res.Location()
+	assert.True(strings.HasSuffix(fwd.Query().Get("state"), ":google:http://example.com/"))
+
+	// Should reject unknown provider
+	req = newDefaultHttpRequest("/_oauth/login?provider=bad")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(400, res.StatusCode, "unknown provider should be rejected")
+
+	// Should allow user to switch provider
+	req = newDefaultHttpRequest("/_oauth/login?switch")
+	res, body = doHttpRequest(req, &http.Cookie{Name: config().ProviderCookieName, Value: "oidc"})
+	assert.Equal(401, res.StatusCode, "switch should ignore remembered provider")
+	assert.Contains(body, "Log in with google")
+}
+
+func TestServerLoginBranding(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().LoginTitle = "Example Corp"
+	config().LoginLogo = "https://example.com/logo.png"
+	config().loginCSS = []byte("body { background: #036; }")
+	config().loginProviderLabels = map[string]string{"oidc": "Corporate SSO"}
+	config().Rules = map[string]*Rule{
+		"1": {
+			Action:   "auth",
+			Rule:     "PathPrefix(`/multi`)",
+			Provider: "google,oidc",
+		},
+	}
+
+	// Should brand the provider chooser
+	req := newDefaultHttpRequest("/multi/page")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Contains(body, "<title>Example Corp</title>")
+	assert.Contains(body, "<h1>Example Corp</h1>")
+	assert.Contains(body, `<img class="logo" src="https://example.com/logo.png" alt="">`)
+	assert.Contains(body, "body { background: #036; }")
+	assert.Contains(body, "Log in with google")
+	assert.Contains(body, "Log in with Corporate SSO")
+
+	// Should list the providers at the login path
+	req = newDefaultHttpRequest("/_oauth/login")
+	res, body = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode)
+	assert.Contains(body, "<h1>Example Corp</h1>")
+	assert.Contains(body, `href="/_oauth/login?provider=oidc&amp;redirect=%2F"`)
+
+	// Should leave out the logo unless set
+	config().LoginLogo = ""
+	req = newDefaultHttpRequest("/multi/page")
+	_, body = doHttpRequest(req, nil)
+	assert.NotContains(body, "<img")
+}
+
+func TestServerAuthCallbackRemembersProvider(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"1": {
+			Action:   "auth",
+			Rule:     "PathPrefix(`/multi`)",
+			Provider: "google,oidc",
+		},
+	}
+
+	// Setup OAuth server
+	server, serverURL := NewOAuthServer(t)
+	defer server.Close()
+	config().Providers.Google.TokenURL, _ = url.Parse(serverURL.String() + "/token")
+	config().Providers.Google.UserURL, _ = url.Parse(serverURL.String() + "/userinfo")
+
+	// Should remember provider
+	req := newDefaultHttpRequest("/_oauth?state=12345678901234567890123456789012:google:http://example.com/redirect")
+	c := MakeCSRFCookie(req, "12345678901234567890123456789012")
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode)
+
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == config().ProviderCookieName {
+			cookie = c
+		}
+	}
+	if assert.NotNil(cookie) {
+		assert.Equal("google", cookie.Value)
+		assert.True(cookie.Expires.After(time.Now().Add(time.Hour*24*300)), "provider cookie should be long lived")
+	}
+}
+
 func TestServerRouteHeaders(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
-	config.Rules = map[string]*Rule{
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
 		"1": {
 			Action: "allow",
 			Rule:   "Headers(`X-Test`, `test123`)",
@@ -378,10 +983,45 @@ func TestServerRouteHeaders(t *testing.T) {
 	assert.Equal(200, res.StatusCode, "request matching allow rule should be allowed")
 }
 
+func TestServerRouteDeny(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"health": {
+			Action: "allow",
+			Rule:   "Path(`/healthz`)",
+		},
+		"admin": {
+			Action: "deny",
+			Rule:   "PathPrefix(`/admin`)",
+		},
+	}
+
+	// Should deny matching requests, even from logged in users
+	req := newDefaultHttpRequest("/admin/users")
+	c, _ := MakeCookie(req, newTestUser("test@example.com"))
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(403, res.StatusCode, "request matching deny rule should be denied")
+
+	// Should not affect other rules
+	req = newDefaultHttpRequest("/healthz")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "request matching allow rule should be allowed")
+	req = newDefaultHttpRequest("/other")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode, "request not matching any rule should require auth")
+
+	// Should allow denied requests while report-only
+	config().reportOnlyUntil = time.Now().Add(time.Hour)
+	req = newDefaultHttpRequest("/admin/users")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode, "report-only should allow the request")
+}
+
 func TestServerRouteHost(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
-	config.Rules = map[string]*Rule{
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
 		"1": {
 			Action: "allow",
 			Rule:   "Host(`api.example.com`)",
@@ -410,8 +1050,8 @@ func TestServerRouteHost(t *testing.T) {
 
 func TestServerRouteMethod(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
-	config.Rules = map[string]*Rule{
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
 		"1": {
 			Action: "allow",
 			Rule:   "Method(`PUT`)",
@@ -431,8 +1071,8 @@ func TestServerRouteMethod(t *testing.T) {
 
 func TestServerRoutePath(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
-	config.Rules = map[string]*Rule{
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
 		"1": {
 			Action: "allow",
 			Rule:   "Path(`/api`)",
@@ -465,8 +1105,8 @@ func TestServerRoutePath(t *testing.T) {
 
 func TestServerRouteQuery(t *testing.T) {
 	assert := assert.New(t)
-	config = newDefaultConfig()
-	config.Rules = map[string]*Rule{
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
 		"1": {
 			Action: "allow",
 			Rule:   "Query(`q=test123`)",
@@ -484,6 +1124,86 @@ func TestServerRouteQuery(t *testing.T) {
 	assert.Equal(200, res.StatusCode, "request matching allow rule should be allowed")
 }
 
+func TestServerReadyHandler(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	previous := sessions
+	defer func() { sessions = previous }()
+
+	backend := newFlakySessionStore()
+	store := NewFailoverSessionStore(backend, "deny")
+	store.probeInterval = time.Hour
+	sessions = store
+	h := NewServer().ReadyHandler()
+
+	res := httptest.NewRecorder()
+	h(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(200, res.Code)
+	assert.Equal("ok\n", res.Body.String())
+
+	// Should not be ready while sessions are denied
+	backend.setDown(true)
+	store.Count()
+	res = httptest.NewRecorder()
+	h(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(503, res.Code)
+
+	// Should stay ready while sessions are served from memory
+	store.mode = "local"
+	res = httptest.NewRecorder()
+	h(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(200, res.Code)
+	assert.Equal("degraded\n", res.Body.String())
+}
+
+func TestServerReadyHandlerChecks(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	previous := sessions
+	defer func() { sessions = previous }()
+	h := NewServer().ReadyHandler()
+
+	// Should not be ready while the session store can't be reached
+	backend := newFlakySessionStore()
+	sessions = backend
+	backend.setDown(true)
+	res := httptest.NewRecorder()
+	h(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(503, res.Code)
+	assert.Equal("session store unavailable\n", res.Body.String())
+
+	// Should not need the session store with stateless cookies
+	config().StatelessCookie = true
+	res = httptest.NewRecorder()
+	h(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(200, res.Code)
+	config().StatelessCookie = false
+
+	// Should not be ready until the provider's documents have been fetched
+	backend.setDown(false)
+	config().DefaultProvider = "oidc"
+	res = httptest.NewRecorder()
+	h(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(503, res.Code)
+	assert.Equal("provider oidc not ready: discovery document hasn't been fetched\n", res.Body.String())
+
+	config().DefaultProvider = "google"
+	res = httptest.NewRecorder()
+	h(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(200, res.Code)
+	assert.Equal("ok\n", res.Body.String())
+
+	// Should ping the store rather than look up a session
+	server := newFakeRedis(t, "")
+	client, _ := NewRedisClient("redis://"+server.addr, false)
+	sessions = NewRedisSessionStore(client)
+	res = httptest.NewRecorder()
+	h(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(200, res.Code)
+	assert.Equal(1, server.commands["PING"])
+	assert.Zero(server.commands["GET"])
+}
+
 /**
  * Utilities
  */
@@ -552,16 +1272,26 @@ func doHttpRequest(r *http.Request, c *http.Cookie) (*http.Response, string) {
 	return res, string(body)
 }
 
+func newTestUser(email string) *provider.User {
+	user := &provider.User{
+		UUID:  uuid.New(),
+		Email: email,
+	}
+	ensureUser(user)
+	return user
+}
+
 func newDefaultConfig() *Config {
-	config, _ = NewConfig([]string{
+	parsed, _ := NewConfig([]string{
 		"--providers.google.client-id=id",
 		"--providers.google.client-secret=secret",
 	})
+	setConfig(parsed)
 
 	// Setup the google providers without running all the config validation
-	config.Providers.Google.Setup()
+	parsed.Providers.Google.Setup()
 
-	return config
+	return parsed
 }
 
 // TODO: replace with newHTTPRequest("GET", "http://example.com/"+uri)
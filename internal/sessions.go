@@ -0,0 +1,689 @@
+package tfa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Sessions
+
+// sessions holds the user each session cookie belongs to, shared between
+// instances when "session-store" is redis
+var sessions SessionStore = NewMemorySessionStore()
+
+// UserEntry is the user a session belongs to
+type UserEntry struct {
+	User    *provider.User
+	AddedAt time.Time
+
+	// IP and UserAgent are the client the session was created from, kept
+	// when "sessions-page" is set
+	IP        string
+	UserAgent string
+
+	// Provider and RefreshToken are kept when "renew-window" is set, so the
+	// session can be renewed before its cookie expires
+	Provider     string
+	RefreshToken string
+	RenewedAt    time.Time
+
+	// IDToken is kept when "logout-provider" is set, to end the session at
+	// the provider on logout
+	IDToken string
+
+	// LastSeenAt is recorded when rules have an "idleTimeout"
+	LastSeenAt time.Time
+}
+
+// SessionStore holds sessions until their TTL has passed
+type SessionStore interface {
+	// Get returns the session, or nil if it's unknown or has expired
+	Get(id uuid.UUID) (*UserEntry, error)
+	// Put stores the session, replacing any with the same id
+	Put(id uuid.UUID, entry *UserEntry, ttl time.Duration) error
+	// Delete removes the session
+	Delete(id uuid.UUID) error
+	// Expire resets the TTL of the session, returning false if it's unknown
+	Expire(id uuid.UUID, ttl time.Duration) (bool, error)
+	// Touch records when the session was last seen, if later than the time
+	// it has, leaving the rest of the session and its TTL as they are
+	Touch(id uuid.UUID, seen time.Time) error
+	// All returns every session, oldest first
+	All() ([]*UserEntry, error)
+	// ByEmail returns the sessions of the user with the email address,
+	// oldest first
+	ByEmail(email string) ([]*UserEntry, error)
+	// Count returns the number of sessions
+	Count() (int, error)
+	// Ping checks the store can be reached
+	Ping() error
+}
+
+// sessionTTL is how long a session is kept: the session-ttl, or as long as
+// its cookie, and any grace period a rule accepts the cookie for once it has
+// expired
+func sessionTTL() time.Duration {
+	var grace time.Duration
+	for _, rule := range config().Rules {
+		if rule.GracePeriod > grace {
+			grace = rule.GracePeriod
+		}
+		if rule.StreamGrace > grace {
+			grace = rule.StreamGrace
+		}
+	}
+	if config().SessionTTL > 0 {
+		return config().SessionTTL + grace
+	}
+	return config().Lifetime + grace
+}
+
+// keepTokens stores the provider tokens the session needs with it: the refresh
+// token to renew it and the id token to end the session at the provider
+func keepTokens(user *provider.User, providerName string, token *provider.Token) error {
+	entry := &UserEntry{User: user, AddedAt: time.Now(), Provider: providerName}
+	if renewable(providerName, token) {
+		entry.RefreshToken = token.RefreshToken
+	}
+	if config().LogoutProvider && token.IDToken != "" {
+		entry.IDToken = token.IDToken
+	}
+	if entry.RefreshToken == "" && entry.IDToken == "" {
+		return nil
+	}
+
+	if existing, err := sessions.Get(user.UUID); err != nil {
+		return err
+	} else if existing != nil {
+		entry.AddedAt = existing.AddedAt
+		entry.IP = existing.IP
+		entry.UserAgent = existing.UserAgent
+	}
+	return sessions.Put(user.UUID, entry, sessionTTL())
+}
+
+var sessionStoreEvictionsTotal = NewCounterVec("session_store_evictions_total",
+	"Sessions dropped from the memory session store to make room for new ones")
+
+// MemorySessionStore keeps sessions in memory, so they're lost on restart and
+// each instance only knows the sessions it created
+type MemorySessionStore struct {
+	sync.RWMutex
+	sessions   map[uuid.UUID]*memorySession
+	byEmail    map[string]map[uuid.UUID]bool
+	lastPurge  time.Time
+	maxEntries int
+}
+
+type memorySession struct {
+	entry   *UserEntry
+	expires time.Time
+	// email is the key of the session in the email index
+	email string
+}
+
+// NewMemorySessionStore creates an empty in memory session store
+func NewMemorySessionStore() *MemorySessionStore {
+	return newMemorySessionStore(0)
+}
+
+// newMemorySessionStore creates an empty in memory session store holding at
+// most maxEntries sessions, or any number if 0
+func newMemorySessionStore(maxEntries int) *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions:   make(map[uuid.UUID]*memorySession),
+		byEmail:    make(map[string]map[uuid.UUID]bool),
+		maxEntries: maxEntries,
+	}
+}
+
+// Get returns the session, or nil if it's unknown or has expired
+func (s *MemorySessionStore) Get(id uuid.UUID) (*UserEntry, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	session, ok := s.sessions[id]
+	if !ok || !time.Now().Before(session.expires) {
+		return nil, nil
+	}
+	return session.entry, nil
+}
+
+// Put stores the session, replacing any with the same id
+func (s *MemorySessionStore) Put(id uuid.UUID, entry *UserEntry, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.purge(now)
+	if _, ok := s.sessions[id]; !ok && s.maxEntries > 0 && len(s.sessions) >= s.maxEntries {
+		s.evict(now)
+	}
+	s.remove(id)
+	var email string
+	if entry.User != nil {
+		email = normalizeEmail(entry.User.Email)
+	}
+	s.sessions[id] = &memorySession{entry: entry, expires: now.Add(ttl), email: email}
+	if s.byEmail[email] == nil {
+		s.byEmail[email] = make(map[uuid.UUID]bool)
+	}
+	s.byEmail[email][id] = true
+	return nil
+}
+
+// Delete removes the session
+func (s *MemorySessionStore) Delete(id uuid.UUID) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.remove(id)
+	return nil
+}
+
+// Expire resets the TTL of the session, returning false if it's unknown
+func (s *MemorySessionStore) Expire(id uuid.UUID, ttl time.Duration) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || !time.Now().Before(session.expires) {
+		return false, nil
+	}
+	session.expires = time.Now().Add(ttl)
+	return true, nil
+}
+
+// Touch records when the session was last seen, leaving its TTL as it is
+func (s *MemorySessionStore) Touch(id uuid.UUID, seen time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || !session.entry.LastSeenAt.Before(seen) {
+		return nil
+	}
+	// Entries may still be held by readers, so they're replaced not changed
+	updated := *session.entry
+	updated.LastSeenAt = seen
+	session.entry = &updated
+	return nil
+}
+
+// All returns every session, oldest first
+func (s *MemorySessionStore) All() ([]*UserEntry, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	now := time.Now()
+	var entries []*UserEntry
+	for _, session := range s.sessions {
+		if now.Before(session.expires) {
+			entries = append(entries, session.entry)
+		}
+	}
+	sortSessions(entries)
+	return entries, nil
+}
+
+// ByEmail returns the sessions of the user with the email address, oldest
+// first
+func (s *MemorySessionStore) ByEmail(email string) ([]*UserEntry, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	now := time.Now()
+	var entries []*UserEntry
+	for id := range s.byEmail[normalizeEmail(email)] {
+		if session, ok := s.sessions[id]; ok && now.Before(session.expires) {
+			entries = append(entries, session.entry)
+		}
+	}
+	sortSessions(entries)
+	return entries, nil
+}
+
+// Count returns the number of sessions
+func (s *MemorySessionStore) Count() (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	now := time.Now()
+	count := 0
+	for _, session := range s.sessions {
+		if now.Before(session.expires) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Ping always succeeds, as the sessions are in memory
+func (s *MemorySessionStore) Ping() error {
+	return nil
+}
+
+// purge drops expired sessions, at most once a minute. Must be called with the
+// lock held
+func (s *MemorySessionStore) purge(now time.Time) {
+	if now.Sub(s.lastPurge) < time.Minute {
+		return
+	}
+	s.lastPurge = now
+
+	for id, session := range s.sessions {
+		if !now.Before(session.expires) {
+			s.remove(id)
+		}
+	}
+}
+
+// remove drops the session and its entry in the email index. Must be called
+// with the lock held
+func (s *MemorySessionStore) remove(id uuid.UUID) {
+	session, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+	delete(s.sessions, id)
+	delete(s.byEmail[session.email], id)
+	if len(s.byEmail[session.email]) == 0 {
+		delete(s.byEmail, session.email)
+	}
+}
+
+// evict makes room for a session once the store is full, dropping expired
+// sessions or failing that the one expiring soonest. Must be called with the
+// lock held
+func (s *MemorySessionStore) evict(now time.Time) {
+	var soonest uuid.UUID
+	var soonestExpires time.Time
+	for id, session := range s.sessions {
+		if !now.Before(session.expires) {
+			s.remove(id)
+			continue
+		}
+		if soonestExpires.IsZero() || session.expires.Before(soonestExpires) {
+			soonest, soonestExpires = id, session.expires
+		}
+	}
+
+	if len(s.sessions) >= s.maxEntries {
+		s.remove(soonest)
+		sessionStoreEvictionsTotal.Inc()
+	}
+}
+
+// RedisSessionStore keeps sessions in redis, so they survive restarts and are
+// shared between all instances
+type RedisSessionStore struct {
+	client      redis.UniversalClient
+	prefix      string
+	emailPrefix string
+}
+
+// storedSession is how a session is stored in redis and SQL, the provider user
+// omits the fields that are only kept in memory from its JSON
+type storedSession struct {
+	UUID          uuid.UUID              `json:"uuid"`
+	Email         string                 `json:"email"`
+	Name          string                 `json:"name,omitempty"`
+	Avatar        string                 `json:"avatar,omitempty"`
+	Roles         []string               `json:"roles,omitempty"`
+	SessionExpiry time.Time              `json:"session_expiry,omitempty"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+	Headers       map[string]string      `json:"headers,omitempty"`
+	AddedAt       time.Time              `json:"added_at"`
+	IP            string                 `json:"ip,omitempty"`
+	UserAgent     string                 `json:"user_agent,omitempty"`
+	Provider      string                 `json:"provider,omitempty"`
+	RefreshToken  string                 `json:"refresh_token,omitempty"`
+	RenewedAt     time.Time              `json:"renewed_at,omitempty"`
+	IDToken       string                 `json:"id_token,omitempty"`
+	LastSeenAt    time.Time              `json:"last_seen_at,omitempty"`
+}
+
+// NewRedisSessionStore creates a session store using the given client
+func NewRedisSessionStore(client redis.UniversalClient) *RedisSessionStore {
+	return &RedisSessionStore{
+		client:      client,
+		prefix:      "tfa:session:",
+		emailPrefix: "tfa:session-email:",
+	}
+}
+
+// Get returns the session, or nil if it's unknown or has expired
+func (s *RedisSessionStore) Get(id uuid.UUID) (*UserEntry, error) {
+	value, err := s.client.Get(context.Background(), s.prefix+id.String()).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeSession([]byte(value))
+}
+
+// Put stores the session, replacing any with the same id
+func (s *RedisSessionStore) Put(id uuid.UUID, entry *UserEntry, ttl time.Duration) error {
+	b, err := encodeSession(id, entry)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	index := s.emailPrefix + normalizeEmail(entry.User.Email)
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.prefix+id.String(), b, ttl)
+		pipe.SAdd(ctx, index, id.String())
+		redisExtendScript.Eval(ctx, pipe, []string{index}, ttl.Milliseconds())
+		return nil
+	})
+	return err
+}
+
+// Delete removes the session
+func (s *RedisSessionStore) Delete(id uuid.UUID) error {
+	return s.client.Del(context.Background(), s.prefix+id.String()).Err()
+}
+
+// Expire resets the TTL of the session, returning false if it's unknown
+func (s *RedisSessionStore) Expire(id uuid.UUID, ttl time.Duration) (bool, error) {
+	ctx := context.Background()
+	key := s.prefix + id.String()
+	var expired *redis.BoolCmd
+	var get *redis.StringCmd
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		expired = pipe.PExpire(ctx, key, ttl)
+		get = pipe.Get(ctx, key)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if !expired.Val() || get.Err() == redis.Nil {
+		return false, nil
+	}
+
+	// The email index has to be kept as long as the session
+	entry, err := decodeSession([]byte(get.Val()))
+	if err != nil {
+		return true, err
+	}
+	index := s.emailPrefix + normalizeEmail(entry.User.Email)
+	return true, redisExtendScript.Run(ctx, s.client, []string{index}, ttl.Milliseconds()).Err()
+}
+
+// redisExtendScript sets the TTL of a key if it's longer than the TTL it has,
+// so an email index outlives each of its sessions
+var redisExtendScript = redis.NewScript(`
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl >= 0 and ttl >= tonumber(ARGV[1]) then
+	return 0
+end
+return redis.call("PEXPIRE", KEYS[1], ARGV[1])`)
+
+// redisTouchScript replaces the session only if it's unchanged, keeping its
+// TTL, so activity isn't written over a session renewed in the meantime
+var redisTouchScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl <= 0 then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ttl)
+return 1`)
+
+// Touch records when the session was last seen, leaving its TTL as it is
+func (s *RedisSessionStore) Touch(id uuid.UUID, seen time.Time) error {
+	ctx := context.Background()
+	key := s.prefix + id.String()
+	for i := 0; i < sessionTouchAttempts; i++ {
+		current, err := s.client.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		updated, err := touchedSession(id, current, seen)
+		if err != nil || updated == "" {
+			return err
+		}
+
+		swapped, err := redisTouchScript.Run(ctx, s.client, []string{key}, current, updated).Int()
+		if err != nil || swapped == 1 {
+			return err
+		}
+	}
+	return errSessionTouchConflict
+}
+
+// All returns every session, oldest first
+func (s *RedisSessionStore) All() ([]*UserEntry, error) {
+	ctx := context.Background()
+	keys, err := scanRedisKeys(ctx, s.client, s.prefix+"*")
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	found, err := s.getSessions(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*UserEntry
+	for _, entry := range found {
+		// Skip sessions that expired in the meantime
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	sortSessions(entries)
+	return entries, nil
+}
+
+// ByEmail returns the sessions of the user with the email address, oldest
+// first. The index is a set of session ids per email, ids of sessions that
+// have since expired or been deleted are dropped from it
+func (s *RedisSessionStore) ByEmail(email string) ([]*UserEntry, error) {
+	ctx := context.Background()
+	email = normalizeEmail(email)
+	index := s.emailPrefix + email
+	ids, err := s.client.SMembers(ctx, index).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.prefix + id
+	}
+	found, err := s.getSessions(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*UserEntry
+	var stale []interface{}
+	for i, entry := range found {
+		if entry == nil || normalizeEmail(entry.User.Email) != email {
+			stale = append(stale, ids[i])
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(stale) > 0 {
+		if err := s.client.SRem(ctx, index, stale...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	sortSessions(entries)
+	return entries, nil
+}
+
+// Count returns the number of sessions
+func (s *RedisSessionStore) Count() (int, error) {
+	keys, err := scanRedisKeys(context.Background(), s.client, s.prefix+"*")
+	return len(keys), err
+}
+
+// Ping checks redis responds
+func (s *RedisSessionStore) Ping() error {
+	return s.client.Ping(context.Background()).Err()
+}
+
+// getSessions reads the sessions under the keys, with nil in place of those
+// that have expired
+func (s *RedisSessionStore) getSessions(ctx context.Context, keys []string) ([]*UserEntry, error) {
+	cmds, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	entries := make([]*UserEntry, len(keys))
+	for i, cmd := range cmds {
+		value, err := cmd.(*redis.StringCmd).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries[i], _ = decodeSession([]byte(value))
+	}
+	return entries, nil
+}
+
+// indexEmails adds the sessions to the email index, for sessions stored by
+// releases before there was one
+func (s *RedisSessionStore) indexEmails() error {
+	ctx := context.Background()
+	keys, err := scanRedisKeys(ctx, s.client, s.prefix+"*")
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	entries, err := s.getSessions(ctx, keys)
+	if err != nil {
+		return err
+	}
+	ttls, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.PTTL(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, entry := range entries {
+			// Skip sessions that expired in the meantime
+			ttl := ttls[i].(*redis.DurationCmd).Val()
+			if entry == nil || ttl <= 0 {
+				continue
+			}
+			index := s.emailPrefix + normalizeEmail(entry.User.Email)
+			pipe.SAdd(ctx, index, entry.User.UUID.String())
+			redisExtendScript.Eval(ctx, pipe, []string{index}, ttl.Milliseconds())
+		}
+		return nil
+	})
+	return err
+}
+
+// startIndexEmails adds the stored sessions to the email index in the
+// background, so starting up isn't held up by a large store
+func (s *RedisSessionStore) startIndexEmails() {
+	background.Go(func(ctx context.Context) {
+		if err := s.indexEmails(); err != nil {
+			log.WithField("error", err).Warn("Error indexing sessions by email")
+		}
+	})
+}
+
+// sessionTouchAttempts is how many times the shared stores try recording
+// activity when the session keeps being written in the meantime
+const sessionTouchAttempts = 3
+
+var errSessionTouchConflict = errors.New("session kept changing while recording activity")
+
+// touchedSession returns the stored session with the last seen time recorded,
+// or an empty string if it already has a later time
+func touchedSession(id uuid.UUID, stored string, seen time.Time) (string, error) {
+	entry, err := decodeSession([]byte(stored))
+	if err != nil || !entry.LastSeenAt.Before(seen) {
+		return "", err
+	}
+	entry.LastSeenAt = seen
+	b, err := encodeSession(id, entry)
+	return string(b), err
+}
+
+func encodeSession(id uuid.UUID, entry *UserEntry) ([]byte, error) {
+	return json.Marshal(storedSession{
+		UUID:          id,
+		Email:         entry.User.Email,
+		Name:          entry.User.Name,
+		Avatar:        entry.User.Avatar,
+		Roles:         entry.User.Roles,
+		SessionExpiry: entry.User.SessionExpiry,
+		Claims:        entry.User.Claims,
+		Headers:       entry.User.Headers,
+		AddedAt:       entry.AddedAt,
+		IP:            entry.IP,
+		UserAgent:     entry.UserAgent,
+		Provider:      entry.Provider,
+		RefreshToken:  entry.RefreshToken,
+		RenewedAt:     entry.RenewedAt,
+		IDToken:       entry.IDToken,
+		LastSeenAt:    entry.LastSeenAt,
+	})
+}
+
+func decodeSession(b []byte) (*UserEntry, error) {
+	var session storedSession
+	if err := json.Unmarshal(b, &session); err != nil {
+		return nil, err
+	}
+	return &UserEntry{
+		User: &provider.User{
+			UUID:          session.UUID,
+			Email:         session.Email,
+			Name:          session.Name,
+			Avatar:        session.Avatar,
+			Roles:         session.Roles,
+			SessionExpiry: session.SessionExpiry,
+			Claims:        session.Claims,
+			Headers:       session.Headers,
+		},
+		AddedAt:      session.AddedAt,
+		IP:           session.IP,
+		UserAgent:    session.UserAgent,
+		Provider:     session.Provider,
+		RefreshToken: session.RefreshToken,
+		RenewedAt:    session.RenewedAt,
+		IDToken:      session.IDToken,
+		LastSeenAt:   session.LastSeenAt,
+	}, nil
+}
+
+func sortSessions(entries []*UserEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].AddedAt.Before(entries[j].AddedAt)
+	})
+}
@@ -0,0 +1,384 @@
+package tfa
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestSessionsMemory(t *testing.T) {
+	assert := assert.New(t)
+	s := NewMemorySessionStore()
+	id := uuid.New()
+	entry := &UserEntry{User: &provider.User{UUID: id, Email: "test@example.com"}, AddedAt: time.Now()}
+
+	got, err := s.Get(id)
+	assert.Nil(err)
+	assert.Nil(got)
+
+	assert.Nil(s.Put(id, entry, time.Hour))
+	got, _ = s.Get(id)
+	assert.Equal(entry, got)
+	all, _ := s.All()
+	assert.Equal([]*UserEntry{entry}, all)
+	count, _ := s.Count()
+	assert.Equal(1, count)
+
+	// Should expire with the TTL
+	s.sessions[id].expires = time.Now()
+	got, _ = s.Get(id)
+	assert.Nil(got)
+	ok, _ := s.Expire(id, time.Hour)
+	assert.False(ok, "expired session should not be extended")
+	all, _ = s.All()
+	assert.Empty(all)
+	count, _ = s.Count()
+	assert.Equal(0, count)
+
+	// Should extend the TTL
+	s.Put(id, entry, time.Minute)
+	ok, _ = s.Expire(id, time.Hour)
+	assert.True(ok)
+	assert.WithinDuration(time.Now().Add(time.Hour), s.sessions[id].expires, time.Second)
+
+	// Should delete
+	assert.Nil(s.Delete(id))
+	got, _ = s.Get(id)
+	assert.Nil(got)
+
+	// Should purge expired sessions
+	s.Put(id, entry, time.Hour)
+	s.sessions[id].expires = time.Now()
+	s.lastPurge = time.Time{}
+	s.Put(uuid.New(), entry, time.Hour)
+	assert.NotContains(s.sessions, id)
+}
+
+func TestSessionsMemoryByEmail(t *testing.T) {
+	assert := assert.New(t)
+	s := NewMemorySessionStore()
+	newEntry := func(email string, added time.Time) (uuid.UUID, *UserEntry) {
+		id := uuid.New()
+		return id, &UserEntry{User: &provider.User{UUID: id, Email: email}, AddedAt: added}
+	}
+
+	first, firstEntry := newEntry("test@example.com", time.Now().Add(-time.Hour))
+	second, secondEntry := newEntry("Test@Example.com", time.Now())
+	other, otherEntry := newEntry("other@example.com", time.Now())
+	s.Put(second, secondEntry, time.Hour)
+	s.Put(first, firstEntry, time.Hour)
+	s.Put(other, otherEntry, time.Hour)
+
+	// Should only return the user's sessions, oldest first
+	mine, err := s.ByEmail("TEST@example.com")
+	assert.Nil(err)
+	assert.Equal([]*UserEntry{firstEntry, secondEntry}, mine)
+
+	// Should skip expired sessions
+	s.sessions[first].expires = time.Now()
+	mine, _ = s.ByEmail("test@example.com")
+	assert.Equal([]*UserEntry{secondEntry}, mine)
+
+	// Should follow a session to its new email
+	secondEntry = &UserEntry{User: &provider.User{UUID: second, Email: "other@example.com"}, AddedAt: time.Now()}
+	s.Put(second, secondEntry, time.Hour)
+	mine, _ = s.ByEmail("test@example.com")
+	assert.Empty(mine)
+	mine, _ = s.ByEmail("other@example.com")
+	assert.Len(mine, 2)
+
+	// Should drop deleted sessions from the index
+	s.Delete(other)
+	s.Delete(second)
+	s.Delete(first)
+	assert.Empty(s.byEmail)
+}
+
+func TestSessionsMemoryMaxEntries(t *testing.T) {
+	assert := assert.New(t)
+	s := newMemorySessionStore(2)
+	newEntry := func() (uuid.UUID, *UserEntry) {
+		id := uuid.New()
+		return id, &UserEntry{User: &provider.User{UUID: id}, AddedAt: time.Now()}
+	}
+
+	first, entry := newEntry()
+	s.Put(first, entry, time.Minute)
+	second, entry := newEntry()
+	s.Put(second, entry, time.Hour)
+
+	// Should replace sessions without evicting others
+	assert.Nil(s.Put(second, entry, time.Hour))
+	count, _ := s.Count()
+	assert.Equal(2, count)
+
+	// Should drop the session expiring soonest to make room
+	third, entry := newEntry()
+	assert.Nil(s.Put(third, entry, time.Hour))
+	assert.NotContains(s.sessions, first)
+	assert.Contains(s.sessions, second)
+	assert.Contains(s.sessions, third)
+
+	// Should drop expired sessions first
+	s.sessions[third].expires = time.Now()
+	fourth, entry := newEntry()
+	assert.Nil(s.Put(fourth, entry, time.Hour))
+	assert.NotContains(s.sessions, third)
+	assert.Contains(s.sessions, second)
+	assert.Contains(s.sessions, fourth)
+}
+
+func TestSessionsMemoryConcurrent(t *testing.T) {
+	s := newMemorySessionStore(50)
+
+	// Should be safe to use from many requests at once, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := uuid.New()
+				s.Put(id, &UserEntry{User: &provider.User{UUID: id}}, time.Hour)
+				s.Get(id)
+				s.Expire(id, time.Hour)
+				s.All()
+				s.ByEmail("test@example.com")
+				s.Count()
+				s.Delete(id)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSessionsRedis(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	server := newFakeRedis(t, "")
+	client, _ := NewRedisClient("redis://"+server.addr, false)
+	s := NewRedisSessionStore(client)
+
+	id := uuid.New()
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	entry := &UserEntry{
+		User: &provider.User{
+			UUID:          id,
+			Email:         "test@example.com",
+			Name:          "Test",
+			Roles:         []string{"admin"},
+			SessionExpiry: expiry,
+			Claims:        map[string]interface{}{"org": "acme"},
+			Headers:       map[string]string{"X-Org": "acme"},
+		},
+		AddedAt:      time.Now().Add(-time.Minute).Truncate(time.Second),
+		Provider:     "google",
+		RefreshToken: "refresh",
+		IDToken:      "id",
+		LastSeenAt:   time.Now().Truncate(time.Second),
+	}
+
+	got, err := s.Get(id)
+	assert.Nil(err)
+	assert.Nil(got)
+
+	// Should be shared with other instances
+	require.Nil(s.Put(id, entry, time.Hour))
+	got, err = NewRedisSessionStore(client).Get(id)
+	require.Nil(err)
+	require.NotNil(got)
+	assert.Equal(id, got.User.UUID)
+	assert.Equal("test@example.com", got.User.Email)
+	assert.Equal("Test", got.User.Name)
+	assert.Equal([]string{"admin"}, got.User.Roles)
+	assert.True(expiry.Equal(got.User.SessionExpiry))
+	assert.Equal(map[string]interface{}{"org": "acme"}, got.User.Claims)
+	assert.Equal(map[string]string{"X-Org": "acme"}, got.User.Headers)
+	assert.True(entry.AddedAt.Equal(got.AddedAt))
+	assert.Equal("google", got.Provider)
+	assert.Equal("refresh", got.RefreshToken)
+	assert.Equal("id", got.IDToken)
+	assert.True(entry.LastSeenAt.Equal(got.LastSeenAt))
+	assert.Contains(server.values, "tfa:session:"+id.String())
+
+	other := uuid.New()
+	s.Put(other, &UserEntry{User: &provider.User{UUID: other}, AddedAt: time.Now()}, time.Hour)
+	client.Set(context.Background(), "tfa:counter:a", "1", 0)
+	all, err := s.All()
+	require.Nil(err)
+	if assert.Len(all, 2) {
+		assert.Equal(id, all[0].User.UUID, "should list oldest first")
+		assert.Equal(other, all[1].User.UUID)
+	}
+	count, err := s.Count()
+	assert.Nil(err)
+	assert.Equal(2, count, "should only count sessions")
+	assert.Zero(server.commands["KEYS"], "should scan rather than block redis with KEYS")
+
+	// Should extend the TTL
+	ok, err := s.Expire(id, 2*time.Hour)
+	assert.Nil(err)
+	assert.True(ok)
+	assert.WithinDuration(time.Now().Add(2*time.Hour), server.expires["tfa:session:"+id.String()], time.Second)
+	ok, _ = s.Expire(uuid.New(), time.Hour)
+	assert.False(ok)
+
+	// Should record activity without extending the TTL
+	expires := server.expires["tfa:session:"+id.String()]
+	seen := time.Now().Add(time.Minute).Truncate(time.Second)
+	require.Nil(s.Touch(id, seen))
+	got, _ = s.Get(id)
+	require.NotNil(got)
+	assert.True(seen.Equal(got.LastSeenAt))
+	assert.Equal("refresh", got.RefreshToken, "should keep the rest of the session")
+	assert.Equal(expires, server.expires["tfa:session:"+id.String()])
+	require.Nil(s.Touch(id, seen.Add(-time.Hour)))
+	got, _ = s.Get(id)
+	assert.True(seen.Equal(got.LastSeenAt), "should not go back in time")
+	assert.Nil(s.Touch(uuid.New(), seen))
+	count, _ = s.Count()
+	assert.Equal(2, count, "should not create unknown sessions")
+
+	// Should expire with the TTL
+	server.expires["tfa:session:"+id.String()] = time.Now()
+	got, _ = s.Get(id)
+	assert.Nil(got)
+
+	// Should delete
+	assert.Nil(s.Delete(other))
+	got, _ = s.Get(other)
+	assert.Nil(got)
+
+	// Should ping redis
+	assert.Nil(s.Ping())
+	assert.Equal(1, server.commands["PING"])
+
+	// Should return errors when redis is unavailable
+	unavailable, _ := NewRedisClient("redis://127.0.0.1:1", false)
+	_, err = NewRedisSessionStore(unavailable).Get(id)
+	assert.Error(err)
+	assert.Error(NewRedisSessionStore(unavailable).Ping())
+}
+
+func TestSessionsRedisByEmail(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	server := newFakeRedis(t, "")
+	client, _ := NewRedisClient("redis://"+server.addr, false)
+	s := NewRedisSessionStore(client)
+	newEntry := func(email string, added time.Time) (uuid.UUID, *UserEntry) {
+		id := uuid.New()
+		return id, &UserEntry{User: &provider.User{UUID: id, Email: email}, AddedAt: added.Truncate(time.Second)}
+	}
+
+	first, entry := newEntry("test@example.com", time.Now().Add(-time.Hour))
+	require.Nil(s.Put(first, entry, time.Hour))
+	second, entry := newEntry("Test@Example.com", time.Now())
+	require.Nil(s.Put(second, entry, 2*time.Hour))
+	other, entry := newEntry("other@example.com", time.Now())
+	require.Nil(s.Put(other, entry, time.Hour))
+
+	// Should only return the user's sessions, oldest first
+	mine, err := s.ByEmail("TEST@example.com")
+	require.Nil(err)
+	if assert.Len(mine, 2) {
+		assert.Equal(first, mine[0].User.UUID)
+		assert.Equal(second, mine[1].User.UUID)
+	}
+	assert.Zero(server.commands["SCAN"], "should not go through every session")
+
+	// Should keep the index as long as the longest session
+	index := "tfa:session-email:test@example.com"
+	assert.WithinDuration(time.Now().Add(2*time.Hour), server.expires[index], time.Second)
+	s.Expire(first, 3*time.Hour)
+	assert.WithinDuration(time.Now().Add(3*time.Hour), server.expires[index], time.Second)
+	s.Expire(second, time.Minute)
+	assert.WithinDuration(time.Now().Add(3*time.Hour), server.expires[index], time.Second)
+
+	// Should drop sessions that have gone from the index
+	s.Delete(first)
+	mine, err = s.ByEmail("test@example.com")
+	require.Nil(err)
+	if assert.Len(mine, 1) {
+		assert.Equal(second, mine[0].User.UUID)
+	}
+	assert.Equal(map[string]bool{second.String(): true}, server.sets[index])
+
+	// Should index sessions stored before there was an index
+	unindexed, entry := newEntry("old@example.com", time.Now())
+	b, _ := encodeSession(unindexed, entry)
+	client.Set(context.Background(), "tfa:session:"+unindexed.String(), b, time.Minute)
+	mine, _ = s.ByEmail("old@example.com")
+	assert.Empty(mine)
+	require.Nil(s.indexEmails())
+	mine, _ = s.ByEmail("old@example.com")
+	if assert.Len(mine, 1) {
+		assert.Equal(unindexed, mine[0].User.UUID)
+	}
+	assert.WithinDuration(time.Now().Add(time.Minute), server.expires["tfa:session-email:old@example.com"], time.Second)
+
+	// Should not count the index as sessions
+	count, _ := s.Count()
+	assert.Equal(3, count)
+}
+
+func TestSessionsTTL(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Lifetime = time.Hour
+
+	assert.Equal(time.Hour, sessionTTL())
+
+	// Should keep sessions for the longest grace period
+	config().Rules = map[string]*Rule{
+		"grace":  {GracePeriod: 10 * time.Minute},
+		"stream": {StreamGrace: 30 * time.Minute},
+	}
+	assert.Equal(90*time.Minute, sessionTTL())
+
+	// Should keep sessions for the session-ttl, and expire cookies with them
+	config().SessionTTL = 20 * time.Minute
+	assert.Equal(50*time.Minute, sessionTTL())
+	assert.WithinDuration(time.Now().Add(20*time.Minute), cookieExpiry(), time.Second)
+
+	// Should keep sessions longer than the cookie lifetime
+	config().SessionTTL = 2 * time.Hour
+	assert.Equal(150*time.Minute, sessionTTL())
+	assert.WithinDuration(time.Now().Add(time.Hour), cookieExpiry(), time.Second)
+}
+
+func TestSessionsEnsureUser(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	previous := sessions
+	s := NewMemorySessionStore()
+	sessions = s
+	defer func() { sessions = previous }()
+
+	user := &provider.User{UUID: uuid.New(), Email: "test@example.com"}
+	assert.Nil(ensureUser(user))
+	first, _ := s.Get(user.UUID)
+	assert.NotNil(first)
+
+	// Should extend an existing session, keeping when it was added
+	s.sessions[user.UUID].expires = time.Now().Add(time.Minute)
+	assert.Nil(ensureUser(&provider.User{UUID: user.UUID, Email: "test@example.com"}))
+	got, _ := s.Get(user.UUID)
+	assert.Equal(first, got)
+	assert.WithinDuration(time.Now().Add(config().Lifetime), s.sessions[user.UUID].expires, time.Second)
+
+	// Should refuse users without a session id
+	assert.Error(ensureUser(&provider.User{Email: "nil@example.com"}))
+	got, _ = s.Get(uuid.Nil)
+	assert.Nil(got)
+}
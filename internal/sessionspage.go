@@ -0,0 +1,219 @@
+package tfa
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Sessions page
+//
+// With "sessions-page" set, logged in users can list their own sessions at
+// <url-path>/sessions, with the address and browser each was created from,
+// and revoke any of them, or every session but the current one. Revoking is a
+// form post carrying a token derived from the current session, so other sites
+// can't revoke sessions on the user's behalf
+
+var sessionsPageTemplate = template.Must(template.New("sessions").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Your sessions</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 4em auto; padding: 0 1em; }
+table { width: 100%; border-collapse: collapse; margin: 1em 0; }
+th, td { text-align: left; padding: 0.5em; border-bottom: 1px solid #ccc; vertical-align: top; }
+td.agent { font-size: 0.85em; color: #555; word-break: break-word; }
+form { margin: 0; }
+button { padding: 0.4em 0.8em; }
+</style>
+</head>
+<body>
+<h1>Your sessions</h1>
+<p>Signed in as {{.Email}}. Revoke any session you don't recognise, whoever is using it will have to log in again.</p>
+<table>
+<tr><th>Created</th><th>Address</th><th>Browser</th><th></th></tr>
+{{range .Sessions}}<tr>
+<td>{{.AddedAt}}</td>
+<td>{{if .IP}}{{.IP}}{{else}}unknown{{end}}</td>
+<td class="agent">{{if .UserAgent}}{{.UserAgent}}{{else}}unknown{{end}}</td>
+<td>{{if .Current}}This session{{else}}<form method="post"><input type="hidden" name="token" value="{{$.Token}}"><input type="hidden" name="id" value="{{.ID}}"><button type="submit">Revoke</button></form>{{end}}</td>
+</tr>
+{{end}}</table>
+{{if .Others}}<form method="post"><input type="hidden" name="token" value="{{.Token}}"><input type="hidden" name="id" value="others"><button type="submit">Revoke all other sessions</button></form>{{end}}
+</body>
+</html>
+`))
+
+type sessionsPage struct {
+	Email    string
+	Token    string
+	Sessions []sessionsPageRow
+	Others   bool
+}
+
+type sessionsPageRow struct {
+	ID        string
+	AddedAt   string
+	IP        string
+	UserAgent string
+	Current   bool
+}
+
+// SessionsPageHandler lists the logged in user's sessions
+func (s *Server) SessionsPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := sessionsPageUser(w, r)
+		if !ok {
+			return
+		}
+
+		entries, err := sessions.ByEmail(user.Email)
+		if err != nil {
+			log.WithField("error", err).Error("Error listing sessions")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		token, err := sessionsPageToken(user.UUID)
+		if err != nil {
+			log.WithField("error", err).Error("Error signing sessions page token")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		page := sessionsPage{Email: user.Email, Token: token}
+		for _, entry := range entries {
+			current := entry.User.UUID == user.UUID
+			page.Others = page.Others || !current
+			page.Sessions = append(page.Sessions, sessionsPageRow{
+				ID:        entry.User.UUID.String(),
+				AddedAt:   entry.AddedAt.UTC().Format(time.RFC1123),
+				IP:        entry.IP,
+				UserAgent: entry.UserAgent,
+				Current:   current,
+			})
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := sessionsPageTemplate.Execute(w, page); err != nil {
+			log.WithField("error", err).Error("Error rendering sessions page")
+		}
+	}
+}
+
+// SessionsRevokeHandler revokes one of the logged in user's sessions, or with
+// the id "others" every session but the current one
+func (s *Server) SessionsRevokeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := sessionsPageUser(w, r)
+		if !ok {
+			return
+		}
+
+		expected, err := sessionsPageToken(user.UUID)
+		if err != nil {
+			log.WithField("error", err).Error("Error signing sessions page token")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+		if !hmac.Equal([]byte(r.PostFormValue("token")), []byte(expected)) {
+			http.Error(w, "Invalid token", 403)
+			return
+		}
+
+		entries, err := sessions.ByEmail(user.Email)
+		if err != nil {
+			log.WithField("error", err).Error("Error listing sessions")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		var revoke []uuid.UUID
+		id := r.PostFormValue("id")
+		for _, entry := range entries {
+			if (id == "others" && entry.User.UUID != user.UUID) || id == entry.User.UUID.String() {
+				revoke = append(revoke, entry.User.UUID)
+			}
+		}
+		if id != "others" && len(revoke) == 0 {
+			http.Error(w, "Session not found", 404)
+			return
+		}
+
+		for _, sessionID := range revoke {
+			err := terminateSession(sessionID, "user_revoked", logrus.Fields{
+				"user":      user.Email,
+				"source_ip": originalClientIP(r),
+			})
+			if err != nil {
+				log.WithField("error", err).Error("Error revoking session")
+				http.Error(w, "Service unavailable", 503)
+				return
+			}
+			log.WithFields(logrus.Fields{
+				"user":    user.Email,
+				"session": sessionID,
+			}).Info("User revoked session")
+		}
+
+		// The current session has gone, so there's nothing left to show
+		if len(revoke) == 1 && revoke[0] == user.UUID {
+			setCookie(w, ClearCookie(r))
+			http.Error(w, "You have been logged out", 401)
+			return
+		}
+
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	}
+}
+
+// sessionsPageUser returns the logged in user, responding with 401 if there
+// isn't one
+func sessionsPageUser(w http.ResponseWriter, r *http.Request) (*provider.User, bool) {
+	c, err := r.Cookie(config().CookieName)
+	if err != nil {
+		http.Error(w, "Not authorized", 401)
+		return nil, false
+	}
+
+	user, err := ValidateCookie(r, c)
+	if err != nil {
+		log.WithField("error", err).Debug("Invalid cookie for sessions page")
+		http.Error(w, "Not authorized", 401)
+		return nil, false
+	}
+	return user, true
+}
+
+// sessionsPageToken signs the session id, so revocations can only be posted
+// from the page
+func sessionsPageToken(id uuid.UUID) (string, error) {
+	mac, err := activeSigner().MAC([]byte("sessions-page|" + id.String()))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// recordSessionClient stores the address and browser the session was created
+// from with it, for the sessions page
+func recordSessionClient(user *provider.User, r *http.Request) error {
+	entry, err := sessions.Get(user.UUID)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	updated := *entry
+	updated.IP = originalClientIP(r)
+	updated.UserAgent = r.UserAgent()
+	return sessions.Put(user.UUID, &updated, sessionTTL())
+}
@@ -0,0 +1,124 @@
+package tfa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestSessionsPage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().SessionsPage = true
+	h := NewServer().Handler()
+	cache, err := NewIdentityCache(filepath.Join(t.TempDir(), "identities.json"), config().Secret, time.Hour)
+	require.Nil(err)
+	fallbackCache = cache
+	defer func() { fallbackCache = nil }()
+
+	current := newTestUser("sessions-page@example.com")
+	laptop := newTestUser("Sessions-Page@example.com")
+	phone := newTestUser("sessions-page@example.com")
+	other := newTestUser("someone-else@example.com")
+	client := httptest.NewRequest("GET", "/", nil)
+	client.Header.Set("X-Forwarded-For", "10.6.6.6, 203.0.113.7")
+	client.Header.Set("User-Agent", "Mozilla/5.0 (Laptop)")
+	require.Nil(recordSessionClient(laptop, client))
+
+	// Should require a cookie
+	req := httptest.NewRequest("GET", "http://example.com/_oauth/sessions", nil)
+	assert.Equal(401, serveRouter(h, req).Code)
+
+	// Should list only the user's sessions
+	c, _ := MakeCookie(req, current)
+	req.AddCookie(c)
+	res := serveRouter(h, req)
+	require.Equal(200, res.Code)
+	assert.Equal("no-store", res.Header().Get("Cache-Control"))
+	body := res.Body.String()
+	assert.Contains(body, "This session")
+	assert.Contains(body, laptop.UUID.String())
+	assert.Contains(body, phone.UUID.String())
+	assert.Contains(body, "203.0.113.7")
+	assert.NotContains(body, "10.6.6.6", "should record the address traefik saw, not one the client sent")
+	assert.Contains(body, "Mozilla/5.0 (Laptop)")
+	assert.NotContains(body, other.UUID.String())
+
+	token, err := sessionsPageToken(current.UUID)
+	require.Nil(err)
+
+	// Should require the page's token to revoke
+	revoke := sessionsRevokeRequest(c, url.Values{"id": {laptop.UUID.String()}, "token": {"wrong"}})
+	assert.Equal(403, serveRouter(h, revoke).Code)
+
+	// Should revoke one of the user's sessions
+	fallbackCache.Record(laptop)
+	revoked := sessionsRevokedTotal.Value("user_revoked")
+	revoke = sessionsRevokeRequest(c, url.Values{"id": {laptop.UUID.String()}, "token": {token}})
+	res = serveRouter(h, revoke)
+	assert.Equal(303, res.Code)
+	assert.Equal("/_oauth/sessions", res.Header().Get("Location"))
+	entry, _ := sessions.Get(laptop.UUID)
+	assert.Nil(entry)
+	assert.Equal(revoked+1, sessionsRevokedTotal.Value("user_revoked"))
+
+	// Should forget the revoked session in the fallback cache
+	_, ok := fallbackCache.Lookup(laptop.UUID)
+	assert.False(ok)
+
+	// Should not revoke other users' sessions
+	revoke = sessionsRevokeRequest(c, url.Values{"id": {other.UUID.String()}, "token": {token}})
+	assert.Equal(404, serveRouter(h, revoke).Code)
+	entry, _ = sessions.Get(other.UUID)
+	assert.NotNil(entry)
+
+	// Should revoke every other session
+	revoke = sessionsRevokeRequest(c, url.Values{"id": {"others"}, "token": {token}})
+	assert.Equal(303, serveRouter(h, revoke).Code)
+	entry, _ = sessions.Get(phone.UUID)
+	assert.Nil(entry)
+	entry, _ = sessions.Get(current.UUID)
+	assert.NotNil(entry)
+
+	// Should log the user out when the current session is revoked
+	revoke = sessionsRevokeRequest(c, url.Values{"id": {current.UUID.String()}, "token": {token}})
+	res = serveRouter(h, revoke)
+	assert.Equal(401, res.Code)
+	assert.Contains(res.Header().Get("Set-Cookie"), config().CookieName+"=;")
+	entry, _ = sessions.Get(current.UUID)
+	assert.Nil(entry)
+}
+
+func TestSessionsPageDisabled(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	h := NewServer().Handler()
+
+	req := httptest.NewRequest("GET", "http://example.com/_oauth/sessions", nil)
+	c, _ := MakeCookie(req, newTestUser("sessions-page@example.com"))
+	req.AddCookie(c)
+	assert.NotEqual(200, serveRouter(h, req).Code)
+}
+
+/**
+ * Utilities
+ */
+
+func sessionsRevokeRequest(c *http.Cookie, form url.Values) *http.Request {
+	req := httptest.NewRequest("POST", "http://example.com/_oauth/sessions", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(c)
+	return req
+}
@@ -0,0 +1,221 @@
+package tfa
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Signing backends
+//
+// Cookies are signed with an HMAC and downstream JWTs with an ECDSA P-256 key.
+// By default both keys are derived from the secret, in regulated environments
+// they can instead be held in a KMS or HSM so they never exist in memory, in
+// which case every new cookie signature is a call to the backend
+
+// Signer holds the keys used to sign cookies and downstream JWTs
+type Signer interface {
+	// MAC returns the HMAC-SHA256 of data, for signing cookies
+	MAC(data []byte) ([]byte, error)
+
+	// JWTKey returns the key to sign downstream JWTs with at the given time
+	JWTKey(now time.Time) jose.SigningKey
+
+	// JWTPublicKeys returns the public keys backends should accept at the
+	// given time
+	JWTPublicKeys(now time.Time) []jose.JSONWebKey
+}
+
+// NewSigner creates the signer selected by the "signer" option
+func NewSigner(c *Config) (Signer, error) {
+	switch c.Signer {
+	case "", "secret":
+		return secretSigner{}, nil
+	case "aws-kms":
+		return newAWSKMSSigner(c.SignerCookieKey, c.SignerJWTKey)
+	case "gcp-kms":
+		return newGCPKMSSigner(c.SignerCookieKey, c.SignerJWTKey)
+	case "pkcs11":
+		return newPKCS11Signer(c.SignerPKCS11Module, c.SignerPKCS11Slot, c.SignerPKCS11PIN, c.SignerCookieKey, c.SignerJWTKey)
+	}
+	return nil, fmt.Errorf("unknown signer: %s", c.Signer)
+}
+
+// activeSigner returns the configured signer, or derives keys from the secret
+// if none has been created
+func activeSigner() Signer {
+	if config().signer != nil {
+		return config().signer
+	}
+	return secretSigner{}
+}
+
+// secretSigner derives its keys from the secret, JWT keys are rotated every
+// "jwt-key-rotation"
+type secretSigner struct{}
+
+func (secretSigner) MAC(data []byte) ([]byte, error) {
+	hash := hmac.New(sha256.New, config().Secret)
+	hash.Write(data)
+	return hash.Sum(nil), nil
+}
+
+func (secretSigner) JWTKey(now time.Time) jose.SigningKey {
+	key := getJWTKey(jwtKeyPeriod(now))
+	return jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       jose.JSONWebKey{Key: key.private, KeyID: key.id},
+	}
+}
+
+// JWTPublicKeys returns the active key, the previous key so tokens minted just
+// before a rotation remain valid, and the next key so backends caching the set
+// are ready for the next rotation
+func (secretSigner) JWTPublicKeys(now time.Time) []jose.JSONWebKey {
+	period := jwtKeyPeriod(now)
+
+	var keys []jose.JSONWebKey
+	for _, p := range []int64{period, period - 1, period + 1} {
+		key := getJWTKey(p)
+		keys = append(keys, jose.JSONWebKey{
+			Key:       &key.private.PublicKey,
+			KeyID:     key.id,
+			Algorithm: string(jose.ES256),
+			Use:       "sig",
+		})
+	}
+	return keys
+}
+
+// remoteSigner is a signer whose keys are held by a backend, keys are rotated
+// in the backend rather than by "jwt-key-rotation"
+type remoteSigner struct {
+	mac       func(data []byte) ([]byte, error)
+	jwtSigner *remoteJWTSigner
+
+	// Cookies are verified on every request, so verified signatures are
+	// remembered rather than asking the backend each time
+	macs     map[string][]byte
+	macsLock sync.Mutex
+}
+
+// maxCachedMACs bounds the signatures remembered by a remote signer, the cache
+// is emptied when it's reached
+const maxCachedMACs = 10000
+
+func (s *remoteSigner) MAC(data []byte) ([]byte, error) {
+	s.macsLock.Lock()
+	mac, ok := s.macs[string(data)]
+	s.macsLock.Unlock()
+	if ok {
+		return mac, nil
+	}
+
+	mac, err := s.mac(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.macsLock.Lock()
+	if s.macs == nil || len(s.macs) >= maxCachedMACs {
+		s.macs = make(map[string][]byte)
+	}
+	s.macs[string(data)] = mac
+	s.macsLock.Unlock()
+
+	return mac, nil
+}
+
+func (s *remoteSigner) JWTKey(now time.Time) jose.SigningKey {
+	return jose.SigningKey{Algorithm: jose.ES256, Key: s.jwtSigner}
+}
+
+func (s *remoteSigner) JWTPublicKeys(now time.Time) []jose.JSONWebKey {
+	if s.jwtSigner == nil {
+		return nil
+	}
+	return []jose.JSONWebKey{*s.jwtSigner.Public()}
+}
+
+// remoteJWTSigner signs JWTs with an ECDSA P-256 key held by a backend, it
+// implements jose.OpaqueSigner
+type remoteJWTSigner struct {
+	public *jose.JSONWebKey
+	// sign returns the r || s signature of the SHA-256 digest
+	sign func(digest []byte) ([]byte, error)
+}
+
+// newRemoteJWTSigner creates a JWT signer from the DER encoded public key of a
+// backend's key, the key ID is its RFC 7638 thumbprint
+func newRemoteJWTSigner(der []byte, sign func(digest []byte) ([]byte, error)) (*remoteJWTSigner, error) {
+	public, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	return newRemoteJWTSignerFromKey(public, sign)
+}
+
+func newRemoteJWTSignerFromKey(public crypto.PublicKey, sign func(digest []byte) ([]byte, error)) (*remoteJWTSigner, error) {
+	key, ok := public.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, errors.New("JWT key must be an ECDSA P-256 key")
+	}
+
+	jwk := &jose.JSONWebKey{Key: key, Algorithm: string(jose.ES256), Use: "sig"}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	return &remoteJWTSigner{public: jwk, sign: sign}, nil
+}
+
+func (s *remoteJWTSigner) Public() *jose.JSONWebKey {
+	return s.public
+}
+
+func (s *remoteJWTSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{jose.ES256}
+}
+
+func (s *remoteJWTSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	if alg != jose.ES256 {
+		return nil, fmt.Errorf("unsupported JWT algorithm: %s", alg)
+	}
+
+	digest := sha256.Sum256(payload)
+	return s.sign(digest[:])
+}
+
+// ecdsaDERToJWS converts a DER encoded ECDSA P-256 signature to the fixed
+// length r || s form used by JWS
+func ecdsaDERToJWS(der []byte) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(der, &sig); err != nil || len(rest) > 0 {
+		return nil, errors.New("invalid ECDSA signature")
+	}
+	if sig.R.BitLen() > 256 || sig.S.BitLen() > 256 {
+		return nil, errors.New("invalid ECDSA P-256 signature")
+	}
+
+	out := make([]byte, 64)
+	r, s := sig.R.Bytes(), sig.S.Bytes()
+	copy(out[32-len(r):32], r)
+	copy(out[64-len(s):], s)
+	return out, nil
+}
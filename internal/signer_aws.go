@@ -0,0 +1,218 @@
+package tfa
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS KMS signer
+//
+// Calls the KMS JSON API directly, credentials are read from the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables. The cookie key must be an HMAC_256 key and the JWT key an
+// ECC_NIST_P256 signing key
+
+type awsKMSClient struct {
+	endpoint string
+	region   string
+	client   *http.Client
+}
+
+func newAWSKMSSigner(cookieKey, jwtKey string) (*remoteSigner, error) {
+	if cookieKey == "" {
+		return nil, errors.New("signer-cookie-key must be set to the ID or ARN of a KMS key")
+	}
+
+	region := awsRegion(cookieKey)
+	if region == "" {
+		return nil, errors.New("unable to determine the KMS region, set AWS_REGION or use a key ARN")
+	}
+	kms := &awsKMSClient{
+		endpoint: fmt.Sprintf("https://kms.%s.amazonaws.com/", region),
+		region:   region,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+
+	return kms.signer(cookieKey, jwtKey)
+}
+
+// signer checks the keys can be used and creates the signer
+func (kms *awsKMSClient) signer(cookieKey, jwtKey string) (*remoteSigner, error) {
+	s := &remoteSigner{
+		mac: func(data []byte) ([]byte, error) {
+			var res struct{ Mac []byte }
+			err := kms.call("GenerateMac", map[string]interface{}{
+				"KeyId":        cookieKey,
+				"Message":      data,
+				"MacAlgorithm": "HMAC_SHA_256",
+			}, &res)
+			return res.Mac, err
+		},
+	}
+	if _, err := s.mac([]byte("tfa-signer-check")); err != nil {
+		return nil, fmt.Errorf("unable to use cookie key: %v", err)
+	}
+
+	if jwtKey != "" {
+		var res struct{ PublicKey []byte }
+		if err := kms.call("GetPublicKey", map[string]interface{}{"KeyId": jwtKey}, &res); err != nil {
+			return nil, fmt.Errorf("unable to get JWT public key: %v", err)
+		}
+
+		var err error
+		s.jwtSigner, err = newRemoteJWTSigner(res.PublicKey, func(digest []byte) ([]byte, error) {
+			var res struct{ Signature []byte }
+			err := kms.call("Sign", map[string]interface{}{
+				"KeyId":            jwtKey,
+				"Message":          digest,
+				"MessageType":      "DIGEST",
+				"SigningAlgorithm": "ECDSA_SHA_256",
+			}, &res)
+			if err != nil {
+				return nil, err
+			}
+			return ecdsaDERToJWS(res.Signature)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to use JWT key: %v", err)
+		}
+	}
+
+	return s, nil
+}
+
+// call makes a KMS API request, binary values are base64 encoded in both
+// directions by encoding/json
+func (kms *awsKMSClient) call(action string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", kms.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signAWSRequest(req, body, kms.region, "kms", awsCredentialsFromEnv(), time.Now())
+
+	res, err := kms.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		json.Unmarshal(b, &e)
+		return fmt.Errorf("%s failed with %d: %s %s", action, res.StatusCode, e.Type, e.Message)
+	}
+
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// awsRegion returns the region from a key ARN, or the environment
+func awsRegion(key string) string {
+	// arn:aws:kms:<region>:<account>:key/<id>
+	if parts := strings.Split(key, ":"); len(parts) >= 6 && parts[0] == "arn" {
+		return parts[3]
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+func awsCredentialsFromEnv() awsCredentials {
+	return awsCredentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// signAWSRequest adds an AWS Signature Version 4 to the request, signing the
+// host, content type and X-Amz-* headers
+func signAWSRequest(req *http.Request, body []byte, region, service string, creds awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(data))
+	return hash.Sum(nil)
+}
@@ -0,0 +1,174 @@
+package tfa
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// GCP KMS signer
+//
+// Calls the Cloud KMS REST API directly, authenticating as the instance's
+// service account via the metadata server. Keys are given as key version
+// names, i.e. projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*.
+// The cookie key must be an HMAC_SHA256 key and the JWT key an
+// EC_SIGN_P256_SHA256 key
+
+type gcpKMSClient struct {
+	endpoint    string
+	metadataURL string
+	client      *http.Client
+
+	token       string
+	tokenExpiry time.Time
+	tokenLock   sync.Mutex
+}
+
+func newGCPKMSSigner(cookieKey, jwtKey string) (*remoteSigner, error) {
+	if cookieKey == "" {
+		return nil, errors.New("signer-cookie-key must be set to the name of a KMS key version")
+	}
+
+	metadataHost := os.Getenv("GCE_METADATA_HOST")
+	if metadataHost == "" {
+		metadataHost = "metadata.google.internal"
+	}
+	kms := &gcpKMSClient{
+		endpoint:    "https://cloudkms.googleapis.com/v1/",
+		metadataURL: "http://" + metadataHost + "/computeMetadata/v1/instance/service-accounts/default/token",
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+
+	return kms.signer(cookieKey, jwtKey)
+}
+
+// signer checks the keys can be used and creates the signer
+func (kms *gcpKMSClient) signer(cookieKey, jwtKey string) (*remoteSigner, error) {
+	s := &remoteSigner{
+		mac: func(data []byte) ([]byte, error) {
+			var res struct{ Mac []byte }
+			err := kms.call("POST", cookieKey+":macSign", map[string]interface{}{"data": data}, &res)
+			return res.Mac, err
+		},
+	}
+	if _, err := s.mac([]byte("tfa-signer-check")); err != nil {
+		return nil, fmt.Errorf("unable to use cookie key: %v", err)
+	}
+
+	if jwtKey != "" {
+		var res struct{ Pem string }
+		if err := kms.call("GET", jwtKey+"/publicKey", nil, &res); err != nil {
+			return nil, fmt.Errorf("unable to get JWT public key: %v", err)
+		}
+		block, _ := pem.Decode([]byte(res.Pem))
+		if block == nil {
+			return nil, errors.New("unable to decode JWT public key")
+		}
+
+		var err error
+		s.jwtSigner, err = newRemoteJWTSigner(block.Bytes, func(digest []byte) ([]byte, error) {
+			var res struct{ Signature []byte }
+			err := kms.call("POST", jwtKey+":asymmetricSign", map[string]interface{}{
+				"digest": map[string][]byte{"sha256": digest},
+			}, &res)
+			if err != nil {
+				return nil, err
+			}
+			return ecdsaDERToJWS(res.Signature)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to use JWT key: %v", err)
+		}
+	}
+
+	return s, nil
+}
+
+// call makes a KMS API request, binary values are base64 encoded in both
+// directions by encoding/json
+func (kms *gcpKMSClient) call(method, path string, params interface{}, result interface{}) error {
+	token, err := kms.accessToken()
+	if err != nil {
+		return fmt.Errorf("unable to get access token: %v", err)
+	}
+
+	var body []byte
+	if params != nil {
+		if body, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, kms.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if params != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := kms.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		json.Unmarshal(b, &e)
+		return fmt.Errorf("%s failed with %d: %s", path, res.StatusCode, e.Error.Message)
+	}
+
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// accessToken returns the service account's access token from the metadata
+// server, it's refreshed a minute before it expires
+func (kms *gcpKMSClient) accessToken() (string, error) {
+	kms.tokenLock.Lock()
+	defer kms.tokenLock.Unlock()
+
+	if kms.token != "" && time.Now().Before(kms.tokenExpiry) {
+		return kms.token, nil
+	}
+
+	req, err := http.NewRequest("GET", kms.metadataURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	res, err := kms.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %d", res.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	kms.token = token.AccessToken
+	kms.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return kms.token, nil
+}
@@ -0,0 +1,11 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package tfa
+
+import "errors"
+
+// PKCS#11 needs cgo, so is only built with the pkcs11 tag
+func newPKCS11Signer(module string, slot uint, pin, cookieKey, jwtKey string) (*remoteSigner, error) {
+	return nil, errors.New("built without PKCS#11 support, rebuild with \"-tags pkcs11\"")
+}
@@ -0,0 +1,154 @@
+//go:build pkcs11
+// +build pkcs11
+
+package tfa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS#11 signer
+//
+// Signs with keys held in an HSM, found by their label. The cookie key must be
+// a generic secret key usable with CKM_SHA256_HMAC, and the JWT key a P-256
+// private key with a public key of the same label
+
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+
+	// Operations on a session can't be interleaved
+	lock sync.Mutex
+}
+
+func newPKCS11Signer(module string, slot uint, pin, cookieKey, jwtKey string) (*remoteSigner, error) {
+	if module == "" {
+		return nil, errors.New("signer-pkcs11-module must be set to the path of the PKCS#11 library")
+	}
+	if cookieKey == "" {
+		return nil, errors.New("signer-cookie-key must be set to the label of the HMAC key")
+	}
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("unable to load PKCS#11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, err
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open session on slot %d: %v", slot, err)
+	}
+	if pin != "" {
+		if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+			return nil, fmt.Errorf("unable to log in: %v", err)
+		}
+	}
+	p := &pkcs11Signer{ctx: ctx, session: session}
+
+	macKey, err := p.findKey(pkcs11.CKO_SECRET_KEY, cookieKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use cookie key: %v", err)
+	}
+	s := &remoteSigner{
+		mac: func(data []byte) ([]byte, error) {
+			return p.sign(pkcs11.CKM_SHA256_HMAC, macKey, data)
+		},
+	}
+	if _, err := s.mac([]byte("tfa-signer-check")); err != nil {
+		return nil, fmt.Errorf("unable to use cookie key: %v", err)
+	}
+
+	if jwtKey != "" {
+		public, err := p.publicKey(jwtKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get JWT public key: %v", err)
+		}
+		private, err := p.findKey(pkcs11.CKO_PRIVATE_KEY, jwtKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use JWT key: %v", err)
+		}
+
+		// CKM_ECDSA signs the digest, already in the r || s form
+		s.jwtSigner, err = newRemoteJWTSignerFromKey(public, func(digest []byte) ([]byte, error) {
+			return p.sign(pkcs11.CKM_ECDSA, private, digest)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to use JWT key: %v", err)
+		}
+	}
+
+	return s, nil
+}
+
+func (p *pkcs11Signer) sign(mechanism uint, key pkcs11.ObjectHandle, data []byte) ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.ctx.SignInit(p.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, key); err != nil {
+		return nil, err
+	}
+	return p.ctx.Sign(p.session, data)
+}
+
+// findKey returns the only object of the class with the label
+func (p *pkcs11Signer) findKey(class uint, label string) (pkcs11.ObjectHandle, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := p.ctx.FindObjectsInit(p.session, template); err != nil {
+		return 0, err
+	}
+	objects, _, err := p.ctx.FindObjects(p.session, 2)
+	p.ctx.FindObjectsFinal(p.session)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(objects) != 1 {
+		return 0, fmt.Errorf("expected one key labelled %q, found %d", label, len(objects))
+	}
+	return objects[0], nil
+}
+
+// publicKey reads the P-256 public key with the label
+func (p *pkcs11Signer) publicKey(label string) (*ecdsa.PublicKey, error) {
+	object, err := p.findKey(pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	attrs, err := p.ctx.GetAttributeValue(p.session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	p.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The point should be DER encoded, but some tokens return it raw
+	point := attrs[0].Value
+	var unwrapped []byte
+	if rest, err := asn1.Unmarshal(point, &unwrapped); err == nil && len(rest) == 0 {
+		point = unwrapped
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		return nil, errors.New("JWT key must be an ECDSA P-256 key")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
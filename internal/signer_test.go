@@ -0,0 +1,362 @@
+package tfa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+/**
+ * Tests
+ */
+
+func TestSignerSecret(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	mac, err := activeSigner().MAC([]byte("data"))
+	assert.Nil(err)
+	expected := hmac.New(sha256.New, config().Secret)
+	expected.Write([]byte("data"))
+	assert.Equal(expected.Sum(nil), mac)
+
+	// Should publish the active, previous and next keys
+	keys := activeSigner().JWTPublicKeys(time.Now())
+	assert.Len(keys, 3)
+	key := activeSigner().JWTKey(time.Now())
+	assert.Equal(jose.ES256, key.Algorithm)
+	assert.Equal(keys[0].KeyID, key.Key.(jose.JSONWebKey).KeyID)
+}
+
+func TestSignerRemoteMACCache(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	s := &remoteSigner{mac: func(data []byte) ([]byte, error) {
+		calls++
+		if string(data) == "fail" {
+			return nil, errors.New("unavailable")
+		}
+		return append([]byte("mac:"), data...), nil
+	}}
+
+	mac, err := s.MAC([]byte("one"))
+	assert.Nil(err)
+	assert.Equal([]byte("mac:one"), mac)
+	mac, err = s.MAC([]byte("one"))
+	assert.Nil(err)
+	assert.Equal([]byte("mac:one"), mac)
+	assert.Equal(1, calls, "signature should be remembered")
+
+	// Errors shouldn't be remembered
+	_, err = s.MAC([]byte("fail"))
+	assert.Error(err)
+	_, err = s.MAC([]byte("fail"))
+	assert.Error(err)
+	assert.Equal(3, calls)
+}
+
+func TestSignerRemoteCookies(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().signer = &remoteSigner{mac: func(data []byte) ([]byte, error) {
+		hash := hmac.New(sha256.New, []byte("held-by-the-kms"))
+		hash.Write(data)
+		return hash.Sum(nil), nil
+	}}
+	defer func() { config().signer = nil }()
+
+	r := newDefaultHttpRequest("/")
+	user := newTestUser("test@example.com")
+	c, err := MakeCookie(r, user)
+	require.Nil(t, err)
+
+	email, err := ValidateCookie(r, c)
+	assert.Nil(err)
+	assert.Equal("test@example.com", email.Email)
+
+	// Cookies signed with the secret shouldn't be valid
+	config().signer = nil
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie mac", err.Error())
+	}
+
+	// Should fail if the backend is unavailable
+	config().signer = &remoteSigner{mac: func(data []byte) ([]byte, error) {
+		return nil, errors.New("unavailable")
+	}}
+	_, err = MakeCookie(r, user)
+	assert.Error(err)
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Unable to generate mac: unavailable", err.Error())
+	}
+}
+
+func TestSignerRemoteJWT(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+	der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	require.Nil(err)
+
+	jwtSigner, err := newRemoteJWTSigner(der, func(digest []byte) ([]byte, error) {
+		r, s, err := ecdsa.Sign(rand.Reader, private, digest)
+		if err != nil {
+			return nil, err
+		}
+		sig, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+		return ecdsaDERToJWS(sig)
+	})
+	require.Nil(err)
+	config().signer = &remoteSigner{jwtSigner: jwtSigner}
+	defer func() { config().signer = nil }()
+
+	// Should publish the backend's key
+	set := JWKS()
+	require.Len(set.Keys, 1)
+	assert.Equal(&private.PublicKey, set.Keys[0].Key)
+	assert.NotEmpty(set.Keys[0].KeyID)
+
+	// Should sign with the backend's key
+	raw, err := MintJWT(newTestUser("test@example.com"), "app.example.com")
+	require.Nil(err)
+	token, err := jwt.ParseSigned(raw)
+	require.Nil(err)
+	assert.Equal(set.Keys[0].KeyID, token.Headers[0].KeyID)
+
+	var claims jwt.Claims
+	assert.Nil(token.Claims(&private.PublicKey, &claims))
+	assert.Equal("test@example.com", claims.Subject)
+
+	// Should refuse other kinds of key
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ = x509.MarshalPKIXPublicKey(&p384.PublicKey)
+	_, err = newRemoteJWTSigner(der, nil)
+	if assert.Error(err) {
+		assert.Equal("JWT key must be an ECDSA P-256 key", err.Error())
+	}
+}
+
+func TestSignerECDSADERToJWS(t *testing.T) {
+	assert := assert.New(t)
+
+	der, _ := asn1.Marshal(struct{ R, S *big.Int }{big.NewInt(1), big.NewInt(258)})
+	sig, err := ecdsaDERToJWS(der)
+	assert.Nil(err)
+	expected := make([]byte, 64)
+	expected[31] = 1
+	expected[62], expected[63] = 1, 2
+	assert.Equal(expected, sig)
+
+	_, err = ecdsaDERToJWS([]byte("invalid"))
+	assert.Error(err)
+
+	tooLong := new(big.Int).Lsh(big.NewInt(1), 256)
+	der, _ = asn1.Marshal(struct{ R, S *big.Int }{tooLong, big.NewInt(1)})
+	_, err = ecdsaDERToJWS(der)
+	assert.Error(err)
+}
+
+func TestSignerAWSRequest(t *testing.T) {
+	// Example from the AWS Signature Version 4 documentation
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	now, _ := time.Parse(time.RFC3339, "2015-08-30T12:36:00Z")
+
+	signAWSRequest(req, nil, "us-east-1", "iam", awsCredentials{
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, now)
+
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+		"SignedHeaders=content-type;host;x-amz-date, "+
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", req.Header.Get("Authorization"))
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+}
+
+func TestSignerAWSKMS(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("application/x-amz-json-1.1", r.Header.Get("Content-Type"))
+		assert.True(strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"))
+
+		var params map[string]interface{}
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &params)
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateMac":
+			if params["KeyId"] != "cookie-key" {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"__type":"NotFoundException","message":"key not found"}`))
+				return
+			}
+			assert.Equal("HMAC_SHA_256", params["MacAlgorithm"])
+			json.NewEncoder(w).Encode(map[string][]byte{"Mac": []byte("mac")})
+		case "TrentService.GetPublicKey":
+			assert.Equal("jwt-key", params["KeyId"])
+			der, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+			json.NewEncoder(w).Encode(map[string][]byte{"PublicKey": der})
+		case "TrentService.Sign":
+			assert.Equal("DIGEST", params["MessageType"])
+			var message []byte
+			json.Unmarshal(b, &struct{ Message *[]byte }{&message})
+			r, s, _ := ecdsa.Sign(rand.Reader, private, message)
+			der, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+			json.NewEncoder(w).Encode(map[string][]byte{"Signature": der})
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+	defer server.Close()
+
+	kms := &awsKMSClient{endpoint: server.URL + "/", region: "eu-west-1", client: server.Client()}
+	s, err := kms.signer("cookie-key", "jwt-key")
+	require.Nil(err)
+
+	mac, err := s.MAC([]byte("data"))
+	assert.Nil(err)
+	assert.Equal([]byte("mac"), mac)
+
+	jws, err := s.JWTKey(time.Now()).Key.(*remoteJWTSigner).SignPayload([]byte("payload"), "ES256")
+	require.Nil(err)
+	digest := sha256.Sum256([]byte("payload"))
+	assert.True(ecdsa.Verify(&private.PublicKey, digest[:], new(big.Int).SetBytes(jws[:32]), new(big.Int).SetBytes(jws[32:])))
+
+	// Should check the cookie key can be used
+	_, err = kms.signer("other-key", "")
+	if assert.Error(err) {
+		assert.Equal("unable to use cookie key: GenerateMac failed with 400: NotFoundException key not found", err.Error())
+	}
+}
+
+func TestSignerAWSRegion(t *testing.T) {
+	assert := assert.New(t)
+	os.Unsetenv("AWS_REGION")
+	os.Unsetenv("AWS_DEFAULT_REGION")
+
+	assert.Equal("eu-west-2", awsRegion("arn:aws:kms:eu-west-2:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"))
+	assert.Equal("", awsRegion("1234abcd-12ab-34cd-56ef-1234567890ab"))
+
+	os.Setenv("AWS_DEFAULT_REGION", "us-east-2")
+	defer os.Unsetenv("AWS_DEFAULT_REGION")
+	assert.Equal("us-east-2", awsRegion("1234abcd-12ab-34cd-56ef-1234567890ab"))
+
+	os.Setenv("AWS_REGION", "us-west-1")
+	defer os.Unsetenv("AWS_REGION")
+	assert.Equal("us-west-1", awsRegion("1234abcd-12ab-34cd-56ef-1234567890ab"))
+}
+
+func TestSignerGCPKMS(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+
+	const cookieKey = "projects/p/locations/global/keyRings/r/cryptoKeys/cookie/cryptoKeyVersions/1"
+	const jwtKey = "projects/p/locations/global/keyRings/r/cryptoKeys/jwt/cryptoKeyVersions/1"
+
+	tokens := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			assert.Equal("Google", r.Header.Get("Metadata-Flavor"))
+			tokens++
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+			return
+		}
+		assert.Equal("Bearer token", r.Header.Get("Authorization"))
+
+		b, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/v1/" + cookieKey + ":macSign":
+			var params struct{ Data []byte }
+			json.Unmarshal(b, &params)
+			assert.Equal([]byte("tfa-signer-check"), params.Data)
+			json.NewEncoder(w).Encode(map[string][]byte{"mac": []byte("mac")})
+		case "/v1/" + jwtKey + "/publicKey":
+			der, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+			json.NewEncoder(w).Encode(map[string]string{
+				"pem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			})
+		case "/v1/" + jwtKey + ":asymmetricSign":
+			var params struct{ Digest struct{ Sha256 []byte } }
+			json.Unmarshal(b, &params)
+			r, s, _ := ecdsa.Sign(rand.Reader, private, params.Digest.Sha256)
+			der, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+			json.NewEncoder(w).Encode(map[string][]byte{"signature": der})
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error":{"message":"not found"}}`))
+		}
+	}))
+	defer server.Close()
+
+	kms := &gcpKMSClient{endpoint: server.URL + "/v1/", metadataURL: server.URL + "/token", client: server.Client()}
+	s, err := kms.signer(cookieKey, jwtKey)
+	require.Nil(err)
+	assert.Equal(1, tokens, "access token should be reused")
+
+	jws, err := s.JWTKey(time.Now()).Key.(*remoteJWTSigner).SignPayload([]byte("payload"), "ES256")
+	require.Nil(err)
+	digest := sha256.Sum256([]byte("payload"))
+	assert.True(ecdsa.Verify(&private.PublicKey, digest[:], new(big.Int).SetBytes(jws[:32]), new(big.Int).SetBytes(jws[32:])))
+
+	// Should check the cookie key can be used
+	_, err = kms.signer("projects/p/locations/global/keyRings/r/cryptoKeys/missing/cryptoKeyVersions/1", "")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "failed with 404: not found")
+	}
+}
+
+func TestSignerNew(t *testing.T) {
+	assert := assert.New(t)
+	c := newDefaultConfig()
+
+	s, err := NewSigner(c)
+	assert.Nil(err)
+	assert.Equal(secretSigner{}, s)
+
+	c.Signer = "aws-kms"
+	_, err = NewSigner(c)
+	if assert.Error(err) {
+		assert.Equal("signer-cookie-key must be set to the ID or ARN of a KMS key", err.Error())
+	}
+
+	c.Signer = "gcp-kms"
+	_, err = NewSigner(c)
+	assert.Error(err)
+}
@@ -0,0 +1,59 @@
+package tfa
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Sliding expiry
+//
+// When "sliding-expiry" is set, a request with a valid cookie more than half
+// way through its lifetime gets a new cookie valid for another lifetime, and
+// the session is kept on the server for as long. Active users stay logged in
+// without a refresh token, while those who stop using the site are logged out
+// once the lifetime passes. With "sliding-max-lifetime" set, the session isn't
+// extended beyond that long after login, so users must log in again eventually
+
+var sessionsExtendedTotal = NewCounterVec("sessions_extended_total",
+	"Sessions whose cookie was extended by a request with sliding expiry")
+
+// slideSession returns a new cookie if the cookie is more than half way
+// through its lifetime, extended by another lifetime up to the maximum. It
+// returns nil if the cookie isn't due or can't be extended any further
+func slideSession(r *http.Request, c *http.Cookie, user *provider.User) (*http.Cookie, error) {
+	if !config().SlidingExpiry {
+		return nil, nil
+	}
+	id, expires, err := parseCookie(r, c)
+	if err != nil || time.Until(expires) > cookieLifetime()/2 {
+		return nil, err
+	}
+
+	entry, err := sessions.Get(id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	extended := time.Now().Add(cookieLifetime())
+	if config().SlidingMaxLifetime > 0 {
+		if limit := entry.AddedAt.Add(config().SlidingMaxLifetime); limit.Before(extended) {
+			extended = limit
+		}
+	}
+	if !user.SessionExpiry.IsZero() && user.SessionExpiry.Before(extended) {
+		extended = user.SessionExpiry
+	}
+	if !extended.After(expires) {
+		return nil, nil
+	}
+
+	// Keep the session as long past the new expiry as past the old one
+	if _, err := sessions.Expire(id, time.Until(extended)+sessionTTL()-cookieLifetime()); err != nil {
+		return nil, err
+	}
+	sessionsExtendedTotal.Inc()
+
+	return makeCookie(r, user, extended)
+}
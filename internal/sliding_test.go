@@ -0,0 +1,84 @@
+package tfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestSlideSession(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().Lifetime = time.Hour
+	user := newTestUser("sliding@example.com")
+	req := newDefaultHttpRequest("/foo")
+
+	// Should not extend sessions without sliding expiry
+	c, err := makeCookie(req, user, time.Now().Add(10*time.Minute))
+	require.Nil(err)
+	extended, err := slideSession(req, c, user)
+	assert.Nil(err)
+	assert.Nil(extended)
+
+	// Should not extend cookies less than half way through their lifetime
+	config().SlidingExpiry = true
+	fresh, _ := makeCookie(req, user, time.Now().Add(45*time.Minute))
+	extended, err = slideSession(req, fresh, user)
+	assert.Nil(err)
+	assert.Nil(extended)
+
+	// Should extend cookies by another lifetime
+	extended, err = slideSession(req, c, user)
+	assert.Nil(err)
+	if assert.NotNil(extended) {
+		assert.WithinDuration(time.Now().Add(time.Hour), extended.Expires, 2*time.Second)
+		extendedUser, err := ValidateCookie(req, extended)
+		assert.Nil(err)
+		assert.Equal(user.Email, extendedUser.Email)
+	}
+
+	// Should not extend sessions past the maximum lifetime
+	entry, _ := sessions.Get(user.UUID)
+	require.NotNil(entry)
+	config().SlidingMaxLifetime = 2 * time.Hour
+	entry.AddedAt = time.Now().Add(-100 * time.Minute)
+	sessions.Put(user.UUID, entry, time.Hour)
+	extended, err = slideSession(req, c, user)
+	assert.Nil(err)
+	if assert.NotNil(extended) {
+		assert.WithinDuration(entry.AddedAt.Add(2*time.Hour), extended.Expires, 2*time.Second)
+	}
+
+	entry.AddedAt = time.Now().Add(-2 * time.Hour)
+	sessions.Put(user.UUID, entry, time.Hour)
+	extended, err = slideSession(req, c, user)
+	assert.Nil(err)
+	assert.Nil(extended)
+}
+
+func TestSlideSessionAuthHandler(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Lifetime = time.Hour
+	config().SlidingExpiry = true
+	user := newTestUser("sliding-handler@example.com")
+
+	// Should allow the request and set the extended cookie
+	req := newDefaultHttpRequest("/foo")
+	c, _ := makeCookie(req, user, time.Now().Add(10*time.Minute))
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	cookies := res.Cookies()
+	if assert.Len(cookies, 2) {
+		extended := cookies[1]
+		assert.Equal(config().CookieName, extended.Name)
+		assert.NotEqual(c.Value, extended.Value)
+	}
+}
@@ -0,0 +1,366 @@
+package tfa
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// SQL drivers for the "sql-driver" option
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v4/stdlib"
+
+	"github.com/google/uuid"
+)
+
+// SQL sessions
+
+// sqlPurgeInterval is how often expired sessions are deleted from the table,
+// they are ignored by reads in the meantime
+const sqlPurgeInterval = time.Minute
+
+// sqlPingTimeout is how long the readiness check waits for the database
+const sqlPingTimeout = 3 * time.Second
+
+// sqlDrivers maps the "sql-driver" option to the database/sql driver name
+var sqlDrivers = map[string]string{
+	"postgres": "pgx",
+	"mysql":    "mysql",
+}
+
+// sqlSchemas create the sessions table and the table indexing sessions by
+// email if they don't exist. Times are stored as unix milliseconds, so they
+// compare the same in every database
+var sqlSchemas = map[string][]string{
+	"postgres": {
+		`CREATE TABLE IF NOT EXISTS tfa_sessions (
+			id VARCHAR(36) PRIMARY KEY,
+			data TEXT NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS tfa_sessions_expires_at ON tfa_sessions (expires_at)`,
+		`CREATE TABLE IF NOT EXISTS tfa_session_emails (
+			id VARCHAR(36) PRIMARY KEY,
+			email VARCHAR(320) NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS tfa_session_emails_email ON tfa_session_emails (email)`,
+	},
+	"mysql": {
+		`CREATE TABLE IF NOT EXISTS tfa_sessions (
+			id VARCHAR(36) PRIMARY KEY,
+			data MEDIUMTEXT NOT NULL,
+			expires_at BIGINT NOT NULL,
+			INDEX tfa_sessions_expires_at (expires_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS tfa_session_emails (
+			id VARCHAR(36) PRIMARY KEY,
+			email VARCHAR(320) NOT NULL,
+			INDEX tfa_session_emails_email (email)
+		)`,
+	},
+}
+
+// sqlUpserts replace the session with the same id
+var sqlUpserts = map[string]string{
+	"postgres": `INSERT INTO tfa_sessions (id, data, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, expires_at = EXCLUDED.expires_at`,
+	"mysql": `INSERT INTO tfa_sessions (id, data, expires_at) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE data = VALUES(data), expires_at = VALUES(expires_at)`,
+}
+
+// sqlEmailUpserts replace the email of the session with the same id
+var sqlEmailUpserts = map[string]string{
+	"postgres": `INSERT INTO tfa_session_emails (id, email) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET email = EXCLUDED.email`,
+	"mysql": `INSERT INTO tfa_session_emails (id, email) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE email = VALUES(email)`,
+}
+
+// SQLSessionStore keeps sessions in a PostgreSQL or MySQL table, so they
+// survive restarts and are shared between all instances
+type SQLSessionStore struct {
+	db *sql.DB
+
+	get    *sql.Stmt
+	put    *sql.Stmt
+	delete *sql.Stmt
+	expire *sql.Stmt
+	swap   *sql.Stmt
+	all    *sql.Stmt
+	count  *sql.Stmt
+	purge  *sql.Stmt
+
+	putEmail    *sql.Stmt
+	deleteEmail *sql.Stmt
+	byEmail     *sql.Stmt
+	unindexed   *sql.Stmt
+	purgeEmails *sql.Stmt
+}
+
+// OpenSQLSessionStore connects to the database with a pool of up to maxConns
+// connections
+func OpenSQLSessionStore(driver, dsn string, maxConns int) (*SQLSessionStore, error) {
+	name, ok := sqlDrivers[driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown driver %q", driver)
+	}
+	db, err := sql.Open(name, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	s, err := NewSQLSessionStore(db, driver)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSQLSessionStore creates the sessions tables if needed, prepares the
+// statements used by the store and indexes any sessions stored without an
+// email by earlier releases
+func NewSQLSessionStore(db *sql.DB, driver string) (*SQLSessionStore, error) {
+	schema, ok := sqlSchemas[driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown driver %q", driver)
+	}
+	for _, query := range schema {
+		if _, err := db.Exec(query); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &SQLSessionStore{db: db}
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.get, "SELECT data FROM tfa_sessions WHERE id = ? AND expires_at > ?"},
+		{&s.put, sqlUpserts[driver]},
+		{&s.delete, "DELETE FROM tfa_sessions WHERE id = ?"},
+		{&s.expire, "UPDATE tfa_sessions SET expires_at = ? WHERE id = ? AND expires_at > ?"},
+		{&s.swap, "UPDATE tfa_sessions SET data = ? WHERE id = ? AND data = ? AND expires_at > ?"},
+		{&s.all, "SELECT data FROM tfa_sessions WHERE expires_at > ?"},
+		{&s.count, "SELECT COUNT(*) FROM tfa_sessions WHERE expires_at > ?"},
+		{&s.purge, "DELETE FROM tfa_sessions WHERE expires_at <= ?"},
+		{&s.putEmail, sqlEmailUpserts[driver]},
+		{&s.deleteEmail, "DELETE FROM tfa_session_emails WHERE id = ?"},
+		{&s.byEmail, `SELECT s.data FROM tfa_sessions s JOIN tfa_session_emails e ON e.id = s.id
+			WHERE e.email = ? AND s.expires_at > ?`},
+		{&s.unindexed, `SELECT s.data FROM tfa_sessions s LEFT JOIN tfa_session_emails e ON e.id = s.id
+			WHERE e.id IS NULL AND s.expires_at > ?`},
+		{&s.purgeEmails, "DELETE FROM tfa_session_emails WHERE id NOT IN (SELECT id FROM tfa_sessions)"},
+	}
+	for _, st := range statements {
+		query := st.query
+		if driver == "postgres" {
+			query = sqlPositionalPlaceholders(query)
+		}
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			return nil, err
+		}
+		*st.stmt = stmt
+	}
+
+	if err := s.indexEmails(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the session, or nil if it's unknown or has expired
+func (s *SQLSessionStore) Get(id uuid.UUID) (*UserEntry, error) {
+	var data string
+	err := s.get.QueryRow(id.String(), sqlMillis(time.Now())).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeSession([]byte(data))
+}
+
+// Put stores the session, replacing any with the same id
+func (s *SQLSessionStore) Put(id uuid.UUID, entry *UserEntry, ttl time.Duration) error {
+	b, err := encodeSession(id, entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.put.Exec(id.String(), string(b), sqlMillis(time.Now().Add(ttl))); err != nil {
+		return err
+	}
+	_, err = s.putEmail.Exec(id.String(), normalizeEmail(entry.User.Email))
+	return err
+}
+
+// Delete removes the session
+func (s *SQLSessionStore) Delete(id uuid.UUID) error {
+	if _, err := s.delete.Exec(id.String()); err != nil {
+		return err
+	}
+	_, err := s.deleteEmail.Exec(id.String())
+	return err
+}
+
+// Expire resets the TTL of the session, returning false if it's unknown
+func (s *SQLSessionStore) Expire(id uuid.UUID, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := s.expire.Exec(sqlMillis(now.Add(ttl)), id.String(), sqlMillis(now))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return n > 0, err
+	}
+
+	// MySQL doesn't count rows left unchanged, as when the expiry is reset
+	// within the same millisecond
+	entry, err := s.Get(id)
+	return entry != nil, err
+}
+
+// Touch records when the session was last seen, leaving its expiry as it is.
+// The session is only replaced if it's unchanged, so activity isn't written
+// over a session renewed in the meantime
+func (s *SQLSessionStore) Touch(id uuid.UUID, seen time.Time) error {
+	for i := 0; i < sessionTouchAttempts; i++ {
+		var current string
+		err := s.get.QueryRow(id.String(), sqlMillis(time.Now())).Scan(&current)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		updated, err := touchedSession(id, current, seen)
+		if err != nil || updated == "" {
+			return err
+		}
+
+		res, err := s.swap.Exec(updated, id.String(), current, sqlMillis(time.Now()))
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+	}
+	return errSessionTouchConflict
+}
+
+// All returns every session, oldest first
+func (s *SQLSessionStore) All() ([]*UserEntry, error) {
+	return s.query(s.all, sqlMillis(time.Now()))
+}
+
+// ByEmail returns the sessions of the user with the email address, oldest
+// first
+func (s *SQLSessionStore) ByEmail(email string) ([]*UserEntry, error) {
+	return s.query(s.byEmail, normalizeEmail(email), sqlMillis(time.Now()))
+}
+
+// query returns the sessions selected by the statement, oldest first
+func (s *SQLSessionStore) query(stmt *sql.Stmt, args ...interface{}) ([]*UserEntry, error) {
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*UserEntry
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if entry, err := decodeSession([]byte(data)); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortSessions(entries)
+	return entries, nil
+}
+
+// Count returns the number of sessions
+func (s *SQLSessionStore) Count() (int, error) {
+	var count int
+	err := s.count.QueryRow(sqlMillis(time.Now())).Scan(&count)
+	return count, err
+}
+
+// Ping checks the database responds
+func (s *SQLSessionStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlPingTimeout)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+// Purge deletes expired sessions, returning how many were deleted
+func (s *SQLSessionStore) Purge() (int64, error) {
+	res, err := s.purge.Exec(sqlMillis(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.purgeEmails.Exec(); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// indexEmails adds the sessions missing from the email index to it, for
+// sessions stored by releases before there was one
+func (s *SQLSessionStore) indexEmails() error {
+	entries, err := s.query(s.unindexed, sqlMillis(time.Now()))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := s.putEmail.Exec(entry.User.UUID.String(), normalizeEmail(entry.User.Email)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startPurge deletes expired sessions in the background every interval, until
+// the background workers are stopped
+func (s *SQLSessionStore) startPurge(interval time.Duration) {
+	background.Go(func(ctx context.Context) {
+		for sleepContext(ctx, interval) {
+			if _, err := s.Purge(); err != nil {
+				log.WithField("error", err).Warn("Error deleting expired sessions")
+			}
+		}
+	})
+}
+
+// sqlPositionalPlaceholders replaces ? placeholders with the $1, $2, ... that
+// PostgreSQL expects
+func sqlPositionalPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func sqlMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
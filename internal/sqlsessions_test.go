@@ -0,0 +1,431 @@
+package tfa
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestSQLSessionsStore(t *testing.T) {
+	for _, driver := range []string{"postgres", "mysql"} {
+		t.Run(driver, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			fake := newFakeSQL(t)
+			db, _ := sql.Open("fakesql", fake.name)
+			defer db.Close()
+
+			s, err := NewSQLSessionStore(db, driver)
+			require.Nil(err)
+			assert.Len(fake.queries, len(sqlSchemas[driver])+13, "should create the table and prepare each statement once")
+
+			// Should use the driver's placeholders and upsert
+			queries := strings.Join(fake.queries, "\n")
+			if driver == "postgres" {
+				assert.Contains(queries, "SELECT data FROM tfa_sessions WHERE id = $1 AND expires_at > $2")
+				assert.Contains(queries, "ON CONFLICT (id)")
+			} else {
+				assert.Contains(queries, "SELECT data FROM tfa_sessions WHERE id = ? AND expires_at > ?")
+				assert.Contains(queries, "ON DUPLICATE KEY UPDATE")
+			}
+
+			id := uuid.New()
+			entry := &UserEntry{
+				User: &provider.User{
+					UUID:   id,
+					Email:  "test@example.com",
+					Roles:  []string{"admin"},
+					Claims: map[string]interface{}{"org": "acme"},
+				},
+				AddedAt:      time.Now().Add(-time.Minute).Truncate(time.Second),
+				Provider:     "google",
+				RefreshToken: "refresh",
+			}
+
+			got, err := s.Get(id)
+			assert.Nil(err)
+			assert.Nil(got)
+
+			// Should be shared with other instances
+			require.Nil(s.Put(id, entry, time.Hour))
+			other, err := NewSQLSessionStore(db, driver)
+			require.Nil(err)
+			got, err = other.Get(id)
+			require.Nil(err)
+			require.NotNil(got)
+			assert.Equal(id, got.User.UUID)
+			assert.Equal("test@example.com", got.User.Email)
+			assert.Equal([]string{"admin"}, got.User.Roles)
+			assert.Equal(map[string]interface{}{"org": "acme"}, got.User.Claims)
+			assert.True(entry.AddedAt.Equal(got.AddedAt))
+			assert.Equal("refresh", got.RefreshToken)
+
+			// Should replace the session
+			entry.RefreshToken = "rotated"
+			require.Nil(s.Put(id, entry, time.Hour))
+			got, _ = s.Get(id)
+			assert.Equal("rotated", got.RefreshToken)
+
+			newer := uuid.New()
+			s.Put(newer, &UserEntry{User: &provider.User{UUID: newer}, AddedAt: time.Now()}, time.Hour)
+			expired := uuid.New()
+			s.Put(expired, &UserEntry{User: &provider.User{UUID: expired}, AddedAt: time.Now()}, -time.Second)
+
+			all, err := s.All()
+			require.Nil(err)
+			if assert.Len(all, 2, "should skip expired sessions") {
+				assert.Equal(id, all[0].User.UUID, "should list oldest first")
+				assert.Equal(newer, all[1].User.UUID)
+			}
+			count, err := s.Count()
+			assert.Nil(err)
+			assert.Equal(2, count)
+			mine, err := s.ByEmail("Test@Example.com")
+			require.Nil(err)
+			if assert.Len(mine, 1, "should only return the user's sessions") {
+				assert.Equal(id, mine[0].User.UUID)
+			}
+			assert.Nil(s.Ping())
+			got, _ = s.Get(expired)
+			assert.Nil(got)
+
+			// Should extend the TTL
+			ok, err := s.Expire(id, 2*time.Hour)
+			assert.Nil(err)
+			assert.True(ok)
+			assert.WithinDuration(time.Now().Add(2*time.Hour), fake.expiry(id), time.Second)
+			ok, err = s.Expire(expired, time.Hour)
+			assert.Nil(err)
+			assert.False(ok, "should not revive expired sessions")
+
+			// Should record activity without extending the expiry
+			expires := fake.expiry(id)
+			seen := time.Now().Truncate(time.Second)
+			require.Nil(s.Touch(id, seen))
+			got, _ = s.Get(id)
+			require.NotNil(got)
+			assert.True(seen.Equal(got.LastSeenAt))
+			assert.Equal("rotated", got.RefreshToken, "should keep the rest of the session")
+			assert.Equal(expires, fake.expiry(id))
+			assert.Nil(s.Touch(expired, seen))
+			got, _ = s.Get(expired)
+			assert.Nil(got, "should not revive expired sessions")
+
+			// Should delete expired sessions
+			purged, err := s.Purge()
+			assert.Nil(err)
+			assert.Equal(int64(1), purged)
+			assert.Len(fake.rows, 2)
+			assert.NotContains(fake.emails, expired.String(), "should drop expired sessions from the index")
+
+			require.Nil(s.Delete(id))
+			got, _ = s.Get(id)
+			assert.Nil(got)
+			mine, _ = s.ByEmail("test@example.com")
+			assert.Empty(mine)
+			assert.NotContains(fake.emails, id.String())
+		})
+	}
+}
+
+func TestSQLSessionsIndexEmails(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	fake := newFakeSQL(t)
+	db, _ := sql.Open("fakesql", fake.name)
+	defer db.Close()
+
+	// Should index sessions stored before there was an index
+	id := uuid.New()
+	b, _ := encodeSession(id, &UserEntry{User: &provider.User{UUID: id, Email: "Test@Example.com"}})
+	fake.rows[id.String()] = fakeSQLRow{data: string(b), expires: sqlMillis(time.Now().Add(time.Hour))}
+	s, err := NewSQLSessionStore(db, "postgres")
+	require.Nil(err)
+	assert.Equal(map[string]string{id.String(): "test@example.com"}, fake.emails)
+	mine, err := s.ByEmail("test@example.com")
+	require.Nil(err)
+	if assert.Len(mine, 1) {
+		assert.Equal(id, mine[0].User.UUID)
+	}
+}
+
+func TestSQLSessionsExpireUnchanged(t *testing.T) {
+	assert := assert.New(t)
+	fake := newFakeSQL(t)
+	fake.foundRows = false
+	db, _ := sql.Open("fakesql", fake.name)
+	defer db.Close()
+	s, _ := NewSQLSessionStore(db, "mysql")
+
+	// Should find sessions MySQL doesn't count as changed
+	id := uuid.New()
+	s.Put(id, &UserEntry{User: &provider.User{UUID: id}}, time.Hour)
+	ok, err := s.Expire(id, time.Hour)
+	assert.Nil(err)
+	assert.True(ok)
+	ok, _ = s.Expire(uuid.New(), time.Hour)
+	assert.False(ok)
+}
+
+func TestSQLSessionsPlaceholders(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("UPDATE t SET a = $1 WHERE b = $2 AND c > $3", sqlPositionalPlaceholders("UPDATE t SET a = ? WHERE b = ? AND c > ?"))
+	assert.Equal("SELECT 1", sqlPositionalPlaceholders("SELECT 1"))
+}
+
+func TestSQLSessionsConfig(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	_, err := OpenSQLSessionStore("sqlite", "file.db", 1)
+	if assert.Error(err) {
+		assert.Equal("unknown driver \"sqlite\"", err.Error())
+	}
+
+	c, _ := NewConfig([]string{
+		"--secret=veryveryverysecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--session-store=sql",
+	})
+	assert.Equal("postgres", c.SQLDriver)
+	assert.Equal(10, c.SQLMaxConns)
+	c.Validate()
+	logs := hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("\"sql-dsn\" must be set to keep sessions in sql", logs[0].Message)
+	}
+}
+
+// fakeSQL is an in memory database/sql driver understanding just the
+// statements used by the session store
+type fakeSQL struct {
+	mu        sync.Mutex
+	name      string
+	queries   []string
+	rows      map[string]fakeSQLRow
+	emails    map[string]string
+	foundRows bool
+}
+
+type fakeSQLRow struct {
+	data    string
+	expires int64
+}
+
+var fakeSQLDatabases = struct {
+	sync.Mutex
+	dbs map[string]*fakeSQL
+}{dbs: make(map[string]*fakeSQL)}
+
+func init() {
+	sql.Register("fakesql", fakeSQLDriver{})
+}
+
+func newFakeSQL(t *testing.T) *fakeSQL {
+	fake := &fakeSQL{
+		name:      t.Name(),
+		rows:      make(map[string]fakeSQLRow),
+		emails:    make(map[string]string),
+		foundRows: true,
+	}
+	fakeSQLDatabases.Lock()
+	fakeSQLDatabases.dbs[fake.name] = fake
+	fakeSQLDatabases.Unlock()
+	return fake
+}
+
+func (f *fakeSQL) expiry(id uuid.UUID) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ms := f.rows[id.String()].expires
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+type fakeSQLDriver struct{}
+
+func (fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	fakeSQLDatabases.Lock()
+	defer fakeSQLDatabases.Unlock()
+	db, ok := fakeSQLDatabases.dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown database %q", name)
+	}
+	return &fakeSQLConn{db}, nil
+}
+
+type fakeSQLConn struct {
+	db *fakeSQL
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	query = strings.Join(strings.Fields(query), " ")
+	c.db.mu.Lock()
+	c.db.queries = append(c.db.queries, query)
+	c.db.mu.Unlock()
+	return &fakeSQLStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type fakeSQLStmt struct {
+	db    *fakeSQL
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	f := s.db
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var affected int64
+	switch {
+	case strings.HasPrefix(s.query, "CREATE"):
+	case strings.HasPrefix(s.query, "INSERT INTO tfa_sessions"):
+		f.rows[args[0].(string)] = fakeSQLRow{data: args[1].(string), expires: args[2].(int64)}
+		affected = 1
+	case strings.HasPrefix(s.query, "UPDATE tfa_sessions SET data"):
+		row, ok := f.rows[args[1].(string)]
+		if ok && row.data == args[2].(string) && row.expires > args[3].(int64) {
+			row.data = args[0].(string)
+			f.rows[args[1].(string)] = row
+			affected = 1
+		}
+	case strings.HasPrefix(s.query, "UPDATE tfa_sessions SET expires_at"):
+		row, ok := f.rows[args[1].(string)]
+		if ok && row.expires > args[2].(int64) {
+			row.expires = args[0].(int64)
+			f.rows[args[1].(string)] = row
+			// Otherwise behave as MySQL does for a row left unchanged
+			if f.foundRows {
+				affected = 1
+			}
+		}
+	case strings.HasPrefix(s.query, "DELETE FROM tfa_sessions WHERE id"):
+		if _, ok := f.rows[args[0].(string)]; ok {
+			delete(f.rows, args[0].(string))
+			affected = 1
+		}
+	case strings.HasPrefix(s.query, "DELETE FROM tfa_sessions WHERE expires_at"):
+		for id, row := range f.rows {
+			if row.expires <= args[0].(int64) {
+				delete(f.rows, id)
+				affected++
+			}
+		}
+	case strings.HasPrefix(s.query, "INSERT INTO tfa_session_emails"):
+		f.emails[args[0].(string)] = args[1].(string)
+		affected = 1
+	case strings.HasPrefix(s.query, "DELETE FROM tfa_session_emails WHERE id = ?"),
+		strings.HasPrefix(s.query, "DELETE FROM tfa_session_emails WHERE id = $1"):
+		if _, ok := f.emails[args[0].(string)]; ok {
+			delete(f.emails, args[0].(string))
+			affected = 1
+		}
+	case strings.HasPrefix(s.query, "DELETE FROM tfa_session_emails WHERE id NOT IN"):
+		for id := range f.emails {
+			if _, ok := f.rows[id]; !ok {
+				delete(f.emails, id)
+				affected++
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected exec %q", s.query)
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	f := s.db
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rows := &fakeSQLRows{}
+	switch {
+	case strings.HasPrefix(s.query, "SELECT data FROM tfa_sessions WHERE id"):
+		if row, ok := f.rows[args[0].(string)]; ok && row.expires > args[1].(int64) {
+			rows.values = append(rows.values, []driver.Value{row.data})
+		}
+	case strings.HasPrefix(s.query, "SELECT data FROM tfa_sessions WHERE expires_at"):
+		for _, id := range f.sortedIDs() {
+			if f.rows[id].expires > args[0].(int64) {
+				rows.values = append(rows.values, []driver.Value{f.rows[id].data})
+			}
+		}
+	case strings.HasPrefix(s.query, "SELECT s.data FROM tfa_sessions s JOIN"):
+		for _, id := range f.sortedIDs() {
+			if f.emails[id] == args[0].(string) && f.rows[id].expires > args[1].(int64) {
+				rows.values = append(rows.values, []driver.Value{f.rows[id].data})
+			}
+		}
+	case strings.HasPrefix(s.query, "SELECT s.data FROM tfa_sessions s LEFT JOIN"):
+		for _, id := range f.sortedIDs() {
+			if _, ok := f.emails[id]; !ok && f.rows[id].expires > args[0].(int64) {
+				rows.values = append(rows.values, []driver.Value{f.rows[id].data})
+			}
+		}
+	case strings.HasPrefix(s.query, "SELECT COUNT(*)"):
+		var count int64
+		for _, row := range f.rows {
+			if row.expires > args[0].(int64) {
+				count++
+			}
+		}
+		rows.values = append(rows.values, []driver.Value{count})
+	default:
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+	return rows, nil
+}
+
+// sortedIDs returns the ids of the sessions in order. Must be called with the
+// lock held
+func (f *fakeSQL) sortedIDs() []string {
+	var ids []string
+	for id := range f.rows {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+type fakeSQLRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return []string{"value"} }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,156 @@
+package tfa
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Stateless cookies
+//
+// With "stateless-cookie" set the auth cookie is a JWT holding the user
+// itself, rather than a signed reference to a session kept on the server, so
+// instances don't need to share a session store. The JWT is signed with
+// HS256 using the cookie key, and its audience is the cookie domain. As
+// nothing is kept on the server, sessions can't be listed or revoked and a
+// cookie is valid until it expires
+
+// statelessCookieHeader is the JOSE header of every stateless cookie
+var statelessCookieHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// maxStatelessCookieSize is the largest cookie browsers are sure to keep
+const maxStatelessCookieSize = 4096
+
+type statelessClaims struct {
+	jwt.Claims
+	Name    string                 `json:"name,omitempty"`
+	Avatar  string                 `json:"avatar,omitempty"`
+	Roles   []string               `json:"roles,omitempty"`
+	Custom  map[string]interface{} `json:"claims,omitempty"`
+	Headers map[string]string      `json:"headers,omitempty"`
+}
+
+// makeStatelessCookie encodes the user into a signed JWT expiring at the
+// given time
+func makeStatelessCookie(r *http.Request, user *provider.User, expires time.Time) (string, error) {
+	payload, err := json.Marshal(statelessClaims{
+		Claims: jwt.Claims{
+			ID:       user.UUID.String(),
+			Subject:  user.Email,
+			Audience: jwt.Audience{cookieDomain(r)},
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+			Expiry:   jwt.NewNumericDate(expires),
+		},
+		Name:    user.Name,
+		Avatar:  user.Avatar,
+		Roles:   user.Roles,
+		Custom:  user.Claims,
+		Headers: user.Headers,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	data := statelessCookieHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac, err := activeSigner().MAC([]byte(data))
+	if err != nil {
+		return "", err
+	}
+
+	value := data + "." + base64.RawURLEncoding.EncodeToString(mac)
+	if config().EncryptCookies {
+		if value, err = encryptValue("auth-cookie", []byte(value)); err != nil {
+			return "", err
+		}
+	}
+	if len(value) > maxStatelessCookieSize {
+		return "", fmt.Errorf("user is too large for a stateless cookie (%d bytes)", len(value))
+	}
+	return value, nil
+}
+
+// parseStatelessCookie verifies the cookie's signature and audience, and
+// returns the user and expiry it contains, it does not check whether the
+// cookie has expired
+func parseStatelessCookie(r *http.Request, c *http.Cookie) (*provider.User, time.Time, error) {
+	user, expires, _, err := verifyStatelessCookie(r, c)
+	return user, expires, err
+}
+
+// verifyStatelessCookie is parseStatelessCookie, also reporting whether the
+// cookie was signed or encrypted with a previous secret
+func verifyStatelessCookie(r *http.Request, c *http.Cookie) (*provider.User, time.Time, bool, error) {
+	// As with session cookies, encrypted cookies are always accepted
+	value := c.Value
+	previous := false
+	if !strings.Contains(value, ".") {
+		plaintext, rotated, err := decryptValueRotated("auth-cookie", value)
+		if err != nil {
+			return nil, time.Time{}, false, errors.New("Invalid cookie format")
+		}
+		value = string(plaintext)
+		previous = rotated
+	}
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 || parts[0] != statelessCookieHeader {
+		return nil, time.Time{}, false, errors.New("Invalid cookie format")
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, time.Time{}, false, errors.New("Unable to decode cookie mac")
+	}
+	data := []byte(parts[0] + "." + parts[1])
+	expected, err := activeSigner().MAC(data)
+	if err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("Unable to generate mac: %v", err)
+	}
+	if !hmac.Equal(mac, expected) {
+		if !signedWithPreviousSecret(mac, data) {
+			return nil, time.Time{}, false, errors.New("Invalid cookie mac")
+		}
+		previous = true
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, time.Time{}, false, errors.New("Unable to decode cookie payload")
+	}
+	var claims statelessClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("Unable to parse cookie payload: %v", err)
+	}
+
+	// Cookies are only valid on the domain they were set for
+	if !claims.Audience.Contains(cookieDomain(r)) {
+		return nil, time.Time{}, false, errors.New("Invalid cookie audience")
+	}
+	if claims.Expiry == nil {
+		return nil, time.Time{}, false, errors.New("Cookie has no expiry")
+	}
+
+	userUUID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+
+	return &provider.User{
+		UUID:    userUUID,
+		Email:   claims.Subject,
+		Name:    claims.Name,
+		Avatar:  claims.Avatar,
+		Roles:   claims.Roles,
+		Claims:  claims.Custom,
+		Headers: claims.Headers,
+	}, claims.Expiry.Time(), previous, nil
+}
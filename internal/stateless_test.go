@@ -0,0 +1,151 @@
+package tfa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestStatelessCookie(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().StatelessCookie = true
+	sessions = NewMemorySessionStore()
+	r := httptest.NewRequest("GET", "http://example.com", nil)
+
+	user := &provider.User{
+		UUID:    uuid.New(),
+		Email:   "stateless@example.com",
+		Name:    "Stateless",
+		Avatar:  "https://example.com/avatar.png",
+		Roles:   []string{"admin"},
+		Claims:  map[string]interface{}{"employee_id": "1234"},
+		Headers: map[string]string{"X-Team": "platform"},
+	}
+	require.Nil(ensureUser(user))
+
+	// Should not keep a session
+	entries, err := sessions.All()
+	require.Nil(err)
+	assert.Len(entries, 0)
+
+	// Should carry the user in the cookie
+	c, err := MakeCookie(r, user)
+	require.Nil(err)
+	assert.Len(strings.Split(c.Value, "."), 3)
+	validUser, err := ValidateCookie(r, c)
+	require.Nil(err)
+	assert.Equal(user.UUID, validUser.UUID)
+	assert.Equal("stateless@example.com", validUser.Email)
+	assert.Equal("Stateless", validUser.Name)
+	assert.Equal("https://example.com/avatar.png", validUser.Avatar)
+	assert.Equal([]string{"admin"}, validUser.Roles)
+	assert.Equal("1234", validUser.Claims["employee_id"])
+	assert.Equal("platform", validUser.Headers["X-Team"])
+
+	session, _, err := parseCookie(r, c)
+	require.Nil(err)
+	assert.Equal(user.UUID, session)
+
+	// Should catch tampering
+	parts := strings.Split(c.Value, ".")
+	tampered := &http.Cookie{Value: parts[0] + "." + parts[1] + "x." + parts[2]}
+	_, err = ValidateCookie(r, tampered)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie mac", err.Error())
+	}
+
+	// Should catch cookies for another domain
+	other := httptest.NewRequest("GET", "http://example.org", nil)
+	_, err = ValidateCookie(other, c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie audience", err.Error())
+	}
+
+	// Should catch session cookies
+	config().StatelessCookie = false
+	c, err = MakeCookie(r, user)
+	require.Nil(err)
+	config().StatelessCookie = true
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie format", err.Error())
+	}
+
+	// Should catch expired
+	config().Lifetime = -time.Second
+	c, err = MakeCookie(r, user)
+	require.Nil(err)
+	_, err = ValidateCookie(r, c)
+	if assert.Error(err) {
+		assert.Equal("Cookie has expired", err.Error())
+	}
+
+	// Should accept encrypted cookies
+	config().Lifetime = time.Hour
+	config().EncryptCookies = true
+	c, err = MakeCookie(r, user)
+	require.Nil(err)
+	assert.NotContains(c.Value, ".")
+	validUser, err = ValidateCookie(r, c)
+	require.Nil(err)
+	assert.Equal("stateless@example.com", validUser.Email)
+	config().EncryptCookies = false
+
+	// Should refuse users too large for a cookie
+	config().Lifetime = time.Hour
+	user.Claims["groups"] = strings.Repeat("group,", 1000)
+	_, err = MakeCookie(r, user)
+	assert.Error(err)
+}
+
+func TestStatelessCookieConfig(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	// Should refuse options that need sessions kept on the server
+	c, err := NewConfig([]string{
+		"--secret=veryveryverysecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--stateless-cookie",
+		"--sessions-page",
+	})
+	assert.Nil(err)
+	c.Validate()
+	logs := hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Contains(logs[0].Message, "can't be used with \"stateless-cookie\"")
+	}
+}
+
+func TestStatelessCookieServer(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().StatelessCookie = true
+	sessions = NewMemorySessionStore()
+	h := NewServer().Handler()
+
+	// Should authenticate without a session on the server
+	req := newDefaultHttpRequest("/foo")
+	c, _ := MakeCookie(req, &provider.User{UUID: uuid.New(), Email: "stateless@example.com"})
+	req.AddCookie(c)
+	res := serveRouter(h, req)
+	assert.Equal(200, res.Code)
+	assert.Equal("stateless@example.com", res.Header().Get("X-Forwarded-User"))
+}
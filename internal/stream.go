@@ -0,0 +1,43 @@
+package tfa
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Streaming requests
+//
+// Traefik asks for a decision once per request, so an established WebSocket,
+// gRPC stream or server-sent event stream is never cut off. Long polls and
+// streams that reconnect do come back for a new decision though, and can't
+// follow a redirect to log in. Rules with "streamGrace" set accept an expired
+// cookie from these requests for a while, and refuse them with a 401 rather
+// than a redirect once it has passed
+
+// isStreamRequest reports whether the request opens a stream or long poll,
+// either by its protocol or because it matches one of the rule's streamPaths
+func isStreamRequest(r *http.Request, rule *Rule) bool {
+	// Upgrade is a hop-by-hop header that traefik doesn't forward, the
+	// handshake key identifies WebSockets instead
+	if r.Header.Get("Sec-Websocket-Key") != "" {
+		return true
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return true
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		return true
+	}
+	return matchGracePath(r.URL.Path, rule.StreamPaths)
+}
+
+// streamGrace returns how long after expiry the rule accepts a cookie for the
+// request, if it's a streaming request
+func streamGrace(r *http.Request, ruleName string) (time.Duration, bool) {
+	rule, ok := config().Rules[ruleName]
+	if !ok || rule.StreamGrace <= 0 || !isStreamRequest(r, rule) {
+		return 0, false
+	}
+	return rule.StreamGrace, true
+}
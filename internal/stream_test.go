@@ -0,0 +1,79 @@
+package tfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestIsStreamRequest(t *testing.T) {
+	assert := assert.New(t)
+	rule := &Rule{StreamPaths: CommaSeparatedList{"/poll/"}}
+
+	req := newDefaultHttpRequest("/index.html")
+	assert.False(isStreamRequest(req, rule))
+
+	req = newDefaultHttpRequest("/ws")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	assert.True(isStreamRequest(req, rule), "websockets should be streams")
+
+	req = newDefaultHttpRequest("/events")
+	req.Header.Set("Accept", "text/event-stream")
+	assert.True(isStreamRequest(req, rule), "server-sent events should be streams")
+
+	req = newHTTPRequest("POST", "http://example.com/chat.Chat/Subscribe")
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	assert.True(isStreamRequest(req, rule), "grpc should be streams")
+
+	req = newDefaultHttpRequest("/poll/messages")
+	assert.True(isStreamRequest(req, rule), "streamPaths should be streams")
+}
+
+func TestServerStreamGrace(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"chat": {
+			Action:      "auth",
+			Rule:        "Host(`example.com`)",
+			Provider:    "google",
+			StreamGrace: 10 * time.Minute,
+			StreamPaths: CommaSeparatedList{"/poll/"},
+		},
+	}
+	user := newTestUser("test@example.com")
+
+	// Should allow streams to reconnect with a recently expired cookie
+	config().Lifetime = -time.Minute
+	req := newDefaultHttpRequest("/poll/messages")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "recently expired cookie should be allowed for streams")
+
+	req = newDefaultHttpRequest("/events")
+	req.Header.Set("Accept", "text/event-stream")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode, "recently expired cookie should be allowed for streams")
+
+	// Should redirect other requests
+	req = newDefaultHttpRequest("/index.html")
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(307, res.StatusCode, "recently expired cookie should be redirected for other requests")
+
+	// Should refuse streams once the grace has passed, rather than redirect
+	config().Lifetime = -time.Hour
+	req = newDefaultHttpRequest("/poll/messages")
+	c, _ = MakeCookie(req, user)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode, "streams should be refused once the grace has passed")
+
+	// Should refuse streams without a cookie, rather than redirect
+	req = newDefaultHttpRequest("/poll/messages")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(401, res.StatusCode, "streams should be refused without a cookie")
+}
@@ -0,0 +1,142 @@
+package tfa
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Lost submissions
+//
+// When "lost-submission-header" is set, an unsafe request refused for want of
+// a session is recorded (method, target and a hash of a small body) in an
+// encrypted cookie. Once the user has logged in again, the first request they
+// make is passed to the backend with the header describing the submission, so
+// the app can warn the user it was lost
+
+// maxSubmissionBody is the largest request body that is hashed
+const maxSubmissionBody = 64 * 1024
+
+// submissionLifetime is how long a lost submission is remembered, as long as
+// the login it prompted may take
+const submissionLifetime = time.Hour
+
+type lostSubmission struct {
+	Method  string `json:"m"`
+	Target  string `json:"t"`
+	Hash    string `json:"h,omitempty"`
+	Expires int64  `json:"e"`
+}
+
+// newLostSubmission records the request, the body is only hashed if it's no
+// larger than maxSubmissionBody
+func newLostSubmission(r *http.Request) *lostSubmission {
+	s := &lostSubmission{
+		Method:  r.Method,
+		Target:  r.URL.RequestURI(),
+		Expires: time.Now().Add(submissionLifetime).Unix(),
+	}
+
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSubmissionBody+1))
+		if err == nil && len(body) > 0 && len(body) <= maxSubmissionBody {
+			hash := sha256.Sum256(body)
+			s.Hash = hex.EncodeToString(hash[:])
+		}
+	}
+
+	return s
+}
+
+// header describes the submission for the backend
+func (s *lostSubmission) header() string {
+	v := url.Values{}
+	v.Set("method", s.Method)
+	v.Set("target", s.Target)
+	if s.Hash != "" {
+		v.Set("sha256", s.Hash)
+	}
+	v.Set("submitted", strconv.FormatInt(s.Expires-int64(submissionLifetime/time.Second), 10))
+	return v.Encode()
+}
+
+func submissionCookieName() string {
+	return config().CookieName + "_submission"
+}
+
+// MakeSubmissionCookie creates a cookie holding the encrypted submission
+func MakeSubmissionCookie(r *http.Request, s *lostSubmission) (*http.Cookie, error) {
+	value, err := encryptSubmission(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Cookie{
+		Name:     submissionCookieName(),
+		Value:    value,
+		Path:     "/",
+		Domain:   cookieDomain(r),
+		HttpOnly: true,
+		Secure:   !config().InsecureCookie,
+		SameSite: cookieSameSite(),
+		Expires:  time.Unix(s.Expires, 0),
+	}, nil
+}
+
+// ClearSubmissionCookie makes an expired submission cookie
+func ClearSubmissionCookie(r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     submissionCookieName(),
+		Value:    "",
+		Path:     "/",
+		Domain:   cookieDomain(r),
+		HttpOnly: true,
+		Secure:   !config().InsecureCookie,
+		SameSite: cookieSameSite(),
+		Expires:  time.Now().Local().Add(time.Hour * -1),
+	}
+}
+
+// signalLostSubmission passes the lost submission, if any, to the backend and
+// clears it so it's only signalled once
+func signalLostSubmission(w http.ResponseWriter, r *http.Request) {
+	if config().LostSubmissionHeader == "" {
+		return
+	}
+	c, err := r.Cookie(submissionCookieName())
+	if err != nil {
+		return
+	}
+
+	setCookie(w, ClearSubmissionCookie(r))
+	if s, err := decryptSubmission(c.Value); err == nil && time.Now().Unix() < s.Expires {
+		w.Header().Set(config().LostSubmissionHeader, s.header())
+	}
+}
+
+func encryptSubmission(s *lostSubmission) (string, error) {
+	plaintext, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return encryptValue("lost-submission", plaintext)
+}
+
+func decryptSubmission(value string) (*lostSubmission, error) {
+	plaintext, err := decryptValue("lost-submission", value)
+	if err != nil {
+		return nil, err
+	}
+
+	var s lostSubmission
+	if err := json.Unmarshal(plaintext, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
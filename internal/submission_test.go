@@ -0,0 +1,110 @@
+package tfa
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestLostSubmission(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	config().LostSubmissionHeader = "X-Lost-Submission"
+
+	// Should record the refused submission in a cookie
+	req := newHTTPRequest("POST", "http://example.com/form/submit?id=1")
+	req.Body = ioutil.NopCloser(strings.NewReader("name=value"))
+	res, _ := doHttpRequest(req, nil)
+	require.Equal(401, res.StatusCode)
+
+	var submission *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == "_forward_auth_submission" {
+			submission = c
+		}
+	}
+	require.NotNil(submission)
+	assert.NotContains(submission.Value, "form", "submission should be encrypted")
+
+	// Should signal the submission once the user has logged in
+	user := newTestUser("example@example.com")
+	req = newHTTPRequest("GET", "http://example.com/form")
+	c, _ := MakeCookie(req, user)
+	req.AddCookie(submission)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+
+	header, err := url.ParseQuery(res.Header.Get("X-Lost-Submission"))
+	require.Nil(err)
+	assert.Equal("POST", header.Get("method"))
+	assert.Equal("/form/submit?id=1", header.Get("target"))
+	hash := sha256.Sum256([]byte("name=value"))
+	assert.Equal(hex.EncodeToString(hash[:]), header.Get("sha256"))
+	assert.NotEmpty(header.Get("submitted"))
+
+	cleared := false
+	for _, c := range res.Cookies() {
+		if c.Name == "_forward_auth_submission" && c.Value == "" {
+			cleared = true
+		}
+	}
+	assert.True(cleared, "submission should only be signalled once")
+}
+
+func TestLostSubmissionCookie(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().LostSubmissionHeader = "X-Lost-Submission"
+	user := newTestUser("example@example.com")
+
+	signal := func(value string) string {
+		req := newHTTPRequest("GET", "http://example.com/form")
+		req.AddCookie(&http.Cookie{Name: "_forward_auth_submission", Value: value})
+		c, _ := MakeCookie(req, user)
+		res, _ := doHttpRequest(req, c)
+		return res.Header.Get("X-Lost-Submission")
+	}
+
+	// Should ignore tampered submissions
+	value, err := encryptSubmission(&lostSubmission{
+		Method:  "POST",
+		Target:  "/form",
+		Expires: time.Now().Add(time.Hour).Unix(),
+	})
+	assert.Nil(err)
+	assert.NotEqual("", signal(value))
+	tampered := []byte(value)
+	tampered[len(tampered)/2] ^= 1
+	assert.Equal("", signal(string(tampered)))
+	assert.Equal("", signal("invalid"))
+
+	// Should ignore expired submissions
+	value, _ = encryptSubmission(&lostSubmission{
+		Method:  "POST",
+		Target:  "/form",
+		Expires: time.Now().Add(-time.Minute).Unix(),
+	})
+	assert.Equal("", signal(value))
+
+	// Should not signal when disabled
+	value, _ = encryptSubmission(&lostSubmission{
+		Method:  "POST",
+		Target:  "/form",
+		Expires: time.Now().Add(time.Hour).Unix(),
+	})
+	config().LostSubmissionHeader = ""
+	assert.Equal("", signal(value))
+}
@@ -0,0 +1,87 @@
+package tfa
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Systemd integration
+//
+// When run by systemd as a Type=notify service, readiness and shutdown are
+// reported on the socket in $NOTIFY_SOCKET, and when WatchdogSec is set the
+// watchdog is pinged so systemd can restart a hung process
+
+// NotifyReady tells systemd the service is ready to accept requests
+func NotifyReady(status string) error {
+	return notifySystemd("READY=1\nSTATUS=" + status)
+}
+
+// NotifyStopping tells systemd the service is shutting down
+func NotifyStopping() error {
+	return notifySystemd("STOPPING=1")
+}
+
+// StartWatchdog pings the systemd watchdog at half the configured interval
+// until stop is closed, if the watchdog is enabled for this process
+func StartWatchdog(stop <-chan struct{}) {
+	interval, ok := watchdogInterval()
+	if !ok {
+		return
+	}
+
+	log.WithField("interval", interval.String()).Debug("Pinging systemd watchdog")
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := notifySystemd("WATCHDOG=1"); err != nil {
+					log.WithField("error", err).Warn("Error pinging systemd watchdog")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// watchdogInterval returns the watchdog interval systemd expects pings within
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+
+	// The watchdog may be meant for another process, e.g. a wrapper script
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// notifySystemd sends the state to systemd, it does nothing if the service
+// isn't run by systemd with notify access
+func notifySystemd(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Sockets starting with @ are in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
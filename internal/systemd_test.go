@@ -0,0 +1,90 @@
+package tfa
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestSystemdNotify(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Should do nothing when not run by systemd
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.Nil(NotifyReady("Listening on :4181"))
+
+	// Should send the state to the notify socket
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.Nil(err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	read := func() string {
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		require.Nil(err)
+		return string(buf[:n])
+	}
+
+	require.Nil(NotifyReady("Listening on :4181"))
+	assert.Equal("READY=1\nSTATUS=Listening on :4181", read())
+
+	require.Nil(NotifyStopping())
+	assert.Equal("STOPPING=1", read())
+
+	// Should ping the watchdog
+	os.Setenv("WATCHDOG_USEC", "20000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	stop := make(chan struct{})
+	StartWatchdog(stop)
+	assert.Equal("WATCHDOG=1", read())
+	close(stop)
+}
+
+func TestSystemdWatchdogInterval(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	// Should be disabled by default
+	os.Unsetenv("WATCHDOG_USEC")
+	_, ok := watchdogInterval()
+	assert.False(ok)
+
+	// Should use the interval
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	interval, ok := watchdogInterval()
+	assert.True(ok)
+	assert.Equal(30*time.Second, interval)
+
+	// Should apply to this process
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	_, ok = watchdogInterval()
+	assert.True(ok)
+
+	// Should ignore the watchdog for other processes
+	os.Setenv("WATCHDOG_PID", "1")
+	_, ok = watchdogInterval()
+	assert.False(ok)
+
+	// Should ignore invalid intervals
+	os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "invalid")
+	_, ok = watchdogInterval()
+	assert.False(ok)
+}
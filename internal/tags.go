@@ -0,0 +1,239 @@
+package tfa
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// User tags
+//
+// Operators can attach tags and a note to users with the admin API, e.g. the
+// tag "contractor" and the note "contract ends 2025-09-01", along with an
+// optional time after which the user is no longer permitted. Tags are kept in
+// the "user-tags" file, keyed by normalized email, and are looked up on every
+// request so changes apply at once: rules permit users with one of their
+// "allowedTags" and refuse those with one of their "blockedTags", and audit
+// events about a user carry their tags. Like the user directory, changes made
+// by other instances are picked up within userTagsReloadInterval
+
+// userTags is set when "user-tags" is configured
+var userTags *TagStore
+
+// userTagsReloadInterval is how often the tags file is checked for changes
+// made by another instance
+const userTagsReloadInterval = 10 * time.Second
+
+// TagStore is a persistent table of the tags and notes attached to users
+type TagStore struct {
+	mu        sync.Mutex
+	path      string
+	users     map[string]*UserTags
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// UserTags are the tags and note attached to a user
+type UserTags struct {
+	Tags      []string   `json:"tags"`
+	Note      string     `json:"note,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+}
+
+// Expired reports whether the user's expiry has passed
+func (t *UserTags) Expired() bool {
+	return t.Expires != nil && time.Now().After(*t.Expires)
+}
+
+// TaggedUser is a user with their tags, as listed by the admin API
+type TaggedUser struct {
+	Email string `json:"email"`
+	UserTags
+}
+
+type userTagsFile struct {
+	SchemaVersion int                  `json:"schema_version"`
+	Users         map[string]*UserTags `json:"users"`
+}
+
+// NewTagStore loads the tags at the given path, a missing file results in no
+// user being tagged
+func NewTagStore(path string) (*TagStore, error) {
+	s := &TagStore{
+		path:  path,
+		users: make(map[string]*UserTags),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.lastCheck = time.Now()
+	return s, nil
+}
+
+// Lookup returns the tags attached to the email address
+func (s *TagStore) Lookup(email string) (*UserTags, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloadIfChanged()
+	tags, ok := s.users[normalizeEmail(email)]
+	return tags, ok
+}
+
+// Users returns all tagged users, sorted by email
+func (s *TagStore) Users() []TaggedUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloadIfChanged()
+	list := []TaggedUser{}
+	for email, tags := range s.users {
+		list = append(list, TaggedUser{Email: email, UserTags: *tags})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Email < list[j].Email
+	})
+	return list
+}
+
+// Set replaces the tags attached to the email address
+func (s *TagStore) Set(email string, tags *UserTags) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Make sure changes from elsewhere aren't lost
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	tags.Tags = sortedUnique(tags.Tags)
+	s.users[normalizeEmail(email)] = tags
+	return s.save()
+}
+
+// Delete removes the tags attached to the email address, returning false if
+// there were none
+func (s *TagStore) Delete(email string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return false, err
+	}
+
+	email = normalizeEmail(email)
+	if _, ok := s.users[email]; !ok {
+		return false, nil
+	}
+	delete(s.users, email)
+	return true, s.save()
+}
+
+// reloadIfChanged reloads the tags if the file has been modified, at most
+// every reload interval. Must be called with the lock held
+func (s *TagStore) reloadIfChanged() {
+	if time.Since(s.lastCheck) < userTagsReloadInterval {
+		return
+	}
+	s.lastCheck = time.Now()
+
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return
+	}
+	if err := s.load(); err != nil {
+		log.WithField("error", err).Warn("Error reloading user tags, keeping previous contents")
+	}
+}
+
+// load reads the tags from disk. Must be called with the lock held
+func (s *TagStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var file userTagsFile
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return err
+	}
+	s.users = make(map[string]*UserTags, len(file.Users))
+	for email, tags := range file.Users {
+		s.users[normalizeEmail(email)] = tags
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save atomically writes the tags to disk. Must be called with the lock held
+func (s *TagStore) save() error {
+	b, err := json.MarshalIndent(userTagsFile{
+		SchemaVersion: latestVersion(userTagsMigrations),
+		Users:         s.users,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// lookupUserTags returns the tags attached to the user, if "user-tags" is
+// configured
+func lookupUserTags(email string) (*UserTags, bool) {
+	if userTags == nil {
+		return nil, false
+	}
+	return userTags.Lookup(email)
+}
+
+// ValidateTags checks if the user has one of the tags
+func ValidateTags(email string, tags CommaSeparatedList) bool {
+	entry, ok := lookupUserTags(email)
+	if !ok {
+		return false
+	}
+	for _, tag := range tags {
+		if containsString(entry.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagsBlocked reports whether the user's tags have expired, or include one of
+// the blocked tags
+func tagsBlocked(email string, blocked CommaSeparatedList) bool {
+	entry, ok := lookupUserTags(email)
+	if !ok {
+		return false
+	}
+	if entry.Expired() {
+		return true
+	}
+	for _, tag := range blocked {
+		if containsString(entry.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
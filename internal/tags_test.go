@@ -0,0 +1,147 @@
+package tfa
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestTagStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "tags.json")
+
+	s, err := NewTagStore(path)
+	require.Nil(err)
+	assert.Empty(s.Users())
+
+	// Should tag users by their normalized email
+	require.Nil(s.Set("One@Example.com", &UserTags{Tags: []string{"contractor", "audit", "contractor"}, Note: "contract ends 2025-09-01"}))
+	tags, ok := s.Lookup("one@example.com")
+	require.True(ok)
+	assert.Equal([]string{"audit", "contractor"}, tags.Tags)
+	assert.Equal("contract ends 2025-09-01", tags.Note)
+
+	// Should persist the tags
+	reloaded, err := NewTagStore(path)
+	require.Nil(err)
+	users := reloaded.Users()
+	require.Len(users, 1)
+	assert.Equal("one@example.com", users[0].Email)
+	assert.Equal([]string{"audit", "contractor"}, users[0].Tags)
+
+	// Should remove tags
+	deleted, err := s.Delete("one@example.com")
+	assert.Nil(err)
+	assert.True(deleted)
+	deleted, err = s.Delete("one@example.com")
+	assert.Nil(err)
+	assert.False(deleted)
+	_, ok = s.Lookup("one@example.com")
+	assert.False(ok)
+}
+
+func TestTagStoreReload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "tags.json")
+
+	s, err := NewTagStore(path)
+	require.Nil(err)
+
+	// Should pick up changes made by other instances
+	require.Nil(ioutil.WriteFile(path, []byte(`{"users": {"one@example.com": {"tags": ["staff"]}}}`), 0600))
+	future := time.Now().Add(time.Minute)
+	require.Nil(os.Chtimes(path, future, future))
+	s.lastCheck = time.Time{}
+
+	tags, ok := s.Lookup("one@example.com")
+	require.True(ok)
+	assert.Equal([]string{"staff"}, tags.Tags)
+}
+
+func TestValidateUserTags(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	s, err := NewTagStore(filepath.Join(t.TempDir(), "tags.json"))
+	require.Nil(err)
+	userTags = s
+	defer func() { userTags = nil }()
+	past := time.Now().Add(-time.Hour)
+	require.Nil(s.Set("staff@example.com", &UserTags{Tags: []string{"staff"}}))
+	require.Nil(s.Set("contractor@example.com", &UserTags{Tags: []string{"contractor"}}))
+	require.Nil(s.Set("expired@example.com", &UserTags{Tags: []string{"staff"}, Expires: &past}))
+
+	// Should allow users with an allowed tag
+	config().AllowedTags = []string{"staff"}
+	assert.True(ValidateUser(&provider.User{Email: "staff@example.com"}, "default"))
+	assert.False(ValidateUser(&provider.User{Email: "contractor@example.com"}, "default"))
+	assert.False(ValidateUser(&provider.User{Email: "untagged@example.com"}, "default"))
+
+	// Should refuse users past their expiry
+	assert.False(ValidateUser(&provider.User{Email: "expired@example.com"}, "default"))
+	assert.True(ValidateBlocked("expired@example.com", "default"))
+
+	// Should refuse users with a blocked tag, even if otherwise permitted
+	config().AllowedTags = nil
+	config().Domains = []string{"example.com"}
+	config().Rules = map[string]*Rule{
+		"internal": {BlockedTags: []string{"contractor"}},
+	}
+	assert.True(ValidateUser(&provider.User{Email: "contractor@example.com"}, "default"))
+	assert.False(ValidateUser(&provider.User{Email: "contractor@example.com"}, "internal"))
+	config().BlockedTags = []string{"contractor"}
+	assert.False(ValidateUser(&provider.User{Email: "contractor@example.com"}, "default"))
+	assert.True(ValidateUser(&provider.User{Email: "staff@example.com"}, "internal"))
+
+	// Should parse the rule's tags
+	c, err := NewConfig([]string{
+		"--rule.internal.action=auth",
+		"--rule.internal.rule=Host(`internal.example.com`)",
+		"--rule.internal.allowedTags=staff",
+		"--rule.internal.blockedTags=contractor,intern",
+	})
+	require.Nil(err)
+	assert.Equal(CommaSeparatedList{"staff"}, c.Rules["internal"].AllowedTags)
+	assert.Equal(CommaSeparatedList{"contractor", "intern"}, c.Rules["internal"].BlockedTags)
+}
+
+func TestAuditEventTags(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setConfig(newDefaultConfig())
+	s, err := NewTagStore(filepath.Join(t.TempDir(), "tags.json"))
+	require.Nil(err)
+	userTags = s
+	defer func() { userTags = nil }()
+	require.Nil(s.Set("contractor@example.com", &UserTags{Tags: []string{"contractor"}}))
+
+	path := filepath.Join(tempAuditDir(t), "audit.log")
+	config().AuditFile = path
+	a, err := NewAuditLog(config())
+	require.Nil(err)
+	auditLog = a
+	defer func() { auditLog = nil }()
+
+	auditEvent("access_denied", "", logrus.Fields{"user": "contractor@example.com"})
+	auditEvent("access_denied", "", logrus.Fields{"user": "other@example.com"})
+	a.Close()
+
+	// Should record the tags of tagged users
+	events := readAuditFile(t, path)
+	require.Len(events, 2)
+	assert.Equal([]interface{}{"contractor"}, events[0]["tags"])
+	assert.NotContains(events[1], "tags")
+}
@@ -0,0 +1,63 @@
+package tfa
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+// Tenant isolation
+//
+// Rules with a "tenantClaim" take the user's tenant from that claim, only
+// admit users whose tenant is in the rule's "tenants" (any tenant if unset),
+// and pass the tenant to the backend in the "tenant-header". This lets one
+// multi-tenant backend sit behind a rule per tenant hostname
+
+// userTenant returns the user's tenant for the rule, claims may be strings or
+// numbers
+func userTenant(user *provider.User, rule *Rule) (string, bool) {
+	value, ok := lookupClaim(user.Claims, rule.TenantClaim)
+	if !ok {
+		return "", false
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// ValidateTenant checks the user belongs to one of the rule's tenants, rules
+// without a tenantClaim permit everyone
+func ValidateTenant(user *provider.User, ruleName string) bool {
+	rule, ok := config().Rules[ruleName]
+	if !ok || rule.TenantClaim == "" {
+		return true
+	}
+
+	tenant, ok := userTenant(user, rule)
+	if !ok {
+		return false
+	}
+	if len(rule.Tenants) == 0 {
+		return true
+	}
+	return containsString(rule.Tenants, tenant)
+}
+
+// setTenantHeader passes the user's tenant to the backend, if the rule has one
+func setTenantHeader(w http.ResponseWriter, r *http.Request, user *provider.User, ruleName string) {
+	rule, ok := config().Rules[ruleName]
+	if !ok || rule.TenantClaim == "" {
+		return
+	}
+
+	if tenant, ok := userTenant(user, rule); ok {
+		traceCheck(r, "tenant", tenant)
+		w.Header().Set(config().TenantHeader, tenant)
+	}
+}
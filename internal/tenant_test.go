@@ -0,0 +1,99 @@
+package tfa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thomseddon/traefik-forward-auth/internal/provider"
+)
+
+/**
+ * Tests
+ */
+
+func TestValidateTenant(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"acme": {
+			Action:      "auth",
+			TenantClaim: "org_id",
+			Tenants:     CommaSeparatedList{"acme"},
+		},
+		"any": {
+			Action:      "auth",
+			TenantClaim: "org.id",
+		},
+		"plain": {
+			Action: "auth",
+		},
+	}
+
+	acme := &provider.User{Email: "test@example.com", Claims: map[string]interface{}{"org_id": "acme"}}
+	globex := &provider.User{Email: "test@example.com", Claims: map[string]interface{}{"org_id": "globex"}}
+	none := &provider.User{Email: "test@example.com"}
+
+	// Should only permit the rule's tenants
+	assert.True(ValidateUser(acme, "acme"))
+	assert.False(ValidateUser(globex, "acme"))
+	assert.False(ValidateUser(none, "acme"))
+
+	// Should permit any tenant when the rule has no tenants
+	nested := &provider.User{Claims: map[string]interface{}{"org": map[string]interface{}{"id": float64(42)}}}
+	assert.True(ValidateTenant(nested, "any"))
+	assert.False(ValidateTenant(acme, "any"))
+	tenant, ok := userTenant(nested, config().Rules["any"])
+	assert.True(ok)
+	assert.Equal("42", tenant)
+
+	// Should not apply to other rules
+	assert.True(ValidateUser(none, "plain"))
+	assert.True(ValidateUser(none, "default"))
+
+	// Should not permit tenants that aren't strings or numbers
+	list := &provider.User{Claims: map[string]interface{}{"org_id": []interface{}{"acme"}}}
+	assert.False(ValidateTenant(list, "acme"))
+}
+
+func TestServerTenantHeader(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().Rules = map[string]*Rule{
+		"acme": {
+			Action:      "auth",
+			Rule:        "Host(`acme.example.com`)",
+			Provider:    "google",
+			TenantClaim: "org_id",
+			Tenants:     CommaSeparatedList{"acme"},
+		},
+	}
+
+	// Should keep the tenant claim on the session
+	user := newTestUser("test@example.com")
+	user.Claims = map[string]interface{}{"org_id": "acme", "other": "dropped"}
+	keepCustomClaims(user)
+	assert.Equal(map[string]interface{}{"org_id": "acme"}, user.Claims)
+
+	// Should pass the tenant to the backend
+	req := newHTTPRequest("GET", "https://acme.example.com/foo")
+	c, _ := MakeCookie(req, user)
+	res, _ := doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("acme", res.Header.Get("X-Forwarded-Tenant"))
+
+	// Should reject users of other tenants
+	other := newTestUser("other@example.com")
+	other.Claims = map[string]interface{}{"org_id": "globex"}
+	req = newHTTPRequest("GET", "https://acme.example.com/foo")
+	c, _ = MakeCookie(req, other)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(401, res.StatusCode)
+	assert.Empty(res.Header.Get("X-Forwarded-Tenant"))
+
+	// Should not pass a tenant for other rules
+	req = newHTTPRequest("GET", "https://example.com/foo")
+	c, _ = MakeCookie(req, other)
+	res, _ = doHttpRequest(req, c)
+	assert.Equal(200, res.StatusCode)
+	assert.Empty(res.Header.Get("X-Forwarded-Tenant"))
+}
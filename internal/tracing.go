@@ -0,0 +1,298 @@
+package tfa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing
+//
+// With "tracing-endpoint" set, each request is traced with OpenTelemetry: a
+// span for the request, annotated with the rule and decision for forward auth
+// requests, and a span for each call made to a provider while handling it,
+// such as the token exchange and userinfo request of a login. The trace is
+// continued from the W3C traceparent header traefik sends when its own tracing
+// is enabled, so a slow login can be followed from traefik through to the
+// provider. Spans are batched and sent with OTLP over HTTP, encoded as JSON,
+// which collectors accept without the gRPC and protobuf dependencies
+
+const tracerName = "github.com/thomseddon/traefik-forward-auth"
+
+// tracesPath is where OTLP/HTTP collectors accept traces
+const tracesPath = "/v1/traces"
+
+var tracePropagator = propagation.TraceContext{}
+
+// tracer records nothing unless tracing is configured
+var tracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+
+// tracerProvider is nil when tracing isn't configured
+var tracerProvider *sdktrace.TracerProvider
+
+// NewTracerProvider creates a tracer provider sending spans to the
+// "tracing-endpoint", or nil if it's unset
+func NewTracerProvider(c *Config) (*sdktrace.TracerProvider, error) {
+	if c.TracingEndpoint == "" {
+		return nil, nil
+	}
+
+	exporter, err := newOTLPExporter(c.TracingEndpoint, c.TracingHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []attribute.KeyValue{attribute.String("service.name", c.TracingServiceName)}
+	if c.InstanceID != "" {
+		attrs = append(attrs, attribute.String("service.instance.id", c.InstanceID))
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.TracingSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+	), nil
+}
+
+// setTracerProvider starts tracing with the provider, or stops it if nil
+func setTracerProvider(p *sdktrace.TracerProvider) {
+	tracerProvider = p
+	if p == nil {
+		tracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+	} else {
+		tracer = p.Tracer(tracerName)
+	}
+}
+
+// shutdownTracing sends the spans waiting to be sent, or as many as it can
+// before ctx expires
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.WithField("error", err).Warn("Error sending traces")
+	}
+	setTracerProvider(nil)
+}
+
+// startRequestSpan starts the span of a request, continuing the trace traefik
+// started if it sent a traceparent header
+func startRequestSpan(r *http.Request, handler string) (*http.Request, trace.Span) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, handler,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+		),
+	)
+	if span.IsRecording() {
+		if id := requestID(r); id != "" {
+			span.SetAttributes(attribute.String("request_id", id))
+		}
+		if isForwardedRequest(r, nil) {
+			span.SetAttributes(
+				attribute.String("forwarded.method", r.Header.Get("X-Forwarded-Method")),
+				attribute.String("forwarded.host", r.Header.Get("X-Forwarded-Host")),
+				attribute.String("forwarded.uri", r.Header.Get("X-Forwarded-Uri")),
+			)
+		}
+	}
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan ends the span of a request with the status of its response
+func endRequestSpan(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// traceProviderRequest records a request made to the provider while handling
+// r, which started at start, as a span of r's trace
+func traceProviderRequest(r *http.Request, providerName, operation string, start time.Time, err error) {
+	_, span := tracer.Start(r.Context(), "provider "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("provider", providerName),
+			attribute.String("operation", operation),
+		),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// OTLP exporter
+
+// otlpExporter sends spans to an OTLP/HTTP collector as JSON
+type otlpExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// newOTLPExporter creates an exporter sending spans to the collector, the
+// traces path is added to endpoints without a path
+func newOTLPExporter(endpoint string, headers []string) (*otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("tracing-endpoint must be an absolute http or https URL")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = tracesPath
+	}
+
+	e := &otlpExporter{
+		url:     u.String(),
+		headers: make(map[string]string),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid tracing-header %q, must be in the format name:value", parts[0])
+		}
+		e.headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return e, nil
+}
+
+// ExportSpans sends the spans, which all come from the one tracer
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(otlpTraces(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("tracing collector returned %s", res.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// otlpTraces encodes the spans as an OTLP ExportTraceServiceRequest
+func otlpTraces(spans []sdktrace.ReadOnlySpan) map[string]interface{} {
+	encoded := make([]interface{}, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           s.SpanContext().TraceID().String(),
+			"spanId":            s.SpanContext().SpanID().String(),
+			"name":              s.Name(),
+			"kind":              int(s.SpanKind()),
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime().UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes()),
+		}
+		if s.Parent().IsValid() {
+			span["parentSpanId"] = s.Parent().SpanID().String()
+		}
+
+		var events []interface{}
+		for _, event := range s.Events() {
+			events = append(events, map[string]interface{}{
+				"name":         event.Name,
+				"timeUnixNano": strconv.FormatInt(event.Time.UnixNano(), 10),
+				"attributes":   otlpAttributes(event.Attributes),
+			})
+		}
+		if len(events) > 0 {
+			span["events"] = events
+		}
+
+		// OTLP numbers the status codes differently
+		switch s.Status().Code {
+		case codes.Ok:
+			span["status"] = map[string]interface{}{"code": 1}
+		case codes.Error:
+			span["status"] = map[string]interface{}{"code": 2, "message": s.Status().Description}
+		}
+
+		encoded = append(encoded, span)
+	}
+
+	scope := spans[0].InstrumentationScope()
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(spans[0].Resource().Attributes()),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": scope.Name, "version": scope.Version},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []interface{} {
+	encoded := make([]interface{}, 0, len(attrs))
+	for _, attr := range attrs {
+		encoded = append(encoded, map[string]interface{}{
+			"key":   string(attr.Key),
+			"value": otlpValue(attr.Value),
+		})
+	}
+	return encoded
+}
+
+func otlpValue(v attribute.Value) map[string]interface{} {
+	switch v.Type() {
+	case attribute.BOOL:
+		return map[string]interface{}{"boolValue": v.AsBool()}
+	case attribute.INT64:
+		// 64 bit integers are encoded as strings
+		return map[string]interface{}{"intValue": strconv.FormatInt(v.AsInt64(), 10)}
+	case attribute.FLOAT64:
+		return map[string]interface{}{"doubleValue": v.AsFloat64()}
+	case attribute.STRINGSLICE:
+		var values []interface{}
+		for _, s := range v.AsStringSlice() {
+			values = append(values, map[string]interface{}{"stringValue": s})
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	default:
+		return map[string]interface{}{"stringValue": v.Emit()}
+	}
+}
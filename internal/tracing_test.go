@@ -0,0 +1,179 @@
+package tfa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestTracingRequestSpans(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	collector := newTestCollector()
+	defer collector.Close()
+	config().TracingEndpoint = collector.URL
+	config().TracingHeaders = []string{"X-Api-Key: key"}
+	defer swapTracerProvider(t)()
+
+	// Should continue the trace from traefik's traceparent header
+	h := NewServer().Handler()
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	res := serveRouter(h, req)
+	assert.Equal(307, res.Code)
+
+	// Should trace provider requests made while handling a request
+	req, span := startRequestSpan(req, "Callback")
+	traceProviderRequest(req, "google", "userinfo", time.Now().Add(-time.Second), errors.New("timeout"))
+	endRequestSpan(span, 503)
+
+	require.Nil(t, tracerProvider.ForceFlush(context.Background()))
+	spans := collector.Spans()
+	assert.Equal("/v1/traces", collector.path)
+	assert.Equal("key", collector.apiKey)
+	if assert.Len(spans, 3) {
+		assert.Equal("Root", spans[0]["name"])
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", spans[0]["traceId"])
+		assert.Equal("00f067aa0ba902b7", spans[0]["parentSpanId"])
+		assert.Equal(float64(2), spans[0]["kind"])
+		assert.Contains(spans[0]["attributes"], map[string]interface{}{
+			"key":   "http.status_code",
+			"value": map[string]interface{}{"intValue": "307"},
+		})
+		assert.Contains(spans[0]["attributes"], map[string]interface{}{
+			"key":   "forwarded.host",
+			"value": map[string]interface{}{"stringValue": "example.com"},
+		})
+
+		assert.Equal("provider userinfo", spans[1]["name"])
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", spans[1]["traceId"])
+		assert.Equal(float64(3), spans[1]["kind"])
+		assert.Equal(spans[2]["spanId"], spans[1]["parentSpanId"])
+		assert.Equal(map[string]interface{}{"code": float64(2), "message": "timeout"}, spans[1]["status"])
+
+		assert.Equal("Callback", spans[2]["name"])
+		assert.Equal(map[string]interface{}{"code": float64(2), "message": "Service Unavailable"}, spans[2]["status"])
+	}
+}
+
+func TestTracingDecision(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	collector := newTestCollector()
+	defer collector.Close()
+	config().TracingEndpoint = collector.URL + "/otlp/v1/traces"
+	config().Rules = map[string]*Rule{
+		"1": {
+			Action: "deny",
+			Rule:   "Host(`example.com`)",
+		},
+	}
+	defer swapTracerProvider(t)()
+
+	res := serveRouter(NewServer().Handler(), newDefaultHttpRequest("/foo"))
+	assert.Equal(403, res.Code)
+
+	require.Nil(t, tracerProvider.ForceFlush(context.Background()))
+	spans := collector.Spans()
+	assert.Equal("/otlp/v1/traces", collector.path)
+	if assert.Len(spans, 1) {
+		assert.Contains(spans[0]["attributes"], map[string]interface{}{
+			"key":   "rule",
+			"value": map[string]interface{}{"stringValue": "1"},
+		})
+		assert.Contains(spans[0]["attributes"], map[string]interface{}{
+			"key":   "decision",
+			"value": map[string]interface{}{"stringValue": "deny"},
+		})
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	p, err := NewTracerProvider(config())
+	assert.Nil(err)
+	assert.Nil(p)
+
+	// Should refuse endpoints that aren't http(s) URLs
+	config().TracingEndpoint = "otel-collector:4318"
+	_, err = NewTracerProvider(config())
+	assert.Error(err)
+
+	// Should refuse malformed headers
+	config().TracingEndpoint = "http://otel-collector:4318"
+	config().TracingHeaders = []string{"X-Api-Key"}
+	_, err = NewTracerProvider(config())
+	assert.Error(err)
+}
+
+/**
+ * Utilities
+ */
+
+// testCollector is an OTLP/HTTP collector keeping the spans it's sent
+type testCollector struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	path   string
+	apiKey string
+	spans  []map[string]interface{}
+}
+
+func newTestCollector() *testCollector {
+	c := &testCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{}
+				}
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.path = r.URL.Path
+		c.apiKey = r.Header.Get("X-Api-Key")
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	return c
+}
+
+// Spans returns the spans sent, in the order they ended
+func (c *testCollector) Spans() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.spans
+}
+
+// swapTracerProvider starts tracing with the config, returning a function to
+// stop it again
+func swapTracerProvider(t *testing.T) func() {
+	p, err := NewTracerProvider(config())
+	require.Nil(t, err)
+	setTracerProvider(p)
+	return func() {
+		p.Shutdown(context.Background())
+		setTracerProvider(nil)
+	}
+}
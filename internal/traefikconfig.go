@@ -0,0 +1,206 @@
+package tfa
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Traefik config
+//
+// The print-traefik-config command prints the dynamic configuration traefik
+// needs to use the service: the forward auth middleware, with every header the
+// config passes to backends in its authResponseHeaders, and a router sending
+// requests for the auth host, or the paths providers post to directly, to the
+// service rather than through the middleware. It's printed for the file
+// provider, as docker labels or as kubernetes resources
+
+// TraefikConfigFormats are the formats the traefik config can be printed in
+var TraefikConfigFormats = []string{"file", "docker", "kubernetes"}
+
+// TraefikConfig is the traefik dynamic configuration for the service
+type TraefikConfig struct {
+	// Name is given to the middleware, router and service
+	Name string
+	// URL the service is reached at by traefik
+	URL string
+	// Port the service listens on, for docker and kubernetes services
+	Port int
+
+	// AuthResponseHeaders are the headers passed on to backends
+	AuthResponseHeaders []string
+	// AuthCookies are the cookies set on successful responses, which traefik
+	// must return to the client
+	AuthCookies []string
+	// Rule routes requests to the service directly, empty if none need to be
+	Rule string
+}
+
+// NewTraefikConfig works out the traefik configuration for the config, with
+// the service reached at url, or at http://<name>:<port> if empty
+func NewTraefikConfig(c *Config, name, url string) *TraefikConfig {
+	t := &TraefikConfig{Name: name, URL: url, Port: c.Port}
+	if t.URL == "" {
+		t.URL = fmt.Sprintf("http://%s:%d", name, c.Port)
+	}
+
+	add := func(header string) {
+		header = http.CanonicalHeaderKey(header)
+		if header != "" && !containsString(t.AuthResponseHeaders, header) {
+			t.AuthResponseHeaders = append(t.AuthResponseHeaders, header)
+		}
+	}
+	add("X-Forwarded-User")
+
+	// Header mappings, globally and then by rule in name order
+	specs := append([]string{}, c.Headers...)
+	names := make([]string, 0, len(c.Rules))
+	for name := range c.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		specs = append(specs, c.Rules[name].Headers...)
+	}
+	for _, spec := range specs {
+		if m, err := parseHeaderMapping(spec); err == nil {
+			add(m.header)
+		}
+	}
+	for _, spec := range c.CustomClaims {
+		if claim, err := parseCustomClaim(spec); err == nil {
+			add(claim.header)
+		}
+	}
+
+	if c.JWT {
+		add(c.JWTHeader)
+	}
+	for _, name := range names {
+		if c.Rules[name].SessionHash != "" {
+			add(c.SessionHashHeader)
+		}
+		if c.Rules[name].TenantClaim != "" {
+			add(c.TenantHeader)
+		}
+	}
+	add(c.ForwardedForHeader)
+	add(c.LostSubmissionHeader)
+	add(c.RequestIDHeader)
+
+	// Renewed and extended sessions get a new cookie on an allowed request
+	if c.RenewWindow > 0 || c.SlidingExpiry {
+		t.AuthCookies = append(t.AuthCookies, c.CookieName)
+	}
+
+	if c.AuthHost != "" {
+		t.Rule = fmt.Sprintf("Host(`%s`)", strings.Split(c.AuthHost, ":")[0])
+	} else {
+		var rules []string
+		if c.providerConfigured("saml") {
+			rules = append(rules, fmt.Sprintf("PathPrefix(`%s/saml/`)", c.Path))
+		}
+		if c.SecurityEventsIssuer != "" {
+			rules = append(rules, fmt.Sprintf("Path(`%s%s`)", c.Path, SecurityEventsPath))
+		}
+		t.Rule = strings.Join(rules, " || ")
+	}
+
+	return t
+}
+
+// Write prints the configuration in the format, one of TraefikConfigFormats
+func (t *TraefikConfig) Write(w io.Writer, format string) error {
+	switch format {
+	case "file":
+		t.writeFile(w)
+	case "docker":
+		t.writeDocker(w)
+	case "kubernetes":
+		t.writeKubernetes(w)
+	default:
+		return fmt.Errorf("unknown format %q, must be one of %s", format, strings.Join(TraefikConfigFormats, ", "))
+	}
+	return nil
+}
+
+// writeFile prints YAML for the file provider
+func (t *TraefikConfig) writeFile(w io.Writer) {
+	fmt.Fprintf(w, "http:\n")
+	fmt.Fprintf(w, "  middlewares:\n")
+	fmt.Fprintf(w, "    %s:\n", t.Name)
+	fmt.Fprintf(w, "      forwardAuth:\n")
+	fmt.Fprintf(w, "        address: %s\n", t.URL)
+	writeYAMLList(w, "        ", "authResponseHeaders", t.AuthResponseHeaders)
+	writeYAMLList(w, "        ", "addAuthCookiesToResponse", t.AuthCookies)
+	if t.Rule != "" {
+		fmt.Fprintf(w, "  routers:\n")
+		fmt.Fprintf(w, "    %s:\n", t.Name)
+		fmt.Fprintf(w, "      rule: %q\n", t.Rule)
+		fmt.Fprintf(w, "      service: %s\n", t.Name)
+	}
+	fmt.Fprintf(w, "  services:\n")
+	fmt.Fprintf(w, "    %s:\n", t.Name)
+	fmt.Fprintf(w, "      loadBalancer:\n")
+	fmt.Fprintf(w, "        servers:\n")
+	fmt.Fprintf(w, "          - url: %s\n", t.URL)
+}
+
+// writeDocker prints labels for the service's container
+func (t *TraefikConfig) writeDocker(w io.Writer) {
+	label := func(key, value string) {
+		fmt.Fprintf(w, "- \"traefik.http.%s=%s\"\n", key, value)
+	}
+	middleware := "middlewares." + t.Name + ".forwardauth."
+	label(middleware+"address", t.URL)
+	label(middleware+"authResponseHeaders", strings.Join(t.AuthResponseHeaders, ","))
+	if len(t.AuthCookies) > 0 {
+		label(middleware+"addAuthCookiesToResponse", strings.Join(t.AuthCookies, ","))
+	}
+	if t.Rule != "" {
+		label("routers."+t.Name+".rule", t.Rule)
+	}
+	label("services."+t.Name+".loadbalancer.server.port", fmt.Sprint(t.Port))
+}
+
+// writeKubernetes prints the traefik custom resources, for a kubernetes
+// service with the same name
+func (t *TraefikConfig) writeKubernetes(w io.Writer) {
+	fmt.Fprintf(w, "apiVersion: traefik.containo.us/v1alpha1\n")
+	fmt.Fprintf(w, "kind: Middleware\n")
+	fmt.Fprintf(w, "metadata:\n")
+	fmt.Fprintf(w, "  name: %s\n", t.Name)
+	fmt.Fprintf(w, "spec:\n")
+	fmt.Fprintf(w, "  forwardAuth:\n")
+	fmt.Fprintf(w, "    address: %s\n", t.URL)
+	writeYAMLList(w, "    ", "authResponseHeaders", t.AuthResponseHeaders)
+	writeYAMLList(w, "    ", "addAuthCookiesToResponse", t.AuthCookies)
+	if t.Rule == "" {
+		return
+	}
+	fmt.Fprintf(w, "---\n")
+	fmt.Fprintf(w, "apiVersion: traefik.containo.us/v1alpha1\n")
+	fmt.Fprintf(w, "kind: IngressRoute\n")
+	fmt.Fprintf(w, "metadata:\n")
+	fmt.Fprintf(w, "  name: %s\n", t.Name)
+	fmt.Fprintf(w, "spec:\n")
+	fmt.Fprintf(w, "  routes:\n")
+	fmt.Fprintf(w, "  - match: %s\n", t.Rule)
+	fmt.Fprintf(w, "    kind: Rule\n")
+	fmt.Fprintf(w, "    services:\n")
+	fmt.Fprintf(w, "    - name: %s\n", t.Name)
+	fmt.Fprintf(w, "      port: %d\n", t.Port)
+}
+
+// writeYAMLList prints the values as a YAML list, or nothing if empty
+func writeYAMLList(w io.Writer, indent, key string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s%s:\n", indent, key)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s  - %s\n", indent, value)
+	}
+}
@@ -0,0 +1,115 @@
+package tfa
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestTraefikConfigHeaders(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--header=X-Roles:roles",
+		"--custom-claim=employee_id",
+		"--jwt",
+		"--forwarded-for-header=X-Client-Chain",
+		"--rule.one.action=auth",
+		"--rule.one.rule=Host(`one.example.com`)",
+		"--rule.one.headers=x-team:claim:team",
+		"--rule.one.sessionHash=user",
+		"--rule.two.action=auth",
+		"--rule.two.rule=Host(`two.example.com`)",
+		"--rule.two.headers=X-Roles:roles",
+	})
+	require.Nil(t, err)
+
+	// Should list every header passed to backends once
+	tc := NewTraefikConfig(c, "tfa", "")
+	assert.Equal([]string{
+		"X-Forwarded-User",
+		"X-Roles",
+		"X-Team",
+		"X-Forwarded-Claim-Employee-Id",
+		"X-Forwarded-Jwt",
+		"X-Auth-Session-Hash",
+		"X-Client-Chain",
+		"X-Request-Id",
+	}, tc.AuthResponseHeaders)
+	assert.Equal("http://tfa:4181", tc.URL)
+	assert.Empty(tc.AuthCookies)
+	assert.Empty(tc.Rule)
+}
+
+func TestTraefikConfigWrite(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--auth-host=auth.example.com:8443",
+		"--cookie-domain=example.com",
+		"--renew-window=1h",
+		"--request-id-header=",
+	})
+	require.Nil(t, err)
+	tc := NewTraefikConfig(c, "traefik-forward-auth", "http://auth.internal:4181")
+
+	// Should print config for the file provider
+	var b bytes.Buffer
+	assert.Nil(tc.Write(&b, "file"))
+	assert.Equal(`http:
+  middlewares:
+    traefik-forward-auth:
+      forwardAuth:
+        address: http://auth.internal:4181
+        authResponseHeaders:
+          - X-Forwarded-User
+        addAuthCookiesToResponse:
+          - _forward_auth
+  routers:
+    traefik-forward-auth:
+      rule: "Host(`+"`auth.example.com`"+`)"
+      service: traefik-forward-auth
+  services:
+    traefik-forward-auth:
+      loadBalancer:
+        servers:
+          - url: http://auth.internal:4181
+`, b.String())
+
+	// Should print docker labels
+	b.Reset()
+	assert.Nil(tc.Write(&b, "docker"))
+	assert.Equal(`- "traefik.http.middlewares.traefik-forward-auth.forwardauth.address=http://auth.internal:4181"
+- "traefik.http.middlewares.traefik-forward-auth.forwardauth.authResponseHeaders=X-Forwarded-User"
+- "traefik.http.middlewares.traefik-forward-auth.forwardauth.addAuthCookiesToResponse=_forward_auth"
+- "traefik.http.routers.traefik-forward-auth.rule=Host(`+"`auth.example.com`"+`)"
+- "traefik.http.services.traefik-forward-auth.loadbalancer.server.port=4181"
+`, b.String())
+
+	// Should print kubernetes resources
+	b.Reset()
+	assert.Nil(tc.Write(&b, "kubernetes"))
+	assert.Contains(b.String(), "kind: Middleware\n")
+	assert.Contains(b.String(), "---\n")
+	assert.Contains(b.String(), "kind: IngressRoute\n")
+	assert.Contains(b.String(), "  - match: Host(`auth.example.com`)\n")
+
+	// Should refuse unknown formats
+	assert.Error(tc.Write(&b, "nginx"))
+}
+
+func TestTraefikConfigDirectRoutes(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--security-events-issuer=https://idp.example.com",
+	})
+	require.Nil(t, err)
+
+	// Should route the paths providers post to past the middleware
+	tc := NewTraefikConfig(c, "traefik-forward-auth", "")
+	assert.Equal("Path(`/_oauth/security-events`)", tc.Rule)
+}
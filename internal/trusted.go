@@ -0,0 +1,80 @@
+package tfa
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Trusted networks
+//
+// Requests from the "trusted-ip-networks", or those of the rule, skip
+// authentication entirely, for health checks, cron jobs and monitoring probes
+// that can't log in. The client address is taken from X-Forwarded-For,
+// skipping the entries added by the "trusted-ip-depth" proxies in front of
+// traefik, so clients can't claim a trusted address by sending the header
+// themselves
+
+// parseNetworks parses a list of CIDRs, a bare address is treated as a
+// network of just that address
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range list {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted network %q, must be a CIDR or IP address", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted network %q, must be a CIDR or IP address", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// trustedIP returns the address of the client, skipping the X-Forwarded-For
+// entries added by trusted proxies, or nil if there aren't enough entries
+func trustedIP(r *http.Request) net.IP {
+	chain, ok := forwardedFor(r)
+	if !ok {
+		return nil
+	}
+	return net.ParseIP(chain[0])
+}
+
+// fromTrustedNetwork reports whether the request comes from one of the
+// global or the rule's trusted networks
+func fromTrustedNetwork(r *http.Request, ruleName string) bool {
+	list := config().TrustedIPNetworks
+	if rule, ok := config().Rules[ruleName]; ok {
+		list = append(append(CommaSeparatedList{}, list...), rule.TrustedIPNetworks...)
+	}
+	if len(list) == 0 {
+		return false
+	}
+
+	ip := trustedIP(r)
+	if ip == nil {
+		return false
+	}
+	networks, _ := parseNetworks(list)
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
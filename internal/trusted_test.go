@@ -0,0 +1,123 @@
+package tfa
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestTrustedParseNetworks(t *testing.T) {
+	assert := assert.New(t)
+
+	networks, err := parseNetworks([]string{"10.0.0.0/8", " 192.168.1.10 ", "fd00::/8", "::1"})
+	assert.Nil(err)
+	if assert.Len(networks, 4) {
+		assert.Equal("10.0.0.0/8", networks[0].String())
+		assert.Equal("192.168.1.10/32", networks[1].String())
+		assert.Equal("fd00::/8", networks[2].String())
+		assert.Equal("::1/128", networks[3].String())
+	}
+
+	_, err = parseNetworks([]string{"10.0.0.0/33"})
+	if assert.Error(err) {
+		assert.Equal("invalid trusted network \"10.0.0.0/33\", must be a CIDR or IP address", err.Error())
+	}
+	_, err = parseNetworks([]string{"localhost"})
+	assert.Error(err)
+}
+
+func TestTrustedIP(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should use the address traefik saw
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 172.16.0.1, 192.168.0.1")
+	assert.Equal("192.168.0.1", trustedIP(req).String())
+
+	// Should skip the entries of trusted proxies
+	config().TrustedIPDepth = 1
+	assert.Equal("172.16.0.1", trustedIP(req).String())
+	config().TrustedIPDepth = 3
+	assert.Nil(trustedIP(req))
+
+	// Should fall back to the connecting address
+	req = newDefaultHttpRequest("/foo")
+	req.RemoteAddr = "10.1.2.3:1234"
+	assert.Nil(trustedIP(req))
+	config().TrustedIPDepth = 0
+	assert.Equal("10.1.2.3", trustedIP(req).String())
+}
+
+func TestTrustedNetworksBypass(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().TrustedIPNetworks = CommaSeparatedList{"10.0.0.0/8"}
+	config().Rules = map[string]*Rule{
+		"health": {
+			Action:            "auth",
+			Rule:              "PathPrefix(`/health`)",
+			Provider:          "google",
+			TrustedIPNetworks: CommaSeparatedList{"192.168.0.5"},
+		},
+	}
+
+	// Should allow requests from the global networks
+	req := newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Forwarded-For", "10.2.3.4")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("", res.Header.Get("X-Forwarded-User"))
+
+	// Should not trust addresses the client claims
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Forwarded-For", "10.2.3.4, 203.0.113.1")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+
+	// Should only allow the rule's networks for its requests
+	req = newDefaultHttpRequest("/health")
+	req.Header.Set("X-Forwarded-For", "192.168.0.5")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+
+	req = newDefaultHttpRequest("/foo")
+	req.Header.Set("X-Forwarded-For", "192.168.0.5")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+}
+
+func TestTrustedNetworksConfig(t *testing.T) {
+	assert := assert.New(t)
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	c, _ := NewConfig([]string{
+		"--secret=veryveryverysecret",
+		"--providers.google.client-id=id",
+		"--providers.google.client-secret=secret",
+		"--trusted-ip-networks=10.0.0.0/8,internal",
+		"--trusted-ip-depth=-1",
+		"--rule.health.action=auth",
+		"--rule.health.rule=PathPrefix(`/health`)",
+		"--rule.health.trustedIpNetworks=192.168.0.0/16,192.168.300.1",
+	})
+	assert.Equal(CommaSeparatedList{"192.168.0.0/16", "192.168.300.1"}, c.Rules["health"].TrustedIPNetworks)
+	c.Validate()
+
+	var messages []string
+	for _, entry := range hook.AllEntries() {
+		messages = append(messages, entry.Message)
+	}
+	assert.Equal([]string{
+		"invalid trusted network \"internal\", must be a CIDR or IP address",
+		"\"trusted-ip-depth\" must not be negative",
+		"invalid rule trustedIpNetworks, invalid trusted network \"192.168.300.1\", must be a CIDR or IP address",
+	}, messages)
+}
@@ -0,0 +1,88 @@
+package tfa
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Auth host files
+//
+// When the auth-host is exposed publicly, the service answers /robots.txt and
+// /.well-known/security.txt for it, so the login domain isn't indexed and has
+// a disclosure contact without routing those paths elsewhere
+
+// defaultRobotsTxt asks crawlers not to index the auth host
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// addAuthHostFiles routes the auth host's robots.txt and security.txt
+func (s *Server) addAuthHostFiles() {
+	if config().AuthHost == "" {
+		return
+	}
+
+	robots := config().robotsTxt
+	if robots == nil {
+		robots = []byte(defaultRobotsTxt)
+	}
+	s.router.AddRoute(authHostRule("/robots.txt"), 1, s.TextFileHandler(robots))
+
+	if config().securityTxt != nil {
+		s.router.AddRoute(authHostRule("/.well-known/security.txt"), 1, s.TextFileHandler(config().securityTxt))
+	}
+}
+
+// authHostRule matches the path on the auth host, the mux host matcher is used
+// as in formattedRule
+func authHostRule(path string) string {
+	return fmt.Sprintf("HostRegexp(`%s`) && Path(`%s`)", config().AuthHost, path)
+}
+
+// TextFileHandler serves a fixed plain text file
+func (s *Server) TextFileHandler(body []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write(body)
+	}
+}
+
+// validateSecurityTxt checks the fields required by RFC 9116 are present,
+// warning if the file has expired
+func validateSecurityTxt(b []byte) error {
+	var contact bool
+	var expires string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "contact":
+			contact = true
+		case "expires":
+			expires = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if !contact {
+		return errors.New("must contain a \"Contact\" field")
+	}
+	if expires == "" {
+		return errors.New("must contain an \"Expires\" field")
+	}
+
+	t, err := time.Parse(time.RFC3339, expires)
+	if err != nil {
+		return fmt.Errorf("\"Expires\" must be an RFC 3339 date, e.g. %s", time.Now().AddDate(1, 0, 0).UTC().Format(time.RFC3339))
+	}
+	if t.Before(time.Now()) {
+		log.WithField("expires", expires).Warn("security-txt has expired, update its \"Expires\" field")
+	}
+	return nil
+}
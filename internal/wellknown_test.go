@@ -0,0 +1,97 @@
+package tfa
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestServerAuthHostRobotsTxt(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+
+	// Should require auth without an auth host
+	req := newHTTPRequest("GET", "https://auth.example.com/robots.txt")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+
+	// Should serve the default on the auth host
+	config().AuthHost = "auth.example.com"
+	req = newHTTPRequest("GET", "https://auth.example.com/robots.txt")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal("User-agent: *\nDisallow: /\n", body)
+
+	// Should serve it when traefik passes the allowed request on to the
+	// service, without the forwarded method or uri
+	req = httptest.NewRequest("GET", "https://auth.example.com/robots.txt", nil)
+	req.Header.Set("X-Forwarded-Host", "auth.example.com")
+	res, body = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("User-agent: *\nDisallow: /\n", body)
+
+	// Should not serve it on other hosts
+	req = newHTTPRequest("GET", "https://app.example.com/robots.txt")
+	res, _ = doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+
+	// Should serve the configured file
+	config().robotsTxt = []byte("User-agent: *\nAllow: /\n")
+	req = newHTTPRequest("GET", "https://auth.example.com/robots.txt")
+	res, body = doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("User-agent: *\nAllow: /\n", body)
+}
+
+func TestServerAuthHostSecurityTxt(t *testing.T) {
+	assert := assert.New(t)
+	setConfig(newDefaultConfig())
+	config().AuthHost = "auth.example.com"
+
+	// Should require auth when not configured
+	req := newHTTPRequest("GET", "https://auth.example.com/.well-known/security.txt")
+	res, _ := doHttpRequest(req, nil)
+	assert.Equal(307, res.StatusCode)
+
+	// Should serve the configured file
+	config().securityTxt = []byte("Contact: mailto:security@example.com\n")
+	req = newHTTPRequest("GET", "https://auth.example.com/.well-known/security.txt")
+	res, body := doHttpRequest(req, nil)
+	assert.Equal(200, res.StatusCode)
+	assert.Equal("Contact: mailto:security@example.com\n", body)
+}
+
+func TestValidateSecurityTxt(t *testing.T) {
+	assert := assert.New(t)
+	expires := time.Now().AddDate(1, 0, 0).UTC().Format(time.RFC3339)
+
+	err := validateSecurityTxt([]byte("Contact: mailto:security@example.com\nExpires: " + expires + "\n"))
+	assert.Nil(err)
+
+	// Should require a contact
+	err = validateSecurityTxt([]byte("Expires: " + expires + "\n"))
+	if assert.Error(err) {
+		assert.Equal("must contain a \"Contact\" field", err.Error())
+	}
+
+	// Should require a valid expiry
+	err = validateSecurityTxt([]byte("Contact: https://example.com/security\n"))
+	if assert.Error(err) {
+		assert.Equal("must contain an \"Expires\" field", err.Error())
+	}
+	err = validateSecurityTxt([]byte("Contact: https://example.com/security\nExpires: next year\n"))
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "\"Expires\" must be an RFC 3339 date")
+	}
+
+	// Should allow comments and field names in any case
+	err = validateSecurityTxt([]byte("# Report issues here\ncontact: mailto:security@example.com\nEXPIRES: " + expires + "\n"))
+	assert.Nil(err)
+}